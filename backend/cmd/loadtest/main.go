@@ -0,0 +1,391 @@
+// Command loadtest simulates many editors against a running Lattice server
+// and reports broadcast latency, memory per room and persisted-write
+// throughput.
+//
+// Each simulated client joins one of the rooms and sends small Yjs text
+// inserts at a steady rate, plus occasional awareness (cursor) updates.
+// Every insert carries the time it was sent, so the other clients in the
+// room can measure how long the server took to fan it out.
+//
+// The server's per-IP connection limits will refuse most of the simulated
+// clients; run it with LATTICE_WS_MAX_CONNS_PER_IP=0 and
+// LATTICE_WS_CONNECT_RATE=0 while load testing.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// Marks the inserts this tool sends, so receivers can find the timestamp
+const marker = "lt:"
+
+type options struct {
+	server    string
+	clients   int
+	rooms     int
+	duration  time.Duration
+	rate      float64
+	awareness float64
+	size      int
+	prefix    string
+	secret    string
+	batch     bool
+}
+
+// stats collects results from every client
+type stats struct {
+	sent          atomic.Int64
+	awareness     atomic.Int64
+	received      atomic.Int64
+	connectErrors atomic.Int64
+	sendErrors    atomic.Int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+}
+
+func (s *stats) record(latency time.Duration) {
+	s.mu.Lock()
+	s.latencies = append(s.latencies, latency)
+	s.mu.Unlock()
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.server, "server", "http://localhost:8080", "Base URL of the Lattice server")
+	flag.IntVar(&opts.clients, "clients", 50, "Simulated clients")
+	flag.IntVar(&opts.rooms, "rooms", 5, "Rooms to spread the clients across")
+	flag.DurationVar(&opts.duration, "duration", 30*time.Second, "How long clients send updates")
+	flag.Float64Var(&opts.rate, "rate", 5, "Document updates per second per client")
+	flag.Float64Var(&opts.awareness, "awareness", 2, "Awareness updates per second per client")
+	flag.IntVar(&opts.size, "size", 64, "Characters inserted per update")
+	flag.StringVar(&opts.prefix, "prefix", "loadtest", "Room ID prefix")
+	flag.StringVar(&opts.secret, "secret", "", "Room secret, if the rooms are protected")
+	flag.BoolVar(&opts.batch, "batch", false, "Ask the server to batch queued updates")
+	flag.Parse()
+
+	if opts.clients < 1 || opts.rooms < 1 || opts.rate <= 0 || opts.size < 1 {
+		log.Fatal("-clients, -rooms, -rate and -size must be positive")
+	}
+	if opts.rooms > opts.clients {
+		opts.rooms = opts.clients
+	}
+
+	if err := run(opts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(opts options) error {
+	base, err := url.Parse(strings.TrimSuffix(opts.server, "/"))
+	if err != nil {
+		return fmt.Errorf("invalid -server: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	before, err := fetchStats(base)
+	if err != nil {
+		log.Printf("⚠️  Could not read server stats, reporting latency only: %v", err)
+	}
+
+	var s stats
+	conns := make([]*websocket.Conn, 0, opts.clients)
+	var readers sync.WaitGroup
+	log.Printf("Connecting %d clients to %d rooms...", opts.clients, opts.rooms)
+	for i := 0; i < opts.clients; i++ {
+		conn, err := dial(base, opts, i)
+		if err != nil {
+			s.connectErrors.Add(1)
+			log.Printf("Client %d failed to connect: %v", i, err)
+			continue
+		}
+		conns = append(conns, conn)
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			read(conn, &s)
+		}()
+	}
+	if len(conns) == 0 {
+		return fmt.Errorf("no clients could connect")
+	}
+
+	log.Printf("Sending for %s...", opts.duration)
+	sendCtx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+	start := time.Now()
+	var writers sync.WaitGroup
+	for i, conn := range conns {
+		writers.Add(1)
+		go func(id int, conn *websocket.Conn) {
+			defer writers.Done()
+			write(sendCtx, conn, id, opts, &s)
+		}(i, conn)
+	}
+	writers.Wait()
+	elapsed := time.Since(start)
+
+	// Let in-flight broadcasts arrive and the write-behind buffer flush
+	time.Sleep(2 * time.Second)
+	for _, conn := range conns {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		conn.Close()
+	}
+	readers.Wait()
+
+	var after map[string]interface{}
+	if before != nil {
+		if after, err = fetchStats(base); err != nil {
+			log.Printf("⚠️  Could not read server stats: %v", err)
+		}
+	}
+
+	report(opts, len(conns), elapsed, &s, before, after)
+	return nil
+}
+
+func dial(base *url.URL, opts options, i int) (*websocket.Conn, error) {
+	u := *base
+	u.Scheme = "ws"
+	if base.Scheme == "https" {
+		u.Scheme = "wss"
+	}
+	u.Path += "/ws"
+	query := url.Values{}
+	query.Set("room", fmt.Sprintf("%s-%d", opts.prefix, i%opts.rooms))
+	if opts.secret != "" {
+		query.Set("secret", opts.secret)
+	}
+	query.Set("v", "1")
+	if opts.batch {
+		query.Set("caps", "batch")
+	}
+	u.RawQuery = query.Encode()
+
+	// Offer the wire format the server speaks, as the web client does
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{"lattice-v1"}
+	conn, resp, err := dialer.Dial(u.String(), nil)
+	if err != nil && resp != nil {
+		return nil, fmt.Errorf("%w (HTTP %d)", err, resp.StatusCode)
+	}
+	return conn, err
+}
+
+// Sends inserts and awareness updates until ctx ends
+func write(ctx context.Context, conn *websocket.Conn, id int, opts options, s *stats) {
+	yjsClient := uint64(rand.Uint32())
+	var clock, awarenessClock uint64
+
+	updates := time.NewTicker(time.Duration(float64(time.Second) / opts.rate))
+	defer updates.Stop()
+	var cursors <-chan time.Time
+	if opts.awareness > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.awareness))
+		defer ticker.Stop()
+		cursors = ticker.C
+	}
+
+	for {
+		var message []byte
+		select {
+		case <-ctx.Done():
+			return
+		case <-updates.C:
+			text := insertText(id, opts.size)
+			message = protocol.EncodeUpdate(protocol.EncodeTextInsert(yjsClient, clock, text))
+			clock += uint64(len(text))
+			s.sent.Add(1)
+		case <-cursors:
+			awarenessClock++
+			state := fmt.Sprintf(`{"user":{"name":"load-%d"},"cursor":{"index":%d}}`, id, clock)
+			message = protocol.EncodeAwarenessMessage([]protocol.AwarenessEntry{
+				{ClientID: yjsClient, Clock: awarenessClock, State: state},
+			})
+			s.awareness.Add(1)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+			s.sendErrors.Add(1)
+			return
+		}
+	}
+}
+
+// Reads until the connection closes, timing every insert from another client
+func read(conn *websocket.Conn, s *stats) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		frames := [][]byte{data}
+		if protocol.ParseMessageType(data) == protocol.MessageTypeBatch {
+			if frames, err = protocol.SplitBatch(data); err != nil {
+				continue
+			}
+		}
+		for _, frame := range frames {
+			if sentAt, ok := sentTime(frame); ok {
+				s.received.Add(1)
+				s.record(time.Since(sentAt))
+			}
+		}
+	}
+}
+
+// Text for one insert: the marker, sender and send time, padded to size
+func insertText(id, size int) string {
+	text := fmt.Sprintf("%s%d:%d:", marker, id, time.Now().UnixNano())
+	if pad := size - len(text); pad > 0 {
+		text += strings.Repeat("x", pad)
+	}
+	return text
+}
+
+// Returns the send time written into an insert by insertText
+func sentTime(frame []byte) (time.Time, bool) {
+	payload, ok := protocol.UpdatePayload(frame)
+	if !ok {
+		return time.Time{}, false
+	}
+	i := bytes.Index(payload, []byte(marker))
+	if i < 0 {
+		return time.Time{}, false
+	}
+	fields := strings.SplitN(string(payload[i+len(marker):]), ":", 3)
+	if len(fields) < 3 {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+func fetchStats(base *url.URL) (map[string]interface{}, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(base.String() + "/api/stats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /api/stats: HTTP %d", resp.StatusCode)
+	}
+
+	var stats map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Reads a number from decoded stats JSON by dotted path
+func number(stats map[string]interface{}, path string) (float64, bool) {
+	var value interface{} = stats
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		value = object[key]
+	}
+	n, ok := value.(float64)
+	return n, ok
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+func report(opts options, connected int, elapsed time.Duration, s *stats, before, after map[string]interface{}) {
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+
+	// Each insert should reach every other client in its room
+	perRoom := float64(connected) / float64(opts.rooms)
+	expected := float64(s.sent.Load()) * (perRoom - 1)
+
+	fmt.Println()
+	fmt.Printf("Clients:           %d connected, %d failed, in %d rooms\n", connected, s.connectErrors.Load(), opts.rooms)
+	fmt.Printf("Duration:          %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Updates sent:      %d (%.1f/s), plus %d awareness\n",
+		s.sent.Load(), float64(s.sent.Load())/elapsed.Seconds(), s.awareness.Load())
+	if expected > 0 {
+		fmt.Printf("Updates received:  %d of ~%.0f expected (%.1f%%)\n",
+			s.received.Load(), expected, 100*float64(s.received.Load())/expected)
+	}
+	if errors := s.sendErrors.Load(); errors > 0 {
+		fmt.Printf("Send errors:       %d\n", errors)
+	}
+
+	fmt.Println()
+	fmt.Println("Broadcast latency:")
+	for _, p := range []float64{50, 95, 99} {
+		fmt.Printf("  p%-2.0f  %s\n", p, percentile(s.latencies, p).Round(time.Microsecond))
+	}
+	if len(s.latencies) > 0 {
+		fmt.Printf("  max  %s\n", s.latencies[len(s.latencies)-1].Round(time.Microsecond))
+	}
+
+	if before == nil || after == nil {
+		return
+	}
+
+	fmt.Println()
+	fmt.Println("Server:")
+	if heapBefore, ok := number(before, "memory.heap_alloc_bytes"); ok {
+		heapAfter, _ := number(after, "memory.heap_alloc_bytes")
+		fmt.Printf("  Heap growth per room:     %s\n", formatBytes((heapAfter-heapBefore)/float64(opts.rooms)))
+	}
+	if rooms, ok := number(after, "memory.loaded_rooms"); ok && rooms > 0 {
+		updateBytes, _ := number(after, "memory.room_update_bytes")
+		fmt.Printf("  Update bytes per room:    %s (%.0f rooms loaded)\n", formatBytes(updateBytes/rooms), rooms)
+	}
+	if updatesBefore, ok := number(before, "write_behind.written"); ok {
+		updatesAfter, _ := number(after, "write_behind.written")
+		fmt.Printf("  Persisted writes:         %.0f (%.1f/s)\n",
+			updatesAfter-updatesBefore, (updatesAfter-updatesBefore)/elapsed.Seconds())
+	}
+}
+
+func formatBytes(n float64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", n/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", n/(1<<10))
+	default:
+		return fmt.Sprintf("%.0f B", n)
+	}
+}
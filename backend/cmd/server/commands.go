@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/api"
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// Cancelled on SIGINT or SIGTERM so long-running commands stop cleanly
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printMigrationVersion(database *db.Database) error {
+	statuses, err := database.MigrationStatus(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to read migration status: %w", err)
+	}
+	fmt.Printf("Database schema is at migration %d\n", statuses[len(statuses)-1].Version)
+	return nil
+}
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	status := fs.Bool("status", false, "list migrations and when they were applied")
+	down := fs.Int("down", -1, "revert migrations newer than this version (0 reverts all)")
+	fs.Parse(args)
+
+	database, _, err := openDatabase(true)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	switch {
+	case *status:
+		statuses, err := database.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return tw.Flush()
+
+	case *down >= 0:
+		n, err := database.MigrateDown(ctx, *down)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reverted %d migrations\n", n)
+		return nil
+
+	default:
+		n, err := database.Migrate(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migrations\n", n)
+		// Older snapshots stay readable, but rewriting them now spares
+		// compaction from it later
+		migrated, err := compaction.MigrateSnapshots(ctx, database)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rewrote %d snapshots in format %d\n", migrated, compaction.CurrentFormat)
+		return printMigrationVersion(database)
+	}
+}
+
+// Safe to run next to the server: compaction rewrites how a document is
+// stored, never its content
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	roomID := fs.String("room", "", "compact only this room, even if it is under the threshold")
+	fs.Parse(args)
+
+	database, _, err := openDatabase(false)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	service := compaction.New(database, compactionConfigFromEnv())
+	if *roomID != "" {
+		result, err := service.CompactNow(ctx, *roomID)
+		if err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, result)
+	}
+	return printJSON(os.Stdout, service.RunNow(ctx))
+}
+
+func runExportRoom(args []string) error {
+	fs := flag.NewFlagSet("export-room", flag.ExitOnError)
+	roomID := fs.String("room", "", "room to export (required)")
+	out := fs.String("o", "", "write to this file instead of stdout")
+	fs.Parse(args)
+
+	if *roomID == "" {
+		fs.Usage()
+		return errors.New("-room is required")
+	}
+
+	database, _, err := openDatabase(false)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	export, err := api.ExportRoom(ctx, database, *roomID)
+	if err != nil {
+		return err
+	}
+	if export == nil {
+		return fmt.Errorf("room %q not found", *roomID)
+	}
+
+	if *out == "" {
+		return printJSON(os.Stdout, export)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(f, export); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func runImportRoom(args []string) error {
+	fs := flag.NewFlagSet("import-room", flag.ExitOnError)
+	in := fs.String("i", "", "read from this file instead of stdin")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var export api.RoomExportData
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return fmt.Errorf("invalid export: %w", err)
+	}
+	if export.Room.ID == "" {
+		return errors.New("invalid export: room.id is missing")
+	}
+
+	database, _, err := openDatabase(false)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	if err := api.ImportRoom(ctx, database, &export); err != nil {
+		return fmt.Errorf("importing room %q: %w", export.Room.ID, err)
+	}
+	fmt.Printf("Imported room %s with %d updates and %d versions\n", export.Room.ID, len(export.Updates), len(export.Versions))
+	return nil
+}
+
+func runCreateAPIKey(args []string) error {
+	fs := flag.NewFlagSet("create-api-key", flag.ExitOnError)
+	name := fs.String("name", "", "what the key is for (required)")
+	fs.Parse(args)
+
+	if *name == "" {
+		fs.Usage()
+		return errors.New("-name is required")
+	}
+
+	database, _, err := openDatabase(false)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	key, info, err := database.CreateAPIKey(context.Background(), *name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Created API key %d (%s). It is shown only once; admin endpoints now require it.\n", info.ID, info.Name)
+	fmt.Println(key)
+	return nil
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	fs.Parse(args)
+
+	database, _, err := openDatabase(false)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	stats, err := database.GetStats(ctx)
+	if err != nil {
+		return err
+	}
+	storage, err := database.GetStorageBytes(ctx)
+	if err != nil {
+		return err
+	}
+	stats["storage_bytes"] = storage
+	versions, err := database.GetVersionStorage(ctx)
+	if err != nil {
+		return err
+	}
+	stats["versions"] = versions
+	return printJSON(os.Stdout, stats)
+}
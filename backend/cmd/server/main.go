@@ -1,103 +1,153 @@
+// Command lattice-server runs the Lattice backend and its maintenance tasks.
+// Run it without a command, or with "serve", to start the server; see
+// "lattice-server help" for the rest. Every command reads the same LATTICE_*
+// environment variables as the server.
 package main
 
 import (
+	"fmt"
 	"log"
-	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/manpreetbhatti/lattice/backend/internal/api"
 	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
 	"github.com/manpreetbhatti/lattice/backend/internal/db"
-	"github.com/manpreetbhatti/lattice/backend/internal/ws"
 )
 
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "[-migrate-only]", "Run the server (the default command)", runServe},
+	{"migrate", "[-status | -down N]", "Apply pending migrations, list them, or revert to version N", runMigrate},
+	{"compact", "[-room ID]", "Compact one room, or every room over the threshold", runCompact},
+	{"export-room", "-room ID [-o FILE]", "Write a room, its document, versions and join secret hash as JSON", runExportRoom},
+	{"import-room", "[-i FILE]", "Recreate a room from export-room JSON", runImportRoom},
+	{"migrate-room", "-from URL -to URL -room ID", "Move a room from one running server to another", runMigrateRoom},
+	{"create-api-key", "-name NAME", "Create a key for the admin API and print it", runCreateAPIKey},
+	{"stats", "", "Print room, update and storage totals as JSON", runStats},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: lattice-server [command] [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-15s %-27s %s\n", c.name, c.usage, c.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, `Run "lattice-server <command> -h" for a command's flags.`)
+}
+
 func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage()
+		return
+	}
+	for _, c := range commands {
+		if c.name == name {
+			if err := c.run(args); err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+// Opens the database configured by the environment. Migrations run unless
+// skipMigrations is set, for commands that manage them explicitly.
+func openDatabase(skipMigrations bool) (*db.Database, string, error) {
 	dbPath := os.Getenv("LATTICE_DB_PATH")
 	if dbPath == "" {
 		dbPath = "./data/lattice.db"
 	}
 
-	database, err := db.New(dbPath)
+	dbConfig := db.DefaultConfig()
+	dbConfig.MaxOpenConns = envInt("LATTICE_DB_MAX_OPEN_CONNS", dbConfig.MaxOpenConns)
+	dbConfig.MaxIdleConns = envInt("LATTICE_DB_MAX_IDLE_CONNS", dbConfig.MaxIdleConns)
+	dbConfig.ConnMaxLifetime = envDuration("LATTICE_DB_CONN_MAX_LIFETIME", dbConfig.ConnMaxLifetime)
+	dbConfig.BusyTimeout = envDuration("LATTICE_DB_BUSY_TIMEOUT", dbConfig.BusyTimeout)
+	dbConfig.BusyRetries = envInt("LATTICE_DB_BUSY_RETRIES", dbConfig.BusyRetries)
+	dbConfig.WALAutoCheckpoint = envInt("LATTICE_DB_WAL_AUTOCHECKPOINT", dbConfig.WALAutoCheckpoint)
+	dbConfig.SkipMigrations = skipMigrations
+
+	database, err := db.NewWithConfig(dbPath, dbConfig)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		return nil, "", fmt.Errorf("failed to initialize database: %w", err)
 	}
-	defer database.Close()
-
-	hub := ws.NewHub(database)
-	go hub.Run()
-
-	compactionService := compaction.New(database, compaction.DefaultConfig())
-	compactionService.Start()
-
-	apiHandler := api.New(hub, database)
-
-	// WebSocket endpoint
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		ws.ServeWs(hub, w, r)
-	})
-
-	http.HandleFunc("/health", apiHandler.HealthHandler)
-	http.HandleFunc("/api/stats", apiHandler.StatsHandler)
-	http.HandleFunc("/api/rooms", apiHandler.RoomsRouter)
-	http.HandleFunc("/api/rooms/", apiHandler.RoomsRouter)
-	http.HandleFunc("/api/versions", apiHandler.VersionsRouter)
-	http.HandleFunc("/api/versions/", apiHandler.VersionsRouter)
-	http.HandleFunc("/api/ai/", apiHandler.AIRouter)
-
-	// Apply CORS middleware
-	handler := corsMiddleware(http.DefaultServeMux)
-
-	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigChan
-
-		log.Println("Shutting down server...")
-		compactionService.Stop()
-		hub.Stop()
-		database.Close()
-		os.Exit(0)
-	}()
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	return database, dbPath, nil
+}
+
+func compactionConfigFromEnv() compaction.Config {
+	config := compaction.DefaultConfig()
+	config.Interval = envDuration("LATTICE_COMPACTION_INTERVAL", config.Interval)
+	config.UpdateThreshold = envInt("LATTICE_COMPACTION_THRESHOLD", config.UpdateThreshold)
+	config.KeepRecentUpdates = envInt("LATTICE_COMPACTION_KEEP_RECENT", config.KeepRecentUpdates)
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid compaction config: %v", err)
 	}
+	return config
+}
 
-	log.Printf("🌸 Lattice server starting on :%s", port)
-	log.Printf("📁 Database: %s", dbPath)
-	log.Println("Endpoints:")
-	log.Println("  - WebSocket: /ws?room={roomId}")
-	log.Println("  - Health:    GET /health")
-	log.Println("  - Stats:     GET /api/stats")
-	log.Println("  - Rooms:     GET/POST /api/rooms")
-	log.Println("  - Room:      GET/DELETE /api/rooms/{id}")
-	log.Println("  - Versions:  GET/POST /api/versions")
-	log.Println("  - Version:   GET/DELETE /api/versions/{id}")
-	log.Println("  - Diff:      GET /api/versions/diff?from=X&to=Y")
-	log.Println("  - Restore:   POST /api/versions/{id}/restore")
-	log.Println("  - AI Complete:  POST /api/ai/complete")
-	log.Println("  - AI Explain:   POST /api/ai/explain")
-	log.Println("  - AI Refactor:  POST /api/ai/refactor")
-
-	if err := http.ListenAndServe(":"+port, handler); err != nil {
-		log.Fatal("ListenAndServe: ", err)
+func envDuration(key string, defaultVal time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultVal
 	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return d
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+func envInt(key string, defaultVal int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultVal
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return n
+}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+func envFloat(key string, defaultVal float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultVal
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return f
+}
 
-		next.ServeHTTP(w, r)
-	})
+func envBool(key string, defaultVal bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultVal
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return b
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/api"
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+// Moves a room between two running servers through their HTTP APIs: the
+// room is locked on the source so no edit is lost, its archive is streamed
+// straight into the target's import, and the source copy is then deleted.
+// If anything fails before the import succeeds the source is unlocked and
+// left as it was.
+func runMigrateRoom(args []string) error {
+	fs := flag.NewFlagSet("migrate-room", flag.ExitOnError)
+	from := fs.String("from", "", "base URL of the server holding the room (required)")
+	to := fs.String("to", "", "base URL of the server to move it to (required)")
+	roomID := fs.String("room", "", "room to move (required)")
+	fromKey := fs.String("from-key", os.Getenv("LATTICE_API_KEY"), "API key for the source server (default $LATTICE_API_KEY)")
+	toKey := fs.String("to-key", os.Getenv("LATTICE_API_KEY"), "API key for the target server (default $LATTICE_API_KEY)")
+	lockTTL := fs.Duration("lock-ttl", time.Minute, "how long the source stays locked if this command dies part way")
+	keepSource := fs.Bool("keep-source", false, "unlock the source room afterwards instead of deleting it")
+	fs.Parse(args)
+
+	if *from == "" || *to == "" || *roomID == "" {
+		fs.Usage()
+		return errors.New("-from, -to and -room are required")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	source := &apiClient{base: strings.TrimSuffix(*from, "/"), key: *fromKey}
+	target := &apiClient{base: strings.TrimSuffix(*to, "/"), key: *toKey}
+	roomPath := "/api/rooms/" + url.PathEscape(*roomID)
+	lockPath := "/api/admin/rooms/" + url.PathEscape(*roomID) + "/lock"
+
+	if _, err := source.do(ctx, "PUT", lockPath+"?ttl="+lockTTL.String(), "", nil); err != nil {
+		return fmt.Errorf("locking room on %s: %w", source.base, err)
+	}
+	unlock := func() {
+		// The command's context may be what failed
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := source.do(ctx, "DELETE", lockPath, "", nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to unlock room on %s, it unlocks within %v: %v\n", source.base, *lockTTL, err)
+		}
+	}
+
+	archive, err := source.do(ctx, "GET", roomPath+"/archive", "", nil)
+	if err != nil {
+		unlock()
+		return fmt.Errorf("downloading room from %s: %w", source.base, err)
+	}
+	defer archive.Close()
+
+	created, err := target.do(ctx, "POST", "/api/rooms/import?id="+url.QueryEscape(*roomID), api.ArchiveContentType, archive)
+	if err != nil {
+		unlock()
+		return fmt.Errorf("importing room into %s: %w", target.base, err)
+	}
+	created.Close()
+
+	if *keepSource {
+		unlock()
+		fmt.Printf("Copied room %s from %s to %s\n", *roomID, source.base, target.base)
+		return nil
+	}
+	deleted, err := source.do(ctx, "DELETE", roomPath, "", nil)
+	if err != nil {
+		return fmt.Errorf("room copied, but deleting it from %s failed (it stays locked until the lock expires): %w", source.base, err)
+	}
+	deleted.Close()
+	fmt.Printf("Moved room %s from %s to %s\n", *roomID, source.base, target.base)
+	return nil
+}
+
+// A Lattice server's HTTP API, authenticated with an admin API key
+type apiClient struct {
+	base string
+	key  string
+}
+
+// Sends a request and returns the body of a 2xx response, which the caller
+// must close. Other responses are returned as errors carrying the server's
+// message.
+func (c *apiClient) do(ctx context.Context, method, path, contentType string, body io.Reader) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+
+	var apiErr apierror.Error
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&apiErr); err != nil || apiErr.Message == "" {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return nil, fmt.Errorf("%s %s: %s: %s (%s)", method, path, resp.Status, apiErr.Message, apiErr.Code)
+}
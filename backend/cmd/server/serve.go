@@ -0,0 +1,684 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/admin"
+	"github.com/manpreetbhatti/lattice/backend/internal/api"
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
+	"github.com/manpreetbhatti/lattice/backend/internal/clientip"
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	"github.com/manpreetbhatti/lattice/backend/internal/embeddings"
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+	"github.com/manpreetbhatti/lattice/backend/internal/exporter"
+	"github.com/manpreetbhatti/lattice/backend/internal/listen"
+	"github.com/manpreetbhatti/lattice/backend/internal/metrics"
+	"github.com/manpreetbhatti/lattice/backend/internal/notify"
+	"github.com/manpreetbhatti/lattice/backend/internal/origin"
+	"github.com/manpreetbhatti/lattice/backend/internal/sandbox"
+	"github.com/manpreetbhatti/lattice/backend/internal/shard"
+	"github.com/manpreetbhatti/lattice/backend/internal/stats"
+	"github.com/manpreetbhatti/lattice/backend/internal/telemetry"
+	"github.com/manpreetbhatti/lattice/backend/internal/tracing"
+	"github.com/manpreetbhatti/lattice/backend/internal/webui"
+	"github.com/manpreetbhatti/lattice/backend/internal/ws"
+)
+
+// Runs the HTTP and WebSocket server until SIGINT or SIGTERM
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	migrateOnly := fs.Bool("migrate-only", false, "apply pending database migrations and exit")
+	fs.Parse(args)
+
+	database, dbPath, err := openDatabase(false)
+	if err != nil {
+		return err
+	}
+	if *migrateOnly {
+		defer database.Close()
+		return printMigrationVersion(database)
+	}
+
+	if envBool("LATTICE_STARTUP_CHECK", true) {
+		if err := checkConsistency(database, envBool("LATTICE_STARTUP_REPAIR", false)); err != nil {
+			log.Printf("Error checking database consistency: %v", err)
+		}
+	}
+	if envBool("LATTICE_MIGRATE_SNAPSHOTS", true) {
+		migrated, err := compaction.MigrateSnapshots(context.Background(), database)
+		if err != nil {
+			log.Printf("Error migrating snapshots: %v", err)
+		} else if migrated > 0 {
+			log.Printf("🗜️ Rewrote %d snapshots in format %d", migrated, compaction.CurrentFormat)
+		}
+	}
+
+	// Spans follow edits from the WebSocket through fan-out to the write
+	// that persists them, so tracing starts before anything that records one
+	tracer := tracerFromEnv()
+	if tracer != nil {
+		tracing.SetDefault(tracer)
+	}
+
+	hubConfig := ws.DefaultHubConfig()
+	hubConfig.WriteBehind.FlushInterval = envDuration("LATTICE_WRITE_FLUSH_INTERVAL", hubConfig.WriteBehind.FlushInterval)
+	hubConfig.WriteBehind.MaxBatch = envInt("LATTICE_WRITE_BATCH_SIZE", hubConfig.WriteBehind.MaxBatch)
+	hubConfig.IdleTimeout = envDuration("LATTICE_WS_IDLE_TIMEOUT", hubConfig.IdleTimeout)
+	hubConfig.StopTimeout = envDuration("LATTICE_HUB_STOP_TIMEOUT", hubConfig.StopTimeout)
+	hubConfig.MaxRoomBytes = int64(envInt("LATTICE_ROOM_MAX_BYTES", int(hubConfig.MaxRoomBytes)))
+	hubConfig.MaxResidentBytes = int64(envInt("LATTICE_ROOM_MEMORY_BYTES", int(hubConfig.MaxResidentBytes)))
+	hubConfig.StrictRooms = envBool("LATTICE_STRICT_ROOMS", hubConfig.StrictRooms)
+	hubConfig.RoomIDs.MaxLength = envInt("LATTICE_ROOM_ID_MAX_LENGTH", hubConfig.RoomIDs.MaxLength)
+	if pattern := os.Getenv("LATTICE_ROOM_ID_PATTERN"); pattern != "" {
+		if hubConfig.RoomIDs.Pattern, err = regexp.Compile(pattern); err != nil {
+			log.Fatalf("Invalid LATTICE_ROOM_ID_PATTERN: %v", err)
+		}
+	}
+	if err := hubConfig.RoomIDs.Validate(); err != nil {
+		log.Fatalf("Invalid room ID config: %v", err)
+	}
+	// Shared by CORS and the WebSocket upgrader, which CORS doesn't cover
+	origins, err := origin.Parse(os.Getenv("LATTICE_ALLOWED_ORIGINS"))
+	if err != nil {
+		log.Fatalf("Invalid LATTICE_ALLOWED_ORIGINS: %v", err)
+	}
+	hubConfig.Origins = origins
+	if !origins.Any() {
+		log.Printf("🌐 Allowing browser origins %s", os.Getenv("LATTICE_ALLOWED_ORIGINS"))
+	}
+	hubConfig.ConnectionLimits.MaxPerIP = envInt("LATTICE_WS_MAX_CONNS_PER_IP", hubConfig.ConnectionLimits.MaxPerIP)
+	hubConfig.ConnectionLimits.RatePerMinute = envInt("LATTICE_WS_CONNECT_RATE", hubConfig.ConnectionLimits.RatePerMinute)
+	hubConfig.ConnectionLimits.Burst = envInt("LATTICE_WS_CONNECT_BURST", hubConfig.ConnectionLimits.Burst)
+
+	hub := ws.NewHubWithConfig(database, hubConfig)
+
+	// Shared by the hub and the API for GET /api/events
+	eventBroker := events.NewBroker()
+	hub.SetEventPublisher(eventBroker)
+
+	// Without a configured key guest tokens are only valid until restart
+	guestIssuer := auth.NewIssuer([]byte(os.Getenv("LATTICE_AUTH_SECRET")), envDuration("LATTICE_GUEST_TOKEN_TTL", auth.DefaultGuestTTL))
+	hub.SetIdentityVerifier(guestIssuer)
+
+	// Each instance serves the rooms the ring gives it and sends sessions
+	// for the others to their owner
+	if spec := os.Getenv("LATTICE_SHARD_NODES"); spec != "" {
+		nodes, err := shard.ParseNodes(spec)
+		if err != nil {
+			log.Fatalf("Invalid LATTICE_SHARD_NODES: %v", err)
+		}
+		ring, err := shard.NewRing(nodes, os.Getenv("LATTICE_SHARD_SELF"), shard.DefaultReplicas)
+		if err != nil {
+			log.Fatalf("Invalid shard config: %v", err)
+		}
+		hub.SetRoomRouter(ring)
+		log.Printf("🧩 Serving shard %s of %d", ring.Self().ID, len(nodes))
+	}
+
+	compactionConfig := compactionConfigFromEnv()
+
+	var compactionService *compaction.Service
+	if envBool("LATTICE_COMPACTION_ENABLED", true) {
+		compactionService = compaction.New(database, compactionConfig)
+		compactionService.Start()
+		hub.SetCompactionNotifier(compactionService)
+		compactionService.SetListener(hub)
+	} else {
+		log.Println("🗜️ Compaction disabled")
+	}
+
+	statsConfig := stats.DefaultConfig()
+	statsConfig.Interval = envDuration("LATTICE_STATS_INTERVAL", statsConfig.Interval)
+	statsConfig.Retention = envDuration("LATTICE_STATS_RETENTION", statsConfig.Retention)
+	if err := statsConfig.Validate(); err != nil {
+		log.Fatalf("Invalid stats config: %v", err)
+	}
+	statsSampler := stats.New(database, hub, statsConfig)
+	statsSampler.Start()
+
+	// Truncates the WAL while writes pause, since automatic checkpoints
+	// never shrink it
+	var checkpointer *db.Checkpointer
+	if envBool("LATTICE_DB_CHECKPOINT_ENABLED", true) {
+		checkpointConfig := db.DefaultCheckpointConfig()
+		checkpointConfig.Interval = envDuration("LATTICE_DB_CHECKPOINT_INTERVAL", checkpointConfig.Interval)
+		checkpointConfig.Idle = envDuration("LATTICE_DB_CHECKPOINT_IDLE", checkpointConfig.Idle)
+		checkpointConfig.MinBytes = int64(envInt("LATTICE_DB_CHECKPOINT_MIN_BYTES", int(checkpointConfig.MinBytes)))
+		if err := checkpointConfig.Validate(); err != nil {
+			log.Fatalf("Invalid checkpoint config: %v", err)
+		}
+		checkpointer = db.NewCheckpointer(database, checkpointConfig)
+	}
+
+	var exportService *exporter.Service
+	if destination := os.Getenv("LATTICE_EXPORT_DESTINATION"); destination != "" {
+		exportConfig := exporter.DefaultConfig()
+		exportConfig.Destination = destination
+		exportConfig.Interval = envDuration("LATTICE_EXPORT_INTERVAL", exportConfig.Interval)
+		if format := os.Getenv("LATTICE_EXPORT_FORMAT"); format != "" {
+			exportConfig.Format = format
+		}
+		exportConfig.GitPush = envBool("LATTICE_EXPORT_GIT_PUSH", false)
+		exportConfig.S3 = exporter.S3Config{
+			Region:          os.Getenv("AWS_REGION"),
+			Endpoint:        os.Getenv("LATTICE_EXPORT_S3_ENDPOINT"),
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if exportService, err = exporter.New(database, exportConfig); err != nil {
+			log.Fatalf("Invalid export config: %v", err)
+		}
+		exportService.Start()
+	}
+
+	var gitMirror *exporter.Mirror
+	if repo := os.Getenv("LATTICE_GIT_MIRROR"); repo != "" {
+		mirrorConfig := exporter.DefaultMirrorConfig()
+		mirrorConfig.Repo = repo
+		mirrorConfig.Interval = envDuration("LATTICE_GIT_MIRROR_INTERVAL", mirrorConfig.Interval)
+		mirrorConfig.Push = envBool("LATTICE_GIT_MIRROR_PUSH", false)
+		if gitMirror, err = exporter.NewMirror(database, mirrorConfig); err != nil {
+			log.Fatalf("Invalid git mirror config: %v", err)
+		}
+		gitMirror.Start()
+	}
+
+	notifyConfig := notify.DefaultConfig()
+	notifyConfig.SlackWebhookURL = os.Getenv("LATTICE_SLACK_WEBHOOK_URL")
+	notifyConfig.DiscordWebhookURL = os.Getenv("LATTICE_DISCORD_WEBHOOK_URL")
+	notifyConfig.UserThreshold = envInt("LATTICE_NOTIFY_USER_THRESHOLD", notifyConfig.UserThreshold)
+	notifyConfig.PublicURL = os.Getenv("LATTICE_PUBLIC_URL")
+
+	var notifier *notify.Notifier
+	if notifyConfig.Enabled() {
+		if notifier, err = notify.New(eventBroker, notifyConfig); err != nil {
+			log.Fatalf("Invalid notification config: %v", err)
+		}
+		notifier.Start()
+	}
+
+	var telemetryCollector *telemetry.Collector
+	if envBool("LATTICE_TELEMETRY", false) {
+		telemetryConfig := telemetry.DefaultConfig()
+		telemetryConfig.Endpoint = os.Getenv("LATTICE_TELEMETRY_ENDPOINT")
+		telemetryConfig.ReportInterval = envDuration("LATTICE_TELEMETRY_INTERVAL", telemetryConfig.ReportInterval)
+		if telemetryCollector, err = telemetry.New(eventBroker, hub, telemetryConfig); err != nil {
+			log.Fatalf("Invalid telemetry config: %v", err)
+		}
+		telemetryCollector.Start()
+	}
+
+	metricsConfig := metrics.DefaultConfig()
+	metricsConfig.TopRooms = envInt("LATTICE_METRICS_TOP_ROOMS", metricsConfig.TopRooms)
+	metricsConfig.Interval = envDuration("LATTICE_METRICS_INTERVAL", metricsConfig.Interval)
+	metricsCollector, err := metrics.New(hub, metricsConfig)
+	if err != nil {
+		log.Fatalf("Invalid metrics config: %v", err)
+	}
+	metricsCollector.Start()
+
+	go hub.Run()
+
+	basePath, err := basePathFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid LATTICE_BASE_PATH: %v", err)
+	}
+
+	apiHandler := api.New(hub, database)
+	apiHandler.SetBasePath(basePath)
+	apiHandler.SetGuestIssuer(guestIssuer)
+	apiHandler.SetEventBroker(eventBroker)
+	if telemetryCollector != nil {
+		apiHandler.SetTelemetry(telemetryCollector)
+	}
+	apiHandler.SetMetrics(metricsCollector)
+	apiHandler.SetMaxVersionBytes(envInt("LATTICE_VERSION_MAX_BYTES", api.DefaultMaxVersionBytes))
+	timeouts := api.DefaultTimeouts()
+	timeouts.Request = envDuration("LATTICE_REQUEST_TIMEOUT", timeouts.Request)
+	timeouts.AI = envDuration("LATTICE_AI_TIMEOUT", timeouts.AI)
+	timeouts.Admin = envDuration("LATTICE_ADMIN_TIMEOUT", timeouts.Admin)
+	apiHandler.SetTimeouts(timeouts)
+	bodyLimits := api.DefaultBodyLimits()
+	bodyLimits.Request = int64(envInt("LATTICE_BODY_MAX_BYTES", int(bodyLimits.Request)))
+	bodyLimits.Versions = int64(envInt("LATTICE_VERSION_BODY_MAX_BYTES", int(bodyLimits.Versions)))
+	bodyLimits.AI = int64(envInt("LATTICE_AI_BODY_MAX_BYTES", int(bodyLimits.AI)))
+	bodyLimits.Updates = int64(envInt("LATTICE_UPDATES_BODY_MAX_BYTES", int(bodyLimits.Updates)))
+	apiHandler.SetBodyLimits(bodyLimits)
+	autoSave := api.DefaultAutoSavePolicy()
+	autoSave.Interval = envDuration("LATTICE_AUTOSAVE_INTERVAL", autoSave.Interval)
+	autoSave.MinChanges = envInt("LATTICE_AUTOSAVE_MIN_CHANGES", autoSave.MinChanges)
+	autoSave.Keep = envInt("LATTICE_AUTOSAVE_KEEP", autoSave.Keep)
+	apiHandler.SetAutoSavePolicy(autoSave)
+	aiConfig := api.DefaultAIProviderConfig()
+	for _, name := range strings.Split(os.Getenv("LATTICE_AI_PROVIDERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			aiConfig.Order = append(aiConfig.Order, name)
+		}
+	}
+	aiConfig.AttemptTimeout = envDuration("LATTICE_AI_PROVIDER_TIMEOUT", aiConfig.AttemptTimeout)
+	aiConfig.FailureThreshold = envInt("LATTICE_AI_FAILURE_THRESHOLD", aiConfig.FailureThreshold)
+	aiConfig.Cooldown = envDuration("LATTICE_AI_COOLDOWN", aiConfig.Cooldown)
+	if err := apiHandler.SetAIProviderConfig(aiConfig); err != nil {
+		log.Fatalf("Invalid AI provider config: %v", err)
+	}
+	if compactionService != nil {
+		apiHandler.SetCompactionService(compactionService)
+	}
+	if gitMirror != nil {
+		apiHandler.AddVersionNotifier(gitMirror)
+	}
+
+	var embeddingIndex *embeddings.Index
+	if provider := os.Getenv("LATTICE_EMBEDDINGS_PROVIDER"); provider != "" {
+		embeddingConfig := embeddings.DefaultConfig()
+		embeddingConfig.Provider = provider
+		embeddingConfig.Model = os.Getenv("LATTICE_EMBEDDINGS_MODEL")
+		embeddingConfig.OpenAIKey = os.Getenv("OPENAI_API_KEY")
+		if ollamaURL := os.Getenv("OLLAMA_URL"); ollamaURL != "" {
+			embeddingConfig.OllamaURL = ollamaURL
+		}
+		if embeddingIndex, err = embeddings.New(database, embeddingConfig); err != nil {
+			log.Fatalf("Invalid embeddings config: %v", err)
+		}
+		embeddingIndex.Start()
+		apiHandler.SetEmbeddingIndex(embeddingIndex)
+		apiHandler.AddVersionNotifier(embeddingIndex)
+	}
+
+	if backend := os.Getenv("LATTICE_SANDBOX_BACKEND"); backend != "" {
+		sandboxConfig := sandbox.DefaultConfig()
+		sandboxConfig.Backend = backend
+		sandboxConfig.Runtime = os.Getenv("LATTICE_SANDBOX_RUNTIME")
+		if languages := os.Getenv("LATTICE_SANDBOX_LANGUAGES"); languages != "" {
+			sandboxConfig.Languages = nil
+			for _, name := range strings.Split(languages, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					sandboxConfig.Languages = append(sandboxConfig.Languages, name)
+				}
+			}
+		}
+		sandboxConfig.Timeout = envDuration("LATTICE_SANDBOX_TIMEOUT", sandboxConfig.Timeout)
+		sandboxConfig.MemoryBytes = int64(envInt("LATTICE_SANDBOX_MEMORY_BYTES", int(sandboxConfig.MemoryBytes)))
+		sandboxConfig.CPUs = envFloat("LATTICE_SANDBOX_CPUS", sandboxConfig.CPUs)
+		sandboxConfig.Pids = envInt("LATTICE_SANDBOX_PIDS", sandboxConfig.Pids)
+		sandboxConfig.MaxOutputBytes = envInt("LATTICE_SANDBOX_MAX_OUTPUT_BYTES", sandboxConfig.MaxOutputBytes)
+		sandboxConfig.MaxConcurrent = envInt("LATTICE_SANDBOX_MAX_CONCURRENT", sandboxConfig.MaxConcurrent)
+		runner, err := sandbox.New(sandboxConfig)
+		if err != nil {
+			log.Fatalf("Invalid sandbox config: %v", err)
+		}
+		apiHandler.SetSandbox(runner)
+		log.Printf("📦 Code execution enabled (%s: %s)", backend, strings.Join(runner.Languages(), ", "))
+	}
+
+	var autoSummarizer *api.AutoSummarizer
+	if envBool("LATTICE_AI_AUTO_SUMMARIZE", false) {
+		autoSummarizer = apiHandler.NewAutoSummarizer()
+		autoSummarizer.Start()
+		apiHandler.AddVersionNotifier(autoSummarizer)
+	}
+
+	mux := http.NewServeMux()
+
+	// WebSocket endpoint
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		ws.ServeWs(hub, w, r)
+	})
+
+	// Shared terminals for pairing, beside the document
+	mux.HandleFunc("/ws/terminal", func(w http.ResponseWriter, r *http.Request) {
+		ws.ServeTerminal(hub, w, r)
+	})
+
+	// SSE fallback transport for networks that block WebSockets
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		ws.ServeSSE(hub, w, r)
+	})
+	mux.HandleFunc("POST /events", func(w http.ResponseWriter, r *http.Request) {
+		ws.ServeSSEPost(hub, w, r)
+	})
+
+	if envBool("LATTICE_ADMIN_UI", true) {
+		mux.Handle("GET /admin/", admin.Handler())
+		mux.Handle("GET /admin", http.RedirectHandler(basePath+"/admin/", http.StatusMovedPermanently))
+	}
+
+	// REST API, and the frontend when this binary serves it, so no separate
+	// web server is needed. The frontend then takes over / and leaves the
+	// API its own paths.
+	apiRoutes := apiHandler.Routes()
+	if ui := webUIFromEnv(); ui != nil {
+		mux.Handle("/api/", apiRoutes)
+		mux.Handle("/health", apiRoutes)
+		mux.Handle("/metrics", apiRoutes)
+		mux.Handle("/", webui.Handler(ui, basePath))
+	} else {
+		mux.Handle("/", apiRoutes)
+	}
+
+	// Behind a reverse proxy, take the client address from forwarding
+	// headers so limits, bans and logs see the real client
+	proxies, err := clientip.Parse(os.Getenv("LATTICE_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Invalid LATTICE_TRUSTED_PROXIES: %v", err)
+	}
+	if proxies.Enabled() {
+		log.Printf("🔀 Trusting forwarding headers from %s", os.Getenv("LATTICE_TRUSTED_PROXIES"))
+	}
+
+	// Apply CORS middleware
+	handler := proxies.Middleware(corsMiddleware(origins, withBasePath(basePath, mux)))
+
+	// HTTP/2 lets the editor's parallel API calls share one connection. It
+	// comes with TLS; in cleartext only the trusted proxies, which terminate
+	// TLS in front of the server, may speak it.
+	certFile, keyFile := os.Getenv("LATTICE_TLS_CERT"), os.Getenv("LATTICE_TLS_KEY")
+	if (certFile == "") != (keyFile == "") {
+		log.Fatal("LATTICE_TLS_CERT and LATTICE_TLS_KEY must be set together")
+	}
+	if envBool("LATTICE_H2C", false) {
+		if !proxies.Enabled() {
+			log.Fatal("LATTICE_H2C needs LATTICE_TRUSTED_PROXIES to name the proxies that speak it")
+		}
+		handler = listen.H2C(handler, proxies.TrustsPeer)
+		log.Println("⚡ Accepting cleartext HTTP/2 from trusted proxies")
+	}
+
+	listener, address, err := listen.Listen(listenConfigFromEnv())
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	log.Printf("🌸 Lattice server starting on %s", address)
+	if basePath != "" {
+		log.Printf("📂 Serving under %s/", basePath)
+	}
+	log.Printf("📁 Database: %s", dbPath)
+	log.Println("Endpoints:")
+	log.Printf("  - WebSocket: %s/ws?room={roomId}", basePath)
+	log.Printf("  - Events:    GET %s/events?room={roomId}, POST %s/events?session={id}", basePath, basePath)
+	log.Printf("  - Health:    GET %s/health", basePath)
+	log.Printf("  - OpenAPI:   GET %s/api/openapi.json", basePath)
+	log.Printf("  - Stats:     GET %s/api/stats", basePath)
+	log.Printf("  - History:   GET %s/api/stats/history?range=24h&step=5m", basePath)
+	log.Printf("  - Rooms:     GET/POST %s/api/rooms", basePath)
+	log.Printf("  - Room:      GET/DELETE %s/api/rooms/{id}", basePath)
+	log.Printf("  - Updates:   POST %s/api/rooms/{id}/updates", basePath)
+	log.Printf("  - Secret:    PUT/DELETE %s/api/rooms/{id}/join-secret", basePath)
+	log.Printf("  - Bulk:      POST %s/api/rooms/bulk", basePath)
+	log.Printf("  - Versions:  GET/POST %s/api/rooms/{id}/versions", basePath)
+	log.Printf("  - Version:   GET/DELETE %s/api/versions/{id}", basePath)
+	log.Printf("  - Diff:      GET %s/api/versions/diff?from=X&to=Y", basePath)
+	log.Printf("  - Restore:   POST %s/api/versions/{id}/restore", basePath)
+	log.Printf("  - Guest:     POST %s/api/auth/guest", basePath)
+	log.Printf("  - AI Complete:  POST %s/api/ai/complete", basePath)
+	log.Printf("  - AI Explain:   POST %s/api/ai/explain", basePath)
+	log.Printf("  - AI Refactor:  POST %s/api/ai/refactor", basePath)
+	log.Printf("  - Event feed:   GET %s/api/events?room={roomId}&type={types}", basePath)
+	log.Printf("  - Verify:       POST %s/api/admin/verify?room={roomId}", basePath)
+	log.Printf("  - Compact:      POST %s/api/admin/compact?room_id={roomId}", basePath)
+	log.Printf("  - Compaction:   GET %s/api/admin/compaction", basePath)
+	log.Printf("  - Connections:  GET %s/api/admin/connections", basePath)
+	log.Printf("  - Kick:         POST %s/api/admin/rooms/{id}/kick", basePath)
+	log.Printf("  - Notice:       POST %s/api/admin/rooms/{id}/notice", basePath)
+	log.Printf("  - Dashboard:    GET %s/admin/", basePath)
+
+	server := &http.Server{Handler: handler}
+	shutdownDone := make(chan struct{})
+
+	go func() {
+		defer close(shutdownDone)
+
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		<-sigChan
+
+		log.Println("Shutting down server...")
+		hub.AnnounceShutdown("server is shutting down", 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("HTTP shutdown error: %v", err)
+		}
+	}()
+
+	if certFile != "" {
+		err = server.ServeTLS(listener, certFile, keyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal("Serve: ", err)
+	}
+	<-shutdownDone
+
+	// Stop writers before the database: the stats sampler, exports and
+	// compaction first, then the hub so buffered updates are flushed, then
+	// the checkpointer so the WAL is left truncated, and the database. The
+	// tracer goes last to export the spans of that final flush.
+	if notifier != nil {
+		notifier.Stop()
+	}
+	if telemetryCollector != nil {
+		telemetryCollector.Stop()
+	}
+	metricsCollector.Stop()
+	if autoSummarizer != nil {
+		autoSummarizer.Stop()
+	}
+	if embeddingIndex != nil {
+		embeddingIndex.Stop()
+	}
+	statsSampler.Stop()
+	if exportService != nil {
+		exportService.Stop()
+	}
+	if gitMirror != nil {
+		gitMirror.Stop()
+	}
+	if compactionService != nil {
+		compactionService.Stop()
+	}
+	hub.Stop()
+	if checkpointer != nil {
+		checkpointer.Close()
+	}
+	if err := database.Close(); err != nil {
+		log.Printf("Error closing database: %v", err)
+	}
+	if tracer != nil {
+		tracer.Shutdown()
+	}
+	log.Println("Server stopped")
+	return nil
+}
+
+// Reports rows left behind by deleted rooms, deleting them when repair is
+// set, and snapshots whose update count has drifted from their content
+func checkConsistency(database *db.Database, repair bool) error {
+	ctx := context.Background()
+
+	orphans, err := database.FindOrphanedRooms(ctx)
+	if err != nil {
+		return err
+	}
+	for _, o := range orphans {
+		log.Printf("⚠️ Room %s no longer exists but has %d updates, %d snapshots and %d versions", o.RoomID, o.Updates, o.Snapshots, o.Versions)
+	}
+	if len(orphans) > 0 {
+		if repair {
+			removed, err := database.DeleteOrphanedRows(ctx)
+			if err != nil {
+				return err
+			}
+			log.Printf("🧹 Deleted %d rows of %d missing rooms", removed, len(orphans))
+		} else {
+			log.Printf("⚠️ %d missing rooms still have stored rows; set LATTICE_STARTUP_REPAIR=true to delete them", len(orphans))
+		}
+	}
+
+	drift, err := compaction.CheckSnapshots(ctx, database)
+	if err != nil {
+		return err
+	}
+	for _, d := range drift {
+		if d.UnknownFormat {
+			log.Printf("⚠️ Snapshot of room %s is in unknown format %d", d.RoomID, d.Format)
+			continue
+		}
+		log.Printf("⚠️ Snapshot of room %s records %d updates but holds %d (%d trailing bytes)", d.RoomID, d.RecordedCount, d.StoredCount, d.TrailingBytes)
+	}
+	return nil
+}
+
+// LATTICE_LISTEN names a TCP address or unix:// socket; without it the
+// server listens on PORT
+func listenConfigFromEnv() listen.Config {
+	config := listen.DefaultConfig()
+	if port := os.Getenv("PORT"); port != "" {
+		config.Address = ":" + port
+	}
+	if address := os.Getenv("LATTICE_LISTEN"); address != "" {
+		config.Address = address
+	}
+	if mode := os.Getenv("LATTICE_SOCKET_MODE"); mode != "" {
+		parsed, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			log.Fatalf("Invalid LATTICE_SOCKET_MODE %q: want octal permissions such as 0660", mode)
+		}
+		config.SocketMode = fs.FileMode(parsed)
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid listen config: %v", err)
+	}
+	return config
+}
+
+// Reads LATTICE_BASE_PATH, the prefix the server is mounted under behind a
+// shared reverse proxy, as "/name" without a trailing slash; empty serves
+// from the root
+func basePathFromEnv() (string, error) {
+	basePath := strings.Trim(strings.TrimSpace(os.Getenv("LATTICE_BASE_PATH")), "/")
+	if basePath == "" {
+		return "", nil
+	}
+	basePath = "/" + basePath
+	if u, err := url.Parse(basePath); err != nil || u.Path != basePath || strings.Contains(basePath, "//") {
+		return "", fmt.Errorf("%q is not a plain path such as /lattice", basePath)
+	}
+	return basePath, nil
+}
+
+// Serves next under basePath with the prefix stripped, so handlers see
+// the paths they were registered with. The bare prefix redirects to the
+// prefix with a slash, and anything outside it is not found.
+func withBasePath(basePath string, next http.Handler) http.Handler {
+	if basePath == "" {
+		return next
+	}
+	mux := http.NewServeMux()
+	mux.Handle(basePath+"/", http.StripPrefix(basePath, next))
+	mux.Handle(basePath, http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, http.StatusNotFound, apierror.NotFound, "Not found", nil)
+	})
+	return mux
+}
+
+// Returns the frontend to serve: the directory in LATTICE_WEB_DIR, else the
+// one built into the binary. Nil when there is none or LATTICE_WEB_UI is
+// false.
+func webUIFromEnv() fs.FS {
+	if !envBool("LATTICE_WEB_UI", true) {
+		return nil
+	}
+	if dir := os.Getenv("LATTICE_WEB_DIR"); dir != "" {
+		if _, err := os.Stat(filepath.Join(dir, "index.html")); err != nil {
+			log.Fatalf("Invalid LATTICE_WEB_DIR: %v", err)
+		}
+		log.Printf("🖥️ Serving the frontend from %s", dir)
+		return os.DirFS(dir)
+	}
+	if ui := webui.Embedded(); ui != nil {
+		log.Println("🖥️ Serving the embedded frontend")
+		return ui
+	}
+	return nil
+}
+
+// Reads the standard OpenTelemetry exporter variables. Tracing stays off
+// unless an OTLP endpoint is set.
+func tracerFromEnv() *tracing.Tracer {
+	config := tracing.DefaultConfig()
+	config.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if config.Endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		config.Endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if headers := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"); headers != "" {
+		config.Headers = make(map[string]string)
+		for _, pair := range strings.Split(headers, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				log.Fatalf("Invalid OTEL_EXPORTER_OTLP_HEADERS: %q is not key=value", pair)
+			}
+			config.Headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		config.ServiceName = name
+	}
+	config.SampleRatio = envFloat("OTEL_TRACES_SAMPLER_ARG", config.SampleRatio)
+
+	tracer, err := tracing.New(config)
+	if err != nil {
+		log.Fatalf("Invalid tracing config: %v", err)
+	}
+	log.Printf("🔭 Exporting traces to %s (sampling %v)", config.Endpoint, config.SampleRatio)
+	return tracer
+}
+
+// Lets pages from allowed origins call the API. Other origins get no
+// Access-Control-Allow-Origin, so browsers keep the responses from them.
+func corsMiddleware(origins *origin.Allowlist, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origins.Any() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Add("Vary", "Origin")
+			if requestOrigin := r.Header.Get("Origin"); requestOrigin != "" && origins.Allowed(requestOrigin) {
+				w.Header().Set("Access-Control-Allow-Origin", requestOrigin)
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Room-Secret, X-Identity-Token, Idempotency-Key, If-Match, traceparent")
+		w.Header().Set("Access-Control-Expose-Headers", "Idempotent-Replayed")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
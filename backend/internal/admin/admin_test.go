@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	handler := Handler()
+
+	tests := []struct {
+		path        string
+		contentType string
+	}{
+		{"/admin/", "text/html"},
+		{"/admin/app.js", "text/javascript"},
+		{"/admin/style.css", "text/css"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType) {
+				t.Errorf("Expected content type %s, got %s", tt.contentType, ct)
+			}
+			if w.Header().Get("Content-Security-Policy") == "" {
+				t.Error("Expected a Content-Security-Policy header")
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/missing.js", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing file, got %d", w.Code)
+	}
+}
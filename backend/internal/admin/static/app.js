@@ -0,0 +1,272 @@
+// Lattice admin dashboard. Everything goes through the REST API; the API key,
+// once entered, is kept in sessionStorage and sent as a bearer token.
+(() => {
+  'use strict';
+
+  const REFRESH_MS = 5000;
+  const KEY_STORAGE = 'lattice-admin-key';
+  // The server may be mounted under a prefix such as /lattice
+  const BASE = location.pathname.replace(/\/admin\/.*$/, '');
+
+  const $ = (id) => document.getElementById(id);
+  let selectedRoom = null;
+  let timer = null;
+
+  class Unauthorized extends Error {}
+
+  async function api(path, options = {}) {
+    const headers = { ...(options.headers || {}) };
+    const key = sessionStorage.getItem(KEY_STORAGE);
+    if (key) headers.Authorization = `Bearer ${key}`;
+    if (options.body) headers['Content-Type'] = 'application/json';
+
+    const res = await fetch(BASE + path, { ...options, headers });
+    if (res.status === 401) throw new Unauthorized();
+
+    const data = await res.json().catch(() => null);
+    if (!res.ok) {
+      // A disabled compaction service is not an error for the overview
+      if (res.status === 503 && data && data.code === 'SERVICE_UNAVAILABLE') return null;
+      throw new Error((data && data.message) || `${res.status} ${res.statusText}`);
+    }
+    return data;
+  }
+
+  function formatBytes(n) {
+    if (!n) return '0 B';
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    const i = Math.min(Math.floor(Math.log(n) / Math.log(1024)), units.length - 1);
+    return `${(n / 1024 ** i).toFixed(i ? 1 : 0)} ${units[i]}`;
+  }
+
+  function formatTime(value) {
+    if (!value) return '–';
+    return new Date(value).toLocaleString();
+  }
+
+  function formatDuration(seconds) {
+    if (seconds < 60) return `${Math.round(seconds)}s`;
+    if (seconds < 3600) return `${Math.round(seconds / 60)}m`;
+    return `${(seconds / 3600).toFixed(1)}h`;
+  }
+
+  function cell(text) {
+    const td = document.createElement('td');
+    td.textContent = text;
+    return td;
+  }
+
+  function button(label, onClick, className) {
+    const b = document.createElement('button');
+    b.type = 'button';
+    b.textContent = label;
+    if (className) b.className = className;
+    b.addEventListener('click', onClick);
+    return b;
+  }
+
+  function fill(tbody, rows, columns, emptyText) {
+    tbody.replaceChildren();
+    if (rows.length === 0) {
+      const tr = document.createElement('tr');
+      tr.className = 'empty';
+      const td = cell(emptyText);
+      td.colSpan = columns;
+      tr.append(td);
+      tbody.append(tr);
+      return;
+    }
+    tbody.append(...rows);
+  }
+
+  function showError(err) {
+    $('error').textContent = err ? err.message : '';
+    $('error').hidden = !err;
+  }
+
+  function needKey() {
+    $('key-form').hidden = false;
+    $('key-input').focus();
+  }
+
+  async function action(fn) {
+    try {
+      await fn();
+      showError(null);
+    } catch (err) {
+      if (err instanceof Unauthorized) needKey();
+      else showError(err);
+    }
+    refresh();
+  }
+
+  const compactRoom = (id) => action(() =>
+    api(`/api/admin/compact?room_id=${encodeURIComponent(id)}`, { method: 'POST' }));
+
+  const archiveRoom = (id) => {
+    if (!confirm(`Archive room "${id}"? It will be hidden from room listings.`)) return;
+    action(async () => {
+      const result = await api('/api/rooms/bulk', {
+        method: 'POST',
+        body: JSON.stringify({ action: 'archive', room_ids: [id] }),
+      });
+      if (result.failed > 0) throw new Error(result.results[0].error);
+      if (selectedRoom === id) closeDetail();
+    });
+  };
+
+  const kickClient = (roomId, clientId) => {
+    if (!confirm(`Disconnect ${clientId}? The client may reconnect.`)) return;
+    action(() => api(`/api/admin/rooms/${encodeURIComponent(roomId)}/kick`, {
+      method: 'POST',
+      body: JSON.stringify({ client_id: clientId }),
+    }));
+  };
+
+  const banClient = (roomId, clientId) => {
+    const duration = prompt(`Ban ${clientId}'s IP from "${roomId}" for how long?`, '1h');
+    if (!duration) return;
+    action(() => api(`/api/admin/rooms/${encodeURIComponent(roomId)}/kick`, {
+      method: 'POST',
+      body: JSON.stringify({ client_id: clientId, ban_duration: duration, ban_by: 'ip' }),
+    }));
+  };
+
+  function renderStats(stats, compaction) {
+    $('active-rooms').textContent = stats.active_rooms;
+    $('active-clients').textContent = stats.active_clients;
+    $('total-rooms').textContent = stats.total_rooms ?? '–';
+    $('total-updates').textContent = stats.total_updates ?? '–';
+
+    if (!compaction) {
+      $('storage').textContent = '–';
+      $('compaction').textContent = 'Compaction disabled';
+      $('compact-all').disabled = true;
+      return;
+    }
+    const bytes = compaction.rooms.reduce((sum, r) => sum + r.update_bytes + r.snapshot_bytes, 0);
+    $('storage').textContent = formatBytes(bytes);
+    $('compaction').textContent = compaction.last_run
+      ? `${formatTime(compaction.last_run)} (${compaction.last_compacted} rooms, every ${compaction.interval})`
+      : `Not yet run (every ${compaction.interval})`;
+    $('compact-all').disabled = false;
+  }
+
+  function renderRooms(rooms, compaction) {
+    const storage = new Map((compaction ? compaction.rooms : []).map((r) => [r.room_id, r]));
+    const rows = rooms.map((room) => {
+      const s = storage.get(room.id);
+      const tr = document.createElement('tr');
+
+      const name = document.createElement('td');
+      name.append(button(room.name ? `${room.name} (${room.id})` : room.id, () => openDetail(room.id), 'link'));
+      tr.append(
+        name,
+        cell(room.active_users),
+        cell(s ? s.update_count : 0),
+        cell(s ? formatBytes(s.update_bytes + s.snapshot_bytes) : '–'),
+        cell(formatTime(room.updated_at)),
+      );
+
+      const actions = document.createElement('td');
+      actions.className = 'actions';
+      const compact = button('Compact', () => compactRoom(room.id));
+      compact.disabled = !compaction;
+      actions.append(compact, ' ', button('Archive', () => archiveRoom(room.id), 'danger'));
+      tr.append(actions);
+      return tr;
+    });
+    fill($('rooms'), rows, 6, 'No rooms');
+  }
+
+  function renderConnections(connections) {
+    connections.sort((a, b) => a.room_id.localeCompare(b.room_id) || a.connected_at.localeCompare(b.connected_at));
+    const rows = connections.map((c) => {
+      const tr = document.createElement('tr');
+      const who = c.identity && c.identity.name ? `${c.identity.name} (${c.client_id})` : c.client_id;
+      const actions = document.createElement('td');
+      actions.className = 'actions';
+      actions.append(button('Kick', () => kickClient(c.room_id, c.client_id), 'danger'));
+      actions.append(button('Ban', () => banClient(c.room_id, c.client_id), 'danger'));
+      tr.append(
+        cell(who),
+        cell(c.room_id),
+        cell(c.remote_addr),
+        cell(formatTime(c.connected_at)),
+        cell(formatDuration(c.idle_seconds)),
+        cell(`${c.messages_in} / ${c.messages_out}`),
+        cell(c.lagging ? `${c.queued} (lagging)` : String(c.queued)),
+        actions,
+      );
+      return tr;
+    });
+    fill($('connections'), rows, 8, 'No connected clients');
+  }
+
+  async function renderDetail() {
+    if (!selectedRoom) return;
+    const data = await api(`/api/rooms/${encodeURIComponent(selectedRoom)}/versions?limit=10`);
+    const rows = data.versions.map((v) => {
+      const tr = document.createElement('tr');
+      tr.append(cell(v.name), cell(v.created_by || '–'), cell(formatTime(v.created_at)), cell(v.is_auto ? 'auto' : 'manual'));
+      return tr;
+    });
+    fill($('versions'), rows, 4, 'No saved versions');
+  }
+
+  function openDetail(id) {
+    selectedRoom = id;
+    $('detail-room').textContent = id;
+    $('room-detail').hidden = false;
+    action(renderDetail);
+  }
+
+  function closeDetail() {
+    selectedRoom = null;
+    $('room-detail').hidden = true;
+  }
+
+  async function refresh() {
+    clearTimeout(timer);
+    try {
+      const [stats, rooms, compaction, connections] = await Promise.all([
+        api('/api/stats'),
+        api('/api/rooms?limit=100&sort=updated_at'),
+        api('/api/admin/compaction'),
+        api('/api/admin/connections'),
+      ]);
+      renderStats(stats, compaction);
+      renderRooms(rooms.rooms, compaction);
+      renderConnections(connections.connections);
+      await renderDetail();
+
+      $('key-form').hidden = true;
+      $('forget-key').hidden = !sessionStorage.getItem(KEY_STORAGE);
+      $('updated').textContent = `Updated ${new Date().toLocaleTimeString()}`;
+      showError(null);
+    } catch (err) {
+      if (err instanceof Unauthorized) {
+        needKey();
+        return; // Wait for a key before polling again
+      }
+      showError(err);
+    }
+    timer = setTimeout(refresh, REFRESH_MS);
+  }
+
+  $('key-form').addEventListener('submit', (e) => {
+    e.preventDefault();
+    sessionStorage.setItem(KEY_STORAGE, $('key-input').value.trim());
+    $('key-input').value = '';
+    refresh();
+  });
+  $('forget-key').addEventListener('click', () => {
+    sessionStorage.removeItem(KEY_STORAGE);
+    refresh();
+  });
+  $('refresh').addEventListener('click', refresh);
+  $('compact-all').addEventListener('click', () => action(() => api('/api/admin/compact', { method: 'POST' })));
+  $('close-detail').addEventListener('click', closeDetail);
+
+  refresh();
+})();
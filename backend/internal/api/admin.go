@@ -0,0 +1,282 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	"github.com/manpreetbhatti/lattice/backend/internal/ws"
+)
+
+// VerifyHandler checks stored updates for corruption, quarantining bad blobs.
+// With ?room=X only that room is verified; otherwise every room is.
+func (a *API) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if roomID := r.URL.Query().Get("room"); roomID != "" {
+		report, err := a.database.VerifyRoom(r.Context(), roomID)
+		if err != nil {
+			log.Printf("Verification failed for room %s: %v", roomID, err)
+			errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to verify room")
+			return
+		}
+
+		affected := 0
+		if report.Affected() {
+			affected = 1
+		}
+
+		jsonResponse(w, http.StatusOK, map[string]interface{}{
+			"checked_rooms":  1,
+			"affected_rooms": affected,
+			"rooms":          []interface{}{report},
+		})
+		return
+	}
+
+	reports, checked, err := a.database.VerifyAllRooms(r.Context())
+	if err != nil {
+		log.Printf("Verification failed: %v", err)
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to verify rooms")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"checked_rooms":  checked,
+		"affected_rooms": len(reports),
+		"rooms":          reports,
+	})
+}
+
+// Rough per-row cost of a document_updates row beyond its payload (rowid,
+// room_id, timestamp, checksum and index entry), minus the 4-byte length
+// prefix each update gains inside a snapshot
+const estimatedRowOverheadBytes = 48
+
+// RoomCompactionStats is one room's entry in the compaction report
+type RoomCompactionStats struct {
+	db.RoomStorage
+	ReclaimableUpdates  int   `json:"reclaimable_updates"`
+	EstimatedBytesSaved int64 `json:"estimated_bytes_saved"`
+	Eligible            bool  `json:"eligible"` // Meets the automatic threshold
+}
+
+// CompactHandler forces compaction of one room (?room_id=X) or runs a full
+// pass over all rooms immediately
+func (a *API) CompactHandler(w http.ResponseWriter, r *http.Request) {
+	if a.compaction == nil {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Compaction service not running")
+		return
+	}
+
+	roomID := r.URL.Query().Get("room_id")
+	if roomID == "" {
+		jsonResponse(w, http.StatusOK, a.compaction.RunNow(r.Context()))
+		return
+	}
+
+	room, err := a.database.GetRoom(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
+		return
+	}
+	if room == nil {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found")
+		return
+	}
+
+	result, err := a.compaction.CompactNow(r.Context(), roomID)
+	if err != nil {
+		log.Printf("Forced compaction failed for room %s: %v", roomID, err)
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to compact room")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, result)
+}
+
+// CompactionStatsHandler reports the last compaction run and per-room storage
+func (a *API) CompactionStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.compaction == nil {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Compaction service not running")
+		return
+	}
+
+	storage, err := a.database.GetRoomStorageStats(r.Context())
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get storage stats")
+		return
+	}
+
+	config := a.compaction.Config()
+	rooms := make([]RoomCompactionStats, len(storage))
+	var totalSaved int64
+	for i, rs := range storage {
+		rooms[i] = RoomCompactionStats{
+			RoomStorage: rs,
+			Eligible:    rs.UpdateCount >= config.UpdateThreshold,
+		}
+		if rs.UpdateCount > config.KeepRecentUpdates {
+			rooms[i].ReclaimableUpdates = rs.UpdateCount - config.KeepRecentUpdates
+			rooms[i].EstimatedBytesSaved = int64(rooms[i].ReclaimableUpdates) * estimatedRowOverheadBytes
+			totalSaved += rooms[i].EstimatedBytesSaved
+		}
+	}
+
+	status := a.compaction.Status()
+	response := map[string]interface{}{
+		"last_compacted":        status.LastCompacted,
+		"interval":              config.Interval.String(),
+		"update_threshold":      config.UpdateThreshold,
+		"keep_recent_updates":   config.KeepRecentUpdates,
+		"estimated_bytes_saved": totalSaved,
+		"rooms":                 rooms,
+	}
+	if !status.LastRun.IsZero() {
+		response["last_run"] = status.LastRun.UTC().Format(time.RFC3339)
+	}
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// ConnectionsHandler lists connected WebSocket sessions with their statistics
+func (a *API) ConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	connections := a.hub.GetConnections()
+	if roomID := r.URL.Query().Get("room_id"); roomID != "" {
+		filtered := connections[:0]
+		for _, c := range connections {
+			if c.RoomID == roomID {
+				filtered = append(filtered, c)
+			}
+		}
+		connections = filtered
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"connections":  connections,
+		"count":        len(connections),
+		"idle_timeout": a.hub.IdleTimeout().String(),
+	})
+}
+
+// KickRequest names the session to disconnect; client IDs are listed by
+// /api/admin/connections. A ban duration also refuses the client's IP (or,
+// with ban_by "user", its verified identity) for that long.
+type KickRequest struct {
+	ClientID    string `json:"client_id"`
+	BanDuration string `json:"ban_duration,omitempty"` // Go duration, e.g. "15m"
+	BanBy       string `json:"ban_by,omitempty"`       // "ip" (default) or "user"
+}
+
+type KickResponse struct {
+	RoomID   string  `json:"room_id"`
+	ClientID string  `json:"client_id"`
+	Kicked   bool    `json:"kicked"`
+	Ban      *ws.Ban `json:"ban,omitempty"`
+}
+
+// KickHandler disconnects one client from a room. Without a ban the client
+// may reconnect.
+func (a *API) KickHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+
+	var req KickRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	opts := ws.KickOptions{BanBy: ws.BanScope(req.BanBy)}
+	if req.BanDuration != "" {
+		opts.BanDuration, _ = time.ParseDuration(req.BanDuration) // Checked by validate
+	}
+
+	ban, err := a.hub.Kick(roomID, req.ClientID, opts)
+	switch {
+	case errors.Is(err, ws.ErrClientNotFound):
+		errorResponse(w, http.StatusNotFound, apierror.ClientNotFound, "Client not connected to this room")
+		return
+	case errors.Is(err, ws.ErrNoIdentity):
+		errorResponse(w, http.StatusConflict, apierror.ClientNotIdentified, "Client has no verified identity; ban by ip instead")
+		return
+	case err != nil:
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to kick client")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, KickResponse{RoomID: roomID, ClientID: req.ClientID, Kicked: true, Ban: ban})
+}
+
+// NoticeRequest is an announcement for every session in a room, delivered
+// on the WebSocket control channel
+type NoticeRequest struct {
+	Type    string `json:"type,omitempty"` // "notice" (default) or "lock"
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+type NoticeResponse struct {
+	RoomID   string `json:"room_id"`
+	Notified int    `json:"notified"` // Sessions the notice was queued for
+}
+
+// NoticeHandler sends a notice to everyone connected to a room
+func (a *API) NoticeHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+
+	var req NoticeRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	notified := a.hub.Notify(roomID, ws.NoticeFrame{Type: req.Type, Code: req.Code, Message: req.Message})
+	jsonResponse(w, http.StatusOK, NoticeResponse{RoomID: roomID, Notified: notified})
+}
+
+// Longest a room may be locked for at once; an abandoned lock expires
+const maxRoomLockTTL = time.Hour
+
+type RoomLockResponse struct {
+	RoomID string     `json:"room_id"`
+	Locked bool       `json:"locked"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// LockRoomHandler makes a room read-only for ?ttl= (default 1m), such as
+// while it is copied to another server. Every update the room accepted is
+// stored by the time it answers.
+func (a *API) LockRoomHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+
+	ttl, err := durationParam(r, "ttl", time.Minute)
+	if err != nil || ttl <= 0 || ttl > maxRoomLockTTL {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "ttl must be a duration up to 1h")
+		return
+	}
+
+	until, err := a.hub.LockRoom(roomID, ttl)
+	if errors.Is(err, ws.ErrHubStopped) {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Server is shutting down")
+		return
+	} else if err != nil {
+		databaseError(w, err, "Failed to write the room's pending updates")
+		return
+	}
+	a.hub.Notify(roomID, ws.NoticeFrame{
+		Type:         ws.ControlLock,
+		Code:         ws.ErrorCodeRoomLocked,
+		Message:      "This room is read-only for a moment",
+		RetryAfterMs: ttl.Milliseconds(),
+	})
+
+	jsonResponse(w, http.StatusOK, RoomLockResponse{RoomID: roomID, Locked: true, Until: &until})
+}
+
+// UnlockRoomHandler lets a locked room be edited again
+func (a *API) UnlockRoomHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+	if a.hub.UnlockRoom(roomID) {
+		a.hub.Notify(roomID, ws.NoticeFrame{Type: ws.ControlNotice, Code: "room_unlocked", Message: "This room can be edited again"})
+	}
+	jsonResponse(w, http.StatusOK, RoomLockResponse{RoomID: roomID})
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
+)
+
+func TestAdminCompaction(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	api.SetCompactionService(compaction.New(api.database, compaction.Config{
+		Interval:          time.Hour,
+		UpdateThreshold:   100,
+		KeepRecentUpdates: 2,
+	}))
+
+	roomID := "compact-room"
+	for i := 0; i < 6; i++ {
+		if err := api.database.SaveUpdate(context.Background(), roomID, []byte{0, 2, 1, byte(i)}); err != nil {
+			t.Fatalf("Failed to save update: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/admin/compaction", nil)
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var stats struct {
+		Rooms []RoomCompactionStats `json:"rooms"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(stats.Rooms) != 1 || stats.Rooms[0].UpdateCount != 6 || stats.Rooms[0].ReclaimableUpdates != 4 {
+		t.Fatalf("Unexpected compaction stats: %+v", stats.Rooms)
+	}
+	if stats.Rooms[0].Eligible {
+		t.Error("Room below the threshold should not be eligible")
+	}
+
+	req = httptest.NewRequest("POST", "/api/admin/compact?room_id="+roomID, nil)
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var result compaction.Result
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !result.Compacted || result.UpdatesMerged != 4 || result.UpdatesKept != 2 {
+		t.Errorf("Expected forced compaction of 4 updates keeping 2, got %+v", result)
+	}
+
+	if count, _ := api.database.GetUpdateCount(context.Background(), roomID); count != 2 {
+		t.Errorf("Expected 2 updates kept, got %d", count)
+	}
+
+	req = httptest.NewRequest("POST", "/api/admin/compact?room_id=missing", nil)
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown room, got %d", w.Code)
+	}
+}
+
+func TestAdminVerify(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	if err := api.database.SaveUpdates(context.Background(), "verify-api-room", [][]byte{{0, 2, 1, 1}, {0, 2, 4, 1}}); err != nil {
+		t.Fatalf("Failed to save updates: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/admin/verify?room=verify-api-room", nil)
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var response map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response["affected_rooms"] != float64(1) {
+		t.Errorf("Expected 1 affected room, got %v", response["affected_rooms"])
+	}
+}
+
+func TestAdminAPIKey(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	routes := api.Routes()
+
+	get := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/admin/connections", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get(""); w.Code != http.StatusOK {
+		t.Fatalf("Expected admin endpoints to be open without keys, got %d", w.Code)
+	}
+
+	key, _, err := api.database.CreateAPIKey(context.Background(), "test")
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"Missing key", "", http.StatusUnauthorized},
+		{"Wrong key", "Bearer lat_wrong", http.StatusUnauthorized},
+		{"Wrong scheme", "Basic " + key, http.StatusUnauthorized},
+		{"Valid key", "Bearer " + key, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.authorization)
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("Expected a WWW-Authenticate header")
+			}
+		})
+	}
+
+	// Only admin endpoints are guarded
+	req := httptest.NewRequest("GET", "/api/rooms", nil)
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected room listing to stay open, got %d", w.Code)
+	}
+}
+
+func TestKickHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   apierror.Code
+	}{
+		{"Missing client ID", `{}`, http.StatusUnprocessableEntity, apierror.ValidationFailed},
+		{"Unknown client", `{"client_id":"nobody"}`, http.StatusNotFound, apierror.ClientNotFound},
+		{"Unknown client with ban", `{"client_id":"nobody","ban_duration":"1h","ban_by":"user"}`, http.StatusNotFound, apierror.ClientNotFound},
+		{"Invalid ban duration", `{"client_id":"c","ban_duration":"forever"}`, http.StatusUnprocessableEntity, apierror.ValidationFailed},
+		{"Negative ban duration", `{"client_id":"c","ban_duration":"-5m"}`, http.StatusUnprocessableEntity, apierror.ValidationFailed},
+		{"Ban too long", `{"client_id":"c","ban_duration":"8760h"}`, http.StatusUnprocessableEntity, apierror.ValidationFailed},
+		{"Unknown ban scope", `{"client_id":"c","ban_duration":"1h","ban_by":"device"}`, http.StatusUnprocessableEntity, apierror.ValidationFailed},
+		{"Scope without duration", `{"client_id":"c","ban_by":"ip"}`, http.StatusUnprocessableEntity, apierror.ValidationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/admin/rooms/room-1/kick", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			api.Routes().ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			var body apierror.Error
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if body.Code != tt.code {
+				t.Errorf("Expected code %s, got %s", tt.code, body.Code)
+			}
+		})
+	}
+}
+
+func TestNoticeHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"Notice", `{"message":"Maintenance at noon"}`, http.StatusOK},
+		{"Lock", `{"type":"lock","code":"locked","message":"Room is read only"}`, http.StatusOK},
+		{"Missing message", `{"type":"notice"}`, http.StatusUnprocessableEntity},
+		{"Reserved type", `{"type":"shutdown","message":"bye"}`, http.StatusUnprocessableEntity},
+		{"Message too long", `{"message":"` + strings.Repeat("x", 501) + `"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/admin/rooms/room-1/notice", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			api.Routes().ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var resp NoticeResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.RoomID != "room-1" || resp.Notified != 0 {
+				t.Errorf("Unexpected response %+v", resp)
+			}
+		})
+	}
+}
+
+func TestRoomLockHandlers(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	update := `{"updates": ["AAEC"]}`
+
+	if w := serve("PUT", "/api/admin/rooms/locked/lock?ttl=2h", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a ttl over 1h, got %d", w.Code)
+	}
+	w := serve("PUT", "/api/admin/rooms/locked/lock?ttl=30s", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp RoomLockResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || !resp.Locked || resp.Until == nil {
+		t.Fatalf("Expected a lock with its expiry, got %+v (err %v)", resp, err)
+	}
+
+	if w := serve("POST", "/api/rooms/locked/updates", update); w.Code != http.StatusLocked {
+		t.Errorf("Expected status 423 posting to a locked room, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve("POST", "/api/rooms/other/updates", update); w.Code != http.StatusOK {
+		t.Errorf("Expected other rooms to stay writable, got %d", w.Code)
+	}
+
+	if w := serve("DELETE", "/api/admin/rooms/locked/lock", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 unlocking, got %d", w.Code)
+	}
+	if w := serve("POST", "/api/rooms/locked/updates", update); w.Code != http.StatusOK {
+		t.Errorf("Expected the unlocked room to accept updates, got %d: %s", w.Code, w.Body.String())
+	}
+}
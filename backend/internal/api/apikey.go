@@ -0,0 +1,57 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+// Guards admin endpoints. They stay open until the first API key is created
+// with `lattice-server create-api-key`, so existing setups keep working;
+// after that every request needs "Authorization: Bearer <key>".
+func (a *API) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		count, err := a.database.CountAPIKeys(r.Context())
+		if err != nil {
+			log.Printf("Failed to count API keys: %v", err)
+			errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to check API key")
+			return
+		}
+		if count == 0 {
+			next(w, r)
+			return
+		}
+
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || key == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lattice"`)
+			errorResponse(w, http.StatusUnauthorized, apierror.Unauthorized, "API key required")
+			return
+		}
+
+		valid, err := a.database.CheckAPIKey(r.Context(), key)
+		if err != nil {
+			log.Printf("Failed to check API key: %v", err)
+			errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to check API key")
+			return
+		}
+		if !valid {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lattice", error="invalid_token"`)
+			errorResponse(w, http.StatusUnauthorized, apierror.Unauthorized, "Invalid API key")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Reports whether the request carries a valid API key. Unlike
+// requireAPIKey, a server without keys doesn't make everyone an admin.
+func (a *API) hasAPIKey(r *http.Request) (bool, error) {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || key == "" {
+		return false, nil
+	}
+	return a.database.CheckAPIKey(r.Context(), key)
+}
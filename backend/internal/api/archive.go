@@ -0,0 +1,274 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+	"github.com/manpreetbhatti/lattice/backend/internal/ws"
+)
+
+// Room archives are gzipped tarballs holding these entries. The snapshot
+// is stored as is; the updates are framed like a snapshot, so both carry
+// their format version.
+const (
+	archiveManifest = "manifest.json"
+	archiveSnapshot = "snapshot.bin"
+	archiveUpdates  = "updates.bin"
+	archiveVersions = "versions.json"
+)
+
+// ArchiveFormat is the version of the archive layout written in manifests
+const ArchiveFormat = 1
+
+// ArchiveContentType is the media type of room archives
+const ArchiveContentType = "application/gzip"
+
+// Largest archive, compressed or not, accepted for import
+const maxArchiveBytes = 256 << 20
+
+var errInvalidArchive = errors.New("invalid room archive")
+
+type archiveManifestData struct {
+	Format         int          `json:"format"`
+	Room           RoomResponse `json:"room"`
+	JoinSecretHash string       `json:"join_secret_hash,omitempty"`
+	UpdateCount    int          `json:"update_count"`
+	ExportedAt     time.Time    `json:"exported_at"`
+}
+
+// WriteRoomArchive writes an exported room as a gzipped tarball
+func WriteRoomArchive(w io.Writer, export *RoomExportData) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now().UTC()
+
+	manifest, err := json.MarshalIndent(archiveManifestData{
+		Format:         ArchiveFormat,
+		Room:           export.Room,
+		JoinSecretHash: export.JoinSecretHash,
+		UpdateCount:    len(export.Updates),
+		ExportedAt:     now,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	versions, err := json.MarshalIndent(export.Versions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	entries := []struct {
+		name string
+		data []byte
+	}{
+		{archiveManifest, manifest},
+		{archiveSnapshot, export.Snapshot},
+		{archiveUpdates, compaction.EncodeSnapshot(export.Updates)},
+		{archiveVersions, versions},
+	}
+	for _, entry := range entries {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    entry.name,
+			Mode:    0o644,
+			Size:    int64(len(entry.data)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadRoomArchive reads a room written by WriteRoomArchive. Archives larger
+// than maxArchiveBytes once decompressed are rejected.
+func ReadRoomArchive(r io.Reader) (*RoomExportData, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidArchive, err)
+	}
+	defer gz.Close()
+
+	entries := make(map[string][]byte)
+	remaining := int64(maxArchiveBytes)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidArchive, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if header.Size > remaining {
+			return nil, fmt.Errorf("%w: larger than %d bytes", errInvalidArchive, maxArchiveBytes)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, header.Size))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidArchive, err)
+		}
+		remaining -= int64(len(data))
+		entries[header.Name] = data
+	}
+
+	var manifest archiveManifestData
+	if err := json.Unmarshal(entries[archiveManifest], &manifest); err != nil {
+		return nil, fmt.Errorf("%w: missing or malformed %s", errInvalidArchive, archiveManifest)
+	}
+	if manifest.Format != ArchiveFormat {
+		return nil, fmt.Errorf("%w: unsupported format %d", errInvalidArchive, manifest.Format)
+	}
+
+	updates, err := compaction.DecodeSnapshot(entries[archiveUpdates])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errInvalidArchive, archiveUpdates, err)
+	}
+	if len(updates) != manifest.UpdateCount {
+		return nil, fmt.Errorf("%w: %s holds %d updates, manifest says %d", errInvalidArchive, archiveUpdates, len(updates), manifest.UpdateCount)
+	}
+	if _, err := compaction.DecodeSnapshot(entries[archiveSnapshot]); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errInvalidArchive, archiveSnapshot, err)
+	}
+
+	export := &RoomExportData{
+		Room:           manifest.Room,
+		Snapshot:       entries[archiveSnapshot],
+		Updates:        updates,
+		UpdateCount:    len(updates),
+		JoinSecretHash: manifest.JoinSecretHash,
+	}
+	if len(export.Snapshot) == 0 {
+		export.Snapshot = nil
+	}
+	if export.Updates == nil {
+		export.Updates = [][]byte{}
+	}
+	if data, ok := entries[archiveVersions]; ok {
+		if err := json.Unmarshal(data, &export.Versions); err != nil {
+			return nil, fmt.Errorf("%w: malformed %s", errInvalidArchive, archiveVersions)
+		}
+	}
+	return export, nil
+}
+
+// RoomArchiveHandler downloads a room, its stored document and saved
+// versions as a tarball that ImportRoomHandler, here or on another server,
+// can recreate it from
+func (a *API) RoomArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+
+	export, err := ExportRoom(r.Context(), a.database, roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to export room")
+		return
+	}
+	if export == nil {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found")
+		return
+	}
+
+	// Built in full first so a failure can still be reported as an error
+	var buf bytes.Buffer
+	if err := WriteRoomArchive(&buf, export); err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to write archive")
+		return
+	}
+
+	filename := fmt.Sprintf("room-%s.tar.gz", roomID)
+	w.Header().Set("Content-Type", ArchiveContentType)
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(filename))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// ImportRoomHandler recreates a room from an archive in the request body,
+// under its original ID unless ?id= names another
+func (a *API) ImportRoomHandler(w http.ResponseWriter, r *http.Request) {
+	export, err := ReadRoomArchive(http.MaxBytesReader(w, r.Body, maxArchiveBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		errorResponse(w, http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge, fmt.Sprintf("archive exceeds %d bytes", maxArchiveBytes))
+		return
+	}
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, err.Error())
+		return
+	}
+
+	if id := r.URL.Query().Get("id"); id != "" {
+		export.Room.ID = id
+	}
+	roomID := export.Room.ID
+	if !a.allowedRoomID(w, "id", roomID) {
+		return
+	}
+	if _, ok := a.hub.GetRoomActivity()[roomID]; ok {
+		errorResponse(w, http.StatusConflict, apierror.RoomExists, "Room is in use")
+		return
+	}
+
+	switch err := ImportRoom(r.Context(), a.database, export); {
+	case errors.Is(err, ErrRoomExists):
+		errorResponse(w, http.StatusConflict, apierror.RoomExists, "Room already exists")
+		return
+	case errors.Is(err, ErrJoinSecretMissing):
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, "The room is protected but the archive holds no join secret")
+		return
+	case errors.Is(err, ErrWorkspaceMissing):
+		errorResponse(w, http.StatusNotFound, apierror.WorkspaceNotFound, fmt.Sprintf("Workspace %q not found; create it before importing", export.Room.Workspace))
+		return
+	case errors.Is(err, db.ErrInvalidJoinSecretHash):
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, "The archive's join secret is malformed")
+		return
+	case errors.Is(err, db.ErrWorkspaceFull):
+		a.workspaceRoomError(w, err)
+		return
+	case err != nil:
+		databaseError(w, err, "Failed to import room")
+		return
+	}
+	// The hub may still hold an empty document from a session that left
+	// before the import, which would hide the imported one from the next
+	if _, err := a.hub.DeleteRoom(roomID); err != nil && !errors.Is(err, ws.ErrHubStopped) {
+		log.Printf("Error dropping state of imported room %s: %v", roomID, err)
+	}
+
+	room, err := a.database.GetRoom(r.Context(), roomID)
+	if err != nil || room == nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
+		return
+	}
+	response := RoomResponse{
+		ID:         room.ID,
+		Name:       room.Name,
+		CreatedAt:  room.CreatedAt,
+		UpdatedAt:  room.UpdatedAt,
+		ArchivedAt: room.ArchivedAt,
+		Protected:  room.Protected,
+		Workspace:  room.Workspace,
+	}
+	a.publish(events.RoomCreated, room.ID, response)
+	jsonResponse(w, http.StatusCreated, response)
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
+)
+
+// Longest accepted guest display name
+const maxGuestNameLength = 64
+
+type GuestRequest struct {
+	Name  string `json:"name,omitempty"`
+	Color string `json:"color,omitempty"` // #rrggbb
+}
+
+type GuestResponse struct {
+	Token    string         `json:"token"`
+	Identity *auth.Identity `json:"identity"`
+}
+
+// SetGuestIssuer enables guest identity issuance
+func (a *API) SetGuestIssuer(issuer *auth.Issuer) {
+	a.guests = issuer
+}
+
+// GuestHandler mints a short-lived signed identity for an anonymous
+// collaborator. The token is presented on the WebSocket (?token= or an auth
+// message) so presence and logs show a server-verified name.
+func (a *API) GuestHandler(w http.ResponseWriter, r *http.Request) {
+	if a.guests == nil {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Guest identities are disabled")
+		return
+	}
+
+	var req GuestRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			bodyError(w, err)
+			return
+		}
+	}
+
+	if len(req.Name) > maxGuestNameLength {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, "name is too long")
+		return
+	}
+
+	if req.Color != "" && !auth.IsValidColor(req.Color) {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, "color must be a #rrggbb hex color")
+		return
+	}
+
+	token, identity, err := a.guests.Issue(req.Name, req.Color)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to issue token")
+		return
+	}
+
+	jsonResponse(w, http.StatusCreated, GuestResponse{
+		Token:    token,
+		Identity: identity,
+	})
+}
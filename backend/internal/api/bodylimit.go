@@ -0,0 +1,94 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+// BodyLimits caps request body sizes, so an oversized body is refused with
+// a 413 PAYLOAD_TOO_LARGE instead of being decoded into memory. Zero
+// disables a limit.
+type BodyLimits struct {
+	Request  int64 // Most routes
+	Versions int64 // /api/versions/* and /api/rooms/{id}/versions, which carry whole documents
+	AI       int64 // /api/ai/*, which carry code and its context
+	Updates  int64 // POST /api/rooms/{id}/updates, a batch of offline edits
+}
+
+func DefaultBodyLimits() BodyLimits {
+	return BodyLimits{
+		Request: 1 << 20,
+		// Room for DefaultMaxVersionBytes of content after JSON escaping
+		Versions: 16 << 20,
+		AI:       2 << 20,
+		Updates:  64 << 20,
+	}
+}
+
+// SetBodyLimits changes the request body limits. Call it before Routes.
+func (a *API) SetBodyLimits(l BodyLimits) {
+	a.bodyLimits = l
+}
+
+// Details of a 413 for a body over its route's limit
+type bodyLimitDetails struct {
+	LimitBytes int64 `json:"limit_bytes"`
+}
+
+// The limit for a route pattern such as "POST /api/ai/complete". Archive
+// imports enforce their own, much larger, limit.
+func (a *API) bodyLimitFor(pattern string) int64 {
+	_, path, _ := strings.Cut(pattern, " ")
+	switch {
+	case path == "/api/rooms/import":
+		return 0
+	case path == "/api/rooms/{id}/updates":
+		return a.bodyLimits.Updates
+	case strings.HasPrefix(path, "/api/ai/"):
+		return a.bodyLimits.AI
+	case strings.HasPrefix(path, "/api/versions"), strings.HasPrefix(path, "/api/rooms/{id}/versions"):
+		return a.bodyLimits.Versions
+	default:
+		return a.bodyLimits.Request
+	}
+}
+
+// Refuses bodies declared larger than limit up front, and stops reading
+// undeclared ones at it; see bodyError
+func withBodyLimit(limit int64, h http.Handler) http.Handler {
+	if limit <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			bodyTooLarge(w, limit)
+			return
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func bodyTooLarge(w http.ResponseWriter, limit int64) {
+	// The rest of the body is not read, so the connection can't be reused
+	w.Header().Set("Connection", "close")
+	apierror.Write(w, http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge,
+		fmt.Sprintf("request body exceeds %d bytes", limit), bodyLimitDetails{LimitBytes: limit})
+}
+
+// Answers a failure to read or decode a request body: a 413 if it ran past
+// its route's limit, otherwise a 400
+func bodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		bodyTooLarge(w, tooLarge.Limit)
+		return
+	}
+	errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+func TestWithBodyLimit(t *testing.T) {
+	handler := withBodyLimit(16, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			bodyError(w, err)
+			return
+		}
+		jsonResponse(w, http.StatusOK, body)
+	}))
+
+	tests := []struct {
+		name     string
+		body     string
+		declared bool
+		status   int
+	}{
+		{"fits", `{"a":"b"}`, true, http.StatusOK},
+		{"declared too large", `{"a":"` + strings.Repeat("x", 64) + `"}`, true, http.StatusRequestEntityTooLarge},
+		{"streamed too large", `{"a":"` + strings.Repeat("x", 64) + `"}`, false, http.StatusRequestEntityTooLarge},
+		{"malformed", `{"a":`, true, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/versions", strings.NewReader(tt.body))
+			if !tt.declared {
+				// Hide the length, as for a chunked body
+				req.Body = io.NopCloser(strings.NewReader(tt.body))
+				req.ContentLength = -1
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, rr.Code, rr.Body.String())
+			}
+			if tt.status != http.StatusRequestEntityTooLarge {
+				return
+			}
+			var body struct {
+				Code    apierror.Code    `json:"code"`
+				Details bodyLimitDetails `json:"details"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode body: %v", err)
+			}
+			if body.Code != apierror.PayloadTooLarge {
+				t.Errorf("Expected code %s, got %s", apierror.PayloadTooLarge, body.Code)
+			}
+			if body.Details.LimitBytes != 16 {
+				t.Errorf("Expected limit_bytes 16, got %d", body.Details.LimitBytes)
+			}
+		})
+	}
+}
+
+func TestBodyLimitFor(t *testing.T) {
+	a := &API{bodyLimits: BodyLimits{Request: 1, Versions: 2, AI: 3, Updates: 4}}
+	tests := map[string]int64{
+		"POST /api/rooms":               1,
+		"POST /api/versions":            2,
+		"POST /api/rooms/{id}/versions": 2,
+		"POST /api/ai/complete":         3,
+		"POST /api/rooms/{id}/updates":  4,
+		"POST /api/rooms/import":        0,
+	}
+	for pattern, want := range tests {
+		if got := a.bodyLimitFor(pattern); got != want {
+			t.Errorf("bodyLimitFor(%q) = %d, want %d", pattern, got, want)
+		}
+	}
+}
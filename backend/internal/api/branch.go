@@ -0,0 +1,219 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// BranchVersionRequest names the room a branch is created as. Both fields
+// are optional; the body may be omitted.
+type BranchVersionRequest struct {
+	RoomID string `json:"room_id,omitempty"` // Generated from the source room's ID if empty
+	Name   string `json:"name,omitempty"`
+}
+
+// BranchResponse describes a newly created branch
+type BranchResponse struct {
+	Room          RoomResponse    `json:"room"`
+	Version       VersionResponse `json:"version"` // The branch's first version
+	SourceRoomID  string          `json:"source_room_id"`
+	SourceVersion VersionResponse `json:"source_version"`
+}
+
+// MergeProposalResponse shows what merging a branch back into the room it
+// came from would change. The diff goes from the source room's latest
+// version to the branch's. Content is the three-way merge of the two
+// against the branch point, with any conflicts between markers; when the
+// source has not moved since the branch point it is the branch as is.
+type MergeProposalResponse struct {
+	RoomID        string          `json:"room_id"`
+	SourceRoomID  string          `json:"source_room_id"`
+	Base          VersionResponse `json:"base"`   // The branch point
+	Branch        VersionResponse `json:"branch"` // The branch's latest version
+	Source        VersionResponse `json:"source"` // The source room's latest version
+	FastForward   bool            `json:"fast_forward"`
+	BranchChanges DiffSummary     `json:"branch_changes"` // Base to branch
+	SourceChanges DiffSummary     `json:"source_changes"` // Base to source
+	Diff          []DiffLine      `json:"diff"`
+	Summary       DiffSummary     `json:"summary"`
+	Content       string          `json:"content"`
+	Clean         bool            `json:"clean"` // No conflicts
+	Conflicts     []MergeConflict `json:"conflicts"`
+}
+
+// BranchVersionHandler creates a room seeded with a version's content and
+// linked back to it, so it can be edited apart and later merged. The branch
+// is protected and scoped like the room it came from.
+func (a *API) BranchVersionHandler(w http.ResponseWriter, r *http.Request) {
+	versionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid version ID")
+		return
+	}
+
+	var req BranchVersionRequest
+	if r.ContentLength != 0 && !decodeRequest(w, r, &req) {
+		return
+	}
+
+	version, err := a.database.GetVersion(r.Context(), versionID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
+		return
+	}
+	if version == nil {
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Version not found")
+		return
+	}
+	if !a.authorizeVersion(w, r, version) {
+		return
+	}
+
+	if req.RoomID == "" {
+		req.RoomID = branchRoomID(version.RoomID, a.hub.RoomIDRules().MaxLength)
+	}
+	if !a.allowedRoomID(w, "room_id", req.RoomID) {
+		return
+	}
+	if req.Name == "" {
+		req.Name = fmt.Sprintf("Branch of %s", version.Name)
+	}
+
+	var update []byte
+	if version.Content != "" {
+		update = protocol.EncodeTextInsert(newYjsClientID(), 0, version.Content)
+	}
+
+	first, err := a.database.CreateBranch(r.Context(), req.RoomID, req.Name,
+		fmt.Sprintf("Branched from version %d (%s) of %s", version.ID, version.Name, version.RoomID),
+		version, update,
+	)
+	if errors.Is(err, db.ErrRoomExists) {
+		errorResponse(w, http.StatusConflict, apierror.RoomExists, "Room already exists")
+		return
+	}
+	if errors.Is(err, db.ErrWorkspaceFull) {
+		errorResponse(w, http.StatusConflict, apierror.WorkspaceFull, "The workspace has reached its room limit")
+		return
+	}
+	if err != nil {
+		databaseError(w, err, "Failed to create branch")
+		return
+	}
+
+	room, err := a.database.GetRoom(r.Context(), req.RoomID)
+	if err != nil || room == nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
+		return
+	}
+
+	response := RoomResponse{
+		ID:           room.ID,
+		Name:         room.Name,
+		CreatedAt:    room.CreatedAt,
+		UpdatedAt:    room.UpdatedAt,
+		Protected:    room.Protected,
+		Workspace:    room.Workspace,
+		BranchedFrom: &db.Branch{RoomID: room.ID, SourceRoomID: version.RoomID, SourceVersionID: version.ID, CreatedAt: room.CreatedAt},
+	}
+	a.publish(events.RoomCreated, room.ID, response)
+	a.versionSaved(first)
+
+	jsonResponse(w, http.StatusCreated, BranchResponse{
+		Room:          response,
+		Version:       newVersionResponse(first),
+		SourceRoomID:  version.RoomID,
+		SourceVersion: newVersionResponse(version),
+	})
+}
+
+// MergeProposalHandler compares a branch with the room it was branched from.
+// It changes nothing; applying the proposal is left to the caller.
+func (a *API) MergeProposalHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+	if !a.requireRoom(r.Context(), w, roomID) {
+		return
+	}
+
+	branch, err := a.database.GetBranch(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get branch")
+		return
+	}
+	if branch == nil {
+		errorResponse(w, http.StatusNotFound, apierror.BranchNotFound, "Room is not a branch")
+		return
+	}
+	if !a.authorizeRoom(w, r, roomID) || !a.authorizeRoom(w, r, branch.SourceRoomID) {
+		return
+	}
+
+	base, err := a.database.GetVersion(r.Context(), branch.SourceVersionID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
+		return
+	}
+	if base == nil {
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "The version the branch was made from no longer exists")
+		return
+	}
+
+	head, err := a.database.GetLatestVersion(r.Context(), roomID)
+	if err != nil || head == nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get the branch's latest version")
+		return
+	}
+	source, err := a.database.GetLatestVersion(r.Context(), branch.SourceRoomID)
+	if err != nil || source == nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get the source room's latest version")
+		return
+	}
+
+	diff := computeDiff(source.Content, head.Content)
+	content, conflicts := mergeText(base.Content, source.Content, head.Content)
+	response := MergeProposalResponse{
+		RoomID:        roomID,
+		SourceRoomID:  branch.SourceRoomID,
+		Base:          newVersionResponse(base),
+		Branch:        newVersionResponse(head),
+		Source:        newVersionResponse(source),
+		FastForward:   source.Content == base.Content,
+		BranchChanges: summarizeDiff(computeDiff(base.Content, head.Content)),
+		SourceChanges: summarizeDiff(computeDiff(base.Content, source.Content)),
+		Diff:          diff,
+		Summary:       summarizeDiff(diff),
+		Content:       content,
+		Clean:         len(conflicts) == 0,
+		Conflicts:     conflicts,
+	}
+
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// A room ID for a branch of roomID, such as "notes-branch-k7q2xm", of at
+// most maxLength characters
+func branchRoomID(roomID string, maxLength int) string {
+	const suffix = "-branch-"
+	code := strings.ToLower(db.GenerateJoinCode())
+	if keep := max(0, maxLength-len(suffix)-len(code)); len(roomID) > keep {
+		roomID = roomID[:keep]
+	}
+	return roomID + suffix + code
+}
+
+// Yjs client IDs are random 32-bit integers
+func newYjsClientID() uint64 {
+	var b [4]byte
+	rand.Read(b[:])
+	return uint64(binary.BigEndian.Uint32(b[:]))
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBranchVersion(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := api.database.CreateRoom(ctx, "trunk", "Trunk"); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	base, _ := api.database.CreateVersion(ctx, "trunk", "v1", "", "a\nb", hashContent("a\nb"), "", false)
+
+	branch := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/versions/"+strconv.Itoa(base.ID)+"/branch", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, req)
+		return w
+	}
+
+	w := branch(`{"room_id": "feature"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created BranchResponse
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if created.Room.ID != "feature" || created.Room.BranchedFrom == nil || created.Room.BranchedFrom.SourceVersionID != base.ID {
+		t.Errorf("Expected room feature branched from %d, got %+v", base.ID, created.Room)
+	}
+	if created.Version.RoomID != "feature" || created.Version.ContentHash != base.ContentHash {
+		t.Errorf("Expected the branch's first version to copy the source, got %+v", created.Version)
+	}
+
+	// The branch's document starts with the version's text
+	updates, _ := api.database.GetAllUpdates(ctx, "feature")
+	if len(updates) != 1 || !bytes.Contains(updates[0], []byte("a\nb")) {
+		t.Errorf("Expected one seed update holding the content, got %d updates", len(updates))
+	}
+
+	if w := branch(`{"room_id": "feature"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for a taken room ID, got %d", w.Code)
+	}
+	if w := branch(`{"room_id": "bad id"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for an invalid room ID, got %d", w.Code)
+	}
+
+	// Without a body the room ID is generated
+	w = branch("")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201 without a body, got %d: %s", w.Code, w.Body.String())
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	if !strings.HasPrefix(created.Room.ID, "trunk-branch-") {
+		t.Errorf("Expected a generated branch room ID, got %q", created.Room.ID)
+	}
+
+	req := httptest.NewRequest("GET", "/api/rooms/feature", nil)
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	var room RoomResponse
+	json.NewDecoder(w.Body).Decode(&room)
+	if room.BranchedFrom == nil || room.BranchedFrom.SourceRoomID != "trunk" {
+		t.Errorf("Expected the room to link back to trunk, got %+v", room.BranchedFrom)
+	}
+}
+
+func TestBranchProtectedRoom(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	api.database.CreateRoom(ctx, "vault", "")
+	if err := api.database.SetJoinSecret(ctx, "vault", "hunter2"); err != nil {
+		t.Fatalf("Failed to set join secret: %v", err)
+	}
+	base, _ := api.database.CreateVersion(ctx, "vault", "v1", "", "a", hashContent("a"), "", false)
+
+	call := func(method, path, body, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if secret != "" {
+			req.Header.Set(roomSecretHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, req)
+		return w
+	}
+
+	branchPath := "/api/versions/" + strconv.Itoa(base.ID) + "/branch"
+	if w := call("POST", branchPath, `{"room_id": "copy"}`, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403 without the secret, got %d", w.Code)
+	}
+	w := call("POST", branchPath, `{"room_id": "copy"}`, "hunter2")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created BranchResponse
+	json.NewDecoder(w.Body).Decode(&created)
+	if !created.Room.Protected {
+		t.Errorf("Expected the branch to keep the source's join secret, got %+v", created.Room)
+	}
+
+	// The branch opens with the same secret, and not without it
+	if ok, _ := api.database.CheckJoinSecret(ctx, "copy", "hunter2"); !ok {
+		t.Error("Expected the source's secret to open the branch")
+	}
+	if w := call("GET", "/api/rooms/copy/merge-proposal", "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for the merge proposal without the secret, got %d", w.Code)
+	}
+	if w := call("GET", "/api/rooms/copy/merge-proposal", "", "hunter2"); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 with the secret, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMergeProposal(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := api.database.CreateRoom(ctx, "trunk", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	base, _ := api.database.CreateVersion(ctx, "trunk", "v1", "", "a\nb", hashContent("a\nb"), "", false)
+	if _, err := api.database.CreateBranch(ctx, "feature", "", "", base, nil); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	api.database.CreateVersion(ctx, "feature", "v2", "", "a\nb\nc", hashContent("a\nb\nc"), "", false)
+
+	propose := func(roomID string) (*httptest.ResponseRecorder, MergeProposalResponse) {
+		req := httptest.NewRequest("GET", "/api/rooms/"+roomID+"/merge-proposal", nil)
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, req)
+
+		var response MergeProposalResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return w, response
+	}
+
+	w, proposal := propose("feature")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if !proposal.FastForward || proposal.Content != "a\nb\nc" {
+		t.Errorf("Expected a fast-forward to the branch's content, got %+v", proposal)
+	}
+	if proposal.Summary.LinesAdded != 1 || proposal.BranchChanges.LinesAdded != 1 || proposal.SourceChanges.LinesAdded != 0 {
+		t.Errorf("Expected the branch to add one line, got %+v", proposal)
+	}
+
+	// Once the source moves on, the two are merged
+	api.database.CreateVersion(ctx, "trunk", "v3", "", "z\na\nb", hashContent("z\na\nb"), "", false)
+	_, proposal = propose("feature")
+	if proposal.FastForward || !proposal.Clean || proposal.Content != "z\na\nb\nc" {
+		t.Errorf("Expected a clean merge after the source changed, got %+v", proposal)
+	}
+	if proposal.Summary.LinesAdded != 1 || proposal.Summary.LinesRemoved != 1 {
+		t.Errorf("Expected the diff from source to branch, got %+v", proposal.Summary)
+	}
+
+	if w, _ := propose("trunk"); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "BRANCH_NOT_FOUND") {
+		t.Errorf("Expected BRANCH_NOT_FOUND for a room that is not a branch, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+)
+
+// Maximum number of rooms accepted by a single bulk request
+const maxBulkRooms = 500
+
+const (
+	BulkActionDelete  = "delete"
+	BulkActionArchive = "archive"
+	BulkActionExport  = "export"
+)
+
+type BulkRoomsRequest struct {
+	Action  string   `json:"action"` // "delete", "archive", "export"
+	RoomIDs []string `json:"room_ids"`
+}
+
+// BulkRoomResult reports the outcome for a single room in a bulk request
+type BulkRoomResult struct {
+	RoomID string          `json:"room_id"`
+	Status string          `json:"status"` // "ok", "not_found", "forbidden", "error"
+	Error  string          `json:"error,omitempty"`
+	Export *RoomExportData `json:"export,omitempty"`
+}
+
+// RoomExportData is the exported form of a room and its saved versions
+type RoomExportData struct {
+	Room        RoomResponse      `json:"room"`
+	Snapshot    []byte            `json:"snapshot,omitempty"`
+	Updates     [][]byte          `json:"updates"`
+	Versions    []VersionResponse `json:"versions"`
+	UpdateCount int               `json:"update_count"`
+
+	// The join secret as stored, salted and hashed, so a protected room
+	// stays protected where it is imported. Only ExportRoom sets it.
+	JoinSecretHash string `json:"join_secret_hash,omitempty"`
+}
+
+// BulkRoomsHandler applies one action to many rooms, reporting per-room failures
+func (a *API) BulkRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	var req BulkRoomsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		bodyError(w, err)
+		return
+	}
+
+	switch req.Action {
+	case BulkActionDelete, BulkActionArchive, BulkActionExport:
+	default:
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, "action must be one of: delete, archive, export")
+		return
+	}
+
+	if len(req.RoomIDs) == 0 {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, "room_ids is required")
+		return
+	}
+
+	if len(req.RoomIDs) > maxBulkRooms {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, fmt.Sprintf("at most %d room_ids per request", maxBulkRooms))
+		return
+	}
+
+	// Requests with an API key may touch any room. Until the first key
+	// exists the route is open to anyone, so without a key each room gets
+	// the checks of its own routes: membership for workspace rooms and the
+	// join secret for protected ones.
+	admin, err := a.hasAPIKey(r)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to check API key")
+		return
+	}
+	caller := bulkCaller{admin: admin, secret: roomSecret(r)}
+	if a.guests != nil {
+		if identity, err := a.guests.Verify(r.Header.Get(identityTokenHeader)); err == nil {
+			caller.userID = identity.ID
+		}
+	}
+
+	results := make([]BulkRoomResult, 0, len(req.RoomIDs))
+	seen := make(map[string]bool, len(req.RoomIDs))
+	failed := 0
+
+	for _, roomID := range req.RoomIDs {
+		if seen[roomID] {
+			continue
+		}
+		seen[roomID] = true
+
+		result := a.applyBulkAction(r.Context(), req.Action, roomID, caller)
+		if result.Status != "ok" {
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	status := http.StatusOK
+	if failed > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	jsonResponse(w, status, map[string]interface{}{
+		"action":    req.Action,
+		"results":   results,
+		"succeeded": len(results) - failed,
+		"failed":    failed,
+	})
+}
+
+// Who a bulk request acts for
+type bulkCaller struct {
+	admin  bool   // Carries an API key
+	userID string // From a verified identity token
+	secret string // Join secret presented with the request
+}
+
+func (a *API) applyBulkAction(ctx context.Context, action, roomID string, caller bulkCaller) BulkRoomResult {
+	result := BulkRoomResult{RoomID: roomID}
+
+	if roomID == "" {
+		result.Status = "error"
+		result.Error = "room ID is empty"
+		return result
+	}
+
+	room, err := a.database.GetRoom(ctx, roomID)
+	if err != nil {
+		result.Status = "error"
+		result.Error = "failed to get room"
+		return result
+	}
+	if room == nil {
+		result.Status = "not_found"
+		result.Error = "room not found"
+		return result
+	}
+	if !caller.admin && room.Workspace != "" {
+		role := ""
+		if caller.userID != "" {
+			role, err = a.database.WorkspaceRole(ctx, room.Workspace, caller.userID)
+		}
+		if err != nil || role == "" {
+			result.Status = "forbidden"
+			result.Error = "workspace membership required"
+			return result
+		}
+	}
+	if !caller.admin && room.Protected {
+		ok, err := a.database.CheckJoinSecret(ctx, roomID, caller.secret)
+		if err != nil || !ok {
+			result.Status = "forbidden"
+			result.Error = "join secret required"
+			return result
+		}
+	}
+
+	switch action {
+	case BulkActionDelete:
+		err = a.deleteRoom(ctx, roomID)
+	case BulkActionArchive:
+		err = a.database.ArchiveRoom(ctx, roomID)
+	case BulkActionExport:
+		result.Export, err = exportRoom(ctx, a.database, room)
+	}
+
+	if err != nil {
+		result.Status = "error"
+		result.Error = fmt.Sprintf("failed to %s room", action)
+		return result
+	}
+
+	switch {
+	case action == BulkActionDelete:
+		a.publish(events.RoomDeleted, roomID, nil)
+	case action == BulkActionArchive && room.ArchivedAt == nil:
+		a.publish(events.RoomArchived, roomID, nil)
+	}
+
+	result.Status = "ok"
+	return result
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Responses smaller than this are sent as is; gzip framing would outweigh the
+// savings
+const minCompressBytes = 1024
+
+// Content types that are already compressed
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/gzip", "application/x-gzip", "application/zip",
+	"application/zstd", "application/octet-stream",
+	"text/event-stream", // Streamed; gzip would hold events back
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return w
+	},
+}
+
+// Reports whether the client accepts gzip, honouring q=0
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Gzips responses for clients that accept it once they reach
+// minCompressBytes, leaving small and already-compressed bodies alone
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, status: http.StatusOK}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// Buffers the start of a response until it knows whether compressing is
+// worthwhile
+type compressWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.status = status
+		c.wroteHeader = true
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	c.wroteHeader = true
+	if c.gz != nil {
+		return c.gz.Write(b)
+	}
+	if c.passthrough {
+		return c.ResponseWriter.Write(b)
+	}
+
+	c.buf.Write(b)
+	if c.buf.Len() < minCompressBytes {
+		return len(b), nil
+	}
+
+	if err := c.start(c.compressible()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *compressWriter) compressible() bool {
+	h := c.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	if c.status < http.StatusOK || c.status == http.StatusNoContent || c.status == http.StatusNotModified {
+		return false
+	}
+
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(c.buf.Bytes())
+	}
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sends the headers and the buffered bytes, compressed or not
+func (c *compressWriter) start(compressed bool) error {
+	if compressed {
+		c.Header().Set("Content-Encoding", "gzip")
+		c.Header().Del("Content-Length")
+		c.ResponseWriter.WriteHeader(c.status)
+
+		c.gz = gzipWriters.Get().(*gzip.Writer)
+		c.gz.Reset(c.ResponseWriter)
+		_, err := c.gz.Write(c.buf.Bytes())
+		c.buf.Reset()
+		return err
+	}
+
+	c.passthrough = true
+	c.ResponseWriter.WriteHeader(c.status)
+	_, err := c.ResponseWriter.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+func (c *compressWriter) close() {
+	if c.gz != nil {
+		c.gz.Close()
+		gzipWriters.Put(c.gz)
+		c.gz = nil
+		return
+	}
+	if !c.passthrough && c.wroteHeader {
+		c.start(false)
+	}
+}
+
+// Sends what has been written so far, for handlers that stream
+func (c *compressWriter) Flush() {
+	if c.gz == nil && !c.passthrough {
+		if err := c.start(c.compressible()); err != nil {
+			return
+		}
+	}
+	if c.gz != nil {
+		c.gz.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Lets http.ResponseController reach the underlying writer
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
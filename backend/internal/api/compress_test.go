@@ -0,0 +1,79 @@
+package api
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat("lattice ", minCompressBytes)
+	handler := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, large[:len(large)/2])
+			io.WriteString(w, large[len(large)/2:])
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"ok":true}`)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, large)
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		gzipped        bool
+		status         int
+	}{
+		{"/large", "gzip, deflate, br", true, http.StatusCreated},
+		{"/large", "", false, http.StatusCreated},
+		{"/large", "gzip;q=0", false, http.StatusCreated},
+		{"/small", "gzip", false, http.StatusOK},
+		{"/image", "gzip", false, http.StatusOK},
+		{"/empty", "gzip", false, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path+" "+tt.acceptEncoding, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if got := w.Header().Get("Content-Encoding") == "gzip"; got != tt.gzipped {
+				t.Fatalf("Expected gzipped=%v, got Content-Encoding %q", tt.gzipped, w.Header().Get("Content-Encoding"))
+			}
+			if w.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Expected Vary: Accept-Encoding, got %q", w.Header().Get("Vary"))
+			}
+
+			body := w.Body.String()
+			if tt.gzipped {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("Invalid gzip body: %v", err)
+				}
+				decoded, _ := io.ReadAll(zr)
+				body = string(decoded)
+			}
+			if tt.path == "/large" && body != large {
+				t.Errorf("Body did not round-trip (%d bytes)", len(body))
+			}
+		})
+	}
+}
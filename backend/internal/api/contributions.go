@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+type contributionsResponse struct {
+	RoomID        string            `json:"room_id"`
+	Contributions []db.Contribution `json:"contributions"`
+}
+
+// ContributionsHandler reports who made a room's stored updates, per user
+// or, for sessions without a verified identity, per session:
+// GET /api/rooms/{id}/contributions
+func (a *API) ContributionsHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+
+	if !a.requireRoom(r.Context(), w, roomID) || !a.authorizeRoom(w, r, roomID) {
+		return
+	}
+
+	contributions, err := a.database.GetRoomContributions(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get contributions")
+		return
+	}
+	jsonResponse(w, http.StatusOK, contributionsResponse{RoomID: roomID, Contributions: contributions})
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+func TestContributionsHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := api.database.CreateRoom(ctx, "pair", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	api.database.SaveAuthoredUpdates(ctx, "pair", []db.AuthoredUpdate{
+		{Data: []byte{1, 2, 3}, Author: db.Author{ClientID: "a", UserID: "user-1"}},
+		{Data: []byte{4}, Author: db.Author{ClientID: "b", UserID: "user-1"}},
+		{Data: []byte{5}, Author: db.Author{ClientID: "c"}},
+	})
+
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/rooms/pair/contributions", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var resp contributionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Contributions) != 2 {
+		t.Fatalf("Expected a user and a session, got %+v", resp.Contributions)
+	}
+	if c := resp.Contributions[0]; c.UserID != "user-1" || c.Clients != 2 || c.Updates != 2 || c.Bytes != 4 {
+		t.Errorf("Expected user-1's updates from two sessions, got %+v", c)
+	}
+	if c := resp.Contributions[1]; c.ClientID != "c" || c.Updates != 1 {
+		t.Errorf("Expected session c's update, got %+v", c)
+	}
+
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/rooms/missing/contributions", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing room, got %d", w.Code)
+	}
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Line diffs use Myers' algorithm in linear space: the middle of the edit
+// script is found by searching from both ends at once and each half is
+// diffed in turn, so memory grows with the documents rather than with their
+// product. Lines are compared as integers, lines only one side has are set
+// aside first, and a search that runs past diffCostLimit edits settles for
+// the furthest point it reached, so even unrelated documents diff in about
+// linear time at the cost of a less than minimal diff.
+
+// Edits a single search may explore before it settles
+const diffCostLimit = 1024
+
+// computeDiff returns the line diff turning oldContent into newContent, with
+// removals before additions where lines were replaced
+func computeDiff(oldContent, newContent string) []DiffLine {
+	oldLines := strings.Split(oldContent, "\n")
+	newLines := strings.Split(newContent, "\n")
+	matches := lineMatches(oldLines, newLines)
+
+	diff := make([]DiffLine, 0, max(len(oldLines), len(newLines)))
+	j := 0
+	for i, match := range matches {
+		if match < 0 {
+			diff = append(diff, DiffLine{Type: "removed", Content: oldLines[i], OldLine: i + 1})
+			continue
+		}
+		for ; j < match; j++ {
+			diff = append(diff, DiffLine{Type: "added", Content: newLines[j], NewLine: j + 1})
+		}
+		diff = append(diff, DiffLine{Type: "unchanged", Content: oldLines[i], OldLine: i + 1, NewLine: j + 1})
+		j++
+	}
+	for ; j < len(newLines); j++ {
+		diff = append(diff, DiffLine{Type: "added", Content: newLines[j], NewLine: j + 1})
+	}
+	return diff
+}
+
+// DiffHunk is a run of changes with the unchanged lines around them, as in
+// a hunk of a unified diff
+type DiffHunk struct {
+	Header   string     `json:"header"`    // "@@ -old_start,old_lines +new_start,new_lines @@"
+	OldStart int        `json:"old_start"` // For an empty side, the line the hunk follows
+	OldLines int        `json:"old_lines"`
+	NewStart int        `json:"new_start"`
+	NewLines int        `json:"new_lines"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// Groups the changes of a diff from computeDiff into hunks with up to
+// context unchanged lines on either side, merging hunks whose context
+// touches and dropping the unchanged lines in between
+func diffHunks(diff []DiffLine, context int) []DiffHunk {
+	show := make([]bool, len(diff))
+	shown := 0 // Lines before this are already marked
+	for i, line := range diff {
+		if line.Type == "unchanged" {
+			continue
+		}
+		for j := max(shown, i-context); j <= i+min(context, len(diff)-1-i); j++ {
+			show[j] = true
+		}
+		shown = max(shown, i+min(context, len(diff)-1-i)+1)
+	}
+
+	hunks := []DiffHunk{}
+	// Old and new lines before index i
+	oldBefore, newBefore := 0, 0
+	for i := 0; i < len(diff); {
+		if !show[i] {
+			oldBefore++
+			newBefore++
+			i++
+			continue
+		}
+
+		end := i
+		oldCount, newCount := 0, 0
+		for ; end < len(diff) && show[end]; end++ {
+			if diff[end].Type != "added" {
+				oldCount++
+			}
+			if diff[end].Type != "removed" {
+				newCount++
+			}
+		}
+
+		hunks = append(hunks, DiffHunk{
+			Header:   fmt.Sprintf("@@ -%s +%s @@", hunkRange(oldBefore, oldCount), hunkRange(newBefore, newCount)),
+			OldStart: hunkStart(oldBefore, oldCount),
+			OldLines: oldCount,
+			NewStart: hunkStart(newBefore, newCount),
+			NewLines: newCount,
+			Lines:    diff[i:end],
+		})
+		oldBefore += oldCount
+		newBefore += newCount
+		i = end
+	}
+	return hunks
+}
+
+// The first line of a hunk range covering count lines after the first
+// before, or the line it follows if it is empty
+func hunkStart(before, count int) int {
+	if count == 0 {
+		return before
+	}
+	return before + 1
+}
+
+// For each line of a, the index of the line of b it is paired with in a
+// longest common subsequence, or -1
+func lineMatches(a, b []string) []int {
+	matches := make([]int, len(a))
+	for i := range matches {
+		matches[i] = -1
+	}
+
+	// Number the distinct lines, and count where each appears
+	ids := make(map[string]int)
+	inA, inB := []int{}, []int{}
+	number := func(line string) int {
+		id, ok := ids[line]
+		if !ok {
+			id = len(ids)
+			ids[line] = id
+			inA, inB = append(inA, 0), append(inB, 0)
+		}
+		return id
+	}
+	aIDs, bIDs := make([]int, len(a)), make([]int, len(b))
+	for i, line := range a {
+		aIDs[i] = number(line)
+		inA[aIDs[i]]++
+	}
+	for j, line := range b {
+		bIDs[j] = number(line)
+		inB[bIDs[j]]++
+	}
+
+	// A line missing from the other side can't be matched, so only lines
+	// both have are diffed; index maps them back
+	d := &myers{}
+	var aIndex, bIndex []int
+	for i, id := range aIDs {
+		if inB[id] > 0 {
+			d.a = append(d.a, id)
+			aIndex = append(aIndex, i)
+		}
+	}
+	for j, id := range bIDs {
+		if inA[id] > 0 {
+			d.b = append(d.b, id)
+			bIndex = append(bIndex, j)
+		}
+	}
+
+	d.compare(0, len(d.a), 0, len(d.b))
+	for _, m := range d.matches {
+		matches[aIndex[m[0]]] = bIndex[m[1]]
+	}
+	return matches
+}
+
+type myers struct {
+	a, b    []int
+	matches [][2]int // Pairs of equal lines, in order
+}
+
+// Diffs a[aLo:aHi] against b[bLo:bHi], appending their matches in order
+func (d *myers) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.matches = append(d.matches, [2]int{aLo, bLo})
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aLo < aHi-suffix && bLo < bHi-suffix && d.a[aHi-suffix-1] == d.b[bHi-suffix-1] {
+		suffix++
+	}
+	aHi, bHi = aHi-suffix, bHi-suffix
+
+	if aLo < aHi && bLo < bHi {
+		if x, y, ok := d.split(aLo, aHi, bLo, bHi); ok {
+			d.compare(aLo, x, bLo, y)
+			d.compare(x, aHi, y, bHi)
+		}
+	}
+
+	for k := 0; k < suffix; k++ {
+		d.matches = append(d.matches, [2]int{aHi + k, bHi + k})
+	}
+}
+
+// Finds a point (x, y) on a shortest edit path through the ranges, or as
+// near one as diffCostLimit allows. ok is false when the ranges share no
+// line, or when no point inside them was found, leaving them unmatched.
+func (d *myers) split(aLo, aHi, bLo, bHi int) (x, y int, ok bool) {
+	n, m := aHi-aLo, bHi-bLo
+	maxD := (n + m + 1) / 2
+	offset := min(maxD, diffCostLimit) + 1
+	// Furthest x reached from the start on each diagonal k = x-y, and from
+	// the end on each diagonal counted back from there
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+
+	delta := n - m
+	odd := delta%2 != 0
+	// Diagonals trimmed off either end once they leave the ranges
+	fLow, fHigh, bLow, bHigh := 0, 0, 0, 0
+	bestX, bestY := 0, 0
+	for step := 0; step < maxD; step++ {
+		if step > diffCostLimit {
+			// Too expensive to finish; split where the forward search got
+			// furthest, which must be strictly inside to make progress
+			if bestX+bestY > 0 && (bestX < n || bestY < m) {
+				return aLo + bestX, bLo + bestY, true
+			}
+			return 0, 0, false
+		}
+
+		for k := -step + fLow; k <= step-fHigh; k += 2 {
+			var fx int
+			if k == -step || (k != step && forward[offset+k-1] < forward[offset+k+1]) {
+				fx = forward[offset+k+1]
+			} else {
+				fx = forward[offset+k-1] + 1
+			}
+			fy := fx - k
+			for fx < n && fy < m && d.a[aLo+fx] == d.b[bLo+fy] {
+				fx++
+				fy++
+			}
+			forward[offset+k] = fx
+			switch {
+			case fx > n:
+				fHigh += 2
+			case fy > m:
+				fLow += 2
+			default:
+				if fx+fy > bestX+bestY {
+					bestX, bestY = fx, fy
+				}
+				if c := offset + delta - k; odd && c >= 0 && c < len(backward) && backward[c] >= 0 && fx >= n-backward[c] {
+					return aLo + fx, bLo + fy, true
+				}
+			}
+		}
+
+		for c := -step + bLow; c <= step-bHigh; c += 2 {
+			var bx int
+			if c == -step || (c != step && backward[offset+c-1] < backward[offset+c+1]) {
+				bx = backward[offset+c+1]
+			} else {
+				bx = backward[offset+c-1] + 1
+			}
+			by := bx - c
+			for bx < n && by < m && d.a[aHi-bx-1] == d.b[bHi-by-1] {
+				bx++
+				by++
+			}
+			backward[offset+c] = bx
+			switch {
+			case bx > n:
+				bHigh += 2
+			case by > m:
+				bLow += 2
+			default:
+				if k := offset + delta - c; !odd && k >= 0 && k < len(forward) && forward[k] >= 0 && forward[k] >= n-bx {
+					fx := forward[k]
+					return aLo + fx, bLo + fx - (k - offset), true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
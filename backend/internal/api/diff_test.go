@@ -0,0 +1,171 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestComputeDiffMinimal(t *testing.T) {
+	tests := []struct {
+		old, new string
+		changed  int // Lines added plus lines removed
+	}{
+		{"a\nb\nc", "a\nb\nc", 0},
+		{"a\nb\nc", "a\nx\nc", 2},
+		{"a\nb\nc\na\nb\nb\na", "c\nb\na\nb\na\nc", 5},
+		{"}\n}\n}", "}\n{\n}\n}", 1},
+		{"", "a\nb", 3},
+	}
+
+	for _, tt := range tests {
+		diff := computeDiff(tt.old, tt.new)
+		var oldLines, newLines []string
+		changed := 0
+		for _, line := range diff {
+			if line.Type != "added" {
+				oldLines = append(oldLines, line.Content)
+			}
+			if line.Type != "removed" {
+				newLines = append(newLines, line.Content)
+			}
+			if line.Type != "unchanged" {
+				changed++
+			}
+		}
+		if strings.Join(oldLines, "\n") != tt.old || strings.Join(newLines, "\n") != tt.new {
+			t.Errorf("%q -> %q: diff doesn't reproduce both sides: %+v", tt.old, tt.new, diff)
+		}
+		if changed != tt.changed {
+			t.Errorf("%q -> %q: expected %d changed lines, got %d", tt.old, tt.new, tt.changed, changed)
+		}
+	}
+}
+
+func TestComputeDiffLargeDocuments(t *testing.T) {
+	// Repetitive lines are the worst case, since most of them match
+	oldLines := make([]string, 50000)
+	newLines := make([]string, 50000)
+	for i := range oldLines {
+		oldLines[i] = []string{"}", "", "return nil", "if err != nil {"}[(i*7)%4]
+		newLines[i] = []string{"}", "", "return nil", "if err != nil {"}[(i*5)%4]
+	}
+	oldLines[25000] = "changed"
+
+	diff := computeDiff(strings.Join(oldLines, "\n"), strings.Join(newLines, "\n"))
+	var gotOld, gotNew int
+	for _, line := range diff {
+		if line.Type != "added" {
+			if line.Content != oldLines[line.OldLine-1] {
+				t.Fatalf("Line %+v doesn't match the old document", line)
+			}
+			gotOld++
+		}
+		if line.Type != "removed" {
+			if line.Content != newLines[line.NewLine-1] {
+				t.Fatalf("Line %+v doesn't match the new document", line)
+			}
+			gotNew++
+		}
+	}
+	if gotOld != len(oldLines) || gotNew != len(newLines) {
+		t.Errorf("Expected every line of both documents, got %d and %d", gotOld, gotNew)
+	}
+}
+
+func TestDiffHunks(t *testing.T) {
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10"
+	new := "1\nchanged\n3\n4\n5\n6\n7\n8\n9\n10\n11"
+	diff := computeDiff(old, new)
+
+	hunks := diffHunks(diff, 1)
+	if len(hunks) != 2 {
+		t.Fatalf("Expected 2 hunks, got %+v", hunks)
+	}
+	if hunks[0].Header != "@@ -1,3 +1,3 @@" || len(hunks[0].Lines) != 4 {
+		t.Errorf("Unexpected first hunk %+v", hunks[0])
+	}
+	if hunks[1].Header != "@@ -10 +10,2 @@" || hunks[1].NewStart != 10 || hunks[1].NewLines != 2 {
+		t.Errorf("Unexpected second hunk %+v", hunks[1])
+	}
+
+	if hunks := diffHunks(diff, 4); len(hunks) != 1 || hunks[0].OldLines != 10 {
+		t.Errorf("Expected touching context to merge the hunks, got %+v", hunks)
+	}
+	if hunks := diffHunks(diff, 0); len(hunks) != 2 || len(hunks[0].Lines) != 2 || hunks[1].Header != "@@ -10,0 +11 @@" {
+		t.Errorf("Expected only the changed lines, got %+v", hunks)
+	}
+	if hunks := diffHunks(computeDiff(old, old), 3); hunks == nil || len(hunks) != 0 {
+		t.Errorf("Expected no hunks without changes, got %+v", hunks)
+	}
+}
+
+func TestDiffVersionsPagination(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := api.database.CreateRoom(ctx, "paged", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	old, new := "a\nb\nc\nd", "a\nx\nc\nd\ne"
+	from, _ := api.database.CreateVersion(ctx, "paged", "v1", "", old, hashContent(old), "", false)
+	to, _ := api.database.CreateVersion(ctx, "paged", "v2", "", new, hashContent(new), "", false)
+
+	get := func(query string) diffResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		path := fmt.Sprintf("/api/versions/diff?from=%d&to=%d%s", from.ID, to.ID, query)
+		api.Routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var response diffResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode %s: %v", w.Body.String(), err)
+		}
+		return response
+	}
+
+	full := get("")
+	if len(full.Diff) != 6 || full.TotalLines != 6 || full.To.ID != to.ID {
+		t.Fatalf("Expected the whole diff, got %+v", full)
+	}
+
+	page := get("&offset=1&limit=2")
+	if len(page.Diff) != 2 || page.Diff[0] != full.Diff[1] || page.Diff[1] != full.Diff[2] {
+		t.Errorf("Expected lines 2 and 3 of the diff, got %+v", page.Diff)
+	}
+	if page.TotalLines != 6 || page.Offset != 1 || page.Limit != 2 {
+		t.Errorf("Unexpected paging fields %+v", page)
+	}
+	if page.Summary != full.Summary {
+		t.Errorf("Expected the summary of the whole diff, got %+v", page.Summary)
+	}
+
+	if past := get("&offset=10"); len(past.Diff) != 0 || past.TotalLines != 6 {
+		t.Errorf("Expected no lines past the end, got %+v", past)
+	}
+
+	hunked := get("&context=0")
+	if hunked.Diff != nil || len(hunked.Hunks) != 2 || hunked.TotalHunks == nil || *hunked.TotalHunks != 2 {
+		t.Fatalf("Expected two hunks instead of lines, got %+v", hunked)
+	}
+	if hunked.Hunks[0].Header != "@@ -2 +2 @@" || hunked.TotalLines != 6 {
+		t.Errorf("Unexpected hunks %+v", hunked)
+	}
+	if second := get("&context=0&offset=1"); len(second.Hunks) != 1 || second.Hunks[0].Header != hunked.Hunks[1].Header {
+		t.Errorf("Expected the second hunk, got %+v", second.Hunks)
+	}
+
+	w := httptest.NewRecorder()
+	path := fmt.Sprintf("/api/versions/diff?from=%d&to=%d&context=-1", from.ID, to.ID)
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a negative context, got %d", w.Code)
+	}
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+// DiffSummary condenses a diff into counts a UI can show as a "+N −M" badge
+type DiffSummary struct {
+	LinesAdded     int     `json:"lines_added"`
+	LinesRemoved   int     `json:"lines_removed"`
+	LinesUnchanged int     `json:"lines_unchanged"`
+	CharsChanged   int     `json:"chars_changed"` // Characters on added and removed lines
+	Similarity     float64 `json:"similarity"`    // Percentage of lines the two sides share
+}
+
+func summarizeDiff(diff []DiffLine) DiffSummary {
+	var s DiffSummary
+	for _, line := range diff {
+		switch line.Type {
+		case "added":
+			s.LinesAdded++
+			s.CharsChanged += utf8.RuneCountInString(line.Content)
+		case "removed":
+			s.LinesRemoved++
+			s.CharsChanged += utf8.RuneCountInString(line.Content)
+		default:
+			s.LinesUnchanged++
+		}
+	}
+
+	// Shared lines over the average length of the two sides
+	total := s.LinesAdded + s.LinesRemoved + 2*s.LinesUnchanged
+	s.Similarity = 100
+	if total > 0 {
+		s.Similarity = math.Round(1000*float64(2*s.LinesUnchanged)/float64(total)) / 10
+	}
+	return s
+}
+
+// VersionSummaryResponse compares a version with the one saved before it
+type VersionSummaryResponse struct {
+	Version  VersionResponse  `json:"version"`
+	Previous *VersionResponse `json:"previous,omitempty"` // Absent for a room's first version
+	Summary  DiffSummary      `json:"summary"`
+}
+
+// VersionSummaryHandler reports how a version differs from its predecessor
+// in the room without sending the diff itself
+func (a *API) VersionSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	versionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid version ID")
+		return
+	}
+
+	version, err := a.database.GetVersion(r.Context(), versionID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
+		return
+	}
+	if version == nil {
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Version not found")
+		return
+	}
+	if !a.authorizeVersion(w, r, version) {
+		return
+	}
+
+	previous, err := a.database.GetPreviousVersion(r.Context(), version.ID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get previous version")
+		return
+	}
+
+	response := VersionSummaryResponse{Version: newVersionResponse(version)}
+	if previous != nil {
+		p := newVersionResponse(previous)
+		response.Previous = &p
+		response.Summary = summarizeDiff(computeDiff(previous.Content, version.Content))
+	} else {
+		// Every line of a room's first version is new
+		var diff []DiffLine
+		for _, line := range strings.Split(version.Content, "\n") {
+			diff = append(diff, DiffLine{Type: "added", Content: line})
+		}
+		response.Summary = summarizeDiff(diff)
+	}
+
+	jsonResponse(w, http.StatusOK, response)
+}
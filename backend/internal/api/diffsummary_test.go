@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestSummarizeDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     DiffSummary
+	}{
+		{"Identical", "a\nb", "a\nb", DiffSummary{LinesUnchanged: 2, Similarity: 100}},
+		{"Both empty", "", "", DiffSummary{LinesUnchanged: 1, Similarity: 100}},
+		{"One line changed", "a\nb\nc\nd", "a\nB!\nc\nd", DiffSummary{LinesAdded: 1, LinesRemoved: 1, LinesUnchanged: 3, CharsChanged: 3, Similarity: 75}},
+		{"Appended", "a", "a\nnew", DiffSummary{LinesAdded: 1, LinesUnchanged: 1, CharsChanged: 3, Similarity: 66.7}},
+		{"Rewritten", "x", "yé", DiffSummary{LinesAdded: 1, LinesRemoved: 1, CharsChanged: 3, Similarity: 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := summarizeDiff(computeDiff(tt.old, tt.new)); got != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestVersionSummaryHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := api.database.CreateRoom(ctx, "summary-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	first, _ := api.database.CreateVersion(ctx, "summary-room", "v1", "", "a\nb", hashContent("a\nb"), "", false)
+	second, _ := api.database.CreateVersion(ctx, "summary-room", "v2", "", "a\nb\nc", hashContent("a\nb\nc"), "", false)
+
+	get := func(id int) (*httptest.ResponseRecorder, VersionSummaryResponse) {
+		req := httptest.NewRequest("GET", "/api/versions/"+strconv.Itoa(id)+"/summary", nil)
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, req)
+
+		var response VersionSummaryResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return w, response
+	}
+
+	w, summary := get(second.ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if summary.Previous == nil || summary.Previous.ID != first.ID {
+		t.Fatalf("Expected version %d as the predecessor, got %+v", first.ID, summary.Previous)
+	}
+	if summary.Summary.LinesAdded != 1 || summary.Summary.LinesRemoved != 0 || summary.Summary.LinesUnchanged != 2 {
+		t.Errorf("Expected one added line, got %+v", summary.Summary)
+	}
+
+	// A room's first version is compared with an empty document
+	_, summary = get(first.ID)
+	if summary.Previous != nil || summary.Summary.LinesAdded != 2 || summary.Summary.LinesRemoved != 0 {
+		t.Errorf("Expected the first version to add 2 lines with no predecessor, got %+v", summary)
+	}
+
+	if w, _ := get(99999); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing version, got %d", w.Code)
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+)
+
+// Comment sent on an idle event stream so proxies keep it open
+const eventsKeepAlive = 30 * time.Second
+
+// SetEventBroker makes the API publish to a broker shared with the hub, so
+// GET /api/events carries room open and close events too. Must be called
+// before serving requests.
+func (a *API) SetEventBroker(broker *events.Broker) {
+	a.events = broker
+}
+
+func (a *API) publish(eventType, roomID string, data interface{}) {
+	a.events.Publish(eventType, roomID, data)
+}
+
+// EventsHandler streams server events as SSE: each has the event's ID, its
+// type as the SSE event name, and the JSON event as data. ?room= and ?type=
+// (comma separated types or categories such as "version") narrow the
+// stream. A client that reconnects with Last-Event-ID first receives the
+// events it missed that the server still holds, preceded by a "reset" event
+// if some were lost. A client too slow to keep up is disconnected.
+func (a *API) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter := events.Filter{RoomID: r.URL.Query().Get("room")}
+	for _, t := range strings.Split(r.URL.Query().Get("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			filter.Types = append(filter.Types, t)
+		}
+	}
+
+	var lastID uint64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid Last-Event-ID")
+			return
+		}
+		lastID = id
+	}
+
+	sub, missed, complete := a.events.Subscribe(filter, lastID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, e := range missed {
+		writeEvent(w, e)
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			writeEvent(w, e)
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e events.Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+)
+
+// Reads the next SSE event from a stream, skipping comments
+func readSSE(t *testing.T, r *bufio.Reader) (name string, data string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return name, data
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	server := httptest.NewServer(api.Routes())
+	defer server.Close()
+
+	// Gzip is accepted to check events are not held back by compression
+	req, _ := http.NewRequest("GET", server.URL+"/api/events?type=room.created,version", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("Expected an uncompressed event stream, got %q (encoding %q)", ct, resp.Header.Get("Content-Encoding"))
+	}
+	stream := bufio.NewReader(resp.Body)
+
+	post := func(path, body string) {
+		t.Helper()
+		resp, err := http.Post(server.URL+path, "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST %s: expected 201, got %d", path, resp.StatusCode)
+		}
+	}
+	post("/api/rooms", `{"id":"notes","name":"Notes"}`)
+	post("/api/rooms", `{"id":"notes","name":"Notes"}`) // Already exists; no event
+	post("/api/rooms/notes/versions", `{"name":"Draft","content":"secret text"}`)
+
+	name, data := readSSE(t, stream)
+	if name != events.RoomCreated {
+		t.Fatalf("Expected room.created first, got %s %s", name, data)
+	}
+
+	name, data = readSSE(t, stream)
+	if name != events.VersionCreated {
+		t.Fatalf("Expected version.created, got %s %s", name, data)
+	}
+	var e struct {
+		ID     uint64          `json:"id"`
+		RoomID string          `json:"room_id"`
+		Data   VersionResponse `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(data), &e); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if e.RoomID != "notes" || e.Data.Name != "Draft" || e.Data.Content != "" {
+		t.Errorf("Expected the version without its content, got %+v", e)
+	}
+
+	// Resuming after the first event replays the version
+	req, _ = http.NewRequest("GET", server.URL+"/api/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to resume stream: %v", err)
+	}
+	defer resumed.Body.Close()
+	if name, _ := readSSE(t, bufio.NewReader(resumed.Body)); name != events.VersionCreated {
+		t.Errorf("Expected the missed version.created on resume, got %s", name)
+	}
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"errors"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+var (
+	// ErrRoomExists is returned by ImportRoom when the room ID is taken
+	ErrRoomExists = errors.New("room already exists")
+	// ErrJoinSecretMissing is returned by ImportRoom for a protected room
+	// exported without its join secret, by an older server or as part of a
+	// bulk export
+	ErrJoinSecretMissing = errors.New("room is protected but the export holds no join secret")
+	// ErrWorkspaceMissing is returned by ImportRoom when the room's
+	// workspace doesn't exist on this server
+	ErrWorkspaceMissing = errors.New("room's workspace does not exist")
+)
+
+// ExportRoom returns a room with its stored document, saved versions and
+// join secret, or nil if the room does not exist
+func ExportRoom(ctx context.Context, database *db.Database, roomID string) (*RoomExportData, error) {
+	room, err := database.GetRoom(ctx, roomID)
+	if err != nil || room == nil {
+		return nil, err
+	}
+	export, err := exportRoom(ctx, database, room)
+	if err != nil {
+		return nil, err
+	}
+	export.JoinSecretHash, err = database.JoinSecretHash(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// ImportRoom recreates an exported room under its original ID, which must
+// be free: no room and no stored updates or snapshot. Versions get new IDs
+// and creation times but keep their order. The room keeps its join secret
+// and goes back into its workspace, which must exist; a protected room
+// exported without its secret is refused rather than opened to everyone.
+func ImportRoom(ctx context.Context, database *db.Database, export *RoomExportData) error {
+	roomID := export.Room.ID
+	if export.Room.Protected && export.JoinSecretHash == "" {
+		return ErrJoinSecretMissing
+	}
+	if err := db.ValidateJoinSecretHash(export.JoinSecretHash); err != nil {
+		return err
+	}
+	if export.Room.Workspace != "" {
+		workspace, err := database.GetWorkspace(ctx, export.Room.Workspace)
+		if err != nil {
+			return err
+		}
+		if workspace == nil {
+			return ErrWorkspaceMissing
+		}
+	}
+
+	existing, err := database.GetRoom(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return ErrRoomExists
+	}
+	// Without strict rooms a room can be edited before it is created
+	count, err := database.GetUpdateCount(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	snapshot, _, err := database.GetSnapshot(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if count > 0 || len(snapshot) > 0 {
+		return ErrRoomExists
+	}
+
+	// Checked first so a snapshot from a newer server leaves no half-imported room
+	snapshotUpdates, err := compaction.DecodeSnapshot(export.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	if export.Room.Workspace != "" {
+		err = database.AddRoomToWorkspace(ctx, export.Room.Workspace, roomID, export.Room.Name)
+	} else {
+		err = database.CreateRoom(ctx, roomID, export.Room.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if err := database.SetJoinSecretHash(ctx, roomID, export.JoinSecretHash); err != nil {
+		return err
+	}
+	if export.Room.Language != "" {
+		if _, err := database.SetRoomLanguage(ctx, roomID, export.Room.Language); err != nil {
+			return err
+		}
+	}
+	if len(export.Snapshot) > 0 {
+		if err := database.SaveSnapshot(ctx, roomID, export.Snapshot, len(snapshotUpdates)); err != nil {
+			return err
+		}
+	}
+	if len(export.Updates) > 0 {
+		if err := database.SaveUpdates(ctx, roomID, export.Updates); err != nil {
+			return err
+		}
+	}
+
+	// Exports list versions newest first. Hashes are recomputed since older
+	// exports carry truncated ones.
+	for i := len(export.Versions) - 1; i >= 0; i-- {
+		v := export.Versions[i]
+		created, err := database.CreateVersion(ctx, roomID, v.Name, v.Description, v.Content, hashContent(v.Content), v.CreatedBy, v.IsAuto)
+		if err != nil {
+			return err
+		}
+		if v.Pinned {
+			if _, err := database.SetVersionPinned(ctx, created.ID, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	if export.Room.ArchivedAt != nil {
+		return database.ArchiveRoom(ctx, roomID)
+	}
+	return nil
+}
+
+func exportRoom(ctx context.Context, database *db.Database, room *db.Room) (*RoomExportData, error) {
+	snapshot, _, err := database.GetSnapshot(ctx, room.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	updates, err := database.GetAllUpdates(ctx, room.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := database.GetVersionCount(ctx, room.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := database.ListVersions(ctx, room.ID, count, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &RoomExportData{
+		Room: RoomResponse{
+			ID:         room.ID,
+			Name:       room.Name,
+			CreatedAt:  room.CreatedAt,
+			UpdatedAt:  room.UpdatedAt,
+			ArchivedAt: room.ArchivedAt,
+			Protected:  room.Protected,
+			Workspace:  room.Workspace,
+			Language:   room.Language,
+		},
+		Snapshot:    snapshot,
+		Updates:     updates,
+		Versions:    make([]VersionResponse, len(versions)),
+		UpdateCount: len(updates),
+	}
+	if export.Updates == nil {
+		export.Updates = [][]byte{}
+	}
+
+	for i, v := range versions {
+		export.Versions[i] = newVersionResponse(&v)
+		export.Versions[i].Content = v.Content
+	}
+
+	return export, nil
+}
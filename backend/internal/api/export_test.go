@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
+)
+
+func TestExportImportRoom(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := api.database.SaveUpdates(ctx, "source", [][]byte{{0, 2, 1}, {0, 2, 2}}); err != nil {
+		t.Fatalf("Failed to save updates: %v", err)
+	}
+	for _, name := range []string{"first", "second"} {
+		if _, err := api.database.CreateVersion(ctx, "source", name, "", name+" content", name, "", false); err != nil {
+			t.Fatalf("Failed to create version: %v", err)
+		}
+	}
+
+	export, err := ExportRoom(ctx, api.database, "source")
+	if err != nil || export == nil {
+		t.Fatalf("Failed to export room: %v", err)
+	}
+	if missing, err := ExportRoom(ctx, api.database, "missing"); err != nil || missing != nil {
+		t.Errorf("Expected nil export for a missing room, got %v (err %v)", missing, err)
+	}
+
+	if err := ImportRoom(ctx, api.database, export); err != ErrRoomExists {
+		t.Errorf("Expected ErrRoomExists, got %v", err)
+	}
+
+	export.Room.ID = "copy"
+	if err := ImportRoom(ctx, api.database, export); err != nil {
+		t.Fatalf("Failed to import room: %v", err)
+	}
+
+	updates, err := api.database.GetAllUpdates(ctx, "copy")
+	if err != nil || len(updates) != 2 {
+		t.Errorf("Expected 2 imported updates, got %d (err %v)", len(updates), err)
+	}
+	versions, err := api.database.ListVersions(ctx, "copy", 10, 0)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected 2 imported versions, got %d (err %v)", len(versions), err)
+	}
+	if versions[0].Name != "second" || versions[1].Name != "first" {
+		t.Errorf("Expected versions to keep their order, got %s before %s", versions[0].Name, versions[1].Name)
+	}
+}
+
+func TestRoomArchiveRoundTrip(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := api.database.CreateRoom(ctx, "source", "Source"); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	if err := api.database.SaveSnapshot(ctx, "source", compaction.EncodeSnapshot([][]byte{{0, 2, 1}}), 1); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	if err := api.database.SaveUpdates(ctx, "source", [][]byte{{0, 2, 2}, {0, 2, 3}}); err != nil {
+		t.Fatalf("Failed to save updates: %v", err)
+	}
+	if _, err := api.database.CreateVersion(ctx, "source", "v1", "", "hello", hashContent("hello"), "", false); err != nil {
+		t.Fatalf("Failed to create version: %v", err)
+	}
+
+	serve := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(body)))
+		return w
+	}
+
+	if w := serve("GET", "/api/rooms/ghost/archive", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 archiving a missing room, got %d", w.Code)
+	}
+	w := serve("GET", "/api/rooms/source/archive", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ArchiveContentType {
+		t.Fatalf("Expected an archive, got status %d (%s)", w.Code, w.Header().Get("Content-Type"))
+	}
+	archive := w.Body.Bytes()
+
+	if w := serve("POST", "/api/rooms/import", archive); w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 importing over the source, got %d", w.Code)
+	}
+	if w := serve("POST", "/api/rooms/import?id=copy", []byte("not an archive")); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a malformed archive, got %d", w.Code)
+	}
+	if w := serve("POST", "/api/rooms/import?id=copy", archive); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	room, _ := api.database.GetRoom(ctx, "copy")
+	if room == nil || room.Name != "Source" {
+		t.Fatalf("Expected the room imported with its name, got %+v", room)
+	}
+	snapshot, count, _ := api.database.GetSnapshot(ctx, "copy")
+	if updates, _ := compaction.DecodeSnapshot(snapshot); count != 1 || len(updates) != 1 || updates[0][2] != 1 {
+		t.Errorf("Expected the snapshot of 1 update, got %v (count %d)", updates, count)
+	}
+	if updates, _ := api.database.GetAllUpdates(ctx, "copy"); len(updates) != 2 || updates[1][2] != 3 {
+		t.Errorf("Expected 2 updates in order, got %v", updates)
+	}
+	if versions, _ := api.database.ListVersions(ctx, "copy", 10, 0); len(versions) != 1 || versions[0].Content != "hello" {
+		t.Errorf("Expected the version imported, got %+v", versions)
+	}
+}
+
+func TestImportRoomKeepsAccess(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	_, owner, _ := api.database.CreateUser(ctx, "owner", "#112233", nil)
+	api.database.CreateWorkspace(ctx, "team", "Team", owner.ID)
+	api.database.AddRoomToWorkspace(ctx, "team", "vault", "Vault")
+	if err := api.database.SetJoinSecret(ctx, "vault", "hunter2"); err != nil {
+		t.Fatalf("Failed to set join secret: %v", err)
+	}
+
+	export, err := ExportRoom(ctx, api.database, "vault")
+	if err != nil || export == nil {
+		t.Fatalf("Failed to export room: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteRoomArchive(&buf, export); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+	export, err = ReadRoomArchive(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+
+	export.Room.ID = "copy"
+	if err := ImportRoom(ctx, api.database, export); err != nil {
+		t.Fatalf("Failed to import room: %v", err)
+	}
+	room, _ := api.database.GetRoom(ctx, "copy")
+	if room == nil || !room.Protected || room.Workspace != "team" {
+		t.Fatalf("Expected the copy protected and in the workspace, got %+v", room)
+	}
+	if ok, _ := api.database.CheckJoinSecret(ctx, "copy", "hunter2"); !ok {
+		t.Error("Expected the copy to open with the original secret")
+	}
+
+	// Without its secret or its workspace, a room is refused rather than
+	// imported open to everyone
+	export.Room.ID = "unlocked"
+	export.JoinSecretHash = ""
+	if err := ImportRoom(ctx, api.database, export); !errors.Is(err, ErrJoinSecretMissing) {
+		t.Errorf("Expected ErrJoinSecretMissing, got %v", err)
+	}
+	export.Room.Protected = false
+	export.Room.Workspace = "elsewhere"
+	if err := ImportRoom(ctx, api.database, export); !errors.Is(err, ErrWorkspaceMissing) {
+		t.Errorf("Expected ErrWorkspaceMissing, got %v", err)
+	}
+	if room, _ := api.database.GetRoom(ctx, "unlocked"); room != nil {
+		t.Errorf("Expected nothing imported, got %+v", room)
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+type AIFixRequest struct {
+	Code     string `json:"code"`
+	Language string `json:"language"`
+	Error    string `json:"error"`          // Compiler or linter message
+	Line     int    `json:"line,omitempty"` // Where the error was reported, if known
+	Provider string `json:"provider,omitempty"`
+}
+
+// AIFixResponse holds the suggested fix as a unified diff against the
+// request's code, and the code with it applied. Both are empty when the
+// provider suggests no change.
+type AIFixResponse struct {
+	Patch string `json:"patch"`
+	Fixed string `json:"fixed"`
+}
+
+// Tokens allowed for the provider's reply
+const fixMaxTokens = 1000
+
+// AIFixHandler asks the AI provider for the smallest change that fixes an
+// error in the given code. The provider replies with a unified diff, which
+// is applied here so a patch that doesn't fit the code is never returned;
+// the response carries a diff recomputed from the result.
+func (a *API) AIFixHandler(w http.ResponseWriter, r *http.Request) {
+	var req AIFixRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if req.Language == "" {
+		req.Language = "javascript"
+	}
+
+	systemPrompt := a.systemPrompt(r.Context(), promptFix, map[string]string{
+		"language":    req.Language,
+		"instruction": "",
+		"framework":   "",
+	})
+	userPrompt := fmt.Sprintf("Fix this error in the %s code below:\n\n%s", req.Language, req.Error)
+	if req.Line > 0 {
+		userPrompt += fmt.Sprintf("\n\nThe error is reported at line %d.", req.Line)
+	}
+	userPrompt += fmt.Sprintf("\n\n```%s\n%s\n```", req.Language, req.Code)
+
+	reply, err := a.ai(r.Context(), req.Provider, systemPrompt, userPrompt, fixMaxTokens)
+	if err != nil {
+		log.Printf("AI fix error: %v", err)
+		errorResponse(w, http.StatusServiceUnavailable, apierror.AIUnavailable, "AI service unavailable")
+		return
+	}
+
+	fixed, err := applyPatch(req.Code, reply)
+	if errors.Is(err, errNoHunks) && strings.TrimSpace(reply) == "" {
+		jsonResponse(w, http.StatusOK, AIFixResponse{})
+		return
+	}
+	if err != nil {
+		log.Printf("AI fix returned an unusable patch: %v in %q", err, truncateForLog(reply))
+		errorResponse(w, http.StatusServiceUnavailable, apierror.AIUnavailable, "AI service returned a patch that does not apply")
+		return
+	}
+
+	patch := renderUnifiedDiff(computeDiff(req.Code, fixed), "a/code", "b/code")
+	if patch == "" {
+		fixed = ""
+	}
+	jsonResponse(w, http.StatusOK, AIFixResponse{Patch: patch, Fixed: fixed})
+}
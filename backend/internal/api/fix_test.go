@@ -0,0 +1,54 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAIFix(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	var reply, prompt string
+	api.ai = func(ctx context.Context, provider, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+		prompt = userPrompt
+		return reply, nil
+	}
+
+	fix := func() *httptest.ResponseRecorder {
+		body := `{"code": "x = 1\nprint(y)", "language": "python", "error": "NameError: name 'y' is not defined", "line": 2}`
+		req := httptest.NewRequest("POST", "/api/ai/fix", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		api.AIFixHandler(w, req)
+		return w
+	}
+
+	reply = "```diff\n@@ -1,2 +1,2 @@\n x = 1\n-print(y)\n+print(x)\n```"
+	w := fix()
+	var response AIFixResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || response.Fixed != "x = 1\nprint(x)" {
+		t.Fatalf("Expected the fixed code, got %d %+v", w.Code, response)
+	}
+	if want := "--- a/code\n+++ b/code\n@@ -1,2 +1,2 @@\n x = 1\n-print(y)\n+print(x)\n"; response.Patch != want {
+		t.Errorf("Expected patch:\n%s\ngot:\n%s", want, response.Patch)
+	}
+	if !strings.Contains(prompt, "NameError") || !strings.Contains(prompt, "line 2") {
+		t.Errorf("Expected the error and its line in the prompt, got:\n%s", prompt)
+	}
+
+	reply = ""
+	if w := fix(); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "print") {
+		t.Errorf("Expected an empty fix for an empty reply, got %d %s", w.Code, w.Body)
+	}
+
+	reply = "@@ -1 +1 @@\n-z = 1\n+z = 2\n"
+	if w := fix(); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for a patch that does not apply, got %d", w.Code)
+	}
+}
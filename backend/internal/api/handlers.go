@@ -1,33 +1,115 @@
 package api
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"bufio"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
 	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	"github.com/manpreetbhatti/lattice/backend/internal/embeddings"
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+	"github.com/manpreetbhatti/lattice/backend/internal/metrics"
+	"github.com/manpreetbhatti/lattice/backend/internal/sandbox"
+	"github.com/manpreetbhatti/lattice/backend/internal/telemetry"
+	"github.com/manpreetbhatti/lattice/backend/internal/tracing"
 	"github.com/manpreetbhatti/lattice/backend/internal/ws"
 )
 
 type API struct {
-	hub      *ws.Hub
-	database *db.Database
+	hub        *ws.Hub
+	database   *db.Database
+	compaction *compaction.Service
+	embeddings *embeddings.Index
+	sandbox    *sandbox.Runner
+	guests     *auth.Issuer
+	events     *events.Broker
+	telemetry  *telemetry.Collector
+	metrics    *metrics.Collector
+
+	// Sends a prompt to an AI provider; providers.complete outside tests
+	ai        func(ctx context.Context, provider, systemPrompt, userPrompt string, maxTokens int) (string, error)
+	providers *aiRouter
+
+	versionNotifiers []VersionNotifier
+
+	// Largest accepted version content in bytes; zero means unlimited
+	maxVersionBytes int
+	autoSave        AutoSavePolicy
+	timeouts        Timeouts
+	bodyLimits      BodyLimits
+
+	// Path prefix the server is mounted under, such as "/lattice"; empty at
+	// the root
+	basePath string
 }
 
+// Default limit on saved version content
+const DefaultMaxVersionBytes = 5 << 20
+
 func New(hub *ws.Hub, database *db.Database) *API {
+	providers := newAIRouter()
 	return &API{
-		hub:      hub,
-		database: database,
+		hub:             hub,
+		database:        database,
+		events:          events.NewBroker(),
+		ai:              providers.complete,
+		providers:       providers,
+		maxVersionBytes: DefaultMaxVersionBytes,
+		autoSave:        DefaultAutoSavePolicy(),
+		timeouts:        DefaultTimeouts(),
+		bodyLimits:      DefaultBodyLimits(),
+	}
+}
+
+// VersionNotifier hears about versions saved through the API; they are also
+// published as version.created events
+type VersionNotifier interface {
+	VersionSaved(v *db.Version)
+}
+
+// AddVersionNotifier registers a notifier for saved versions. Must be called
+// before serving requests.
+func (a *API) AddVersionNotifier(notifier VersionNotifier) {
+	a.versionNotifiers = append(a.versionNotifiers, notifier)
+}
+
+func (a *API) versionSaved(v *db.Version) {
+	a.publish(events.VersionCreated, v.RoomID, newVersionResponse(v))
+	for _, notifier := range a.versionNotifiers {
+		notifier.VersionSaved(v)
 	}
 }
 
+// SetCompactionService enables the admin compaction endpoints
+func (a *API) SetCompactionService(service *compaction.Service) {
+	a.compaction = service
+}
+
+// SetBasePath tells the API the path prefix it is served under, which the
+// OpenAPI document then names as its server. Routes themselves are
+// registered without it; strip the prefix before they see a request.
+func (a *API) SetBasePath(basePath string) {
+	a.basePath = basePath
+}
+
+// SetMaxVersionBytes limits the size of saved version content
+func (a *API) SetMaxVersionBytes(n int) {
+	a.maxVersionBytes = n
+}
+
 func jsonResponse(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -37,8 +119,19 @@ func jsonResponse(w http.ResponseWriter, status int, data interface{}) {
 	}
 }
 
-func errorResponse(w http.ResponseWriter, status int, message string) {
-	jsonResponse(w, status, map[string]string{"error": message})
+func errorResponse(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, status, code, message, nil)
+}
+
+// Reports a failed write: a 503 asking the client to retry when the database
+// stayed locked, otherwise a 500 with message
+func databaseError(w http.ResponseWriter, err error, message string) {
+	if db.IsBusy(err) {
+		w.Header().Set("Retry-After", "1")
+		errorResponse(w, http.StatusServiceUnavailable, apierror.DatabaseBusy, "Database busy, try again shortly")
+		return
+	}
+	errorResponse(w, http.StatusInternalServerError, apierror.Internal, message)
 }
 
 func (a *API) HealthHandler(w http.ResponseWriter, r *http.Request) {
@@ -48,19 +141,46 @@ func (a *API) HealthHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// MemoryStats is the server process's memory use
+type MemoryStats struct {
+	HeapAllocBytes  uint64 `json:"heap_alloc_bytes"`
+	SysBytes        uint64 `json:"sys_bytes"`
+	Goroutines      int    `json:"goroutines"`
+	LoadedRooms     int    `json:"loaded_rooms"`      // Rooms with state in memory
+	RoomUpdateBytes int64  `json:"room_update_bytes"` // Update bytes those rooms keep in memory
+}
+
+func (a *API) memoryStats() MemoryStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	rooms, roomBytes := a.hub.LoadedRoomBytes()
+	return MemoryStats{
+		HeapAllocBytes:  m.HeapAlloc,
+		SysBytes:        m.Sys,
+		Goroutines:      runtime.NumGoroutine(),
+		LoadedRooms:     rooms,
+		RoomUpdateBytes: roomBytes,
+	}
+}
+
 func (a *API) StatsHandler(w http.ResponseWriter, r *http.Request) {
 	stats := map[string]any{
 		"active_rooms":   a.hub.GetRoomCount(),
 		"active_clients": a.hub.GetClientCount(),
+		"send":           a.hub.GetSendStats(),
+		"connections":    a.hub.GetConnectionLimitStats(),
+		"memory":         a.memoryStats(),
+		"write_behind":   a.hub.GetWriteBehindStats(),
 		"timestamp":      time.Now().UTC().Format(time.RFC3339),
 	}
 
 	if a.database != nil {
-		dbStats, err := a.database.GetStats()
+		dbStats, err := a.database.GetStats(r.Context())
 		if err == nil {
 			stats["total_rooms"] = dbStats["room_count"]
 			stats["total_updates"] = dbStats["update_count"]
 		}
+		stats["wal"] = a.database.WALStats()
 	}
 
 	jsonResponse(w, http.StatusOK, stats)
@@ -69,183 +189,391 @@ func (a *API) StatsHandler(w http.ResponseWriter, r *http.Request) {
 // Room handlers
 
 type RoomResponse struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name,omitempty"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	ActiveUsers int       `json:"active_users"`
-	UpdateCount int       `json:"update_count,omitempty"`
+	ID          string     `json:"id"`
+	Name        string     `json:"name,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ArchivedAt  *time.Time `json:"archived_at,omitempty"`
+	Protected   bool       `json:"protected,omitempty"`
+	Workspace   string     `json:"workspace,omitempty"`
+	Language    string     `json:"language,omitempty"`
+	ActiveUsers int        `json:"active_users"`
+	UpdateCount int        `json:"update_count,omitempty"`
+	Usage       *RoomUsage `json:"usage,omitempty"`
+
+	BranchedFrom *db.Branch `json:"branched_from,omitempty"` // Set on branches
+
+	// Only returned when a join code is generated
+	JoinCode string `json:"join_code,omitempty"`
+}
+
+// RoomUsage reports a room's storage against its limits
+type RoomUsage struct {
+	db.RoomUsage
+	LiveUpdateBytes int64 `json:"live_update_bytes"`
+	MaxRoomBytes    int64 `json:"max_room_bytes,omitempty"`
+	MaxVersionBytes int   `json:"max_version_bytes,omitempty"`
+}
+
+// Returns a room's stored usage with the limits that apply to it, which
+// come from its workspace when that sets them
+func (a *API) roomUsage(ctx context.Context, room *db.Room) (*RoomUsage, error) {
+	stored, err := a.database.GetRoomUsage(ctx, room.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	maxRoomBytes := a.hub.MaxRoomBytes()
+	if room.Workspace != "" {
+		if workspace, err := a.database.GetWorkspace(ctx, room.Workspace); err == nil && workspace != nil && workspace.MaxRoomBytes > 0 {
+			maxRoomBytes = workspace.MaxRoomBytes
+		}
+	}
+
+	return &RoomUsage{
+		RoomUsage:       *stored,
+		LiveUpdateBytes: a.hub.RoomBytes(room.ID),
+		MaxRoomBytes:    maxRoomBytes,
+		MaxVersionBytes: a.maxVersionBytes,
+	}, nil
 }
 
 type CreateRoomRequest struct {
 	ID   string `json:"id"`
 	Name string `json:"name,omitempty"`
+
+	// Optional join secret: a chosen password, or a generated join code
+	Password string `json:"password,omitempty"`
+	JoinCode bool   `json:"join_code,omitempty"`
+
+	// Workspace to create the room in; needs a member's identity token
+	Workspace string `json:"workspace,omitempty"`
+
+	// Editor language of the document, such as "python"
+	Language string `json:"language,omitempty"`
 }
 
-func (a *API) ListRoomsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
+// roomCursorToken is the decoded form of the opaque next_cursor value
+type roomCursorToken struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func encodeRoomCursor(token roomCursorToken) string {
+	data, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeRoomCursor(cursor string) (*roomCursorToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
 	}
 
-	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	var token roomCursorToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+	if !db.IsValidRoomSort(token.Sort) || (token.Order != "asc" && token.Order != "desc") {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &token, nil
+}
+
+func (a *API) ListRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
 	if limit <= 0 || limit > 100 {
 		limit = 20
 	}
 
-	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	offset, _ := strconv.Atoi(query.Get("offset"))
 	if offset < 0 {
 		offset = 0
 	}
 
-	rooms, err := a.database.ListRooms(limit, offset)
-	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to list rooms")
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "updated_at"
+	}
+	if !db.IsValidRoomSort(sort) {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "sort must be one of: created_at, updated_at, name")
+		return
+	}
+
+	order := strings.ToLower(query.Get("order"))
+	if order == "" {
+		order = "desc"
+	}
+	if order != "asc" && order != "desc" {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "order must be asc or desc")
 		return
 	}
 
+	var filter db.RoomFilter
+	filter.NameQuery = strings.TrimSpace(query.Get("q"))
+
+	// Listings cover one workspace at a time, or the rooms outside any
+	workspace := query.Get("workspace")
+	if workspace != "" && !a.isWorkspaceMember(w, r, workspace) {
+		return
+	}
+	filter.Workspace = &workspace
+
+	if updatedAfter := query.Get("updated_after"); updatedAfter != "" {
+		t, err := time.Parse(time.RFC3339, updatedAfter)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "updated_after must be an RFC3339 timestamp")
+			return
+		}
+		filter.UpdatedAfter = &t
+	}
+
 	activeRooms := a.hub.GetActiveRooms()
 
-	response := make([]RoomResponse, len(rooms))
-	for i, room := range rooms {
+	if active := query.Get("active"); active != "" {
+		activeOnly, err := strconv.ParseBool(active)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "active must be true or false")
+			return
+		}
+		if activeOnly {
+			filter.IDs = make([]string, 0, len(activeRooms))
+			for roomID := range activeRooms {
+				filter.IDs = append(filter.IDs, roomID)
+			}
+		}
+	}
+
+	opts := db.RoomListOptions{
+		RoomFilter: filter,
+		Limit:      limit,
+		Offset:     offset,
+		Sort:       sort,
+		Desc:       order == "desc",
+	}
+
+	// A cursor pins the sort order it was issued for
+	if cursor := query.Get("cursor"); cursor != "" {
+		token, err := decodeRoomCursor(cursor)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid cursor")
+			return
+		}
+		sort, order = token.Sort, token.Order
+		opts.Sort = token.Sort
+		opts.Desc = token.Order == "desc"
+		opts.Cursor = &db.RoomCursor{Value: token.Value, ID: token.ID}
+		opts.Offset = 0
+		offset = 0
+	}
+
+	page, err := a.database.ListRoomsPage(r.Context(), opts)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list rooms")
+		return
+	}
+
+	total, err := a.database.CountRooms(r.Context(), filter)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to count rooms")
+		return
+	}
+
+	response := make([]RoomResponse, len(page.Rooms))
+	for i, room := range page.Rooms {
 		response[i] = RoomResponse{
 			ID:          room.ID,
 			Name:        room.Name,
 			CreatedAt:   room.CreatedAt,
 			UpdatedAt:   room.UpdatedAt,
+			Protected:   room.Protected,
+			Workspace:   room.Workspace,
 			ActiveUsers: activeRooms[room.ID],
 		}
 	}
 
-	jsonResponse(w, http.StatusOK, map[string]interface{}{
-		"rooms":  response,
-		"limit":  limit,
-		"offset": offset,
-	})
+	result := map[string]interface{}{
+		"rooms":       response,
+		"limit":       limit,
+		"offset":      offset,
+		"sort":        sort,
+		"order":       order,
+		"total_count": total,
+	}
+	if page.Next != nil {
+		result["next_cursor"] = encodeRoomCursor(roomCursorToken{
+			Sort:  sort,
+			Order: order,
+			Value: page.Next.Value,
+			ID:    page.Next.ID,
+		})
+	}
+
+	jsonResponse(w, http.StatusOK, result)
 }
 
 func (a *API) CreateRoomHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+	var req CreateRoomRequest
+	if !decodeRequest(w, r, &req) || !a.allowedRoomID(w, "id", req.ID) {
 		return
 	}
 
-	var req CreateRoomRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid request body")
-		return
+	secret := req.Password
+	if req.JoinCode {
+		secret = db.GenerateJoinCode()
 	}
 
-	if req.ID == "" {
-		errorResponse(w, http.StatusBadRequest, "Room ID is required")
+	existing, err := a.database.GetRoom(r.Context(), req.ID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
 		return
 	}
-
-	if err := a.database.CreateRoom(req.ID, req.Name); err != nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to create room")
+	if secret != "" && existing != nil {
+		// Securing an existing room goes through the join secret API, which
+		// checks the current secret
+		errorResponse(w, http.StatusConflict, apierror.RoomExists, "Room already exists")
 		return
 	}
 
-	room, err := a.database.GetRoom(req.ID)
+	if req.Workspace == "" {
+		if existing != nil && !a.authorizeRoomWorkspace(w, r, req.ID) {
+			return
+		}
+		if err := a.database.CreateRoom(r.Context(), req.ID, req.Name); err != nil {
+			databaseError(w, err, "Failed to create room")
+			return
+		}
+	} else {
+		// Moving an existing room in goes through the workspace API, which
+		// only owners may use
+		if existing != nil && existing.Workspace != req.Workspace {
+			errorResponse(w, http.StatusConflict, apierror.RoomExists, "Room already exists")
+			return
+		}
+		if !a.isWorkspaceMember(w, r, req.Workspace) {
+			return
+		}
+		if err := a.database.AddRoomToWorkspace(r.Context(), req.Workspace, req.ID, req.Name); err != nil {
+			a.workspaceRoomError(w, err)
+			return
+		}
+	}
+
+	if secret != "" {
+		if err := a.database.SetJoinSecret(r.Context(), req.ID, secret); err != nil {
+			databaseError(w, err, "Failed to set join secret")
+			return
+		}
+	}
+	if req.Language != "" {
+		if _, err := a.database.SetRoomLanguage(r.Context(), req.ID, req.Language); err != nil {
+			databaseError(w, err, "Failed to set language")
+			return
+		}
+	}
+
+	room, err := a.database.GetRoom(r.Context(), req.ID)
 	if err != nil || room == nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to get room")
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
 		return
 	}
 
-	jsonResponse(w, http.StatusCreated, RoomResponse{
+	response := RoomResponse{
 		ID:        room.ID,
 		Name:      room.Name,
 		CreatedAt: room.CreatedAt,
 		UpdatedAt: room.UpdatedAt,
-	})
+		Protected: room.Protected,
+		Workspace: room.Workspace,
+		Language:  room.Language,
+	}
+	if existing == nil {
+		a.publish(events.RoomCreated, room.ID, response)
+	}
+	if req.JoinCode {
+		response.JoinCode = secret
+	}
+
+	jsonResponse(w, http.StatusCreated, response)
 }
 
 func (a *API) GetRoomHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
-	}
-
-	// Extract room ID from path: /api/rooms/{id}
-	path := strings.TrimPrefix(r.URL.Path, "/api/rooms/")
-	roomID := strings.TrimSuffix(path, "/")
+	roomID := r.PathValue("id")
 
-	if roomID == "" {
-		errorResponse(w, http.StatusBadRequest, "Room ID is required")
+	room, err := a.database.GetRoom(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
 		return
 	}
 
-	room, err := a.database.GetRoom(roomID)
-	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to get room")
+	if room == nil {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found")
 		return
 	}
 
-	if room == nil {
-		errorResponse(w, http.StatusNotFound, "Room not found")
+	if room.Workspace != "" && !a.isWorkspaceMember(w, r, room.Workspace) {
 		return
 	}
 
-	updateCount, _ := a.database.GetUpdateCount(roomID)
+	updateCount, _ := a.database.GetUpdateCount(r.Context(), roomID)
 	activeRooms := a.hub.GetActiveRooms()
+	usage, _ := a.roomUsage(r.Context(), room)
+
+	branch, _ := a.database.GetBranch(r.Context(), roomID)
 
 	jsonResponse(w, http.StatusOK, RoomResponse{
-		ID:          room.ID,
-		Name:        room.Name,
-		CreatedAt:   room.CreatedAt,
-		UpdatedAt:   room.UpdatedAt,
-		ActiveUsers: activeRooms[roomID],
-		UpdateCount: updateCount,
+		ID:           room.ID,
+		Name:         room.Name,
+		CreatedAt:    room.CreatedAt,
+		UpdatedAt:    room.UpdatedAt,
+		ArchivedAt:   room.ArchivedAt,
+		Protected:    room.Protected,
+		Workspace:    room.Workspace,
+		Language:     room.Language,
+		ActiveUsers:  activeRooms[roomID],
+		UpdateCount:  updateCount,
+		Usage:        usage,
+		BranchedFrom: branch,
 	})
 }
 
 func (a *API) DeleteRoomHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+	roomID := r.PathValue("id")
+
+	room, err := a.database.GetRoom(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
 		return
 	}
-
-	path := strings.TrimPrefix(r.URL.Path, "/api/rooms/")
-	roomID := strings.TrimSuffix(path, "/")
-
-	if roomID == "" {
-		errorResponse(w, http.StatusBadRequest, "Room ID is required")
+	if room != nil && room.Workspace != "" && !a.isWorkspaceMember(w, r, room.Workspace) {
 		return
 	}
 
-	if err := a.database.DeleteRoom(roomID); err != nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to delete room")
+	if err := a.deleteRoom(r.Context(), roomID); errors.Is(err, ws.ErrHubStopped) {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Server is shutting down")
 		return
+	} else if err != nil {
+		databaseError(w, err, "Failed to delete room")
+		return
+	}
+	if room != nil {
+		a.publish(events.RoomDeleted, roomID, nil)
 	}
 
 	jsonResponse(w, http.StatusOK, map[string]string{"message": "Room deleted"})
 }
 
-func (a *API) RoomsRouter(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/api/rooms")
-
-	// /api/rooms or /api/rooms/
-	if path == "" || path == "/" {
-		switch r.Method {
-		case http.MethodGet:
-			a.ListRoomsHandler(w, r)
-		case http.MethodPost:
-			a.CreateRoomHandler(w, r)
-		default:
-			errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
-		}
-		return
-	}
-
-	// /api/rooms/{id}
-	switch r.Method {
-	case http.MethodGet:
-		a.GetRoomHandler(w, r)
-	case http.MethodDelete:
-		a.DeleteRoomHandler(w, r)
-	default:
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+// Closes the room's sessions and drops what the hub holds for it before
+// deleting its rows, so connected clients cannot write the room back
+func (a *API) deleteRoom(ctx context.Context, roomID string) error {
+	if _, err := a.hub.DeleteRoom(roomID); err != nil {
+		return err
 	}
+	return a.database.DeleteRoom(ctx, roomID)
 }
 
 // Version handlers
@@ -260,32 +588,80 @@ type CreateVersionRequest struct {
 }
 
 type VersionResponse struct {
-	ID          int       `json:"id"`
-	RoomID      string    `json:"room_id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Content     string    `json:"content,omitempty"` // Omit in list view
-	ContentHash string    `json:"content_hash"`
-	CreatedBy   string    `json:"created_by"`
-	CreatedAt   time.Time `json:"created_at"`
-	IsAuto      bool      `json:"is_auto"`
+	ID              int       `json:"id"`
+	RoomID          string    `json:"room_id"`
+	Name            string    `json:"name"`
+	Description     string    `json:"description"`
+	Content         string    `json:"content,omitempty"`  // Omit in list view
+	ContentHash     string    `json:"content_hash"`       // Full hex SHA-256
+	ShortHash       string    `json:"content_hash_short"` // For display
+	CreatedBy       string    `json:"created_by"`
+	CreatedAt       time.Time `json:"created_at"`
+	IsAuto          bool      `json:"is_auto"`
+	ParentVersionID int       `json:"parent_version_id,omitempty"` // Room's latest version when this was saved
+	RestoredFromID  int       `json:"restored_from_id,omitempty"`  // Set on restores
+	Pinned          bool      `json:"pinned"`                      // Never pruned with old auto-saves
+}
+
+// Describes a version without its content
+func newVersionResponse(v *db.Version) VersionResponse {
+	return VersionResponse{
+		ID:              v.ID,
+		RoomID:          v.RoomID,
+		Name:            v.Name,
+		Description:     v.Description,
+		ContentHash:     v.ContentHash,
+		ShortHash:       shortHash(v.ContentHash),
+		CreatedBy:       v.CreatedBy,
+		CreatedAt:       v.CreatedAt,
+		IsAuto:          v.IsAuto,
+		ParentVersionID: v.ParentVersionID,
+		RestoredFromID:  v.RestoredFromID,
+		Pinned:          v.Pinned,
+	}
 }
 
 func hashContent(content string) string {
-	h := sha256.Sum256([]byte(content))
-	return hex.EncodeToString(h[:8])
+	return db.BlobHash(content)
 }
 
-// ListVersionsHandler returns all versions for a room
+// Hex digits of a content hash shown to people
+const shortHashLength = 16
+
+func shortHash(hash string) string {
+	if len(hash) > shortHashLength {
+		return hash[:shortHashLength]
+	}
+	return hash
+}
+
+// Writes a 404 and returns false unless the room exists
+func (a *API) requireRoom(ctx context.Context, w http.ResponseWriter, roomID string) bool {
+	room, err := a.database.GetRoom(ctx, roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
+		return false
+	}
+	if room == nil {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found")
+		return false
+	}
+	return true
+}
+
+// ListVersionsHandler lists a room's versions without content. The room comes
+// from /api/rooms/{id}/versions or, on the legacy route, ?room_id=.
 func (a *API) ListVersionsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+	roomID := r.PathValue("id")
+	if roomID == "" {
+		roomID = r.URL.Query().Get("room_id")
+	}
+	if roomID == "" {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "room_id is required")
 		return
 	}
 
-	roomID := r.URL.Query().Get("room_id")
-	if roomID == "" {
-		errorResponse(w, http.StatusBadRequest, "room_id is required")
+	if !a.requireRoom(r.Context(), w, roomID) || !a.authorizeRoom(w, r, roomID) {
 		return
 	}
 
@@ -299,27 +675,18 @@ func (a *API) ListVersionsHandler(w http.ResponseWriter, r *http.Request) {
 		offset = 0
 	}
 
-	versions, err := a.database.ListVersions(roomID, limit, offset)
+	versions, err := a.database.ListVersions(r.Context(), roomID, limit, offset)
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to list versions")
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list versions")
 		return
 	}
 
 	response := make([]VersionResponse, len(versions))
 	for i, v := range versions {
-		response[i] = VersionResponse{
-			ID:          v.ID,
-			RoomID:      v.RoomID,
-			Name:        v.Name,
-			Description: v.Description,
-			ContentHash: v.ContentHash,
-			CreatedBy:   v.CreatedBy,
-			CreatedAt:   v.CreatedAt,
-			IsAuto:      v.IsAuto,
-		}
+		response[i] = newVersionResponse(&v)
 	}
 
-	total, _ := a.database.GetVersionCount(roomID)
+	total, _ := a.database.GetVersionCount(r.Context(), roomID)
 
 	jsonResponse(w, http.StatusOK, map[string]interface{}{
 		"versions": response,
@@ -329,25 +696,30 @@ func (a *API) ListVersionsHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// CreateVersionHandler saves a version of an existing room. On
+// /api/rooms/{id}/versions the room comes from the path and room_id may be
+// omitted from the body.
 func (a *API) CreateVersionHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
-	}
-
 	var req CreateVersionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid request body")
+		bodyError(w, err)
 		return
 	}
 
-	if req.RoomID == "" {
-		errorResponse(w, http.StatusBadRequest, "room_id is required")
+	if roomID := r.PathValue("id"); roomID != "" {
+		if req.RoomID != "" && req.RoomID != roomID {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, "room_id does not match the room in the path")
+			return
+		}
+		req.RoomID = roomID
+	}
+
+	if !validRequest(w, &req) {
 		return
 	}
 
-	if req.Content == "" {
-		errorResponse(w, http.StatusBadRequest, "content is required")
+	if a.maxVersionBytes > 0 && len(req.Content) > a.maxVersionBytes {
+		errorResponse(w, http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge, fmt.Sprintf("content exceeds %d bytes", a.maxVersionBytes))
 		return
 	}
 
@@ -360,164 +732,290 @@ func (a *API) CreateVersionHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if !a.requireRoom(r.Context(), w, req.RoomID) || !a.authorizeRoom(w, r, req.RoomID) {
+		return
+	}
+
 	contentHash := hashContent(req.Content)
 
-	// Check if this is a duplicate (same content hash as latest)
-	latest, err := a.database.GetLatestVersion(req.RoomID)
-	if err == nil && latest != nil && latest.ContentHash == contentHash {
+	key, ok := idempotencyKey(w, r)
+	if !ok {
+		return
+	}
+	if key != "" {
+		existing, err := a.database.GetVersionByIdempotencyKey(r.Context(), req.RoomID, key)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
+			return
+		}
+		if existing != nil {
+			replayVersion(w, existing, req.Content, req.IsAuto)
+			return
+		}
+	}
+
+	// Check if this is a duplicate of the latest version, manual or not. The
+	// content is compared too, so a hash collision can never swallow a save.
+	latest, err := a.database.GetLatestVersion(r.Context(), req.RoomID)
+	if err == nil && latest != nil && latest.ContentHash == contentHash && latest.Content == req.Content {
 		// Skip duplicate auto-saves
 		if req.IsAuto {
-			jsonResponse(w, http.StatusOK, VersionResponse{
-				ID:          latest.ID,
-				RoomID:      latest.RoomID,
-				Name:        latest.Name,
-				Description: latest.Description,
-				ContentHash: latest.ContentHash,
-				CreatedBy:   latest.CreatedBy,
-				CreatedAt:   latest.CreatedAt,
-				IsAuto:      latest.IsAuto,
-			})
+			jsonResponse(w, http.StatusOK, newVersionResponse(latest))
 			return
 		}
 	}
 
-	version, err := a.database.CreateVersion(
-		req.RoomID, req.Name, req.Description, req.Content, contentHash, req.CreatedBy, req.IsAuto,
+	version, created, err := a.database.CreateVersionIdempotent(r.Context(),
+		key, req.RoomID, req.Name, req.Description, req.Content, contentHash, req.CreatedBy, req.IsAuto,
 	)
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to create version")
+		databaseError(w, err, "Failed to create version")
+		return
+	}
+	if !created {
+		if key != "" {
+			// A concurrent retry with the same key got there first
+			replayVersion(w, version, req.Content, req.IsAuto)
+			return
+		}
+		// Another client saved the same content a moment earlier
+		jsonResponse(w, http.StatusOK, newVersionResponse(version))
 		return
 	}
 
-	// Clean up old auto-saves (keep last 20)
-	if req.IsAuto {
-		if err := a.database.DeleteOldAutoVersions(req.RoomID, 20); err != nil {
+	a.versionSaved(version)
+
+	// Clean up old auto-saves, keeping the policy's newest
+	if req.IsAuto && a.autoSave.Keep > 0 {
+		if err := a.database.DeleteOldAutoVersions(r.Context(), req.RoomID, a.autoSave.Keep); err != nil {
 			log.Printf("Failed to clean up old auto versions: %v", err)
 		}
 	}
 
-	jsonResponse(w, http.StatusCreated, VersionResponse{
-		ID:          version.ID,
-		RoomID:      version.RoomID,
-		Name:        version.Name,
-		Description: version.Description,
-		ContentHash: version.ContentHash,
-		CreatedBy:   version.CreatedBy,
-		CreatedAt:   version.CreatedAt,
-		IsAuto:      version.IsAuto,
-	})
+	jsonResponse(w, http.StatusCreated, newVersionResponse(version))
 }
 
 // GetVersionHandler retrieves a specific version with full content
 func (a *API) GetVersionHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
-	}
-
-	// Extract version ID from path: /api/versions/{id}
-	path := strings.TrimPrefix(r.URL.Path, "/api/versions/")
-	versionID, err := strconv.Atoi(strings.TrimSuffix(path, "/"))
+	versionID, err := strconv.Atoi(r.PathValue("id"))
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid version ID")
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid version ID")
 		return
 	}
 
-	version, err := a.database.GetVersion(versionID)
+	version, err := a.database.GetVersion(r.Context(), versionID)
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to get version")
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
 		return
 	}
 
 	if version == nil {
-		errorResponse(w, http.StatusNotFound, "Version not found")
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Version not found")
+		return
+	}
+	if !a.authorizeVersion(w, r, version) {
 		return
 	}
 
-	jsonResponse(w, http.StatusOK, VersionResponse{
-		ID:          version.ID,
-		RoomID:      version.RoomID,
-		Name:        version.Name,
-		Description: version.Description,
-		Content:     version.Content,
-		ContentHash: version.ContentHash,
-		CreatedBy:   version.CreatedBy,
-		CreatedAt:   version.CreatedAt,
-		IsAuto:      version.IsAuto,
-	})
+	response := newVersionResponse(version)
+	response.Content = version.Content
+	jsonResponse(w, http.StatusOK, response)
 }
 
 // DeleteVersionHandler removes a version
 func (a *API) DeleteVersionHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+	versionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid version ID")
 		return
 	}
 
-	path := strings.TrimPrefix(r.URL.Path, "/api/versions/")
-	versionID, err := strconv.Atoi(strings.TrimSuffix(path, "/"))
+	version, err := a.database.GetVersion(r.Context(), versionID)
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid version ID")
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
+		return
+	}
+	if version != nil && !a.authorizeVersion(w, r, version) {
 		return
 	}
 
-	if err := a.database.DeleteVersion(versionID); err != nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to delete version")
+	if err := a.database.DeleteVersion(r.Context(), versionID); err != nil {
+		databaseError(w, err, "Failed to delete version")
 		return
 	}
+	if version != nil {
+		a.publish(events.VersionDeleted, version.RoomID, newVersionResponse(version))
+	}
 
 	jsonResponse(w, http.StatusOK, map[string]string{"message": "Version deleted"})
 }
 
-// DiffVersionsHandler computes diff between two versions
-func (a *API) DiffVersionsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+// PinVersionHandler pins a version on POST, so pruning old auto-saves never
+// removes it, and unpins it on DELETE
+func (a *API) PinVersionHandler(w http.ResponseWriter, r *http.Request) {
+	versionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid version ID")
+		return
+	}
+
+	version, err := a.database.GetVersion(r.Context(), versionID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
+		return
+	}
+	if version == nil {
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Version not found")
+		return
+	}
+	if !a.authorizeVersion(w, r, version) {
 		return
 	}
 
-	fromID, err := strconv.Atoi(r.URL.Query().Get("from"))
+	pinned := r.Method == http.MethodPost
+	found, err := a.database.SetVersionPinned(r.Context(), versionID, pinned)
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid 'from' version ID")
+		databaseError(w, err, "Failed to pin version")
+		return
+	}
+	if !found {
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Version not found")
+		return
+	}
+	version.Pinned = pinned
+	jsonResponse(w, http.StatusOK, newVersionResponse(version))
+}
+
+// DiffVersionsHandler computes diff between two versions. With ?context=N
+// the changes come grouped into hunks with N unchanged lines around them,
+// like git's, instead of as every line of both versions. ?offset= and
+// ?limit= page through the lines, or the hunks, all of them by default; the
+// summary and totals always cover the whole diff.
+func (a *API) DiffVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	fromID, err := strconv.Atoi(query.Get("from"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid 'from' version ID")
 		return
 	}
 
-	toID, err := strconv.Atoi(r.URL.Query().Get("to"))
+	toID, err := strconv.Atoi(query.Get("to"))
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid 'to' version ID")
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid 'to' version ID")
 		return
 	}
 
-	fromVersion, err := a.database.GetVersion(fromID)
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit < 0 {
+		limit = 0
+	}
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	contextLines := -1
+	if query.Has("context") {
+		contextLines, err = strconv.Atoi(query.Get("context"))
+		if err != nil || contextLines < 0 {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "context must be a non-negative number of lines")
+			return
+		}
+	}
+
+	fromVersion, err := a.database.GetVersion(r.Context(), fromID)
 	if err != nil || fromVersion == nil {
-		errorResponse(w, http.StatusNotFound, "From version not found")
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "From version not found")
 		return
 	}
 
-	toVersion, err := a.database.GetVersion(toID)
+	toVersion, err := a.database.GetVersion(r.Context(), toID)
 	if err != nil || toVersion == nil {
-		errorResponse(w, http.StatusNotFound, "To version not found")
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "To version not found")
+		return
+	}
+	if !a.authorizeVersion(w, r, fromVersion) || !a.authorizeVersion(w, r, toVersion) {
 		return
 	}
 
 	// Compute line-by-line diff
 	diff := computeDiff(fromVersion.Content, toVersion.Content)
 
-	jsonResponse(w, http.StatusOK, map[string]interface{}{
-		"from": VersionResponse{
+	response := diffResponse{
+		From: VersionResponse{
 			ID:          fromVersion.ID,
 			Name:        fromVersion.Name,
 			ContentHash: fromVersion.ContentHash,
+			ShortHash:   shortHash(fromVersion.ContentHash),
 			CreatedAt:   fromVersion.CreatedAt,
 		},
-		"to": VersionResponse{
+		To: VersionResponse{
 			ID:          toVersion.ID,
 			Name:        toVersion.Name,
 			ContentHash: toVersion.ContentHash,
+			ShortHash:   shortHash(toVersion.ContentHash),
 			CreatedAt:   toVersion.CreatedAt,
 		},
-		"diff": diff,
-	})
+		Summary:    summarizeDiff(diff),
+		TotalLines: len(diff),
+		Offset:     offset,
+		Limit:      limit,
+	}
+	if contextLines < 0 {
+		response.Diff = diff[min(offset, len(diff)):]
+		if limit > 0 && limit < len(response.Diff) {
+			response.Diff = response.Diff[:limit]
+		}
+	} else {
+		hunks := diffHunks(diff, contextLines)
+		total := len(hunks)
+		response.Hunks = hunks[min(offset, len(hunks)):]
+		if limit > 0 && limit < len(response.Hunks) {
+			response.Hunks = response.Hunks[:limit]
+		}
+		response.TotalHunks = &total
+	}
+	writeDiffResponse(w, response)
+}
+
+// Writes a diff response a line or hunk at a time rather than encoding it in
+// one buffer, which for large documents would hold another copy of every line
+func writeDiffResponse(w http.ResponseWriter, response diffResponse) {
+	field, count := "diff", len(response.Diff)
+	item := func(i int) any { return &response.Diff[i] }
+	if response.Hunks != nil {
+		field, count = "hunks", len(response.Hunks)
+		item = func(i int) any { return &response.Hunks[i] }
+	}
+	head := response
+	head.Diff, head.Hunks = nil, nil
+	rest, err := json.Marshal(head)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to encode diff")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`{"` + field + `":[`)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		data, err := json.Marshal(item(i))
+		if err != nil {
+			log.Printf("Error encoding diff: %v", err)
+			return
+		}
+		bw.Write(data)
+	}
+	// The other fields follow the array, after rest's opening brace
+	bw.WriteString("],")
+	bw.Write(rest[1:])
+	bw.WriteByte('\n')
+	if err := bw.Flush(); err != nil {
+		log.Printf("Error writing diff: %v", err)
+	}
 }
 
 // DiffLine represents a single line in a diff
@@ -528,121 +1026,79 @@ type DiffLine struct {
 	NewLine int    `json:"new_line,omitempty"`
 }
 
-// computeDiff performs a simple line-by-line diff using LCS
-func computeDiff(oldContent, newContent string) []DiffLine {
-	oldLines := strings.Split(oldContent, "\n")
-	newLines := strings.Split(newContent, "\n")
-
-	// Simple LCS-based diff
-	lcs := lcsMatrix(oldLines, newLines)
-	return backtrackDiff(oldLines, newLines, lcs)
-}
-
-func lcsMatrix(a, b []string) [][]int {
-	m, n := len(a), len(b)
-	dp := make([][]int, m+1)
-	for i := range dp {
-		dp[i] = make([]int, n+1)
-	}
-
-	for i := 1; i <= m; i++ {
-		for j := 1; j <= n; j++ {
-			if a[i-1] == b[j-1] {
-				dp[i][j] = dp[i-1][j-1] + 1
-			} else {
-				dp[i][j] = max(dp[i-1][j], dp[i][j-1])
-			}
-		}
-	}
-	return dp
+// Details of a 409 VERSION_CONFLICT: the room's newest version, which the
+// client can diff against before trying again. Nil if the room has none.
+type versionConflictDetails struct {
+	LatestVersion *VersionResponse `json:"latest_version"`
 }
 
-func backtrackDiff(oldLines, newLines []string, lcs [][]int) []DiffLine {
-	var result []DiffLine
-	i, j := len(oldLines), len(newLines)
-	oldLineNum, newLineNum := len(oldLines), len(newLines)
-
-	// Backtrack to build diff
-	var stack []DiffLine
-	for i > 0 || j > 0 {
-		if i > 0 && j > 0 && oldLines[i-1] == newLines[j-1] {
-			stack = append(stack, DiffLine{
-				Type:    "unchanged",
-				Content: oldLines[i-1],
-				OldLine: oldLineNum,
-				NewLine: newLineNum,
-			})
-			i--
-			j--
-			oldLineNum--
-			newLineNum--
-		} else if j > 0 && (i == 0 || lcs[i][j-1] >= lcs[i-1][j]) {
-			stack = append(stack, DiffLine{
-				Type:    "added",
-				Content: newLines[j-1],
-				NewLine: newLineNum,
-			})
-			j--
-			newLineNum--
-		} else if i > 0 {
-			stack = append(stack, DiffLine{
-				Type:    "removed",
-				Content: oldLines[i-1],
-				OldLine: oldLineNum,
-			})
-			i--
-			oldLineNum--
-		}
+// Reads an If-Match header naming the version the client believes is the
+// room's latest, quoted or not; "0" means the room has none. check is false
+// without one or for "*".
+func expectedLatestVersion(r *http.Request) (id int, check bool, err error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return 0, false, nil
 	}
-
-	// Reverse the stack
-	for k := len(stack) - 1; k >= 0; k-- {
-		result = append(result, stack[k])
+	id, err = strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || id < 0 {
+		return 0, false, errors.New("If-Match must be a version ID")
 	}
-
-	return result
+	return id, true, nil
 }
 
+// RestoreVersionHandler saves a copy of a version as its room's newest. With
+// an If-Match header naming the latest version the client saw, the restore
+// fails with a 409 if another version was saved since.
 func (a *API) RestoreVersionHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
+	versionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid version ID")
 		return
 	}
-
-	// Extract version ID from path: /api/versions/{id}/restore
-	path := strings.TrimPrefix(r.URL.Path, "/api/versions/")
-	path = strings.TrimSuffix(path, "/restore")
-	versionID, err := strconv.Atoi(path)
+	expectedLatest, checkLatest, err := expectedLatestVersion(r)
 	if err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid version ID")
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, err.Error())
 		return
 	}
 
-	version, err := a.database.GetVersion(versionID)
+	version, err := a.database.GetVersion(r.Context(), versionID)
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to get version")
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
 		return
 	}
 
 	if version == nil {
-		errorResponse(w, http.StatusNotFound, "Version not found")
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Version not found")
+		return
+	}
+	if !a.authorizeVersion(w, r, version) {
 		return
 	}
 
 	restoreName := fmt.Sprintf("Restored from: %s", version.Name)
-	newVersion, err := a.database.CreateVersion(
-		version.RoomID,
-		restoreName,
-		fmt.Sprintf("Restored to version %d (%s)", version.ID, version.Name),
-		version.Content,
-		version.ContentHash,
-		"", // No specific creator for restore
-		false,
-	)
+	description := fmt.Sprintf("Restored to version %d (%s)", version.ID, version.Name)
+	var newVersion *db.Version
+	if checkLatest {
+		newVersion, err = a.database.CreateRestoredVersionIfLatest(r.Context(), version, restoreName, description, "", expectedLatest)
+	} else {
+		// No specific creator for restore
+		newVersion, err = a.database.CreateRestoredVersion(r.Context(), version, restoreName, description, "")
+	}
+	if errors.Is(err, db.ErrLatestVersionChanged) {
+		details := versionConflictDetails{}
+		if latest, err := a.database.GetLatestVersion(r.Context(), version.RoomID); err == nil && latest != nil {
+			response := newVersionResponse(latest)
+			details.LatestVersion = &response
+		}
+		apierror.Write(w, http.StatusConflict, apierror.VersionConflict, "Another version was saved since; review it before restoring", details)
+		return
+	}
 	if err != nil {
-		errorResponse(w, http.StatusInternalServerError, "Failed to create restore version")
+		databaseError(w, err, "Failed to create restore version")
 		return
 	}
+	a.versionSaved(newVersion)
 
 	jsonResponse(w, http.StatusOK, map[string]interface{}{
 		"message":       "Version restored",
@@ -653,45 +1109,6 @@ func (a *API) RestoreVersionHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (a *API) VersionsRouter(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/api/versions")
-
-	// /api/versions or /api/versions/
-	if path == "" || path == "/" {
-		switch r.Method {
-		case http.MethodGet:
-			a.ListVersionsHandler(w, r)
-		case http.MethodPost:
-			a.CreateVersionHandler(w, r)
-		default:
-			errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
-		}
-		return
-	}
-
-	// /api/versions/diff
-	if strings.HasPrefix(path, "/diff") {
-		a.DiffVersionsHandler(w, r)
-		return
-	}
-
-	// /api/versions/{id}/restore
-	if strings.HasSuffix(path, "/restore") {
-		a.RestoreVersionHandler(w, r)
-		return
-	}
-
-	// /api/versions/{id}
-	switch r.Method {
-	case http.MethodGet:
-		a.GetVersionHandler(w, r)
-	case http.MethodDelete:
-		a.DeleteVersionHandler(w, r)
-	default:
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
-	}
-}
-
 type AICompleteRequest struct {
 	Code      string `json:"code"`
 	Language  string `json:"language"`
@@ -699,6 +1116,7 @@ type AICompleteRequest struct {
 	Prompt    string `json:"prompt,omitempty"`
 	MaxTokens int    `json:"max_tokens,omitempty"`
 	Provider  string `json:"provider,omitempty"` // "openai", "anthropic", "ollama"
+	RoomID    string `json:"room_id,omitempty"`  // Adds related code from the room's saved document
 }
 
 type AICompleteResponse struct {
@@ -718,19 +1136,8 @@ type AIRefactorRequest struct {
 }
 
 func (a *API) AICompleteHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
-	}
-
 	var req AICompleteRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid request body")
-		return
-	}
-
-	if req.Code == "" {
-		errorResponse(w, http.StatusBadRequest, "code is required")
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
@@ -749,23 +1156,27 @@ func (a *API) AICompleteHandler(w http.ResponseWriter, r *http.Request) {
 		afterCursor = req.Code[req.CursorPos:]
 	}
 
-	systemPrompt := fmt.Sprintf(`You are a code completion assistant. Complete the code at the cursor position.
-Rules:
-- Only output the completion, no explanations
-- Match the existing code style
-- Be concise - complete the current statement or block
-- Language: %s
-- If there's code after cursor, make sure completion flows naturally into it`, req.Language)
+	systemPrompt := a.systemPrompt(r.Context(), promptComplete, map[string]string{
+		"language":    req.Language,
+		"instruction": req.Prompt,
+		"framework":   "",
+	})
 
 	userPrompt := fmt.Sprintf("Complete this code at [CURSOR]:\n\n%s[CURSOR]%s", beforeCursor, afterCursor)
 	if req.Prompt != "" {
 		userPrompt = fmt.Sprintf("%s\n\nHint: %s", userPrompt, req.Prompt)
 	}
+	if req.RoomID != "" && a.embeddings != nil {
+		if !a.authorizeRoom(w, r, req.RoomID) {
+			return
+		}
+		userPrompt = a.roomContext(r.Context(), req.RoomID, req.Language, req.Code, req.CursorPos) + userPrompt
+	}
 
-	completion, err := callAIProvider(req.Provider, systemPrompt, userPrompt, req.MaxTokens)
+	completion, err := a.ai(r.Context(), req.Provider, systemPrompt, userPrompt, req.MaxTokens)
 	if err != nil {
 		log.Printf("AI completion error: %v", err)
-		errorResponse(w, http.StatusServiceUnavailable, "AI service unavailable")
+		errorResponse(w, http.StatusServiceUnavailable, apierror.AIUnavailable, "AI service unavailable")
 		return
 	}
 
@@ -776,34 +1187,23 @@ Rules:
 }
 
 func (a *API) AIExplainHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
-	}
-
 	var req AIExplainRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid request body")
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	if req.Code == "" {
-		errorResponse(w, http.StatusBadRequest, "code is required")
-		return
-	}
-
-	systemPrompt := `You are a code explanation assistant. Explain the given code clearly and concisely.
-Include:
-- What the code does
-- Key concepts used
-- Any potential issues or improvements`
+	systemPrompt := a.systemPrompt(r.Context(), promptExplain, map[string]string{
+		"language":    req.Language,
+		"instruction": "",
+		"framework":   "",
+	})
 
 	userPrompt := fmt.Sprintf("Explain this %s code:\n\n```%s\n%s\n```", req.Language, req.Language, req.Code)
 
-	explanation, err := callAIProvider("", systemPrompt, userPrompt, 500)
+	explanation, err := a.ai(r.Context(), "", systemPrompt, userPrompt, 500)
 	if err != nil {
 		log.Printf("AI explain error: %v", err)
-		errorResponse(w, http.StatusServiceUnavailable, "AI service unavailable")
+		errorResponse(w, http.StatusServiceUnavailable, apierror.AIUnavailable, "AI service unavailable")
 		return
 	}
 
@@ -813,19 +1213,8 @@ Include:
 }
 
 func (a *API) AIRefactorHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
-	}
-
 	var req AIRefactorRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		errorResponse(w, http.StatusBadRequest, "Invalid request body")
-		return
-	}
-
-	if req.Code == "" {
-		errorResponse(w, http.StatusBadRequest, "code is required")
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
@@ -833,19 +1222,19 @@ func (a *API) AIRefactorHandler(w http.ResponseWriter, r *http.Request) {
 		req.Instruction = "Improve this code"
 	}
 
-	systemPrompt := `You are a code refactoring assistant. Refactor the given code according to the instruction.
-Rules:
-- Only output the refactored code
-- Preserve functionality unless asked to change it
-- Follow best practices for the language`
+	systemPrompt := a.systemPrompt(r.Context(), promptRefactor, map[string]string{
+		"language":    req.Language,
+		"instruction": req.Instruction,
+		"framework":   "",
+	})
 
 	userPrompt := fmt.Sprintf("Refactor this %s code:\n\n```%s\n%s\n```\n\nInstruction: %s",
 		req.Language, req.Language, req.Code, req.Instruction)
 
-	refactored, err := callAIProvider("", systemPrompt, userPrompt, 1000)
+	refactored, err := a.ai(r.Context(), "", systemPrompt, userPrompt, 1000)
 	if err != nil {
 		log.Printf("AI refactor error: %v", err)
-		errorResponse(w, http.StatusServiceUnavailable, "AI service unavailable")
+		errorResponse(w, http.StatusServiceUnavailable, apierror.AIUnavailable, "AI service unavailable")
 		return
 	}
 
@@ -857,55 +1246,45 @@ Rules:
 	})
 }
 
-func (a *API) AIRouter(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/api/ai")
-
-	switch path {
-	case "/complete", "/complete/":
-		a.AICompleteHandler(w, r)
-	case "/explain", "/explain/":
-		a.AIExplainHandler(w, r)
-	case "/refactor", "/refactor/":
-		a.AIRefactorHandler(w, r)
-	default:
-		errorResponse(w, http.StatusNotFound, "AI endpoint not found")
+// Reports whether provider has the settings it needs. Ollama needs none
+// beyond its default local URL.
+func providerConfigured(provider string) bool {
+	switch provider {
+	case "openai":
+		return getEnv("OPENAI_API_KEY", "") != ""
+	case "anthropic":
+		return getEnv("ANTHROPIC_API_KEY", "") != ""
+	case "ollama":
+		return true
 	}
+	return false
 }
 
-func callAIProvider(provider, systemPrompt, userPrompt string, maxTokens int) (string, error) {
-	openaiKey := getEnv("OPENAI_API_KEY", "")
-	anthropicKey := getEnv("ANTHROPIC_API_KEY", "")
-	ollamaURL := getEnv("OLLAMA_URL", "http://localhost:11434")
-
-	if provider == "" {
-		if openaiKey != "" {
-			provider = "openai"
-		} else if anthropicKey != "" {
-			provider = "anthropic"
-		} else {
-			provider = "ollama"
-		}
-	}
+// Sends a prompt to one provider; aiRouter chooses which
+func callProvider(ctx context.Context, provider, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+	ctx, span := tracing.Start(ctx, "ai."+provider, tracing.WithKind(tracing.KindClient), tracing.WithAttributes(
+		tracing.String("gen_ai.system", provider),
+		tracing.Int("gen_ai.request.max_tokens", maxTokens),
+	))
+	defer span.End()
 
+	var text string
+	var err error
 	switch provider {
 	case "openai":
-		if openaiKey == "" {
-			return "", fmt.Errorf("openai API key not set")
-		}
-		return callOpenAI(openaiKey, systemPrompt, userPrompt, maxTokens)
+		text, err = callOpenAI(ctx, getEnv("OPENAI_API_KEY", ""), systemPrompt, userPrompt, maxTokens)
 	case "anthropic":
-		if anthropicKey == "" {
-			return "", fmt.Errorf("anthropic API key not set")
-		}
-		return callAnthropic(anthropicKey, systemPrompt, userPrompt, maxTokens)
+		text, err = callAnthropic(ctx, getEnv("ANTHROPIC_API_KEY", ""), systemPrompt, userPrompt, maxTokens)
 	case "ollama":
-		return callOllama(ollamaURL, systemPrompt, userPrompt, maxTokens)
+		text, err = callOllama(ctx, getEnv("OLLAMA_URL", "http://localhost:11434"), systemPrompt, userPrompt, maxTokens)
 	default:
-		return "", fmt.Errorf("unknown AI provider: %s", provider)
+		err = fmt.Errorf("unknown AI provider: %s", provider)
 	}
+	tracing.RecordError(span, err)
+	return text, err
 }
 
-func callOpenAI(apiKey, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+func callOpenAI(ctx context.Context, apiKey, systemPrompt, userPrompt string, maxTokens int) (string, error) {
 	reqBody := map[string]any{
 		"model": getEnv("OPENAI_MODEL", "gpt-4o-mini"),
 		"messages": []map[string]string{
@@ -917,12 +1296,11 @@ func callOpenAI(apiKey, systemPrompt, userPrompt string, maxTokens int) (string,
 	}
 
 	body, _ := json.Marshal(reqBody)
-	req, _ := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", strings.NewReader(string(body)))
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://api.openai.com/v1/chat/completions", strings.NewReader(string(body)))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -951,7 +1329,7 @@ func callOpenAI(apiKey, systemPrompt, userPrompt string, maxTokens int) (string,
 	return strings.TrimSpace(result.Choices[0].Message.Content), nil
 }
 
-func callAnthropic(apiKey, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+func callAnthropic(ctx context.Context, apiKey, systemPrompt, userPrompt string, maxTokens int) (string, error) {
 	reqBody := map[string]any{
 		"model":      getEnv("ANTHROPIC_MODEL", "claude-3-haiku-20240307"),
 		"max_tokens": maxTokens,
@@ -962,13 +1340,12 @@ func callAnthropic(apiKey, systemPrompt, userPrompt string, maxTokens int) (stri
 	}
 
 	body, _ := json.Marshal(reqBody)
-	req, _ := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", strings.NewReader(string(body)))
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", strings.NewReader(string(body)))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("x-api-key", apiKey)
 	req.Header.Set("anthropic-version", "2023-06-01")
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -995,7 +1372,7 @@ func callAnthropic(apiKey, systemPrompt, userPrompt string, maxTokens int) (stri
 	return strings.TrimSpace(result.Content[0].Text), nil
 }
 
-func callOllama(baseURL, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+func callOllama(ctx context.Context, baseURL, systemPrompt, userPrompt string, maxTokens int) (string, error) {
 	reqBody := map[string]any{
 		"model":  getEnv("OLLAMA_MODEL", "codellama"),
 		"prompt": fmt.Sprintf("%s\n\n%s", systemPrompt, userPrompt),
@@ -1007,11 +1384,10 @@ func callOllama(baseURL, systemPrompt, userPrompt string, maxTokens int) (string
 	}
 
 	body, _ := json.Marshal(reqBody)
-	req, _ := http.NewRequest("POST", baseURL+"/api/generate", strings.NewReader(string(body)))
+	req, _ := http.NewRequestWithContext(ctx, "POST", baseURL+"/api/generate", strings.NewReader(string(body)))
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("ollama not available at %s: %v (run 'ollama serve' first)", baseURL, err)
 	}
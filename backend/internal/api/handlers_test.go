@@ -2,14 +2,24 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
 	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	"github.com/manpreetbhatti/lattice/backend/internal/metrics"
+	"github.com/manpreetbhatti/lattice/backend/internal/telemetry"
 	"github.com/manpreetbhatti/lattice/backend/internal/ws"
 )
 
@@ -113,7 +123,7 @@ func TestCreateRoom(t *testing.T) {
 		{
 			name:           "Missing ID should fail",
 			body:           map[string]string{"name": "No ID Room"},
-			expectedStatus: http.StatusBadRequest,
+			expectedStatus: http.StatusUnprocessableEntity,
 		},
 	}
 
@@ -138,12 +148,12 @@ func TestGetRoom(t *testing.T) {
 	defer cleanup()
 
 	roomID := "get-test-room"
-	api.database.CreateRoom(roomID, "Get Test Room")
+	api.database.CreateRoom(context.Background(), roomID, "Get Test Room")
 
 	req := httptest.NewRequest("GET", "/api/rooms/"+roomID, nil)
 	w := httptest.NewRecorder()
 
-	api.GetRoomHandler(w, req)
+	api.Routes().ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", w.Code)
@@ -166,7 +176,7 @@ func TestGetRoomNotFound(t *testing.T) {
 	req := httptest.NewRequest("GET", "/api/rooms/non-existent", nil)
 	w := httptest.NewRecorder()
 
-	api.GetRoomHandler(w, req)
+	api.Routes().ServeHTTP(w, req)
 
 	if w.Code != http.StatusNotFound {
 		t.Errorf("Expected status 404, got %d", w.Code)
@@ -178,7 +188,7 @@ func TestListRooms(t *testing.T) {
 	defer cleanup()
 
 	for i := 0; i < 5; i++ {
-		if err := api.database.CreateRoom("list-room-"+string(rune('a'+i)), "Room "+string(rune('A'+i))); err != nil {
+		if err := api.database.CreateRoom(context.Background(), "list-room-"+string(rune('a'+i)), "Room "+string(rune('A'+i))); err != nil {
 			t.Fatalf("Failed to create room: %v", err)
 		}
 	}
@@ -212,7 +222,7 @@ func TestListRoomsPagination(t *testing.T) {
 	defer cleanup()
 
 	for i := 0; i < 10; i++ {
-		if err := api.database.CreateRoom("page-room-"+string(rune('a'+i)), ""); err != nil {
+		if err := api.database.CreateRoom(context.Background(), "page-room-"+string(rune('a'+i)), ""); err != nil {
 			t.Fatalf("Failed to create room: %v", err)
 		}
 	}
@@ -247,23 +257,136 @@ func TestListRoomsPagination(t *testing.T) {
 	}
 }
 
+func TestListRoomsCursor(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	for i := 0; i < 7; i++ {
+		if err := api.database.CreateRoom(context.Background(), "cursor-room-"+string(rune('a'+i)), ""); err != nil {
+			t.Fatalf("Failed to create room: %v", err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	url := "/api/rooms?limit=3&sort=name&order=asc"
+	for pages := 0; url != ""; pages++ {
+		if pages > 5 {
+			t.Fatal("Cursor pagination did not terminate")
+		}
+
+		req := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		api.ListRoomsHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+
+		var response struct {
+			Rooms      []RoomResponse `json:"rooms"`
+			TotalCount int            `json:"total_count"`
+			NextCursor string         `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+
+		if response.TotalCount != 7 {
+			t.Errorf("Expected total_count 7, got %d", response.TotalCount)
+		}
+		for _, room := range response.Rooms {
+			if seen[room.ID] {
+				t.Errorf("Room %s returned twice", room.ID)
+			}
+			seen[room.ID] = true
+		}
+
+		url = ""
+		if response.NextCursor != "" {
+			url = "/api/rooms?limit=3&cursor=" + response.NextCursor
+		}
+	}
+
+	if len(seen) != 7 {
+		t.Errorf("Expected 7 rooms across pages, got %d", len(seen))
+	}
+}
+
+func TestListRoomsInvalidParams(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	for _, url := range []string{
+		"/api/rooms?sort=id",
+		"/api/rooms?order=sideways",
+		"/api/rooms?cursor=!!",
+		"/api/rooms?updated_after=yesterday",
+		"/api/rooms?active=maybe",
+	} {
+		req := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		api.ListRoomsHandler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", url, w.Code)
+		}
+	}
+}
+
+func TestCreateRoomIDRules(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer database.Close()
+
+	config := ws.DefaultHubConfig()
+	config.RoomIDs = ws.RoomIDConfig{MaxLength: 20, Pattern: regexp.MustCompile(`^team-`)}
+	hub := ws.NewHubWithConfig(database, config)
+	go hub.Run()
+	defer hub.Stop()
+	api := New(hub, database)
+
+	for id, status := range map[string]int{
+		"team-notes":                 http.StatusCreated,
+		"notes":                      http.StatusUnprocessableEntity,
+		"team-notes-that-run-on-far": http.StatusUnprocessableEntity,
+	} {
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/rooms", strings.NewReader(`{"id":"`+id+`"}`)))
+		if w.Code != status {
+			t.Errorf("%s: expected %d, got %d: %s", id, status, w.Code, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/rooms", strings.NewReader(`{"id":"notes"}`)))
+	var body struct {
+		Details []FieldError `json:"details"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if len(body.Details) != 1 || body.Details[0].Field != "id" || body.Details[0].Message != "must match ^team-" {
+		t.Errorf("Unexpected field errors %+v", body.Details)
+	}
+}
+
 func TestDeleteRoom(t *testing.T) {
 	api, cleanup := setupTestAPI(t)
 	defer cleanup()
 
 	roomID := "delete-test-room"
-	api.database.CreateRoom(roomID, "Delete Test")
+	api.database.CreateRoom(context.Background(), roomID, "Delete Test")
 
 	req := httptest.NewRequest("DELETE", "/api/rooms/"+roomID, nil)
 	w := httptest.NewRecorder()
 
-	api.DeleteRoomHandler(w, req)
+	api.Routes().ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", w.Code)
 	}
 
-	room, _ := api.database.GetRoom(roomID)
+	room, _ := api.database.GetRoom(context.Background(), roomID)
 	if room != nil {
 		t.Error("Room should have been deleted")
 	}
@@ -329,7 +452,7 @@ func TestRoomsRouter(t *testing.T) {
 			req.Header.Set("Content-Type", "application/json")
 			w := httptest.NewRecorder()
 
-			api.RoomsRouter(w, req)
+			api.Routes().ServeHTTP(w, req)
 
 			if w.Code != tt.expectedStatus {
 				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
@@ -337,3 +460,960 @@ func TestRoomsRouter(t *testing.T) {
 		})
 	}
 }
+
+func TestBulkRooms(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	for _, id := range []string{"bulk-a", "bulk-b", "bulk-c"} {
+		if err := api.database.CreateRoom(context.Background(), id, ""); err != nil {
+			t.Fatalf("Failed to create room: %v", err)
+		}
+	}
+
+	body := `{"action": "archive", "room_ids": ["bulk-a", "bulk-b", "missing"]}`
+	req := httptest.NewRequest("POST", "/api/rooms/bulk", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+
+	api.Routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("Expected status 207 for partial failure, got %d", w.Code)
+	}
+
+	var response struct {
+		Results   []BulkRoomResult `json:"results"`
+		Succeeded int              `json:"succeeded"`
+		Failed    int              `json:"failed"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if response.Succeeded != 2 || response.Failed != 1 {
+		t.Errorf("Expected 2 succeeded and 1 failed, got %d and %d", response.Succeeded, response.Failed)
+	}
+	if response.Results[2].Status != "not_found" {
+		t.Errorf("Expected missing room to be not_found, got %s", response.Results[2].Status)
+	}
+
+	rooms, err := api.database.ListRooms(context.Background(), 10, 0)
+	if err != nil {
+		t.Fatalf("Failed to list rooms: %v", err)
+	}
+	if len(rooms) != 1 || rooms[0].ID != "bulk-c" {
+		t.Errorf("Expected only bulk-c to remain listed, got %v", rooms)
+	}
+
+	body = `{"action": "delete", "room_ids": ["bulk-a", "bulk-c"]}`
+	req = httptest.NewRequest("POST", "/api/rooms/bulk", bytes.NewReader([]byte(body)))
+	w = httptest.NewRecorder()
+
+	api.Routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+
+	if room, _ := api.database.GetRoom(context.Background(), "bulk-c"); room != nil {
+		t.Error("bulk-c should have been deleted")
+	}
+}
+
+func TestBulkRoomsProtected(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	api.database.CreateRoom(ctx, "vault", "")
+	api.database.SetJoinSecret(ctx, "vault", "hunter2")
+
+	bulk := func(secret, key string) (int, string) {
+		req := httptest.NewRequest("POST", "/api/rooms/bulk", strings.NewReader(`{"action": "export", "room_ids": ["vault"]}`))
+		if secret != "" {
+			req.Header.Set(roomSecretHeader, secret)
+		}
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, req)
+		var response struct {
+			Results []BulkRoomResult `json:"results"`
+		}
+		json.NewDecoder(w.Body).Decode(&response)
+		if len(response.Results) != 1 {
+			return w.Code, ""
+		}
+		return w.Code, response.Results[0].Status
+	}
+
+	// Before any API key exists, protected rooms need their secret
+	if _, status := bulk("", ""); status != "forbidden" {
+		t.Errorf("Expected the room to be refused without its secret, got %q", status)
+	}
+	if _, status := bulk("hunter2", ""); status != "ok" {
+		t.Errorf("Expected the room to be exported with its secret, got %q", status)
+	}
+
+	// After, the route needs a key, which opens every room
+	key, _, err := api.database.CreateAPIKey(ctx, "admin")
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	if code, _ := bulk("hunter2", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without an API key, got %d", code)
+	}
+	if _, status := bulk("", key); status != "ok" {
+		t.Errorf("Expected an admin to export the room, got %q", status)
+	}
+}
+
+func TestBulkRoomsInvalidAction(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	body := `{"action": "explode", "room_ids": ["a"]}`
+	req := httptest.NewRequest("POST", "/api/rooms/bulk", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+
+	api.BulkRoomsHandler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
+
+func TestPostUpdates(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	body, _ := json.Marshal(PostUpdatesRequest{Updates: [][]byte{{1, 2, 3}, {0, 0}, {4, 5}}})
+	req := httptest.NewRequest("POST", "/api/rooms/offline-room/updates", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	api.Routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response struct {
+		RoomID    string `json:"room_id"`
+		Applied   int    `json:"applied"`
+		Sequences []int  `json:"sequences"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if response.RoomID != "offline-room" {
+		t.Errorf("Expected room offline-room, got %s", response.RoomID)
+	}
+	// The empty update is relayed but not stored
+	if response.Applied != 2 {
+		t.Errorf("Expected 2 applied updates, got %d", response.Applied)
+	}
+	if len(response.Sequences) != 3 || response.Sequences[0] != 1 || response.Sequences[1] != 0 || response.Sequences[2] != 2 {
+		t.Errorf("Expected sequences [1 0 2], got %v", response.Sequences)
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing updates", `{}`},
+		{"empty update", `{"updates": [""]}`},
+		{"invalid JSON", `{`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/rooms/offline-room/updates", bytes.NewReader([]byte(tt.body)))
+			w := httptest.NewRecorder()
+
+			api.Routes().ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status 400, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestRoomJoinSecret(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	body := `{"id": "locked-room", "join_code": true}`
+	req := httptest.NewRequest("POST", "/api/rooms", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var created RoomResponse
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !created.Protected || len(created.JoinCode) != 6 {
+		t.Fatalf("Expected protected room with a join code, got %+v", created)
+	}
+
+	// Securing an existing room must go through the join secret API
+	req = httptest.NewRequest("POST", "/api/rooms", bytes.NewReader([]byte(`{"id": "locked-room", "password": "x"}`)))
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for existing room, got %d", w.Code)
+	}
+
+	updates := `{"updates": ["AQID"]}`
+	req = httptest.NewRequest("POST", "/api/rooms/locked-room/updates", bytes.NewReader([]byte(updates)))
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 without secret, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("PUT", "/api/rooms/locked-room/join-secret", bytes.NewReader([]byte(`{"password": "hunter2"}`)))
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 rotating without current secret, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("PUT", "/api/rooms/locked-room/join-secret", bytes.NewReader([]byte(`{"password": "hunter2"}`)))
+	req.Header.Set("X-Room-Secret", created.JoinCode)
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 rotating with current secret, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/api/rooms/locked-room/updates", bytes.NewReader([]byte(updates)))
+	req.Header.Set("X-Room-Secret", "hunter2")
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 with rotated secret, got %d", w.Code)
+	}
+}
+
+func TestProtectedVersionRoutes(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	req := httptest.NewRequest("POST", "/api/rooms", strings.NewReader(`{"id": "locked-room", "password": "hunter2"}`))
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	v1, _ := api.database.CreateVersion(ctx, "locked-room", "v1", "", "a", hashContent("a"), "", false)
+	v2, _ := api.database.CreateVersion(ctx, "locked-room", "v2", "", "b", hashContent("b"), "", false)
+
+	tests := []struct{ method, path, body string }{
+		{"GET", "/api/rooms/locked-room/versions", ""},
+		{"POST", "/api/rooms/locked-room/versions", `{"content": "c"}`},
+		{"GET", "/api/rooms/locked-room/versions/graph", ""},
+		{"GET", fmt.Sprintf("/api/versions/%d", v1.ID), ""},
+		{"GET", fmt.Sprintf("/api/versions/%d/raw", v1.ID), ""},
+		{"GET", fmt.Sprintf("/api/versions/diff?from=%d&to=%d", v1.ID, v2.ID), ""},
+		{"POST", fmt.Sprintf("/api/versions/%d/restore", v1.ID), ""},
+		{"GET", "/api/rooms/locked-room/versions/export", ""},
+		{"GET", "/api/rooms/locked-room/at?time=" + time.Now().Format(time.RFC3339), ""},
+		{"GET", "/api/rooms/locked-room/playback", ""},
+		{"GET", "/api/rooms/locked-room/contributions", ""},
+	}
+	for _, tt := range tests {
+		call := func(secret string) int {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if secret != "" {
+				req.Header.Set(roomSecretHeader, secret)
+			}
+			w := httptest.NewRecorder()
+			api.Routes().ServeHTTP(w, req)
+			return w.Code
+		}
+		if code := call(""); code != http.StatusForbidden {
+			t.Errorf("%s %s: expected 403 without the secret, got %d", tt.method, tt.path, code)
+		}
+		if code := call("hunter2"); code >= 400 {
+			t.Errorf("%s %s: expected success with the secret, got %d", tt.method, tt.path, code)
+		}
+	}
+}
+
+func TestGuestHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	req := httptest.NewRequest("POST", "/api/auth/guest", bytes.NewReader([]byte(`{"name": "Ada"}`)))
+	w := httptest.NewRecorder()
+	api.GuestHandler(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 without an issuer, got %d", w.Code)
+	}
+
+	issuer := auth.NewIssuer([]byte("test-key"), time.Hour)
+	api.SetGuestIssuer(issuer)
+
+	req = httptest.NewRequest("POST", "/api/auth/guest", bytes.NewReader([]byte(`{"name": "Ada", "color": "#abcdef"}`)))
+	w = httptest.NewRecorder()
+	api.GuestHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response GuestResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	identity, err := issuer.Verify(response.Token)
+	if err != nil {
+		t.Fatalf("Issued token does not verify: %v", err)
+	}
+	if identity.Name != "Ada" || identity.Color != "#abcdef" {
+		t.Errorf("Unexpected identity: %+v", identity)
+	}
+
+	req = httptest.NewRequest("POST", "/api/auth/guest", bytes.NewReader([]byte(`{"color": "pink"}`)))
+	w = httptest.NewRecorder()
+	api.GuestHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid color, got %d", w.Code)
+	}
+}
+
+func TestContentLimits(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	api.SetMaxVersionBytes(8)
+	if err := api.database.CreateRoom(context.Background(), "limits-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	body := `{"room_id": "limits-room", "content": "way more than eight bytes"}`
+	req := httptest.NewRequest("POST", "/api/versions", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+	api.CreateVersionHandler(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413 for oversized version, got %d", w.Code)
+	}
+
+	body = `{"room_id": "limits-room", "content": "small"}`
+	req = httptest.NewRequest("POST", "/api/versions", bytes.NewReader([]byte(body)))
+	w = httptest.NewRecorder()
+	api.CreateVersionHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/rooms/limits-room", nil)
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var room RoomResponse
+	if err := json.NewDecoder(w.Body).Decode(&room); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if room.Usage == nil || room.Usage.VersionBytes != 5 || room.Usage.VersionCount != 1 || room.Usage.MaxVersionBytes != 8 {
+		t.Errorf("Unexpected usage: %+v", room.Usage)
+	}
+}
+
+func TestStatsHistory(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	now := time.Now().UTC().Truncate(time.Hour)
+	for _, offset := range []time.Duration{-3 * time.Hour, -50 * time.Minute, -40 * time.Minute} {
+		sample := db.StatsSample{SampledAt: now.Add(offset), RoomCount: 1, MessageRate: 2}
+		if offset == -40*time.Minute {
+			sample.RoomCount, sample.MessageRate = 3, 4
+		}
+		if err := api.database.RecordStatsSample(context.Background(), sample); err != nil {
+			t.Fatalf("Failed to record sample: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/stats/history?range=2h&step=1h", nil)
+	w := httptest.NewRecorder()
+	api.StatsHistoryHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response struct {
+		Points []db.StatsSample `json:"points"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	// The two samples in the last hour share a bucket; the older one is out of range
+	if len(response.Points) != 1 {
+		t.Fatalf("Expected 1 point, got %d: %+v", len(response.Points), response.Points)
+	}
+	if p := response.Points[0]; p.RoomCount != 3 || p.MessageRate != 3 {
+		t.Errorf("Expected last room count 3 and mean rate 3, got %+v", p)
+	}
+
+	for _, query := range []string{"range=bogus", "step=0s", "range=720h&step=1s"} {
+		req := httptest.NewRequest("GET", "/api/stats/history?"+query, nil)
+		w := httptest.NewRecorder()
+		api.StatsHistoryHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestAggregateStats(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/stats/aggregate", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with telemetry disabled, got %d", w.Code)
+	}
+
+	collector, err := telemetry.New(api.events, api.hub, telemetry.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+	api.SetTelemetry(collector)
+	routes := api.Routes()
+	routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/rooms/private", nil))
+
+	w = httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats/aggregate", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var aggregate telemetry.Aggregate
+	if err := json.NewDecoder(w.Body).Decode(&aggregate); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	// Requests count under their route pattern, never the room ID
+	if aggregate.Features["GET /api/rooms/{id}"] != 1 {
+		t.Errorf("Expected the room request counted by pattern, got %v", aggregate.Features)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with metrics disabled, got %d", w.Code)
+	}
+
+	collector, err := metrics.New(api.hub, metrics.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+	api.SetMetrics(collector)
+
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != metrics.ContentType {
+		t.Errorf("Expected Content-Type %q, got %q", metrics.ContentType, ct)
+	}
+	if !strings.Contains(w.Body.String(), "lattice_active_rooms 0\n") {
+		t.Errorf("Expected server-wide gauges, got:\n%s", w.Body.String())
+	}
+
+	// Room IDs are exposed, so an API key is needed once one exists
+	if _, _, err := api.database.CreateAPIKey(context.Background(), "prometheus"); err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without an API key, got %d", w.Code)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	req := httptest.NewRequest("GET", "/api/openapi.json", nil)
+	w := httptest.NewRecorder()
+	api.OpenAPIHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var spec struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{} `json:"properties"`
+				Required   []string               `json:"required"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&spec); err != nil {
+		t.Fatalf("Failed to decode spec: %v", err)
+	}
+
+	if spec.OpenAPI != "3.0.3" {
+		t.Errorf("Expected OpenAPI 3.0.3, got %q", spec.OpenAPI)
+	}
+
+	for path, method := range map[string]string{
+		"/api/rooms":                 "post",
+		"/api/rooms/{id}":            "get",
+		"/api/rooms/{id}/updates":    "post",
+		"/api/versions":              "get",
+		"/api/versions/{id}/restore": "post",
+		"/api/ai/complete":           "post",
+		"/api/stats/history":         "get",
+	} {
+		if _, ok := spec.Paths[path][method]; !ok {
+			t.Errorf("Expected %s %s in spec", method, path)
+		}
+	}
+
+	room, ok := spec.Components.Schemas["RoomResponse"]
+	if !ok {
+		t.Fatal("Expected RoomResponse schema")
+	}
+	if _, ok := room.Properties["created_at"]; !ok {
+		t.Error("Expected created_at property on RoomResponse")
+	}
+	for _, name := range room.Required {
+		if name == "usage" {
+			t.Error("Expected omitempty field usage to be optional")
+		}
+	}
+
+	// Embedded db.RoomUsage fields are flattened like encoding/json does
+	usage, ok := spec.Components.Schemas["RoomUsage"]
+	if !ok {
+		t.Fatal("Expected RoomUsage schema")
+	}
+	if len(usage.Properties) < 2 {
+		t.Errorf("Expected flattened RoomUsage properties, got %v", usage.Properties)
+	}
+
+	// Under a path prefix the spec names it as its server
+	api.SetBasePath("/lattice")
+	w = httptest.NewRecorder()
+	api.OpenAPIHandler(w, req)
+	var prefixed struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&prefixed); err != nil {
+		t.Fatalf("Failed to decode spec: %v", err)
+	}
+	if len(prefixed.Servers) != 1 || prefixed.Servers[0].URL != "/lattice" {
+		t.Errorf("Expected server /lattice, got %+v", prefixed.Servers)
+	}
+}
+
+func TestRouterErrors(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	tests := []struct {
+		method         string
+		path           string
+		expectedStatus int
+		code           apierror.Code
+		allow          string
+	}{
+		{"GET", "/api/unknown", http.StatusNotFound, apierror.NotFound, ""},
+		{"GET", "/api/rooms/a/b/c", http.StatusNotFound, apierror.NotFound, ""},
+		{"GET", "/api/rooms/missing", http.StatusNotFound, apierror.RoomNotFound, ""},
+		{"PATCH", "/api/rooms/some-room", http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "DELETE, GET, HEAD"},
+		{"GET", "/api/versions/diff", http.StatusBadRequest, apierror.InvalidParameter, ""}, // not treated as a version ID
+		{"GET", "/api/versions/abc", http.StatusBadRequest, apierror.InvalidParameter, ""},
+		{"GET", "/api/versions/999", http.StatusNotFound, apierror.VersionNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			w := httptest.NewRecorder()
+			api.Routes().ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.allow != "" && w.Header().Get("Allow") != tt.allow {
+				t.Errorf("Expected Allow %q, got %q", tt.allow, w.Header().Get("Allow"))
+			}
+
+			var body apierror.Error
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("Expected JSON error body: %v", err)
+			}
+			if body.Code != tt.code || body.Message == "" {
+				t.Errorf("Expected code %s with a message, got %+v", tt.code, body)
+			}
+		})
+	}
+}
+
+func TestRoutesMatchSpec(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	mux := api.routes()
+	for _, op := range apiOperations() {
+		path := strings.ReplaceAll(op.Path, "{id}", "1")
+		req := httptest.NewRequest(op.Method, path, nil)
+
+		if _, pattern := mux.Handler(req); pattern != op.Method+" "+op.Path {
+			t.Errorf("Documented %s %s routes to %q", op.Method, op.Path, pattern)
+		}
+	}
+}
+
+func TestRoomVersions(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, req)
+		return w
+	}
+
+	// Unknown rooms are rejected on both routes
+	if w := serve("POST", "/api/rooms/ghost/versions", `{"content": "hello"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 creating a version of a missing room, got %d", w.Code)
+	}
+	if w := serve("POST", "/api/versions", `{"room_id": "ghost", "content": "hello"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 on the legacy route, got %d", w.Code)
+	}
+	if w := serve("GET", "/api/rooms/ghost/versions", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 listing versions of a missing room, got %d", w.Code)
+	}
+
+	if err := api.database.CreateRoom(context.Background(), "versioned", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	w := serve("POST", "/api/rooms/versioned/versions", `{"name": "First", "content": "hello"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var created VersionResponse
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if created.RoomID != "versioned" {
+		t.Errorf("Expected room_id from the path, got %q", created.RoomID)
+	}
+
+	if w := serve("POST", "/api/rooms/versioned/versions", `{"room_id": "other", "content": "x"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for mismatched room_id, got %d", w.Code)
+	}
+
+	// Both routes list the same versions
+	for _, path := range []string{"/api/rooms/versioned/versions", "/api/versions?room_id=versioned"} {
+		w := serve("GET", path, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", path, w.Code)
+		}
+		var list struct {
+			Versions []VersionResponse `json:"versions"`
+			Total    int               `json:"total"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if list.Total != 1 || len(list.Versions) != 1 || list.Versions[0].ID != created.ID {
+			t.Errorf("%s: unexpected versions %+v", path, list)
+		}
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		fields []string
+	}{
+		{
+			name:   "room ID characters and name length",
+			path:   "/api/rooms",
+			body:   `{"id": "bad room/id", "name": "` + strings.Repeat("n", maxRoomNameLength+1) + `"}`,
+			fields: []string{"id", "name"},
+		},
+		{
+			name:   "password with join code",
+			path:   "/api/rooms",
+			body:   `{"id": "ok", "password": "x", "join_code": true}`,
+			fields: []string{"join_code"},
+		},
+		{
+			name:   "version without content",
+			path:   "/api/versions",
+			body:   `{"room_id": "ok", "content": "  "}`,
+			fields: []string{"content"},
+		},
+		{
+			name:   "completion out of range",
+			path:   "/api/ai/complete",
+			body:   `{"code": "abc", "cursor_pos": 10, "language": "cobol", "provider": "skynet"}`,
+			fields: []string{"cursor_pos", "language", "provider"},
+		},
+		{
+			name:   "refactor without code",
+			path:   "/api/ai/refactor",
+			body:   `{"instruction": "shorter"}`,
+			fields: []string{"code"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, bytes.NewReader([]byte(tt.body)))
+			w := httptest.NewRecorder()
+			api.Routes().ServeHTTP(w, req)
+
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("Expected status 422, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp struct {
+				Code    apierror.Code `json:"code"`
+				Details []FieldError  `json:"details"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp.Code != apierror.ValidationFailed {
+				t.Errorf("Expected code %s, got %s", apierror.ValidationFailed, resp.Code)
+			}
+
+			var fields []string
+			for _, f := range resp.Details {
+				if f.Message == "" {
+					t.Errorf("Expected a message for field %s", f.Field)
+				}
+				fields = append(fields, f.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("Expected invalid fields %v, got %v", tt.fields, fields)
+			}
+		})
+	}
+}
+
+func TestCreateVersionIdempotencyKey(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	if err := api.database.CreateRoom(context.Background(), "idem-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/rooms/idem-room/versions", bytes.NewReader([]byte(body)))
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, req)
+		return w
+	}
+
+	var ids []int
+	for i := 0; i < 2; i++ {
+		w := post("save-1", `{"name": "Snapshot", "content": "hello"}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Attempt %d: expected status 201, got %d: %s", i, w.Code, w.Body.String())
+		}
+		if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != (i > 0) {
+			t.Errorf("Attempt %d: unexpected Idempotent-Replayed header %q", i, w.Header().Get("Idempotent-Replayed"))
+		}
+
+		var version VersionResponse
+		if err := json.NewDecoder(w.Body).Decode(&version); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		ids = append(ids, version.ID)
+
+		if len(version.ContentHash) != 64 || version.ShortHash != version.ContentHash[:16] {
+			t.Errorf("Expected a full hash and its 16-digit short form, got %q and %q", version.ContentHash, version.ShortHash)
+		}
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("Expected the retry to return version %d, got %d", ids[0], ids[1])
+	}
+
+	if count, _ := api.database.GetVersionCount(context.Background(), "idem-room"); count != 1 {
+		t.Errorf("Expected 1 version after a retry, got %d", count)
+	}
+
+	w := post("save-1", `{"name": "Snapshot", "content": "changed"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 when reusing a key for different content, got %d", w.Code)
+	}
+
+	w = post(strings.Repeat("k", maxIdempotencyKeyLength+1), `{"content": "hello"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an oversized key, got %d", w.Code)
+	}
+}
+
+func TestConcurrentAutoSaves(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	if err := api.database.CreateRoom(context.Background(), "auto-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	const clients = 8
+	ids := make(chan int, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/api/rooms/auto-room/versions", strings.NewReader(`{"content": "same", "is_auto": true}`))
+			w := httptest.NewRecorder()
+			api.Routes().ServeHTTP(w, req)
+			if w.Code != http.StatusCreated && w.Code != http.StatusOK {
+				t.Errorf("Expected status 201 or 200, got %d: %s", w.Code, w.Body.String())
+				return
+			}
+			var version VersionResponse
+			if err := json.NewDecoder(w.Body).Decode(&version); err != nil {
+				t.Errorf("Failed to decode response: %v", err)
+				return
+			}
+			ids <- version.ID
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	first := 0
+	for id := range ids {
+		if first == 0 {
+			first = id
+		} else if id != first {
+			t.Errorf("Expected every client to get version %d, got %d", first, id)
+		}
+	}
+	if count, _ := api.database.GetVersionCount(context.Background(), "auto-room"); count != 1 {
+		t.Errorf("Expected 1 auto-save, got %d", count)
+	}
+}
+
+func TestPinVersionHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := api.database.CreateRoom(ctx, "pin-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	v, _ := api.database.CreateVersion(ctx, "pin-room", "Checkpoint", "", "a", hashContent("a"), "", true)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	for _, method := range []string{"POST", "DELETE"} {
+		w := serve(method, fmt.Sprintf("/api/versions/%d/pin", v.ID))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", method, w.Code, w.Body.String())
+		}
+		var version VersionResponse
+		if err := json.NewDecoder(w.Body).Decode(&version); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if version.Pinned != (method == "POST") {
+			t.Errorf("%s: expected pinned=%v, got %v", method, method == "POST", version.Pinned)
+		}
+	}
+
+	if w := serve("POST", "/api/versions/9999/pin"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing version, got %d", w.Code)
+	}
+	if w := serve("POST", "/api/versions/abc/pin"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid ID, got %d", w.Code)
+	}
+}
+
+func TestRestoreVersionIfMatch(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := api.database.CreateRoom(ctx, "restore-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	first, _ := api.database.CreateVersion(ctx, "restore-room", "v1", "", "one", hashContent("one"), "", false)
+	second, _ := api.database.CreateVersion(ctx, "restore-room", "v2", "", "two", hashContent("two"), "", false)
+
+	restore := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/versions/%d/restore", first.ID), nil)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, req)
+		return w
+	}
+
+	// Someone saved v2 after the client last looked
+	w := restore(fmt.Sprintf(`"%d"`, first.ID))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status 409, got %d: %s", w.Code, w.Body.String())
+	}
+	var conflict struct {
+		Code    apierror.Code          `json:"code"`
+		Details versionConflictDetails `json:"details"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&conflict); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if conflict.Code != apierror.VersionConflict || conflict.Details.LatestVersion == nil || conflict.Details.LatestVersion.ID != second.ID {
+		t.Errorf("Expected a conflict naming version %d, got %+v", second.ID, conflict)
+	}
+	if count, _ := api.database.GetVersionCount(ctx, "restore-room"); count != 2 {
+		t.Errorf("Expected no version saved on conflict, got %d", count)
+	}
+
+	if w := restore(fmt.Sprintf(`"%d"`, second.ID)); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 when the latest matches, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := restore("*"); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for If-Match *, got %d", w.Code)
+	}
+	if w := restore("soon"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a malformed If-Match, got %d", w.Code)
+	}
+}
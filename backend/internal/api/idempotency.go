@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+const (
+	// Header clients set so a retried POST returns the original result
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// Set on responses that replay an earlier request
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+// Returns the request's idempotency key, writing a 400 and returning false if
+// it is too long
+func idempotencyKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Idempotency-Key must be at most 255 characters")
+		return "", false
+	}
+	return key, true
+}
+
+// Answers a retried version creation with the version the first request
+// created. Reusing a key for different content is rejected so a client bug
+// can't silently drop a save.
+func replayVersion(w http.ResponseWriter, version *db.Version, content string, isAuto bool) {
+	if version.Content != content || version.IsAuto != isAuto {
+		errorResponse(w, http.StatusUnprocessableEntity, apierror.IdempotencyKeyReused, "Idempotency-Key was already used for a different version")
+		return
+	}
+
+	w.Header().Set(idempotentReplayedHeader, "true")
+	jsonResponse(w, http.StatusCreated, newVersionResponse(version))
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// Header carrying a room's current join secret on REST requests
+const roomSecretHeader = "X-Room-Secret"
+
+// SetJoinSecretRequest sets a password, or generates a join code when empty
+type SetJoinSecretRequest struct {
+	Password string `json:"password,omitempty"`
+}
+
+// Returns the join secret presented with a request
+func roomSecret(r *http.Request) string {
+	if secret := r.Header.Get(roomSecretHeader); secret != "" {
+		return secret
+	}
+	return r.URL.Query().Get("secret")
+}
+
+// Writes an error and returns false unless the request carries the room's
+// join secret (or the room has none) and, for workspace rooms, a member's
+// identity token
+func (a *API) authorizeRoom(w http.ResponseWriter, r *http.Request, roomID string) bool {
+	if !a.authorizeRoomWorkspace(w, r, roomID) {
+		return false
+	}
+
+	ok, err := a.database.CheckJoinSecret(r.Context(), roomID, roomSecret(r))
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to check join secret")
+		return false
+	}
+	if !ok {
+		errorResponse(w, http.StatusForbidden, apierror.RoomAccessDenied, "Invalid or missing room secret")
+		return false
+	}
+	return true
+}
+
+// JoinSecretHandler rotates (PUT) or removes (DELETE) a room's join secret.
+// Protected rooms require the current secret in X-Room-Secret.
+func (a *API) JoinSecretHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+
+	room, err := a.database.GetRoom(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
+		return
+	}
+	if room == nil {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found")
+		return
+	}
+
+	if !a.authorizeRoom(w, r, roomID) {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := a.database.SetJoinSecret(r.Context(), roomID, ""); err != nil {
+			databaseError(w, err, "Failed to remove join secret")
+			return
+		}
+		jsonResponse(w, http.StatusOK, map[string]interface{}{
+			"room_id":   roomID,
+			"protected": false,
+		})
+		return
+	}
+
+	var req SetJoinSecretRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			bodyError(w, err)
+			return
+		}
+	}
+
+	secret := req.Password
+	if secret == "" {
+		secret = db.GenerateJoinCode()
+	}
+
+	if err := a.database.SetJoinSecret(r.Context(), roomID, secret); err != nil {
+		databaseError(w, err, "Failed to set join secret")
+		return
+	}
+
+	response := map[string]interface{}{
+		"room_id":   roomID,
+		"protected": true,
+	}
+	if req.Password == "" {
+		response["join_code"] = secret
+	}
+
+	jsonResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+// How a document in each editor language is downloaded
+type languageFile struct {
+	ContentType string
+	Extension   string
+}
+
+// Keyed by the languages in aiLanguages; rooms without one get plain text
+var languageFiles = map[string]languageFile{
+	"javascript": {"text/javascript", ".js"},
+	"typescript": {"text/x-typescript", ".ts"},
+	"jsx":        {"text/javascript", ".jsx"},
+	"tsx":        {"text/x-typescript", ".tsx"},
+	"python":     {"text/x-python", ".py"},
+	"go":         {"text/x-go", ".go"},
+	"rust":       {"text/x-rust", ".rs"},
+	"cpp":        {"text/x-c++src", ".cpp"},
+	"c":          {"text/x-csrc", ".c"},
+	"java":       {"text/x-java", ".java"},
+	"json":       {"application/json", ".json"},
+	"html":       {"text/html", ".html"},
+	"css":        {"text/css", ".css"},
+	"markdown":   {"text/markdown", ".md"},
+	"sql":        {"application/sql", ".sql"},
+	"plaintext":  {"text/plain", ".txt"},
+}
+
+func fileForLanguage(language string) languageFile {
+	if file, ok := languageFiles[language]; ok {
+		return file
+	}
+	return languageFiles["plaintext"]
+}
+
+// SetRoomLanguageRequest sets the language of a room's document
+type SetRoomLanguageRequest struct {
+	Language string `json:"language"` // Empty clears it
+}
+
+// RoomLanguageHandler sets (PUT) the language a room's document is written
+// in, which decides how its versions are downloaded. Protected rooms
+// require the current secret in X-Room-Secret.
+func (a *API) RoomLanguageHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+
+	var req SetRoomLanguageRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if !a.requireRoom(r.Context(), w, roomID) || !a.authorizeRoom(w, r, roomID) {
+		return
+	}
+
+	found, err := a.database.SetRoomLanguage(r.Context(), roomID, req.Language)
+	if err != nil {
+		databaseError(w, err, "Failed to set language")
+		return
+	}
+	if !found {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]string{
+		"room_id":  roomID,
+		"language": req.Language,
+	})
+}
+
+// VersionRawHandler downloads just a version's content, typed and named
+// after its room's language, so large documents needn't be unwrapped from
+// JSON. Range and conditional requests are honoured.
+func (a *API) VersionRawHandler(w http.ResponseWriter, r *http.Request) {
+	versionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid version ID")
+		return
+	}
+
+	version, err := a.database.GetVersion(r.Context(), versionID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
+		return
+	}
+	if version == nil {
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Version not found")
+		return
+	}
+	if !a.authorizeVersion(w, r, version) {
+		return
+	}
+
+	room, err := a.database.GetRoom(r.Context(), version.RoomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
+		return
+	}
+	language := ""
+	if room != nil {
+		language = room.Language
+	}
+	file := fileForLanguage(language)
+
+	filename := fmt.Sprintf("%s-v%d%s", version.RoomID, version.ID, file.Extension)
+	w.Header().Set("Content-Type", file.ContentType+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(filename))
+	// Content is the user's; never let a browser render it as something else
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+version.ContentHash+`"`)
+	http.ServeContent(w, r, "", version.CreatedAt, strings.NewReader(version.Content))
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
+)
+
+func TestVersionRawHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	serve := func(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("POST", "/api/rooms", `{"id": "script", "language": "cobol"}`, nil); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for an unknown language, got %d", w.Code)
+	}
+	if w := serve("POST", "/api/rooms", `{"id": "script"}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create room: %d %s", w.Code, w.Body.String())
+	}
+	content := "print('hi')\n"
+	v, err := api.database.CreateVersion(context.Background(), "script", "v1", "", content, hashContent(content), "", false)
+	if err != nil {
+		t.Fatalf("Failed to create version: %v", err)
+	}
+	path := fmt.Sprintf("/api/versions/%d/raw", v.ID)
+
+	w := serve("GET", path, "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Fatalf("Expected the content, got %d %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Expected plain text without a language, got %q", ct)
+	}
+
+	if w := serve("PUT", "/api/rooms/script/language", `{"language": "python"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Failed to set language: %d %s", w.Code, w.Body.String())
+	}
+	w = serve("GET", path, "", nil)
+	if ct := w.Header().Get("Content-Type"); ct != "text/x-python; charset=utf-8" {
+		t.Errorf("Expected a Python content type, got %q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != fmt.Sprintf("attachment; filename*=UTF-8''script-v%d.py", v.ID) {
+		t.Errorf("Unexpected Content-Disposition %q", cd)
+	}
+
+	w = serve("GET", path, "", http.Header{"If-None-Match": {w.Header().Get("ETag")}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected status 304 for a matching ETag, got %d", w.Code)
+	}
+	w = serve("GET", path, "", http.Header{"Range": {"bytes=0-4"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "print" {
+		t.Errorf("Expected the first 5 bytes, got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := serve("GET", "/api/versions/9999/raw", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing version, got %d", w.Code)
+	}
+	if w := serve("PUT", "/api/rooms/ghost/language", `{"language": "go"}`, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing room, got %d", w.Code)
+	}
+}
+
+func TestVersionRawHandlerWorkspace(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	api.SetGuestIssuer(auth.NewIssuer([]byte("test-key"), time.Hour))
+
+	ctx := context.Background()
+	_, owner, err := api.database.CreateUser(ctx, "owner", "#112233", nil)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if _, err := api.database.CreateWorkspace(ctx, "team", "Team", owner.ID); err != nil {
+		t.Fatalf("Failed to create workspace: %v", err)
+	}
+	if err := api.database.AddRoomToWorkspace(ctx, "team", "plans", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	v, _ := api.database.CreateVersion(ctx, "plans", "v1", "", "secret", hashContent("secret"), "", false)
+	path := fmt.Sprintf("/api/versions/%d/raw", v.ID)
+
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("Expected status 403 without membership, got %d %q", w.Code, w.Body.String())
+	}
+
+	token, _, _ := api.guests.IssueFor(owner.ID, owner.Name, owner.Color)
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set(identityTokenHeader, token)
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "secret" {
+		t.Errorf("Expected a member to download the content, got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// UserRoomsResponse lists the rooms in a user's recent or favorite list
+type UserRoomsResponse struct {
+	Rooms []db.UserRoom `json:"rooms"`
+}
+
+// RecentRoomsHandler lists the rooms the caller's sessions joined, most
+// recent first. Visits are recorded when a session identifies with a
+// profile's token.
+func (a *API) RecentRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.tokenUser(w, r, "")
+	if !ok {
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 50 {
+		limit = 20
+	}
+
+	rooms, err := a.database.ListRecentRooms(r.Context(), user.ID, limit)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list recent rooms")
+		return
+	}
+	jsonResponse(w, http.StatusOK, UserRoomsResponse{Rooms: rooms})
+}
+
+// ForgetRecentRoomHandler removes a room from the caller's recent list
+func (a *API) ForgetRecentRoomHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.tokenUser(w, r, "")
+	if !ok {
+		return
+	}
+
+	removed, err := a.database.ForgetRecentRoom(r.Context(), user.ID, r.PathValue("id"))
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to forget room")
+		return
+	}
+	if !removed {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not in recent rooms")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]string{"message": "Room forgotten"})
+}
+
+// FavoriteRoomsHandler lists the rooms the caller starred
+func (a *API) FavoriteRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.tokenUser(w, r, "")
+	if !ok {
+		return
+	}
+	a.favoriteRooms(w, r, user.ID, http.StatusOK)
+}
+
+// StarRoomHandler adds a room to the caller's favorites. Rooms need not
+// exist yet, so a client can bring over favorites it kept locally.
+func (a *API) StarRoomHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.tokenUser(w, r, "")
+	if !ok {
+		return
+	}
+
+	roomID := r.PathValue("id")
+	if !validRoomIDParam(w, roomID) {
+		return
+	}
+
+	added, err := a.database.AddFavoriteRoom(r.Context(), user.ID, roomID)
+	if errors.Is(err, db.ErrTooManyFavorites) {
+		errorResponse(w, http.StatusConflict, apierror.FavoriteLimitReached,
+			fmt.Sprintf("At most %d rooms can be starred", db.MaxFavoriteRooms))
+		return
+	}
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to star room")
+		return
+	}
+
+	status := http.StatusOK
+	if added {
+		status = http.StatusCreated
+	}
+	a.favoriteRooms(w, r, user.ID, status)
+}
+
+// UnstarRoomHandler removes a room from the caller's favorites. Unstarring
+// a room that isn't starred succeeds, like starring one twice.
+func (a *API) UnstarRoomHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.tokenUser(w, r, "")
+	if !ok {
+		return
+	}
+
+	if _, err := a.database.RemoveFavoriteRoom(r.Context(), user.ID, r.PathValue("id")); err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to unstar room")
+		return
+	}
+	a.favoriteRooms(w, r, user.ID, http.StatusOK)
+}
+
+// Writes the user's favorites, which each change returns so clients need
+// not fetch them again
+func (a *API) favoriteRooms(w http.ResponseWriter, r *http.Request, userID string, status int) {
+	rooms, err := a.database.ListFavoriteRooms(r.Context(), userID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list favorite rooms")
+		return
+	}
+	jsonResponse(w, status, UserRoomsResponse{Rooms: rooms})
+}
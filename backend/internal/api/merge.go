@@ -0,0 +1,156 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// Conflict markers written into merged content, as git does
+const (
+	conflictOurs   = "<<<<<<< ours"
+	conflictSplit  = "======="
+	conflictTheirs = ">>>>>>> theirs"
+)
+
+// MergeVersionsRequest names the versions of a three-way merge: the common
+// ancestor and the two versions that changed it
+type MergeVersionsRequest struct {
+	Base   int `json:"base"`
+	Ours   int `json:"ours"`
+	Theirs int `json:"theirs"`
+}
+
+// MergeConflict is a region both sides changed differently. Lines are
+// 1-based and span the markers in the merged content.
+type MergeConflict struct {
+	StartLine int      `json:"start_line"`
+	EndLine   int      `json:"end_line"`
+	Base      []string `json:"base"`
+	Ours      []string `json:"ours"`
+	Theirs    []string `json:"theirs"`
+}
+
+// MergeResponse is the result of a three-way merge. Conflicting regions are
+// left in content between git-style markers.
+type MergeResponse struct {
+	Base      VersionResponse `json:"base"`
+	Ours      VersionResponse `json:"ours"`
+	Theirs    VersionResponse `json:"theirs"`
+	Content   string          `json:"content"`
+	Clean     bool            `json:"clean"` // No conflicts
+	Conflicts []MergeConflict `json:"conflicts"`
+}
+
+// MergeVersionsHandler merges two versions against their common ancestor.
+// The caller needs access to every version's room; the one join secret a
+// request carries can only open protected rooms that share it.
+func (a *API) MergeVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	var req MergeVersionsRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	versions := make([]*db.Version, 3)
+	authorized := make(map[string]bool)
+	for i, id := range []int{req.Base, req.Ours, req.Theirs} {
+		version, err := a.database.GetVersion(r.Context(), id)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
+			return
+		}
+		if version == nil {
+			errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Version not found")
+			return
+		}
+		if !authorized[version.RoomID] {
+			if !a.authorizeVersion(w, r, version) {
+				return
+			}
+			authorized[version.RoomID] = true
+		}
+		versions[i] = version
+	}
+	base, ours, theirs := versions[0], versions[1], versions[2]
+
+	content, conflicts := mergeText(base.Content, ours.Content, theirs.Content)
+	jsonResponse(w, http.StatusOK, MergeResponse{
+		Base:      newVersionResponse(base),
+		Ours:      newVersionResponse(ours),
+		Theirs:    newVersionResponse(theirs),
+		Content:   content,
+		Clean:     len(conflicts) == 0,
+		Conflicts: conflicts,
+	})
+}
+
+// mergeText merges the changes ours and theirs each made to base, line by
+// line. Lines both sides kept anchor the merge; between anchors a side's
+// change is taken if the other left base alone or made the same change, and
+// anything else is a conflict.
+func mergeText(base, ours, theirs string) (string, []MergeConflict) {
+	baseLines := strings.Split(base, "\n")
+	ourLines := strings.Split(ours, "\n")
+	theirLines := strings.Split(theirs, "\n")
+	toOurs := lineMatches(baseLines, ourLines)
+	toTheirs := lineMatches(baseLines, theirLines)
+
+	merged := []string{}
+	conflicts := []MergeConflict{}
+	i, o, t := 0, 0, 0
+	for i < len(baseLines) || o < len(ourLines) || t < len(theirLines) {
+		// A base line both sides kept where they now are is stable
+		if i < len(baseLines) && toOurs[i] == o && toTheirs[i] == t {
+			merged = append(merged, baseLines[i])
+			i, o, t = i+1, o+1, t+1
+			continue
+		}
+
+		// Otherwise the changed chunk runs to the next line both kept
+		next, nextOurs, nextTheirs := len(baseLines), len(ourLines), len(theirLines)
+		for k := i; k < len(baseLines); k++ {
+			if toOurs[k] >= o && toTheirs[k] >= t {
+				next, nextOurs, nextTheirs = k, toOurs[k], toTheirs[k]
+				break
+			}
+		}
+		b, oc, tc := baseLines[i:next], ourLines[o:nextOurs], theirLines[t:nextTheirs]
+
+		switch {
+		case equalLines(oc, b):
+			merged = append(merged, tc...)
+		case equalLines(tc, b), equalLines(oc, tc):
+			merged = append(merged, oc...)
+		default:
+			start := len(merged) + 1
+			merged = append(merged, conflictOurs)
+			merged = append(merged, oc...)
+			merged = append(merged, conflictSplit)
+			merged = append(merged, tc...)
+			merged = append(merged, conflictTheirs)
+			conflicts = append(conflicts, MergeConflict{
+				StartLine: start,
+				EndLine:   len(merged),
+				Base:      b,
+				Ours:      oc,
+				Theirs:    tc,
+			})
+		}
+		i, o, t = next, nextOurs, nextTheirs
+	}
+	return strings.Join(merged, "\n"), conflicts
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
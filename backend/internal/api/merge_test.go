@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMergeText(t *testing.T) {
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		want               string
+		conflicts          int
+	}{
+		{"Unchanged", "a\nb", "a\nb", "a\nb", "a\nb", 0},
+		{"Only ours changed", "a\nb\nc", "a\nB\nc", "a\nb\nc", "a\nB\nc", 0},
+		{"Only theirs changed", "a\nb\nc", "a\nb\nc", "a\nb\nC", "a\nb\nC", 0},
+		{"Separate changes", "a\nb\nc\nd", "A\nb\nc\nd", "a\nb\nc\nD", "A\nb\nc\nD", 0},
+		{"Same change", "a\nb", "a\nX", "a\nX", "a\nX", 0},
+		{"Insert and delete", "a\nb\nc", "a\nnew\nb\nc", "a\nb", "a\nnew\nb", 0},
+		{"Both appended", "a", "a\nours", "a\ntheirs", "a\n<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs", 1},
+		{"Conflicting edit", "a\nb\nc", "a\nours\nc", "a\ntheirs\nc", "a\n<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs\nc", 1},
+		{"Edit against delete", "a\nb\nc", "a\nB\nc", "a\nc", "a\n<<<<<<< ours\nB\n=======\n>>>>>>> theirs\nc", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conflicts := mergeText(tt.base, tt.ours, tt.theirs)
+			if got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+			if len(conflicts) != tt.conflicts {
+				t.Errorf("Expected %d conflicts, got %+v", tt.conflicts, conflicts)
+			}
+		})
+	}
+}
+
+func TestMergeConflictRegion(t *testing.T) {
+	_, conflicts := mergeText("a\nb\nc", "a\nours\nc", "a\ntheirs\nc")
+	if len(conflicts) != 1 {
+		t.Fatalf("Expected one conflict, got %+v", conflicts)
+	}
+	c := conflicts[0]
+	if c.StartLine != 2 || c.EndLine != 6 {
+		t.Errorf("Expected the conflict on lines 2-6, got %d-%d", c.StartLine, c.EndLine)
+	}
+	if len(c.Base) != 1 || c.Base[0] != "b" || c.Ours[0] != "ours" || c.Theirs[0] != "theirs" {
+		t.Errorf("Expected each side's lines, got %+v", c)
+	}
+}
+
+func TestMergeVersionsHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := api.database.CreateRoom(ctx, "merge-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	base, _ := api.database.CreateVersion(ctx, "merge-room", "base", "", "a\nb\nc", hashContent("a\nb\nc"), "", false)
+	ours, _ := api.database.CreateVersion(ctx, "merge-room", "ours", "", "A\nb\nc", hashContent("A\nb\nc"), "", false)
+	theirs, _ := api.database.CreateVersion(ctx, "merge-room", "theirs", "", "a\nb\nC", hashContent("a\nb\nC"), "", false)
+
+	merge := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/versions/merge", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, req)
+		return w
+	}
+
+	w := merge(fmt.Sprintf(`{"base": %d, "ours": %d, "theirs": %d}`, base.ID, ours.ID, theirs.ID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response MergeResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !response.Clean || response.Content != "A\nb\nC" || len(response.Conflicts) != 0 {
+		t.Errorf("Expected a clean merge, got %+v", response)
+	}
+
+	if w := merge(fmt.Sprintf(`{"base": %d, "ours": %d, "theirs": 99999}`, base.ID, ours.ID)); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing version, got %d", w.Code)
+	}
+	if w := merge(`{"base": 1}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 without ours and theirs, got %d", w.Code)
+	}
+
+	// Every version's room must let the caller in, not just the base's
+	api.database.CreateRoom(ctx, "vault", "")
+	api.database.SetJoinSecret(ctx, "vault", "hunter2")
+	secret, _ := api.database.CreateVersion(ctx, "vault", "secret", "", "a\nb\nS", hashContent("a\nb\nS"), "", false)
+	body := fmt.Sprintf(`{"base": %d, "ours": %d, "theirs": %d}`, base.ID, ours.ID, secret.ID)
+	if w := merge(body); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 without the join secret, got %d", w.Code)
+	}
+	req := httptest.NewRequest("POST", "/api/versions/merge", strings.NewReader(body))
+	req.Header.Set(roomSecretHeader, "hunter2")
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 with the join secret, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,708 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+	"github.com/manpreetbhatti/lattice/backend/internal/telemetry"
+	"github.com/manpreetbhatti/lattice/backend/internal/ws"
+)
+
+// apiOperation documents one endpoint. Request and Response hold zero values
+// of the types the handler decodes and encodes; their schemas are derived by
+// reflection so the document follows the Go structs.
+type apiOperation struct {
+	Method   string
+	Path     string
+	Tag      string
+	Summary  string
+	Params   []apiParam
+	Request  interface{}
+	Response interface{}
+	Status   int // success status, 200 when zero
+
+	// Kept for existing clients; a newer route covers the same operation
+	Deprecated bool
+
+	// Needs an API key once any exist; see requireAPIKey
+	RequiresKey bool
+
+	// Response is a text/event-stream whose events carry Response as data
+	Stream bool
+}
+
+type apiParam struct {
+	Name        string
+	In          string // "path", "query" or "header"
+	Type        string // "string", "integer" or "boolean"
+	Description string
+	Required    bool
+}
+
+// Response shapes written as map literals by the handlers
+
+type messageResponse struct {
+	Message string `json:"message"`
+}
+
+// The 422 variant of apierror.Error
+type validationErrorBody struct {
+	Code    apierror.Code `json:"code"`
+	Message string        `json:"message"`
+	Details []FieldError  `json:"details"`
+}
+
+type healthResponse struct {
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+}
+
+// oneOf documents an endpoint that returns one of several shapes
+type oneOf []interface{}
+
+type listRoomsResponse struct {
+	Rooms      []RoomResponse `json:"rooms"`
+	Limit      int            `json:"limit"`
+	Offset     int            `json:"offset"`
+	Sort       string         `json:"sort"`
+	Order      string         `json:"order"`
+	TotalCount int            `json:"total_count"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+type listVersionsResponse struct {
+	Versions []VersionResponse `json:"versions"`
+	Total    int               `json:"total"`
+	Limit    int               `json:"limit"`
+	Offset   int               `json:"offset"`
+}
+
+type diffResponse struct {
+	Diff       []DiffLine      `json:"diff,omitempty"`  // Without ?context=
+	Hunks      []DiffHunk      `json:"hunks,omitempty"` // With ?context=
+	From       VersionResponse `json:"from"`
+	To         VersionResponse `json:"to"`
+	Summary    DiffSummary     `json:"summary"`
+	TotalLines int             `json:"total_lines"`
+	TotalHunks *int            `json:"total_hunks,omitempty"` // With ?context=
+	Offset     int             `json:"offset"`
+	Limit      int             `json:"limit"` // Zero when the rest of the diff was returned
+}
+
+type restoreResponse struct {
+	Message      string `json:"message"`
+	RestoredFrom int    `json:"restored_from"`
+	NewVersion   int    `json:"new_version"`
+	RoomID       string `json:"room_id"`
+	Content      string `json:"content"`
+}
+
+type bulkRoomsResponse struct {
+	Action    string           `json:"action"`
+	Results   []BulkRoomResult `json:"results"`
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+}
+
+type postUpdatesResponse struct {
+	RoomID    string `json:"room_id"`
+	Applied   int    `json:"applied"`
+	Sequences []int  `json:"sequences"`
+}
+
+type joinSecretResponse struct {
+	RoomID    string `json:"room_id"`
+	Protected bool   `json:"protected"`
+	JoinCode  string `json:"join_code,omitempty"`
+}
+
+type roomLanguageResponse struct {
+	RoomID   string `json:"room_id"`
+	Language string `json:"language"`
+}
+
+type statsResponse struct {
+	ActiveRooms   int                     `json:"active_rooms"`
+	ActiveClients int                     `json:"active_clients"`
+	Send          ws.SendStats            `json:"send"`
+	Connections   ws.ConnectionLimitStats `json:"connections"`
+	Memory        MemoryStats             `json:"memory"`
+	WriteBehind   db.WriteBehindStats     `json:"write_behind"`
+	Timestamp     string                  `json:"timestamp"`
+	TotalRooms    int                     `json:"total_rooms,omitempty"`
+	TotalUpdates  int                     `json:"total_updates,omitempty"`
+	WAL           *db.WALStats            `json:"wal,omitempty"`
+}
+
+type statsHistoryResponse struct {
+	Range  string           `json:"range"`
+	Step   string           `json:"step"`
+	From   time.Time        `json:"from"`
+	To     time.Time        `json:"to"`
+	Points []db.StatsSample `json:"points"`
+}
+
+type verifyResponse struct {
+	CheckedRooms  int               `json:"checked_rooms"`
+	AffectedRooms int               `json:"affected_rooms"`
+	Rooms         []db.VerifyReport `json:"rooms"`
+}
+
+type compactionStatsResponse struct {
+	LastRun             string                `json:"last_run,omitempty"`
+	LastCompacted       int                   `json:"last_compacted"`
+	Interval            string                `json:"interval"`
+	UpdateThreshold     int                   `json:"update_threshold"`
+	KeepRecentUpdates   int                   `json:"keep_recent_updates"`
+	EstimatedBytesSaved int64                 `json:"estimated_bytes_saved"`
+	Rooms               []RoomCompactionStats `json:"rooms"`
+}
+
+type connectionsResponse struct {
+	Connections []ws.ConnectionInfo `json:"connections"`
+	Count       int                 `json:"count"`
+	IdleTimeout string              `json:"idle_timeout"`
+}
+
+var (
+	roomIDPath          = apiParam{Name: "id", In: "path", Type: "string", Required: true, Description: "Room ID"}
+	versionIDPath       = apiParam{Name: "id", In: "path", Type: "integer", Required: true, Description: "Version ID"}
+	idempotencyKeyParam = apiParam{Name: idempotencyKeyHeader, In: "header", Type: "string", Description: "Retries with the same key return the version created by the first request"}
+	roomSecretQuery     = apiParam{Name: "secret", In: "query", Type: "string", Description: "Join secret for protected rooms (or the X-Room-Secret header)"}
+	promptNamePath      = apiParam{Name: "name", In: "path", Type: "string", Required: true, Description: "complete, explain, refactor, tests or fix"}
+	userIDPath          = apiParam{Name: "id", In: "path", Type: "string", Required: true, Description: "User ID"}
+	identityTokenParam  = apiParam{Name: identityTokenHeader, In: "header", Type: "string", Required: true, Description: "Identity token issued for this user"}
+	memberTokenParam    = apiParam{Name: identityTokenHeader, In: "header", Type: "string", Description: "Identity token of a workspace member, for rooms in a workspace"}
+	workspaceIDPath     = apiParam{Name: "id", In: "path", Type: "string", Required: true, Description: "Workspace ID"}
+	memberIDPath        = apiParam{Name: "user", In: "path", Type: "string", Required: true, Description: "User ID of the member"}
+	workspaceRoomPath   = apiParam{Name: "room", In: "path", Type: "string", Required: true, Description: "Room ID"}
+)
+
+// Every documented endpoint. Add an entry here when adding a route.
+func apiOperations() []apiOperation {
+	return []apiOperation{
+		{Method: "GET", Path: "/health", Tag: "system", Summary: "Health check", Response: healthResponse{}},
+		{Method: "GET", Path: "/api/stats", Tag: "stats", Summary: "Server statistics", Response: statsResponse{}},
+		{Method: "GET", Path: "/api/stats/history", Tag: "stats", Summary: "Sampled usage over time",
+			Params: []apiParam{
+				{Name: "range", In: "query", Type: "string", Description: "How far back to look, e.g. 24h"},
+				{Name: "step", In: "query", Type: "string", Description: "Bucket size, e.g. 5m"},
+			},
+			Response: statsHistoryResponse{}},
+		{Method: "GET", Path: "/api/stats/aggregate", Tag: "stats", Summary: "Anonymous usage since start, when telemetry is enabled",
+			Response: telemetry.Aggregate{}},
+		{Method: "GET", Path: "/metrics", Tag: "stats", Summary: "Server and busiest-room load in the Prometheus text format",
+			RequiresKey: true},
+
+		{Method: "GET", Path: "/api/rooms", Tag: "rooms", Summary: "List rooms",
+			Params: []apiParam{
+				{Name: "limit", In: "query", Type: "integer", Description: "Page size (max 100)"},
+				{Name: "offset", In: "query", Type: "integer", Description: "Rows to skip when not using a cursor"},
+				{Name: "cursor", In: "query", Type: "string", Description: "next_cursor from the previous page"},
+				{Name: "sort", In: "query", Type: "string", Description: "created_at, updated_at or name"},
+				{Name: "order", In: "query", Type: "string", Description: "asc or desc"},
+				{Name: "q", In: "query", Type: "string", Description: "Case-insensitive name search"},
+				{Name: "updated_after", In: "query", Type: "string", Description: "RFC 3339 timestamp"},
+				{Name: "active", In: "query", Type: "boolean", Description: "Only rooms with connected clients"},
+				{Name: "workspace", In: "query", Type: "string", Description: "List this workspace's rooms instead of those outside any workspace"},
+				memberTokenParam,
+			},
+			Response: listRoomsResponse{}},
+		{Method: "POST", Path: "/api/rooms", Tag: "rooms", Summary: "Create a room",
+			Params: []apiParam{memberTokenParam}, Request: CreateRoomRequest{}, Response: RoomResponse{}, Status: http.StatusCreated},
+		{Method: "GET", Path: "/api/rooms/{id}", Tag: "rooms", Summary: "Get room details and usage",
+			Params: []apiParam{roomIDPath, memberTokenParam}, Response: RoomResponse{}},
+		{Method: "DELETE", Path: "/api/rooms/{id}", Tag: "rooms", Summary: "Delete a room",
+			Params: []apiParam{roomIDPath, memberTokenParam}, Response: messageResponse{}},
+		{Method: "GET", Path: "/api/rooms/{id}/usage", Tag: "rooms", Summary: "Storage breakdown and connected clients over the last 24h",
+			Params: []apiParam{
+				roomIDPath,
+				{Name: "step", In: "query", Type: "string", Description: "Client history bucket size, 1m to 24h (default 5m)"},
+				memberTokenParam,
+			},
+			Response: RoomUsageReport{}},
+		{Method: "GET", Path: "/api/rooms/{id}/at", Tag: "rooms", Summary: "Rebuild the document as it read at a past time",
+			Params: []apiParam{
+				roomIDPath,
+				{Name: "time", In: "query", Type: "string", Required: true, Description: "RFC3339 timestamp, no earlier than the room's last compaction"},
+				memberTokenParam,
+			},
+			Response: RoomAtResponse{}},
+		{Method: "GET", Path: "/api/rooms/{id}/contributions", Tag: "rooms", Summary: "Updates, bytes and active times per author of the room's stored updates",
+			Params: []apiParam{roomIDPath, memberTokenParam}, Response: contributionsResponse{}},
+		{Method: "GET", Path: "/api/rooms/{id}/playback", Tag: "rooms", Summary: "Stream the document's stored updates between two times, with their authors and the text after each (SSE, or an NDJSON download)",
+			Params: []apiParam{
+				roomIDPath,
+				{Name: "from", In: "query", Type: "string", Description: "RFC3339 start, no earlier than the last compaction (default: oldest stored history)"},
+				{Name: "to", In: "query", Type: "string", Description: "RFC3339 end (default: now)"},
+				{Name: "format", In: "query", Type: "string", Description: "sse (default) or ndjson for a file download"},
+				memberTokenParam,
+			},
+			Response: PlaybackEvent{}, Stream: true},
+		{Method: "POST", Path: "/api/rooms/bulk", Tag: "rooms", Summary: "Delete, archive or export many rooms",
+			Params: []apiParam{memberTokenParam, roomSecretQuery}, Request: BulkRoomsRequest{}, Response: bulkRoomsResponse{}, RequiresKey: true},
+		{Method: "GET", Path: "/api/rooms/{id}/archive", Tag: "rooms", Summary: "Download a room, its document and versions as a gzipped tarball",
+			Params: []apiParam{roomIDPath}, RequiresKey: true},
+		{Method: "POST", Path: "/api/rooms/import", Tag: "rooms", Summary: "Recreate a room from an archive in the body",
+			Params:   []apiParam{{Name: "id", In: "query", Type: "string", Description: "Room ID to import under instead of the archived one"}},
+			Response: RoomResponse{}, Status: http.StatusCreated, RequiresKey: true},
+		{Method: "POST", Path: "/api/rooms/{id}/updates", Tag: "rooms", Summary: "Apply Yjs updates made offline",
+			Params: []apiParam{roomIDPath, roomSecretQuery}, Request: PostUpdatesRequest{}, Response: postUpdatesResponse{}},
+		{Method: "PUT", Path: "/api/rooms/{id}/language", Tag: "rooms", Summary: "Set the editor language of the room's document",
+			Params: []apiParam{roomIDPath}, Request: SetRoomLanguageRequest{}, Response: roomLanguageResponse{}},
+		{Method: "PUT", Path: "/api/rooms/{id}/join-secret", Tag: "rooms", Summary: "Set a password or rotate the join code",
+			Params: []apiParam{roomIDPath}, Request: SetJoinSecretRequest{}, Response: joinSecretResponse{}},
+		{Method: "DELETE", Path: "/api/rooms/{id}/join-secret", Tag: "rooms", Summary: "Remove the join secret",
+			Params: []apiParam{roomIDPath}, Response: joinSecretResponse{}},
+		{Method: "POST", Path: "/api/rooms/{id}/run", Tag: "rooms", Summary: "Run posted code or the latest version in the sandbox, streaming stdout, stderr and exit events (SSE)",
+			Params: []apiParam{roomIDPath, roomSecretQuery}, Request: RunRequest{}, Response: RunExit{}, Stream: true},
+
+		{Method: "GET", Path: "/api/rooms/{id}/policy", Tag: "versions", Summary: "How often clients should auto-save the room and how auto-saves are deduplicated and pruned",
+			Params: []apiParam{roomIDPath}, Response: RoomPolicyResponse{}},
+		{Method: "GET", Path: "/api/rooms/{id}/versions", Tag: "versions", Summary: "List versions of a room",
+			Params: []apiParam{
+				roomIDPath,
+				{Name: "limit", In: "query", Type: "integer", Description: "Page size (max 100)"},
+				{Name: "offset", In: "query", Type: "integer"},
+			},
+			Response: listVersionsResponse{}},
+		{Method: "POST", Path: "/api/rooms/{id}/versions", Tag: "versions", Summary: "Save a version (room_id may be omitted)",
+			Params: []apiParam{roomIDPath, idempotencyKeyParam}, Request: CreateVersionRequest{}, Response: VersionResponse{}, Status: http.StatusCreated},
+		{Method: "GET", Path: "/api/rooms/{id}/versions/export", Tag: "versions", Summary: "Download versions as a zip of one file each, named by save time, with a versions.json manifest",
+			Params: []apiParam{
+				roomIDPath,
+				{Name: "from", In: "query", Type: "string", Description: "Only versions saved at or after this RFC3339 time"},
+				{Name: "to", In: "query", Type: "string", Description: "Only versions saved at or before this RFC3339 time"},
+				{Name: "auto", In: "query", Type: "boolean", Description: "Include auto-saves (default true)"},
+				{Name: "pinned", In: "query", Type: "boolean", Description: "Only pinned versions"},
+			}},
+		{Method: "GET", Path: "/api/rooms/{id}/versions/graph", Tag: "versions", Summary: "Version history as a tree of parent and restore links",
+			Params: []apiParam{roomIDPath}, Response: VersionGraphResponse{}},
+		{Method: "GET", Path: "/api/rooms/{id}/merge-proposal", Tag: "versions", Summary: "Diff a branch against the room it was branched from",
+			Params: []apiParam{roomIDPath}, Response: MergeProposalResponse{}},
+		{Method: "GET", Path: "/api/versions", Tag: "versions", Summary: "List versions of a room", Deprecated: true,
+			Params: []apiParam{
+				{Name: "room_id", In: "query", Type: "string", Required: true},
+				{Name: "limit", In: "query", Type: "integer", Description: "Page size (max 100)"},
+				{Name: "offset", In: "query", Type: "integer"},
+			},
+			Response: listVersionsResponse{}},
+		{Method: "POST", Path: "/api/versions", Tag: "versions", Summary: "Save a version", Deprecated: true,
+			Params: []apiParam{idempotencyKeyParam}, Request: CreateVersionRequest{}, Response: VersionResponse{}, Status: http.StatusCreated},
+		{Method: "GET", Path: "/api/versions/{id}", Tag: "versions", Summary: "Get a version with its content",
+			Params: []apiParam{versionIDPath}, Response: VersionResponse{}},
+		{Method: "GET", Path: "/api/versions/{id}/raw", Tag: "versions", Summary: "Download only the content, typed and named after the room's language",
+			Params: []apiParam{versionIDPath}},
+		{Method: "DELETE", Path: "/api/versions/{id}", Tag: "versions", Summary: "Delete a version",
+			Params: []apiParam{versionIDPath}, Response: messageResponse{}},
+		{Method: "GET", Path: "/api/versions/diff", Tag: "versions", Summary: "Line diff between two versions",
+			Params: []apiParam{
+				{Name: "from", In: "query", Type: "integer", Required: true},
+				{Name: "to", In: "query", Type: "integer", Required: true},
+				{Name: "context", In: "query", Type: "integer", Description: "Group changes into hunks with this many unchanged lines around them"},
+				{Name: "limit", In: "query", Type: "integer", Description: "Diff lines, or hunks with context, to return (all by default)"},
+				{Name: "offset", In: "query", Type: "integer", Description: "Diff lines, or hunks with context, to skip"},
+			},
+			Response: diffResponse{}},
+		{Method: "POST", Path: "/api/versions/merge", Tag: "versions", Summary: "Three-way merge of two versions against their common ancestor",
+			Request: MergeVersionsRequest{}, Response: MergeResponse{}},
+		{Method: "GET", Path: "/api/versions/{id}/summary", Tag: "versions", Summary: "Line and character change counts against the previous version",
+			Params: []apiParam{versionIDPath}, Response: VersionSummaryResponse{}},
+		{Method: "POST", Path: "/api/versions/{id}/summarize", Tag: "versions", Summary: "Replace the description with an AI summary of the change (the body may be omitted)",
+			Params: []apiParam{versionIDPath}, Request: SummarizeVersionRequest{}, Response: VersionResponse{}},
+		{Method: "POST", Path: "/api/versions/{id}/restore", Tag: "versions", Summary: "Restore a version",
+			Params: []apiParam{versionIDPath, {Name: "If-Match", In: "header", Type: "string",
+				Description: `Latest version ID the client has seen, such as "12" ("0" for none); the restore fails with 409 VERSION_CONFLICT if another was saved since`}},
+			Response: restoreResponse{}},
+		{Method: "POST", Path: "/api/versions/{id}/pin", Tag: "versions", Summary: "Pin a version so pruning old auto-saves never removes it",
+			Params: []apiParam{versionIDPath}, Response: VersionResponse{}},
+		{Method: "DELETE", Path: "/api/versions/{id}/pin", Tag: "versions", Summary: "Unpin a version",
+			Params: []apiParam{versionIDPath}, Response: VersionResponse{}},
+		{Method: "POST", Path: "/api/versions/{id}/branch", Tag: "versions", Summary: "Create a room seeded from a version (the body may be omitted)",
+			Params: []apiParam{versionIDPath}, Request: BranchVersionRequest{}, Response: BranchResponse{}, Status: http.StatusCreated},
+
+		{Method: "GET", Path: "/api/ai/providers", Tag: "ai", Summary: "Provider availability, failover order and recent latency",
+			Response: AIProvidersResponse{}},
+		{Method: "POST", Path: "/api/ai/complete", Tag: "ai", Summary: "Complete code at the cursor",
+			Request: AICompleteRequest{}, Response: AICompleteResponse{}},
+		{Method: "POST", Path: "/api/ai/explain", Tag: "ai", Summary: "Explain code",
+			Request: AIExplainRequest{}, Response: struct {
+				Explanation string `json:"explanation"`
+			}{}},
+		{Method: "POST", Path: "/api/ai/refactor", Tag: "ai", Summary: "Refactor code",
+			Request: AIRefactorRequest{}, Response: struct {
+				Refactored string `json:"refactored"`
+			}{}},
+
+		{Method: "POST", Path: "/api/ai/tests", Tag: "ai", Summary: "Generate unit tests for code",
+			Request: AITestsRequest{}, Response: AITestsResponse{}},
+		{Method: "POST", Path: "/api/ai/fix", Tag: "ai", Summary: "Suggest a minimal fix for a compiler or linter error as a unified diff",
+			Request: AIFixRequest{}, Response: AIFixResponse{}},
+		{Method: "POST", Path: "/api/ai/review", Tag: "ai", Summary: "Review the diff between two versions, or a room's live content and its latest version",
+			Request: AIReviewRequest{}, Response: AIReviewResponse{}},
+
+		{Method: "POST", Path: "/api/auth/guest", Tag: "auth", Summary: "Issue a signed guest identity",
+			Request: GuestRequest{}, Response: GuestResponse{}, Status: http.StatusCreated},
+
+		{Method: "POST", Path: "/api/users", Tag: "users", Summary: "Create a profile, returning its sign-in secret and an identity token",
+			Request: CreateUserRequest{}, Response: UserResponse{}, Status: http.StatusCreated},
+		{Method: "GET", Path: "/api/users/{id}", Tag: "users", Summary: "Get your profile and editor preferences",
+			Params: []apiParam{userIDPath, identityTokenParam}, Response: db.User{}},
+		{Method: "PATCH", Path: "/api/users/{id}", Tag: "users", Summary: "Change your name, color or preferences; connected sessions and presence follow",
+			Params: []apiParam{userIDPath, identityTokenParam}, Request: UpdateUserRequest{}, Response: UserResponse{}},
+		{Method: "DELETE", Path: "/api/users/{id}", Tag: "users", Summary: "Delete your profile",
+			Params: []apiParam{userIDPath, identityTokenParam}, Response: messageResponse{}},
+		{Method: "POST", Path: "/api/users/{id}/token", Tag: "users", Summary: "Sign in to a profile on another device with its secret",
+			Params: []apiParam{userIDPath}, Request: UserTokenRequest{}, Response: UserResponse{}},
+		{Method: "GET", Path: "/api/me/recent", Tag: "users", Summary: "Rooms your sessions joined, most recent first",
+			Params: []apiParam{identityTokenParam, {Name: "limit", In: "query", Type: "integer", Description: "At most 50; defaults to 20"}}, Response: UserRoomsResponse{}},
+		{Method: "DELETE", Path: "/api/me/recent/{id}", Tag: "users", Summary: "Remove a room from your recent rooms",
+			Params: []apiParam{roomIDPath, identityTokenParam}, Response: messageResponse{}},
+		{Method: "GET", Path: "/api/me/favorites", Tag: "users", Summary: "Rooms you starred",
+			Params: []apiParam{identityTokenParam}, Response: UserRoomsResponse{}},
+		{Method: "PUT", Path: "/api/me/favorites/{id}", Tag: "users", Summary: "Star a room, returning your favorites",
+			Params: []apiParam{roomIDPath, identityTokenParam}, Response: UserRoomsResponse{}},
+		{Method: "DELETE", Path: "/api/me/favorites/{id}", Tag: "users", Summary: "Unstar a room, returning your favorites",
+			Params: []apiParam{roomIDPath, identityTokenParam}, Response: UserRoomsResponse{}},
+
+		{Method: "POST", Path: "/api/workspaces", Tag: "workspaces", Summary: "Create a workspace owned by your profile",
+			Params: []apiParam{identityTokenParam}, Request: CreateWorkspaceRequest{}, Response: WorkspaceResponse{}, Status: http.StatusCreated},
+		{Method: "GET", Path: "/api/workspaces", Tag: "workspaces", Summary: "Workspaces you belong to, with your role",
+			Params: []apiParam{identityTokenParam}, Response: workspacesResponse{}},
+		{Method: "GET", Path: "/api/workspaces/{id}", Tag: "workspaces", Summary: "A workspace's members, limits and usage",
+			Params: []apiParam{workspaceIDPath, identityTokenParam}, Response: WorkspaceResponse{}},
+		{Method: "DELETE", Path: "/api/workspaces/{id}", Tag: "workspaces", Summary: "Delete a workspace with no rooms (owners)",
+			Params: []apiParam{workspaceIDPath, identityTokenParam}, Response: messageResponse{}},
+		{Method: "PUT", Path: "/api/workspaces/{id}/members/{user}", Tag: "workspaces", Summary: "Add a member or change their role (owners)",
+			Params: []apiParam{workspaceIDPath, memberIDPath, identityTokenParam}, Request: SetMemberRequest{}, Response: workspaceMembersResponse{}},
+		{Method: "DELETE", Path: "/api/workspaces/{id}/members/{user}", Tag: "workspaces", Summary: "Remove a member (owners) or leave",
+			Params: []apiParam{workspaceIDPath, memberIDPath, identityTokenParam}, Response: workspaceMembersResponse{}},
+		{Method: "PUT", Path: "/api/workspaces/{id}/rooms/{room}", Tag: "workspaces", Summary: "Move an unused room into the workspace or create it there (owners; any room with an admin API key)",
+			Params: []apiParam{workspaceIDPath, workspaceRoomPath, identityTokenParam}, Response: messageResponse{}},
+		{Method: "DELETE", Path: "/api/workspaces/{id}/rooms/{room}", Tag: "workspaces", Summary: "Open a workspace room to everyone (owners)",
+			Params: []apiParam{workspaceIDPath, workspaceRoomPath, identityTokenParam}, Response: messageResponse{}},
+
+		{Method: "GET", Path: "/api/events", Tag: "admin", Summary: "Stream room lifecycle and version events (SSE)",
+			Params: []apiParam{
+				{Name: "room", In: "query", Type: "string", Description: "Only events for this room"},
+				{Name: "type", In: "query", Type: "string", Description: "Comma-separated event types or categories, e.g. room.created,version"},
+				{Name: "Last-Event-ID", In: "header", Type: "string", Description: "Resume after this event"},
+			},
+			Response: events.Event{}, Stream: true, RequiresKey: true},
+		{Method: "POST", Path: "/api/admin/verify", Tag: "admin", Summary: "Check stored updates for corruption",
+			Params:   []apiParam{{Name: "room", In: "query", Type: "string", Description: "Only verify this room"}},
+			Response: verifyResponse{}, RequiresKey: true},
+		{Method: "POST", Path: "/api/admin/compact", Tag: "admin", Summary: "Force compaction of a room or all rooms",
+			Params:   []apiParam{{Name: "room_id", In: "query", Type: "string", Description: "Only compact this room"}},
+			Response: oneOf{compaction.Result{}, compaction.Status{}}, RequiresKey: true},
+		{Method: "GET", Path: "/api/admin/compaction", Tag: "admin", Summary: "Compaction status and per-room storage",
+			Response: compactionStatsResponse{}, RequiresKey: true},
+		{Method: "GET", Path: "/api/admin/connections", Tag: "admin", Summary: "Connected sessions with traffic statistics",
+			Params:   []apiParam{{Name: "room_id", In: "query", Type: "string"}},
+			Response: connectionsResponse{}, RequiresKey: true},
+		{Method: "POST", Path: "/api/admin/rooms/{id}/kick", Tag: "admin", Summary: "Disconnect a client from a room",
+			Params: []apiParam{roomIDPath}, Request: KickRequest{}, Response: KickResponse{}, RequiresKey: true},
+		{Method: "POST", Path: "/api/admin/rooms/{id}/notice", Tag: "admin", Summary: "Send a notice to every session in a room",
+			Params: []apiParam{roomIDPath}, Request: NoticeRequest{}, Response: NoticeResponse{}, RequiresKey: true},
+		{Method: "PUT", Path: "/api/admin/rooms/{id}/lock", Tag: "admin", Summary: "Make a room read-only for a while, with its pending updates written",
+			Params: []apiParam{
+				roomIDPath,
+				{Name: "ttl", In: "query", Type: "string", Description: "How long the lock lasts unless lifted, up to 1h (default 1m)"},
+			},
+			Response: RoomLockResponse{}, RequiresKey: true},
+		{Method: "DELETE", Path: "/api/admin/rooms/{id}/lock", Tag: "admin", Summary: "Let a locked room be edited again",
+			Params: []apiParam{roomIDPath}, Response: RoomLockResponse{}, RequiresKey: true},
+		{Method: "GET", Path: "/api/admin/ai/prompts", Tag: "admin", Summary: "AI system prompts with their built-in defaults",
+			Response: listPromptsResponse{}, RequiresKey: true},
+		{Method: "PUT", Path: "/api/admin/ai/prompts/{name}", Tag: "admin", Summary: "Replace an AI system prompt",
+			Params: []apiParam{promptNamePath}, Request: SetPromptRequest{}, Response: PromptResponse{}, RequiresKey: true},
+		{Method: "DELETE", Path: "/api/admin/ai/prompts/{name}", Tag: "admin", Summary: "Restore an AI system prompt's built-in default",
+			Params: []apiParam{promptNamePath}, Response: PromptResponse{}, RequiresKey: true},
+		{Method: "PUT", Path: "/api/admin/workspaces/{id}/quota", Tag: "admin", Summary: "Set a workspace's room limit and per-room storage quota",
+			Params: []apiParam{workspaceIDPath}, Request: WorkspaceQuotaRequest{}, Response: WorkspaceResponse{}, RequiresKey: true},
+	}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	codeType = reflect.TypeOf(apierror.Code(""))
+)
+
+// Derives JSON schemas from Go types, collecting named structs as components
+type schemaBuilder struct {
+	components map[string]interface{}
+	names      map[reflect.Type]string
+}
+
+// Schema for a documented request or response value
+func (b *schemaBuilder) schemaOf(v interface{}) map[string]interface{} {
+	if alternatives, ok := v.(oneOf); ok {
+		schemas := make([]map[string]interface{}, len(alternatives))
+		for i, alt := range alternatives {
+			schemas[i] = b.schemaOf(alt)
+		}
+		return map[string]interface{}{"oneOf": schemas}
+	}
+	return b.schemaFor(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) schemaFor(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t == codeType {
+		return map[string]interface{}{"type": "string", "enum": apierror.Codes()}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schemaFor(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		// encoding/json writes []byte as base64
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		return b.ref(t)
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// Registers a named struct as a component and returns a reference to it
+func (b *schemaBuilder) ref(t reflect.Type) map[string]interface{} {
+	name, ok := b.names[t]
+	if !ok {
+		name = strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, taken := b.components[name]; taken {
+			pkg := t.PkgPath()
+			pkg = pkg[strings.LastIndex(pkg, "/")+1:]
+			name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+		}
+		b.names[t] = name
+		b.components[name] = map[string]interface{}{} // placeholder for recursive types
+		b.components[name] = b.structSchema(t)
+	}
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	b.addFields(t, properties, &required)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// Adds a struct's fields following encoding/json rules: embedded structs are
+// flattened, "-" fields skipped and omitempty fields optional
+func (b *schemaBuilder) addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				b.addFields(embedded, properties, required)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = b.schemaFor(field.Type)
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Ptr {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// BuildOpenAPISpec assembles the OpenAPI 3 document for the REST API
+func BuildOpenAPISpec() map[string]interface{} {
+	b := &schemaBuilder{
+		components: map[string]interface{}{},
+		names:      map[reflect.Type]string{},
+	}
+	errorSchema := b.schemaOf(apierror.Error{})
+
+	paths := map[string]interface{}{}
+	for _, op := range apiOperations() {
+		operation := map[string]interface{}{
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"operationId": strings.ToLower(op.Method) + operationName(op.Path),
+		}
+
+		if op.Deprecated {
+			operation["deprecated"] = true
+		}
+		if op.RequiresKey {
+			operation["security"] = []map[string][]string{{"apiKey": {}}}
+		}
+
+		if len(op.Params) > 0 {
+			params := make([]map[string]interface{}, len(op.Params))
+			for i, p := range op.Params {
+				params[i] = map[string]interface{}{
+					"name":     p.Name,
+					"in":       p.In,
+					"required": p.Required || p.In == "path",
+					"schema":   map[string]interface{}{"type": p.Type},
+				}
+				if p.Description != "" {
+					params[i]["description"] = p.Description
+				}
+			}
+			operation["parameters"] = params
+		}
+
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(b.schemaOf(op.Request)),
+			}
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		responses := map[string]interface{}{
+			"default": map[string]interface{}{"description": "Error", "content": jsonContent(errorSchema)},
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		if op.Response != nil && op.Stream {
+			success["content"] = map[string]interface{}{
+				"text/event-stream": map[string]interface{}{"schema": b.schemaOf(op.Response)},
+			}
+		} else if op.Response != nil {
+			success["content"] = jsonContent(b.schemaOf(op.Response))
+		}
+		responses[strconv.Itoa(status)] = success
+		if validated(op.Request) {
+			responses["422"] = map[string]interface{}{
+				"description": "Invalid fields",
+				"content":     jsonContent(b.schemaOf(validationErrorBody{})),
+			}
+		}
+		operation["responses"] = responses
+
+		item, ok := paths[op.Path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Lattice API",
+			"version":     "1.0.0",
+			"description": "REST API of the Lattice collaborative editor. Real-time sync uses the WebSocket at /ws.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "An API key from `lattice-server create-api-key`. Required only once a key exists.",
+				},
+			},
+		},
+	}
+}
+
+// Reports whether handlers validate a request body and may answer 422
+func validated(request interface{}) bool {
+	if request == nil {
+		return false
+	}
+	_, ok := reflect.New(reflect.TypeOf(request)).Interface().(validatable)
+	return ok
+}
+
+// Turns "/api/rooms/{id}/updates" into "RoomsIdUpdates"
+func operationName(path string) string {
+	var name strings.Builder
+	for _, part := range strings.Split(strings.TrimPrefix(path, "/api"), "/") {
+		part = strings.Trim(part, "{}")
+		for _, word := range strings.FieldsFunc(part, func(r rune) bool { return r == '-' || r == '_' }) {
+			name.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return name.String()
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPISpec map[string]interface{}
+)
+
+// OpenAPIHandler serves the generated OpenAPI document
+func (a *API) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPISpec = BuildOpenAPISpec()
+	})
+	if a.basePath == "" {
+		jsonResponse(w, http.StatusOK, openAPISpec)
+		return
+	}
+
+	// The cached spec is shared, so the server is added to a copy
+	spec := make(map[string]interface{}, len(openAPISpec)+1)
+	for k, v := range openAPISpec {
+		spec[k] = v
+	}
+	spec["servers"] = []map[string]string{{"url": a.basePath}}
+	jsonResponse(w, http.StatusOK, spec)
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Unchanged lines around each change in a unified diff
+const patchContextLines = 3
+
+// Renders a diff from computeDiff in unified format, with hunks of
+// patchContextLines context. Returns "" if nothing changed.
+func renderUnifiedDiff(diff []DiffLine, oldName, newName string) string {
+	hunks := diffHunks(diff, patchContextLines)
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+	for _, hunk := range hunks {
+		b.WriteString(hunk.Header + "\n")
+		for _, line := range hunk.Lines {
+			marker := " "
+			switch line.Type {
+			case "added":
+				marker = "+"
+			case "removed":
+				marker = "-"
+			}
+			b.WriteString(marker + line.Content + "\n")
+		}
+	}
+	return b.String()
+}
+
+// A hunk range covering count lines after the first before; an empty range
+// names the line it follows
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return strconv.Itoa(before + 1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// One hunk of a unified diff
+type patchHunk struct {
+	oldStart int // 1-based; for an empty old side, the line it follows
+	old      []string
+	new      []string
+}
+
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+\d+(?:,\d+)? @@`)
+
+var errNoHunks = errors.New("no hunks in patch")
+
+// Reads the hunks of a unified diff, skipping file headers and anything
+// before the first hunk. Blank lines inside a hunk are read as blank
+// context, since they often lose their leading space.
+func parsePatch(patch string) ([]patchHunk, error) {
+	var hunks []patchHunk
+	var current *patchHunk
+	for _, line := range strings.Split(patch, "\n") {
+		if m := hunkHeaderPattern.FindStringSubmatch(line); m != nil {
+			start, _ := strconv.Atoi(m[1])
+			hunks = append(hunks, patchHunk{oldStart: start})
+			current = &hunks[len(hunks)-1]
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "--- "), strings.HasPrefix(line, "+++ "):
+			// The next file's header ends the hunk
+			current = nil
+		case line == "":
+			current.old = append(current.old, "")
+			current.new = append(current.new, "")
+		case line[0] == ' ':
+			current.old = append(current.old, line[1:])
+			current.new = append(current.new, line[1:])
+		case line[0] == '-':
+			current.old = append(current.old, line[1:])
+		case line[0] == '+':
+			current.new = append(current.new, line[1:])
+		case line[0] == '\\':
+			// "\ No newline at end of file"
+		default:
+			current = nil
+		}
+	}
+	if len(hunks) == 0 {
+		return nil, errNoHunks
+	}
+	for i := range hunks {
+		trimBlankContext(&hunks[i])
+	}
+	return hunks, nil
+}
+
+// Drops trailing blank context a hunk picked up from the blank lines that
+// end most replies
+func trimBlankContext(h *patchHunk) {
+	for len(h.old) > 0 && len(h.new) > 0 && h.old[len(h.old)-1] == "" && h.new[len(h.new)-1] == "" {
+		h.old = h.old[:len(h.old)-1]
+		h.new = h.new[:len(h.new)-1]
+	}
+}
+
+// Applies a unified diff to content. Hunks are matched by their lines
+// rather than their line numbers, which are only used to choose between
+// several matches, so a patch with miscounted headers still applies. Fails
+// if a hunk's old lines are not found in order.
+func applyPatch(content, patch string) (string, error) {
+	hunks, err := parsePatch(patch)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(content, "\n")
+	var out []string
+	pos := 0 // Lines before pos have been copied or replaced
+	for n, h := range hunks {
+		at := -1
+		if len(h.old) == 0 {
+			at = min(max(h.oldStart, pos), len(lines))
+		} else {
+			at = findLines(lines, h.old, pos, h.oldStart-1)
+		}
+		if at < 0 {
+			return "", fmt.Errorf("hunk %d does not match the code", n+1)
+		}
+		out = append(out, lines[pos:at]...)
+		out = append(out, h.new...)
+		pos = at + len(h.old)
+	}
+	out = append(out, lines[pos:]...)
+	return strings.Join(out, "\n"), nil
+}
+
+// Returns the index at or after from where want occurs in lines, choosing
+// the occurrence nearest hint, or -1. Lines are compared exactly first and
+// then ignoring trailing whitespace.
+func findLines(lines, want []string, from, hint int) int {
+	for _, equal := range []func(a, b string) bool{
+		func(a, b string) bool { return a == b },
+		func(a, b string) bool { return strings.TrimRight(a, " \t\r") == strings.TrimRight(b, " \t\r") },
+	} {
+		best := -1
+		for i := from; i+len(want) <= len(lines); i++ {
+			match := true
+			for j := range want {
+				if !equal(lines[i+j], want[j]) {
+					match = false
+					break
+				}
+			}
+			if match && (best < 0 || abs(i-hint) < abs(best-hint)) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			return best
+		}
+	}
+	return -1
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
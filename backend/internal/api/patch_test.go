@@ -0,0 +1,80 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestRenderUnifiedDiff(t *testing.T) {
+	old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk"
+	new := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl"
+	want := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -9,3 +9,4 @@
+ i
+ j
+ k
++l
+`
+	if got := renderUnifiedDiff(computeDiff(old, new), "old", "new"); got != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, got)
+	}
+	if got := renderUnifiedDiff(computeDiff(old, old), "old", "new"); got != "" {
+		t.Errorf("Expected no diff for equal content, got:\n%s", got)
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	code := "func f() {\n\tx := 1\n\treturn x\n}\n\nfunc g() {\n\treturn\n}"
+
+	tests := []struct {
+		name  string
+		patch string
+		want  string
+	}{
+		{
+			name:  "Exact hunk",
+			patch: "--- a/code\n+++ b/code\n@@ -2,2 +2,2 @@\n \tx := 1\n-\treturn x\n+\treturn x + 1\n",
+			want:  "func f() {\n\tx := 1\n\treturn x + 1\n}\n\nfunc g() {\n\treturn\n}",
+		},
+		{
+			name:  "Wrong line numbers and a fence",
+			patch: "```diff\n@@ -40,3 +40,3 @@\n func g() {\n-\treturn\n+\treturn nil\n }\n```",
+			want:  "func f() {\n\tx := 1\n\treturn x\n}\n\nfunc g() {\n\treturn nil\n}",
+		},
+		{
+			name:  "Blank context without its space",
+			patch: "@@ -4,3 +4,4 @@\n }\n\n+// g does nothing\n func g() {\n",
+			want:  "func f() {\n\tx := 1\n\treturn x\n}\n\n// g does nothing\nfunc g() {\n\treturn\n}",
+		},
+		{
+			name:  "Insertion",
+			patch: "@@ -0,0 +1 @@\n+package main\n",
+			want:  "package main\n" + code,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyPatch(code, tt.patch)
+			if err != nil {
+				t.Fatalf("Failed to apply: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected:\n%s\ngot:\n%s", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := applyPatch(code, "@@ -1 +1 @@\n-func h() {\n+func f() {\n"); err == nil {
+		t.Error("Expected an error for a hunk that does not match")
+	}
+	if _, err := applyPatch(code, "Looks fine to me"); err != errNoHunks {
+		t.Errorf("Expected errNoHunks, got %v", err)
+	}
+}
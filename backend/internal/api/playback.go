@@ -0,0 +1,192 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// Most updates one playback streams; the end event says when more remain
+const maxPlaybackUpdates = 10000
+
+// Stops the update scan once maxPlaybackUpdates have been sent
+var errPlaybackFull = errors.New("playback limit reached")
+
+// PlaybackEvent is one step of a room's history. A playback opens with a
+// start event holding the text at its start, then an update event per
+// stored update, and closes with an end event.
+type PlaybackEvent struct {
+	Type      string    `json:"type"`             // start, update or end
+	ID        int64     `json:"id,omitempty"`     // Stored update ID, on updates
+	At        time.Time `json:"at"`               // When the update was stored, to the second
+	Update    []byte    `json:"update,omitempty"` // The raw Yjs update, on updates
+	Content   string    `json:"content"`          // The text after the event
+	Count     int       `json:"count,omitempty"`  // Updates streamed, on end
+	Truncated bool      `json:"truncated,omitempty"`
+
+	db.Author // Who made the update, when known
+}
+
+// PlaybackHandler streams how a room's document evolved between two times,
+// so clients can animate an editing session:
+// GET /api/rooms/{id}/playback?from=...&to=...&format=sse
+//
+// Both times are RFC3339. from defaults to the oldest stored history and to
+// to now; from can't precede the last compaction. The events go out as SSE,
+// or with format=ndjson as a downloadable file of one JSON event per line.
+func (a *API) PlaybackHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format == "" {
+		format = "sse"
+	}
+	if format != "sse" && format != "ndjson" {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "format must be sse or ndjson")
+		return
+	}
+	var from time.Time
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "from must be an RFC3339 timestamp")
+			return
+		}
+		from = t
+	}
+	to := time.Now().UTC()
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "to must be an RFC3339 timestamp")
+			return
+		}
+		to = t
+	}
+	if !from.IsZero() && !to.After(from) {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "to must be after from")
+		return
+	}
+
+	room, err := a.database.GetRoom(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
+		return
+	}
+	if room == nil {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found")
+		return
+	}
+	if !a.authorizeRoom(w, r, roomID) {
+		return
+	}
+
+	// Without from, play from the snapshot when there is one: it is the
+	// oldest state still stored
+	start := from
+	if start.IsZero() {
+		_, snapshotAt, err := a.database.GetSnapshotAt(r.Context(), roomID)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to load room history")
+			return
+		}
+		if snapshotAt != nil {
+			start = *snapshotAt
+		}
+	}
+	snapshot, ok := a.historySnapshot(w, r, roomID, start)
+	if !ok {
+		return
+	}
+	rp := newReplay(snapshot)
+	if !start.IsZero() {
+		err := a.database.ForEachUpdateUntil(r.Context(), roomID, start, func(frame []byte) error {
+			rp.apply(frame)
+			return nil
+		})
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to load room history")
+			return
+		}
+	}
+
+	if format == "sse" {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": roomID + "-playback.ndjson",
+		}))
+	}
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	send := func(e PlaybackEvent) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if format == "ndjson" {
+			_, err = fmt.Fprintf(w, "%s\n", data)
+			return err
+		}
+		if e.ID != 0 {
+			fmt.Fprintf(w, "id: %d\n", e.ID)
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	startAt := start
+	if startAt.IsZero() {
+		startAt = room.CreatedAt
+	}
+	if send(PlaybackEvent{Type: "start", At: startAt.UTC(), Content: rp.replica.String()}) != nil {
+		return
+	}
+
+	end := PlaybackEvent{Type: "end", At: to.UTC()}
+	var sendErr error
+	err = a.database.ForEachUpdateBetween(r.Context(), roomID, start, to, func(update db.StoredUpdate) error {
+		if end.Count == maxPlaybackUpdates {
+			end.Truncated = true
+			return errPlaybackFull
+		}
+		rp.apply(update.Data)
+		end.Count++
+		payload, _ := protocol.UpdatePayload(update.Data)
+		sendErr = send(PlaybackEvent{
+			Type:    "update",
+			ID:      update.ID,
+			At:      update.CreatedAt.UTC(),
+			Update:  payload,
+			Content: rp.replica.String(),
+			Author:  update.Author,
+		})
+		return sendErr
+	})
+	if sendErr != nil {
+		return // The client went away
+	}
+	if err != nil && !errors.Is(err, errPlaybackFull) {
+		// Headers are out, so the stream just ends without its end event
+		log.Printf("Failed to stream playback for room %s: %v", roomID, err)
+		return
+	}
+	rp.logSkipped(roomID)
+
+	end.Content = rp.replica.String()
+	send(end)
+}
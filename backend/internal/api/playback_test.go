@@ -0,0 +1,102 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+func TestPlaybackHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := api.database.CreateRoom(ctx, "session", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	hello := protocol.EncodeTextInsert(1013, 0, "hello")
+	deleteH := []byte{0x00, 0x01, 0xf5, 0x07, 0x01, 0x00, 0x01} // Deletes 1013:0
+	api.database.SaveUpdates(ctx, "session", [][]byte{protocol.EncodeUpdate(hello), protocol.EncodeUpdate(deleteH)})
+
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/rooms/session/playback?format=ndjson", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename=session-playback.ndjson` {
+		t.Errorf("Expected a download, got Content-Disposition %q", got)
+	}
+
+	var playback []PlaybackEvent
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var e PlaybackEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Failed to decode %q: %v", scanner.Text(), err)
+		}
+		playback = append(playback, e)
+	}
+	if len(playback) != 4 {
+		t.Fatalf("Expected start, two updates and end, got %+v", playback)
+	}
+	for i, want := range []struct{ typ, content string }{
+		{"start", ""}, {"update", "hello"}, {"update", "ello"}, {"end", "ello"},
+	} {
+		if playback[i].Type != want.typ || playback[i].Content != want.content {
+			t.Errorf("Event %d: expected %s %q, got %s %q", i, want.typ, want.content, playback[i].Type, playback[i].Content)
+		}
+	}
+	if string(playback[1].Update) != string(hello) || playback[1].ID == 0 || playback[1].At.IsZero() {
+		t.Errorf("Expected the raw update with its ID and time, got %+v", playback[1])
+	}
+	if playback[3].Count != 2 || playback[3].Truncated {
+		t.Errorf("Expected an end event counting 2 updates, got %+v", playback[3])
+	}
+
+	// SSE names each event and carries update IDs
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/rooms/session/playback", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %q", ct)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"event: start\n", "id: ", "event: update\n", "event: end\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in the stream:\n%s", want, body)
+		}
+	}
+
+	// A window after both updates starts from the finished text
+	from := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	to := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/rooms/session/playback?format=ndjson&from="+from+"&to="+to, nil))
+	if first, _, _ := strings.Cut(w.Body.String(), "\n"); !strings.Contains(first, `"content":"ello"`) {
+		t.Errorf("Expected the start event to hold the text at from, got %s", first)
+	}
+
+	frame := protocol.EncodeUpdate(hello)
+	snapshot := binary.BigEndian.AppendUint32(nil, uint32(len(frame)))
+	api.database.SaveSnapshot(ctx, "session", append(snapshot, frame...), 1)
+	for path, status := range map[string]int{
+		"/api/rooms/session/playback?from=2000-01-01T00:00:00Z":                         http.StatusGone,
+		"/api/rooms/session/playback?format=csv":                                        http.StatusBadRequest,
+		"/api/rooms/session/playback?from=soon":                                         http.StatusBadRequest,
+		"/api/rooms/session/playback?from=2024-05-02T00:00:00Z&to=2024-05-01T00:00:00Z": http.StatusBadRequest,
+		"/api/rooms/missing/playback":                                                   http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s: expected %d, got %d", path, status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+	"time"
+)
+
+// AutoSavePolicy is how often clients should auto-save a room and how many
+// auto-saves the server keeps. Clients read it from /api/rooms/{id}/policy
+// so they all save on the same cadence.
+type AutoSavePolicy struct {
+	Interval   time.Duration // Between a client's auto-saves
+	MinChanges int           // Character changes worth an auto-save before the interval is up
+	Keep       int           // Newest unpinned auto-saves kept per room
+}
+
+func DefaultAutoSavePolicy() AutoSavePolicy {
+	return AutoSavePolicy{
+		Interval:   time.Minute,
+		MinChanges: 50,
+		Keep:       20,
+	}
+}
+
+// SetAutoSavePolicy changes the auto-save policy. Call it before Routes.
+func (a *API) SetAutoSavePolicy(p AutoSavePolicy) {
+	a.autoSave = p
+}
+
+// How a repeated auto-save is answered: with the existing version and a 200
+const autoSaveDedupContent = "content"
+
+// RoomPolicyResponse tells clients how to save versions of a room
+type RoomPolicyResponse struct {
+	RoomID          string               `json:"room_id"`
+	AutoSave        AutoSavePolicyDetail `json:"autosave"`
+	MaxVersionBytes int                  `json:"max_version_bytes,omitempty"` // Zero when unlimited
+}
+
+type AutoSavePolicyDetail struct {
+	IntervalMs int64 `json:"interval_ms"`
+	MinChanges int   `json:"min_changes"`
+	// "content": an auto-save matching the room's latest version or one of
+	// its auto-saves returns that version instead of creating another
+	Dedup string `json:"dedup"`
+	Keep  int    `json:"keep"` // Older auto-saves are pruned unless pinned
+}
+
+// RoomPolicyHandler returns the auto-save policy for a room
+func (a *API) RoomPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+	if !a.requireRoom(r.Context(), w, roomID) {
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, RoomPolicyResponse{
+		RoomID: roomID,
+		AutoSave: AutoSavePolicyDetail{
+			IntervalMs: a.autoSave.Interval.Milliseconds(),
+			MinChanges: a.autoSave.MinChanges,
+			Dedup:      autoSaveDedupContent,
+			Keep:       a.autoSave.Keep,
+		},
+		MaxVersionBytes: a.maxVersionBytes,
+	})
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomPolicyHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	api.SetAutoSavePolicy(AutoSavePolicy{Interval: 30 * time.Second, MinChanges: 10, Keep: 2})
+	if err := api.database.CreateRoom(context.Background(), "policy-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	routes := api.Routes()
+
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", "/api/rooms/policy-room/policy", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var policy RoomPolicyResponse
+	if err := json.NewDecoder(w.Body).Decode(&policy); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	want := AutoSavePolicyDetail{IntervalMs: 30000, MinChanges: 10, Dedup: autoSaveDedupContent, Keep: 2}
+	if policy.AutoSave != want || policy.MaxVersionBytes != DefaultMaxVersionBytes {
+		t.Errorf("Expected policy %+v, got %+v", want, policy)
+	}
+
+	// Auto-saves beyond the policy's count are pruned
+	for i := 0; i < 4; i++ {
+		body := fmt.Sprintf(`{"content": "draft %d", "is_auto": true}`, i)
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, httptest.NewRequest("POST", "/api/rooms/policy-room/versions", strings.NewReader(body)))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if count, _ := api.database.GetVersionCount(context.Background(), "policy-room"); count != 2 {
+		t.Errorf("Expected 2 auto-saves kept, got %d", count)
+	}
+
+	w = httptest.NewRecorder()
+	routes.ServeHTTP(w, httptest.NewRequest("GET", "/api/rooms/ghost/policy", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing room, got %d", w.Code)
+	}
+}
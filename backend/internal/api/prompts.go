@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+// AI system prompts a deployment may replace
+const (
+	promptComplete = "complete"
+	promptExplain  = "explain"
+	promptRefactor = "refactor"
+	promptTests    = "tests"
+	promptFix      = "fix"
+)
+
+var promptNames = []string{promptComplete, promptExplain, promptRefactor, promptTests, promptFix}
+
+// Built-in system prompts, used until an administrator stores a template
+var defaultPrompts = map[string]string{
+	promptComplete: `You are a code completion assistant. Complete the code at the cursor position.
+Rules:
+- Only output the completion, no explanations
+- Match the existing code style
+- Be concise - complete the current statement or block
+- Language: {{language}}
+- If there's code after cursor, make sure completion flows naturally into it`,
+
+	promptExplain: `You are a code explanation assistant. Explain the given code clearly and concisely.
+Include:
+- What the code does
+- Key concepts used
+- Any potential issues or improvements`,
+
+	promptRefactor: `You are a code refactoring assistant. Refactor the given code according to the instruction.
+Rules:
+- Only output the refactored code
+- Preserve functionality unless asked to change it
+- Follow best practices for the language`,
+
+	promptTests: `You are a test writing assistant. Write unit tests for the given code.
+Rules:
+- Only output the test code, no explanations
+- Use {{framework}} and the conventions of {{language}} projects
+- Cover normal behavior, edge cases and error handling
+- Test the code as given; do not rewrite it`,
+
+	promptFix: `You are a code fixing assistant. Fix the reported error with the smallest possible change.
+Rules:
+- Reply with only a unified diff against the given code, no explanations or markdown
+- Start each hunk with an @@ -start,count +start,count @@ header
+- Include up to 3 unchanged lines around each change, copied exactly
+- Do not change anything unrelated to the error
+- Reply with nothing if the code has no such error`,
+}
+
+// Variables a template may use. instruction is the completion hint or the
+// refactoring instruction, and framework the test framework; each is empty
+// for the other prompts.
+var promptVariables = []string{"language", "instruction", "framework"}
+
+var promptVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+
+// Replaces {{name}} with vars[name] in one pass, so values that contain
+// braces are never expanded themselves
+func renderPrompt(template string, vars map[string]string) string {
+	return promptVariablePattern.ReplaceAllStringFunc(template, func(match string) string {
+		name := promptVariablePattern.FindStringSubmatch(match)[1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+// Returns the system prompt called name with vars filled in. A stored
+// template replaces the built-in one; if it can't be read the built-in
+// prompt is used rather than failing the request.
+func (a *API) systemPrompt(ctx context.Context, name string, vars map[string]string) string {
+	template := defaultPrompts[name]
+	stored, err := a.database.GetPromptTemplate(ctx, name)
+	if err != nil {
+		log.Printf("Failed to load the %s prompt, using the built-in one: %v", name, err)
+	} else if stored != nil {
+		template = stored.Template
+	}
+	return renderPrompt(template, vars)
+}
+
+type SetPromptRequest struct {
+	Template string `json:"template"`
+}
+
+// PromptResponse describes a system prompt and whether it has been replaced
+type PromptResponse struct {
+	Name      string     `json:"name"`
+	Template  string     `json:"template"`
+	Default   string     `json:"default"`
+	Custom    bool       `json:"custom"` // Template is a stored replacement
+	Variables []string   `json:"variables"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+func newPromptResponse(name, template string, updatedAt *time.Time) PromptResponse {
+	p := PromptResponse{
+		Name:      name,
+		Template:  defaultPrompts[name],
+		Default:   defaultPrompts[name],
+		Variables: promptVariables,
+	}
+	if updatedAt != nil {
+		p.Template = template
+		p.Custom = true
+		p.UpdatedAt = updatedAt
+	}
+	return p
+}
+
+type listPromptsResponse struct {
+	Prompts []PromptResponse `json:"prompts"`
+}
+
+// ListPromptsHandler returns every AI system prompt in use
+func (a *API) ListPromptsHandler(w http.ResponseWriter, r *http.Request) {
+	stored, err := a.database.ListPromptTemplates(r.Context())
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list prompts")
+		return
+	}
+
+	prompts := make([]PromptResponse, 0, len(promptNames))
+	for _, name := range promptNames {
+		p := newPromptResponse(name, "", nil)
+		for _, s := range stored {
+			if s.Name == name {
+				p = newPromptResponse(name, s.Template, &s.UpdatedAt)
+			}
+		}
+		prompts = append(prompts, p)
+	}
+	jsonResponse(w, http.StatusOK, listPromptsResponse{Prompts: prompts})
+}
+
+// SetPromptHandler replaces an AI system prompt. The new template applies
+// to the next request.
+func (a *API) SetPromptHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !slices.Contains(promptNames, name) {
+		errorResponse(w, http.StatusNotFound, apierror.PromptNotFound,
+			"Unknown prompt; use one of: "+strings.Join(promptNames, ", "))
+		return
+	}
+
+	var req SetPromptRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	stored, err := a.database.SetPromptTemplate(r.Context(), name, req.Template)
+	if err != nil {
+		databaseError(w, err, "Failed to save prompt")
+		return
+	}
+	log.Printf("AI prompt %s updated", name)
+	jsonResponse(w, http.StatusOK, newPromptResponse(name, stored.Template, &stored.UpdatedAt))
+}
+
+// ResetPromptHandler drops a stored template, restoring the built-in prompt
+func (a *API) ResetPromptHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !slices.Contains(promptNames, name) {
+		errorResponse(w, http.StatusNotFound, apierror.PromptNotFound,
+			"Unknown prompt; use one of: "+strings.Join(promptNames, ", "))
+		return
+	}
+
+	if _, err := a.database.DeletePromptTemplate(r.Context(), name); err != nil {
+		databaseError(w, err, "Failed to reset prompt")
+		return
+	}
+	jsonResponse(w, http.StatusOK, newPromptResponse(name, "", nil))
+}
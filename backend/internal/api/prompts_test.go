@@ -0,0 +1,84 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRenderPrompt(t *testing.T) {
+	got := renderPrompt("Write {{ language }} for {{instruction}}; keep {{other}}", map[string]string{
+		"language":    "go",
+		"instruction": "{{language}}",
+	})
+	if want := "Write go for {{language}}; keep {{other}}"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestPromptTemplates(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	routes := api.Routes()
+
+	var systemPrompt string
+	api.ai = func(ctx context.Context, provider, system, user string, maxTokens int) (string, error) {
+		systemPrompt = system
+		return "done", nil
+	}
+	refactor := func() {
+		req := httptest.NewRequest("POST", "/api/ai/refactor", bytes.NewBufferString(`{"code": "x", "language": "go", "instruction": "Inline it"}`))
+		routes.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+		return w
+	}
+
+	refactor()
+	if systemPrompt != defaultPrompts[promptRefactor] {
+		t.Errorf("Expected the built-in prompt, got %q", systemPrompt)
+	}
+
+	w := send("PUT", "/api/admin/ai/prompts/refactor", `{"template": "Refactor {{language}}: {{instruction}}"}`)
+	var updated PromptResponse
+	json.NewDecoder(w.Body).Decode(&updated)
+	if w.Code != http.StatusOK || !updated.Custom || updated.UpdatedAt == nil {
+		t.Fatalf("Expected the stored template, got %d %+v", w.Code, updated)
+	}
+	refactor()
+	if systemPrompt != "Refactor go: Inline it" {
+		t.Errorf("Expected the stored template to be used, got %q", systemPrompt)
+	}
+
+	var list listPromptsResponse
+	json.NewDecoder(send("GET", "/api/admin/ai/prompts", "").Body).Decode(&list)
+	if len(list.Prompts) != len(promptNames) {
+		t.Fatalf("Expected %d prompts, got %+v", len(promptNames), list)
+	}
+	for _, p := range list.Prompts {
+		if p.Custom != (p.Name == promptRefactor) {
+			t.Errorf("Expected only refactor to be custom, got %+v", p)
+		}
+	}
+
+	if w := send("PUT", "/api/admin/ai/prompts/refactor", `{"template": "Use {{code}}"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an unknown variable, got %d", w.Code)
+	}
+	if w := send("PUT", "/api/admin/ai/prompts/summarize", `{"template": "x"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown prompt, got %d", w.Code)
+	}
+
+	if w := send("DELETE", "/api/admin/ai/prompts/refactor", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 resetting the prompt, got %d", w.Code)
+	}
+	refactor()
+	if systemPrompt != defaultPrompts[promptRefactor] {
+		t.Errorf("Expected the built-in prompt after a reset, got %q", systemPrompt)
+	}
+}
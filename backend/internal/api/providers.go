@@ -0,0 +1,327 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AIProviderConfig controls how AI requests move between providers. A
+// request that names a provider only tries that one; otherwise each
+// provider in Order is tried until one answers. A provider that keeps
+// failing is skipped for a while (its circuit is open), then trusted again
+// after one successful request.
+type AIProviderConfig struct {
+	// Providers to try, in order. Empty means openai and anthropic when
+	// their API keys are set, then ollama when OLLAMA_URL is set or no key
+	// is.
+	Order []string
+
+	AttemptTimeout   time.Duration // Per provider, so a hung one leaves time for the next; zero disables
+	FailureThreshold int           // Consecutive failures that open a circuit
+	Cooldown         time.Duration // How long an open circuit skips its provider
+}
+
+func DefaultAIProviderConfig() AIProviderConfig {
+	return AIProviderConfig{
+		AttemptTimeout:   30 * time.Second,
+		FailureThreshold: 3,
+		Cooldown:         30 * time.Second,
+	}
+}
+
+// Validate rejects configurations the router can't run with
+func (c AIProviderConfig) Validate() error {
+	for _, name := range c.Order {
+		if !slices.Contains(aiProviders, name) {
+			return fmt.Errorf("unknown AI provider %q", name)
+		}
+	}
+	if c.AttemptTimeout < 0 {
+		return fmt.Errorf("attempt timeout must not be negative, got %v", c.AttemptTimeout)
+	}
+	if c.FailureThreshold < 1 {
+		return fmt.Errorf("failure threshold must be at least 1, got %d", c.FailureThreshold)
+	}
+	if c.Cooldown <= 0 {
+		return fmt.Errorf("cooldown must be positive, got %v", c.Cooldown)
+	}
+	return nil
+}
+
+// SetAIProviderConfig changes provider failover. Call it before serving
+// requests.
+func (a *API) SetAIProviderConfig(c AIProviderConfig) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	a.providers.config = c
+	return nil
+}
+
+// Successful calls whose latency is averaged
+const providerLatencySamples = 20
+
+// Circuit states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open" // One trial request decides
+)
+
+type providerHealth struct {
+	failures  int // Consecutive
+	openUntil time.Time
+	probing   bool // A half-open trial is in flight
+
+	requests, errors int64
+	latencies        []time.Duration // Recent successes, oldest overwritten
+	nextLatency      int
+
+	lastSuccess, lastFailure time.Time
+}
+
+func (h *providerHealth) state(now time.Time, threshold int) string {
+	if h.failures < threshold {
+		return circuitClosed
+	}
+	if now.Before(h.openUntil) {
+		return circuitOpen
+	}
+	return circuitHalfOpen
+}
+
+var errNoProviders = errors.New("no AI provider configured")
+
+// Sends prompts to AI providers with failover and per-provider circuit
+// breakers
+type aiRouter struct {
+	config     AIProviderConfig
+	call       func(ctx context.Context, provider, systemPrompt, userPrompt string, maxTokens int) (string, error)
+	configured func(provider string) bool
+	now        func() time.Time
+
+	mu     sync.Mutex
+	health map[string]*providerHealth
+}
+
+func newAIRouter() *aiRouter {
+	return &aiRouter{
+		config:     DefaultAIProviderConfig(),
+		call:       callProvider,
+		configured: providerConfigured,
+		now:        time.Now,
+		health:     make(map[string]*providerHealth),
+	}
+}
+
+// Providers tried for a request that names none
+func (r *aiRouter) order() []string {
+	if len(r.config.Order) > 0 {
+		var order []string
+		for _, name := range r.config.Order {
+			if r.configured(name) {
+				order = append(order, name)
+			}
+		}
+		return order
+	}
+
+	var order []string
+	for _, name := range []string{"openai", "anthropic"} {
+		if r.configured(name) {
+			order = append(order, name)
+		}
+	}
+	if os.Getenv("OLLAMA_URL") != "" || len(order) == 0 {
+		order = append(order, "ollama")
+	}
+	return order
+}
+
+// complete sends a prompt to provider, or down the fallback order when
+// provider is empty, and returns the first reply
+func (r *aiRouter) complete(ctx context.Context, provider, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+	candidates := r.order()
+	if provider != "" {
+		if !r.configured(provider) {
+			return "", fmt.Errorf("%s is not configured", provider)
+		}
+		candidates = []string{provider}
+	}
+	if len(candidates) == 0 {
+		return "", errNoProviders
+	}
+
+	var errs []error
+	for _, name := range candidates {
+		if !r.acquire(name) {
+			errs = append(errs, fmt.Errorf("%s: skipped while failing", name))
+			continue
+		}
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if r.config.AttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, r.config.AttemptTimeout)
+		}
+		start := r.now()
+		reply, err := r.call(attemptCtx, name, systemPrompt, userPrompt, maxTokens)
+		cancel()
+
+		if err != nil && ctx.Err() != nil {
+			// The request ended, which says nothing about the provider
+			r.release(name)
+			return "", err
+		}
+		r.record(name, r.now().Sub(start), err)
+		if err == nil {
+			return reply, nil
+		}
+		log.Printf("AI provider %s failed: %v", name, err)
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	return "", errors.Join(errs...)
+}
+
+func (r *aiRouter) healthOf(name string) *providerHealth {
+	h, ok := r.health[name]
+	if !ok {
+		h = &providerHealth{}
+		r.health[name] = h
+	}
+	return h
+}
+
+// Reports whether a request may go to name, claiming the trial request if
+// its circuit is half open
+func (r *aiRouter) acquire(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h := r.healthOf(name)
+	switch h.state(r.now(), r.config.FailureThreshold) {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		if h.probing {
+			return false
+		}
+		h.probing = true
+	}
+	return true
+}
+
+// Gives up a claimed trial without a verdict
+func (r *aiRouter) release(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.healthOf(name).probing = false
+}
+
+func (r *aiRouter) record(name string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h := r.healthOf(name)
+	now := r.now()
+	h.requests++
+	h.probing = false
+	if err == nil {
+		h.failures = 0
+		h.lastSuccess = now
+		if len(h.latencies) < providerLatencySamples {
+			h.latencies = append(h.latencies, latency)
+		} else {
+			h.latencies[h.nextLatency] = latency
+			h.nextLatency = (h.nextLatency + 1) % providerLatencySamples
+		}
+		return
+	}
+
+	h.errors++
+	h.failures++
+	h.lastFailure = now
+	if h.failures >= r.config.FailureThreshold {
+		if h.failures == r.config.FailureThreshold {
+			log.Printf("AI provider %s failed %d times in a row; skipping it for %v", name, h.failures, r.config.Cooldown)
+		}
+		h.openUntil = now.Add(r.config.Cooldown)
+	}
+}
+
+// AIProviderStatus is one provider's health as seen by this server
+type AIProviderStatus struct {
+	Name                string     `json:"name"`
+	Configured          bool       `json:"configured"`
+	Available           bool       `json:"available"` // Configured and its circuit is not open
+	State               string     `json:"state"`     // "closed", "open" or "half_open"
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Requests            int64      `json:"requests"`
+	Failures            int64      `json:"failures"`
+	AvgLatencyMS        *int64     `json:"avg_latency_ms,omitempty"` // Over recent successful requests
+	LastSuccessAt       *time.Time `json:"last_success_at,omitempty"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"` // When an open circuit admits a trial request
+}
+
+type AIProvidersResponse struct {
+	Order     []string           `json:"order"` // Tried in turn for requests that name no provider
+	Providers []AIProviderStatus `json:"providers"`
+}
+
+func (r *aiRouter) status() AIProvidersResponse {
+	response := AIProvidersResponse{Order: r.order(), Providers: []AIProviderStatus{}}
+	if response.Order == nil {
+		response.Order = []string{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for _, name := range aiProviders {
+		h := r.healthOf(name)
+		s := AIProviderStatus{
+			Name:                name,
+			Configured:          r.configured(name),
+			State:               h.state(now, r.config.FailureThreshold),
+			ConsecutiveFailures: h.failures,
+			Requests:            h.requests,
+			Failures:            h.errors,
+		}
+		s.Available = s.Configured && s.State != circuitOpen
+		if len(h.latencies) > 0 {
+			var total time.Duration
+			for _, l := range h.latencies {
+				total += l
+			}
+			avg := (total / time.Duration(len(h.latencies))).Milliseconds()
+			s.AvgLatencyMS = &avg
+		}
+		if !h.lastSuccess.IsZero() {
+			t := h.lastSuccess
+			s.LastSuccessAt = &t
+		}
+		if !h.lastFailure.IsZero() {
+			t := h.lastFailure
+			s.LastFailureAt = &t
+		}
+		if s.State == circuitOpen {
+			t := h.openUntil
+			s.RetryAt = &t
+		}
+		response.Providers = append(response.Providers, s)
+	}
+	return response
+}
+
+// AIProvidersHandler reports each provider's availability and recent
+// latency
+func (a *API) AIProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, http.StatusOK, a.providers.status())
+}
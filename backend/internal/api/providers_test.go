@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A router over fake providers whose replies the test controls
+func testRouter(t *testing.T) (*aiRouter, map[string]error, *[]string, *time.Time) {
+	t.Helper()
+	failing := map[string]error{}
+	var calls []string
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	r := newAIRouter()
+	r.config.Order = []string{"anthropic", "openai", "ollama"}
+	r.config.FailureThreshold = 2
+	r.config.Cooldown = time.Minute
+	r.configured = func(name string) bool { return name != "ollama" }
+	r.now = func() time.Time { return now }
+	r.call = func(ctx context.Context, provider, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+		calls = append(calls, provider)
+		if err := failing[provider]; err != nil {
+			return "", err
+		}
+		return "reply from " + provider, nil
+	}
+	return r, failing, &calls, &now
+}
+
+func TestAIRouterFailover(t *testing.T) {
+	r, failing, calls, now := testRouter(t)
+	ctx := context.Background()
+	failing["anthropic"] = errors.New("overloaded")
+
+	for i := 0; i < 2; i++ {
+		reply, err := r.complete(ctx, "", "system", "user", 10)
+		if err != nil || reply != "reply from openai" {
+			t.Fatalf("Expected openai to answer after anthropic failed, got %q, %v", reply, err)
+		}
+	}
+
+	// Two failures open anthropic's circuit, so it is skipped
+	*calls = nil
+	r.complete(ctx, "", "system", "user", 10)
+	if len(*calls) != 1 || (*calls)[0] != "openai" {
+		t.Errorf("Expected only openai to be called while anthropic's circuit is open, got %v", *calls)
+	}
+	if _, err := r.complete(ctx, "anthropic", "system", "user", 10); err == nil {
+		t.Error("Expected a request naming anthropic to fail without falling back")
+	}
+
+	status := r.status()
+	if status.Providers[1].Name != "anthropic" || status.Providers[1].State != circuitOpen || status.Providers[1].Available {
+		t.Errorf("Expected anthropic to be reported open, got %+v", status.Providers[1])
+	}
+	if s := status.Providers[0]; s.Name != "openai" || !s.Available || s.AvgLatencyMS == nil || s.Requests != 3 {
+		t.Errorf("Expected openai to be available with latency, got %+v", s)
+	}
+	if s := status.Providers[2]; s.Configured || s.Available {
+		t.Errorf("Expected unconfigured ollama to be unavailable, got %+v", s)
+	}
+	if len(status.Order) != 2 {
+		t.Errorf("Expected unconfigured providers to be left out of the order, got %v", status.Order)
+	}
+
+	// After the cooldown one trial request decides
+	*now = now.Add(2 * time.Minute)
+	delete(failing, "anthropic")
+	*calls = nil
+	reply, _ := r.complete(ctx, "", "system", "user", 10)
+	if reply != "reply from anthropic" || r.status().Providers[1].State != circuitClosed {
+		t.Errorf("Expected a successful trial to close the circuit, got %q (%v)", reply, *calls)
+	}
+}
+
+func TestAIRouterAllFailing(t *testing.T) {
+	r, failing, _, _ := testRouter(t)
+	failing["anthropic"] = errors.New("overloaded")
+	failing["openai"] = errors.New("invalid key")
+
+	_, err := r.complete(context.Background(), "", "system", "user", 10)
+	if err == nil || !errors.Is(err, failing["openai"]) || !errors.Is(err, failing["anthropic"]) {
+		t.Errorf("Expected both providers' errors, got %v", err)
+	}
+
+	r.configured = func(string) bool { return false }
+	if _, err := r.complete(context.Background(), "", "system", "user", 10); err != errNoProviders {
+		t.Errorf("Expected errNoProviders, got %v", err)
+	}
+}
+
+func TestAIRouterCancelledRequest(t *testing.T) {
+	r, _, _, _ := testRouter(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	r.call = func(ctx context.Context, provider, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+		cancel()
+		return "", ctx.Err()
+	}
+
+	r.complete(ctx, "", "system", "user", 10)
+	if s := r.status().Providers[1]; s.Requests != 0 || s.ConsecutiveFailures != 0 {
+		t.Errorf("Expected a cancelled request not to count against the provider, got %+v", s)
+	}
+}
+
+func TestAIProvidersHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	api.AIProvidersHandler(w, httptest.NewRequest("GET", "/api/ai/providers", nil))
+	var response AIProvidersResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Providers) != len(aiProviders) || response.Order == nil {
+		t.Errorf("Expected every provider and an order, got %+v", response)
+	}
+}
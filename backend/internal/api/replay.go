@@ -0,0 +1,110 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// RoomAtResponse is a room's document as it read at a past time
+type RoomAtResponse struct {
+	RoomID         string    `json:"room_id"`
+	At             time.Time `json:"at"`
+	Content        string    `json:"content"`
+	UpdatesApplied int       `json:"updates_applied"`           // Stored updates replayed after the snapshot, if any
+	FromSnapshot   bool      `json:"from_snapshot"`             // Whether replay started from the compaction snapshot
+	SkippedUpdates int       `json:"skipped_updates,omitempty"` // Updates that failed to decode and were left out
+}
+
+// RoomAtHandler rebuilds a room's document from its stored updates as it
+// read at a point in time, whether or not a version was saved then:
+// GET /api/rooms/{id}/at?time=2024-05-01T12:00:00Z
+//
+// Replay starts from the compaction snapshot when there is one, since the
+// updates it merged are gone. Times before the snapshot can't be rebuilt
+// and get 410 HISTORY_COMPACTED with the snapshot's time.
+func (a *API) RoomAtHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("time"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "time must be an RFC3339 timestamp")
+		return
+	}
+
+	if !a.requireRoom(r.Context(), w, roomID) || !a.authorizeRoom(w, r, roomID) {
+		return
+	}
+
+	snapshot, ok := a.historySnapshot(w, r, roomID, at)
+	if !ok {
+		return
+	}
+
+	resp := RoomAtResponse{RoomID: roomID, At: at, FromSnapshot: snapshot != nil}
+	rp := newReplay(snapshot)
+	err = a.database.ForEachUpdateUntil(r.Context(), roomID, at, func(frame []byte) error {
+		resp.UpdatesApplied++
+		rp.apply(frame)
+		return nil
+	})
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to load room history")
+		return
+	}
+	rp.logSkipped(roomID)
+
+	resp.Content = rp.replica.String()
+	resp.SkippedUpdates = rp.skipped
+	jsonResponse(w, http.StatusOK, resp)
+}
+
+// Loads a room's compaction snapshot, if any, for replaying from a time.
+// Times before it answer 410 HISTORY_COMPACTED, since the updates it
+// merged are gone.
+func (a *API) historySnapshot(w http.ResponseWriter, r *http.Request, roomID string, from time.Time) ([]byte, bool) {
+	snapshot, snapshotAt, err := a.database.GetSnapshotAt(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to load room history")
+		return nil, false
+	}
+	// Stored times have whole seconds, so compare at that precision
+	if snapshotAt != nil && from.Truncate(time.Second).Before(*snapshotAt) {
+		apierror.Write(w, http.StatusGone, apierror.HistoryCompacted, "History before the room's last compaction is no longer stored",
+			map[string]interface{}{"snapshot_at": snapshotAt})
+		return nil, false
+	}
+	return snapshot, true
+}
+
+// Rebuilds a room's text from its snapshot and stored update frames.
+// Updates that fail to decode are counted and left out rather than losing
+// the whole document.
+type replay struct {
+	replica *protocol.TextReplica
+	skipped int
+}
+
+func newReplay(snapshot []byte) *replay {
+	rp := &replay{replica: protocol.NewTextReplica()}
+	for _, frame := range compaction.SplitMergedUpdates(snapshot) {
+		rp.apply(frame)
+	}
+	return rp
+}
+
+func (rp *replay) apply(frame []byte) {
+	if update, ok := protocol.UpdatePayload(frame); ok && rp.replica.Apply(update) != nil {
+		rp.skipped++
+	}
+}
+
+func (rp *replay) logSkipped(roomID string) {
+	if rp.skipped > 0 {
+		log.Printf("Replaying room %s skipped %d updates that failed to decode", roomID, rp.skipped)
+	}
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+func TestRoomAtHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := api.database.CreateRoom(ctx, "history", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	hello := protocol.EncodeUpdate(protocol.EncodeTextInsert(1013, 0, "hello"))
+	deleteH := protocol.EncodeUpdate([]byte{0x00, 0x01, 0xf5, 0x07, 0x01, 0x00, 0x01}) // Deletes 1013:0
+	api.database.SaveUpdates(ctx, "history", [][]byte{hello, deleteH})
+
+	get := func(at time.Time) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/rooms/history/at?time="+at.UTC().Format(time.RFC3339), nil))
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) RoomAtResponse {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var resp RoomAtResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return resp
+	}
+
+	later := time.Now().Add(time.Minute)
+	if resp := decode(get(later)); resp.Content != "ello" || resp.UpdatesApplied != 2 || resp.FromSnapshot {
+		t.Errorf("Expected both updates replayed, got %+v", resp)
+	}
+	if resp := decode(get(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))); resp.Content != "" || resp.UpdatesApplied != 0 {
+		t.Errorf("Expected an empty document before the first update, got %+v", resp)
+	}
+
+	// After compaction replay starts from the snapshot, which the kept
+	// updates overlap, and earlier times are gone
+	snapshot := binary.BigEndian.AppendUint32(nil, uint32(len(hello)))
+	api.database.SaveSnapshot(ctx, "history", append(snapshot, hello...), 1)
+	if resp := decode(get(later)); resp.Content != "ello" || !resp.FromSnapshot {
+		t.Errorf("Expected replay from the snapshot, got %+v", resp)
+	}
+
+	w := get(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	var body apierror.Error
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusGone || body.Code != apierror.HistoryCompacted {
+		t.Errorf("Expected 410 %s, got %d %s", apierror.HistoryCompacted, w.Code, body.Code)
+	}
+	if details, ok := body.Details.(map[string]interface{}); !ok || details["snapshot_at"] == nil {
+		t.Errorf("Expected the snapshot time in details, got %v", body.Details)
+	}
+
+	for path, status := range map[string]int{
+		"/api/rooms/history/at":                                  http.StatusBadRequest,
+		"/api/rooms/history/at?time=yesterday":                   http.StatusBadRequest,
+		"/api/rooms/missing/at?time=2024-05-01T12:00:00Z":        http.StatusNotFound,
+		"/api/rooms/history/at?time=2099-05-01T12:00:00%2B02:00": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s: expected %d, got %d", path, status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// AIReviewRequest names the change to review: two versions, or a room's
+// live document against its latest version. The server cannot read live
+// documents, so the editor sends the text it holds as content.
+type AIReviewRequest struct {
+	From     int    `json:"from,omitempty"`
+	To       int    `json:"to,omitempty"`
+	RoomID   string `json:"room_id,omitempty"`
+	Content  string `json:"content,omitempty"` // Live document of room_id
+	Language string `json:"language,omitempty"`
+	Provider string `json:"provider,omitempty"`
+}
+
+// Review finding severities, most serious first
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+var reviewSeverities = []string{SeverityError, SeverityWarning, SeverityInfo}
+
+// ReviewFinding is one comment on the reviewed text. Lines are 1-based and
+// refer to the new side of the diff.
+type ReviewFinding struct {
+	Severity  string `json:"severity"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Message   string `json:"message"`
+}
+
+type AIReviewResponse struct {
+	From     VersionResponse  `json:"from"`
+	To       *VersionResponse `json:"to,omitempty"` // Absent when reviewing live content
+	Findings []ReviewFinding  `json:"findings"`
+}
+
+// Unchanged lines shown around each change in the prompt
+const reviewContextLines = 3
+
+// Tokens allowed for the provider's reply
+const reviewMaxTokens = 1500
+
+const reviewSystemPrompt = `You are a code reviewer. Review the change shown as a diff.
+Each line is "+" (added), "-" (removed) or " " (unchanged), then the line number in the new text (blank for removed lines), then "|" and the line.
+Rules:
+- Comment only on the added lines and how they fit the unchanged ones
+- Report bugs, security problems, and clear readability or style issues; skip praise
+- Reply with only a JSON array, no prose or markdown, where each item is
+  {"severity": "error"|"warning"|"info", "start_line": N, "end_line": N, "message": "..."}
+- Line numbers refer to the new text
+- Reply [] if there is nothing to report`
+
+// AIReviewHandler asks the AI provider to review the diff between two
+// versions, or between a room's latest version and its live content, and
+// returns the findings it reports.
+func (a *API) AIReviewHandler(w http.ResponseWriter, r *http.Request) {
+	var req AIReviewRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	var from, to *db.Version
+	var newContent string
+	var err error
+	if req.RoomID != "" {
+		if !a.authorizeRoom(w, r, req.RoomID) {
+			return
+		}
+		from, err = a.database.GetLatestVersion(r.Context(), req.RoomID)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
+			return
+		}
+		if from == nil {
+			errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Room has no saved versions")
+			return
+		}
+		newContent = req.Content
+	} else {
+		if from, err = a.database.GetVersion(r.Context(), req.From); err != nil || from == nil {
+			errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "From version not found")
+			return
+		}
+		if to, err = a.database.GetVersion(r.Context(), req.To); err != nil || to == nil {
+			errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "To version not found")
+			return
+		}
+		if !a.authorizeVersion(w, r, from) || !a.authorizeVersion(w, r, to) {
+			return
+		}
+		newContent = to.Content
+	}
+
+	response := AIReviewResponse{From: newVersionResponse(from), Findings: []ReviewFinding{}}
+	if to != nil {
+		toResponse := newVersionResponse(to)
+		response.To = &toResponse
+	}
+
+	diff := computeDiff(from.Content, newContent)
+	prompt, changed := renderReviewDiff(diff)
+	if !changed {
+		jsonResponse(w, http.StatusOK, response)
+		return
+	}
+	if len(prompt) > maxAICodeBytes {
+		errorResponse(w, http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge,
+			fmt.Sprintf("Diff exceeds %d bytes; review a smaller change", maxAICodeBytes))
+		return
+	}
+
+	language := req.Language
+	if language == "" {
+		language = "plaintext"
+	}
+	userPrompt := fmt.Sprintf("Review this change to a %s file:\n\n%s", language, prompt)
+
+	reply, err := a.ai(r.Context(), req.Provider, reviewSystemPrompt, userPrompt, reviewMaxTokens)
+	if err != nil {
+		log.Printf("AI review error: %v", err)
+		errorResponse(w, http.StatusServiceUnavailable, apierror.AIUnavailable, "AI service unavailable")
+		return
+	}
+
+	findings, err := parseReviewFindings(reply, len(strings.Split(newContent, "\n")))
+	if err != nil {
+		log.Printf("AI review returned an unreadable reply: %v", err)
+		errorResponse(w, http.StatusServiceUnavailable, apierror.AIUnavailable, "AI service returned an unreadable review")
+		return
+	}
+	response.Findings = findings
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// Renders the changed parts of a diff with a few lines of context around
+// each, in the format reviewSystemPrompt describes. Reports false if
+// nothing changed.
+func renderReviewDiff(diff []DiffLine) (string, bool) {
+	// Lines within reviewContextLines of a change
+	show := make([]bool, len(diff))
+	changed := false
+	for i, line := range diff {
+		if line.Type == "unchanged" {
+			continue
+		}
+		changed = true
+		for j := max(0, i-reviewContextLines); j <= min(len(diff)-1, i+reviewContextLines); j++ {
+			show[j] = true
+		}
+	}
+	if !changed {
+		return "", false
+	}
+
+	var b strings.Builder
+	for i, line := range diff {
+		if !show[i] {
+			if i > 0 && show[i-1] {
+				b.WriteString("...\n")
+			}
+			continue
+		}
+		marker, number := " ", ""
+		switch line.Type {
+		case "added":
+			marker = "+"
+		case "removed":
+			marker = "-"
+		}
+		if line.Type != "removed" {
+			number = fmt.Sprint(line.NewLine)
+		}
+		fmt.Fprintf(&b, "%s %5s | %s\n", marker, number, line.Content)
+	}
+	return b.String(), true
+}
+
+// Reads the JSON array of findings from a provider reply, tolerating a
+// markdown fence or prose around it. Findings are checked and clamped to
+// the new text's lines; ones without a message are dropped.
+func parseReviewFindings(reply string, lineCount int) ([]ReviewFinding, error) {
+	start, end := strings.Index(reply, "["), strings.LastIndex(reply, "]")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no JSON array in %q", truncateForLog(reply))
+	}
+
+	var raw []ReviewFinding
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &raw); err != nil {
+		return nil, fmt.Errorf("%v in %q", err, truncateForLog(reply))
+	}
+
+	findings := make([]ReviewFinding, 0, len(raw))
+	for _, f := range raw {
+		f.Message = strings.TrimSpace(f.Message)
+		if f.Message == "" {
+			continue
+		}
+		f.Severity = strings.ToLower(strings.TrimSpace(f.Severity))
+		if !slices.Contains(reviewSeverities, f.Severity) {
+			f.Severity = SeverityInfo
+		}
+		f.StartLine = min(max(f.StartLine, 1), lineCount)
+		if f.EndLine < f.StartLine {
+			f.EndLine = f.StartLine
+		}
+		f.EndLine = min(f.EndLine, lineCount)
+		findings = append(findings, f)
+	}
+	return findings, nil
+}
+
+// Shortens provider output quoted in logs
+func truncateForLog(s string) string {
+	const limit = 200
+	if len(s) <= limit {
+		return s
+	}
+	return s[:limit] + "..."
+}
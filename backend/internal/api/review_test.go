@@ -0,0 +1,80 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAIReview(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	api.database.CreateRoom(ctx, "notes", "")
+	from, _ := api.database.CreateVersion(ctx, "notes", "v1", "", "a\nb\nc", hashContent("a\nb\nc"), "", false)
+	to, _ := api.database.CreateVersion(ctx, "notes", "v2", "", "a\nB\nc\nd", hashContent("a\nB\nc\nd"), "", false)
+
+	var prompt string
+	api.ai = func(ctx context.Context, provider, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+		prompt = userPrompt
+		return "Here you go:\n```json\n" + `[
+			{"severity": "ERROR", "start_line": 2, "end_line": 2, "message": "Capital B"},
+			{"severity": "nit", "start_line": 9, "end_line": 1, "message": "Past the end"},
+			{"severity": "info", "start_line": 1, "end_line": 1, "message": " "}
+		]` + "\n```", nil
+	}
+
+	review := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/ai/review", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		api.AIReviewHandler(w, req)
+		return w
+	}
+
+	w := review(fmt.Sprintf(`{"from": %d, "to": %d, "language": "go"}`, from.ID, to.ID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(prompt, "a go file") || !strings.Contains(prompt, "+     2 | B") || !strings.Contains(prompt, "-       | b") {
+		t.Errorf("Expected a numbered diff in the prompt, got:\n%s", prompt)
+	}
+
+	var response AIReviewResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	want := []ReviewFinding{
+		{Severity: SeverityError, StartLine: 2, EndLine: 2, Message: "Capital B"},
+		{Severity: SeverityInfo, StartLine: 4, EndLine: 4, Message: "Past the end"},
+	}
+	if fmt.Sprint(response.Findings) != fmt.Sprint(want) || response.To == nil || response.To.ID != to.ID {
+		t.Errorf("Expected findings %v for version %d, got %+v", want, to.ID, response)
+	}
+
+	// Live content is reviewed against the room's latest version, and an
+	// unchanged document needs no provider call
+	prompt = ""
+	w = review(`{"room_id": "notes", "content": "a\nB\nc\nd"}`)
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || prompt != "" || len(response.Findings) != 0 || response.From.ID != to.ID {
+		t.Errorf("Expected no findings without calling the provider, got %d %s", w.Code, w.Body)
+	}
+
+	if w := review(`{"room_id": "notes", "from": 1}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for room_id with from, got %d", w.Code)
+	}
+	if w := review(`{"room_id": "empty", "content": "x"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a room without versions, got %d", w.Code)
+	}
+
+	api.ai = func(context.Context, string, string, string, int) (string, error) {
+		return "Looks good to me!", nil
+	}
+	if w := review(fmt.Sprintf(`{"from": %d, "to": %d}`, from.ID, to.ID)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for an unreadable reply, got %d", w.Code)
+	}
+}
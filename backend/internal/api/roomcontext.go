@@ -0,0 +1,54 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/embeddings"
+)
+
+// SetEmbeddingIndex lets completions that name a room_id draw related code
+// from the room's saved document. Register the index with
+// AddVersionNotifier too so it follows new versions.
+func (a *API) SetEmbeddingIndex(index *embeddings.Index) {
+	a.embeddings = index
+}
+
+// Bounds on the context added to a completion prompt
+const (
+	contextQueryBefore = 2000 // Bytes before the cursor the search uses
+	contextQueryAfter  = 500
+	contextMaxChunks   = 3
+	contextMaxBytes    = 6000
+)
+
+// Returns related chunks of the room's saved document as a prompt preamble,
+// leaving out any already in code. Context is optional, so failures are
+// logged and give an empty preamble.
+func (a *API) roomContext(ctx context.Context, roomID, language, code string, cursor int) string {
+	query := code[max(0, cursor-contextQueryBefore):min(len(code), cursor+contextQueryAfter)]
+	matches, err := a.embeddings.Search(ctx, roomID, query, contextMaxChunks*2)
+	if err != nil {
+		log.Printf("Failed to search room %s for completion context: %v", roomID, err)
+		return ""
+	}
+
+	var b strings.Builder
+	used := 0
+	for _, m := range matches {
+		if used == contextMaxChunks || b.Len()+len(m.Content) > contextMaxBytes {
+			break
+		}
+		if strings.Contains(code, strings.TrimSpace(m.Content)) {
+			continue
+		}
+		fmt.Fprintf(&b, "Lines %d-%d:\n```%s\n%s\n```\n\n", m.StartLine, m.EndLine, language, m.Content)
+		used++
+	}
+	if used == 0 {
+		return ""
+	}
+	return "Related code from the saved version of this document, for reference:\n\n" + b.String()
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/embeddings"
+)
+
+// Embeds a text as counts of a few keywords
+type keywordEmbedder struct{}
+
+func (keywordEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		for _, word := range []string{"config", "server", "user"} {
+			vectors[i] = append(vectors[i], float32(strings.Count(text, word)))
+		}
+	}
+	return vectors, nil
+}
+
+func TestCompletionRoomContext(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	config := embeddings.DefaultConfig()
+	config.Provider, config.Model = "test", "keywords"
+	config.ChunkLines, config.ChunkOverlap = 1, 0
+	index := embeddings.NewWithEmbedder(api.database, config, keywordEmbedder{})
+	api.SetEmbeddingIndex(index)
+
+	content := "type Config struct{ config string }\nfunc startServer() { server.Run() }\nvar user = \"\""
+	api.database.CreateRoom(ctx, "notes", "")
+	v, _ := api.database.CreateVersion(ctx, "notes", "v1", "", content, hashContent(content), "", false)
+	if err := index.IndexVersion(ctx, v); err != nil {
+		t.Fatalf("Failed to index: %v", err)
+	}
+
+	var prompt string
+	api.ai = func(ctx context.Context, provider, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+		prompt = userPrompt
+		return "done", nil
+	}
+
+	complete := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/ai/complete", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		api.AICompleteHandler(w, req)
+		return w
+	}
+
+	w := complete(`{"code": "load the config from the server", "cursor_pos": 10, "language": "go", "room_id": "notes"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(prompt, "type Config struct") || !strings.Contains(prompt, "func startServer()") {
+		t.Errorf("Expected related chunks in the prompt, got:\n%s", prompt)
+	}
+	if strings.Contains(prompt, "var user") {
+		t.Errorf("Expected unrelated chunks to be left out, got:\n%s", prompt)
+	}
+
+	// Chunks the client already sent are not repeated
+	w = complete(`{"code": "type Config struct{ config string }\n", "cursor_pos": 0, "language": "go", "room_id": "notes"}`)
+	if strings.Contains(prompt, "Related code") {
+		t.Errorf("Expected no context for code the client sent, got:\n%s", prompt)
+	}
+
+	api.database.SetJoinSecret(ctx, "notes", "hunter2")
+	if w := complete(`{"code": "config", "cursor_pos": 0, "room_id": "notes"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without the room secret, got %d", w.Code)
+	}
+}
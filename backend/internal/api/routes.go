@@ -0,0 +1,170 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/tracing"
+)
+
+// Routes returns the REST API handler. Unknown paths answer 404 and known
+// paths with the wrong method answer 405 (with an Allow header), both as JSON
+// errors like the handlers themselves. Large responses are gzipped for
+// clients that accept it.
+func (a *API) Routes() http.Handler {
+	return compress(jsonErrors(a.routes()))
+}
+
+func (a *API) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	handle := func(pattern string, limit time.Duration, h http.HandlerFunc) {
+		mux.Handle(pattern, tracing.Handler(pattern, a.telemetry.Handler(pattern,
+			withBodyLimit(a.bodyLimitFor(pattern), withTimeout(limit, h)))))
+	}
+	request, ai, admin := a.timeouts.Request, a.timeouts.AI, a.timeouts.Admin
+
+	handle("GET /health", request, a.HealthHandler)
+	handle("GET /api/openapi.json", request, a.OpenAPIHandler)
+	handle("GET /api/stats", request, a.StatsHandler)
+	handle("GET /api/stats/history", request, a.StatsHistoryHandler)
+	handle("GET /api/stats/aggregate", request, a.AggregateStatsHandler)
+	// Names busy rooms, so it is guarded like the admin routes
+	handle("GET /metrics", request, a.requireAPIKey(a.MetricsHandler))
+
+	// Rooms. Routes acting on a room's live sessions are served by the
+	// instance that owns it; see ownedRoom.
+	handle("GET /api/rooms", request, a.ListRoomsHandler)
+	handle("POST /api/rooms", request, a.CreateRoomHandler)
+	// Bulk actions are for admins cleaning up; see BulkRoomsHandler
+	handle("POST /api/rooms/bulk", admin, a.requireAPIKey(a.BulkRoomsHandler))
+	// Archives move whole rooms between servers, so they are admin-only
+	handle("POST /api/rooms/import", admin, a.requireAPIKey(a.ImportRoomHandler))
+	handle("GET /api/rooms/{id}/archive", admin, a.requireAPIKey(a.RoomArchiveHandler))
+	handle("GET /api/rooms/{id}", request, a.GetRoomHandler)
+	handle("DELETE /api/rooms/{id}", request, a.ownedRoom(a.DeleteRoomHandler))
+	handle("GET /api/rooms/{id}/usage", request, a.RoomUsageHandler)
+	handle("GET /api/rooms/{id}/at", request, a.RoomAtHandler)
+	handle("GET /api/rooms/{id}/contributions", request, a.ContributionsHandler)
+	// Playback streams until the history runs out, however long that takes
+	handle("GET /api/rooms/{id}/playback", 0, a.PlaybackHandler)
+	handle("GET /api/rooms/{id}/policy", request, a.RoomPolicyHandler)
+	handle("GET /api/rooms/{id}/versions", request, a.ListVersionsHandler)
+	handle("POST /api/rooms/{id}/versions", request, a.CreateVersionHandler)
+	handle("GET /api/rooms/{id}/versions/graph", request, a.VersionGraphHandler)
+	// Exports stream one version at a time, however many there are
+	handle("GET /api/rooms/{id}/versions/export", 0, a.ExportVersionsHandler)
+	handle("GET /api/rooms/{id}/merge-proposal", request, a.MergeProposalHandler)
+	handle("POST /api/rooms/{id}/updates", request, a.ownedRoom(a.PostUpdatesHandler))
+	handle("PUT /api/rooms/{id}/language", request, a.RoomLanguageHandler)
+	handle("PUT /api/rooms/{id}/join-secret", request, a.JoinSecretHandler)
+	handle("DELETE /api/rooms/{id}/join-secret", request, a.JoinSecretHandler)
+	// Runs are bounded by the sandbox timeout and stream as they go
+	handle("POST /api/rooms/{id}/run", 0, a.RunHandler)
+
+	// Versions; listing and creating also live under /api/rooms/{id}/versions
+	handle("GET /api/versions", request, a.ListVersionsHandler)
+	handle("POST /api/versions", request, a.CreateVersionHandler)
+	handle("GET /api/versions/diff", request, a.DiffVersionsHandler)
+	handle("POST /api/versions/merge", request, a.MergeVersionsHandler)
+	handle("GET /api/versions/{id}", request, a.GetVersionHandler)
+	handle("GET /api/versions/{id}/raw", request, a.VersionRawHandler)
+	handle("DELETE /api/versions/{id}", request, a.DeleteVersionHandler)
+	handle("GET /api/versions/{id}/summary", request, a.VersionSummaryHandler)
+	handle("POST /api/versions/{id}/summarize", ai, a.SummarizeVersionHandler)
+	handle("POST /api/versions/{id}/restore", request, a.RestoreVersionHandler)
+	handle("POST /api/versions/{id}/pin", request, a.PinVersionHandler)
+	handle("DELETE /api/versions/{id}/pin", request, a.PinVersionHandler)
+	handle("POST /api/versions/{id}/branch", request, a.BranchVersionHandler)
+
+	// AI
+	handle("GET /api/ai/providers", request, a.AIProvidersHandler)
+	handle("POST /api/ai/complete", ai, a.AICompleteHandler)
+	handle("POST /api/ai/explain", ai, a.AIExplainHandler)
+	handle("POST /api/ai/refactor", ai, a.AIRefactorHandler)
+	handle("POST /api/ai/tests", ai, a.AITestsHandler)
+	handle("POST /api/ai/fix", ai, a.AIFixHandler)
+	handle("POST /api/ai/review", ai, a.AIReviewHandler)
+
+	handle("POST /api/auth/guest", request, a.GuestHandler)
+
+	// User profiles; see authorizeUser
+	handle("POST /api/users", request, a.CreateUserHandler)
+	handle("GET /api/users/{id}", request, a.GetUserHandler)
+	handle("PATCH /api/users/{id}", request, a.UpdateUserHandler)
+	handle("DELETE /api/users/{id}", request, a.DeleteUserHandler)
+	handle("POST /api/users/{id}/token", request, a.UserTokenHandler)
+	handle("GET /api/me/recent", request, a.RecentRoomsHandler)
+	handle("DELETE /api/me/recent/{id}", request, a.ForgetRecentRoomHandler)
+	handle("GET /api/me/favorites", request, a.FavoriteRoomsHandler)
+	handle("PUT /api/me/favorites/{id}", request, a.StarRoomHandler)
+	handle("DELETE /api/me/favorites/{id}", request, a.UnstarRoomHandler)
+
+	// Workspaces; see authorizeWorkspace
+	handle("POST /api/workspaces", request, a.CreateWorkspaceHandler)
+	handle("GET /api/workspaces", request, a.ListWorkspacesHandler)
+	handle("GET /api/workspaces/{id}", request, a.GetWorkspaceHandler)
+	handle("DELETE /api/workspaces/{id}", request, a.DeleteWorkspaceHandler)
+	handle("PUT /api/workspaces/{id}/members/{user}", request, a.SetMemberHandler)
+	handle("DELETE /api/workspaces/{id}/members/{user}", request, a.RemoveMemberHandler)
+	handle("PUT /api/workspaces/{id}/rooms/{room}", request, a.AddWorkspaceRoomHandler)
+	handle("DELETE /api/workspaces/{id}/rooms/{room}", request, a.RemoveWorkspaceRoomHandler)
+
+	// Admin; see requireAPIKey. The event stream runs until the client
+	// leaves, so it has no time limit.
+	handle("GET /api/events", 0, a.requireAPIKey(a.EventsHandler))
+	handle("POST /api/admin/verify", admin, a.requireAPIKey(a.VerifyHandler))
+	handle("POST /api/admin/compact", admin, a.requireAPIKey(a.CompactHandler))
+	handle("GET /api/admin/compaction", admin, a.requireAPIKey(a.CompactionStatsHandler))
+	handle("GET /api/admin/connections", admin, a.requireAPIKey(a.ConnectionsHandler))
+	handle("POST /api/admin/rooms/{id}/kick", admin, a.requireAPIKey(a.ownedRoom(a.KickHandler)))
+	handle("POST /api/admin/rooms/{id}/notice", admin, a.requireAPIKey(a.ownedRoom(a.NoticeHandler)))
+	handle("PUT /api/admin/rooms/{id}/lock", admin, a.requireAPIKey(a.ownedRoom(a.LockRoomHandler)))
+	handle("DELETE /api/admin/rooms/{id}/lock", admin, a.requireAPIKey(a.ownedRoom(a.UnlockRoomHandler)))
+	handle("GET /api/admin/ai/prompts", admin, a.requireAPIKey(a.ListPromptsHandler))
+	handle("PUT /api/admin/ai/prompts/{name}", admin, a.requireAPIKey(a.SetPromptHandler))
+	handle("DELETE /api/admin/ai/prompts/{name}", admin, a.requireAPIKey(a.ResetPromptHandler))
+	handle("PUT /api/admin/workspaces/{id}/quota", admin, a.requireAPIKey(a.WorkspaceQuotaHandler))
+
+	return mux
+}
+
+// Serves requests the mux cannot route with JSON errors instead of its
+// plain-text replies
+func jsonErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern == "" {
+			h.ServeHTTP(&errorRewriter{ResponseWriter: w}, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Replaces the status text written by the mux's fallback handlers with an
+// error body, keeping headers such as Allow
+type errorRewriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (e *errorRewriter) WriteHeader(status int) {
+	if e.wroteHeader {
+		return
+	}
+	e.wroteHeader = true
+
+	if status == http.StatusMethodNotAllowed {
+		errorResponse(e.ResponseWriter, status, apierror.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	errorResponse(e.ResponseWriter, status, apierror.NotFound, "Not found")
+}
+
+func (e *errorRewriter) Write(b []byte) (int, error) {
+	if !e.wroteHeader {
+		e.WriteHeader(http.StatusNotFound)
+	}
+	return len(b), nil
+}
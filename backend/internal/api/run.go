@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/sandbox"
+)
+
+// SetSandbox enables POST /api/rooms/{id}/run
+func (a *API) SetSandbox(runner *sandbox.Runner) {
+	a.sandbox = runner
+}
+
+// RunRequest names the code to run. Without code the room's latest saved
+// version runs, since the server cannot read live documents.
+type RunRequest struct {
+	Code     string `json:"code,omitempty"`
+	Language string `json:"language"`
+	Stdin    string `json:"stdin,omitempty"`
+}
+
+// RunOutput is the data of a stdout or stderr event
+type RunOutput struct {
+	Text string `json:"text"`
+}
+
+// RunExit is the data of the exit event that ends a run
+type RunExit struct {
+	ExitCode   int   `json:"exit_code"` // -1 if the program was stopped
+	DurationMS int64 `json:"duration_ms"`
+	TimedOut   bool  `json:"timed_out"`
+	Truncated  bool  `json:"truncated"`            // Stopped for printing too much
+	VersionID  int   `json:"version_id,omitempty"` // Version that ran, when no code was posted
+}
+
+// RunHandler executes code in the sandbox and streams its output as SSE:
+// stdout and stderr events as output arrives, then an exit event. Runs are
+// limited in time, memory and output, and in how many happen at once.
+func (a *API) RunHandler(w http.ResponseWriter, r *http.Request) {
+	if a.sandbox == nil {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Code execution is disabled")
+		return
+	}
+
+	roomID := r.PathValue("id")
+	room, err := a.database.GetRoom(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
+		return
+	}
+	if room == nil {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found")
+		return
+	}
+	if !a.authorizeRoom(w, r, roomID) {
+		return
+	}
+
+	var req RunRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if !a.sandbox.Allows(req.Language) {
+		apierror.Write(w, http.StatusUnprocessableEntity, apierror.ValidationFailed, "Validation failed", []FieldError{{
+			Field:   "language",
+			Message: "must be one of: " + strings.Join(a.sandbox.Languages(), ", "),
+		}})
+		return
+	}
+
+	exit := RunExit{}
+	code := req.Code
+	if code == "" {
+		version, err := a.database.GetLatestVersion(r.Context(), roomID)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
+			return
+		}
+		if version == nil {
+			errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Room has no saved versions; post the code to run")
+			return
+		}
+		code = version.Content
+		exit.VersionID = version.ID
+	}
+
+	// Headers go out with the first output, so a run that can't start
+	// still gets a JSON error
+	rc := http.NewResponseController(w)
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// Output is cut at arbitrary bytes; hold back a split character until
+	// the rest arrives
+	partial := map[string][]byte{}
+	out := func(stream string, data []byte) {
+		start()
+		data = append(partial[stream], data...)
+		cut := len(data)
+		for cut > 0 && cut > len(data)-utf8.UTFMax && !utf8.Valid(data[:cut]) {
+			cut--
+		}
+		if !utf8.Valid(data[:cut]) {
+			cut = len(data)
+		}
+		partial[stream] = append([]byte(nil), data[cut:]...)
+		if cut > 0 {
+			writeRunEvent(w, stream, RunOutput{Text: string(data[:cut])})
+			rc.Flush()
+		}
+	}
+
+	result, err := a.sandbox.Run(r.Context(), req.Language, code, req.Stdin, out)
+	if !started {
+		switch {
+		case errors.Is(err, sandbox.ErrBusy):
+			w.Header().Set("Retry-After", "5")
+			errorResponse(w, http.StatusTooManyRequests, apierror.RateLimited, "Too many programs running, try again shortly")
+			return
+		case err != nil:
+			log.Printf("Failed to run code in room %s: %v", roomID, err)
+			errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to run code")
+			return
+		}
+		start()
+	}
+	if err != nil {
+		log.Printf("Failed to run code in room %s: %v", roomID, err)
+	}
+
+	for stream, rest := range partial {
+		if len(rest) > 0 {
+			writeRunEvent(w, stream, RunOutput{Text: string(rest)})
+		}
+	}
+	exit.ExitCode = result.ExitCode
+	exit.DurationMS = result.Duration.Milliseconds()
+	exit.TimedOut = result.TimedOut
+	exit.Truncated = result.Truncated
+	writeRunEvent(w, "exit", exit)
+	rc.Flush()
+}
+
+func writeRunEvent(w http.ResponseWriter, event string, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body)
+}
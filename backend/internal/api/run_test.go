@@ -0,0 +1,54 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/sandbox"
+)
+
+func TestRunHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	api.database.CreateRoom(context.Background(), "scratch", "")
+
+	run := func(roomID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/rooms/"+roomID+"/run", bytes.NewBufferString(body))
+		req.SetPathValue("id", roomID)
+		w := httptest.NewRecorder()
+		api.RunHandler(w, req)
+		return w
+	}
+
+	if w := run("scratch", `{"language": "python", "code": "print(1)"}`); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a sandbox, got %d: %s", w.Code, w.Body)
+	}
+
+	// Nothing below reaches the backend, so it need not be installed
+	config := sandbox.DefaultConfig()
+	config.Backend = "firejail"
+	runner, err := sandbox.New(config)
+	if err != nil {
+		t.Fatalf("Failed to create runner: %v", err)
+	}
+	api.SetSandbox(runner)
+
+	tests := []struct {
+		room, body string
+		status     int
+	}{
+		{"missing", `{"language": "python", "code": "print(1)"}`, http.StatusNotFound},
+		{"scratch", `{"code": "print(1)"}`, http.StatusUnprocessableEntity},
+		{"scratch", `{"language": "go", "code": "package main"}`, http.StatusUnprocessableEntity},
+		// No code and no saved version to run
+		{"scratch", `{"language": "python"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := run(tt.room, tt.body); w.Code != tt.status {
+			t.Errorf("%s %s: expected %d, got %d: %s", tt.room, tt.body, tt.status, w.Code, w.Body)
+		}
+	}
+}
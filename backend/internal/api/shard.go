@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// In a sharded deployment, sends requests that act on a room's live
+// sessions to the instance serving it with a 307, which keeps the method
+// and body. Clients must send the Authorization header again themselves;
+// Go's, like browsers', drops it on a redirect to another host.
+func (a *API) ownedRoom(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if owner := a.hub.RoomOwner(r.PathValue("id")); owner != "" {
+			http.Redirect(w, r, strings.TrimSuffix(owner, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		next(w, r)
+	}
+}
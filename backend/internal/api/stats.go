@@ -0,0 +1,100 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/metrics"
+	"github.com/manpreetbhatti/lattice/backend/internal/stats"
+	"github.com/manpreetbhatti/lattice/backend/internal/telemetry"
+)
+
+const (
+	defaultHistoryRange = 24 * time.Hour
+	defaultHistoryStep  = 5 * time.Minute
+	maxHistoryRange     = 90 * 24 * time.Hour
+	maxHistoryPoints    = 2000
+)
+
+// StatsHistoryHandler returns sampled usage statistics bucketed by step, for
+// charting growth: GET /api/stats/history?range=24h&step=5m
+func (a *API) StatsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	span, err := durationParam(r, "range", defaultHistoryRange)
+	if err != nil || span <= 0 || span > maxHistoryRange {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, fmt.Sprintf("range must be a positive duration up to %v", maxHistoryRange))
+		return
+	}
+
+	step, err := durationParam(r, "step", defaultHistoryStep)
+	if err != nil || step < time.Second {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "step must be a duration of at least 1s")
+		return
+	}
+
+	if span/step > maxHistoryPoints {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, fmt.Sprintf("range/step must not exceed %d points", maxHistoryPoints))
+		return
+	}
+
+	to := time.Now().UTC()
+	from := to.Add(-span).Truncate(step)
+
+	samples, err := a.database.ListStatsSamples(r.Context(), from)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to load stats history")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"range":  span.String(),
+		"step":   step.String(),
+		"from":   from,
+		"to":     to,
+		"points": stats.Downsample(samples, from, step),
+	})
+}
+
+// SetTelemetry enables anonymous usage counting and GET /api/stats/aggregate.
+// Must be called before Routes.
+func (a *API) SetTelemetry(collector *telemetry.Collector) {
+	a.telemetry = collector
+}
+
+// AggregateStatsHandler returns the anonymous usage telemetry has counted
+// since the server started: GET /api/stats/aggregate
+func (a *API) AggregateStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.telemetry == nil {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Telemetry is disabled")
+		return
+	}
+	jsonResponse(w, http.StatusOK, a.telemetry.Aggregate())
+}
+
+// SetMetrics enables GET /metrics. Must be called before Routes.
+func (a *API) SetMetrics(collector *metrics.Collector) {
+	a.metrics = collector
+}
+
+// MetricsHandler serves hub load for Prometheus to scrape: GET /metrics
+func (a *API) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.metrics == nil {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Metrics are disabled")
+		return
+	}
+	w.Header().Set("Content-Type", metrics.ContentType)
+	if err := a.metrics.Write(w); err != nil {
+		log.Printf("Error writing metrics: %v", err)
+	}
+}
+
+// Parses a Go duration query parameter, falling back to def when absent
+func durationParam(r *http.Request, key string, def time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	return time.ParseDuration(v)
+}
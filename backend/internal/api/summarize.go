@@ -0,0 +1,237 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// SummarizeVersionRequest is the optional body of POST
+// /api/versions/{id}/summarize
+type SummarizeVersionRequest struct {
+	Provider string `json:"provider,omitempty"`
+}
+
+// Longest summary kept; providers sometimes ignore the one-line rule
+const maxSummaryLength = 200
+
+// Tokens allowed for the provider's reply
+const summaryMaxTokens = 100
+
+// Stored when a version's content matches its predecessor's
+const unchangedSummary = "No changes from the previous version"
+
+const summarySystemPrompt = `You summarize what changed between two versions of a document, shown as a diff.
+Each line is "+" (added), "-" (removed) or " " (unchanged), then the line number in the new text, then "|" and the line.
+Rules:
+- Reply with one line of at most 15 words, like a commit message subject
+- Describe the effect of the change, not the individual lines
+- No quotes, markdown or trailing period`
+
+var errDiffTooLarge = fmt.Errorf("diff exceeds %d bytes", maxAICodeBytes)
+
+// Asks the AI provider for a one-line summary of how a version differs from
+// the one saved before it in its room
+func (a *API) summarizeVersion(ctx context.Context, version *db.Version, provider string) (string, error) {
+	previous, err := a.database.GetPreviousVersion(ctx, version.ID)
+	if err != nil {
+		return "", err
+	}
+	oldContent := ""
+	if previous != nil {
+		oldContent = previous.Content
+	}
+
+	diff, changed := renderReviewDiff(computeDiff(oldContent, version.Content))
+	if !changed {
+		return unchangedSummary, nil
+	}
+	if len(diff) > maxAICodeBytes {
+		return "", errDiffTooLarge
+	}
+
+	userPrompt := "Summarize this change:\n\n" + diff
+	if previous == nil {
+		userPrompt = "Summarize this new document:\n\n" + diff
+	}
+	reply, err := a.ai(ctx, provider, summarySystemPrompt, userPrompt, summaryMaxTokens)
+	if err != nil {
+		return "", err
+	}
+	summary := cleanSummary(reply)
+	if summary == "" {
+		return "", fmt.Errorf("empty summary in %q", truncateForLog(reply))
+	}
+	return summary, nil
+}
+
+// Keeps the first line of a reply without surrounding quotes or markdown,
+// cut to maxSummaryLength
+func cleanSummary(reply string) string {
+	line := strings.TrimSpace(reply)
+	for _, l := range strings.Split(line, "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "```") {
+			line = l
+			break
+		}
+	}
+	line = strings.TrimLeft(line, "-*# ")
+	line = strings.Trim(line, "\"'`*")
+	line = strings.TrimSuffix(strings.TrimSpace(line), ".")
+
+	if runes := []rune(line); len(runes) > maxSummaryLength {
+		line = string(runes[:maxSummaryLength-1]) + "…"
+	}
+	return line
+}
+
+// SummarizeVersionHandler replaces a version's description with an AI
+// summary of what changed since the version before it
+func (a *API) SummarizeVersionHandler(w http.ResponseWriter, r *http.Request) {
+	versionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid version ID")
+		return
+	}
+
+	var req SummarizeVersionRequest
+	if r.ContentLength != 0 && !decodeRequest(w, r, &req) {
+		return
+	}
+
+	version, err := a.database.GetVersion(r.Context(), versionID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get version")
+		return
+	}
+	if version == nil {
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Version not found")
+		return
+	}
+	if !a.authorizeVersion(w, r, version) {
+		return
+	}
+
+	summary, err := a.summarizeVersion(r.Context(), version, req.Provider)
+	if errors.Is(err, errDiffTooLarge) {
+		errorResponse(w, http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge, "Change is too large to summarize")
+		return
+	}
+	if err != nil {
+		log.Printf("AI summary error for version %d: %v", version.ID, err)
+		errorResponse(w, http.StatusServiceUnavailable, apierror.AIUnavailable, "AI service unavailable")
+		return
+	}
+
+	found, err := a.database.SetVersionDescription(r.Context(), version.ID, summary)
+	if err != nil {
+		databaseError(w, err, "Failed to save summary")
+		return
+	}
+	if !found {
+		errorResponse(w, http.StatusNotFound, apierror.VersionNotFound, "Version not found")
+		return
+	}
+
+	version.Description = summary
+	jsonResponse(w, http.StatusOK, newVersionResponse(version))
+}
+
+// Versions waiting for an automatic summary; more are skipped
+const summaryQueueSize = 64
+
+// AutoSummarizer fills in the description of manual versions saved without
+// one, in the background so saving never waits on the AI provider
+type AutoSummarizer struct {
+	api     *API
+	timeout time.Duration
+	queue   chan *db.Version
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewAutoSummarizer returns a summarizer for versions saved through this
+// API. Register it with AddVersionNotifier after starting it.
+func (a *API) NewAutoSummarizer() *AutoSummarizer {
+	return &AutoSummarizer{
+		api:     a,
+		timeout: a.timeouts.AI,
+		queue:   make(chan *db.Version, summaryQueueSize),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (s *AutoSummarizer) Start() {
+	s.wg.Add(1)
+	go s.run()
+	log.Println("📝 Automatic version summaries enabled")
+}
+
+// Stop abandons queued versions and waits for the summary in progress
+func (s *AutoSummarizer) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// VersionSaved queues a manual version without a description. It never
+// blocks.
+func (s *AutoSummarizer) VersionSaved(v *db.Version) {
+	if v.IsAuto || v.Description != "" {
+		return
+	}
+	select {
+	case s.queue <- v:
+	default:
+		log.Printf("Summary queue full, not summarizing version %d", v.ID)
+	}
+}
+
+func (s *AutoSummarizer) run() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case v := <-s.queue:
+			s.summarize(v)
+		}
+	}
+}
+
+func (s *AutoSummarizer) summarize(v *db.Version) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if s.timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), s.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	// Abort the provider call on shutdown
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	summary, err := s.api.summarizeVersion(ctx, v, "")
+	if err != nil {
+		log.Printf("Failed to summarize version %d: %v", v.ID, err)
+		return
+	}
+	if _, err := s.api.database.SetVersionDescription(ctx, v.ID, summary); err != nil {
+		log.Printf("Failed to save summary of version %d: %v", v.ID, err)
+	}
+}
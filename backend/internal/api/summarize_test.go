@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCleanSummary(t *testing.T) {
+	cases := map[string]string{
+		"Add error handling to the parser.":             "Add error handling to the parser",
+		"\n```\n\"Rename the config loader\"\n```":      "Rename the config loader",
+		"- **Fix typo in README**\nSecond line ignored": "Fix typo in README",
+		strings.Repeat("x", 300):                        strings.Repeat("x", maxSummaryLength-1) + "…",
+	}
+	for reply, want := range cases {
+		if got := cleanSummary(reply); got != want {
+			t.Errorf("cleanSummary(%q) = %q, want %q", reply, got, want)
+		}
+	}
+}
+
+func TestSummarizeVersion(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	api.database.CreateRoom(ctx, "notes", "")
+	api.database.CreateVersion(ctx, "notes", "v1", "", "a\nb", hashContent("a\nb"), "", false)
+	v2, _ := api.database.CreateVersion(ctx, "notes", "v2", "Old description", "a\nb\nc", hashContent("a\nb\nc"), "", false)
+	v3, _ := api.database.CreateVersion(ctx, "notes", "v3", "", "a\nb\nc", hashContent("a\nb\nc"), "", false)
+
+	calls := 0
+	var prompt string
+	api.ai = func(ctx context.Context, provider, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+		calls++
+		prompt = userPrompt
+		return "Add line c.", nil
+	}
+
+	summarize := func(id int, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/versions/%d/summarize", id), bytes.NewBufferString(body))
+		req.SetPathValue("id", fmt.Sprint(id))
+		w := httptest.NewRecorder()
+		api.SummarizeVersionHandler(w, req)
+		return w
+	}
+
+	w := summarize(v2.ID, "")
+	var response VersionResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || response.Description != "Add line c" {
+		t.Fatalf("Expected the summary as the description, got %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(prompt, "+     3 | c") {
+		t.Errorf("Expected the diff against v1 in the prompt, got:\n%s", prompt)
+	}
+	if stored, _ := api.database.GetVersion(ctx, v2.ID); stored.Description != "Add line c" {
+		t.Errorf("Expected the summary to be stored, got %q", stored.Description)
+	}
+
+	// Identical content is described without asking the provider
+	w = summarize(v3.ID, `{"provider": "ollama"}`)
+	json.NewDecoder(w.Body).Decode(&response)
+	if calls != 1 || response.Description != unchangedSummary {
+		t.Errorf("Expected %q without a provider call, got %q after %d calls", unchangedSummary, response.Description, calls)
+	}
+
+	if w := summarize(v2.ID, `{"provider": "nope"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an unknown provider, got %d", w.Code)
+	}
+	if w := summarize(9999, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing version, got %d", w.Code)
+	}
+}
+
+func TestAutoSummarizer(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	api.ai = func(context.Context, string, string, string, int) (string, error) {
+		return "Start the notes", nil
+	}
+	summarizer := api.NewAutoSummarizer()
+	summarizer.Start()
+	defer summarizer.Stop()
+
+	api.database.CreateRoom(ctx, "notes", "")
+	auto, _ := api.database.CreateVersion(ctx, "notes", "Auto-save", "", "x", hashContent("x"), "", true)
+	manual, _ := api.database.CreateVersion(ctx, "notes", "Draft", "", "x\ny", hashContent("x\ny"), "", false)
+	summarizer.VersionSaved(auto)
+	summarizer.VersionSaved(manual)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		v, _ := api.database.GetVersion(ctx, manual.ID)
+		if v.Description == "Start the notes" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the manual version to be summarized, got %q", v.Description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, _ := api.database.GetVersion(ctx, auto.ID); v.Description != "" {
+		t.Errorf("Expected auto-saves to be left alone, got %q", v.Description)
+	}
+}
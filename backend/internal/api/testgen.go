@@ -0,0 +1,78 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+type AITestsRequest struct {
+	Code      string `json:"code"`
+	Language  string `json:"language"`
+	Framework string `json:"framework,omitempty"` // e.g. "pytest"; chosen from the language when empty
+	Provider  string `json:"provider,omitempty"`
+}
+
+type AITestsResponse struct {
+	Tests     string `json:"tests"`
+	Framework string `json:"framework"`
+}
+
+// Tokens allowed for the provider's reply; tests run longer than the code
+const testsMaxTokens = 2000
+
+// Test frameworks assumed when the request names none
+var defaultTestFrameworks = map[string]string{
+	"javascript": "Jest",
+	"typescript": "Jest",
+	"jsx":        "Jest with React Testing Library",
+	"tsx":        "Jest with React Testing Library",
+	"python":     "pytest",
+	"go":         "the standard testing package",
+	"rust":       "Rust's built-in test harness",
+	"cpp":        "GoogleTest",
+	"c":          "Unity",
+	"java":       "JUnit 5",
+}
+
+// AITestsHandler asks the AI provider for unit tests of the given code
+func (a *API) AITestsHandler(w http.ResponseWriter, r *http.Request) {
+	var req AITestsRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if req.Language == "" {
+		req.Language = "javascript"
+	}
+	if req.Framework == "" {
+		req.Framework = defaultTestFrameworks[req.Language]
+	}
+	framework := req.Framework
+	if framework == "" {
+		framework = "the most common test framework for the language"
+	}
+
+	systemPrompt := a.systemPrompt(r.Context(), promptTests, map[string]string{
+		"language":    req.Language,
+		"framework":   framework,
+		"instruction": "",
+	})
+	userPrompt := fmt.Sprintf("Write unit tests for this %s code using %s:\n\n```%s\n%s\n```",
+		req.Language, framework, req.Language, req.Code)
+
+	tests, err := a.ai(r.Context(), req.Provider, systemPrompt, userPrompt, testsMaxTokens)
+	if err != nil {
+		log.Printf("AI tests error: %v", err)
+		errorResponse(w, http.StatusServiceUnavailable, apierror.AIUnavailable, "AI service unavailable")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, AITestsResponse{
+		Tests:     extractCodeFromMarkdown(strings.TrimSpace(tests)),
+		Framework: req.Framework,
+	})
+}
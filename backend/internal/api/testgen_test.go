@@ -0,0 +1,48 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAITests(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	var system, user string
+	api.ai = func(ctx context.Context, provider, systemPrompt, userPrompt string, maxTokens int) (string, error) {
+		system, user = systemPrompt, userPrompt
+		return "```python\ndef test_add():\n    assert add(1, 2) == 3\n```", nil
+	}
+
+	generate := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/ai/tests", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		api.AITestsHandler(w, req)
+		return w
+	}
+
+	w := generate(`{"code": "def add(a, b): return a + b", "language": "python"}`)
+	var response AITestsResponse
+	json.NewDecoder(w.Body).Decode(&response)
+	if w.Code != http.StatusOK || response.Framework != "pytest" || !strings.HasPrefix(response.Tests, "def test_add") {
+		t.Fatalf("Expected pytest tests without the fence, got %d %+v", w.Code, response)
+	}
+	if !strings.Contains(system, "Use pytest") || !strings.Contains(user, "def add") {
+		t.Errorf("Expected the framework and code in the prompts, got %q and %q", system, user)
+	}
+
+	generate(`{"code": "x", "language": "python", "framework": "unittest"}`)
+	if !strings.Contains(system, "Use unittest") {
+		t.Errorf("Expected the requested framework, got %q", system)
+	}
+
+	if w := generate(`{"language": "python"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 without code, got %d", w.Code)
+	}
+}
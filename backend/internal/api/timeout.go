@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+// Timeouts bounds how long REST handlers may run. A handler still running at
+// its deadline has its request context cancelled, which aborts in-flight
+// queries and provider calls, and the client gets a 503 TIMEOUT error. Zero
+// disables a limit.
+type Timeouts struct {
+	Request time.Duration // Most routes
+	AI      time.Duration // /api/ai/*, which wait on an external provider
+	Admin   time.Duration // /api/admin/*, which may scan every room
+}
+
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Request: 30 * time.Second,
+		AI:      90 * time.Second,
+		Admin:   5 * time.Minute,
+	}
+}
+
+// SetTimeouts changes the handler time limits. Call it before Routes.
+func (a *API) SetTimeouts(t Timeouts) {
+	a.timeouts = t
+}
+
+var timeoutBody = func() string {
+	body, _ := json.Marshal(apierror.Error{Code: apierror.Timeout, Message: "Request timed out"})
+	return string(body)
+}()
+
+// Cancels the request context after d and answers with a JSON error if the
+// handler has not finished. The handler's response is buffered until it
+// returns, so this is only for routes that do not stream.
+func withTimeout(d time.Duration, h http.HandlerFunc) http.Handler {
+	if d <= 0 {
+		return h
+	}
+
+	th := http.TimeoutHandler(h, d, timeoutBody)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only reaches the client on timeout; otherwise the handler's own
+		// headers replace it
+		w.Header().Set("Content-Type", "application/json")
+		th.ServeHTTP(w, r)
+	})
+}
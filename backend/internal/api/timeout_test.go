@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+func TestWithTimeout(t *testing.T) {
+	cancelled := make(chan error, 1)
+	slow := withTimeout(20*time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		cancelled <- r.Context().Err()
+	})
+
+	rr := httptest.NewRecorder()
+	slow.ServeHTTP(rr, httptest.NewRequest("GET", "/slow", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", ct)
+	}
+	var body apierror.Error
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode body: %v", err)
+	}
+	if body.Code != apierror.Timeout {
+		t.Errorf("Expected code %s, got %s", apierror.Timeout, body.Code)
+	}
+
+	select {
+	case err := <-cancelled:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected handler context to hit its deadline, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handler context was not cancelled")
+	}
+
+	fast := withTimeout(time.Second, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handler", "fast")
+		jsonResponse(w, http.StatusCreated, map[string]bool{"ok": true})
+	})
+	rr = httptest.NewRecorder()
+	fast.ServeHTTP(rr, httptest.NewRequest("GET", "/fast", nil))
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Expected status 201, got %d", rr.Code)
+	}
+	if rr.Header().Get("X-Handler") != "fast" {
+		t.Error("Expected handler headers to be kept")
+	}
+
+	// A zero limit leaves the handler unwrapped
+	var hasDeadline bool
+	unlimited := withTimeout(0, func(w http.ResponseWriter, r *http.Request) {
+		_, hasDeadline = r.Context().Deadline()
+	})
+	unlimited.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if hasDeadline {
+		t.Error("Expected no deadline when the limit is zero")
+	}
+}
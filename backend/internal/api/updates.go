@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+	"github.com/manpreetbhatti/lattice/backend/internal/ws"
+)
+
+const (
+	// Maximum number of updates accepted by a single offline batch
+	maxOfflineUpdates = 1000
+
+	// Matches the WebSocket read limit
+	maxOfflineUpdateBytes = 1024 * 1024
+)
+
+// PostUpdatesRequest carries raw Yjs updates (base64 in JSON) made while a
+// client was offline
+type PostUpdatesRequest struct {
+	Updates [][]byte `json:"updates"`
+}
+
+// PostUpdatesHandler applies a batch of Yjs updates over plain HTTP. They are
+// stored, persisted and broadcast exactly as if sent over the WebSocket.
+func (a *API) PostUpdatesHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+
+	if !a.authorizeRoom(w, r, roomID) {
+		return
+	}
+	if a.hub.StrictRooms() {
+		room, err := a.database.GetRoom(r.Context(), roomID)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
+			return
+		}
+		if room == nil {
+			errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found")
+			return
+		}
+	}
+
+	var req PostUpdatesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		bodyError(w, err)
+		return
+	}
+
+	if len(req.Updates) == 0 {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, "updates is required")
+		return
+	}
+
+	if len(req.Updates) > maxOfflineUpdates {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, fmt.Sprintf("at most %d updates per request", maxOfflineUpdates))
+		return
+	}
+
+	frames := make([][]byte, len(req.Updates))
+	for i, update := range req.Updates {
+		if len(update) == 0 || len(update) > maxOfflineUpdateBytes {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidBody, fmt.Sprintf("update %d must be between 1 and %d bytes", i, maxOfflineUpdateBytes))
+			return
+		}
+		frames[i] = protocol.EncodeUpdate(update)
+	}
+
+	seqs, err := a.hub.ApplyUpdates(roomID, frames)
+	if errors.Is(err, ws.ErrRoomQuotaExceeded) {
+		errorResponse(w, http.StatusRequestEntityTooLarge, apierror.RoomQuotaExceeded, "Room storage quota exceeded")
+		return
+	}
+	if errors.Is(err, ws.ErrRoomLocked) {
+		errorResponse(w, http.StatusLocked, apierror.RoomLocked, "Room is locked; try again later")
+		return
+	}
+	if err != nil {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Server is shutting down")
+		return
+	}
+
+	applied := 0
+	for _, seq := range seqs {
+		if seq > 0 {
+			applied++
+		}
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"room_id":   roomID,
+		"applied":   applied,
+		"sequences": seqs,
+	})
+}
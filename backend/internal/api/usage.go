@@ -0,0 +1,76 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	"github.com/manpreetbhatti/lattice/backend/internal/stats"
+)
+
+// RoomUsageReport breaks down the storage a room holds and how many clients
+// used it over the last day, so owners can find the rooms taking up space
+type RoomUsageReport struct {
+	RoomID      string `json:"room_id"`
+	UpdateCount int    `json:"update_count"`
+	RoomUsage
+
+	ActiveClients int                   `json:"active_clients"`
+	HistoryStep   string                `json:"history_step"`
+	ClientHistory []db.RoomClientSample `json:"client_history"` // Peak clients per step; steps with none are left out
+}
+
+// RoomUsageHandler reports a room's storage and recent clients:
+// GET /api/rooms/{id}/usage?step=5m
+func (a *API) RoomUsageHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+
+	step, err := durationParam(r, "step", defaultHistoryStep)
+	if err != nil || step < time.Minute || step > stats.RoomHistoryRetention {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter,
+			fmt.Sprintf("step must be a duration between 1m and %v", stats.RoomHistoryRetention))
+		return
+	}
+
+	room, err := a.database.GetRoom(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
+		return
+	}
+	if room == nil {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found")
+		return
+	}
+	if room.Workspace != "" && !a.isWorkspaceMember(w, r, room.Workspace) {
+		return
+	}
+
+	usage, err := a.roomUsage(r.Context(), room)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room usage")
+		return
+	}
+	updateCount, err := a.database.GetUpdateCount(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room usage")
+		return
+	}
+
+	from := time.Now().UTC().Add(-stats.RoomHistoryRetention).Truncate(step)
+	samples, err := a.database.ListRoomClientSamples(r.Context(), roomID, from)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to load client history")
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, RoomUsageReport{
+		RoomID:        roomID,
+		UpdateCount:   updateCount,
+		RoomUsage:     *usage,
+		ActiveClients: a.hub.GetActiveRooms()[roomID],
+		HistoryStep:   step.String(),
+		ClientHistory: stats.DownsampleRoomClients(samples, from, step),
+	})
+}
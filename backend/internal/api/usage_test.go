@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRoomUsageHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := api.database.CreateRoom(ctx, "heavy", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	api.database.SaveUpdates(ctx, "heavy", [][]byte{make([]byte, 100), make([]byte, 50)})
+	api.database.SaveSnapshot(ctx, "heavy", make([]byte, 40), 2)
+
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour)
+	api.database.RecordRoomClients(ctx, hour.Add(-48*time.Hour), map[string]int{"heavy": 9})
+	api.database.RecordRoomClients(ctx, hour, map[string]int{"heavy": 3})
+	api.database.RecordRoomClients(ctx, hour.Add(time.Minute), map[string]int{"heavy": 5})
+
+	req := httptest.NewRequest("GET", "/api/rooms/heavy/usage?step=1h", nil)
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var report RoomUsageReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if report.UpdateCount != 2 || report.UpdateBytes != 150 || report.SnapshotBytes != 40 {
+		t.Errorf("Unexpected storage %+v", report)
+	}
+	if report.CompactedAt == nil {
+		t.Error("Expected the compaction time")
+	}
+
+	// Samples older than a day are left out and each step reports its peak
+	if len(report.ClientHistory) != 1 || report.ClientHistory[0].Clients != 5 {
+		t.Errorf("Unexpected client history %+v", report.ClientHistory)
+	}
+
+	for path, status := range map[string]int{
+		"/api/rooms/missing/usage":        http.StatusNotFound,
+		"/api/rooms/heavy/usage?step=10s": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s: expected %d, got %d", path, status, w.Code)
+		}
+	}
+}
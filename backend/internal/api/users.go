@@ -0,0 +1,219 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// Header carrying the identity token of the profile a request acts on
+const identityTokenHeader = "X-Identity-Token"
+
+// Largest accepted editor preferences object
+const maxPreferencesBytes = 16 * 1024
+
+type CreateUserRequest struct {
+	Name        string          `json:"name"`
+	Color       string          `json:"color,omitempty"`       // #rrggbb; picked for the user if empty
+	Preferences json.RawMessage `json:"preferences,omitempty"` // JSON object
+}
+
+// UpdateUserRequest changes the fields it includes
+type UpdateUserRequest struct {
+	Name        *string         `json:"name,omitempty"`
+	Color       *string         `json:"color,omitempty"`
+	Preferences json.RawMessage `json:"preferences,omitempty"` // Replaces the stored object
+}
+
+// UserTokenRequest signs a device in to a profile
+type UserTokenRequest struct {
+	Secret string `json:"secret"`
+}
+
+// UserResponse is a profile with a fresh identity token for the WebSocket
+// (?token= or an auth message) and later profile requests
+type UserResponse struct {
+	User     *db.User       `json:"user"`
+	Token    string         `json:"token"`
+	Identity *auth.Identity `json:"identity"`
+	Secret   string         `json:"secret,omitempty"`           // Sign-in secret, only returned on creation
+	Sessions int            `json:"sessions_updated,omitempty"` // Connected sessions given the new name and color
+}
+
+// CreateUserHandler stores a profile that can be signed in to from any
+// device with the returned secret
+func (a *API) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	if a.guests == nil {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Identities are disabled")
+		return
+	}
+
+	var req CreateUserRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	color := req.Color
+	if color == "" {
+		color = auth.RandomColor()
+	}
+	secret, user, err := a.database.CreateUser(r.Context(), strings.TrimSpace(req.Name), color, req.Preferences)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to create user")
+		return
+	}
+
+	a.userResponse(w, http.StatusCreated, UserResponse{User: user, Secret: secret})
+}
+
+// UserTokenHandler signs another device in to a profile with its secret
+func (a *API) UserTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if a.guests == nil {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Identities are disabled")
+		return
+	}
+
+	var req UserTokenRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	id := r.PathValue("id")
+	ok, err := a.database.CheckUserSecret(r.Context(), id, req.Secret)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to check secret")
+		return
+	}
+	if !ok {
+		errorResponse(w, http.StatusUnauthorized, apierror.Unauthorized, "Invalid user or secret")
+		return
+	}
+
+	user, err := a.database.GetUser(r.Context(), id)
+	if err != nil || user == nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get user")
+		return
+	}
+	a.userResponse(w, http.StatusOK, UserResponse{User: user})
+}
+
+// GetUserHandler returns the caller's own profile
+func (a *API) GetUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.authorizeUser(w, r)
+	if !ok {
+		return
+	}
+	jsonResponse(w, http.StatusOK, user)
+}
+
+// UpdateUserHandler changes the caller's profile. A new name or color
+// reaches sessions signed in as the user straight away, including the
+// presence their peers see.
+func (a *API) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.authorizeUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req UpdateUserRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	name, color, preferences := user.Name, user.Color, user.Preferences
+	if req.Name != nil {
+		name = strings.TrimSpace(*req.Name)
+	}
+	if req.Color != nil {
+		color = *req.Color
+	}
+	if len(req.Preferences) > 0 {
+		preferences = req.Preferences
+	}
+
+	updated, err := a.database.UpdateUser(r.Context(), user.ID, name, color, preferences)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to update user")
+		return
+	}
+	if updated == nil {
+		errorResponse(w, http.StatusNotFound, apierror.UserNotFound, "User not found")
+		return
+	}
+
+	response := UserResponse{User: updated}
+	if updated.Name != user.Name || updated.Color != user.Color {
+		response.Sessions = a.hub.UpdateIdentity(&auth.Identity{ID: updated.ID, Name: updated.Name, Color: updated.Color})
+	}
+	a.userResponse(w, http.StatusOK, response)
+}
+
+// DeleteUserHandler removes the caller's profile. Its tokens stop working
+// on new connections; sessions already signed in keep their identity until
+// they disconnect.
+func (a *API) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.authorizeUser(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := a.database.DeleteUser(r.Context(), user.ID); err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to delete user")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]string{"message": "User deleted"})
+}
+
+// Returns the profile in the path, writing an error and returning false
+// unless the request carries an identity token for it
+func (a *API) authorizeUser(w http.ResponseWriter, r *http.Request) (*db.User, bool) {
+	return a.tokenUser(w, r, r.PathValue("id"))
+}
+
+// Returns the profile the request's identity token was issued for, writing
+// an error and returning false if there is none or it is not id (when set)
+func (a *API) tokenUser(w http.ResponseWriter, r *http.Request, id string) (*db.User, bool) {
+	if a.guests == nil {
+		errorResponse(w, http.StatusServiceUnavailable, apierror.ServiceUnavailable, "Identities are disabled")
+		return nil, false
+	}
+
+	identity, err := a.guests.Verify(r.Header.Get(identityTokenHeader))
+	if err != nil || (id != "" && identity.ID != id) || !strings.HasPrefix(identity.ID, db.UserIDPrefix) {
+		errorResponse(w, http.StatusUnauthorized, apierror.Unauthorized, "Identity token for this user required in "+identityTokenHeader)
+		return nil, false
+	}
+
+	user, err := a.database.GetUser(r.Context(), identity.ID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get user")
+		return nil, false
+	}
+	if user == nil {
+		errorResponse(w, http.StatusNotFound, apierror.UserNotFound, "User not found")
+		return nil, false
+	}
+	return user, true
+}
+
+// Issues a token for the response's user and writes it
+func (a *API) userResponse(w http.ResponseWriter, status int, response UserResponse) {
+	token, identity, err := a.guests.IssueFor(response.User.ID, response.User.Name, response.User.Color)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to issue token")
+		return
+	}
+	response.Token = token
+	response.Identity = identity
+	jsonResponse(w, status, response)
+}
+
+// Reports whether raw is absent or a JSON object
+func isJSONObject(raw json.RawMessage) bool {
+	return len(raw) == 0 || bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{"))
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
+)
+
+func TestUsers(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	api.SetGuestIssuer(auth.NewIssuer([]byte("test-key"), time.Hour))
+
+	call := func(handler http.HandlerFunc, method, id, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/users/"+id, bytes.NewBufferString(body))
+		req.SetPathValue("id", id)
+		if token != "" {
+			req.Header.Set(identityTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	w := call(api.CreateUserHandler, "POST", "", "", `{"name": " Ada ", "preferences": {"theme": "dark"}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var created UserResponse
+	json.NewDecoder(w.Body).Decode(&created)
+	user := created.User
+	if user.Name != "Ada" || !auth.IsValidColor(user.Color) || created.Secret == "" || created.Identity.ID != user.ID {
+		t.Fatalf("Unexpected created user %+v", created)
+	}
+
+	// Another device signs in with the secret and gets the same identity
+	w = call(api.UserTokenHandler, "POST", user.ID, "", `{"secret": "`+created.Secret+`"}`)
+	var signedIn UserResponse
+	json.NewDecoder(w.Body).Decode(&signedIn)
+	if w.Code != http.StatusOK || signedIn.Identity.ID != user.ID || signedIn.Secret != "" {
+		t.Fatalf("Expected to sign in as %s, got %d: %+v", user.ID, w.Code, signedIn)
+	}
+	if w := call(api.UserTokenHandler, "POST", user.ID, "", `{"secret": "latu_wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong secret, got %d", w.Code)
+	}
+
+	// Only the user's own token reads or changes the profile
+	_, guest, _ := api.guests.Issue("Eve", "")
+	guestToken, _, _ := api.guests.IssueFor(guest.ID, guest.Name, guest.Color)
+	for _, token := range []string{"", guestToken, "forged.token"} {
+		if w := call(api.GetUserHandler, "GET", user.ID, token, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 with token %q, got %d", token, w.Code)
+		}
+	}
+	w = call(api.GetUserHandler, "GET", user.ID, signedIn.Token, "")
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"theme":"dark"`)) {
+		t.Errorf("Expected the profile with preferences, got %d: %s", w.Code, w.Body)
+	}
+
+	w = call(api.UpdateUserHandler, "PATCH", user.ID, created.Token, `{"color": "#123456"}`)
+	var updated UserResponse
+	json.NewDecoder(w.Body).Decode(&updated)
+	if w.Code != http.StatusOK || updated.User.Name != "Ada" || updated.User.Color != "#123456" || updated.Identity.Color != "#123456" {
+		t.Errorf("Expected only the color changed, got %d: %+v", w.Code, updated.User)
+	}
+	if string(updated.User.Preferences) != `{"theme":"dark"}` {
+		t.Errorf("Expected preferences kept, got %s", updated.User.Preferences)
+	}
+
+	for _, body := range []string{`{"name": " "}`, `{"color": "blue"}`, `{"preferences": [1]}`} {
+		if w := call(api.UpdateUserHandler, "PATCH", user.ID, created.Token, body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for %s, got %d", body, w.Code)
+		}
+	}
+
+	if w := call(api.DeleteUserHandler, "DELETE", user.ID, created.Token, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 deleting, got %d: %s", w.Code, w.Body)
+	}
+	if w := call(api.GetUserHandler, "GET", user.ID, created.Token, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after deleting, got %d", w.Code)
+	}
+}
+
+func TestUserRooms(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	api.SetGuestIssuer(auth.NewIssuer([]byte("test-key"), time.Hour))
+	ctx := context.Background()
+
+	_, user, err := api.database.CreateUser(ctx, "Ada", "#112233", nil)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	token, _, _ := api.guests.IssueFor(user.ID, user.Name, user.Color)
+	api.database.RecordRoomVisit(ctx, user.ID, "first")
+	api.database.RecordRoomVisit(ctx, user.ID, "second")
+
+	call := func(handler http.HandlerFunc, method, roomID, token string) (*httptest.ResponseRecorder, []string) {
+		req := httptest.NewRequest(method, "/api/me", nil)
+		req.SetPathValue("id", roomID)
+		if token != "" {
+			req.Header.Set(identityTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		var response UserRoomsResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+		var ids []string
+		for _, room := range response.Rooms {
+			ids = append(ids, room.RoomID)
+		}
+		return w, ids
+	}
+
+	// Guests have no lists
+	_, guest, _ := api.guests.Issue("Grace", "")
+	guestToken, _, _ := api.guests.IssueFor(guest.ID, guest.Name, guest.Color)
+	for _, token := range []string{"", guestToken} {
+		if w, _ := call(api.RecentRoomsHandler, "GET", "", token); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 with token %q, got %d", token, w.Code)
+		}
+	}
+
+	if w, ids := call(api.RecentRoomsHandler, "GET", "", token); w.Code != http.StatusOK || strings.Join(ids, ",") != "second,first" {
+		t.Errorf("Expected recent rooms second,first, got %d: %v", w.Code, ids)
+	}
+	if w, _ := call(api.ForgetRecentRoomHandler, "DELETE", "first", token); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 forgetting a room, got %d", w.Code)
+	}
+	if w, _ := call(api.ForgetRecentRoomHandler, "DELETE", "first", token); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 forgetting it again, got %d", w.Code)
+	}
+
+	if w, ids := call(api.StarRoomHandler, "PUT", "alpha", token); w.Code != http.StatusCreated || len(ids) != 1 {
+		t.Errorf("Expected 201 starring a room, got %d: %v", w.Code, ids)
+	}
+	if w, ids := call(api.StarRoomHandler, "PUT", "alpha", token); w.Code != http.StatusOK || len(ids) != 1 {
+		t.Errorf("Expected 200 starring it again, got %d: %v", w.Code, ids)
+	}
+	if w, _ := call(api.StarRoomHandler, "PUT", "bad room", token); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid room ID, got %d", w.Code)
+	}
+	call(api.StarRoomHandler, "PUT", "beta", token)
+	if w, ids := call(api.FavoriteRoomsHandler, "GET", "", token); w.Code != http.StatusOK || len(ids) != 2 {
+		t.Errorf("Expected 2 favorites, got %d: %v", w.Code, ids)
+	}
+	if w, ids := call(api.UnstarRoomHandler, "DELETE", "alpha", token); w.Code != http.StatusOK || strings.Join(ids, ",") != "beta" {
+		t.Errorf("Expected only beta left, got %d: %v", w.Code, ids)
+	}
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	"github.com/manpreetbhatti/lattice/backend/internal/ws"
+)
+
+// Request field limits
+const (
+	maxRoomIDLength      = ws.MaxRoomIDLength
+	maxRoomNameLength    = 200
+	maxPasswordLength    = 256
+	maxVersionNameLength = 200
+	maxDescriptionLength = 2000
+	maxCreatedByLength   = 100
+	maxInstructionLength = 2000
+	maxAICodeBytes       = 100 * 1024
+	maxAITokens          = 4096
+	maxBanDuration       = 30 * 24 * time.Hour
+	maxNoticeLength      = 500
+	maxNoticeCodeLength  = 64
+	maxPromptLength      = 8000
+	maxFrameworkLength   = 100
+	maxErrorMessageBytes = 16 * 1024
+	maxRunCodeBytes      = 256 * 1024
+	maxRunStdinBytes     = 64 * 1024
+)
+
+// Room IDs end up in URLs and share links
+var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Languages the editor offers; requests may also omit the language
+var aiLanguages = []string{
+	"javascript", "typescript", "jsx", "tsx", "python", "go", "rust", "cpp",
+	"c", "java", "json", "html", "css", "markdown", "sql", "plaintext",
+}
+
+var aiProviders = []string{"openai", "anthropic", "ollama"}
+
+var workspaceRoles = []string{db.WorkspaceRoleOwner, db.WorkspaceRoleMember}
+
+var banScopes = []string{string(ws.BanByIP), string(ws.BanByUser)}
+
+// Control frame types an administrator may send
+var noticeTypes = []string{ws.ControlNotice, ws.ControlLock}
+
+// FieldError describes why one request field was rejected. A 422 response
+// lists them in details.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Collects field errors so a response reports all of them at once
+type validator struct {
+	errors []FieldError
+}
+
+func (v *validator) add(field, format string, args ...interface{}) {
+	v.errors = append(v.errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) check(ok bool, field, format string, args ...interface{}) {
+	if !ok {
+		v.add(field, format, args...)
+	}
+}
+
+func (v *validator) required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, "is required")
+		return false
+	}
+	return true
+}
+
+// Limits length in characters, which is what users see
+func (v *validator) maxLength(field, value string, max int) {
+	v.check(utf8.RuneCountInString(value) <= max, field, "must be at most %d characters", max)
+}
+
+func (v *validator) maxBytes(field, value string, max int) {
+	v.check(len(value) <= max, field, "must be at most %d bytes", max)
+}
+
+// Accepts an empty value; pair with required when the field is mandatory
+func (v *validator) oneOf(field, value string, allowed []string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.add(field, "must be one of: %s", strings.Join(allowed, ", "))
+}
+
+func (v *validator) roomID(field, value string) {
+	if !v.required(field, value) {
+		return
+	}
+	v.maxLength(field, value, maxRoomIDLength)
+	v.check(roomIDPattern.MatchString(value), field, "may only contain letters, digits, '.', '_' and '-'")
+}
+
+// Writes a 422 and returns false unless the deployment's room ID rules
+// accept id. Only requests that create rooms check them, so rooms made
+// before the rules were narrowed stay usable.
+func (a *API) allowedRoomID(w http.ResponseWriter, field, id string) bool {
+	err := a.hub.CheckRoomID(id)
+	if err == nil {
+		return true
+	}
+
+	message := err.Error()
+	var idErr *ws.RoomIDError
+	if errors.As(err, &idErr) {
+		message = idErr.Reason
+	}
+	apierror.Write(w, http.StatusUnprocessableEntity, apierror.ValidationFailed, "Validation failed",
+		[]FieldError{{Field: field, Message: message}})
+	return false
+}
+
+// Request bodies that can check their own fields
+type validatable interface {
+	validate(v *validator)
+}
+
+// Decodes a JSON body into req and validates it. Writes a 400 for malformed
+// JSON, a 413 for a body over the route's limit or a 422 listing invalid
+// fields, and returns false in each case.
+func decodeRequest(w http.ResponseWriter, r *http.Request, req validatable) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		bodyError(w, err)
+		return false
+	}
+	return validRequest(w, req)
+}
+
+// Writes a 422 listing invalid fields and returns false unless req is valid
+func validRequest(w http.ResponseWriter, req validatable) bool {
+	var v validator
+	req.validate(&v)
+	if len(v.errors) > 0 {
+		apierror.Write(w, http.StatusUnprocessableEntity, apierror.ValidationFailed, "Validation failed", v.errors)
+		return false
+	}
+	return true
+}
+
+func (req *CreateRoomRequest) validate(v *validator) {
+	v.roomID("id", req.ID)
+	v.maxLength("name", req.Name, maxRoomNameLength)
+	v.oneOf("language", req.Language, aiLanguages)
+	v.maxLength("password", req.Password, maxPasswordLength)
+	v.check(req.Password == "" || !req.JoinCode, "join_code", "cannot be combined with password")
+}
+
+func (req *SetRoomLanguageRequest) validate(v *validator) {
+	v.oneOf("language", req.Language, aiLanguages)
+}
+
+func (req *BranchVersionRequest) validate(v *validator) {
+	if req.RoomID != "" {
+		v.roomID("room_id", req.RoomID)
+	}
+	v.maxLength("name", req.Name, maxRoomNameLength)
+}
+
+func (req *MergeVersionsRequest) validate(v *validator) {
+	v.check(req.Base > 0, "base", "must be a version ID")
+	v.check(req.Ours > 0, "ours", "must be a version ID")
+	v.check(req.Theirs > 0, "theirs", "must be a version ID")
+}
+
+// The content cap is configurable and enforced by the handler with a 413
+func (req *CreateVersionRequest) validate(v *validator) {
+	v.roomID("room_id", req.RoomID)
+	v.maxLength("name", req.Name, maxVersionNameLength)
+	v.maxLength("description", req.Description, maxDescriptionLength)
+	v.maxLength("created_by", req.CreatedBy, maxCreatedByLength)
+	v.required("content", req.Content)
+}
+
+func (req *AICompleteRequest) validate(v *validator) {
+	if v.required("code", req.Code) {
+		v.maxBytes("code", req.Code, maxAICodeBytes)
+	}
+	v.check(req.CursorPos >= 0 && req.CursorPos <= len(req.Code), "cursor_pos", "must be between 0 and the length of code")
+	v.check(req.MaxTokens >= 0 && req.MaxTokens <= maxAITokens, "max_tokens", "must be between 0 and %d", maxAITokens)
+	v.maxLength("prompt", req.Prompt, maxInstructionLength)
+	v.oneOf("language", req.Language, aiLanguages)
+	v.oneOf("provider", req.Provider, aiProviders)
+	if req.RoomID != "" {
+		v.roomID("room_id", req.RoomID)
+	}
+}
+
+func (req *AIExplainRequest) validate(v *validator) {
+	if v.required("code", req.Code) {
+		v.maxBytes("code", req.Code, maxAICodeBytes)
+	}
+	v.oneOf("language", req.Language, aiLanguages)
+}
+
+func (req *AIRefactorRequest) validate(v *validator) {
+	if v.required("code", req.Code) {
+		v.maxBytes("code", req.Code, maxAICodeBytes)
+	}
+	v.maxLength("instruction", req.Instruction, maxInstructionLength)
+	v.oneOf("language", req.Language, aiLanguages)
+}
+
+func (req *AITestsRequest) validate(v *validator) {
+	if v.required("code", req.Code) {
+		v.maxBytes("code", req.Code, maxAICodeBytes)
+	}
+	v.maxLength("framework", req.Framework, maxFrameworkLength)
+	v.oneOf("language", req.Language, aiLanguages)
+	v.oneOf("provider", req.Provider, aiProviders)
+}
+
+func (req *AIFixRequest) validate(v *validator) {
+	if v.required("code", req.Code) {
+		v.maxBytes("code", req.Code, maxAICodeBytes)
+	}
+	if v.required("error", req.Error) {
+		v.maxBytes("error", req.Error, maxErrorMessageBytes)
+	}
+	v.check(req.Line >= 0, "line", "must not be negative")
+	v.oneOf("language", req.Language, aiLanguages)
+	v.oneOf("provider", req.Provider, aiProviders)
+}
+
+func (req *AIReviewRequest) validate(v *validator) {
+	if req.RoomID != "" {
+		v.roomID("room_id", req.RoomID)
+		v.check(req.From == 0 && req.To == 0, "room_id", "cannot be combined with from and to")
+		v.maxBytes("content", req.Content, maxAICodeBytes)
+	} else {
+		v.check(req.From > 0, "from", "must be a version ID, or give room_id and content")
+		v.check(req.To > 0, "to", "must be a version ID, or give room_id and content")
+		v.check(req.Content == "", "content", "is only used with room_id")
+	}
+	v.oneOf("language", req.Language, aiLanguages)
+	v.oneOf("provider", req.Provider, aiProviders)
+}
+
+func (req *RunRequest) validate(v *validator) {
+	v.required("language", req.Language)
+	v.maxBytes("code", req.Code, maxRunCodeBytes)
+	v.maxBytes("stdin", req.Stdin, maxRunStdinBytes)
+}
+
+func (req *CreateUserRequest) validate(v *validator) {
+	if v.required("name", strings.TrimSpace(req.Name)) {
+		v.maxLength("name", req.Name, maxGuestNameLength)
+	}
+	v.check(req.Color == "" || auth.IsValidColor(req.Color), "color", "must be a #rrggbb hex color")
+	validatePreferences(v, req.Preferences)
+}
+
+func (req *UpdateUserRequest) validate(v *validator) {
+	if req.Name != nil && v.required("name", strings.TrimSpace(*req.Name)) {
+		v.maxLength("name", *req.Name, maxGuestNameLength)
+	}
+	v.check(req.Color == nil || auth.IsValidColor(*req.Color), "color", "must be a #rrggbb hex color")
+	validatePreferences(v, req.Preferences)
+}
+
+func validatePreferences(v *validator, preferences json.RawMessage) {
+	v.check(isJSONObject(preferences), "preferences", "must be a JSON object")
+	v.check(len(preferences) <= maxPreferencesBytes, "preferences", "must be at most %d bytes", maxPreferencesBytes)
+}
+
+func (req *UserTokenRequest) validate(v *validator) {
+	v.required("secret", req.Secret)
+}
+
+func (req *CreateWorkspaceRequest) validate(v *validator) {
+	v.roomID("id", req.ID)
+	if v.required("name", strings.TrimSpace(req.Name)) {
+		v.maxLength("name", req.Name, maxRoomNameLength)
+	}
+}
+
+func (req *SetMemberRequest) validate(v *validator) {
+	v.oneOf("role", req.Role, workspaceRoles)
+}
+
+func (req *WorkspaceQuotaRequest) validate(v *validator) {
+	v.check(req.MaxRooms >= 0, "max_rooms", "must not be negative")
+	v.check(req.MaxRoomBytes >= 0, "max_room_bytes", "must not be negative")
+}
+
+func (req *SummarizeVersionRequest) validate(v *validator) {
+	v.oneOf("provider", req.Provider, aiProviders)
+}
+
+func (req *SetPromptRequest) validate(v *validator) {
+	if !v.required("template", req.Template) {
+		return
+	}
+	v.maxLength("template", req.Template, maxPromptLength)
+	for _, match := range promptVariablePattern.FindAllStringSubmatch(req.Template, -1) {
+		v.check(slices.Contains(promptVariables, match[1]), "template",
+			"uses unknown variable {{%s}}; available: %s", match[1], strings.Join(promptVariables, ", "))
+	}
+}
+
+func (req *KickRequest) validate(v *validator) {
+	v.required("client_id", req.ClientID)
+	if req.BanDuration != "" {
+		d, err := time.ParseDuration(req.BanDuration)
+		v.check(err == nil && d > 0 && d <= maxBanDuration, "ban_duration", "must be a positive duration of at most %s", maxBanDuration)
+	}
+	v.oneOf("ban_by", req.BanBy, banScopes)
+	v.check(req.BanBy == "" || req.BanDuration != "", "ban_by", "requires ban_duration")
+}
+
+func (req *NoticeRequest) validate(v *validator) {
+	if v.required("message", req.Message) {
+		v.maxLength("message", req.Message, maxNoticeLength)
+	}
+	v.oneOf("type", req.Type, noticeTypes)
+	v.maxLength("code", req.Code, maxNoticeCodeLength)
+}
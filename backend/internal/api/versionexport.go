@@ -0,0 +1,154 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// Lists the versions in a version export, in the order of their files
+const versionExportManifest = "versions.json"
+
+// Version files are named by when they were saved, in a form every file
+// system accepts, with the version ID to keep same-second saves apart
+const versionFileTime = "2006-01-02T15-04-05Z"
+
+// An entry of versionExportManifest
+type exportedVersionFile struct {
+	File string `json:"file"`
+	VersionResponse
+}
+
+// ExportVersionsHandler downloads a room's versions as a zip of one file
+// per version, oldest first, named by the time it was saved and typed after
+// the room's language, plus a manifest of their details. ?from= and ?to=
+// (RFC3339) bound the save times, ?auto=false leaves out auto-saves and
+// ?pinned=true keeps only pinned versions. Content is read one version at a
+// time, so long histories don't have to fit in memory.
+func (a *API) ExportVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+	query := r.URL.Query()
+
+	var from, to time.Time
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "from must be an RFC3339 timestamp")
+			return
+		}
+		from = t
+	}
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "to must be an RFC3339 timestamp")
+			return
+		}
+		to = t
+	}
+	includeAuto, onlyPinned := true, false
+	if v := query.Get("auto"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "auto must be true or false")
+			return
+		}
+		includeAuto = b
+	}
+	if v := query.Get("pinned"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "pinned must be true or false")
+			return
+		}
+		onlyPinned = b
+	}
+
+	room, err := a.database.GetRoom(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get room")
+		return
+	}
+	if room == nil {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found")
+		return
+	}
+	if !a.authorizeRoom(w, r, roomID) {
+		return
+	}
+
+	history, err := a.database.ListVersionHistory(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list versions")
+		return
+	}
+	var selected []db.Version
+	for _, v := range history {
+		switch {
+		case !from.IsZero() && v.CreatedAt.Before(from),
+			!to.IsZero() && v.CreatedAt.After(to),
+			v.IsAuto && !includeAuto,
+			!v.Pinned && onlyPinned:
+			continue
+		}
+		selected = append(selected, v)
+	}
+
+	extension := fileForLanguage(room.Language).Extension
+	filename := fmt.Sprintf("room-%s-versions.zip", roomID)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(filename))
+	w.WriteHeader(http.StatusOK)
+
+	// Past this point errors can only cut the download short, which leaves
+	// a zip without its central directory that unzip rejects
+	zw := zip.NewWriter(w)
+	manifest := make([]exportedVersionFile, 0, len(selected))
+	for _, listed := range selected {
+		version, err := a.database.GetVersion(r.Context(), listed.ID)
+		if err != nil {
+			log.Printf("Error exporting version %d of room %s: %v", listed.ID, roomID, err)
+			return
+		}
+		if version == nil {
+			// Deleted since it was listed
+			continue
+		}
+
+		name := fmt.Sprintf("%s_v%d%s", version.CreatedAt.UTC().Format(versionFileTime), version.ID, extension)
+		file, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: version.CreatedAt,
+		})
+		if err == nil {
+			_, err = file.Write([]byte(version.Content))
+		}
+		if err != nil {
+			log.Printf("Error exporting versions of room %s: %v", roomID, err)
+			return
+		}
+		manifest = append(manifest, exportedVersionFile{File: name, VersionResponse: newVersionResponse(version)})
+	}
+
+	file, err := zw.Create(versionExportManifest)
+	if err == nil {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(manifest)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("Error exporting versions of room %s: %v", roomID, err)
+	}
+}
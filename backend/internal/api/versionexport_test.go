@@ -0,0 +1,102 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExportVersionsHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := api.database.CreateRoom(ctx, "history", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	api.database.SetRoomLanguage(ctx, "history", "go")
+	manual, _ := api.database.CreateVersion(ctx, "history", "v1", "", "package a", hashContent("package a"), "", false)
+	auto, _ := api.database.CreateVersion(ctx, "history", "Auto-save", "", "package b", hashContent("package b"), "", true)
+
+	export := func(query string) map[string]string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/rooms/history/versions/export"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/zip" {
+			t.Errorf("Expected a zip, got %q", ct)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatalf("Failed to read zip: %v", err)
+		}
+		files := make(map[string]string)
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("Failed to open %s: %v", f.Name, err)
+			}
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			files[f.Name] = string(data)
+		}
+		return files
+	}
+
+	files := export("")
+	if len(files) != 3 {
+		t.Fatalf("Expected 2 versions and a manifest, got %v", files)
+	}
+	var manifest []exportedVersionFile
+	if err := json.Unmarshal([]byte(files[versionExportManifest]), &manifest); err != nil {
+		t.Fatalf("Failed to decode manifest: %v", err)
+	}
+	if len(manifest) != 2 || manifest[0].ID != manual.ID || manifest[1].ID != auto.ID {
+		t.Fatalf("Expected both versions oldest first, got %+v", manifest)
+	}
+	for _, entry := range manifest {
+		if !strings.HasSuffix(entry.File, ".go") {
+			t.Errorf("Expected a .go file for a Go room, got %q", entry.File)
+		}
+	}
+	if files[manifest[0].File] != "package a" {
+		t.Errorf("Expected the first version's content, got %q", files[manifest[0].File])
+	}
+
+	files = export("?auto=false")
+	if len(files) != 2 || files[manifest[0].File] != "package a" {
+		t.Errorf("Expected only the manual version, got %v", files)
+	}
+
+	api.database.SetVersionPinned(ctx, auto.ID, true)
+	files = export("?pinned=true")
+	if len(files) != 2 || files[manifest[1].File] != "package b" {
+		t.Errorf("Expected only the pinned version, got %v", files)
+	}
+
+	files = export("?to=2000-01-01T00:00:00Z")
+	if len(files) != 1 {
+		t.Errorf("Expected only the manifest before any save, got %v", files)
+	}
+
+	for _, path := range []string{"/api/rooms/history/versions/export?from=yesterday", "/api/rooms/history/versions/export?auto=maybe"} {
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", path, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/rooms/ghost/versions/export", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing room, got %d", w.Code)
+	}
+}
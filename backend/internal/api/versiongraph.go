@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+// VersionEdge links a version to one it descends from
+type VersionEdge struct {
+	From int    `json:"from"` // The older version
+	To   int    `json:"to"`
+	Type string `json:"type"` // "parent" or "restore"
+}
+
+// VersionGraphResponse is a room's version history as a tree. Versions are
+// oldest first; a room's first version and any whose parent is gone are
+// listed in roots.
+type VersionGraphResponse struct {
+	RoomID   string            `json:"room_id"`
+	Versions []VersionResponse `json:"versions"`
+	Edges    []VersionEdge     `json:"edges"`
+	Roots    []int             `json:"roots"`
+}
+
+// VersionGraphHandler returns every version of a room with the links between
+// them, for rendering the history as a tree
+func (a *API) VersionGraphHandler(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("id")
+	if !a.requireRoom(r.Context(), w, roomID) || !a.authorizeRoom(w, r, roomID) {
+		return
+	}
+
+	versions, err := a.database.ListVersionHistory(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list versions")
+		return
+	}
+
+	exists := make(map[int]bool, len(versions))
+	for _, v := range versions {
+		exists[v.ID] = true
+	}
+
+	response := VersionGraphResponse{
+		RoomID:   roomID,
+		Versions: make([]VersionResponse, len(versions)),
+		Edges:    []VersionEdge{},
+		Roots:    []int{},
+	}
+	for i, v := range versions {
+		response.Versions[i] = newVersionResponse(&v)
+		if exists[v.ParentVersionID] {
+			response.Edges = append(response.Edges, VersionEdge{From: v.ParentVersionID, To: v.ID, Type: "parent"})
+		} else {
+			response.Roots = append(response.Roots, v.ID)
+		}
+		if exists[v.RestoredFromID] {
+			response.Edges = append(response.Edges, VersionEdge{From: v.RestoredFromID, To: v.ID, Type: "restore"})
+		}
+	}
+
+	jsonResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestVersionGraphHandler(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := api.database.CreateRoom(ctx, "graph-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	first, _ := api.database.CreateVersion(ctx, "graph-room", "v1", "", "a", hashContent("a"), "", false)
+	second, _ := api.database.CreateVersion(ctx, "graph-room", "v2", "", "b", hashContent("b"), "", false)
+
+	req := httptest.NewRequest("POST", "/api/versions/"+strconv.Itoa(first.ID)+"/restore", nil)
+	w := httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 restoring, got %d: %s", w.Code, w.Body.String())
+	}
+	var restore restoreResponse
+	if err := json.NewDecoder(w.Body).Decode(&restore); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	req = httptest.NewRequest("GET", "/api/rooms/graph-room/versions/graph", nil)
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var graph VersionGraphResponse
+	if err := json.NewDecoder(w.Body).Decode(&graph); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(graph.Versions) != 3 || graph.Versions[2].ID != restore.NewVersion {
+		t.Fatalf("Expected 3 versions ending with the restore, got %+v", graph.Versions)
+	}
+	if got := graph.Versions[2]; got.ParentVersionID != second.ID || got.RestoredFromID != first.ID {
+		t.Errorf("Expected the restore to link to %d and %d, got %+v", second.ID, first.ID, got)
+	}
+	if len(graph.Roots) != 1 || graph.Roots[0] != first.ID {
+		t.Errorf("Expected version %d as the only root, got %v", first.ID, graph.Roots)
+	}
+
+	want := []VersionEdge{
+		{From: first.ID, To: second.ID, Type: "parent"},
+		{From: second.ID, To: restore.NewVersion, Type: "parent"},
+		{From: first.ID, To: restore.NewVersion, Type: "restore"},
+	}
+	if len(graph.Edges) != len(want) {
+		t.Fatalf("Expected edges %+v, got %+v", want, graph.Edges)
+	}
+	for i := range want {
+		if graph.Edges[i] != want[i] {
+			t.Errorf("Expected edge %+v, got %+v", want[i], graph.Edges[i])
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/api/rooms/missing/versions/graph", nil)
+	w = httptest.NewRecorder()
+	api.Routes().ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing room, got %d", w.Code)
+	}
+}
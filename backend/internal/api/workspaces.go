@@ -0,0 +1,414 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+type CreateWorkspaceRequest struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// SetMemberRequest adds a profile to a workspace or changes its role
+type SetMemberRequest struct {
+	Role string `json:"role,omitempty"` // owner or member (the default)
+}
+
+// WorkspaceQuotaRequest replaces a workspace's limits; zero means unlimited
+type WorkspaceQuotaRequest struct {
+	MaxRooms     int   `json:"max_rooms"`
+	MaxRoomBytes int64 `json:"max_room_bytes"` // Replaces the server's per-room quota for the workspace's rooms
+}
+
+// WorkspaceResponse is a workspace with the caller's role, its members and
+// what its rooms use
+type WorkspaceResponse struct {
+	db.Workspace
+	Role    string               `json:"role,omitempty"`
+	Usage   *WorkspaceUsage      `json:"usage,omitempty"`
+	Members []db.WorkspaceMember `json:"members,omitempty"`
+}
+
+// WorkspaceUsage adds live connections to a workspace's stored usage
+type WorkspaceUsage struct {
+	db.WorkspaceUsage
+	ActiveRooms int `json:"active_rooms"`
+	ActiveUsers int `json:"active_users"`
+}
+
+type workspacesResponse struct {
+	Workspaces []db.UserWorkspace `json:"workspaces"`
+}
+
+type workspaceMembersResponse struct {
+	Members []db.WorkspaceMember `json:"members"`
+}
+
+// CreateWorkspaceHandler creates a workspace owned by the caller's profile
+func (a *API) CreateWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.tokenUser(w, r, "")
+	if !ok {
+		return
+	}
+
+	var req CreateWorkspaceRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	workspace, err := a.database.CreateWorkspace(r.Context(), req.ID, strings.TrimSpace(req.Name), user.ID)
+	if errors.Is(err, db.ErrWorkspaceExists) {
+		errorResponse(w, http.StatusConflict, apierror.WorkspaceExists, "Workspace already exists")
+		return
+	}
+	if err != nil {
+		databaseError(w, err, "Failed to create workspace")
+		return
+	}
+	jsonResponse(w, http.StatusCreated, WorkspaceResponse{Workspace: *workspace, Role: db.WorkspaceRoleOwner})
+}
+
+// ListWorkspacesHandler lists the workspaces the caller belongs to
+func (a *API) ListWorkspacesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.tokenUser(w, r, "")
+	if !ok {
+		return
+	}
+
+	workspaces, err := a.database.ListUserWorkspaces(r.Context(), user.ID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list workspaces")
+		return
+	}
+	jsonResponse(w, http.StatusOK, workspacesResponse{Workspaces: workspaces})
+}
+
+// GetWorkspaceHandler returns a workspace with its members and usage
+func (a *API) GetWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+	_, workspace, role, ok := a.authorizeWorkspace(w, r, false)
+	if !ok {
+		return
+	}
+
+	stored, err := a.database.GetWorkspaceUsage(r.Context(), workspace.ID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get workspace usage")
+		return
+	}
+	roomIDs, err := a.database.WorkspaceRoomIDs(r.Context(), workspace.ID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list workspace rooms")
+		return
+	}
+	members, err := a.database.ListWorkspaceMembers(r.Context(), workspace.ID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list members")
+		return
+	}
+
+	usage := &WorkspaceUsage{WorkspaceUsage: *stored}
+	activeRooms := a.hub.GetActiveRooms()
+	for _, roomID := range roomIDs {
+		if users := activeRooms[roomID]; users > 0 {
+			usage.ActiveRooms++
+			usage.ActiveUsers += users
+		}
+	}
+
+	jsonResponse(w, http.StatusOK, WorkspaceResponse{
+		Workspace: *workspace,
+		Role:      role,
+		Usage:     usage,
+		Members:   members,
+	})
+}
+
+// DeleteWorkspaceHandler deletes an empty workspace. Only owners may.
+func (a *API) DeleteWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+	_, workspace, _, ok := a.authorizeWorkspace(w, r, true)
+	if !ok {
+		return
+	}
+
+	if _, err := a.database.DeleteWorkspace(r.Context(), workspace.ID); err != nil {
+		if errors.Is(err, db.ErrWorkspaceNotEmpty) {
+			errorResponse(w, http.StatusConflict, apierror.WorkspaceNotEmpty, "Delete or remove the workspace's rooms first")
+			return
+		}
+		databaseError(w, err, "Failed to delete workspace")
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]string{"message": "Workspace deleted"})
+}
+
+// SetMemberHandler adds a profile to the workspace or changes its role.
+// Only owners may.
+func (a *API) SetMemberHandler(w http.ResponseWriter, r *http.Request) {
+	_, workspace, _, ok := a.authorizeWorkspace(w, r, true)
+	if !ok {
+		return
+	}
+
+	var req SetMemberRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	role := req.Role
+	if role == "" {
+		role = db.WorkspaceRoleMember
+	}
+
+	userID := r.PathValue("user")
+	member, err := a.database.GetUser(r.Context(), userID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get user")
+		return
+	}
+	if member == nil {
+		errorResponse(w, http.StatusNotFound, apierror.UserNotFound, "User not found")
+		return
+	}
+
+	if err := a.database.SetWorkspaceMember(r.Context(), workspace.ID, userID, role); err != nil {
+		a.memberError(w, err)
+		return
+	}
+	a.workspaceMembers(w, r, workspace.ID)
+}
+
+// RemoveMemberHandler takes a profile out of the workspace. Owners may
+// remove anyone; members may only leave.
+func (a *API) RemoveMemberHandler(w http.ResponseWriter, r *http.Request) {
+	user, workspace, role, ok := a.authorizeWorkspace(w, r, false)
+	if !ok {
+		return
+	}
+
+	userID := r.PathValue("user")
+	if userID != user.ID && role != db.WorkspaceRoleOwner {
+		errorResponse(w, http.StatusForbidden, apierror.WorkspaceForbidden, "Only owners can remove other members")
+		return
+	}
+
+	removed, err := a.database.RemoveWorkspaceMember(r.Context(), workspace.ID, userID)
+	if err != nil {
+		a.memberError(w, err)
+		return
+	}
+	if !removed {
+		errorResponse(w, http.StatusNotFound, apierror.UserNotFound, "User is not a member")
+		return
+	}
+	a.workspaceMembers(w, r, workspace.ID)
+}
+
+// AddWorkspaceRoomHandler moves a room into the workspace, or creates it
+// there. Only owners may, and a protected room needs its join secret.
+// Rooms with content, versions or connected sessions belong to whoever is
+// using them, so only a request with an admin API key may move those.
+// Sessions already connected stay until they reconnect.
+func (a *API) AddWorkspaceRoomHandler(w http.ResponseWriter, r *http.Request) {
+	_, workspace, _, ok := a.authorizeWorkspace(w, r, true)
+	if !ok {
+		return
+	}
+
+	roomID := r.PathValue("room")
+	if !validRoomIDParam(w, roomID) || !a.allowedRoomID(w, "room", roomID) || !a.authorizeRoom(w, r, roomID) {
+		return
+	}
+
+	admin, err := a.hasAPIKey(r)
+	if err != nil {
+		log.Printf("Failed to check API key: %v", err)
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to check API key")
+		return
+	}
+	if admin {
+		err = a.database.AddRoomToWorkspace(r.Context(), workspace.ID, roomID, "")
+	} else if a.hub.GetActiveRooms()[roomID] > 0 {
+		err = db.ErrRoomInUse
+	} else {
+		err = a.database.ClaimRoomForWorkspace(r.Context(), workspace.ID, roomID)
+	}
+	if err != nil {
+		a.workspaceRoomError(w, err)
+		return
+	}
+	a.hub.SetRoomQuota(roomID, workspace.MaxRoomBytes)
+	jsonResponse(w, http.StatusOK, map[string]string{"message": "Room added to workspace"})
+}
+
+// RemoveWorkspaceRoomHandler opens a workspace room to everyone again. Only
+// owners may.
+func (a *API) RemoveWorkspaceRoomHandler(w http.ResponseWriter, r *http.Request) {
+	_, workspace, _, ok := a.authorizeWorkspace(w, r, true)
+	if !ok {
+		return
+	}
+
+	roomID := r.PathValue("room")
+	removed, err := a.database.RemoveRoomFromWorkspace(r.Context(), workspace.ID, roomID)
+	if err != nil {
+		databaseError(w, err, "Failed to remove room")
+		return
+	}
+	if !removed {
+		errorResponse(w, http.StatusNotFound, apierror.RoomNotFound, "Room not in workspace")
+		return
+	}
+	a.hub.SetRoomQuota(roomID, 0)
+	jsonResponse(w, http.StatusOK, map[string]string{"message": "Room removed from workspace"})
+}
+
+// WorkspaceQuotaHandler replaces a workspace's limits. Limits are the server
+// operator's, so this is an admin endpoint rather than an owner's.
+func (a *API) WorkspaceQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	var req WorkspaceQuotaRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	workspace, err := a.database.SetWorkspaceQuota(r.Context(), r.PathValue("id"), req.MaxRooms, req.MaxRoomBytes)
+	if err != nil {
+		databaseError(w, err, "Failed to set quota")
+		return
+	}
+	if workspace == nil {
+		errorResponse(w, http.StatusNotFound, apierror.WorkspaceNotFound, "Workspace not found")
+		return
+	}
+
+	// Loaded rooms pick up the new quota now; the rest load it with the room
+	roomIDs, err := a.database.WorkspaceRoomIDs(r.Context(), workspace.ID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list workspace rooms")
+		return
+	}
+	for _, roomID := range roomIDs {
+		a.hub.SetRoomQuota(roomID, workspace.MaxRoomBytes)
+	}
+	jsonResponse(w, http.StatusOK, WorkspaceResponse{Workspace: *workspace})
+}
+
+// Returns the caller's profile with the workspace in the path and the
+// caller's role in it, writing an error and returning false unless the
+// caller is a member (an owner when owner is set)
+func (a *API) authorizeWorkspace(w http.ResponseWriter, r *http.Request, owner bool) (*db.User, *db.Workspace, string, bool) {
+	user, ok := a.tokenUser(w, r, "")
+	if !ok {
+		return nil, nil, "", false
+	}
+
+	workspace, err := a.database.GetWorkspace(r.Context(), r.PathValue("id"))
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get workspace")
+		return nil, nil, "", false
+	}
+	if workspace == nil {
+		errorResponse(w, http.StatusNotFound, apierror.WorkspaceNotFound, "Workspace not found")
+		return nil, nil, "", false
+	}
+
+	role, err := a.database.WorkspaceRole(r.Context(), workspace.ID, user.ID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to check membership")
+		return nil, nil, "", false
+	}
+	if role == "" || (owner && role != db.WorkspaceRoleOwner) {
+		message := "Not a member of this workspace"
+		if role != "" {
+			message = "Only workspace owners can do this"
+		}
+		errorResponse(w, http.StatusForbidden, apierror.WorkspaceForbidden, message)
+		return nil, nil, "", false
+	}
+	return user, workspace, role, true
+}
+
+// Writes an error and returns false unless the room is outside any
+// workspace or the request carries a member's identity token
+func (a *API) authorizeRoomWorkspace(w http.ResponseWriter, r *http.Request, roomID string) bool {
+	workspace, err := a.database.RoomWorkspace(r.Context(), roomID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to get workspace")
+		return false
+	}
+	if workspace == nil {
+		return true
+	}
+	return a.isWorkspaceMember(w, r, workspace.ID)
+}
+
+// authorizeRoom for the room a version belongs to
+func (a *API) authorizeVersion(w http.ResponseWriter, r *http.Request, version *db.Version) bool {
+	return a.authorizeRoom(w, r, version.RoomID)
+}
+
+// Writes an error and returns false unless the request carries the identity
+// token of a member of the workspace
+func (a *API) isWorkspaceMember(w http.ResponseWriter, r *http.Request, workspaceID string) bool {
+	role := ""
+	if a.guests != nil {
+		identity, err := a.guests.Verify(r.Header.Get(identityTokenHeader))
+		if err == nil {
+			role, err = a.database.WorkspaceRole(r.Context(), workspaceID, identity.ID)
+			if err != nil {
+				errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to check membership")
+				return false
+			}
+		}
+	}
+	if role == "" {
+		errorResponse(w, http.StatusForbidden, apierror.RoomAccessDenied, "Workspace membership required; send a member's identity token in "+identityTokenHeader)
+		return false
+	}
+	return true
+}
+
+func (a *API) workspaceMembers(w http.ResponseWriter, r *http.Request, workspaceID string) {
+	members, err := a.database.ListWorkspaceMembers(r.Context(), workspaceID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, apierror.Internal, "Failed to list members")
+		return
+	}
+	jsonResponse(w, http.StatusOK, workspaceMembersResponse{Members: members})
+}
+
+func (a *API) memberError(w http.ResponseWriter, err error) {
+	if errors.Is(err, db.ErrLastOwner) {
+		errorResponse(w, http.StatusConflict, apierror.WorkspaceOwnerNeeded, "The workspace would be left without an owner")
+		return
+	}
+	databaseError(w, err, "Failed to update members")
+}
+
+func (a *API) workspaceRoomError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrWorkspaceFull):
+		errorResponse(w, http.StatusConflict, apierror.WorkspaceFull, "The workspace has reached its room limit")
+	case errors.Is(err, db.ErrRoomInOtherWorkspace):
+		errorResponse(w, http.StatusConflict, apierror.RoomExists, "Room belongs to another workspace")
+	case errors.Is(err, db.ErrRoomInUse):
+		errorResponse(w, http.StatusForbidden, apierror.WorkspaceForbidden, "Room is already in use; only an admin can move it into a workspace")
+	default:
+		databaseError(w, err, "Failed to add room to workspace")
+	}
+}
+
+// Writes a 400 and returns false unless id is a valid room ID
+func validRoomIDParam(w http.ResponseWriter, id string) bool {
+	v := &validator{}
+	v.roomID("id", id)
+	if len(v.errors) > 0 {
+		errorResponse(w, http.StatusBadRequest, apierror.InvalidParameter, "Invalid room ID: "+v.errors[0].Message)
+		return false
+	}
+	return true
+}
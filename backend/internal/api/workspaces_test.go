@@ -0,0 +1,252 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
+)
+
+func TestWorkspaces(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	api.SetGuestIssuer(auth.NewIssuer([]byte("test-key"), time.Hour))
+	routes := api.Routes()
+	ctx := context.Background()
+
+	tokens := map[string]string{}
+	ids := map[string]string{}
+	for _, name := range []string{"owner", "member", "outsider"} {
+		_, user, err := api.database.CreateUser(ctx, name, "#112233", nil)
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		ids[name] = user.ID
+		tokens[name], _, _ = api.guests.IssueFor(user.ID, user.Name, user.Color)
+	}
+
+	call := func(method, path, as, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if as != "" {
+			req.Header.Set(identityTokenHeader, tokens[as])
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code apierror.Code) {
+		t.Helper()
+		if w.Code != status {
+			t.Fatalf("Expected %d, got %d: %s", status, w.Code, w.Body)
+		}
+		if code != "" && !strings.Contains(w.Body.String(), string(code)) {
+			t.Errorf("Expected code %s, got %s", code, w.Body)
+		}
+	}
+
+	expect(call("POST", "/api/workspaces", "owner", `{"id": "team", "name": "Team"}`), http.StatusCreated, "")
+	expect(call("POST", "/api/workspaces", "outsider", `{"id": "team", "name": "Again"}`), http.StatusConflict, apierror.WorkspaceExists)
+	expect(call("PUT", "/api/workspaces/team/members/"+ids["member"], "member", `{}`), http.StatusForbidden, apierror.WorkspaceForbidden)
+	expect(call("PUT", "/api/workspaces/team/members/"+ids["member"], "owner", `{}`), http.StatusOK, "")
+	expect(call("PUT", "/api/workspaces/team/members/"+ids["owner"], "owner", `{"role": "member"}`), http.StatusConflict, apierror.WorkspaceOwnerNeeded)
+
+	// Members create rooms in the workspace; outsiders can't see or join them
+	expect(call("POST", "/api/rooms", "member", `{"id": "plans", "workspace": "team"}`), http.StatusCreated, "")
+	expect(call("POST", "/api/rooms", "outsider", `{"id": "sneaky", "workspace": "team"}`), http.StatusForbidden, apierror.RoomAccessDenied)
+	expect(call("POST", "/api/rooms", "", `{"id": "public"}`), http.StatusCreated, "")
+	expect(call("GET", "/api/rooms/plans", "outsider", ""), http.StatusForbidden, apierror.RoomAccessDenied)
+	expect(call("GET", "/api/rooms/plans", "", ""), http.StatusForbidden, apierror.RoomAccessDenied)
+	expect(call("POST", "/api/rooms/plans/updates", "outsider", `{"updates": []}`), http.StatusForbidden, apierror.RoomAccessDenied)
+	expect(call("DELETE", "/api/rooms/plans", "outsider", ""), http.StatusForbidden, apierror.RoomAccessDenied)
+	expect(call("GET", "/api/rooms/plans", "member", ""), http.StatusOK, "")
+
+	// Listings are scoped to one workspace, or to rooms outside any
+	listed := func(path, as string) []string {
+		t.Helper()
+		w := call("GET", path, as, "")
+		expect(w, http.StatusOK, "")
+		var response struct {
+			Rooms []RoomResponse `json:"rooms"`
+		}
+		json.NewDecoder(w.Body).Decode(&response)
+		var names []string
+		for _, room := range response.Rooms {
+			names = append(names, room.ID)
+		}
+		return names
+	}
+	if got := listed("/api/rooms", ""); strings.Join(got, ",") != "public" {
+		t.Errorf("Expected only the public room, got %v", got)
+	}
+	if got := listed("/api/rooms?workspace=team", "member"); strings.Join(got, ",") != "plans" {
+		t.Errorf("Expected the workspace's room, got %v", got)
+	}
+	expect(call("GET", "/api/rooms?workspace=team", "outsider", ""), http.StatusForbidden, apierror.RoomAccessDenied)
+
+	// Bulk actions skip workspace rooms for non-members
+	w := call("POST", "/api/rooms/bulk", "outsider", `{"action": "delete", "room_ids": ["plans"]}`)
+	expect(w, http.StatusMultiStatus, "")
+	if !strings.Contains(w.Body.String(), `"forbidden"`) {
+		t.Errorf("Expected the room to be refused, got %s", w.Body)
+	}
+
+	// Limits are set by the server admin and apply to new rooms
+	expect(call("PUT", "/api/admin/workspaces/team/quota", "", `{"max_rooms": 1, "max_room_bytes": 4096}`), http.StatusOK, "")
+	expect(call("POST", "/api/rooms", "member", `{"id": "more", "workspace": "team"}`), http.StatusConflict, apierror.WorkspaceFull)
+	expect(call("PUT", "/api/workspaces/team/rooms/public", "owner", ""), http.StatusConflict, apierror.WorkspaceFull)
+
+	w = call("GET", "/api/workspaces/team", "member", "")
+	expect(w, http.StatusOK, "")
+	var workspace WorkspaceResponse
+	json.NewDecoder(w.Body).Decode(&workspace)
+	if workspace.Role != "member" || workspace.MaxRooms != 1 || workspace.Usage.Rooms != 1 || len(workspace.Members) != 2 {
+		t.Errorf("Unexpected workspace %+v", workspace)
+	}
+	expect(call("GET", "/api/workspaces/team", "outsider", ""), http.StatusForbidden, apierror.WorkspaceForbidden)
+
+	// Owners move rooms in and out; a workspace is only deleted empty
+	expect(call("PUT", "/api/admin/workspaces/team/quota", "", `{"max_rooms": 0, "max_room_bytes": 0}`), http.StatusOK, "")
+	expect(call("PUT", "/api/workspaces/team/rooms/public", "member", ""), http.StatusForbidden, apierror.WorkspaceForbidden)
+	expect(call("PUT", "/api/workspaces/team/rooms/public", "owner", ""), http.StatusOK, "")
+	expect(call("GET", "/api/rooms/public", "outsider", ""), http.StatusForbidden, apierror.RoomAccessDenied)
+	expect(call("DELETE", "/api/workspaces/team", "owner", ""), http.StatusConflict, apierror.WorkspaceNotEmpty)
+	expect(call("DELETE", "/api/workspaces/team/rooms/public", "owner", ""), http.StatusOK, "")
+	expect(call("GET", "/api/rooms/public", "outsider", ""), http.StatusOK, "")
+
+	// Members may leave, but not remove others
+	expect(call("DELETE", "/api/workspaces/team/members/"+ids["owner"], "member", ""), http.StatusForbidden, apierror.WorkspaceForbidden)
+	expect(call("DELETE", "/api/workspaces/team/members/"+ids["member"], "member", ""), http.StatusOK, "")
+	expect(call("GET", "/api/rooms/plans", "member", ""), http.StatusForbidden, apierror.RoomAccessDenied)
+
+	expect(call("DELETE", "/api/rooms/plans", "owner", ""), http.StatusOK, "")
+	expect(call("DELETE", "/api/workspaces/team", "owner", ""), http.StatusOK, "")
+	expect(call("GET", "/api/workspaces", "owner", ""), http.StatusOK, "")
+}
+
+func TestAddWorkspaceRoomInUse(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	api.SetGuestIssuer(auth.NewIssuer([]byte("test-key"), time.Hour))
+	ctx := context.Background()
+
+	_, owner, _ := api.database.CreateUser(ctx, "owner", "#112233", nil)
+	token, _, _ := api.guests.IssueFor(owner.ID, owner.Name, owner.Color)
+	api.database.CreateWorkspace(ctx, "team", "Team", owner.ID)
+	api.database.CreateRoom(ctx, "busy", "")
+	api.database.SaveUpdate(ctx, "busy", []byte{1, 2, 3})
+	key, _, err := api.database.CreateAPIKey(ctx, "admin")
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+
+	move := func(roomID, apiKey string) int {
+		req := httptest.NewRequest("PUT", "/api/workspaces/team/rooms/"+roomID, nil)
+		req.Header.Set(identityTokenHeader, token)
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		w := httptest.NewRecorder()
+		api.Routes().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Owners may only claim rooms nobody has used; admins may move any
+	if code := move("busy", ""); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a room with content, got %d", code)
+	}
+	if code := move("busy", "wrong"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 with an invalid key, got %d", code)
+	}
+	if code := move("unused", ""); code != http.StatusOK {
+		t.Errorf("Expected 200 for a new room, got %d", code)
+	}
+	if code := move("busy", key); code != http.StatusOK {
+		t.Errorf("Expected 200 with an admin key, got %d", code)
+	}
+	if room, _ := api.database.GetRoom(ctx, "busy"); room.Workspace != "team" {
+		t.Errorf("Expected the room in the workspace, got %+v", room)
+	}
+}
+
+func TestWorkspaceVersionRoutes(t *testing.T) {
+	api, cleanup := setupTestAPI(t)
+	defer cleanup()
+	api.SetGuestIssuer(auth.NewIssuer([]byte("test-key"), time.Hour))
+	routes := api.Routes()
+	ctx := context.Background()
+
+	tokens := map[string]string{}
+	for _, name := range []string{"member", "outsider"} {
+		_, user, err := api.database.CreateUser(ctx, name, "#112233", nil)
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		tokens[name], _, _ = api.guests.IssueFor(user.ID, user.Name, user.Color)
+	}
+	call := func(method, path, as, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if as != "" {
+			req.Header.Set(identityTokenHeader, tokens[as])
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, step := range []struct{ path, body string }{
+		{"/api/workspaces", `{"id": "team", "name": "Team"}`},
+		{"/api/rooms", `{"id": "plans", "workspace": "team"}`},
+	} {
+		if w := call("POST", step.path, "member", step.body); w.Code != http.StatusCreated {
+			t.Fatalf("POST %s: %d %s", step.path, w.Code, w.Body)
+		}
+	}
+	v1, _ := api.database.CreateVersion(ctx, "plans", "v1", "", "a", hashContent("a"), "", false)
+	v2, _ := api.database.CreateVersion(ctx, "plans", "v2", "", "b", hashContent("b"), "", false)
+	// A branch takes the workspace of the room it came from
+	if w := call("POST", fmt.Sprintf("/api/versions/%d/branch", v2.ID), "member", `{"room_id": "leak"}`); w.Code != http.StatusCreated {
+		t.Fatalf("Failed to branch: %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct{ method, path, body string }{
+		{"GET", "/api/rooms/plans/versions", ""},
+		{"GET", "/api/versions?room_id=plans", ""},
+		{"POST", "/api/rooms/plans/versions", `{"content": "c"}`},
+		{"GET", "/api/rooms/plans/versions/graph", ""},
+		{"GET", "/api/rooms/leak/merge-proposal", ""},
+		{"GET", fmt.Sprintf("/api/versions/%d", v1.ID), ""},
+		{"GET", fmt.Sprintf("/api/versions/diff?from=%d&to=%d", v1.ID, v2.ID), ""},
+		{"GET", fmt.Sprintf("/api/versions/%d/summary", v2.ID), ""},
+		{"POST", fmt.Sprintf("/api/versions/%d/summarize", v2.ID), ""},
+		{"POST", fmt.Sprintf("/api/versions/%d/restore", v1.ID), ""},
+		{"POST", fmt.Sprintf("/api/versions/%d/branch", v1.ID), `{"room_id": "stolen"}`},
+		{"POST", "/api/versions/merge", fmt.Sprintf(`{"base": %d, "ours": %d, "theirs": %d}`, v1.ID, v2.ID, v1.ID)},
+		{"POST", "/api/ai/review", fmt.Sprintf(`{"from": %d, "to": %d}`, v1.ID, v2.ID)},
+		{"POST", "/api/ai/review", `{"room_id": "plans", "content": "c"}`},
+		{"POST", fmt.Sprintf("/api/versions/%d/pin", v1.ID), ""},
+		{"DELETE", fmt.Sprintf("/api/versions/%d/pin", v1.ID), ""},
+		{"DELETE", fmt.Sprintf("/api/versions/%d", v1.ID), ""},
+	}
+	for _, tt := range tests {
+		for _, as := range []string{"outsider", ""} {
+			w := call(tt.method, tt.path, as, tt.body)
+			if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), string(apierror.RoomAccessDenied)) {
+				t.Errorf("%s %s as %q: expected 403 %s, got %d %s", tt.method, tt.path, as, apierror.RoomAccessDenied, w.Code, w.Body)
+			}
+		}
+	}
+
+	if w := call("GET", fmt.Sprintf("/api/versions/%d", v1.ID), "member", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected a member to read the version, got %d %s", w.Code, w.Body)
+	}
+	if w := call("DELETE", fmt.Sprintf("/api/versions/%d", v1.ID), "member", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected a member to delete the version, got %d %s", w.Code, w.Body)
+	}
+}
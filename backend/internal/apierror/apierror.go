@@ -0,0 +1,83 @@
+// Package apierror defines the JSON error envelope returned by every HTTP
+// endpoint and the stable codes clients can branch on.
+package apierror
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Code identifies the kind of error. Codes are part of the API contract:
+// add new ones freely but never rename or reuse them.
+type Code string
+
+const (
+	InvalidBody          Code = "INVALID_BODY"      // malformed JSON or a bad body field
+	InvalidParameter     Code = "INVALID_PARAMETER" // bad path or query parameter
+	ValidationFailed     Code = "VALIDATION_FAILED" // details lists the invalid fields
+	NotFound             Code = "NOT_FOUND"         // no such endpoint
+	RoomNotFound         Code = "ROOM_NOT_FOUND"
+	VersionNotFound      Code = "VERSION_NOT_FOUND"
+	UserNotFound         Code = "USER_NOT_FOUND"
+	WorkspaceNotFound    Code = "WORKSPACE_NOT_FOUND"
+	BranchNotFound       Code = "BRANCH_NOT_FOUND"      // the room was not branched from a version
+	HistoryCompacted     Code = "HISTORY_COMPACTED"     // the updates for that time were merged into a snapshot; details gives its time
+	SessionNotFound      Code = "SESSION_NOT_FOUND"     // unknown or closed SSE session
+	ClientNotFound       Code = "CLIENT_NOT_FOUND"      // no such client connected to the room
+	ClientNotIdentified  Code = "CLIENT_NOT_IDENTIFIED" // user ban on a client without a verified identity
+	PromptNotFound       Code = "PROMPT_NOT_FOUND"      // not one of the configurable AI prompts
+	MethodNotAllowed     Code = "METHOD_NOT_ALLOWED"    // see the Allow header
+	RoomExists           Code = "ROOM_EXISTS"
+	WorkspaceExists      Code = "WORKSPACE_EXISTS"
+	WorkspaceNotEmpty    Code = "WORKSPACE_NOT_EMPTY"    // delete or move its rooms first
+	WorkspaceOwnerNeeded Code = "WORKSPACE_OWNER_NEEDED" // the change would leave no owner
+	IdempotencyKeyReused Code = "IDEMPOTENCY_KEY_REUSED" // same key, different request
+	VersionConflict      Code = "VERSION_CONFLICT"       // If-Match named a version that is no longer the room's latest; details has the latest
+	RoomAccessDenied     Code = "ROOM_ACCESS_DENIED"     // missing or wrong join secret, or not a workspace member
+	OriginNotAllowed     Code = "ORIGIN_NOT_ALLOWED"     // the page's origin is not in LATTICE_ALLOWED_ORIGINS
+	UnsupportedProtocol  Code = "UNSUPPORTED_PROTOCOL"   // no WebSocket subprotocol offered is supported; details lists those that are
+	WorkspaceForbidden   Code = "WORKSPACE_FORBIDDEN"    // not a member, or not an owner for owner-only changes
+	Unauthorized         Code = "UNAUTHORIZED"           // missing or invalid API key
+	PayloadTooLarge      Code = "PAYLOAD_TOO_LARGE"
+	RoomQuotaExceeded    Code = "ROOM_QUOTA_EXCEEDED"
+	RoomLocked           Code = "ROOM_LOCKED" // read-only while it is moved to another server
+	FavoriteLimitReached Code = "FAVORITE_LIMIT_REACHED"
+	WorkspaceFull        Code = "WORKSPACE_FULL"      // the workspace's room limit
+	RateLimited          Code = "RATE_LIMITED"        // see the Retry-After header
+	AIUnavailable        Code = "AI_UNAVAILABLE"      // no provider configured or the provider failed
+	ServiceUnavailable   Code = "SERVICE_UNAVAILABLE" // feature disabled or server shutting down
+	Timeout              Code = "TIMEOUT"             // the handler exceeded its time limit
+	DatabaseBusy         Code = "DATABASE_BUSY"       // write contention; see the Retry-After header
+	Internal             Code = "INTERNAL_ERROR"
+)
+
+// Codes lists every code, for documentation
+func Codes() []Code {
+	return []Code{
+		InvalidBody, InvalidParameter, ValidationFailed, NotFound, RoomNotFound,
+		VersionNotFound, BranchNotFound, HistoryCompacted, SessionNotFound, ClientNotFound, ClientNotIdentified, PromptNotFound,
+		UserNotFound, WorkspaceNotFound, MethodNotAllowed, RoomExists, WorkspaceExists, WorkspaceNotEmpty, WorkspaceOwnerNeeded,
+		IdempotencyKeyReused, VersionConflict, RoomAccessDenied, OriginNotAllowed, UnsupportedProtocol, WorkspaceForbidden, Unauthorized, PayloadTooLarge, RoomQuotaExceeded, RoomLocked,
+		FavoriteLimitReached, WorkspaceFull, RateLimited,
+		AIUnavailable, ServiceUnavailable, Timeout, DatabaseBusy, Internal,
+	}
+}
+
+// Error is the body of every error response
+type Error struct {
+	Code    Code        `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Write sends an error response. Message is for humans; details carries
+// structured data for codes that document it.
+func Write(w http.ResponseWriter, status int, code Code, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(Error{Code: code, Message: message, Details: details}); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIssueAndVerify(t *testing.T) {
+	issuer := NewIssuer([]byte("test-key"), time.Hour)
+
+	token, identity, err := issuer.Issue("Ada", "#112233")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if identity.Name != "Ada" || identity.Color != "#112233" {
+		t.Errorf("Unexpected identity: %+v", identity)
+	}
+
+	verified, err := issuer.Verify(token)
+	if err != nil {
+		t.Fatalf("Failed to verify token: %v", err)
+	}
+	if verified.ID != identity.ID || verified.Name != "Ada" {
+		t.Errorf("Verified identity %+v does not match issued %+v", verified, identity)
+	}
+
+	if _, err := NewIssuer([]byte("other-key"), time.Hour).Verify(token); err != ErrInvalidToken {
+		t.Errorf("Expected ErrInvalidToken for another key, got %v", err)
+	}
+	if _, err := issuer.Verify(token + "x"); err != ErrInvalidToken {
+		t.Errorf("Expected ErrInvalidToken for tampered token, got %v", err)
+	}
+}
+
+func TestIssueDefaults(t *testing.T) {
+	issuer := NewIssuer(nil, 0)
+
+	_, identity, err := issuer.Issue("  ", "red")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if identity.Name == "" {
+		t.Error("Expected a generated name")
+	}
+	if !IsValidColor(identity.Color) {
+		t.Errorf("Expected a generated color, got %q", identity.Color)
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	issuer := NewIssuer([]byte("test-key"), time.Nanosecond)
+
+	token, _, err := issuer.Issue("Ada", "")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	time.Sleep(time.Second)
+	if _, err := issuer.Verify(token); err != ErrExpiredToken {
+		t.Errorf("Expected ErrExpiredToken, got %v", err)
+	}
+}
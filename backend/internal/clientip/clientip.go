@@ -0,0 +1,134 @@
+// Package clientip finds the address of the client behind trusted reverse
+// proxies, so limits, bans and logs see the user rather than the balancer.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Resolver trusts forwarding headers only on requests arriving from one of
+// its proxy ranges; with no ranges it always uses the TCP peer address
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// Parse reads a comma-separated list of proxy IPs and CIDR ranges, such as
+// "10.0.0.0/8, 127.0.0.1"
+func Parse(spec string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy range %q: %w", entry, err)
+			}
+			r.trusted = append(r.trusted, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy address %q: %w", entry, err)
+		}
+		addr = addr.Unmap()
+		r.trusted = append(r.trusted, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return r, nil
+}
+
+// Enabled reports whether any proxies are trusted
+func (r *Resolver) Enabled() bool {
+	return len(r.trusted) > 0
+}
+
+func (r *Resolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustsPeer reports whether a request came directly from a trusted proxy
+func (r *Resolver) TrustsPeer(req *http.Request) bool {
+	addr, err := netip.ParseAddr(hostOf(req.RemoteAddr))
+	return err == nil && r.isTrusted(addr.Unmap())
+}
+
+// ClientIP returns the originating client's IP. X-Forwarded-For is read
+// right to left, skipping trusted proxies, so a client cannot spoof its
+// address by sending the header itself; X-Real-IP is used when there is no
+// X-Forwarded-For.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	peer := hostOf(req.RemoteAddr)
+	peerAddr, err := netip.ParseAddr(peer)
+	if err != nil || !r.isTrusted(peerAddr.Unmap()) {
+		return peer
+	}
+
+	if hops := forwardedFor(req.Header); len(hops) > 0 {
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(hops[i])
+			if err != nil {
+				// Anything left of a malformed hop cannot be trusted
+				return peer
+			}
+			if !r.isTrusted(addr.Unmap()) || i == 0 {
+				return addr.Unmap().String()
+			}
+		}
+	}
+
+	if real := strings.TrimSpace(req.Header.Get("X-Real-IP")); real != "" {
+		if addr, err := netip.ParseAddr(real); err == nil {
+			return addr.Unmap().String()
+		}
+	}
+	return peer
+}
+
+// Middleware replaces each request's RemoteAddr with the resolved client
+// IP, so handlers need no knowledge of proxies
+func (r *Resolver) Middleware(next http.Handler) http.Handler {
+	if !r.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ip := r.ClientIP(req); ip != hostOf(req.RemoteAddr) {
+			req.RemoteAddr = ip
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Every hop listed across all X-Forwarded-For headers, in order
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// Host part of an address, or the address itself if it has no port
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,99 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	r, err := Parse(" 10.0.0.0/8, 127.0.0.1 ,::1,")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(r.trusted) != 3 {
+		t.Errorf("Expected 3 trusted ranges, got %d", len(r.trusted))
+	}
+
+	for _, spec := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1/abc"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+
+	empty, err := Parse("")
+	if err != nil || empty.Enabled() {
+		t.Errorf("Expected an empty spec to trust nothing, got %v", err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r, err := Parse("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"Direct client", "203.0.113.9:4000", nil, "", "203.0.113.9"},
+		{"Untrusted peer spoofing", "203.0.113.9:4000", []string{"198.51.100.1"}, "198.51.100.2", "203.0.113.9"},
+		{"Single proxy", "10.0.0.2:4000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"Client-supplied prefix ignored", "10.0.0.2:4000", []string{"1.2.3.4, 198.51.100.1"}, "", "198.51.100.1"},
+		{"Chained proxies", "10.0.0.2:4000", []string{"198.51.100.1, 10.0.0.7", "10.0.0.3"}, "", "198.51.100.1"},
+		{"All hops trusted", "10.0.0.2:4000", []string{"10.0.0.5"}, "", "10.0.0.5"},
+		{"Malformed hop", "10.0.0.2:4000", []string{"198.51.100.1, garbage"}, "", "10.0.0.2"},
+		{"Real IP fallback", "10.0.0.2:4000", nil, "198.51.100.3", "198.51.100.3"},
+		{"Invalid real IP", "10.0.0.2:4000", nil, "nope", "10.0.0.2"},
+		{"IPv4-mapped IPv6", "[::ffff:10.0.0.2]:4000", []string{"::ffff:198.51.100.1"}, "", "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			if got := r.ClientIP(req); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	r, err := Parse("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen string
+	handler := r.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = req.RemoteAddr
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:5555"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if seen != "198.51.100.1" {
+		t.Errorf("Expected RemoteAddr 198.51.100.1, got %s", seen)
+	}
+
+	// Requests without forwarding headers keep their port
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:5555"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if seen != "127.0.0.1:5555" {
+		t.Errorf("Expected RemoteAddr to be unchanged, got %s", seen)
+	}
+}
@@ -1,6 +1,9 @@
 package compaction
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -22,18 +25,73 @@ func DefaultConfig() Config {
 	}
 }
 
+// Validate rejects configurations the ticker or compaction can't run with
+func (c Config) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %v", c.Interval)
+	}
+	if c.KeepRecentUpdates < 0 {
+		return fmt.Errorf("keep-recent must not be negative, got %d", c.KeepRecentUpdates)
+	}
+	if c.UpdateThreshold <= c.KeepRecentUpdates {
+		return fmt.Errorf("threshold (%d) must exceed keep-recent (%d)", c.UpdateThreshold, c.KeepRecentUpdates)
+	}
+	return nil
+}
+
+// Rooms fetched per query during a periodic scan
+const scanPageSize = 500
+
 type Service struct {
 	database *db.Database
 	config   Config
 	stop     chan struct{}
 	wg       sync.WaitGroup
+
+	// Rooms the hub reported as crossing the threshold, deduplicated
+	requests  chan string
+	requested map[string]bool
+	reqMu     sync.Mutex
+
+	// Serializes compaction so the ticker and admin requests don't overlap
+	runMu sync.Mutex
+
+	listener Listener
+
+	statusMu      sync.RWMutex
+	lastRun       time.Time
+	lastCompacted int
+}
+
+// Result describes the outcome of compacting one room
+type Result struct {
+	RoomID        string `json:"room_id"`
+	Compacted     bool   `json:"compacted"`
+	UpdatesMerged int    `json:"updates_merged"`
+	UpdatesKept   int    `json:"updates_kept"`
+	SnapshotBytes int    `json:"snapshot_bytes"`
+}
+
+// Status reports when the last full compaction pass ran
+type Status struct {
+	LastRun       time.Time `json:"last_run"`
+	LastCompacted int       `json:"last_compacted"`
+}
+
+// Listener is told when a room's updates have been folded into its
+// snapshot, so a copy of the history held elsewhere can be swapped for it.
+// covered is how many of the room's first updates the snapshot stands for.
+type Listener interface {
+	RoomCompacted(roomID string, snapshot []byte, covered int)
 }
 
 func New(database *db.Database, config Config) *Service {
 	return &Service{
-		database: database,
-		config:   config,
-		stop:     make(chan struct{}),
+		database:  database,
+		config:    config,
+		stop:      make(chan struct{}),
+		requests:  make(chan string, 256),
+		requested: make(map[string]bool),
 	}
 }
 
@@ -56,120 +114,208 @@ func (s *Service) run() {
 	ticker := time.NewTicker(s.config.Interval)
 	defer ticker.Stop()
 
-	s.compactAllRooms()
+	ctx := context.Background()
+	s.compactAllRooms(ctx)
 
 	for {
 		select {
 		case <-s.stop:
 			return
 		case <-ticker.C:
-			s.compactAllRooms()
+			s.compactAllRooms(ctx)
+		case roomID := <-s.requests:
+			s.reqMu.Lock()
+			delete(s.requested, roomID)
+			s.reqMu.Unlock()
+
+			s.compactIfNeeded(ctx, roomID)
 		}
 	}
 }
 
-func (s *Service) compactAllRooms() {
-	rooms, err := s.database.ListRooms(1000, 0)
-	if err != nil {
-		log.Printf("Compaction: failed to list rooms: %v", err)
+// SetListener registers the listener told about each compacted room. Must be
+// called before Start.
+func (s *Service) SetListener(listener Listener) {
+	s.listener = listener
+}
+
+// Notify asks for a room to be compacted soon because it crossed the update
+// threshold. It never blocks; if the queue is full the periodic scan will
+// pick the room up instead.
+func (s *Service) Notify(roomID string) {
+	s.reqMu.Lock()
+	defer s.reqMu.Unlock()
+
+	if s.requested[roomID] {
 		return
 	}
 
+	select {
+	case s.requests <- roomID:
+		s.requested[roomID] = true
+	default:
+	}
+}
+
+// UpdateThreshold is the number of updates after which a room is compacted
+func (s *Service) UpdateThreshold() int {
+	return s.config.UpdateThreshold
+}
+
+func (s *Service) compactIfNeeded(ctx context.Context, roomID string) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	if !s.shouldCompact(ctx, roomID) {
+		return
+	}
+	if _, err := s.compactRoom(ctx, roomID, false); err != nil {
+		log.Printf("Compaction: failed for room %s: %v", roomID, err)
+	}
+}
+
+// Scans for rooms over the threshold and compacts them, stopping early if ctx
+// is cancelled
+func (s *Service) compactAllRooms(ctx context.Context) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
 	compactedCount := 0
-	for _, room := range rooms {
-		if s.shouldCompact(room.ID) {
-			if err := s.compactRoom(room.ID); err != nil {
-				log.Printf("Compaction: failed for room %s: %v", room.ID, err)
-			} else {
+	afterID := ""
+	for {
+		roomIDs, err := s.database.ListRoomsOverUpdateThreshold(ctx, s.config.UpdateThreshold, afterID, scanPageSize)
+		if err != nil {
+			log.Printf("Compaction: failed to list rooms: %v", err)
+			break
+		}
+
+		for _, roomID := range roomIDs {
+			if ctx.Err() != nil {
+				break
+			}
+			if result, err := s.compactRoom(ctx, roomID, false); err != nil {
+				log.Printf("Compaction: failed for room %s: %v", roomID, err)
+			} else if result.Compacted {
 				compactedCount++
 			}
 		}
+
+		if len(roomIDs) < scanPageSize || ctx.Err() != nil {
+			break
+		}
+		afterID = roomIDs[len(roomIDs)-1]
 	}
 
+	s.statusMu.Lock()
+	s.lastRun = time.Now()
+	s.lastCompacted = compactedCount
+	s.statusMu.Unlock()
+
 	if compactedCount > 0 {
 		log.Printf("🗜️ Compacted %d rooms", compactedCount)
 	}
 }
 
-func (s *Service) shouldCompact(roomID string) bool {
-	count, err := s.database.GetUpdateCount(roomID)
+func (s *Service) shouldCompact(ctx context.Context, roomID string) bool {
+	count, err := s.database.GetUpdateCount(ctx, roomID)
 	if err != nil {
 		return false
 	}
 	return count >= s.config.UpdateThreshold
 }
 
-func mergeYjsUpdates(updates [][]byte) []byte {
-	totalSize := 0
-	for _, update := range updates {
-		totalSize += len(update)
+// Merges a room's updates, all but the most recent, into its snapshot.
+// Unless forced, rooms below the update threshold are left alone.
+func (s *Service) compactRoom(ctx context.Context, roomID string, force bool) (*Result, error) {
+	minUpdates := s.config.UpdateThreshold
+	if force {
+		minUpdates = 0
 	}
-
-	merged := make([]byte, 0, totalSize+len(updates)*4)
-
-	for _, update := range updates {
-		length := uint32(len(update))
-		merged = append(merged, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
-		merged = append(merged, update...)
-	}
-
-	return merged
-}
-
-func (s *Service) compactRoom(roomID string) error {
-	updates, err := s.database.GetAllUpdates(roomID)
+	compacted, err := s.database.CompactUpdates(ctx, roomID, s.config.KeepRecentUpdates, minUpdates, mergeSnapshot)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(updates) < s.config.UpdateThreshold {
-		return nil
+	result := &Result{RoomID: roomID, UpdatesKept: compacted.Kept}
+	if compacted.Merged == 0 {
+		return result, nil
 	}
 
-	mergedUpdate := mergeYjsUpdates(updates)
-
-	if err := s.database.SaveSnapshot(roomID, mergedUpdate, len(updates)); err != nil {
-		return err
+	log.Printf("🗜️ Compacted room %s: %d updates → snapshot of %d + %d recent",
+		roomID, compacted.Merged, compacted.SnapshotCount, compacted.Kept)
+	if s.listener != nil {
+		s.listener.RoomCompacted(roomID, compacted.Snapshot, compacted.SnapshotCount)
 	}
 
-	if err := s.database.DeleteUpdatesBeforeSnapshot(roomID, s.config.KeepRecentUpdates); err != nil {
-		return err
-	}
-
-	log.Printf("🗜️ Compacted room %s: %d updates → snapshot + %d recent",
-		roomID, len(updates), s.config.KeepRecentUpdates)
+	result.Compacted = true
+	result.UpdatesMerged = compacted.Merged
+	result.SnapshotBytes = len(compacted.Snapshot)
+	return result, nil
+}
 
-	return nil
+// Appends updates to a snapshot, keeping what earlier compactions merged,
+// and writes it in the current format
+func mergeSnapshot(snapshot []byte, updates [][]byte) ([]byte, int, error) {
+	existing, err := DecodeSnapshot(snapshot)
+	if err != nil {
+		return nil, 0, err
+	}
+	all := append(existing, updates...)
+	return EncodeSnapshot(all), len(all), nil
 }
 
-func SplitMergedUpdates(merged []byte) [][]byte {
-	var updates [][]byte
-	offset := 0
+// SnapshotDrift is a snapshot whose recorded update count disagrees with
+// the updates it holds, as left by a crash part way through compaction, or
+// one in a format this server can't read
+type SnapshotDrift struct {
+	RoomID        string `json:"room_id"`
+	RecordedCount int    `json:"recorded_count"` // update_count stored with the snapshot
+	StoredCount   int    `json:"stored_count"`   // Updates the snapshot actually frames
+	TrailingBytes int    `json:"trailing_bytes"` // Left over after the last whole update
+	Format        byte   `json:"format"`
+	UnknownFormat bool   `json:"unknown_format,omitempty"`
+}
 
-	for offset < len(merged) {
-		if offset+4 > len(merged) {
-			break
+// CheckSnapshots reads every snapshot and returns those that disagree with
+// their recorded update count, end in a partial update or can't be read
+func CheckSnapshots(ctx context.Context, database *db.Database) ([]SnapshotDrift, error) {
+	drift := []SnapshotDrift{}
+	err := database.ForEachSnapshot(ctx, func(snapshot db.StoredSnapshot) error {
+		updates, trailing, err := decodeSnapshot(snapshot.Data)
+		if len(updates) != snapshot.UpdateCount || trailing > 0 || err != nil {
+			drift = append(drift, SnapshotDrift{
+				RoomID:        snapshot.RoomID,
+				RecordedCount: snapshot.UpdateCount,
+				StoredCount:   len(updates),
+				TrailingBytes: trailing,
+				Format:        SnapshotFormat(snapshot.Data),
+				UnknownFormat: errors.Is(err, ErrUnknownFormat),
+			})
 		}
+		return nil
+	})
+	return drift, err
+}
 
-		length := uint32(merged[offset])<<24 |
-			uint32(merged[offset+1])<<16 |
-			uint32(merged[offset+2])<<8 |
-			uint32(merged[offset+3])
-		offset += 4
-
-		if offset+int(length) > len(merged) {
-			break
-		}
+// CompactNow compacts a room immediately, ignoring the update threshold
+func (s *Service) CompactNow(ctx context.Context, roomID string) (*Result, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	return s.compactRoom(ctx, roomID, true)
+}
 
-		update := make([]byte, length)
-		copy(update, merged[offset:offset+int(length)])
-		updates = append(updates, update)
-		offset += int(length)
-	}
+// RunNow performs a full compaction pass without waiting for the ticker
+func (s *Service) RunNow(ctx context.Context) Status {
+	s.compactAllRooms(ctx)
+	return s.Status()
+}
 
-	return updates
+func (s *Service) Status() Status {
+	s.statusMu.RLock()
+	defer s.statusMu.RUnlock()
+	return Status{LastRun: s.lastRun, LastCompacted: s.lastCompacted}
 }
 
-func (s *Service) CompactNow(roomID string) error {
-	return s.compactRoom(roomID)
+func (s *Service) Config() Config {
+	return s.config
 }
@@ -0,0 +1,174 @@
+package compaction
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// Snapshot formats. Snapshots written before formats existed have no
+// header; every later format starts with snapshotMagic and a version byte.
+// The magic can't open a headerless snapshot, whose first four bytes are
+// the length of its first update and so below 0xFF000000.
+const (
+	FormatLegacy byte = 0 // Length-prefixed updates without a header
+	FormatFramed byte = 1 // Header, then length-prefixed updates
+
+	// The format new snapshots are written in
+	CurrentFormat = FormatFramed
+)
+
+var snapshotMagic = [3]byte{0xFF, 'L', 'S'}
+
+const headerSize = len(snapshotMagic) + 1
+
+// ErrUnknownFormat is returned for snapshots written in a format this
+// server doesn't know, such as by a newer version. They are left untouched.
+var ErrUnknownFormat = errors.New("unknown snapshot format")
+
+// SnapshotFormat returns the format a snapshot was written in
+func SnapshotFormat(snapshot []byte) byte {
+	if len(snapshot) < headerSize || [3]byte(snapshot[:3]) != snapshotMagic {
+		return FormatLegacy
+	}
+	return snapshot[3]
+}
+
+// EncodeSnapshot writes updates as a snapshot in the current format
+func EncodeSnapshot(updates [][]byte) []byte {
+	totalSize := headerSize
+	for _, update := range updates {
+		totalSize += 4 + len(update)
+	}
+
+	snapshot := make([]byte, 0, totalSize)
+	snapshot = append(snapshot, snapshotMagic[:]...)
+	snapshot = append(snapshot, CurrentFormat)
+	for _, update := range updates {
+		length := uint32(len(update))
+		snapshot = append(snapshot, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+		snapshot = append(snapshot, update...)
+	}
+	return snapshot
+}
+
+// DecodeSnapshot returns the updates a snapshot holds, in order, whatever
+// known format it was written in. An empty snapshot holds none.
+func DecodeSnapshot(snapshot []byte) ([][]byte, error) {
+	updates, _, err := decodeSnapshot(snapshot)
+	return updates, err
+}
+
+// SplitMergedUpdates returns the updates a snapshot holds, or none for a
+// snapshot in an unknown format. Callers that would write the snapshot back
+// must use DecodeSnapshot instead, so an unknown one isn't overwritten.
+func SplitMergedUpdates(snapshot []byte) [][]byte {
+	updates, err := DecodeSnapshot(snapshot)
+	if err != nil {
+		log.Printf("Error reading snapshot: %v", err)
+		return nil
+	}
+	return updates
+}
+
+// Also returns how many bytes follow the last whole update
+func decodeSnapshot(snapshot []byte) ([][]byte, int, error) {
+	if len(snapshot) == 0 {
+		return nil, 0, nil
+	}
+	switch format := SnapshotFormat(snapshot); format {
+	case FormatLegacy:
+		updates, trailing := splitFrames(snapshot)
+		return updates, trailing, nil
+	case FormatFramed:
+		updates, trailing := splitFrames(snapshot[headerSize:])
+		return updates, trailing, nil
+	default:
+		return nil, 0, fmt.Errorf("%w %d", ErrUnknownFormat, format)
+	}
+}
+
+func splitFrames(data []byte) ([][]byte, int) {
+	var updates [][]byte
+	offset := 0
+
+	for offset+4 <= len(data) {
+		length := uint32(data[offset])<<24 |
+			uint32(data[offset+1])<<16 |
+			uint32(data[offset+2])<<8 |
+			uint32(data[offset+3])
+		if uint64(offset)+4+uint64(length) > uint64(len(data)) {
+			break
+		}
+		offset += 4
+
+		update := make([]byte, length)
+		copy(update, data[offset:offset+int(length)])
+		updates = append(updates, update)
+		offset += int(length)
+	}
+
+	return updates, len(data) - offset
+}
+
+// MigrateSnapshot rewrites a snapshot in the current format. It reports
+// false, returning the snapshot as is, when it already is in it.
+func MigrateSnapshot(snapshot []byte) ([]byte, bool, error) {
+	if len(snapshot) == 0 || SnapshotFormat(snapshot) == CurrentFormat {
+		return snapshot, false, nil
+	}
+	updates, trailing, err := decodeSnapshot(snapshot)
+	if err != nil {
+		return nil, false, err
+	}
+	if trailing > 0 {
+		// Rewriting would drop the partial update CheckSnapshots reports
+		return nil, false, fmt.Errorf("snapshot ends in %d bytes of a partial update", trailing)
+	}
+	return EncodeSnapshot(updates), true, nil
+}
+
+// MigrateSnapshots rewrites every snapshot in an older format in the
+// current one, leaving its content and update count alone, and returns how
+// many it rewrote. Snapshots it can't migrate are logged and skipped. Safe
+// to run next to compaction: a snapshot compacted meanwhile is skipped, as
+// compaction writes the current format.
+func MigrateSnapshots(ctx context.Context, database *db.Database) (int, error) {
+	var stale []string
+	err := database.ForEachSnapshot(ctx, func(snapshot db.StoredSnapshot) error {
+		if len(snapshot.Data) > 0 && SnapshotFormat(snapshot.Data) != CurrentFormat {
+			stale = append(stale, snapshot.RoomID)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, roomID := range stale {
+		snapshot, _, err := database.GetSnapshot(ctx, roomID)
+		if err != nil {
+			return migrated, err
+		}
+		rewritten, changed, err := MigrateSnapshot(snapshot)
+		if err != nil {
+			log.Printf("⚠️ Not migrating snapshot of room %s: %v", roomID, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		replaced, err := database.ReplaceSnapshotData(ctx, roomID, snapshot, rewritten)
+		if err != nil {
+			return migrated, err
+		}
+		if replaced {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
@@ -0,0 +1,106 @@
+package compaction
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// Writes updates the way snapshots were stored before formats existed
+func legacySnapshot(updates ...[]byte) []byte {
+	var snapshot []byte
+	for _, update := range updates {
+		n := len(update)
+		snapshot = append(snapshot, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		snapshot = append(snapshot, update...)
+	}
+	return snapshot
+}
+
+func TestSnapshotFormats(t *testing.T) {
+	updates := [][]byte{{1, 2}, {}, {3}}
+
+	encoded := EncodeSnapshot(updates)
+	if SnapshotFormat(encoded) != CurrentFormat {
+		t.Errorf("Expected format %d, got %d", CurrentFormat, SnapshotFormat(encoded))
+	}
+	legacy := legacySnapshot(updates...)
+	if SnapshotFormat(legacy) != FormatLegacy {
+		t.Errorf("Expected a headerless snapshot to be legacy, got %d", SnapshotFormat(legacy))
+	}
+
+	for name, snapshot := range map[string][]byte{"current": encoded, "legacy": legacy} {
+		decoded, err := DecodeSnapshot(snapshot)
+		if err != nil || len(decoded) != 3 || !bytes.Equal(decoded[0], updates[0]) || !bytes.Equal(decoded[2], updates[2]) {
+			t.Errorf("Expected the %s snapshot's updates back, got %v (err %v)", name, decoded, err)
+		}
+	}
+
+	future := append([]byte(nil), encoded...)
+	future[3] = CurrentFormat + 1
+	if _, err := DecodeSnapshot(future); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("Expected ErrUnknownFormat, got %v", err)
+	}
+	if _, _, err := mergeSnapshot(future, [][]byte{{4}}); err == nil {
+		t.Error("Expected compaction to refuse a snapshot it can't read")
+	}
+
+	merged, count, err := mergeSnapshot(legacy, [][]byte{{4}})
+	if err != nil || count != 4 || SnapshotFormat(merged) != CurrentFormat {
+		t.Errorf("Expected the legacy snapshot merged into the current format, got %d updates in format %d (err %v)", count, SnapshotFormat(merged), err)
+	}
+}
+
+func TestMigrateSnapshots(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	ctx := context.Background()
+
+	future := EncodeSnapshot([][]byte{{9}})
+	future[3] = CurrentFormat + 1
+	snapshots := map[string][]byte{
+		"legacy":  legacySnapshot([]byte{1}, []byte{2}),
+		"current": EncodeSnapshot([][]byte{{3}}),
+		"future":  future,
+		"partial": append(legacySnapshot([]byte{4}), 0, 0),
+	}
+	for roomID, snapshot := range snapshots {
+		if err := database.SaveSnapshot(ctx, roomID, snapshot, 2); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+	}
+
+	migrated, err := MigrateSnapshots(ctx, database)
+	if err != nil || migrated != 1 {
+		t.Fatalf("Expected 1 snapshot migrated, got %d (err %v)", migrated, err)
+	}
+
+	snapshot, count, _ := database.GetSnapshot(ctx, "legacy")
+	if updates, err := DecodeSnapshot(snapshot); SnapshotFormat(snapshot) != CurrentFormat || len(updates) != 2 || err != nil || count != 2 {
+		t.Errorf("Expected the legacy snapshot rewritten with its 2 updates, got format %d with %v (count %d)", SnapshotFormat(snapshot), updates, count)
+	}
+	for _, roomID := range []string{"current", "future", "partial"} {
+		if snapshot, _, _ := database.GetSnapshot(ctx, roomID); !bytes.Equal(snapshot, snapshots[roomID]) {
+			t.Errorf("Expected the %s snapshot left alone", roomID)
+		}
+	}
+
+	drift, err := CheckSnapshots(ctx, database)
+	if err != nil {
+		t.Fatalf("CheckSnapshots failed: %v", err)
+	}
+	reported := map[string]SnapshotDrift{}
+	for _, d := range drift {
+		reported[d.RoomID] = d
+	}
+	if !reported["future"].UnknownFormat || reported["partial"].TrailingBytes != 2 {
+		t.Errorf("Expected the future and partial snapshots reported, got %+v", drift)
+	}
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// API keys start with this so they are recognisable in configs and logs
+const apiKeyPrefix = "lat_"
+
+// Characters of a key kept in plain text to tell keys apart
+const apiKeyVisibleLength = len(apiKeyPrefix) + 6
+
+// APIKey describes a stored key; the key itself is only known when created
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Keys carry 256 random bits, so an unsalted hash is enough
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey stores a new key and returns it. Only its hash is kept, so the
+// returned key cannot be recovered later.
+func (d *Database) CreateAPIKey(ctx context.Context, name string) (string, *APIKey, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	result, err := d.exec(ctx,
+		"INSERT INTO api_keys (name, key_hash, prefix) VALUES (?, ?, ?)",
+		name, hashAPIKey(key), key[:apiKeyVisibleLength],
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return "", nil, err
+	}
+
+	info := &APIKey{ID: int(id), Name: name, Prefix: key[:apiKeyVisibleLength]}
+	err = d.db.QueryRowContext(ctx, "SELECT created_at FROM api_keys WHERE id = ?", id).Scan(&info.CreatedAt)
+	return key, info, err
+}
+
+// CheckAPIKey reports whether key is a stored API key and records its use
+func (d *Database) CheckAPIKey(ctx context.Context, key string) (bool, error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return false, nil
+	}
+
+	var id int
+	err := d.db.QueryRowContext(ctx, "SELECT id FROM api_keys WHERE key_hash = ?", hashAPIKey(key)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = d.exec(ctx, "UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+	return true, err
+}
+
+// CountAPIKeys returns how many API keys exist
+func (d *Database) CountAPIKeys(ctx context.Context) (int, error) {
+	var count int
+	err := d.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM api_keys").Scan(&count)
+	return count, err
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+)
+
+// ErrHashCollision is returned when content hashes to the key of a blob
+// holding different content
+var ErrHashCollision = errors.New("content hash collides with different stored content")
+
+// Versions moved into blobs per transaction by MoveVersionContentToBlobs
+const blobBackfillBatch = 200
+
+// BlobHash returns the hex SHA-256 of content, which keys its blob
+func BlobHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Stores content as a blob unless an identical one exists and returns its
+// hash. An existing blob is only shared after checking it holds the same
+// content. Reference counts are kept by triggers on document_versions, so a
+// new blob starts at zero until a version points at it.
+func putBlob(ctx context.Context, tx *sql.Tx, content string) (string, error) {
+	hash := BlobHash(content)
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO version_blobs (hash, content, size) VALUES (?, ?, ?)
+		ON CONFLICT(hash) DO NOTHING
+	`, hash, content, len(content))
+	if err != nil {
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return hash, err
+	}
+
+	var same bool
+	if err := tx.QueryRowContext(ctx,
+		"SELECT size = ? AND content = ? FROM version_blobs WHERE hash = ?", len(content), content, hash,
+	).Scan(&same); err != nil {
+		return "", err
+	}
+	if !same {
+		log.Printf("🔥 SHA-256 collision on version blob %s", hash)
+		return "", ErrHashCollision
+	}
+	return hash, nil
+}
+
+func dropUnusedBlob(ctx context.Context, tx *sql.Tx, hash string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM version_blobs WHERE hash = ? AND ref_count <= 0", hash)
+	return err
+}
+
+// MoveVersionContentToBlobs moves the content of versions saved before
+// content-addressed storage into shared blobs, returning how many versions
+// it moved. It is safe to run repeatedly.
+func (d *Database) MoveVersionContentToBlobs(ctx context.Context) (int, error) {
+	moved := 0
+	for {
+		n, err := d.moveVersionBatch(ctx)
+		moved += n
+		if err != nil || n < blobBackfillBatch {
+			return moved, err
+		}
+	}
+}
+
+func (d *Database) moveVersionBatch(ctx context.Context) (int, error) {
+	moved := 0
+	err := d.retryBusy(ctx, func() error {
+		moved = 0
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		rows, err := tx.QueryContext(ctx,
+			"SELECT id, content FROM document_versions WHERE blob_hash IS NULL LIMIT ?", blobBackfillBatch)
+		if err != nil {
+			return err
+		}
+		type inline struct {
+			id      int
+			content string
+		}
+		var pending []inline
+		for rows.Next() {
+			var v inline
+			if err := rows.Scan(&v.id, &v.content); err != nil {
+				rows.Close()
+				return err
+			}
+			pending = append(pending, v)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, v := range pending {
+			hash, err := putBlob(ctx, tx, v.content)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx,
+				"UPDATE document_versions SET blob_hash = ?, content_hash = ?, content = '' WHERE id = ?", hash, hash, v.id); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		moved = len(pending)
+		return nil
+	})
+	return moved, err
+}
+
+// VersionStorage compares the content size of every version with what is
+// stored once duplicates are shared
+type VersionStorage struct {
+	Versions     int   `json:"versions"`
+	Blobs        int   `json:"blobs"`
+	ContentBytes int64 `json:"content_bytes"` // Sum over versions, counting shared content each time
+	StoredBytes  int64 `json:"stored_bytes"`
+}
+
+// GetVersionStorage reports how much version content is stored and how much
+// deduplication saves
+func (d *Database) GetVersionStorage(ctx context.Context) (*VersionStorage, error) {
+	var s VersionStorage
+	err := d.db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM document_versions),
+			(SELECT COUNT(*) FROM version_blobs),
+			(SELECT COALESCE(SUM(COALESCE(b.size, LENGTH(v.content))), 0)
+				FROM document_versions v LEFT JOIN version_blobs b ON b.hash = v.blob_hash),
+			(SELECT COALESCE(SUM(LENGTH(content)), 0) FROM document_versions) +
+			(SELECT COALESCE(SUM(size), 0) FROM version_blobs)
+	`).Scan(&s.Versions, &s.Blobs, &s.ContentBytes, &s.StoredBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (d *Database) backfillVersionBlobs(ctx context.Context) {
+	moved, err := d.MoveVersionContentToBlobs(ctx)
+	if err != nil {
+		log.Printf("⚠️ Failed to move version content into blobs: %v", err)
+		return
+	}
+	if moved > 0 {
+		log.Printf("Moved the content of %d versions into shared blobs", moved)
+	}
+}
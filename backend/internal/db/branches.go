@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrRoomExists is returned when creating a room whose ID is taken
+var ErrRoomExists = errors.New("room already exists")
+
+// Branch records the version a room was branched from
+type Branch struct {
+	RoomID          string    `json:"room_id"`
+	SourceRoomID    string    `json:"source_room_id"`
+	SourceVersionID int       `json:"source_version_id"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// CreateBranch creates roomID as a branch of source. The room's document is
+// seeded with update, a Yjs update holding source's content, and the content
+// is saved as the branch's first version with the given description, which
+// it returns. The branch keeps the source room's join secret and workspace,
+// within the workspace's room limit. It fails with ErrRoomExists if the room
+// ID is taken.
+func (d *Database) CreateBranch(ctx context.Context, roomID, name, description string, source *Version, update []byte) (*Version, error) {
+	var id int64
+	err := d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var workspaceID sql.NullString
+		if err := tx.QueryRowContext(ctx, "SELECT workspace_id FROM rooms WHERE id = ?", source.RoomID).Scan(&workspaceID); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if workspaceID.Valid {
+			var full bool
+			if err := tx.QueryRowContext(ctx, `
+				SELECT max_rooms > 0 AND (SELECT COUNT(*) FROM rooms WHERE workspace_id = ?) >= max_rooms
+				FROM workspaces WHERE id = ?`, workspaceID, workspaceID,
+			).Scan(&full); err != nil {
+				return err
+			}
+			if full {
+				return ErrWorkspaceFull
+			}
+		}
+
+		result, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO rooms (id, name, join_secret, workspace_id)
+			VALUES (?, ?, (SELECT join_secret FROM rooms WHERE id = ?), ?)`,
+			roomID, name, source.RoomID, workspaceID,
+		)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrRoomExists
+		}
+
+		if _, err := tx.ExecContext(ctx,
+			"INSERT OR REPLACE INTO room_branches (room_id, source_room_id, source_version_id) VALUES (?, ?, ?)",
+			roomID, source.RoomID, source.ID,
+		); err != nil {
+			return err
+		}
+
+		if len(update) > 0 {
+			if _, err := tx.ExecContext(ctx,
+				"INSERT INTO document_updates (room_id, update_data, checksum) VALUES (?, ?, ?)",
+				roomID, update, checksum(update),
+			); err != nil {
+				return err
+			}
+		}
+
+		id, _, err = insertVersionTx(ctx, tx, "", roomID, source.Name, description,
+			source.Content, source.ContentHash, source.CreatedBy, false, 0)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.GetVersion(ctx, int(id))
+}
+
+// GetBranch returns where a room was branched from, or nil if it is not a
+// branch
+func (d *Database) GetBranch(ctx context.Context, roomID string) (*Branch, error) {
+	var b Branch
+	err := d.db.QueryRowContext(ctx,
+		"SELECT room_id, source_room_id, source_version_id, created_at FROM room_branches WHERE room_id = ?",
+		roomID,
+	).Scan(&b.RoomID, &b.SourceRoomID, &b.SourceVersionID, &b.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Checkpoint modes accepted by Checkpoint, from least to most disruptive
+const (
+	CheckpointPassive  = "PASSIVE"  // Copy what it can without waiting on readers or writers
+	CheckpointFull     = "FULL"     // Wait for writers, then copy the whole log
+	CheckpointRestart  = "RESTART"  // As FULL, then wait for readers so the log restarts from the top
+	CheckpointTruncate = "TRUNCATE" // As RESTART, then truncate the log file to zero bytes
+)
+
+// CheckpointResult is what SQLite reports for one checkpoint
+type CheckpointResult struct {
+	Mode         string    `json:"mode"`
+	Busy         bool      `json:"busy"`         // A reader or writer kept it from finishing
+	LogPages     int       `json:"log_pages"`    // Pages in the WAL
+	Checkpointed int       `json:"checkpointed"` // Pages copied back into the database
+	At           time.Time `json:"at"`
+}
+
+// WALStats reports the size of the write-ahead log and the latest explicit
+// checkpoint
+type WALStats struct {
+	Bytes          int64             `json:"bytes"`
+	AutoCheckpoint int               `json:"autocheckpoint_pages"` // Zero when automatic checkpoints are off
+	Checkpoints    uint64            `json:"checkpoints"`          // Explicit checkpoints since startup
+	LastCheckpoint *CheckpointResult `json:"last_checkpoint,omitempty"`
+}
+
+type checkpointState struct {
+	mu    sync.Mutex
+	count uint64
+	last  *CheckpointResult
+}
+
+// Checkpoint copies the WAL back into the database file using one of the
+// Checkpoint* modes
+func (d *Database) Checkpoint(ctx context.Context, mode string) (*CheckpointResult, error) {
+	switch mode {
+	case CheckpointPassive, CheckpointFull, CheckpointRestart, CheckpointTruncate:
+	default:
+		return nil, fmt.Errorf("unknown checkpoint mode %q", mode)
+	}
+
+	result := CheckpointResult{Mode: mode}
+	var busy int
+	err := d.db.QueryRowContext(ctx, "PRAGMA wal_checkpoint("+mode+")").Scan(&busy, &result.LogPages, &result.Checkpointed)
+	if err != nil {
+		return nil, err
+	}
+	result.Busy = busy != 0
+	result.At = time.Now().UTC()
+
+	d.checkpoint.mu.Lock()
+	d.checkpoint.count++
+	d.checkpoint.last = &result
+	d.checkpoint.mu.Unlock()
+	return &result, nil
+}
+
+// WALSize returns the size of the write-ahead log file, zero when there is
+// none
+func (d *Database) WALSize() (int64, error) {
+	info, err := os.Stat(d.path + "-wal")
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// WALStats returns the WAL size and checkpoint history
+func (d *Database) WALStats() WALStats {
+	stats := WALStats{AutoCheckpoint: d.config.WALAutoCheckpoint}
+	stats.Bytes, _ = d.WALSize()
+
+	d.checkpoint.mu.Lock()
+	defer d.checkpoint.mu.Unlock()
+	stats.Checkpoints = d.checkpoint.count
+	if d.checkpoint.last != nil {
+		last := *d.checkpoint.last
+		stats.LastCheckpoint = &last
+	}
+	return stats
+}
+
+// Reports how long it has been since the last committed write, or since
+// the database was opened if nothing was written
+func (d *Database) sinceLastWrite() time.Duration {
+	last := d.lastWrite.Load()
+	if last == 0 {
+		return math.MaxInt64
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// CheckpointConfig controls when the Checkpointer truncates the WAL
+type CheckpointConfig struct {
+	Interval time.Duration // How often to look for a quiet moment
+	Idle     time.Duration // How long writes must have paused
+	MinBytes int64         // Skip checkpoints while the WAL is smaller than this
+}
+
+func DefaultCheckpointConfig() CheckpointConfig {
+	return CheckpointConfig{
+		Interval: 30 * time.Second,
+		Idle:     5 * time.Second,
+		MinBytes: 4 << 20,
+	}
+}
+
+func (c CheckpointConfig) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("checkpoint interval must be positive, got %v", c.Interval)
+	}
+	if c.Idle < 0 {
+		return fmt.Errorf("checkpoint idle time must not be negative, got %v", c.Idle)
+	}
+	if c.MinBytes < 0 {
+		return fmt.Errorf("checkpoint minimum WAL size must not be negative, got %d", c.MinBytes)
+	}
+	return nil
+}
+
+// Checkpointer runs TRUNCATE checkpoints while writes pause. Automatic
+// checkpoints copy pages back but never shrink the WAL file, and under
+// sustained writes they keep failing to reach the end of the log while
+// readers hold old snapshots, so the file only grows. A truncating
+// checkpoint in a quiet moment returns it to zero bytes.
+type Checkpointer struct {
+	database *Database
+	config   CheckpointConfig
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewCheckpointer(database *Database, config CheckpointConfig) *Checkpointer {
+	c := &Checkpointer{
+		database: database,
+		config:   config,
+		stop:     make(chan struct{}),
+	}
+
+	c.wg.Add(1)
+	go c.run()
+	return c
+}
+
+// Close stops the checkpointer and truncates the WAL one last time
+func (c *Checkpointer) Close() {
+	close(c.stop)
+	c.wg.Wait()
+	if _, err := c.database.Checkpoint(context.Background(), CheckpointTruncate); err != nil {
+		log.Printf("Final WAL checkpoint failed: %v", err)
+	}
+}
+
+func (c *Checkpointer) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.checkpointIfIdle()
+		}
+	}
+}
+
+// Truncates the WAL if it has grown and no write landed for the idle time
+func (c *Checkpointer) checkpointIfIdle() {
+	if c.database.sinceLastWrite() < c.config.Idle {
+		return
+	}
+	size, err := c.database.WALSize()
+	if err != nil {
+		log.Printf("Failed to stat WAL: %v", err)
+		return
+	}
+	if size == 0 || size < c.config.MinBytes {
+		return
+	}
+
+	result, err := c.database.Checkpoint(context.Background(), CheckpointTruncate)
+	if err != nil {
+		log.Printf("WAL checkpoint failed: %v", err)
+		return
+	}
+	if result.Busy {
+		log.Printf("WAL checkpoint blocked by open transactions; %d of %d pages copied", result.Checkpointed, result.LogPages)
+		return
+	}
+	log.Printf("💾 WAL truncated (%d bytes, %d pages)", size, result.LogPages)
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckpointer(t *testing.T) {
+	config := DefaultConfig()
+	config.WALAutoCheckpoint = 0
+	database, err := NewWithConfig(filepath.Join(t.TempDir(), "test.db"), config)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer database.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		if err := database.SaveUpdate(ctx, "wal-room", make([]byte, 4096)); err != nil {
+			t.Fatalf("Failed to save update: %v", err)
+		}
+	}
+	grown, err := database.WALSize()
+	if err != nil || grown == 0 {
+		t.Fatalf("Expected the WAL to grow without automatic checkpoints, got %d (err %v)", grown, err)
+	}
+
+	// Nothing happens while writes are recent
+	checkpointer := &Checkpointer{database: database, config: CheckpointConfig{Interval: time.Hour, Idle: time.Hour}}
+	checkpointer.checkpointIfIdle()
+	if stats := database.WALStats(); stats.Checkpoints != 0 || stats.Bytes != grown {
+		t.Errorf("Expected no checkpoint while busy, got %+v", stats)
+	}
+
+	// or while the WAL is small
+	checkpointer.config = CheckpointConfig{Interval: time.Hour, MinBytes: grown + 1}
+	checkpointer.checkpointIfIdle()
+	if stats := database.WALStats(); stats.Checkpoints != 0 {
+		t.Errorf("Expected no checkpoint below the minimum size, got %+v", stats)
+	}
+
+	checkpointer.config = CheckpointConfig{Interval: time.Hour}
+	checkpointer.checkpointIfIdle()
+	stats := database.WALStats()
+	if stats.Bytes != 0 || stats.Checkpoints != 1 || stats.AutoCheckpoint != 0 {
+		t.Errorf("Expected a truncated WAL, got %+v", stats)
+	}
+	if last := stats.LastCheckpoint; last == nil || last.Mode != CheckpointTruncate || last.Busy || last.Checkpointed != last.LogPages {
+		t.Errorf("Unexpected checkpoint %+v", last)
+	}
+
+	if _, err := database.Checkpoint(ctx, "SIDEWAYS"); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+)
+
+// OrphanedRoom is a room ID that stored rows refer to but the rooms table no
+// longer holds. Foreign keys are not enforced, so deleting a room leaves its
+// rows behind.
+type OrphanedRoom struct {
+	RoomID    string `json:"room_id"`
+	Updates   int    `json:"updates"`
+	Snapshots int    `json:"snapshots"`
+	Versions  int    `json:"versions"`
+}
+
+// FindOrphanedRooms returns the room IDs referenced by updates, snapshots or
+// versions that have no row in rooms, with how many rows of each they hold
+func (d *Database) FindOrphanedRooms(ctx context.Context) ([]OrphanedRoom, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT room_id, SUM(updates), SUM(snapshots), SUM(versions) FROM (
+			SELECT room_id, COUNT(*) AS updates, 0 AS snapshots, 0 AS versions FROM document_updates GROUP BY room_id
+			UNION ALL
+			SELECT room_id, 0, COUNT(*), 0 FROM room_snapshots GROUP BY room_id
+			UNION ALL
+			SELECT room_id, 0, 0, COUNT(*) FROM document_versions GROUP BY room_id
+		)
+		WHERE room_id NOT IN (SELECT id FROM rooms)
+		GROUP BY room_id
+		ORDER BY room_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orphans := []OrphanedRoom{}
+	for rows.Next() {
+		var o OrphanedRoom
+		if err := rows.Scan(&o.RoomID, &o.Updates, &o.Snapshots, &o.Versions); err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, o)
+	}
+	return orphans, rows.Err()
+}
+
+// DeleteOrphanedRows removes the updates, snapshots and versions of rooms
+// that no longer exist, as deleting the room would have with foreign keys
+// enforced. Version blobs are released by their triggers. It returns how many
+// rows were removed.
+func (d *Database) DeleteOrphanedRows(ctx context.Context) (int64, error) {
+	var removed int64
+	err := d.retryBusy(ctx, func() error {
+		removed = 0
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, table := range []string{"document_updates", "room_snapshots", "document_versions"} {
+			result, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE room_id NOT IN (SELECT id FROM rooms)")
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			removed += n
+		}
+		return tx.Commit()
+	})
+	return removed, err
+}
+
+// StoredSnapshot is a room's snapshot with the number of updates it was
+// recorded as merging
+type StoredSnapshot struct {
+	RoomID      string
+	Data        []byte
+	UpdateCount int
+}
+
+// ForEachSnapshot calls fn with every room's snapshot in room order, one at
+// a time. It stops at the first error fn returns.
+func (d *Database) ForEachSnapshot(ctx context.Context, fn func(snapshot StoredSnapshot) error) error {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT room_id, snapshot_data, COALESCE(update_count, 0)
+		FROM room_snapshots
+		ORDER BY room_id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s StoredSnapshot
+		if err := rows.Scan(&s.RoomID, &s.Data, &s.UpdateCount); err != nil {
+			return err
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestOrphanedRooms(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, roomID := range []string{"kept", "deleted"} {
+		if err := db.SaveUpdates(ctx, roomID, [][]byte{{0, 2, 1, 1}, {0, 2, 1, 2}}); err != nil {
+			t.Fatalf("Failed to save updates: %v", err)
+		}
+		if err := db.SaveSnapshot(ctx, roomID, []byte{0, 0, 0, 1, 7}, 1); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+		if _, err := db.CreateVersion(ctx, roomID, "v1", "", "hello", "hash-"+roomID, "", false); err != nil {
+			t.Fatalf("Failed to create version: %v", err)
+		}
+	}
+	// Foreign keys are not enforced, so the room's rows stay behind
+	if err := db.DeleteRoom(ctx, "deleted"); err != nil {
+		t.Fatalf("Failed to delete room: %v", err)
+	}
+
+	orphans, err := db.FindOrphanedRooms(ctx)
+	if err != nil {
+		t.Fatalf("FindOrphanedRooms failed: %v", err)
+	}
+	want := OrphanedRoom{RoomID: "deleted", Updates: 2, Snapshots: 1, Versions: 1}
+	if len(orphans) != 1 || orphans[0] != want {
+		t.Fatalf("Expected %+v, got %+v", want, orphans)
+	}
+
+	removed, err := db.DeleteOrphanedRows(ctx)
+	if err != nil {
+		t.Fatalf("DeleteOrphanedRows failed: %v", err)
+	}
+	if removed != 4 {
+		t.Errorf("Expected 4 rows removed, got %d", removed)
+	}
+	if orphans, _ := db.FindOrphanedRooms(ctx); len(orphans) != 0 {
+		t.Errorf("Expected no orphans after repair, got %+v", orphans)
+	}
+	if count, _ := db.GetUpdateCount(ctx, "kept"); count != 2 {
+		t.Errorf("Expected the existing room's updates kept, got %d", count)
+	}
+}
+
+func TestForEachSnapshot(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, roomID := range []string{"b", "a"} {
+		if err := db.CreateRoom(ctx, roomID, ""); err != nil {
+			t.Fatalf("Failed to create room: %v", err)
+		}
+		if err := db.SaveSnapshot(ctx, roomID, []byte(roomID), 3); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+	}
+
+	var seen []StoredSnapshot
+	err := db.ForEachSnapshot(ctx, func(s StoredSnapshot) error {
+		seen = append(seen, s)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachSnapshot failed: %v", err)
+	}
+	if len(seen) != 2 || seen[0].RoomID != "a" || string(seen[0].Data) != "a" || seen[0].UpdateCount != 3 || seen[1].RoomID != "b" {
+		t.Errorf("Expected snapshots of a then b, got %+v", seen)
+	}
+}
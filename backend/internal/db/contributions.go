@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Contribution sums the stored updates one author made to a room. Authors
+// are users when the session had a verified identity, otherwise the session
+// itself; updates with no author at all share one contribution with both
+// IDs empty.
+type Contribution struct {
+	UserID   string    `json:"user_id,omitempty"`
+	ClientID string    `json:"client_id,omitempty"` // Only for sessions without a user
+	Name     string    `json:"name,omitempty"`      // The user's profile name, if they have one
+	Clients  int       `json:"clients"`             // Distinct sessions the updates came from
+	Updates  int       `json:"updates"`
+	Bytes    int64     `json:"bytes"`
+	FirstAt  time.Time `json:"first_at"`
+	LastAt   time.Time `json:"last_at"`
+}
+
+// GetRoomContributions returns the authors of a room's stored updates, most
+// updates first and unattributed updates last. Updates merged into a
+// snapshot by compaction are no longer stored and not counted.
+func (d *Database) GetRoomContributions(ctx context.Context, roomID string) ([]Contribution, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT c.user_id, c.client_id, COALESCE(u.name, ''), c.clients, c.updates, c.bytes, c.first_at, c.last_at
+		FROM (
+			SELECT COALESCE(user_id, '') AS user_id,
+				CASE WHEN user_id IS NULL THEN COALESCE(client_id, '') ELSE '' END AS client_id,
+				COUNT(DISTINCT client_id) AS clients,
+				COUNT(*) AS updates,
+				SUM(LENGTH(update_data)) AS bytes,
+				MIN(created_at) AS first_at,
+				MAX(created_at) AS last_at
+			FROM document_updates
+			WHERE room_id = ?
+			GROUP BY 1, 2
+		) c
+		LEFT JOIN users u ON u.id = c.user_id
+		ORDER BY c.user_id = '' AND c.client_id = '', c.updates DESC, c.user_id ASC, c.client_id ASC
+	`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contributions := []Contribution{}
+	for rows.Next() {
+		var c Contribution
+		var firstAt, lastAt string
+		if err := rows.Scan(&c.UserID, &c.ClientID, &c.Name, &c.Clients, &c.Updates, &c.Bytes, &firstAt, &lastAt); err != nil {
+			return nil, err
+		}
+		// Aggregates lose the column's type, so the times come back as text
+		if c.FirstAt, err = time.Parse(sqliteTimeFormat, firstAt); err != nil {
+			return nil, err
+		}
+		if c.LastAt, err = time.Parse(sqliteTimeFormat, lastAt); err != nil {
+			return nil, err
+		}
+		contributions = append(contributions, c)
+	}
+	return contributions, rows.Err()
+}
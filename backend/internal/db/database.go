@@ -1,24 +1,37 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
-
-	_ "modernc.org/sqlite"
 )
 
 type Database struct {
-	db *sql.DB
+	db     *sql.DB
+	config Config
+	path   string
+
+	lastWrite  atomic.Int64 // Unix nanoseconds of the last committed write
+	checkpoint checkpointState
 }
 
 type Room struct {
-	ID        string
-	Name      string
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID         string
+	Name       string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	ArchivedAt *time.Time
+	Protected  bool   // requires a join secret
+	Workspace  string // owning workspace, empty for rooms open to everyone
+	Language   string // editor language, empty if never set; only GetRoom reads it
 }
 
 type DocumentState struct {
@@ -29,90 +42,60 @@ type DocumentState struct {
 }
 
 type Version struct {
-	ID          int       `json:"id"`
-	RoomID      string    `json:"room_id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Content     string    `json:"content"`
-	ContentHash string    `json:"content_hash"`
-	CreatedBy   string    `json:"created_by"`
-	CreatedAt   time.Time `json:"created_at"`
-	IsAuto      bool      `json:"is_auto"` // Auto-saved vs manual
+	ID              int       `json:"id"`
+	RoomID          string    `json:"room_id"`
+	Name            string    `json:"name"`
+	Description     string    `json:"description"`
+	Content         string    `json:"content"`
+	ContentHash     string    `json:"content_hash"`
+	CreatedBy       string    `json:"created_by"`
+	CreatedAt       time.Time `json:"created_at"`
+	IsAuto          bool      `json:"is_auto"`                     // Auto-saved vs manual
+	ParentVersionID int       `json:"parent_version_id,omitempty"` // Latest version in the room when this one was saved
+	RestoredFromID  int       `json:"restored_from_id,omitempty"`  // Version a restore brought back
+	Pinned          bool      `json:"pinned"`                      // Kept when old auto-saves are pruned
 }
 
 func New(dbPath string) (*Database, error) {
+	return NewWithConfig(dbPath, DefaultConfig())
+}
+
+func NewWithConfig(dbPath string, config Config) (*Database, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
 	// Ensure directory exists
 	dir := filepath.Dir(dbPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
 
-	db, err := sql.Open("sqlite", dbPath)
+	db, err := sql.Open(tracedDriverName, config.dsn(dbPath))
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
 
 	// Enable WAL mode for better concurrency
 	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	// Create tables
-	if err := createTables(db); err != nil {
-		return nil, err
+	d := &Database{db: db, config: config, path: dbPath}
+	if !config.SkipMigrations {
+		if _, err := migrateUp(context.Background(), db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("migrating database: %w", err)
+		}
+		d.backfillVersionBlobs(context.Background())
 	}
 
 	log.Printf("Database initialized at %s", dbPath)
-	return &Database{db: db}, nil
-}
-
-func createTables(db *sql.DB) error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS rooms (
-		id TEXT PRIMARY KEY,
-		name TEXT NOT NULL DEFAULT '',
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS document_updates (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		room_id TEXT NOT NULL,
-		update_data BLOB NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_document_updates_room_id ON document_updates(room_id);
-
-	CREATE TABLE IF NOT EXISTS room_snapshots (
-		room_id TEXT PRIMARY KEY,
-		snapshot_data BLOB NOT NULL,
-		update_count INTEGER DEFAULT 0,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
-	);
-
-	CREATE TABLE IF NOT EXISTS document_versions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		room_id TEXT NOT NULL,
-		name TEXT NOT NULL,
-		description TEXT DEFAULT '',
-		content TEXT NOT NULL,
-		content_hash TEXT NOT NULL,
-		created_by TEXT DEFAULT '',
-		is_auto BOOLEAN DEFAULT FALSE,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_document_versions_room_id ON document_versions(room_id);
-	CREATE INDEX IF NOT EXISTS idx_document_versions_created_at ON document_versions(room_id, created_at DESC);
-	`
-
-	_, err := db.Exec(schema)
-	return err
+	return d, nil
 }
 
 func (d *Database) Close() error {
@@ -121,22 +104,22 @@ func (d *Database) Close() error {
 
 // Room operations
 
-func (d *Database) CreateRoom(id, name string) error {
-	_, err := d.db.Exec(
+func (d *Database) CreateRoom(ctx context.Context, id, name string) error {
+	_, err := d.exec(ctx,
 		"INSERT OR IGNORE INTO rooms (id, name) VALUES (?, ?)",
 		id, name,
 	)
 	return err
 }
 
-func (d *Database) GetRoom(id string) (*Room, error) {
-	row := d.db.QueryRow(
-		"SELECT id, name, created_at, updated_at FROM rooms WHERE id = ?",
+func (d *Database) GetRoom(ctx context.Context, id string) (*Room, error) {
+	row := d.db.QueryRowContext(ctx,
+		"SELECT id, name, created_at, updated_at, archived_at, join_secret IS NOT NULL, COALESCE(workspace_id, ''), language FROM rooms WHERE id = ?",
 		id,
 	)
 
 	var room Room
-	err := row.Scan(&room.ID, &room.Name, &room.CreatedAt, &room.UpdatedAt)
+	err := row.Scan(&room.ID, &room.Name, &room.CreatedAt, &room.UpdatedAt, &room.ArchivedAt, &room.Protected, &room.Workspace, &room.Language)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -146,9 +129,21 @@ func (d *Database) GetRoom(id string) (*Room, error) {
 	return &room, nil
 }
 
-func (d *Database) ListRooms(limit, offset int) ([]Room, error) {
-	rows, err := d.db.Query(
-		"SELECT id, name, created_at, updated_at FROM rooms ORDER BY updated_at DESC LIMIT ? OFFSET ?",
+// SetRoomLanguage sets the language of a room's document; empty clears it.
+// Returns false if the room does not exist.
+func (d *Database) SetRoomLanguage(ctx context.Context, id, language string) (bool, error) {
+	result, err := d.exec(ctx, "UPDATE rooms SET language = ? WHERE id = ?", language, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ListRooms returns rooms that have not been archived, most recently updated first
+func (d *Database) ListRooms(ctx context.Context, limit, offset int) ([]Room, error) {
+	rows, err := d.db.QueryContext(ctx,
+		"SELECT id, name, created_at, updated_at, archived_at, join_secret IS NOT NULL, COALESCE(workspace_id, '') FROM rooms WHERE archived_at IS NULL ORDER BY updated_at DESC LIMIT ? OFFSET ?",
 		limit, offset,
 	)
 	if err != nil {
@@ -159,7 +154,7 @@ func (d *Database) ListRooms(limit, offset int) ([]Room, error) {
 	var rooms []Room
 	for rows.Next() {
 		var room Room
-		if err := rows.Scan(&room.ID, &room.Name, &room.CreatedAt, &room.UpdatedAt); err != nil {
+		if err := rows.Scan(&room.ID, &room.Name, &room.CreatedAt, &room.UpdatedAt, &room.ArchivedAt, &room.Protected, &room.Workspace); err != nil {
 			return nil, err
 		}
 		rooms = append(rooms, room)
@@ -167,88 +162,415 @@ func (d *Database) ListRooms(limit, offset int) ([]Room, error) {
 	return rooms, rows.Err()
 }
 
-func (d *Database) UpdateRoomTimestamp(id string) error {
-	_, err := d.db.Exec(
+// Columns rooms can be sorted by in ListRoomsPage
+var roomSortColumns = map[string]string{
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+	"name":       "name",
+}
+
+// IsValidRoomSort reports whether sort is a supported room sort column
+func IsValidRoomSort(sort string) bool {
+	_, ok := roomSortColumns[sort]
+	return ok
+}
+
+// RoomCursor marks the last row of a page for keyset pagination
+type RoomCursor struct {
+	Value string // Sort column value of the last row, as stored
+	ID    string
+}
+
+// RoomFilter narrows which rooms are listed or counted
+type RoomFilter struct {
+	NameQuery    string     // Case-insensitive substring of the room name
+	UpdatedAfter *time.Time // Only rooms updated strictly after this time
+	IDs          []string   // Only these rooms; nil means no restriction
+	Workspace    *string    // Only rooms in this workspace, or in none when empty; nil means no restriction
+}
+
+// Returns the SQL conditions and arguments for the filter, each prefixed with AND
+func (f RoomFilter) where() (string, []interface{}) {
+	var clause strings.Builder
+	var args []interface{}
+
+	if f.NameQuery != "" {
+		clause.WriteString(` AND name LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(f.NameQuery)+"%")
+	}
+
+	if f.UpdatedAfter != nil {
+		clause.WriteString(" AND updated_at > ?")
+		args = append(args, f.UpdatedAfter.UTC().Format(sqliteTimeFormat))
+	}
+
+	if f.Workspace != nil {
+		clause.WriteString(" AND COALESCE(workspace_id, '') = ?")
+		args = append(args, *f.Workspace)
+	}
+
+	if f.IDs != nil {
+		if len(f.IDs) == 0 {
+			clause.WriteString(" AND 0")
+		} else {
+			// One JSON array rather than a parameter per ID, which could
+			// pass SQLite's limit on bound parameters
+			ids, _ := json.Marshal(f.IDs)
+			clause.WriteString(" AND id IN (SELECT value FROM json_each(?))")
+			args = append(args, string(ids))
+		}
+	}
+
+	return clause.String(), args
+}
+
+// Layout SQLite uses for CURRENT_TIMESTAMP
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// RoomListOptions controls filtering, ordering and paging for ListRoomsPage
+type RoomListOptions struct {
+	RoomFilter
+	Limit  int
+	Offset int // Ignored when Cursor is set
+	Sort   string
+	Desc   bool
+	Cursor *RoomCursor
+}
+
+// RoomPage is one page of rooms plus the cursor for the following page
+type RoomPage struct {
+	Rooms []Room
+	Next  *RoomCursor // nil when there are no more rows
+}
+
+// ListRoomsPage returns rooms ordered by opts.Sort with id as a tiebreaker, so
+// pages stay stable while rooms are being created concurrently
+func (d *Database) ListRoomsPage(ctx context.Context, opts RoomListOptions) (*RoomPage, error) {
+	column, ok := roomSortColumns[opts.Sort]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort column: %s", opts.Sort)
+	}
+
+	direction, cmp := "ASC", ">"
+	if opts.Desc {
+		direction, cmp = "DESC", "<"
+	}
+
+	query := fmt.Sprintf(
+		"SELECT id, name, created_at, updated_at, archived_at, join_secret IS NOT NULL, COALESCE(workspace_id, ''), CAST(%s AS TEXT) FROM rooms WHERE archived_at IS NULL",
+		column,
+	)
+	filterClause, args := opts.RoomFilter.where()
+	query += filterClause
+
+	if opts.Cursor != nil {
+		query += fmt.Sprintf(" AND (%s %s ? OR (%s = ? AND id %s ?))", column, cmp, column, cmp)
+		args = append(args, opts.Cursor.Value, opts.Cursor.Value, opts.Cursor.ID)
+	}
+
+	// Fetch one extra row to find out whether another page exists
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT ?", column, direction, direction)
+	args = append(args, opts.Limit+1)
+
+	if opts.Cursor == nil && opts.Offset > 0 {
+		query += " OFFSET ?"
+		args = append(args, opts.Offset)
+	}
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &RoomPage{Rooms: make([]Room, 0, opts.Limit)}
+	var lastKey string
+	for rows.Next() {
+		var room Room
+		var sortKey string
+		if err := rows.Scan(&room.ID, &room.Name, &room.CreatedAt, &room.UpdatedAt, &room.ArchivedAt, &room.Protected, &room.Workspace, &sortKey); err != nil {
+			return nil, err
+		}
+
+		if len(page.Rooms) == opts.Limit {
+			page.Next = &RoomCursor{Value: lastKey, ID: page.Rooms[len(page.Rooms)-1].ID}
+			break
+		}
+
+		page.Rooms = append(page.Rooms, room)
+		lastKey = sortKey
+	}
+	return page, rows.Err()
+}
+
+// CountRooms returns the number of rooms matching filter that have not been archived
+func (d *Database) CountRooms(ctx context.Context, filter RoomFilter) (int, error) {
+	filterClause, args := filter.where()
+
+	var count int
+	err := d.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM rooms WHERE archived_at IS NULL"+filterClause, args...).Scan(&count)
+	return count, err
+}
+
+func (d *Database) UpdateRoomTimestamp(ctx context.Context, id string) error {
+	_, err := d.exec(ctx,
 		"UPDATE rooms SET updated_at = CURRENT_TIMESTAMP WHERE id = ?",
 		id,
 	)
 	return err
 }
 
-func (d *Database) DeleteRoom(id string) error {
-	_, err := d.db.Exec("DELETE FROM rooms WHERE id = ?", id)
+func (d *Database) DeleteRoom(ctx context.Context, id string) error {
+	_, err := d.exec(ctx, "DELETE FROM rooms WHERE id = ?", id)
+	return err
+}
+
+// ArchiveRoom hides a room from listings without deleting its data
+func (d *Database) ArchiveRoom(ctx context.Context, id string) error {
+	_, err := d.exec(ctx,
+		"UPDATE rooms SET archived_at = CURRENT_TIMESTAMP WHERE id = ? AND archived_at IS NULL",
+		id,
+	)
 	return err
 }
 
 // Document update operations
 
-func (d *Database) SaveUpdate(roomID string, update []byte) error {
+func (d *Database) SaveUpdate(ctx context.Context, roomID string, update []byte) error {
+	return d.SaveUpdates(ctx, roomID, [][]byte{update})
+}
+
+// SaveUpdates stores a batch of updates for a room in a single transaction
+func (d *Database) SaveUpdates(ctx context.Context, roomID string, updates [][]byte) error {
+	authored := make([]AuthoredUpdate, len(updates))
+	for i, update := range updates {
+		authored[i].Data = update
+	}
+	return d.SaveAuthoredUpdates(ctx, roomID, authored)
+}
+
+// Author records who made an update: the session that sent it and, when the
+// session has a verified identity, its user
+type Author struct {
+	ClientID string `json:"client_id,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+}
+
+// AuthoredUpdate is a document update with who made it
+type AuthoredUpdate struct {
+	Data []byte
+	Author
+}
+
+// SaveAuthoredUpdates is SaveUpdates recording each update's author
+func (d *Database) SaveAuthoredUpdates(ctx context.Context, roomID string, updates []AuthoredUpdate) error {
+	return d.retryBusy(ctx, func() error {
+		return d.saveUpdates(ctx, roomID, updates)
+	})
+}
+
+func (d *Database) saveUpdates(ctx context.Context, roomID string, updates []AuthoredUpdate) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// Ensure room exists
-	if err := d.CreateRoom(roomID, ""); err != nil {
+	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO rooms (id, name) VALUES (?, '')", roomID); err != nil {
 		return err
 	}
 
-	// Save the update
-	_, err := d.db.Exec(
-		"INSERT INTO document_updates (room_id, update_data) VALUES (?, ?)",
-		roomID, update,
-	)
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO document_updates (room_id, update_data, checksum, client_id, user_id) VALUES (?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))")
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
+
+	for _, update := range updates {
+		if _, err := stmt.ExecContext(ctx, roomID, update.Data, checksum(update.Data), update.ClientID, update.UserID); err != nil {
+			return err
+		}
+	}
 
 	// Update room timestamp
-	return d.UpdateRoomTimestamp(roomID)
+	if _, err := tx.ExecContext(ctx, "UPDATE rooms SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", roomID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (d *Database) GetAllUpdates(roomID string) ([][]byte, error) {
-	rows, err := d.db.Query(
+func (d *Database) GetAllUpdates(ctx context.Context, roomID string) ([][]byte, error) {
+	var updates [][]byte
+	err := d.ForEachUpdate(ctx, roomID, func(update []byte) error {
+		updates = append(updates, update)
+		return nil
+	})
+	return updates, err
+}
+
+// ForEachUpdate calls fn with each of a room's stored updates in order,
+// without holding them all in memory. It stops at the first error fn returns.
+func (d *Database) ForEachUpdate(ctx context.Context, roomID string, fn func(update []byte) error) error {
+	return d.forEachUpdate(ctx, fn,
 		"SELECT update_data FROM document_updates WHERE room_id = ? ORDER BY id ASC",
 		roomID,
 	)
+}
+
+// ForEachUpdateUntil is ForEachUpdate for the updates stored at or before
+// until, to the second
+func (d *Database) ForEachUpdateUntil(ctx context.Context, roomID string, until time.Time, fn func(update []byte) error) error {
+	return d.forEachUpdate(ctx, fn,
+		"SELECT update_data FROM document_updates WHERE room_id = ? AND created_at <= ? ORDER BY id ASC",
+		roomID, until.UTC().Format(sqliteTimeFormat),
+	)
+}
+
+func (d *Database) forEachUpdate(ctx context.Context, fn func(update []byte) error, query string, args ...interface{}) error {
+	rows, err := d.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var updates [][]byte
 	for rows.Next() {
 		var data []byte
 		if err := rows.Scan(&data); err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(data); err != nil {
+			return err
 		}
-		updates = append(updates, data)
 	}
-	return updates, rows.Err()
+	return rows.Err()
 }
 
-func (d *Database) GetUpdateCount(roomID string) (int, error) {
+// ForEachStoredUpdate calls fn with a room's snapshot, if it has one, and
+// then with each update stored after it, in order. Both come from one
+// statement, so they are read from one consistent view of the database: a
+// compaction meanwhile can't drop updates from the stream or repeat them.
+// The view, and a connection, are held until fn has seen the last update.
+func (d *Database) ForEachStoredUpdate(ctx context.Context, roomID string, fn func(data []byte, snapshot bool) error) error {
+	// Update IDs start at 1, so the snapshot's 0 sorts it first without
+	// sorting the updates, which come in ID order from the index
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT snapshot_data, 1, 0 AS id FROM room_snapshots WHERE room_id = ?
+		UNION ALL
+		SELECT update_data, 0, id FROM document_updates WHERE room_id = ?
+		ORDER BY id ASC
+	`, roomID, roomID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		var snapshot bool
+		var id int64
+		if err := rows.Scan(&data, &snapshot, &id); err != nil {
+			return err
+		}
+		if err := fn(data, snapshot); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// StoredUpdate is a document update with its row ID, when it was stored and
+// who made it
+type StoredUpdate struct {
+	ID        int64
+	Data      []byte
+	CreatedAt time.Time
+	Author
+}
+
+// ForEachUpdateBetween calls fn in order with each update stored after from
+// and at or before to, to the second. It stops at the first error fn returns.
+func (d *Database) ForEachUpdateBetween(ctx context.Context, roomID string, from, to time.Time, fn func(update StoredUpdate) error) error {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT id, update_data, created_at, COALESCE(client_id, ''), COALESCE(user_id, '') FROM document_updates
+		WHERE room_id = ? AND created_at > ? AND created_at <= ?
+		ORDER BY id ASC
+	`, roomID, from.UTC().Format(sqliteTimeFormat), to.UTC().Format(sqliteTimeFormat))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var update StoredUpdate
+		if err := rows.Scan(&update.ID, &update.Data, &update.CreatedAt, &update.ClientID, &update.UserID); err != nil {
+			return err
+		}
+		if err := fn(update); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (d *Database) GetUpdateCount(ctx context.Context, roomID string) (int, error) {
 	var count int
-	err := d.db.QueryRow(
+	err := d.db.QueryRowContext(ctx,
 		"SELECT COUNT(*) FROM document_updates WHERE room_id = ?",
 		roomID,
 	).Scan(&count)
 	return count, err
 }
 
+// ListRoomsOverUpdateThreshold returns up to limit room IDs after afterID
+// (in ID order) that hold at least threshold stored updates
+func (d *Database) ListRoomsOverUpdateThreshold(ctx context.Context, threshold int, afterID string, limit int) ([]string, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT room_id FROM document_updates
+		WHERE room_id > ?
+		GROUP BY room_id
+		HAVING COUNT(*) >= ?
+		ORDER BY room_id ASC
+		LIMIT ?
+	`, afterID, threshold, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roomIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, id)
+	}
+	return roomIDs, rows.Err()
+}
+
 // Snapshot operations (for compaction)
 
-func (d *Database) SaveSnapshot(roomID string, snapshot []byte, updateCount int) error {
-	_, err := d.db.Exec(`
-		INSERT INTO room_snapshots (room_id, snapshot_data, update_count, updated_at)
-		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+func (d *Database) SaveSnapshot(ctx context.Context, roomID string, snapshot []byte, updateCount int) error {
+	_, err := d.exec(ctx, `
+		INSERT INTO room_snapshots (room_id, snapshot_data, update_count, checksum, updated_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
 		ON CONFLICT(room_id) DO UPDATE SET
 			snapshot_data = excluded.snapshot_data,
 			update_count = excluded.update_count,
+			checksum = excluded.checksum,
 			updated_at = CURRENT_TIMESTAMP
-	`, roomID, snapshot, updateCount)
+	`, roomID, snapshot, updateCount, checksum(snapshot))
 	return err
 }
 
-func (d *Database) GetSnapshot(roomID string) ([]byte, int, error) {
+func (d *Database) GetSnapshot(ctx context.Context, roomID string) ([]byte, int, error) {
 	var snapshot []byte
 	var updateCount int
-	err := d.db.QueryRow(
+	err := d.db.QueryRowContext(ctx,
 		"SELECT snapshot_data, update_count FROM room_snapshots WHERE room_id = ?",
 		roomID,
 	).Scan(&snapshot, &updateCount)
@@ -258,67 +580,259 @@ func (d *Database) GetSnapshot(roomID string) ([]byte, int, error) {
 	return snapshot, updateCount, err
 }
 
-func (d *Database) DeleteUpdatesBeforeSnapshot(roomID string, keepCount int) error {
-	// Delete old updates, keeping only the most recent ones after snapshot
-	_, err := d.db.Exec(`
-		DELETE FROM document_updates 
-		WHERE room_id = ? AND id NOT IN (
-			SELECT id FROM document_updates 
-			WHERE room_id = ? 
-			ORDER BY id DESC 
-			LIMIT ?
-		)
-	`, roomID, roomID, keepCount)
-	return err
+// GetSnapshotAt returns a room's snapshot and when it was written, or nil
+// without one
+func (d *Database) GetSnapshotAt(ctx context.Context, roomID string) ([]byte, *time.Time, error) {
+	var snapshot []byte
+	var updatedAt time.Time
+	err := d.db.QueryRowContext(ctx,
+		"SELECT snapshot_data, updated_at FROM room_snapshots WHERE room_id = ?",
+		roomID,
+	).Scan(&snapshot, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return snapshot, &updatedAt, nil
 }
 
-// Version operations
+// ReplaceSnapshotData swaps a room's snapshot for the same content stored
+// differently, keeping its update count and time. It reports false, changing
+// nothing, when the snapshot is no longer old, as after a compaction.
+func (d *Database) ReplaceSnapshotData(ctx context.Context, roomID string, old, snapshot []byte) (bool, error) {
+	result, err := d.exec(ctx, `
+		UPDATE room_snapshots SET snapshot_data = ?, checksum = ?
+		WHERE room_id = ? AND checksum = ? AND snapshot_data = ?
+	`, snapshot, checksum(snapshot), roomID, checksum(old), old)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// CompactedRoom describes what CompactUpdates did to a room
+type CompactedRoom struct {
+	Merged        int // Updates folded into the snapshot and deleted
+	Kept          int // Updates left stored after the snapshot
+	Snapshot      []byte
+	SnapshotCount int // Updates the snapshot now holds
+}
+
+// CompactUpdates folds a room's updates, all but the newest keep, into its
+// snapshot and deletes them, in one transaction. merge receives the current
+// snapshot (nil without one) and the updates in order, and returns the new
+// snapshot and how many updates it holds; an error from it leaves the room
+// alone. The transaction takes the write
+// lock up front and the updates merged are fixed by the highest update ID
+// read first, so a crash leaves either the old snapshot and every update or
+// the new snapshot and only the kept ones, and no update is deleted without
+// being in the snapshot. Rooms with fewer than minUpdates updates, or no more
+// than keep, are left alone and only Kept is set.
+func (d *Database) CompactUpdates(ctx context.Context, roomID string, keep, minUpdates int, merge func(snapshot []byte, updates [][]byte) ([]byte, int, error)) (*CompactedRoom, error) {
+	var result *CompactedRoom
+	err := d.retryBusy(ctx, func() error {
+		result = &CompactedRoom{}
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var maxID int64
+		var count int
+		if err := tx.QueryRowContext(ctx,
+			"SELECT COALESCE(MAX(id), 0), COUNT(*) FROM document_updates WHERE room_id = ?",
+			roomID,
+		).Scan(&maxID, &count); err != nil {
+			return err
+		}
+		if count < minUpdates || count <= keep {
+			result.Kept = count
+			return nil
+		}
+
+		// The newest update to merge; the keep after it stay
+		var cutoff int64
+		if err := tx.QueryRowContext(ctx,
+			"SELECT id FROM document_updates WHERE room_id = ? AND id <= ? ORDER BY id DESC LIMIT 1 OFFSET ?",
+			roomID, maxID, keep,
+		).Scan(&cutoff); err != nil {
+			return err
+		}
+
+		var snapshot []byte
+		err = tx.QueryRowContext(ctx, "SELECT snapshot_data FROM room_snapshots WHERE room_id = ?", roomID).Scan(&snapshot)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx,
+			"SELECT update_data FROM document_updates WHERE room_id = ? AND id <= ? ORDER BY id ASC",
+			roomID, cutoff,
+		)
+		if err != nil {
+			return err
+		}
+		var updates [][]byte
+		for rows.Next() {
+			var update []byte
+			if err := rows.Scan(&update); err != nil {
+				rows.Close()
+				return err
+			}
+			updates = append(updates, update)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
 
-// CreateVersion saves a new version of the document
-func (d *Database) CreateVersion(roomID, name, description, content, contentHash, createdBy string, isAuto bool) (*Version, error) {
-	result, err := d.db.Exec(`
-		INSERT INTO document_versions (room_id, name, description, content, content_hash, created_by, is_auto)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, roomID, name, description, content, contentHash, createdBy, isAuto)
+		merged, mergedCount, err := merge(snapshot, updates)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO room_snapshots (room_id, snapshot_data, update_count, checksum, updated_at)
+			VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(room_id) DO UPDATE SET
+				snapshot_data = excluded.snapshot_data,
+				update_count = excluded.update_count,
+				checksum = excluded.checksum,
+				updated_at = CURRENT_TIMESTAMP
+		`, roomID, merged, mergedCount, checksum(merged)); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			"DELETE FROM document_updates WHERE room_id = ? AND id <= ?",
+			roomID, cutoff,
+		); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		result.Merged = len(updates)
+		result.Kept = count - len(updates)
+		result.Snapshot = merged
+		result.SnapshotCount = mergedCount
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return result, nil
+}
+
+// RoomStorage summarizes how much update and snapshot data a room holds
+type RoomStorage struct {
+	RoomID              string     `json:"room_id"`
+	UpdateCount         int        `json:"update_count"`
+	UpdateBytes         int64      `json:"update_bytes"`
+	SnapshotBytes       int64      `json:"snapshot_bytes"`
+	SnapshotUpdateCount int        `json:"snapshot_update_count"`
+	SnapshotUpdatedAt   *time.Time `json:"snapshot_updated_at,omitempty"`
+}
 
-	id, err := result.LastInsertId()
+// GetRoomStorageStats returns storage usage for every room holding updates or
+// a snapshot, rooms with the most pending updates first
+func (d *Database) GetRoomStorageStats(ctx context.Context) ([]RoomStorage, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT r.id,
+			COALESCE(u.cnt, 0), COALESCE(u.bytes, 0),
+			COALESCE(LENGTH(s.snapshot_data), 0), COALESCE(s.update_count, 0), s.updated_at
+		FROM rooms r
+		LEFT JOIN (
+			SELECT room_id, COUNT(*) AS cnt, SUM(LENGTH(update_data)) AS bytes
+			FROM document_updates GROUP BY room_id
+		) u ON u.room_id = r.id
+		LEFT JOIN room_snapshots s ON s.room_id = r.id
+		WHERE u.cnt > 0 OR s.room_id IS NOT NULL
+		ORDER BY COALESCE(u.cnt, 0) DESC, r.id ASC
+	`)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return d.GetVersion(int(id))
+	stats := []RoomStorage{}
+	for rows.Next() {
+		var rs RoomStorage
+		if err := rows.Scan(&rs.RoomID, &rs.UpdateCount, &rs.UpdateBytes, &rs.SnapshotBytes, &rs.SnapshotUpdateCount, &rs.SnapshotUpdatedAt); err != nil {
+			return nil, err
+		}
+		stats = append(stats, rs)
+	}
+	return stats, rows.Err()
 }
 
-// GetVersion retrieves a specific version by ID
-func (d *Database) GetVersion(id int) (*Version, error) {
-	row := d.db.QueryRow(`
-		SELECT id, room_id, name, description, content, content_hash, created_by, is_auto, created_at
-		FROM document_versions WHERE id = ?
-	`, id)
+// RoomUsage is the storage a single room occupies
+type RoomUsage struct {
+	UpdateBytes   int64 `json:"update_bytes"`
+	SnapshotBytes int64 `json:"snapshot_bytes"`
+	VersionBytes  int64 `json:"version_bytes"`
+	VersionCount  int   `json:"version_count"`
 
-	var v Version
-	err := row.Scan(&v.ID, &v.RoomID, &v.Name, &v.Description, &v.Content, &v.ContentHash, &v.CreatedBy, &v.IsAuto, &v.CreatedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
+	CompactedAt *time.Time `json:"compacted_at,omitempty"` // When the snapshot was last written
+}
+
+// GetRoomUsage returns the stored update, snapshot and version sizes for a
+// room, and when it was last compacted
+func (d *Database) GetRoomUsage(ctx context.Context, roomID string) (*RoomUsage, error) {
+	var usage RoomUsage
+	err := d.db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COALESCE(SUM(LENGTH(update_data)), 0) FROM document_updates WHERE room_id = ?),
+			COALESCE((SELECT LENGTH(snapshot_data) FROM room_snapshots WHERE room_id = ?), 0),
+			(SELECT COALESCE(SUM(LENGTH(content)), 0) FROM document_versions WHERE room_id = ?) +
+			(SELECT COALESCE(SUM(size), 0) FROM version_blobs
+				WHERE hash IN (SELECT blob_hash FROM document_versions WHERE room_id = ?)),
+			(SELECT COUNT(*) FROM document_versions WHERE room_id = ?),
+			(SELECT updated_at FROM room_snapshots WHERE room_id = ?)
+	`, roomID, roomID, roomID, roomID, roomID, roomID).Scan(&usage.UpdateBytes, &usage.SnapshotBytes, &usage.VersionBytes, &usage.VersionCount, &usage.CompactedAt)
+	if err != nil {
+		return nil, err
 	}
+	return &usage, nil
+}
+
+// Version operations
+
+// Selects a version with its content, which lives in version_blobs except
+// for rows not yet moved there
+const selectVersion = `
+	SELECT v.id, v.room_id, v.name, v.description, COALESCE(b.content, v.content), v.content_hash, v.created_by, v.is_auto, v.created_at,
+		COALESCE(v.parent_version_id, 0), COALESCE(v.restored_from_id, 0), v.pinned
+	FROM document_versions v LEFT JOIN version_blobs b ON b.hash = v.blob_hash`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanVersion(row rowScanner) (*Version, error) {
+	var v Version
+	err := row.Scan(&v.ID, &v.RoomID, &v.Name, &v.Description, &v.Content, &v.ContentHash, &v.CreatedBy, &v.IsAuto, &v.CreatedAt, &v.ParentVersionID, &v.RestoredFromID, &v.Pinned)
 	if err != nil {
 		return nil, err
 	}
 	return &v, nil
 }
 
-// ListVersions returns all versions for a room, newest first
-func (d *Database) ListVersions(roomID string, limit, offset int) ([]Version, error) {
-	rows, err := d.db.Query(`
-		SELECT id, room_id, name, description, content, content_hash, created_by, is_auto, created_at
-		FROM document_versions 
-		WHERE room_id = ?
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`, roomID, limit, offset)
+// Returns the single version a query selects, or nil if it selects none
+func (d *Database) queryVersion(ctx context.Context, where string, args ...interface{}) (*Version, error) {
+	v, err := scanVersion(d.db.QueryRowContext(ctx, selectVersion+" "+where, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return v, err
+}
+
+// Returns every version a query selects
+func (d *Database) queryVersions(ctx context.Context, query string, args ...interface{}) ([]Version, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -326,57 +840,296 @@ func (d *Database) ListVersions(roomID string, limit, offset int) ([]Version, er
 
 	var versions []Version
 	for rows.Next() {
-		var v Version
-		if err := rows.Scan(&v.ID, &v.RoomID, &v.Name, &v.Description, &v.Content, &v.ContentHash, &v.CreatedBy, &v.IsAuto, &v.CreatedAt); err != nil {
+		v, err := scanVersion(rows)
+		if err != nil {
 			return nil, err
 		}
-		versions = append(versions, v)
+		versions = append(versions, *v)
 	}
 	return versions, rows.Err()
 }
 
+// CreateVersion saves a new version of the document. An auto-save of the
+// content of the room's latest version returns that one instead.
+func (d *Database) CreateVersion(ctx context.Context, roomID, name, description, content, contentHash, createdBy string, isAuto bool) (*Version, error) {
+	id, _, err := d.insertVersion(ctx, "", roomID, name, description, content, contentHash, createdBy, isAuto, 0)
+	if err != nil {
+		return nil, err
+	}
+	return d.GetVersion(ctx, int(id))
+}
+
+// CreateRestoredVersion saves a copy of source as the newest version of its
+// room, linked back to it
+func (d *Database) CreateRestoredVersion(ctx context.Context, source *Version, name, description, createdBy string) (*Version, error) {
+	id, _, err := d.insertVersion(ctx, "", source.RoomID, name, description, source.Content, source.ContentHash, createdBy, false, source.ID)
+	if err != nil {
+		return nil, err
+	}
+	return d.GetVersion(ctx, int(id))
+}
+
+// ErrLatestVersionChanged is returned by CreateRestoredVersionIfLatest when
+// the room's newest version is no longer the one the caller expected
+var ErrLatestVersionChanged = errors.New("latest version changed")
+
+// CreateRestoredVersionIfLatest is CreateRestoredVersion, but only while
+// expectedLatest is still the newest version of the room, zero meaning it
+// has none. Otherwise nothing is saved and ErrLatestVersionChanged returned.
+func (d *Database) CreateRestoredVersionIfLatest(ctx context.Context, source *Version, name, description, createdBy string, expectedLatest int) (*Version, error) {
+	var id int64
+	err := d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var latest int
+		if err := tx.QueryRowContext(ctx, `
+			SELECT COALESCE((
+				SELECT id FROM document_versions WHERE room_id = ? ORDER BY created_at DESC, id DESC LIMIT 1
+			), 0)`, source.RoomID).Scan(&latest); err != nil {
+			return err
+		}
+		if latest != expectedLatest {
+			return ErrLatestVersionChanged
+		}
+
+		if id, _, err = insertVersionTx(ctx, tx, "", source.RoomID, name, description, source.Content, source.ContentHash, createdBy, false, source.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.GetVersion(ctx, int(id))
+}
+
+// CreateVersionIdempotent saves a new version unless one was already created
+// in the room with the same idempotency key, or this is an auto-save of the
+// content of the room's latest version, in which case it returns that
+// version and created is false. An empty key never matches.
+func (d *Database) CreateVersionIdempotent(ctx context.Context, key, roomID, name, description, content, contentHash, createdBy string, isAuto bool) (version *Version, created bool, err error) {
+	id, created, err := d.insertVersion(ctx, key, roomID, name, description, content, contentHash, createdBy, isAuto, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	version, err = d.GetVersion(ctx, int(id))
+	return version, created, err
+}
+
+// Stores a version with its content in a shared blob and returns its ID. If
+// the room already has a version with the key, or this is an auto-save and
+// the room's latest version has the same content, the insert is skipped and
+// that version's ID returned with created false. Its parent is whichever
+// version was the room's latest at the time.
+func (d *Database) insertVersion(ctx context.Context, key, roomID, name, description, content, contentHash, createdBy string, isAuto bool, restoredFrom int) (int64, bool, error) {
+	var id int64
+	var created bool
+	err := d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if id, created, err = insertVersionTx(ctx, tx, key, roomID, name, description, content, contentHash, createdBy, isAuto, restoredFrom); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	return id, created, err
+}
+
+func insertVersionTx(ctx context.Context, tx *sql.Tx, key, roomID, name, description, content, contentHash, createdBy string, isAuto bool, restoredFrom int) (int64, bool, error) {
+	// Write transactions run one at a time, so of two clients auto-saving
+	// the same content at once, the second finds the first's save here.
+	// Only the latest version counts, so returning to earlier content is
+	// still saved.
+	if isAuto {
+		var latestID int64
+		err := tx.QueryRowContext(ctx, `
+			SELECT id FROM (
+				SELECT id, blob_hash FROM document_versions
+				WHERE room_id = ? ORDER BY created_at DESC, id DESC LIMIT 1
+			) WHERE blob_hash = ?
+		`, roomID, BlobHash(content)).Scan(&latestID)
+		if err == nil {
+			return latestID, false, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, false, err
+		}
+	}
+
+	insert := "INSERT"
+	var idempotencyKey interface{}
+	if key != "" {
+		insert = "INSERT OR IGNORE"
+		idempotencyKey = key
+	}
+	var restoredFromID interface{}
+	if restoredFrom != 0 {
+		restoredFromID = restoredFrom
+	}
+
+	hash, err := putBlob(ctx, tx, content)
+	if err != nil {
+		return 0, false, err
+	}
+
+	result, err := tx.ExecContext(ctx, insert+` INTO document_versions
+		(room_id, name, description, content, content_hash, blob_hash, created_by, is_auto, idempotency_key,
+			parent_version_id, restored_from_id)
+		VALUES (?, ?, ?, '', ?, ?, ?, ?, ?, (
+			SELECT id FROM document_versions WHERE room_id = ? ORDER BY created_at DESC, id DESC LIMIT 1
+		), ?)
+	`, roomID, name, description, contentHash, hash, createdBy, isAuto, idempotencyKey, roomID, restoredFromID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return 0, false, err
+	} else if n > 0 {
+		id, err := result.LastInsertId()
+		return id, true, err
+	}
+
+	// Nothing refers to a blob this insert just created
+	if err := dropUnusedBlob(ctx, tx, hash); err != nil {
+		return 0, false, err
+	}
+	var id int64
+	err = tx.QueryRowContext(ctx,
+		"SELECT id FROM document_versions WHERE room_id = ? AND idempotency_key = ?", roomID, key,
+	).Scan(&id)
+	return id, false, err
+}
+
+// GetVersionByIdempotencyKey returns the version created in a room with key,
+// or nil if there is none
+func (d *Database) GetVersionByIdempotencyKey(ctx context.Context, roomID, key string) (*Version, error) {
+	return d.queryVersion(ctx, "WHERE v.room_id = ? AND v.idempotency_key = ?", roomID, key)
+}
+
+// GetVersion retrieves a specific version by ID
+func (d *Database) GetVersion(ctx context.Context, id int) (*Version, error) {
+	return d.queryVersion(ctx, "WHERE v.id = ?", id)
+}
+
+// ListVersions returns all versions for a room, newest first
+func (d *Database) ListVersions(ctx context.Context, roomID string, limit, offset int) ([]Version, error) {
+	return d.queryVersions(ctx, selectVersion+`
+		WHERE v.room_id = ?
+		ORDER BY v.created_at DESC, v.id DESC
+		LIMIT ? OFFSET ?
+	`, roomID, limit, offset)
+}
+
+// ListVersionHistory returns every version of a room without its content,
+// oldest first, for drawing the history as a tree
+func (d *Database) ListVersionHistory(ctx context.Context, roomID string) ([]Version, error) {
+	return d.queryVersions(ctx, `
+		SELECT id, room_id, name, description, '', content_hash, created_by, is_auto, created_at,
+			COALESCE(parent_version_id, 0), COALESCE(restored_from_id, 0), pinned
+		FROM document_versions
+		WHERE room_id = ?
+		ORDER BY created_at, id
+	`, roomID)
+}
+
 // GetVersionCount returns the number of versions for a room
-func (d *Database) GetVersionCount(roomID string) (int, error) {
+func (d *Database) GetVersionCount(ctx context.Context, roomID string) (int, error) {
 	var count int
-	err := d.db.QueryRow("SELECT COUNT(*) FROM document_versions WHERE room_id = ?", roomID).Scan(&count)
+	err := d.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM document_versions WHERE room_id = ?", roomID).Scan(&count)
 	return count, err
 }
 
 // GetLatestVersion returns the most recent version for a room
-func (d *Database) GetLatestVersion(roomID string) (*Version, error) {
-	row := d.db.QueryRow(`
-		SELECT id, room_id, name, description, content, content_hash, created_by, is_auto, created_at
-		FROM document_versions 
-		WHERE room_id = ?
-		ORDER BY created_at DESC
-		LIMIT 1
-	`, roomID)
+func (d *Database) GetLatestVersion(ctx context.Context, roomID string) (*Version, error) {
+	return d.queryVersion(ctx, "WHERE v.room_id = ? ORDER BY v.created_at DESC, v.id DESC LIMIT 1", roomID)
+}
 
-	var v Version
-	err := row.Scan(&v.ID, &v.RoomID, &v.Name, &v.Description, &v.Content, &v.ContentHash, &v.CreatedBy, &v.IsAuto, &v.CreatedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
+// ListLatestVersions returns the most recent version of each room with an
+// ID after the given one, in room ID order, for scanning every room's
+// latest content a page at a time. Rooms without versions are skipped, so a
+// short page is the last.
+func (d *Database) ListLatestVersions(ctx context.Context, afterRoomID string, limit int) ([]Version, error) {
+	return d.queryVersions(ctx, selectVersion+`
+		WHERE v.id IN (
+			SELECT (
+				SELECT id FROM document_versions
+				WHERE room_id = r.id ORDER BY created_at DESC, id DESC LIMIT 1
+			)
+			FROM rooms r
+			WHERE r.id > ? AND EXISTS (SELECT 1 FROM document_versions WHERE room_id = r.id)
+			ORDER BY r.id LIMIT ?
+		)
+		ORDER BY v.room_id
+	`, afterRoomID, limit)
+}
+
+// ListManualVersionsAfter returns manually saved versions with IDs above
+// afterID across all rooms, oldest first
+func (d *Database) ListManualVersionsAfter(ctx context.Context, afterID, limit int) ([]Version, error) {
+	return d.queryVersions(ctx, selectVersion+`
+		WHERE v.id > ? AND v.is_auto = FALSE
+		ORDER BY v.id
+		LIMIT ?
+	`, afterID, limit)
+}
+
+// GetPreviousVersion returns the version saved in the same room just before
+// the given one, or nil if it is the room's first
+func (d *Database) GetPreviousVersion(ctx context.Context, id int) (*Version, error) {
+	return d.queryVersion(ctx, `
+		JOIN document_versions cur ON cur.id = ?
+		WHERE v.room_id = cur.room_id
+			AND (v.created_at < cur.created_at OR (v.created_at = cur.created_at AND v.id < cur.id))
+		ORDER BY v.created_at DESC, v.id DESC LIMIT 1
+	`, id)
+}
+
+// SetVersionDescription replaces a version's description. Returns false if
+// the version does not exist.
+func (d *Database) SetVersionDescription(ctx context.Context, id int, description string) (bool, error) {
+	result, err := d.exec(ctx, "UPDATE document_versions SET description = ? WHERE id = ?", description, id)
+	if err != nil {
+		return false, err
 	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetVersionPinned pins or unpins a version. Returns false if the version
+// does not exist.
+func (d *Database) SetVersionPinned(ctx context.Context, id int, pinned bool) (bool, error) {
+	result, err := d.exec(ctx, "UPDATE document_versions SET pinned = ? WHERE id = ?", pinned, id)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	return &v, nil
+	n, err := result.RowsAffected()
+	return n > 0, err
 }
 
 // DeleteVersion removes a version by ID
-func (d *Database) DeleteVersion(id int) error {
-	_, err := d.db.Exec("DELETE FROM document_versions WHERE id = ?", id)
+func (d *Database) DeleteVersion(ctx context.Context, id int) error {
+	_, err := d.exec(ctx, "DELETE FROM document_versions WHERE id = ?", id)
 	return err
 }
 
-// DeleteOldAutoVersions removes old auto-saved versions, keeping the most recent N
-func (d *Database) DeleteOldAutoVersions(roomID string, keepCount int) error {
-	_, err := d.db.Exec(`
+// DeleteOldAutoVersions removes old auto-saved versions, keeping the most
+// recent N. Pinned versions are always kept and don't count towards N.
+func (d *Database) DeleteOldAutoVersions(ctx context.Context, roomID string, keepCount int) error {
+	_, err := d.exec(ctx, `
 		DELETE FROM document_versions 
-		WHERE room_id = ? AND is_auto = TRUE AND id NOT IN (
+		WHERE room_id = ? AND is_auto = TRUE AND pinned = FALSE AND id NOT IN (
 			SELECT id FROM document_versions 
-			WHERE room_id = ? AND is_auto = TRUE
-			ORDER BY created_at DESC 
+			WHERE room_id = ? AND is_auto = TRUE AND pinned = FALSE
+			ORDER BY created_at DESC, id DESC
 			LIMIT ?
 		)
 	`, roomID, roomID, keepCount)
@@ -385,17 +1138,17 @@ func (d *Database) DeleteOldAutoVersions(roomID string, keepCount int) error {
 
 // Stats
 
-func (d *Database) GetStats() (map[string]interface{}, error) {
+func (d *Database) GetStats(ctx context.Context) (map[string]interface{}, error) {
 	stats := make(map[string]interface{})
 
 	var roomCount int
-	if err := d.db.QueryRow("SELECT COUNT(*) FROM rooms").Scan(&roomCount); err != nil {
+	if err := d.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM rooms").Scan(&roomCount); err != nil {
 		return nil, err
 	}
 	stats["room_count"] = roomCount
 
 	var updateCount int
-	if err := d.db.QueryRow("SELECT COUNT(*) FROM document_updates").Scan(&updateCount); err != nil {
+	if err := d.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM document_updates").Scan(&updateCount); err != nil {
 		return nil, err
 	}
 	stats["update_count"] = updateCount
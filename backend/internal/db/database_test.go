@@ -1,12 +1,18 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
-func setupTestDB(t *testing.T) (*Database, func()) {
+func setupTestDB(t testing.TB) (*Database, func()) {
 	t.Helper()
 
 	tmpDir, err := os.MkdirTemp("", "lattice-test-*")
@@ -43,13 +49,13 @@ func TestRoomOperations(t *testing.T) {
 	defer cleanup()
 
 	// Create room
-	err := db.CreateRoom("test-room", "Test Room")
+	err := db.CreateRoom(context.Background(), "test-room", "Test Room")
 	if err != nil {
 		t.Fatalf("Failed to create room: %v", err)
 	}
 
 	// Get room
-	room, err := db.GetRoom("test-room")
+	room, err := db.GetRoom(context.Background(), "test-room")
 	if err != nil {
 		t.Fatalf("Failed to get room: %v", err)
 	}
@@ -64,7 +70,7 @@ func TestRoomOperations(t *testing.T) {
 	}
 
 	// Get non-existent room
-	room, err = db.GetRoom("non-existent")
+	room, err = db.GetRoom(context.Background(), "non-existent")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -72,13 +78,13 @@ func TestRoomOperations(t *testing.T) {
 		t.Error("Non-existent room should return nil")
 	}
 
-	err = db.DeleteRoom("test-room")
+	err = db.DeleteRoom(context.Background(), "test-room")
 	if err != nil {
 		t.Fatalf("Failed to delete room: %v", err)
 	}
 
 	// Verify deletion
-	room, err = db.GetRoom("test-room")
+	room, err = db.GetRoom(context.Background(), "test-room")
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -92,13 +98,13 @@ func TestListRooms(t *testing.T) {
 	defer cleanup()
 
 	for i := 0; i < 5; i++ {
-		err := db.CreateRoom("room-"+string(rune('a'+i)), "Room "+string(rune('A'+i)))
+		err := db.CreateRoom(context.Background(), "room-"+string(rune('a'+i)), "Room "+string(rune('A'+i)))
 		if err != nil {
 			t.Fatalf("Failed to create room: %v", err)
 		}
 	}
 
-	rooms, err := db.ListRooms(10, 0)
+	rooms, err := db.ListRooms(context.Background(), 10, 0)
 	if err != nil {
 		t.Fatalf("Failed to list rooms: %v", err)
 	}
@@ -106,7 +112,7 @@ func TestListRooms(t *testing.T) {
 		t.Errorf("Expected 5 rooms, got %d", len(rooms))
 	}
 
-	rooms, err = db.ListRooms(2, 0)
+	rooms, err = db.ListRooms(context.Background(), 2, 0)
 	if err != nil {
 		t.Fatalf("Failed to list rooms: %v", err)
 	}
@@ -114,7 +120,7 @@ func TestListRooms(t *testing.T) {
 		t.Errorf("Expected 2 rooms with limit, got %d", len(rooms))
 	}
 
-	rooms, err = db.ListRooms(2, 3)
+	rooms, err = db.ListRooms(context.Background(), 2, 3)
 	if err != nil {
 		t.Fatalf("Failed to list rooms: %v", err)
 	}
@@ -123,6 +129,138 @@ func TestListRooms(t *testing.T) {
 	}
 }
 
+func TestListRoomsPage(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for i := 0; i < 5; i++ {
+		if err := db.CreateRoom(context.Background(), "page-"+string(rune('a'+i)), "Room "+string(rune('E'-i))); err != nil {
+			t.Fatalf("Failed to create room: %v", err)
+		}
+	}
+
+	var seen []string
+	opts := RoomListOptions{Limit: 2, Sort: "created_at"}
+	for {
+		page, err := db.ListRoomsPage(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Failed to list rooms page: %v", err)
+		}
+		for _, room := range page.Rooms {
+			seen = append(seen, room.ID)
+		}
+		if page.Next == nil {
+			break
+		}
+		opts.Cursor = page.Next
+	}
+
+	if len(seen) != 5 {
+		t.Fatalf("Expected 5 rooms across pages, got %d (%v)", len(seen), seen)
+	}
+	for i, id := range seen {
+		if expected := "page-" + string(rune('a'+i)); id != expected {
+			t.Errorf("Position %d: expected %s, got %s", i, expected, id)
+		}
+	}
+
+	page, err := db.ListRoomsPage(context.Background(), RoomListOptions{Limit: 1, Sort: "name"})
+	if err != nil {
+		t.Fatalf("Failed to list rooms by name: %v", err)
+	}
+	if page.Rooms[0].Name != "Room A" {
+		t.Errorf("Expected 'Room A' first by name, got %s", page.Rooms[0].Name)
+	}
+
+	if _, err := db.ListRoomsPage(context.Background(), RoomListOptions{Limit: 1, Sort: "bogus"}); err == nil {
+		t.Error("Expected error for invalid sort column")
+	}
+
+	count, err := db.CountRooms(context.Background(), RoomFilter{})
+	if err != nil {
+		t.Fatalf("Failed to count rooms: %v", err)
+	}
+	if count != 5 {
+		t.Errorf("Expected count 5, got %d", count)
+	}
+}
+
+func manyIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("missing-%d", i)
+	}
+	return ids
+}
+
+func TestRoomFilter(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rooms := map[string]string{
+		"filter-a": "Frontend Interview",
+		"filter-b": "Backend interview",
+		"filter-c": "100% done",
+		"filter-d": "",
+	}
+	for id, name := range rooms {
+		if err := db.CreateRoom(context.Background(), id, name); err != nil {
+			t.Fatalf("Failed to create room: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		filter   RoomFilter
+		expected int
+	}{
+		{"no filter", RoomFilter{}, 4},
+		{"name substring is case-insensitive", RoomFilter{NameQuery: "INTERVIEW"}, 2},
+		{"LIKE wildcards are literal", RoomFilter{NameQuery: "%"}, 1},
+		{"restricted to IDs", RoomFilter{IDs: []string{"filter-a", "filter-d"}}, 2},
+		{"empty ID restriction matches nothing", RoomFilter{IDs: []string{}}, 0},
+		{"more IDs than SQLite binds", RoomFilter{IDs: append(manyIDs(40000), "filter-b")}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count, err := db.CountRooms(context.Background(), tt.filter)
+			if err != nil {
+				t.Fatalf("Failed to count rooms: %v", err)
+			}
+			if count != tt.expected {
+				t.Errorf("Expected %d rooms, got %d", tt.expected, count)
+			}
+
+			page, err := db.ListRoomsPage(context.Background(), RoomListOptions{RoomFilter: tt.filter, Limit: 10, Sort: "name"})
+			if err != nil {
+				t.Fatalf("Failed to list rooms: %v", err)
+			}
+			if len(page.Rooms) != tt.expected {
+				t.Errorf("Expected %d listed rooms, got %d", tt.expected, len(page.Rooms))
+			}
+		})
+	}
+
+	future := time.Now().Add(time.Hour)
+	count, err := db.CountRooms(context.Background(), RoomFilter{UpdatedAfter: &future})
+	if err != nil {
+		t.Fatalf("Failed to count rooms: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected no rooms updated after the future, got %d", count)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	count, err = db.CountRooms(context.Background(), RoomFilter{UpdatedAfter: &past})
+	if err != nil {
+		t.Fatalf("Failed to count rooms: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("Expected 4 rooms updated in the last hour, got %d", count)
+	}
+}
+
 func TestDocumentUpdates(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -136,14 +274,14 @@ func TestDocumentUpdates(t *testing.T) {
 	}
 
 	for _, update := range updates {
-		err := db.SaveUpdate(roomID, update)
+		err := db.SaveUpdate(context.Background(), roomID, update)
 		if err != nil {
 			t.Fatalf("Failed to save update: %v", err)
 		}
 	}
 
 	// Get all updates
-	retrieved, err := db.GetAllUpdates(roomID)
+	retrieved, err := db.GetAllUpdates(context.Background(), roomID)
 	if err != nil {
 		t.Fatalf("Failed to get updates: %v", err)
 	}
@@ -161,7 +299,7 @@ func TestDocumentUpdates(t *testing.T) {
 	}
 
 	// Get update count
-	count, err := db.GetUpdateCount(roomID)
+	count, err := db.GetUpdateCount(context.Background(), roomID)
 	if err != nil {
 		t.Fatalf("Failed to get update count: %v", err)
 	}
@@ -170,23 +308,113 @@ func TestDocumentUpdates(t *testing.T) {
 	}
 }
 
+func TestForEachStoredUpdate(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	collect := func(roomID string) []string {
+		t.Helper()
+		var got []string
+		err := db.ForEachStoredUpdate(ctx, roomID, func(data []byte, snapshot bool) error {
+			got = append(got, fmt.Sprintf("%v:%v", snapshot, data))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to read history: %v", err)
+		}
+		return got
+	}
+
+	db.SaveUpdates(ctx, "history", [][]byte{{1}, {2}})
+	if got := strings.Join(collect("history"), " "); got != "false:[1] false:[2]" {
+		t.Errorf("Expected the updates in order, got %s", got)
+	}
+
+	db.SaveSnapshot(ctx, "history", []byte{9}, 2)
+	db.SaveUpdates(ctx, "history", [][]byte{{3}, {4}})
+	if got := strings.Join(collect("history"), " "); got != "true:[9] false:[1] false:[2] false:[3] false:[4]" {
+		t.Errorf("Expected the snapshot first, got %s", got)
+	}
+	if got := collect("empty"); len(got) != 0 {
+		t.Errorf("Expected nothing for an empty room, got %v", got)
+	}
+}
+
+func TestForEachUpdateUntil(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	roomID := "replay-test-room"
+	if err := db.SaveUpdates(ctx, roomID, [][]byte{{1}, {2}, {3}}); err != nil {
+		t.Fatalf("Failed to save updates: %v", err)
+	}
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, id := range []int{1, 2, 3} {
+		stored := base.Add(time.Duration(i) * time.Hour).Format(sqliteTimeFormat)
+		if _, err := db.db.Exec("UPDATE document_updates SET created_at = ? WHERE update_data = ?", stored, []byte{byte(id)}); err != nil {
+			t.Fatalf("Failed to backdate update: %v", err)
+		}
+	}
+
+	for until, want := range map[time.Time]int{
+		base.Add(-time.Second):     0,
+		base:                       1,
+		base.Add(90 * time.Minute): 2,
+		base.Add(2 * time.Hour).In(time.FixedZone("EST", -5*3600)): 3,
+	} {
+		var got []byte
+		err := db.ForEachUpdateUntil(ctx, roomID, until, func(update []byte) error {
+			got = append(got, update...)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to read updates: %v", err)
+		}
+		if len(got) != want {
+			t.Errorf("Until %v: expected %d updates, got %v", until, want, got)
+		}
+	}
+
+	var between []StoredUpdate
+	err := db.ForEachUpdateBetween(ctx, roomID, base, base.Add(time.Hour), func(update StoredUpdate) error {
+		between = append(between, update)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read updates: %v", err)
+	}
+	if len(between) != 1 || between[0].Data[0] != 2 || !between[0].CreatedAt.Equal(base.Add(time.Hour)) {
+		t.Errorf("Expected only the second update, got %+v", between)
+	}
+
+	if snapshot, at, err := db.GetSnapshotAt(ctx, roomID); err != nil || snapshot != nil || at != nil {
+		t.Errorf("Expected no snapshot, got %v at %v (%v)", snapshot, at, err)
+	}
+	db.SaveSnapshot(ctx, roomID, []byte{9}, 3)
+	if _, at, err := db.GetSnapshotAt(ctx, roomID); err != nil || at == nil || time.Since(*at) > time.Minute {
+		t.Errorf("Expected the snapshot's time, got %v (%v)", at, err)
+	}
+}
+
 func TestSnapshots(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
 	roomID := "snapshot-test-room"
-	err := db.CreateRoom(roomID, "Snapshot Test")
+	err := db.CreateRoom(context.Background(), roomID, "Snapshot Test")
 	if err != nil {
 		t.Fatalf("Failed to create room: %v", err)
 	}
 
 	snapshotData := []byte{100, 101, 102, 103}
-	err = db.SaveSnapshot(roomID, snapshotData, 10)
+	err = db.SaveSnapshot(context.Background(), roomID, snapshotData, 10)
 	if err != nil {
 		t.Fatalf("Failed to save snapshot: %v", err)
 	}
 
-	retrieved, count, err := db.GetSnapshot(roomID)
+	retrieved, count, err := db.GetSnapshot(context.Background(), roomID)
 	if err != nil {
 		t.Fatalf("Failed to get snapshot: %v", err)
 	}
@@ -198,12 +426,12 @@ func TestSnapshots(t *testing.T) {
 	}
 
 	newSnapshotData := []byte{200, 201, 202}
-	err = db.SaveSnapshot(roomID, newSnapshotData, 20)
+	err = db.SaveSnapshot(context.Background(), roomID, newSnapshotData, 20)
 	if err != nil {
 		t.Fatalf("Failed to update snapshot: %v", err)
 	}
 
-	_, count, err = db.GetSnapshot(roomID)
+	_, count, err = db.GetSnapshot(context.Background(), roomID)
 	if err != nil {
 		t.Fatalf("Failed to get updated snapshot: %v", err)
 	}
@@ -212,22 +440,78 @@ func TestSnapshots(t *testing.T) {
 	}
 }
 
+func TestCompactUpdates(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	roomID := "compact-room"
+	if err := db.SaveUpdates(ctx, roomID, [][]byte{{1}, {2}, {3}, {4}, {5}}); err != nil {
+		t.Fatalf("Failed to save updates: %v", err)
+	}
+	// Joins the updates into one blob, counting them
+	merge := func(snapshot []byte, updates [][]byte) ([]byte, int, error) {
+		merged := append([]byte(nil), snapshot...)
+		for _, update := range updates {
+			merged = append(merged, update...)
+		}
+		return merged, len(merged), nil
+	}
+
+	result, err := db.CompactUpdates(ctx, roomID, 2, 10, merge)
+	if err != nil || result.Merged != 0 || result.Kept != 5 {
+		t.Fatalf("Expected a room below the minimum left alone, got %+v (%v)", result, err)
+	}
+
+	result, err = db.CompactUpdates(ctx, roomID, 2, 0, merge)
+	if err != nil {
+		t.Fatalf("CompactUpdates failed: %v", err)
+	}
+
+	snapshot, count, _ := db.GetSnapshot(ctx, roomID)
+	remaining, _ := db.GetAllUpdates(ctx, roomID)
+	var all []byte
+	all = append(all, snapshot...)
+	for _, update := range remaining {
+		all = append(all, update...)
+	}
+	if !bytes.Equal(all, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("Expected every update once across snapshot and rows, got %v", all)
+	}
+	if result.Merged != 3 || result.Kept != 2 || len(remaining) != 2 || result.SnapshotCount != count || count != 3 {
+		t.Errorf("Result %+v disagrees with snapshot of %d and %d rows", result, count, len(remaining))
+	}
+
+	// A second compaction builds on the first snapshot
+	if err := db.SaveUpdates(ctx, roomID, [][]byte{{6}, {7}, {8}}); err != nil {
+		t.Fatalf("Failed to save updates: %v", err)
+	}
+	if _, err := db.CompactUpdates(ctx, roomID, 1, 0, merge); err != nil {
+		t.Fatalf("CompactUpdates failed: %v", err)
+	}
+	snapshot, _, _ = db.GetSnapshot(ctx, roomID)
+	remaining, _ = db.GetAllUpdates(ctx, roomID)
+	if !bytes.Equal(snapshot, []byte{1, 2, 3, 4, 5, 6, 7}) || len(remaining) != 1 || remaining[0][0] != 8 {
+		t.Errorf("Expected snapshot 1-7 and update 8, got %v and %v", snapshot, remaining)
+	}
+}
+
 func TestStats(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
 	for i := 0; i < 3; i++ {
-		if err := db.CreateRoom("stats-room-"+string(rune('a'+i)), ""); err != nil {
+		if err := db.CreateRoom(context.Background(), "stats-room-"+string(rune('a'+i)), ""); err != nil {
 			t.Fatalf("Failed to create room: %v", err)
 		}
 	}
 	for i := 0; i < 5; i++ {
-		if err := db.SaveUpdate("stats-room-a", []byte{byte(i)}); err != nil {
+		if err := db.SaveUpdate(context.Background(), "stats-room-a", []byte{byte(i)}); err != nil {
 			t.Fatalf("Failed to save update: %v", err)
 		}
 	}
 
-	stats, err := db.GetStats()
+	stats, err := db.GetStats(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to get stats: %v", err)
 	}
@@ -239,3 +523,650 @@ func TestStats(t *testing.T) {
 		t.Errorf("Expected 5 updates, got %v", stats["update_count"])
 	}
 }
+
+func TestListRoomsOverUpdateThreshold(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	counts := map[string]int{"busy-a": 5, "busy-b": 3, "quiet": 1}
+	for roomID, n := range counts {
+		for i := 0; i < n; i++ {
+			if err := db.SaveUpdate(context.Background(), roomID, []byte{0, 2, 1, byte(i)}); err != nil {
+				t.Fatalf("Failed to save update: %v", err)
+			}
+		}
+	}
+
+	roomIDs, err := db.ListRoomsOverUpdateThreshold(context.Background(), 3, "", 1)
+	if err != nil {
+		t.Fatalf("Failed to list rooms: %v", err)
+	}
+	if len(roomIDs) != 1 || roomIDs[0] != "busy-a" {
+		t.Fatalf("Expected first page [busy-a], got %v", roomIDs)
+	}
+
+	roomIDs, err = db.ListRoomsOverUpdateThreshold(context.Background(), 3, roomIDs[0], 10)
+	if err != nil {
+		t.Fatalf("Failed to list rooms: %v", err)
+	}
+	if len(roomIDs) != 1 || roomIDs[0] != "busy-b" {
+		t.Errorf("Expected second page [busy-b], got %v", roomIDs)
+	}
+}
+
+func TestJoinSecret(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if err := db.CreateRoom(context.Background(), "secret-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	ok, err := db.CheckJoinSecret(context.Background(), "secret-room", "")
+	if err != nil || !ok {
+		t.Fatalf("Room without a secret should admit everyone (ok=%v, err=%v)", ok, err)
+	}
+
+	code := GenerateJoinCode()
+	if len(code) != 6 {
+		t.Fatalf("Expected 6-character join code, got %q", code)
+	}
+	if err := db.SetJoinSecret(context.Background(), "secret-room", code); err != nil {
+		t.Fatalf("Failed to set join secret: %v", err)
+	}
+
+	room, err := db.GetRoom(context.Background(), "secret-room")
+	if err != nil {
+		t.Fatalf("Failed to get room: %v", err)
+	}
+	if !room.Protected {
+		t.Error("Room with a join secret should be protected")
+	}
+
+	if ok, _ := db.CheckJoinSecret(context.Background(), "secret-room", code); !ok {
+		t.Error("Correct join code should be accepted")
+	}
+	if ok, _ := db.CheckJoinSecret(context.Background(), "secret-room", "WRONG1"); ok {
+		t.Error("Wrong join code should be rejected")
+	}
+
+	// The stored hash carries the secret to another room as is
+	hash, err := db.JoinSecretHash(context.Background(), "secret-room")
+	if err != nil || hash == "" {
+		t.Fatalf("Expected the stored hash, got %q (err=%v)", hash, err)
+	}
+	db.CreateRoom(context.Background(), "copied-room", "")
+	if err := db.SetJoinSecretHash(context.Background(), "copied-room", hash); err != nil {
+		t.Fatalf("Failed to set join secret hash: %v", err)
+	}
+	if ok, _ := db.CheckJoinSecret(context.Background(), "copied-room", code); !ok {
+		t.Error("The copied hash should accept the original code")
+	}
+	if err := db.SetJoinSecretHash(context.Background(), "copied-room", code); !errors.Is(err, ErrInvalidJoinSecretHash) {
+		t.Errorf("Expected ErrInvalidJoinSecretHash for a plain secret, got %v", err)
+	}
+
+	if err := db.SetJoinSecret(context.Background(), "secret-room", ""); err != nil {
+		t.Fatalf("Failed to remove join secret: %v", err)
+	}
+	if ok, _ := db.CheckJoinSecret(context.Background(), "secret-room", ""); !ok {
+		t.Error("Room should admit everyone after the secret is removed")
+	}
+}
+
+func TestStatsSamples(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	now := time.Now().Truncate(time.Second)
+	for i := 0; i < 3; i++ {
+		err := db.RecordStatsSample(context.Background(), StatsSample{
+			SampledAt:     now.Add(time.Duration(i-2) * time.Hour),
+			RoomCount:     i,
+			ActiveClients: i * 2,
+			MessageRate:   float64(i),
+		})
+		if err != nil {
+			t.Fatalf("Failed to record sample: %v", err)
+		}
+	}
+
+	samples, err := db.ListStatsSamples(context.Background(), now.Add(-90*time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to list samples: %v", err)
+	}
+	if len(samples) != 2 || samples[0].RoomCount != 1 || samples[1].ActiveClients != 4 {
+		t.Errorf("Unexpected samples: %+v", samples)
+	}
+
+	pruned, err := db.PruneStatsSamples(context.Background(), now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to prune samples: %v", err)
+	}
+	if pruned != 1 {
+		t.Errorf("Expected 1 pruned sample, got %d", pruned)
+	}
+}
+
+func TestRoomClientSamples(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Second)
+	for i := 0; i < 3; i++ {
+		clients := map[string]int{"busy": i + 1, "idle": 0}
+		if err := db.RecordRoomClients(ctx, now.Add(time.Duration(i-2)*time.Hour), clients); err != nil {
+			t.Fatalf("Failed to record clients: %v", err)
+		}
+	}
+
+	samples, err := db.ListRoomClientSamples(ctx, "busy", now.Add(-90*time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to list samples: %v", err)
+	}
+	if len(samples) != 2 || samples[0].Clients != 2 || !samples[1].SampledAt.Equal(now) {
+		t.Errorf("Unexpected samples: %+v", samples)
+	}
+	if samples, _ := db.ListRoomClientSamples(ctx, "idle", time.Time{}); len(samples) != 0 {
+		t.Errorf("Expected rooms without clients to be skipped, got %+v", samples)
+	}
+
+	if pruned, err := db.PruneRoomClientSamples(ctx, now.Add(-time.Hour)); err != nil || pruned != 1 {
+		t.Errorf("Expected 1 pruned sample, got %d (err %v)", pruned, err)
+	}
+}
+
+func TestCreateVersionIdempotent(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	if err := db.CreateRoom(context.Background(), "idem-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	first, created, err := db.CreateVersionIdempotent(context.Background(), "key-1", "idem-room", "v1", "", "hello", "h1", "", false)
+	if err != nil || !created {
+		t.Fatalf("Expected version to be created, got created=%v err=%v", created, err)
+	}
+
+	again, created, err := db.CreateVersionIdempotent(context.Background(), "key-1", "idem-room", "v1 retry", "", "hello", "h1", "", false)
+	if err != nil {
+		t.Fatalf("Failed to retry: %v", err)
+	}
+	if created || again.ID != first.ID || again.Name != "v1" {
+		t.Errorf("Expected the original version back, got created=%v %+v", created, again)
+	}
+
+	// Keys are scoped to a room, and empty keys never deduplicate
+	if err := db.CreateRoom(context.Background(), "other-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	if _, created, _ := db.CreateVersionIdempotent(context.Background(), "key-1", "other-room", "v1", "", "hello", "h1", "", false); !created {
+		t.Error("Expected the same key in another room to create a version")
+	}
+	for i := 0; i < 2; i++ {
+		if _, created, _ := db.CreateVersionIdempotent(context.Background(), "", "idem-room", "v", "", "hello", "h1", "", false); !created {
+			t.Error("Expected versions without a key to always be created")
+		}
+	}
+
+	if count, _ := db.GetVersionCount(context.Background(), "idem-room"); count != 3 {
+		t.Errorf("Expected 3 versions, got %d", count)
+	}
+}
+
+func TestVersionContentDeduplicated(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, id := range []string{"blob-room", "blob-other"} {
+		if err := db.CreateRoom(ctx, id, ""); err != nil {
+			t.Fatalf("Failed to create room: %v", err)
+		}
+	}
+
+	shared := strings.Repeat("shared content\n", 100)
+	first, err := db.CreateVersion(ctx, "blob-room", "v1", "", shared, "h1", "", true)
+	if err != nil {
+		t.Fatalf("Failed to create version: %v", err)
+	}
+	renamed, _ := db.CreateVersion(ctx, "blob-room", "v1 renamed", "", shared, "h1", "", false)
+	db.CreateVersion(ctx, "blob-other", "copy", "", shared, "h1", "", false)
+	db.CreateVersion(ctx, "blob-room", "v2", "", "different", "h2", "", false)
+
+	// A retried idempotent save must not leave an unreferenced blob behind
+	db.CreateVersionIdempotent(ctx, "key", "blob-room", "keyed", "", "keyed", "h3", "", false)
+	db.CreateVersionIdempotent(ctx, "key", "blob-room", "keyed", "", "keyed retry", "h4", "", false)
+
+	storage, err := db.GetVersionStorage(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get version storage: %v", err)
+	}
+	if storage.Versions != 5 || storage.Blobs != 3 {
+		t.Errorf("Expected 5 versions sharing 3 blobs, got %+v", storage)
+	}
+	if storage.StoredBytes >= storage.ContentBytes {
+		t.Errorf("Expected deduplication to save space, got %+v", storage)
+	}
+
+	if got, _ := db.GetVersion(ctx, renamed.ID); got.Content != shared {
+		t.Error("Expected the renamed version to read back the shared content")
+	}
+
+	// Deleting some references keeps the blob; deleting the last drops it
+	db.DeleteVersion(ctx, first.ID)
+	db.DeleteVersion(ctx, renamed.ID)
+	if storage, _ := db.GetVersionStorage(ctx); storage.Blobs != 3 {
+		t.Errorf("Expected the shared blob to survive while referenced, got %d blobs", storage.Blobs)
+	}
+	if versions, _ := db.ListVersions(ctx, "blob-other", 10, 0); len(versions) != 1 || versions[0].Content != shared {
+		t.Error("Expected the other room's copy to keep its content")
+	}
+	db.DeleteVersion(ctx, versions(t, db, "blob-other")[0].ID)
+	if storage, _ := db.GetVersionStorage(ctx); storage.Blobs != 2 {
+		t.Errorf("Expected the shared blob to be dropped with its last version, got %d blobs", storage.Blobs)
+	}
+}
+
+func TestMoveVersionContentToBlobs(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := db.CreateRoom(ctx, "legacy-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	// Versions saved before blobs existed hold their content inline
+	for i := 0; i < 3; i++ {
+		if _, err := db.db.ExecContext(ctx, `
+			INSERT INTO document_versions (room_id, name, content, content_hash) VALUES ('legacy-room', 'old', 'inline', 'h')
+		`); err != nil {
+			t.Fatalf("Failed to insert legacy version: %v", err)
+		}
+	}
+	if got := versions(t, db, "legacy-room"); got[0].Content != "inline" {
+		t.Errorf("Expected inline content to be readable before moving, got %q", got[0].Content)
+	}
+
+	moved, err := db.MoveVersionContentToBlobs(ctx)
+	if err != nil || moved != 3 {
+		t.Fatalf("Expected 3 versions moved, got %d (err %v)", moved, err)
+	}
+	if again, _ := db.MoveVersionContentToBlobs(ctx); again != 0 {
+		t.Errorf("Expected nothing left to move, got %d", again)
+	}
+
+	storage, _ := db.GetVersionStorage(ctx)
+	if storage.Blobs != 1 || storage.StoredBytes != int64(len("inline")) {
+		t.Errorf("Expected one shared blob, got %+v", storage)
+	}
+	for _, v := range versions(t, db, "legacy-room") {
+		if v.Content != "inline" {
+			t.Errorf("Expected moved content to read back, got %q", v.Content)
+		}
+		if v.ContentHash != BlobHash("inline") {
+			t.Errorf("Expected the full content hash after moving, got %q", v.ContentHash)
+		}
+	}
+}
+
+func TestVersionBlobCollision(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := db.CreateRoom(ctx, "collide-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	// Plant different content under the hash of "mine"
+	if _, err := db.db.ExecContext(ctx, "INSERT INTO version_blobs (hash, content, size) VALUES (?, 'theirs', 6)",
+		BlobHash("mine")); err != nil {
+		t.Fatalf("Failed to plant blob: %v", err)
+	}
+
+	if _, err := db.CreateVersion(ctx, "collide-room", "v", "", "mine", BlobHash("mine"), "", false); !errors.Is(err, ErrHashCollision) {
+		t.Errorf("Expected ErrHashCollision, got %v", err)
+	}
+	if count, _ := db.GetVersionCount(ctx, "collide-room"); count != 0 {
+		t.Errorf("Expected no version to be saved, got %d", count)
+	}
+}
+
+func TestVersionParents(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := db.CreateRoom(ctx, "tree-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	first, _ := db.CreateVersion(ctx, "tree-room", "v1", "", "one", BlobHash("one"), "", false)
+	second, _ := db.CreateVersion(ctx, "tree-room", "v2", "", "two", BlobHash("two"), "", false)
+	if first.ParentVersionID != 0 {
+		t.Errorf("Expected the first version to have no parent, got %d", first.ParentVersionID)
+	}
+	if second.ParentVersionID != first.ID {
+		t.Errorf("Expected parent %d, got %d", first.ID, second.ParentVersionID)
+	}
+
+	restored, err := db.CreateRestoredVersion(ctx, first, "Restored", "", "")
+	if err != nil {
+		t.Fatalf("Failed to restore version: %v", err)
+	}
+	if restored.ParentVersionID != second.ID || restored.RestoredFromID != first.ID {
+		t.Errorf("Expected parent %d restored from %d, got %+v", second.ID, first.ID, restored)
+	}
+	if restored.Content != "one" {
+		t.Errorf("Expected restored content, got %q", restored.Content)
+	}
+
+	// Deleting a version moves its children up to its parent
+	if err := db.DeleteVersion(ctx, second.ID); err != nil {
+		t.Fatalf("Failed to delete version: %v", err)
+	}
+	restored, _ = db.GetVersion(ctx, restored.ID)
+	if restored.ParentVersionID != first.ID {
+		t.Errorf("Expected parent %d after deleting %d, got %d", first.ID, second.ID, restored.ParentVersionID)
+	}
+
+	// And drops links to what was restored
+	if err := db.DeleteVersion(ctx, first.ID); err != nil {
+		t.Fatalf("Failed to delete version: %v", err)
+	}
+	history, err := db.ListVersionHistory(ctx, "tree-room")
+	if err != nil {
+		t.Fatalf("Failed to list history: %v", err)
+	}
+	if len(history) != 1 || history[0].ParentVersionID != 0 || history[0].RestoredFromID != 0 {
+		t.Errorf("Expected one unlinked version, got %+v", history)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	secret, user, err := db.CreateUser(ctx, "Ada", "#112233", nil)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if !strings.HasPrefix(user.ID, UserIDPrefix) || user.Name != "Ada" || string(user.Preferences) != "{}" {
+		t.Errorf("Unexpected user %+v", user)
+	}
+
+	for _, tt := range []struct {
+		id, secret string
+		want       bool
+	}{
+		{user.ID, secret, true},
+		{user.ID, secret + "x", false},
+		{user.ID, "", false},
+		{"user-0000000000000000", secret, false},
+	} {
+		if ok, err := db.CheckUserSecret(ctx, tt.id, tt.secret); err != nil || ok != tt.want {
+			t.Errorf("CheckUserSecret(%s, %q) = %v, %v; want %v", tt.id, tt.secret, ok, err, tt.want)
+		}
+	}
+
+	updated, err := db.UpdateUser(ctx, user.ID, "Ada L", "#445566", []byte(`{"theme":"dark"}`))
+	if err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	if updated.Name != "Ada L" || updated.Color != "#445566" || string(updated.Preferences) != `{"theme":"dark"}` {
+		t.Errorf("Unexpected updated user %+v", updated)
+	}
+	if missing, err := db.UpdateUser(ctx, "user-missing", "x", "#000000", []byte("{}")); err != nil || missing != nil {
+		t.Errorf("Expected no user to update, got %+v, %v", missing, err)
+	}
+
+	if deleted, err := db.DeleteUser(ctx, user.ID); err != nil || !deleted {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+	if gone, err := db.GetUser(ctx, user.ID); err != nil || gone != nil {
+		t.Errorf("Expected the user to be gone, got %+v, %v", gone, err)
+	}
+}
+
+func TestUserRooms(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	_, user, err := db.CreateUser(ctx, "Ada", "#112233", nil)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	db.CreateRoom(ctx, "named", "Named Room")
+	db.CreateRoom(ctx, "archived", "")
+	db.ArchiveRoom(ctx, "archived")
+
+	for i := 0; i < maxRecentRooms+5; i++ {
+		db.RecordRoomVisit(ctx, user.ID, fmt.Sprintf("room-%d", i))
+	}
+	for _, roomID := range []string{"archived", "named"} {
+		if err := db.RecordRoomVisit(ctx, user.ID, roomID); err != nil {
+			t.Fatalf("Failed to record visit: %v", err)
+		}
+	}
+	recent, err := db.ListRecentRooms(ctx, user.ID, 100)
+	if err != nil {
+		t.Fatalf("Failed to list recent rooms: %v", err)
+	}
+	// The cap counts the archived room, which is hidden from the list
+	if len(recent) != maxRecentRooms-1 {
+		t.Fatalf("Expected %d recent rooms, got %d", maxRecentRooms-1, len(recent))
+	}
+	if recent[0].RoomID != "named" || recent[0].Name != "Named Room" || recent[1].RoomID != fmt.Sprintf("room-%d", maxRecentRooms+4) {
+		t.Errorf("Expected the latest visits first, got %+v", recent[:2])
+	}
+	if forgot, err := db.ForgetRecentRoom(ctx, user.ID, "named"); err != nil || !forgot {
+		t.Errorf("Failed to forget room: %v", err)
+	}
+
+	for _, roomID := range []string{"named", "archived", "named"} {
+		if _, err := db.AddFavoriteRoom(ctx, user.ID, roomID); err != nil {
+			t.Fatalf("Failed to star %s: %v", roomID, err)
+		}
+	}
+	favorites, err := db.ListFavoriteRooms(ctx, user.ID)
+	if err != nil || len(favorites) != 2 {
+		t.Fatalf("Expected 2 favorites including the archived room, got %+v, %v", favorites, err)
+	}
+	if removed, err := db.RemoveFavoriteRoom(ctx, user.ID, "named"); err != nil || !removed {
+		t.Errorf("Failed to unstar room: %v", err)
+	}
+
+	db.DeleteUser(ctx, user.ID)
+	recent, _ = db.ListRecentRooms(ctx, user.ID, 100)
+	favorites, _ = db.ListFavoriteRooms(ctx, user.ID)
+	if len(recent) != 0 || len(favorites) != 0 {
+		t.Errorf("Expected a deleted user's rooms gone, got %d recent and %d favorites", len(recent), len(favorites))
+	}
+}
+
+func TestWorkspaces(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	_, ada, _ := db.CreateUser(ctx, "Ada", "#112233", nil)
+	_, grace, _ := db.CreateUser(ctx, "Grace", "#445566", nil)
+
+	if _, err := db.CreateWorkspace(ctx, "team", "Team", ada.ID); err != nil {
+		t.Fatalf("Failed to create workspace: %v", err)
+	}
+	if _, err := db.CreateWorkspace(ctx, "team", "Other", grace.ID); !errors.Is(err, ErrWorkspaceExists) {
+		t.Errorf("Expected ErrWorkspaceExists, got %v", err)
+	}
+	if role, _ := db.WorkspaceRole(ctx, "team", ada.ID); role != WorkspaceRoleOwner {
+		t.Errorf("Expected the creator to own the workspace, got %q", role)
+	}
+
+	// The only owner can neither step down nor leave
+	if err := db.SetWorkspaceMember(ctx, "team", ada.ID, WorkspaceRoleMember); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("Expected ErrLastOwner demoting the only owner, got %v", err)
+	}
+	if _, err := db.RemoveWorkspaceMember(ctx, "team", ada.ID); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("Expected ErrLastOwner removing the only owner, got %v", err)
+	}
+	if err := db.SetWorkspaceMember(ctx, "team", grace.ID, WorkspaceRoleMember); err != nil {
+		t.Fatalf("Failed to add member: %v", err)
+	}
+	members, _ := db.ListWorkspaceMembers(ctx, "team")
+	if len(members) != 2 || members[0].UserID != ada.ID || members[1].Role != WorkspaceRoleMember {
+		t.Errorf("Expected the owner then the member, got %+v", members)
+	}
+	if list, _ := db.ListUserWorkspaces(ctx, grace.ID); len(list) != 1 || list[0].Role != WorkspaceRoleMember {
+		t.Errorf("Expected grace in one workspace, got %+v", list)
+	}
+
+	// Rooms move in within the room limit, and only from outside any workspace
+	db.SetWorkspaceQuota(ctx, "team", 2, 1024)
+	db.CreateRoom(ctx, "existing", "Existing")
+	db.SaveUpdate(ctx, "existing", []byte{1, 2, 3})
+	if err := db.ClaimRoomForWorkspace(ctx, "team", "existing"); !errors.Is(err, ErrRoomInUse) {
+		t.Errorf("Expected ErrRoomInUse, got %v", err)
+	}
+	for _, roomID := range []string{"existing", "fresh", "existing"} {
+		if err := db.AddRoomToWorkspace(ctx, "team", roomID, ""); err != nil {
+			t.Fatalf("Failed to add %s: %v", roomID, err)
+		}
+	}
+	if err := db.AddRoomToWorkspace(ctx, "team", "third", ""); !errors.Is(err, ErrWorkspaceFull) {
+		t.Errorf("Expected ErrWorkspaceFull, got %v", err)
+	}
+	db.CreateWorkspace(ctx, "other", "Other", grace.ID)
+	if err := db.AddRoomToWorkspace(ctx, "other", "fresh", ""); !errors.Is(err, ErrRoomInOtherWorkspace) {
+		t.Errorf("Expected ErrRoomInOtherWorkspace, got %v", err)
+	}
+
+	if ws, _ := db.RoomWorkspace(ctx, "fresh"); ws == nil || ws.ID != "team" || ws.MaxRoomBytes != 1024 {
+		t.Errorf("Expected fresh in team with its quota, got %+v", ws)
+	}
+	if room, _ := db.GetRoom(ctx, "existing"); room.Workspace != "team" {
+		t.Errorf("Expected the room to report its workspace, got %q", room.Workspace)
+	}
+	usage, err := db.GetWorkspaceUsage(ctx, "team")
+	if err != nil || usage.Rooms != 2 || usage.UpdateBytes != 3 {
+		t.Errorf("Unexpected usage %+v, %v", usage, err)
+	}
+
+	team, outside := "team", ""
+	if count, _ := db.CountRooms(ctx, RoomFilter{Workspace: &team}); count != 2 {
+		t.Errorf("Expected 2 rooms in the workspace, got %d", count)
+	}
+	db.CreateRoom(ctx, "public", "")
+	if count, _ := db.CountRooms(ctx, RoomFilter{Workspace: &outside}); count != 1 {
+		t.Errorf("Expected 1 room outside workspaces, got %d", count)
+	}
+
+	if _, err := db.DeleteWorkspace(ctx, "team"); !errors.Is(err, ErrWorkspaceNotEmpty) {
+		t.Errorf("Expected ErrWorkspaceNotEmpty, got %v", err)
+	}
+	for _, roomID := range []string{"existing", "fresh"} {
+		if removed, err := db.RemoveRoomFromWorkspace(ctx, "team", roomID); err != nil || !removed {
+			t.Errorf("Failed to remove %s: %v", roomID, err)
+		}
+	}
+	if deleted, err := db.DeleteWorkspace(ctx, "team"); err != nil || !deleted {
+		t.Errorf("Failed to delete workspace: %v", err)
+	}
+	if list, _ := db.ListUserWorkspaces(ctx, ada.ID); len(list) != 0 {
+		t.Errorf("Expected no workspaces left for ada, got %+v", list)
+	}
+}
+
+func versions(t *testing.T, db *Database, roomID string) []Version {
+	t.Helper()
+	list, err := db.ListVersions(context.Background(), roomID, 100, 0)
+	if err != nil {
+		t.Fatalf("Failed to list versions: %v", err)
+	}
+	return list
+}
+
+func TestAutoSaveSkipsLatestContent(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := db.CreateRoom(ctx, "auto-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	first, err := db.CreateVersion(ctx, "auto-room", "Auto-save", "", "same", BlobHash("same"), "", true)
+	if err != nil {
+		t.Fatalf("Failed to create version: %v", err)
+	}
+	again, created, err := db.CreateVersionIdempotent(ctx, "", "auto-room", "Auto-save later", "", "same", BlobHash("same"), "", true)
+	if err != nil {
+		t.Fatalf("Failed to create version: %v", err)
+	}
+	if created || again.ID != first.ID {
+		t.Errorf("Expected auto-save %d back, got created=%v %+v", first.ID, created, again)
+	}
+
+	// Going back to earlier content is a new save
+	db.CreateVersion(ctx, "auto-room", "Edit", "", "other", BlobHash("other"), "", true)
+	if _, created, _ := db.CreateVersionIdempotent(ctx, "", "auto-room", "Revert", "", "same", BlobHash("same"), "", true); !created {
+		t.Error("Expected an auto-save reverting to earlier content to be created")
+	}
+
+	// Manual saves of the same content are always kept
+	if _, created, _ := db.CreateVersionIdempotent(ctx, "", "auto-room", "Manual", "", "same", BlobHash("same"), "", false); !created {
+		t.Error("Expected a manual save to be created")
+	}
+	if count, _ := db.GetVersionCount(ctx, "auto-room"); count != 4 {
+		t.Errorf("Expected 4 versions, got %d", count)
+	}
+	storage, _ := db.GetVersionStorage(ctx)
+	if storage.Blobs != 2 {
+		t.Errorf("Expected one blob per content, got %+v", storage)
+	}
+}
+
+func TestPinnedVersionsSurvivePruning(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := db.CreateRoom(ctx, "pin-room", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	var autos []*Version
+	for i := 0; i < 4; i++ {
+		content := fmt.Sprintf("auto %d", i)
+		v, err := db.CreateVersion(ctx, "pin-room", "Auto-save", "", content, BlobHash(content), "", true)
+		if err != nil {
+			t.Fatalf("Failed to create version: %v", err)
+		}
+		autos = append(autos, v)
+	}
+	if found, err := db.SetVersionPinned(ctx, autos[0].ID, true); !found || err != nil {
+		t.Fatalf("Failed to pin version: found=%v err=%v", found, err)
+	}
+	if found, _ := db.SetVersionPinned(ctx, 9999, true); found {
+		t.Error("Expected pinning a missing version to report it not found")
+	}
+
+	if err := db.DeleteOldAutoVersions(ctx, "pin-room", 1); err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	versions, _ := db.ListVersions(ctx, "pin-room", 10, 0)
+	if len(versions) != 2 || versions[0].ID != autos[3].ID || versions[1].ID != autos[0].ID || !versions[1].Pinned {
+		t.Errorf("Expected the newest and the pinned auto-save to be kept, got %+v", versions)
+	}
+
+	db.SetVersionPinned(ctx, autos[0].ID, false)
+	db.DeleteOldAutoVersions(ctx, "pin-room", 1)
+	if count, _ := db.GetVersionCount(ctx, "pin-room"); count != 1 {
+		t.Errorf("Expected an unpinned version to be pruned, got %d versions", count)
+	}
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+)
+
+// EmbeddingChunk is a run of lines from a room's indexed version with its
+// embedding vector
+type EmbeddingChunk struct {
+	RoomID      string
+	VersionID   int
+	StartLine   int
+	EndLine     int
+	Content     string
+	ContentHash string
+	Model       string
+	Embedding   []float32
+}
+
+func encodeVector(v []float32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(f))
+	}
+	return b
+}
+
+func decodeVector(b []byte) []float32 {
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v
+}
+
+// ReplaceEmbeddingChunks replaces a room's indexed chunks in one transaction
+func (d *Database) ReplaceEmbeddingChunks(ctx context.Context, roomID string, chunks []EmbeddingChunk) error {
+	return d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM embedding_chunks WHERE room_id = ?", roomID); err != nil {
+			return err
+		}
+		for _, c := range chunks {
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO embedding_chunks (room_id, version_id, start_line, end_line, content, content_hash, model, embedding)
+				 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				roomID, c.VersionID, c.StartLine, c.EndLine, c.Content, c.ContentHash, c.Model, encodeVector(c.Embedding),
+			); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// GetEmbeddingChunks returns a room's indexed chunks in line order
+func (d *Database) GetEmbeddingChunks(ctx context.Context, roomID string) ([]EmbeddingChunk, error) {
+	rows, err := d.db.QueryContext(ctx,
+		`SELECT version_id, start_line, end_line, content, content_hash, model, embedding
+		 FROM embedding_chunks WHERE room_id = ? ORDER BY start_line`,
+		roomID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []EmbeddingChunk
+	for rows.Next() {
+		c := EmbeddingChunk{RoomID: roomID}
+		var vector []byte
+		if err := rows.Scan(&c.VersionID, &c.StartLine, &c.EndLine, &c.Content, &c.ContentHash, &c.Model, &vector); err != nil {
+			return nil, err
+		}
+		c.Embedding = decodeVector(vector)
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
+
+// EmbeddingVersion returns the version a room's chunks were built from, or
+// zero if the room is not indexed
+func (d *Database) EmbeddingVersion(ctx context.Context, roomID string) (int, error) {
+	var versionID int
+	err := d.db.QueryRowContext(ctx,
+		"SELECT COALESCE(MAX(version_id), 0) FROM embedding_chunks WHERE room_id = ?", roomID,
+	).Scan(&versionID)
+	return versionID, err
+}
@@ -0,0 +1,213 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"hash/crc32"
+
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// Quarantine reasons
+const (
+	ReasonChecksumMismatch = "checksum_mismatch"
+	ReasonMalformed        = "malformed"
+)
+
+// CRC32 stored alongside every update and snapshot blob
+func checksum(data []byte) int64 {
+	return int64(crc32.ChecksumIEEE(data))
+}
+
+// QuarantinedBlob describes a stored blob that failed verification
+type QuarantinedBlob struct {
+	Source     string `json:"source"` // "update" or "snapshot"
+	OriginalID int64  `json:"original_id,omitempty"`
+	Size       int    `json:"size"`
+	Reason     string `json:"reason"`
+}
+
+// VerifyReport summarizes a verification pass over one room
+type VerifyReport struct {
+	RoomID      string            `json:"room_id"`
+	Checked     int               `json:"checked"`
+	Backfilled  int               `json:"backfilled"`
+	Quarantined []QuarantinedBlob `json:"quarantined"`
+}
+
+// Affected reports whether anything was quarantined
+func (r *VerifyReport) Affected() bool {
+	return len(r.Quarantined) > 0
+}
+
+// VerifyRoom checks the room's snapshot and updates against their stored
+// checksums and the sync frame layout. Bad blobs are moved to
+// quarantined_updates so they are never served to clients. Rows written
+// before checksums existed are checked structurally and then backfilled.
+func (d *Database) VerifyRoom(ctx context.Context, roomID string) (*VerifyReport, error) {
+	report := &VerifyReport{RoomID: roomID, Quarantined: []QuarantinedBlob{}}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var snapshot []byte
+	var snapshotSum sql.NullInt64
+	err = tx.QueryRowContext(ctx,
+		"SELECT snapshot_data, checksum FROM room_snapshots WHERE room_id = ?",
+		roomID,
+	).Scan(&snapshot, &snapshotSum)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err == nil {
+		report.Checked++
+		if snapshotSum.Valid && snapshotSum.Int64 != checksum(snapshot) {
+			if err := quarantine(ctx, tx, roomID, "snapshot", 0, snapshot, snapshotSum, ReasonChecksumMismatch); err != nil {
+				return nil, err
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM room_snapshots WHERE room_id = ?", roomID); err != nil {
+				return nil, err
+			}
+			report.Quarantined = append(report.Quarantined, QuarantinedBlob{
+				Source: "snapshot",
+				Size:   len(snapshot),
+				Reason: ReasonChecksumMismatch,
+			})
+		} else if !snapshotSum.Valid {
+			if _, err := tx.ExecContext(ctx, "UPDATE room_snapshots SET checksum = ? WHERE room_id = ?", checksum(snapshot), roomID); err != nil {
+				return nil, err
+			}
+			report.Backfilled++
+		}
+	}
+
+	type row struct {
+		id   int64
+		data []byte
+		sum  sql.NullInt64
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT id, update_data, checksum FROM document_updates WHERE room_id = ? ORDER BY id ASC",
+		roomID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.data, &r.sum); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		updates = append(updates, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range updates {
+		report.Checked++
+
+		reason := ""
+		switch {
+		case r.sum.Valid && r.sum.Int64 != checksum(r.data):
+			reason = ReasonChecksumMismatch
+		case !protocol.IsWellFormed(r.data):
+			reason = ReasonMalformed
+		}
+
+		if reason == "" {
+			if !r.sum.Valid {
+				if _, err := tx.ExecContext(ctx, "UPDATE document_updates SET checksum = ? WHERE id = ?", checksum(r.data), r.id); err != nil {
+					return nil, err
+				}
+				report.Backfilled++
+			}
+			continue
+		}
+
+		if err := quarantine(ctx, tx, roomID, "update", r.id, r.data, r.sum, reason); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM document_updates WHERE id = ?", r.id); err != nil {
+			return nil, err
+		}
+		report.Quarantined = append(report.Quarantined, QuarantinedBlob{
+			Source:     "update",
+			OriginalID: r.id,
+			Size:       len(r.data),
+			Reason:     reason,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// VerifyAllRooms verifies every room and returns reports for the rooms that
+// had blobs quarantined, along with the number of rooms checked
+func (d *Database) VerifyAllRooms(ctx context.Context) ([]*VerifyReport, int, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT room_id FROM document_updates
+		UNION
+		SELECT room_id FROM room_snapshots
+	`)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var roomIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		roomIDs = append(roomIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	affected := []*VerifyReport{}
+	for _, roomID := range roomIDs {
+		report, err := d.VerifyRoom(ctx, roomID)
+		if err != nil {
+			return nil, 0, err
+		}
+		if report.Affected() {
+			affected = append(affected, report)
+		}
+	}
+	return affected, len(roomIDs), nil
+}
+
+// GetQuarantineCount returns how many blobs have been quarantined for a room
+func (d *Database) GetQuarantineCount(ctx context.Context, roomID string) (int, error) {
+	var count int
+	err := d.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM quarantined_updates WHERE room_id = ?", roomID).Scan(&count)
+	return count, err
+}
+
+func quarantine(ctx context.Context, tx *sql.Tx, roomID, source string, originalID int64, data []byte, sum sql.NullInt64, reason string) error {
+	var id interface{}
+	if originalID != 0 {
+		id = originalID
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO quarantined_updates (room_id, source, original_id, data, checksum, reason)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, roomID, source, id, data, sum, reason)
+	return err
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestVerifyRoomQuarantinesCorruptUpdates(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	roomID := "verify-room"
+	updates := [][]byte{
+		{0, 2, 2, 1, 1}, // valid
+		{0, 2, 5, 1, 1}, // truncated payload
+		{0, 2, 1, 9},    // valid, corrupted below
+	}
+	if err := db.SaveUpdates(context.Background(), roomID, updates); err != nil {
+		t.Fatalf("Failed to save updates: %v", err)
+	}
+
+	if _, err := db.db.Exec(
+		"UPDATE document_updates SET update_data = ? WHERE room_id = ? AND id = (SELECT MAX(id) FROM document_updates)",
+		[]byte{0, 2, 1, 8}, roomID,
+	); err != nil {
+		t.Fatalf("Failed to corrupt update: %v", err)
+	}
+
+	report, err := db.VerifyRoom(context.Background(), roomID)
+	if err != nil {
+		t.Fatalf("Failed to verify room: %v", err)
+	}
+
+	if report.Checked != 3 {
+		t.Errorf("Expected 3 blobs checked, got %d", report.Checked)
+	}
+	if len(report.Quarantined) != 2 {
+		t.Fatalf("Expected 2 quarantined blobs, got %d", len(report.Quarantined))
+	}
+	if report.Quarantined[0].Reason != ReasonMalformed {
+		t.Errorf("Expected truncated update to be malformed, got %s", report.Quarantined[0].Reason)
+	}
+	if report.Quarantined[1].Reason != ReasonChecksumMismatch {
+		t.Errorf("Expected corrupted update to fail checksum, got %s", report.Quarantined[1].Reason)
+	}
+
+	remaining, err := db.GetAllUpdates(context.Background(), roomID)
+	if err != nil {
+		t.Fatalf("Failed to get updates: %v", err)
+	}
+	if len(remaining) != 1 {
+		t.Errorf("Expected 1 update left after quarantine, got %d", len(remaining))
+	}
+
+	if count, _ := db.GetQuarantineCount(context.Background(), roomID); count != 2 {
+		t.Errorf("Expected 2 quarantined rows, got %d", count)
+	}
+
+	// A second pass finds nothing new
+	report, err = db.VerifyRoom(context.Background(), roomID)
+	if err != nil {
+		t.Fatalf("Failed to re-verify room: %v", err)
+	}
+	if report.Affected() {
+		t.Errorf("Expected clean second pass, got %v", report.Quarantined)
+	}
+}
+
+func TestVerifyRoomSnapshotChecksum(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	roomID := "verify-snapshot"
+	if err := db.CreateRoom(context.Background(), roomID, ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	if err := db.SaveSnapshot(context.Background(), roomID, []byte{1, 2, 3, 4}, 4); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+
+	if _, err := db.db.Exec("UPDATE room_snapshots SET snapshot_data = ? WHERE room_id = ?", []byte{1, 2}, roomID); err != nil {
+		t.Fatalf("Failed to truncate snapshot: %v", err)
+	}
+
+	reports, checked, err := db.VerifyAllRooms(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to verify rooms: %v", err)
+	}
+	if checked != 1 || len(reports) != 1 {
+		t.Fatalf("Expected 1 checked and 1 affected room, got %d and %d", checked, len(reports))
+	}
+
+	snapshot, _, err := db.GetSnapshot(context.Background(), roomID)
+	if err != nil {
+		t.Fatalf("Failed to get snapshot: %v", err)
+	}
+	if snapshot != nil {
+		t.Error("Corrupted snapshot should have been quarantined")
+	}
+}
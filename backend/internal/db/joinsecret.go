@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidJoinSecretHash is returned when a stored join secret is not in
+// the form hashJoinSecret writes
+var ErrInvalidJoinSecretHash = errors.New("invalid join secret hash")
+
+// Join codes avoid characters that are easy to confuse when read aloud
+const joinCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const joinCodeLength = 6
+
+// GenerateJoinCode returns a random 6-character code for sharing a room
+func GenerateJoinCode() string {
+	b := make([]byte, joinCodeLength)
+	rand.Read(b)
+	for i := range b {
+		b[i] = joinCodeAlphabet[int(b[i])%len(joinCodeAlphabet)]
+	}
+	return string(b)
+}
+
+// Join secrets are stored as "salt$sha256(salt+secret)"; they only guard
+// casual sharing, not accounts
+func hashJoinSecret(secret string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	saltHex := hex.EncodeToString(salt)
+	sum := sha256.Sum256([]byte(saltHex + secret))
+	return saltHex + "$" + hex.EncodeToString(sum[:])
+}
+
+func matchJoinSecret(stored, secret string) bool {
+	saltHex, digest, ok := strings.Cut(stored, "$")
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(saltHex + secret))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(digest)) == 1
+}
+
+// SetJoinSecret replaces a room's join secret; an empty secret removes it
+func (d *Database) SetJoinSecret(ctx context.Context, roomID, secret string) error {
+	var stored interface{}
+	if secret != "" {
+		stored = hashJoinSecret(secret)
+	}
+	_, err := d.exec(ctx, "UPDATE rooms SET join_secret = ? WHERE id = ?", stored, roomID)
+	return err
+}
+
+// JoinSecretHash returns a room's join secret as stored, or "" if it has
+// none, for copying the secret to another server
+func (d *Database) JoinSecretHash(ctx context.Context, roomID string) (string, error) {
+	var stored sql.NullString
+	err := d.db.QueryRowContext(ctx, "SELECT join_secret FROM rooms WHERE id = ?", roomID).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return stored.String, err
+}
+
+// ValidateJoinSecretHash returns ErrInvalidJoinSecretHash unless hash is
+// empty or in the form JoinSecretHash returns
+func ValidateJoinSecretHash(hash string) error {
+	if hash == "" {
+		return nil
+	}
+	salt, digest, ok := strings.Cut(hash, "$")
+	if _, err := hex.DecodeString(salt); !ok || err != nil || salt == "" {
+		return ErrInvalidJoinSecretHash
+	}
+	if sum, err := hex.DecodeString(digest); err != nil || len(sum) != sha256.Size {
+		return ErrInvalidJoinSecretHash
+	}
+	return nil
+}
+
+// SetJoinSecretHash replaces a room's join secret with one stored as
+// JoinSecretHash returned it; an empty hash removes it
+func (d *Database) SetJoinSecretHash(ctx context.Context, roomID, hash string) error {
+	if err := ValidateJoinSecretHash(hash); err != nil {
+		return err
+	}
+	var stored interface{}
+	if hash != "" {
+		stored = hash
+	}
+	_, err := d.exec(ctx, "UPDATE rooms SET join_secret = ? WHERE id = ?", stored, roomID)
+	return err
+}
+
+// CheckJoinSecret reports whether secret admits a client to the room. Rooms
+// without a secret, including rooms that do not exist yet, admit everyone.
+func (d *Database) CheckJoinSecret(ctx context.Context, roomID, secret string) (bool, error) {
+	var stored sql.NullString
+	err := d.db.QueryRowContext(ctx, "SELECT join_secret FROM rooms WHERE id = ?", roomID).Scan(&stored)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !stored.Valid {
+		return true, nil
+	}
+	return matchJoinSecret(stored.String, secret), nil
+}
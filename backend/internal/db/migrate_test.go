@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	database, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+
+	statuses, err := database.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get migration status: %v", err)
+	}
+	if len(statuses) != len(migrations) {
+		t.Fatalf("Expected %d statuses, got %d", len(migrations), len(statuses))
+	}
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			t.Errorf("Expected migration %d to be applied on open", s.Version)
+		}
+	}
+
+	if n, err := database.Migrate(ctx); err != nil || n != 0 {
+		t.Errorf("Expected no pending migrations, got %d (err %v)", n, err)
+	}
+
+	if n, err := database.MigrateDown(ctx, 0); err != nil || n != len(migrations) {
+		t.Fatalf("Expected to revert %d migrations, got %d (err %v)", len(migrations), n, err)
+	}
+	if exists, _ := tableExists(ctx, database.db, "rooms"); exists {
+		t.Error("Expected rooms table to be dropped")
+	}
+
+	if n, err := database.Migrate(ctx); err != nil || n != len(migrations) {
+		t.Fatalf("Expected to apply %d migrations, got %d (err %v)", len(migrations), n, err)
+	}
+	if err := database.CreateRoom(ctx, "room-1", "Room"); err != nil {
+		t.Errorf("Failed to create room after re-migrating: %v", err)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "legacy.db")
+	ctx := context.Background()
+
+	// The schema as it was before checksums, archiving, join secrets and
+	// idempotency keys
+	legacy, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open legacy database: %v", err)
+	}
+	_, err = legacy.Exec(`
+		CREATE TABLE rooms (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE document_updates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			room_id TEXT NOT NULL,
+			update_data BLOB NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE document_versions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			room_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			description TEXT DEFAULT '',
+			content TEXT NOT NULL,
+			content_hash TEXT NOT NULL,
+			created_by TEXT DEFAULT '',
+			is_auto BOOLEAN DEFAULT FALSE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO rooms (id, name) VALUES ('old-room', 'Old');
+		INSERT INTO document_versions (room_id, name, content, content_hash, is_auto) VALUES
+			('old-room', 'Auto-save', 'same', 'h', TRUE),
+			('old-room', 'Auto-save', 'same', 'h', TRUE);
+	`)
+	legacy.Close()
+	if err != nil {
+		t.Fatalf("Failed to create legacy schema: %v", err)
+	}
+
+	database, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open legacy database: %v", err)
+	}
+	defer database.Close()
+
+	room, err := database.GetRoom(ctx, "old-room")
+	if err != nil || room == nil {
+		t.Fatalf("Expected legacy room to survive, got %v (err %v)", room, err)
+	}
+	if count, _ := database.GetVersionCount(ctx, "old-room"); count != 2 {
+		t.Errorf("Expected both auto-saves to be kept, got %d versions", count)
+	}
+	if err := database.ArchiveRoom(ctx, "old-room"); err != nil {
+		t.Errorf("Expected archived_at to be added: %v", err)
+	}
+	if _, _, err := database.CreateVersionIdempotent(ctx, "key", "old-room", "v1", "", "content", "hash", "", false); err != nil {
+		t.Errorf("Expected idempotency_key to be added: %v", err)
+	}
+	if err := database.SaveUpdate(ctx, "old-room", []byte{0, 2, 1}); err != nil {
+		t.Errorf("Expected checksum to be added: %v", err)
+	}
+	if exists, _ := tableExists(ctx, database.db, "stats_samples"); !exists {
+		t.Error("Expected missing tables to be created")
+	}
+}
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS stats_samples;
+DROP TABLE IF EXISTS quarantined_updates;
+DROP TABLE IF EXISTS document_versions;
+DROP TABLE IF EXISTS room_snapshots;
+DROP TABLE IF EXISTS document_updates;
+DROP TABLE IF EXISTS rooms;
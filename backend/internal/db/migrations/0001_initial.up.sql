@@ -0,0 +1,73 @@
+-- Baseline schema. Databases created before migrations existed already have
+-- these tables; upgradeLegacySchema brings their columns up to date first.
+
+CREATE TABLE IF NOT EXISTS rooms (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	archived_at DATETIME,
+	join_secret TEXT
+);
+
+CREATE TABLE IF NOT EXISTS document_updates (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	room_id TEXT NOT NULL,
+	update_data BLOB NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	checksum INTEGER,
+	FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_document_updates_room_id ON document_updates(room_id);
+
+CREATE TABLE IF NOT EXISTS room_snapshots (
+	room_id TEXT PRIMARY KEY,
+	snapshot_data BLOB NOT NULL,
+	update_count INTEGER DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	checksum INTEGER,
+	FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS document_versions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	room_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	description TEXT DEFAULT '',
+	content TEXT NOT NULL,
+	content_hash TEXT NOT NULL,
+	created_by TEXT DEFAULT '',
+	is_auto BOOLEAN DEFAULT FALSE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	idempotency_key TEXT,
+	FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_document_versions_room_id ON document_versions(room_id);
+CREATE INDEX IF NOT EXISTS idx_document_versions_created_at ON document_versions(room_id, created_at DESC);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_document_versions_idempotency
+	ON document_versions(room_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS quarantined_updates (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	room_id TEXT NOT NULL,
+	source TEXT NOT NULL,
+	original_id INTEGER,
+	data BLOB,
+	checksum INTEGER,
+	reason TEXT NOT NULL,
+	quarantined_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_quarantined_updates_room_id ON quarantined_updates(room_id);
+
+CREATE TABLE IF NOT EXISTS stats_samples (
+	sampled_at INTEGER PRIMARY KEY, -- Unix seconds
+	room_count INTEGER NOT NULL,
+	active_rooms INTEGER NOT NULL,
+	active_clients INTEGER NOT NULL,
+	message_rate REAL NOT NULL,
+	storage_bytes INTEGER NOT NULL
+);
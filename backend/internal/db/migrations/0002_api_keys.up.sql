@@ -0,0 +1,8 @@
+CREATE TABLE api_keys (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	key_hash TEXT NOT NULL UNIQUE, -- hex sha256 of the key
+	prefix TEXT NOT NULL,          -- first characters of the key, for identification
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_used_at DATETIME
+);
@@ -0,0 +1,9 @@
+UPDATE document_versions
+SET content = (SELECT content FROM version_blobs WHERE hash = document_versions.blob_hash)
+WHERE blob_hash IS NOT NULL;
+
+DROP TRIGGER IF EXISTS version_blobs_acquire;
+DROP TRIGGER IF EXISTS version_blobs_swap;
+DROP TRIGGER IF EXISTS version_blobs_release;
+ALTER TABLE document_versions DROP COLUMN blob_hash;
+DROP TABLE IF EXISTS version_blobs;
@@ -0,0 +1,35 @@
+-- Version content is stored once per distinct text and shared by reference.
+-- Rows written before this migration keep their inline content until the
+-- server moves it into a blob at startup.
+CREATE TABLE version_blobs (
+	hash TEXT PRIMARY KEY,              -- hex sha256 of content
+	content TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	ref_count INTEGER NOT NULL DEFAULT 0, -- versions pointing at this blob
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE document_versions ADD COLUMN blob_hash TEXT;
+
+-- Reference counts follow every insert, update and delete of a version, so
+-- no code path can leak or drop a shared blob
+CREATE TRIGGER version_blobs_acquire AFTER INSERT ON document_versions
+WHEN NEW.blob_hash IS NOT NULL
+BEGIN
+	UPDATE version_blobs SET ref_count = ref_count + 1 WHERE hash = NEW.blob_hash;
+END;
+
+CREATE TRIGGER version_blobs_swap AFTER UPDATE OF blob_hash ON document_versions
+WHEN OLD.blob_hash IS NOT NEW.blob_hash
+BEGIN
+	UPDATE version_blobs SET ref_count = ref_count + 1 WHERE hash = NEW.blob_hash;
+	UPDATE version_blobs SET ref_count = ref_count - 1 WHERE hash = OLD.blob_hash;
+	DELETE FROM version_blobs WHERE hash = OLD.blob_hash AND ref_count <= 0;
+END;
+
+CREATE TRIGGER version_blobs_release AFTER DELETE ON document_versions
+WHEN OLD.blob_hash IS NOT NULL
+BEGIN
+	UPDATE version_blobs SET ref_count = ref_count - 1 WHERE hash = OLD.blob_hash;
+	DELETE FROM version_blobs WHERE hash = OLD.blob_hash AND ref_count <= 0;
+END;
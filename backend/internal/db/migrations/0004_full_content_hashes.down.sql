@@ -0,0 +1,2 @@
+UPDATE document_versions SET content_hash = substr(content_hash, 1, 16)
+WHERE length(content_hash) = 64;
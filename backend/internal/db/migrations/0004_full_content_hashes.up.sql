@@ -0,0 +1,5 @@
+-- Versions used to carry the first 8 bytes of their SHA-256; every version
+-- with a blob already has the full hash as its blob key. The rest get it
+-- when their content is moved into a blob at startup.
+UPDATE document_versions SET content_hash = blob_hash
+WHERE blob_hash IS NOT NULL AND content_hash <> blob_hash;
@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS version_parents_release;
+DROP INDEX IF EXISTS idx_versions_parent;
+ALTER TABLE document_versions DROP COLUMN restored_from_id;
+ALTER TABLE document_versions DROP COLUMN parent_version_id;
@@ -0,0 +1,33 @@
+-- Each version points at the version that was latest in its room when it was
+-- saved, and a restore also points at the version it brought back
+ALTER TABLE document_versions ADD COLUMN parent_version_id INTEGER;
+ALTER TABLE document_versions ADD COLUMN restored_from_id INTEGER;
+
+CREATE INDEX idx_versions_parent ON document_versions(parent_version_id);
+
+UPDATE document_versions SET parent_version_id = (
+	SELECT p.id FROM document_versions p
+	WHERE p.room_id = document_versions.room_id
+		AND (p.created_at < document_versions.created_at
+			OR (p.created_at = document_versions.created_at AND p.id < document_versions.id))
+	ORDER BY p.created_at DESC, p.id DESC LIMIT 1
+);
+
+-- Restores only recorded their source in the description, as
+-- "Restored to version <id> (<name>)"
+UPDATE document_versions SET restored_from_id = (
+	SELECT s.id FROM document_versions s
+	WHERE s.room_id = document_versions.room_id
+		AND s.id = CAST(substr(document_versions.description, 21) AS INTEGER)
+)
+WHERE name LIKE 'Restored from: %' AND description LIKE 'Restored to version %';
+
+-- Deleting a version hands its children to its own parent, so the history
+-- stays connected when old auto-saves are pruned
+CREATE TRIGGER version_parents_release AFTER DELETE ON document_versions
+BEGIN
+	UPDATE document_versions SET parent_version_id = OLD.parent_version_id
+	WHERE parent_version_id = OLD.id;
+	UPDATE document_versions SET restored_from_id = NULL
+	WHERE restored_from_id = OLD.id;
+END;
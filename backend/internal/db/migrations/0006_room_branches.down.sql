@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_room_branches_source;
+DROP TABLE IF EXISTS room_branches;
@@ -0,0 +1,10 @@
+-- A branch is a room seeded from a version of another room
+CREATE TABLE room_branches (
+	room_id TEXT PRIMARY KEY,
+	source_room_id TEXT NOT NULL,
+	source_version_id INTEGER NOT NULL, -- The branch point
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_room_branches_source ON room_branches(source_room_id);
@@ -0,0 +1,6 @@
+-- Deployment overrides of the built-in AI system prompts
+CREATE TABLE ai_prompts (
+	name TEXT PRIMARY KEY,
+	template TEXT NOT NULL,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_embedding_chunks_room;
+DROP TABLE IF EXISTS embedding_chunks;
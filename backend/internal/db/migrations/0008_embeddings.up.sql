@@ -0,0 +1,15 @@
+-- Embeddings of the latest indexed version of each room, in line chunks
+CREATE TABLE embedding_chunks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	room_id TEXT NOT NULL,
+	version_id INTEGER NOT NULL,
+	start_line INTEGER NOT NULL, -- 1-based, inclusive
+	end_line INTEGER NOT NULL,
+	content TEXT NOT NULL,
+	content_hash TEXT NOT NULL, -- Lets unchanged chunks keep their vectors
+	model TEXT NOT NULL,
+	embedding BLOB NOT NULL, -- Little-endian float32s
+	FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_embedding_chunks_room ON embedding_chunks(room_id, start_line);
@@ -0,0 +1,11 @@
+-- Collaborator profiles that follow a person across devices. Each device
+-- signs in with the secret handed out when the profile was created.
+CREATE TABLE users (
+	id TEXT PRIMARY KEY,                    -- "user-" and 16 hex digits
+	name TEXT NOT NULL,
+	color TEXT NOT NULL,                    -- #rrggbb
+	preferences TEXT NOT NULL DEFAULT '{}', -- editor preferences, a JSON object the server does not read
+	secret_hash TEXT NOT NULL,              -- hex sha256 of the sign-in secret
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_favorite_rooms;
+DROP TABLE IF EXISTS user_recent_rooms;
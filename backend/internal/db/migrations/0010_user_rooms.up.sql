@@ -0,0 +1,20 @@
+-- Rooms each user profile visited recently or starred, for the room picker.
+-- Room IDs are not checked against rooms, which only gains a row once a room
+-- has content.
+CREATE TABLE user_recent_rooms (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	visited_at DATETIME NOT NULL,
+	PRIMARY KEY (user_id, room_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_user_recent_rooms_visited ON user_recent_rooms(user_id, visited_at);
+
+CREATE TABLE user_favorite_rooms (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	starred_at DATETIME NOT NULL,
+	PRIMARY KEY (user_id, room_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_rooms_workspace;
+ALTER TABLE rooms DROP COLUMN workspace_id;
+DROP TABLE IF EXISTS workspace_members;
+DROP TABLE IF EXISTS workspaces;
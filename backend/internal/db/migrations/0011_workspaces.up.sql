@@ -0,0 +1,25 @@
+-- Workspaces group rooms for one team. Rooms outside any workspace stay open
+-- to everyone, as before.
+CREATE TABLE workspaces (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	max_rooms INTEGER NOT NULL DEFAULT 0,      -- 0 means unlimited
+	max_room_bytes INTEGER NOT NULL DEFAULT 0, -- overrides the server's per-room quota when set
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE workspace_members (
+	workspace_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	role TEXT NOT NULL, -- owner or member
+	joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (workspace_id, user_id),
+	FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_workspace_members_user ON workspace_members(user_id);
+
+ALTER TABLE rooms ADD COLUMN workspace_id TEXT;
+
+CREATE INDEX idx_rooms_workspace ON rooms(workspace_id);
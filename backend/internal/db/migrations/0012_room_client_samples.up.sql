@@ -0,0 +1,10 @@
+-- Connected clients per room, sampled with stats_samples for the room usage
+-- report. Only rooms with clients get a row, and rows are kept for a day.
+CREATE TABLE room_client_samples (
+	room_id TEXT NOT NULL,
+	sampled_at INTEGER NOT NULL, -- Unix seconds
+	clients INTEGER NOT NULL,
+	PRIMARY KEY (room_id, sampled_at)
+);
+
+CREATE INDEX idx_room_client_samples_sampled ON room_client_samples(sampled_at);
@@ -0,0 +1,2 @@
+ALTER TABLE document_updates DROP COLUMN user_id;
+ALTER TABLE document_updates DROP COLUMN client_id;
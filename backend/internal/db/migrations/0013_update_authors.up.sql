@@ -0,0 +1,5 @@
+-- Who made each update: the session's client ID and, when the session has a
+-- verified identity, its user. Updates stored before this migration, and
+-- ones applied over HTTP, have neither.
+ALTER TABLE document_updates ADD COLUMN client_id TEXT;
+ALTER TABLE document_updates ADD COLUMN user_id TEXT;
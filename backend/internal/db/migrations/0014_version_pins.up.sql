@@ -0,0 +1,2 @@
+-- Pinned versions are never pruned with old auto-saves
+ALTER TABLE document_versions ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,3 @@
+-- The language a room's document is written in, such as "python"; empty
+-- when it was never set
+ALTER TABLE rooms ADD COLUMN language TEXT NOT NULL DEFAULT '';
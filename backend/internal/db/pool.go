@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Config tunes how the database is opened: the connection pool, lock
+// contention and migrations
+type Config struct {
+	MaxOpenConns    int           // Zero means unlimited
+	MaxIdleConns    int           // Connections kept open between queries
+	ConnMaxLifetime time.Duration // Zero keeps connections until closed
+	BusyTimeout     time.Duration // How long SQLite waits on a lock before failing with SQLITE_BUSY
+	BusyRetries     int           // Further attempts for writes that still fail with SQLITE_BUSY
+	SkipMigrations  bool          // Open without applying pending migrations
+
+	// WAL pages a commit may leave before it checkpoints the log; zero
+	// disables automatic checkpoints, leaving them to a Checkpointer
+	WALAutoCheckpoint int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MaxOpenConns: 8,
+		MaxIdleConns: 4,
+		BusyTimeout:  5 * time.Second,
+		BusyRetries:  3,
+
+		WALAutoCheckpoint: 1000, // SQLite's default
+	}
+}
+
+func (c Config) Validate() error {
+	if c.MaxOpenConns < 0 {
+		return fmt.Errorf("max open connections must not be negative, got %d", c.MaxOpenConns)
+	}
+	if c.MaxIdleConns < 0 {
+		return fmt.Errorf("max idle connections must not be negative, got %d", c.MaxIdleConns)
+	}
+	if c.MaxOpenConns > 0 && c.MaxIdleConns > c.MaxOpenConns {
+		return fmt.Errorf("max idle connections (%d) must not exceed max open connections (%d)", c.MaxIdleConns, c.MaxOpenConns)
+	}
+	if c.ConnMaxLifetime < 0 {
+		return fmt.Errorf("connection lifetime must not be negative, got %v", c.ConnMaxLifetime)
+	}
+	if c.BusyTimeout < 0 {
+		return fmt.Errorf("busy timeout must not be negative, got %v", c.BusyTimeout)
+	}
+	if c.BusyRetries < 0 {
+		return fmt.Errorf("busy retries must not be negative, got %d", c.BusyRetries)
+	}
+	if c.WALAutoCheckpoint < 0 {
+		return fmt.Errorf("WAL autocheckpoint must not be negative, got %d", c.WALAutoCheckpoint)
+	}
+	return nil
+}
+
+// Builds the driver DSN. Pragmas in the DSN run on every new connection,
+// which busy_timeout and wal_autocheckpoint need since they are per
+// connection. Transactions begin
+// IMMEDIATE so a writer waits for the lock up front; a deferred transaction
+// that later tries to write fails with SQLITE_BUSY without waiting.
+func (c Config) dsn(dbPath string) string {
+	q := url.Values{}
+	q.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", c.BusyTimeout.Milliseconds()))
+	q.Add("_pragma", fmt.Sprintf("wal_autocheckpoint(%d)", c.WALAutoCheckpoint))
+	q.Set("_txlock", "immediate")
+	return dbPath + "?" + q.Encode()
+}
+
+// IsBusy reports whether err means the database stayed locked by another
+// writer, so the operation may succeed if tried again later
+func IsBusy(err error) bool {
+	var e *sqlite.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	// Extended result codes carry the primary code in the low byte
+	code := e.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// Runs fn, retrying with backoff while it fails with SQLITE_BUSY. fn must be
+// safe to run again, which holds for a single statement or a transaction
+// that rolled back. Successes are noted so checkpoints can wait for writes
+// to pause.
+func (d *Database) retryBusy(ctx context.Context, fn func() error) error {
+	backoff := 10 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			d.lastWrite.Store(time.Now().UnixNano())
+			return nil
+		}
+		if !IsBusy(err) || attempt >= d.config.BusyRetries {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// Executes a write statement, retrying if the database is busy
+func (d *Database) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := d.retryBusy(ctx, func() error {
+		var err error
+		result, err = d.db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentWrites(t *testing.T) {
+	database, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	const writers = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*2)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := database.SaveUpdate(ctx, "room-1", []byte{0, 2, byte(i)}); err != nil {
+				errs <- err
+			}
+			if _, err := database.CreateVersion(ctx, "room-1", fmt.Sprintf("v%d", i), "", "content", "hash", "", false); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Concurrent write failed: %v", err)
+	}
+	if count, err := database.GetVersionCount(ctx, "room-1"); err != nil || count != writers {
+		t.Errorf("Expected %d versions, got %d (err %v)", writers, count, err)
+	}
+}
+
+// Holds the write lock from a separate connection for the given duration
+func holdWriteLock(t *testing.T, dbPath string, d time.Duration) {
+	t.Helper()
+
+	other, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open second handle: %v", err)
+	}
+	conn, err := other.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("Failed to take write lock: %v", err)
+	}
+
+	time.AfterFunc(d, func() {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		conn.Close()
+		other.Close()
+	})
+}
+
+func TestBusyRetry(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	ctx := context.Background()
+
+	// Without a busy timeout every lock conflict surfaces, so only the
+	// retries can get the write through
+	config := DefaultConfig()
+	config.BusyTimeout = 0
+	config.BusyRetries = 5
+	database, err := NewWithConfig(dbPath, config)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer database.Close()
+
+	holdWriteLock(t, dbPath, 30*time.Millisecond)
+	if err := database.CreateRoom(ctx, "room-1", "Room"); err != nil {
+		t.Fatalf("Expected the write to succeed after retrying, got %v", err)
+	}
+
+	database.config.BusyRetries = 0
+	holdWriteLock(t, dbPath, 100*time.Millisecond)
+	err = database.CreateRoom(ctx, "room-2", "Room")
+	if !IsBusy(err) {
+		t.Fatalf("Expected a busy error without retries, got %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("Default config should be valid: %v", err)
+	}
+
+	invalid := []func(*Config){
+		func(c *Config) { c.MaxOpenConns = -1 },
+		func(c *Config) { c.MaxIdleConns = c.MaxOpenConns + 1 },
+		func(c *Config) { c.BusyTimeout = -time.Second },
+		func(c *Config) { c.BusyRetries = -1 },
+		func(c *Config) { c.WALAutoCheckpoint = -1 },
+	}
+	for i, mutate := range invalid {
+		c := DefaultConfig()
+		mutate(&c)
+		if c.Validate() == nil {
+			t.Errorf("Case %d: expected a validation error", i)
+		}
+	}
+}
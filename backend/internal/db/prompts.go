@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PromptTemplate replaces a built-in AI system prompt
+type PromptTemplate struct {
+	Name      string    `json:"name"`
+	Template  string    `json:"template"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GetPromptTemplate returns the stored template for name, or nil if the
+// built-in prompt is in use
+func (d *Database) GetPromptTemplate(ctx context.Context, name string) (*PromptTemplate, error) {
+	p := &PromptTemplate{Name: name}
+	err := d.db.QueryRowContext(ctx,
+		"SELECT template, updated_at FROM ai_prompts WHERE name = ?", name,
+	).Scan(&p.Template, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ListPromptTemplates returns every stored template by name
+func (d *Database) ListPromptTemplates(ctx context.Context) ([]PromptTemplate, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT name, template, updated_at FROM ai_prompts ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prompts []PromptTemplate
+	for rows.Next() {
+		var p PromptTemplate
+		if err := rows.Scan(&p.Name, &p.Template, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		prompts = append(prompts, p)
+	}
+	return prompts, rows.Err()
+}
+
+// SetPromptTemplate stores or replaces the template for name
+func (d *Database) SetPromptTemplate(ctx context.Context, name, template string) (*PromptTemplate, error) {
+	if _, err := d.exec(ctx,
+		`INSERT INTO ai_prompts (name, template) VALUES (?, ?)
+		 ON CONFLICT(name) DO UPDATE SET template = excluded.template, updated_at = CURRENT_TIMESTAMP`,
+		name, template,
+	); err != nil {
+		return nil, err
+	}
+	return d.GetPromptTemplate(ctx, name)
+}
+
+// DeletePromptTemplate removes the template for name, restoring the
+// built-in prompt. It reports whether one was stored.
+func (d *Database) DeletePromptTemplate(ctx context.Context, name string) (bool, error) {
+	result, err := d.exec(ctx, "DELETE FROM ai_prompts WHERE name = ?", name)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// StatsSample is one periodic snapshot of server usage
+type StatsSample struct {
+	SampledAt     time.Time `json:"sampled_at"`
+	RoomCount     int       `json:"room_count"`
+	ActiveRooms   int       `json:"active_rooms"`
+	ActiveClients int       `json:"active_clients"`
+	MessageRate   float64   `json:"message_rate"` // messages per second since the previous sample
+	StorageBytes  int64     `json:"storage_bytes"`
+}
+
+// RecordStatsSample stores a sample; a second sample in the same second
+// replaces the first
+func (d *Database) RecordStatsSample(ctx context.Context, sample StatsSample) error {
+	_, err := d.exec(ctx, `
+		INSERT OR REPLACE INTO stats_samples
+			(sampled_at, room_count, active_rooms, active_clients, message_rate, storage_bytes)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, sample.SampledAt.Unix(), sample.RoomCount, sample.ActiveRooms, sample.ActiveClients,
+		sample.MessageRate, sample.StorageBytes)
+	return err
+}
+
+// ListStatsSamples returns samples taken at or after since, oldest first
+func (d *Database) ListStatsSamples(ctx context.Context, since time.Time) ([]StatsSample, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT sampled_at, room_count, active_rooms, active_clients, message_rate, storage_bytes
+		FROM stats_samples
+		WHERE sampled_at >= ?
+		ORDER BY sampled_at ASC
+	`, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := []StatsSample{}
+	for rows.Next() {
+		var s StatsSample
+		var sampledAt int64
+		if err := rows.Scan(&sampledAt, &s.RoomCount, &s.ActiveRooms, &s.ActiveClients, &s.MessageRate, &s.StorageBytes); err != nil {
+			return nil, err
+		}
+		s.SampledAt = time.Unix(sampledAt, 0).UTC()
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+// PruneStatsSamples deletes samples older than before
+func (d *Database) PruneStatsSamples(ctx context.Context, before time.Time) (int64, error) {
+	result, err := d.exec(ctx, "DELETE FROM stats_samples WHERE sampled_at < ?", before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetStorageBytes returns the total size of stored updates, snapshots and
+// versions
+func (d *Database) GetStorageBytes(ctx context.Context) (int64, error) {
+	var total int64
+	err := d.db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COALESCE(SUM(LENGTH(update_data)), 0) FROM document_updates) +
+			(SELECT COALESCE(SUM(LENGTH(snapshot_data)), 0) FROM room_snapshots) +
+			(SELECT COALESCE(SUM(LENGTH(content)), 0) FROM document_versions) +
+			(SELECT COALESCE(SUM(size), 0) FROM version_blobs)
+	`).Scan(&total)
+	return total, err
+}
+
+// RoomClientSample is the number of clients connected to a room at one
+// sample
+type RoomClientSample struct {
+	SampledAt time.Time `json:"sampled_at"`
+	Clients   int       `json:"clients"`
+}
+
+// RecordRoomClients stores the connected client count of each room at one
+// sample. Rooms without clients are skipped, so a missing sample means none
+// were connected.
+func (d *Database) RecordRoomClients(ctx context.Context, at time.Time, clients map[string]int) error {
+	return d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for roomID, count := range clients {
+			if count <= 0 {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx,
+				"INSERT OR REPLACE INTO room_client_samples (room_id, sampled_at, clients) VALUES (?, ?, ?)",
+				roomID, at.Unix(), count,
+			); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// ListRoomClientSamples returns a room's samples taken at or after since,
+// oldest first
+func (d *Database) ListRoomClientSamples(ctx context.Context, roomID string, since time.Time) ([]RoomClientSample, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT sampled_at, clients FROM room_client_samples
+		WHERE room_id = ? AND sampled_at >= ?
+		ORDER BY sampled_at ASC
+	`, roomID, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := []RoomClientSample{}
+	for rows.Next() {
+		var s RoomClientSample
+		var sampledAt int64
+		if err := rows.Scan(&sampledAt, &s.Clients); err != nil {
+			return nil, err
+		}
+		s.SampledAt = time.Unix(sampledAt, 0).UTC()
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+// PruneRoomClientSamples deletes room samples older than before
+func (d *Database) PruneRoomClientSamples(ctx context.Context, before time.Time) (int64, error) {
+	result, err := d.exec(ctx, "DELETE FROM room_client_samples WHERE sampled_at < ?", before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/tracing"
+	"modernc.org/sqlite"
+)
+
+// The SQLite driver wrapped so statements get spans. Wrapping the driver
+// rather than each query covers every statement, transactions included.
+// Only statements run for a traced operation are recorded; migrations and
+// maintenance with no span in their context are left out.
+const tracedDriverName = "sqlite-traced"
+
+func init() {
+	sql.Register(tracedDriverName, tracingDriver{&sqlite.Driver{}})
+}
+
+// Longest statement text attached to a span
+const maxTracedStatement = 1000
+
+type tracingDriver struct {
+	driver.Driver
+}
+
+func (d tracingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tracingConn{conn}, nil
+}
+
+// Passes everything through to the SQLite connection, timing statements
+// executed directly on it. Prepared statements are covered by the span of
+// the operation that prepared them.
+type tracingConn struct {
+	driver.Conn
+}
+
+func (c *tracingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startStatement(ctx, query)
+	result, err := execer.ExecContext(ctx, query, args)
+	endStatement(span, err)
+	return result, err
+}
+
+func (c *tracingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startStatement(ctx, query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	endStatement(span, err)
+	return rows, err
+}
+
+func (c *tracingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *tracingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *tracingConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// Starts a span named after the statement's operation, such as "SELECT".
+// Query spans end once the first rows are ready, not when they are read.
+func startStatement(ctx context.Context, query string) tracing.Span {
+	query = strings.TrimSpace(query)
+	operation, _, _ := strings.Cut(query, " ")
+	if len(query) > maxTracedStatement {
+		query = query[:maxTracedStatement]
+	}
+	_, span := tracing.Start(ctx, strings.ToUpper(operation), tracing.ChildOnly(), tracing.WithKind(tracing.KindClient),
+		tracing.WithAttributes(
+			tracing.String("db.system", "sqlite"),
+			tracing.String("db.statement", query),
+		))
+	return span
+}
+
+func endStatement(span tracing.Span, err error) {
+	if err != nil && err != driver.ErrSkip {
+		tracing.RecordError(span, err)
+	}
+	span.End()
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Visits kept per user; older ones are dropped as new rooms are visited
+const maxRecentRooms = 50
+
+// Rooms a user can star
+const MaxFavoriteRooms = 200
+
+// ErrTooManyFavorites is returned when starring a room would exceed MaxFavoriteRooms
+var ErrTooManyFavorites = errors.New("too many favorite rooms")
+
+// UserRoom is a room in a user's recent or favorite list. Name is empty for
+// rooms that have no content yet, and Protected reports rooms that need a
+// join secret.
+type UserRoom struct {
+	RoomID    string    `json:"room_id"`
+	Name      string    `json:"name,omitempty"`
+	Protected bool      `json:"protected,omitempty"`
+	At        time.Time `json:"at"` // Last visit or when it was starred
+}
+
+// RecordRoomVisit marks a room as visited by a user now, forgetting the
+// user's oldest visits beyond maxRecentRooms
+func (d *Database) RecordRoomVisit(ctx context.Context, userID, roomID string) error {
+	return d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO user_recent_rooms (user_id, room_id, visited_at) VALUES (?, ?, ?) ON CONFLICT (user_id, room_id) DO UPDATE SET visited_at = excluded.visited_at",
+			userID, roomID, time.Now().UTC(),
+		); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM user_recent_rooms WHERE user_id = ? AND room_id NOT IN (
+				SELECT room_id FROM user_recent_rooms WHERE user_id = ? ORDER BY visited_at DESC LIMIT ?
+			)`, userID, userID, maxRecentRooms,
+		); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// ListRecentRooms returns up to limit rooms a user visited, most recent
+// first. Archived rooms are left out.
+func (d *Database) ListRecentRooms(ctx context.Context, userID string, limit int) ([]UserRoom, error) {
+	return d.listUserRooms(ctx, `
+		SELECT u.room_id, COALESCE(r.name, ''), r.join_secret IS NOT NULL, u.visited_at
+		FROM user_recent_rooms u LEFT JOIN rooms r ON r.id = u.room_id
+		WHERE u.user_id = ? AND r.archived_at IS NULL
+		ORDER BY u.visited_at DESC LIMIT ?`, userID, limit)
+}
+
+// ForgetRecentRoom removes a room from a user's recent list. It reports
+// whether the room was in it.
+func (d *Database) ForgetRecentRoom(ctx context.Context, userID, roomID string) (bool, error) {
+	result, err := d.exec(ctx, "DELETE FROM user_recent_rooms WHERE user_id = ? AND room_id = ?", userID, roomID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ListFavoriteRooms returns the rooms a user starred, most recently starred
+// first, including archived ones so they can be found again
+func (d *Database) ListFavoriteRooms(ctx context.Context, userID string) ([]UserRoom, error) {
+	return d.listUserRooms(ctx, `
+		SELECT f.room_id, COALESCE(r.name, ''), r.join_secret IS NOT NULL, f.starred_at
+		FROM user_favorite_rooms f LEFT JOIN rooms r ON r.id = f.room_id
+		WHERE f.user_id = ?
+		ORDER BY f.starred_at DESC LIMIT ?`, userID, MaxFavoriteRooms)
+}
+
+// AddFavoriteRoom stars a room for a user. Starring a room again keeps its
+// original time. It reports whether the room was newly starred.
+func (d *Database) AddFavoriteRoom(ctx context.Context, userID, roomID string) (bool, error) {
+	added := false
+	err := d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var count int
+		if err := tx.QueryRowContext(ctx,
+			"SELECT COUNT(*) FROM user_favorite_rooms WHERE user_id = ?", userID,
+		).Scan(&count); err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx,
+			"INSERT OR IGNORE INTO user_favorite_rooms (user_id, room_id, starred_at) VALUES (?, ?, ?)",
+			userID, roomID, time.Now().UTC(),
+		)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 && count >= MaxFavoriteRooms {
+			return ErrTooManyFavorites
+		}
+		added = n > 0
+		return tx.Commit()
+	})
+	return added, err
+}
+
+// RemoveFavoriteRoom unstars a room for a user. It reports whether the room
+// was starred.
+func (d *Database) RemoveFavoriteRoom(ctx context.Context, userID, roomID string) (bool, error) {
+	result, err := d.exec(ctx, "DELETE FROM user_favorite_rooms WHERE user_id = ? AND room_id = ?", userID, roomID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (d *Database) listUserRooms(ctx context.Context, query string, args ...interface{}) ([]UserRoom, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []UserRoom{}
+	for rows.Next() {
+		var room UserRoom
+		if err := rows.Scan(&room.RoomID, &room.Name, &room.Protected, &room.At); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
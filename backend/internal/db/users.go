@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// User IDs start with this, so identities can be told apart from guests
+const UserIDPrefix = "user-"
+
+// Sign-in secrets start with this so they are recognisable if pasted
+const userSecretPrefix = "latu_"
+
+// User is a collaborator's profile. Preferences are the editor's to define.
+type User struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Color       string          `json:"color"`
+	Preferences json.RawMessage `json:"preferences"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// Secrets carry 256 random bits, so an unsalted hash is enough
+func hashUserSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateUser stores a new profile and returns it with its sign-in secret.
+// Only the secret's hash is kept, so it cannot be recovered later.
+func (d *Database) CreateUser(ctx context.Context, name, color string, preferences json.RawMessage) (string, *User, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	userID := UserIDPrefix + hex.EncodeToString(id)
+	secret := userSecretPrefix + base64.RawURLEncoding.EncodeToString(b)
+	if len(preferences) == 0 {
+		preferences = json.RawMessage("{}")
+	}
+
+	if _, err := d.exec(ctx,
+		"INSERT INTO users (id, name, color, preferences, secret_hash) VALUES (?, ?, ?, ?, ?)",
+		userID, name, color, string(preferences), hashUserSecret(secret),
+	); err != nil {
+		return "", nil, err
+	}
+	user, err := d.GetUser(ctx, userID)
+	return secret, user, err
+}
+
+// GetUser returns a profile, or nil if there is none with that ID
+func (d *Database) GetUser(ctx context.Context, id string) (*User, error) {
+	u := &User{ID: id}
+	var preferences string
+	err := d.db.QueryRowContext(ctx,
+		"SELECT name, color, preferences, created_at, updated_at FROM users WHERE id = ?", id,
+	).Scan(&u.Name, &u.Color, &preferences, &u.CreatedAt, &u.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.Preferences = json.RawMessage(preferences)
+	return u, nil
+}
+
+// UpdateUser replaces a profile's name, color and preferences, returning
+// the updated profile or nil if there is none with that ID
+func (d *Database) UpdateUser(ctx context.Context, id, name, color string, preferences json.RawMessage) (*User, error) {
+	result, err := d.exec(ctx,
+		"UPDATE users SET name = ?, color = ?, preferences = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		name, color, string(preferences), id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+	return d.GetUser(ctx, id)
+}
+
+// DeleteUser removes a profile with its recent and favorite rooms and its
+// workspace memberships. It reports whether one was stored.
+func (d *Database) DeleteUser(ctx context.Context, id string) (bool, error) {
+	deleted := false
+	err := d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, table := range []string{"user_recent_rooms", "user_favorite_rooms", "workspace_members"} {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user_id = ?", id); err != nil {
+				return err
+			}
+		}
+		result, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		deleted = n > 0
+		return tx.Commit()
+	})
+	return deleted, err
+}
+
+// CheckUserSecret reports whether secret signs in as the user
+func (d *Database) CheckUserSecret(ctx context.Context, id, secret string) (bool, error) {
+	if !strings.HasPrefix(secret, userSecretPrefix) {
+		return false, nil
+	}
+
+	var hash string
+	err := d.db.QueryRowContext(ctx, "SELECT secret_hash FROM users WHERE id = ?", id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(hashUserSecret(secret))) == 1, nil
+}
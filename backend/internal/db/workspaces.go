@@ -0,0 +1,432 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Workspace roles. Owners manage members and rooms; members use the rooms.
+const (
+	WorkspaceRoleOwner  = "owner"
+	WorkspaceRoleMember = "member"
+)
+
+var (
+	// ErrWorkspaceExists is returned when creating a workspace whose ID is taken
+	ErrWorkspaceExists = errors.New("workspace already exists")
+	// ErrWorkspaceFull is returned when a room would take a workspace over its room limit
+	ErrWorkspaceFull = errors.New("workspace room limit reached")
+	// ErrWorkspaceNotEmpty is returned when deleting a workspace that still has rooms
+	ErrWorkspaceNotEmpty = errors.New("workspace still has rooms")
+	// ErrLastOwner is returned when a change would leave a workspace without an owner
+	ErrLastOwner = errors.New("workspace must keep an owner")
+	// ErrRoomInOtherWorkspace is returned when adding a room that belongs to another workspace
+	ErrRoomInOtherWorkspace = errors.New("room belongs to another workspace")
+	// ErrRoomInUse is returned when claiming a room that already has content
+	ErrRoomInUse = errors.New("room already has content")
+)
+
+// Workspace groups the rooms of one team. Zero limits mean unlimited, and
+// MaxRoomBytes replaces the server's per-room quota when set.
+type Workspace struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	MaxRooms     int       `json:"max_rooms,omitempty"`
+	MaxRoomBytes int64     `json:"max_room_bytes,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// UserWorkspace is a workspace with the role a user has in it
+type UserWorkspace struct {
+	Workspace
+	Role string `json:"role"`
+}
+
+// WorkspaceMember is a profile's membership of a workspace
+type WorkspaceMember struct {
+	UserID   string    `json:"user_id"`
+	Name     string    `json:"name"`
+	Color    string    `json:"color"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// WorkspaceUsage totals the storage of a workspace's rooms
+type WorkspaceUsage struct {
+	Rooms         int   `json:"rooms"`
+	UpdateBytes   int64 `json:"update_bytes"`
+	SnapshotBytes int64 `json:"snapshot_bytes"`
+}
+
+const selectWorkspace = "SELECT id, name, max_rooms, max_room_bytes, created_at FROM workspaces"
+
+func scanWorkspace(row rowScanner, ws *Workspace) error {
+	return row.Scan(&ws.ID, &ws.Name, &ws.MaxRooms, &ws.MaxRoomBytes, &ws.CreatedAt)
+}
+
+// CreateWorkspace stores a workspace with ownerID as its first owner
+func (d *Database) CreateWorkspace(ctx context.Context, id, name, ownerID string) (*Workspace, error) {
+	err := d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO workspaces (id, name) VALUES (?, ?)", id, name)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrWorkspaceExists
+		}
+
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO workspace_members (workspace_id, user_id, role) VALUES (?, ?, ?)",
+			id, ownerID, WorkspaceRoleOwner,
+		); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.GetWorkspace(ctx, id)
+}
+
+// GetWorkspace returns a workspace, or nil if there is none with that ID
+func (d *Database) GetWorkspace(ctx context.Context, id string) (*Workspace, error) {
+	var ws Workspace
+	err := scanWorkspace(d.db.QueryRowContext(ctx, selectWorkspace+" WHERE id = ?", id), &ws)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ws, nil
+}
+
+// ListUserWorkspaces returns the workspaces a user belongs to, by name
+func (d *Database) ListUserWorkspaces(ctx context.Context, userID string) ([]UserWorkspace, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT w.id, w.name, w.max_rooms, w.max_room_bytes, w.created_at, m.role
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = ?
+		ORDER BY w.name, w.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []UserWorkspace{}
+	for rows.Next() {
+		var ws UserWorkspace
+		if err := rows.Scan(&ws.ID, &ws.Name, &ws.MaxRooms, &ws.MaxRoomBytes, &ws.CreatedAt, &ws.Role); err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, ws)
+	}
+	return workspaces, rows.Err()
+}
+
+// DeleteWorkspace removes a workspace and its memberships. Its rooms must be
+// deleted first, so none become open to everyone by accident. It reports
+// whether a workspace was stored.
+func (d *Database) DeleteWorkspace(ctx context.Context, id string) (bool, error) {
+	deleted := false
+	err := d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var rooms int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM rooms WHERE workspace_id = ?", id).Scan(&rooms); err != nil {
+			return err
+		}
+		if rooms > 0 {
+			return ErrWorkspaceNotEmpty
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM workspace_members WHERE workspace_id = ?", id); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, "DELETE FROM workspaces WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		deleted = n > 0
+		return tx.Commit()
+	})
+	return deleted, err
+}
+
+// SetWorkspaceQuota replaces a workspace's limits, returning the updated
+// workspace or nil if there is none with that ID
+func (d *Database) SetWorkspaceQuota(ctx context.Context, id string, maxRooms int, maxRoomBytes int64) (*Workspace, error) {
+	result, err := d.exec(ctx,
+		"UPDATE workspaces SET max_rooms = ?, max_room_bytes = ? WHERE id = ?",
+		maxRooms, maxRoomBytes, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+	return d.GetWorkspace(ctx, id)
+}
+
+// WorkspaceRole returns a user's role in a workspace, or "" if the user is
+// not a member
+func (d *Database) WorkspaceRole(ctx context.Context, workspaceID, userID string) (string, error) {
+	var role string
+	err := d.db.QueryRowContext(ctx,
+		"SELECT role FROM workspace_members WHERE workspace_id = ? AND user_id = ?",
+		workspaceID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// ListWorkspaceMembers returns a workspace's members, owners first
+func (d *Database) ListWorkspaceMembers(ctx context.Context, workspaceID string) ([]WorkspaceMember, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT m.user_id, u.name, u.color, m.role, m.joined_at
+		FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = ?
+		ORDER BY m.role = 'owner' DESC, u.name, m.user_id`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []WorkspaceMember{}
+	for rows.Next() {
+		var m WorkspaceMember
+		if err := rows.Scan(&m.UserID, &m.Name, &m.Color, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// SetWorkspaceMember adds a user to a workspace or changes their role
+func (d *Database) SetWorkspaceMember(ctx context.Context, workspaceID, userID, role string) error {
+	return d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if role != WorkspaceRoleOwner {
+			if err := checkOtherOwnerTx(ctx, tx, workspaceID, userID); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO workspace_members (workspace_id, user_id, role) VALUES (?, ?, ?)
+			ON CONFLICT (workspace_id, user_id) DO UPDATE SET role = excluded.role`,
+			workspaceID, userID, role,
+		); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// RemoveWorkspaceMember takes a user out of a workspace. It reports whether
+// the user was a member.
+func (d *Database) RemoveWorkspaceMember(ctx context.Context, workspaceID, userID string) (bool, error) {
+	removed := false
+	err := d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := checkOtherOwnerTx(ctx, tx, workspaceID, userID); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx,
+			"DELETE FROM workspace_members WHERE workspace_id = ? AND user_id = ?",
+			workspaceID, userID,
+		)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		removed = n > 0
+		return tx.Commit()
+	})
+	return removed, err
+}
+
+// Returns ErrLastOwner if userID is the workspace's only owner
+func checkOtherOwnerTx(ctx context.Context, tx *sql.Tx, workspaceID, userID string) error {
+	var others, self int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(user_id <> ?), 0), COALESCE(SUM(user_id = ?), 0)
+		FROM workspace_members WHERE workspace_id = ? AND role = ?`,
+		userID, userID, workspaceID, WorkspaceRoleOwner,
+	).Scan(&others, &self); err != nil {
+		return err
+	}
+	if self > 0 && others == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// AddRoomToWorkspace moves a room into a workspace, creating the room if it
+// doesn't exist, within the workspace's room limit
+func (d *Database) AddRoomToWorkspace(ctx context.Context, workspaceID, roomID, name string) error {
+	return d.addRoomToWorkspace(ctx, workspaceID, roomID, name, false)
+}
+
+// ClaimRoomForWorkspace is AddRoomToWorkspace for rooms nobody has used yet.
+// It returns ErrRoomInUse if the room has stored updates, a snapshot or
+// versions.
+func (d *Database) ClaimRoomForWorkspace(ctx context.Context, workspaceID, roomID string) error {
+	return d.addRoomToWorkspace(ctx, workspaceID, roomID, "", true)
+}
+
+func (d *Database) addRoomToWorkspace(ctx context.Context, workspaceID, roomID, name string, unused bool) error {
+	return d.retryBusy(ctx, func() error {
+		tx, err := d.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var current sql.NullString
+		err = tx.QueryRowContext(ctx, "SELECT workspace_id FROM rooms WHERE id = ?", roomID).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if current.String == workspaceID && current.Valid {
+			return nil
+		}
+		if current.Valid {
+			return ErrRoomInOtherWorkspace
+		}
+
+		if unused {
+			var used bool
+			if err := tx.QueryRowContext(ctx, `
+				SELECT EXISTS (SELECT 1 FROM document_updates WHERE room_id = ?)
+					OR EXISTS (SELECT 1 FROM room_snapshots WHERE room_id = ?)
+					OR EXISTS (SELECT 1 FROM document_versions WHERE room_id = ?)`,
+				roomID, roomID, roomID,
+			).Scan(&used); err != nil {
+				return err
+			}
+			if used {
+				return ErrRoomInUse
+			}
+		}
+
+		var maxRooms, rooms int
+		if err := tx.QueryRowContext(ctx, `
+			SELECT max_rooms, (SELECT COUNT(*) FROM rooms WHERE workspace_id = ?)
+			FROM workspaces WHERE id = ?`, workspaceID, workspaceID,
+		).Scan(&maxRooms, &rooms); err != nil {
+			return err
+		}
+		if maxRooms > 0 && rooms >= maxRooms {
+			return ErrWorkspaceFull
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO rooms (id, name) VALUES (?, ?)", roomID, name); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE rooms SET workspace_id = ? WHERE id = ?", workspaceID, roomID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// RemoveRoomFromWorkspace opens a workspace room to everyone again. It
+// reports whether the room was in the workspace.
+func (d *Database) RemoveRoomFromWorkspace(ctx context.Context, workspaceID, roomID string) (bool, error) {
+	result, err := d.exec(ctx, "UPDATE rooms SET workspace_id = NULL WHERE id = ? AND workspace_id = ?", roomID, workspaceID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RoomWorkspace returns the workspace a room belongs to, or nil if it
+// belongs to none
+func (d *Database) RoomWorkspace(ctx context.Context, roomID string) (*Workspace, error) {
+	var ws Workspace
+	err := scanWorkspace(d.db.QueryRowContext(ctx,
+		"SELECT w.id, w.name, w.max_rooms, w.max_room_bytes, w.created_at FROM workspaces w JOIN rooms r ON r.workspace_id = w.id WHERE r.id = ?",
+		roomID,
+	), &ws)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ws, nil
+}
+
+// WorkspaceRoomIDs returns the IDs of a workspace's rooms
+func (d *Database) WorkspaceRoomIDs(ctx context.Context, workspaceID string) ([]string, error) {
+	rows, err := d.db.QueryContext(ctx, "SELECT id FROM rooms WHERE workspace_id = ? ORDER BY id", workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetWorkspaceUsage counts a workspace's rooms and the update and snapshot
+// bytes they store
+func (d *Database) GetWorkspaceUsage(ctx context.Context, workspaceID string) (*WorkspaceUsage, error) {
+	var usage WorkspaceUsage
+	err := d.db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM rooms WHERE workspace_id = ?),
+			(SELECT COALESCE(SUM(LENGTH(u.update_data)), 0) FROM document_updates u
+				JOIN rooms r ON r.id = u.room_id WHERE r.workspace_id = ?),
+			(SELECT COALESCE(SUM(LENGTH(s.snapshot_data)), 0) FROM room_snapshots s
+				JOIN rooms r ON r.id = s.room_id WHERE r.workspace_id = ?)
+	`, workspaceID, workspaceID, workspaceID).Scan(&usage.Rooms, &usage.UpdateBytes, &usage.SnapshotBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
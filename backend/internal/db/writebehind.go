@@ -0,0 +1,255 @@
+package db
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/tracing"
+)
+
+// Most traced edits a flush span links to, as OpenTelemetry's default link
+// limit
+const maxFlushLinks = 128
+
+// WriteBehindConfig controls how often buffered updates are flushed
+type WriteBehindConfig struct {
+	FlushInterval time.Duration
+	MaxBatch      int // Flush early once this many updates are pending
+}
+
+func DefaultWriteBehindConfig() WriteBehindConfig {
+	return WriteBehindConfig{
+		FlushInterval: 50 * time.Millisecond,
+		MaxBatch:      200,
+	}
+}
+
+// UpdateWriter buffers document updates and writes them to SQLite in one
+// transaction per room, keeping SQL off the broadcast path.
+//
+// Crash safety: an update is relayed to peers before it is durable, so a
+// crash loses at most the updates buffered since the last flush (one
+// FlushInterval or MaxBatch updates). Connected clients still hold those
+// changes in their Yjs documents and exchange them again when they resync.
+// Each room's batch commits atomically, so a crash never leaves a partial
+// batch behind. Close flushes everything still buffered.
+type UpdateWriter struct {
+	database *Database
+	config   WriteBehindConfig
+
+	pending      map[string][]AuthoredUpdate
+	traces       map[string][]tracing.SpanContext // Sampled edits behind each room's pending updates
+	order        []string                         // Rooms in the order they first became pending
+	pendingCount int
+	closed       bool
+	mu           sync.Mutex
+
+	written atomic.Uint64 // Updates committed since the writer started
+
+	flushMu sync.Mutex // Serializes flushes so batches commit in order
+	flushCh chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewUpdateWriter(database *Database, config WriteBehindConfig) *UpdateWriter {
+	defaults := DefaultWriteBehindConfig()
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaults.FlushInterval
+	}
+	if config.MaxBatch <= 0 {
+		config.MaxBatch = defaults.MaxBatch
+	}
+
+	w := &UpdateWriter{
+		database: database,
+		config:   config,
+		pending:  make(map[string][]AuthoredUpdate),
+		traces:   make(map[string][]tracing.SpanContext),
+		flushCh:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// Enqueue buffers an update for the room, made by author. After Close it
+// writes synchronously. When ctx carries a sampled trace, the flush that
+// persists the update is recorded as part of it.
+func (w *UpdateWriter) Enqueue(ctx context.Context, roomID string, update []byte, author Author) {
+	authored := AuthoredUpdate{Data: update, Author: author}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		if err := w.database.SaveAuthoredUpdates(ctx, roomID, []AuthoredUpdate{authored}); err != nil {
+			log.Printf("Error persisting update: %v", err)
+			return
+		}
+		w.written.Add(1)
+		return
+	}
+
+	if _, ok := w.pending[roomID]; !ok {
+		w.order = append(w.order, roomID)
+	}
+	w.pending[roomID] = append(w.pending[roomID], authored)
+	if sc, ok := tracing.SpanContextFromContext(ctx); ok && sc.IsSampled() && len(w.traces[roomID]) < maxFlushLinks {
+		w.traces[roomID] = append(w.traces[roomID], sc)
+	}
+	w.pendingCount++
+	full := w.pendingCount >= w.config.MaxBatch
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Pending returns the number of buffered updates not yet written
+func (w *UpdateWriter) Pending() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pendingCount
+}
+
+// WriteBehindStats reports the writer's backlog and throughput
+type WriteBehindStats struct {
+	Pending int    `json:"pending"`
+	Written uint64 `json:"written"` // Updates committed since startup
+}
+
+// Stats returns the number of buffered and committed updates
+func (w *UpdateWriter) Stats() WriteBehindStats {
+	return WriteBehindStats{Pending: w.Pending(), Written: w.written.Load()}
+}
+
+// Flush writes all buffered updates. Batches that fail are kept and retried
+// on the next flush.
+func (w *UpdateWriter) Flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	pending, traces, order := w.pending, w.traces, w.order
+	w.pending = make(map[string][]AuthoredUpdate)
+	w.traces = make(map[string][]tracing.SpanContext)
+	w.order = nil
+	w.pendingCount = 0
+	w.mu.Unlock()
+
+	var firstErr error
+	for _, roomID := range order {
+		updates := pending[roomID]
+		ctx, span := startFlushSpan(roomID, len(updates), traces[roomID])
+		err := w.database.SaveAuthoredUpdates(ctx, roomID, updates)
+		tracing.RecordError(span, err)
+		span.End()
+		if err != nil {
+			log.Printf("Error persisting %d updates for room %s: %v", len(updates), roomID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			w.requeue(roomID, updates, traces[roomID])
+			continue
+		}
+		w.written.Add(uint64(len(updates)))
+	}
+	return firstErr
+}
+
+// Records a room's flush in the trace of the first traced edit it
+// persists, linking the other edits' traces, so each edit's trace reaches
+// the transaction that made it durable
+func startFlushSpan(roomID string, updates int, traces []tracing.SpanContext) (context.Context, tracing.Span) {
+	ctx := context.Background()
+	if len(traces) == 0 {
+		return tracing.Start(ctx, "db.flush_updates", tracing.ChildOnly())
+	}
+	ctx = tracing.ContextWithSpanContext(ctx, traces[0])
+	return tracing.Start(ctx, "db.flush_updates", tracing.WithLinks(traces[1:]...), tracing.WithAttributes(
+		tracing.String("lattice.room_id", roomID),
+		tracing.Int("lattice.updates", updates),
+	))
+}
+
+// Discard drops the updates buffered for a room and returns how many there
+// were. It waits for a flush in progress, so nothing for the room is written
+// once it returns.
+func (w *UpdateWriter) Discard(roomID string) int {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	updates, ok := w.pending[roomID]
+	if !ok {
+		return 0
+	}
+	delete(w.pending, roomID)
+	delete(w.traces, roomID)
+	for i, id := range w.order {
+		if id == roomID {
+			w.order = append(w.order[:i], w.order[i+1:]...)
+			break
+		}
+	}
+	w.pendingCount -= len(updates)
+	return len(updates)
+}
+
+// Puts a failed batch back ahead of anything buffered since the flush began
+func (w *UpdateWriter) requeue(roomID string, updates []AuthoredUpdate, traces []tracing.SpanContext) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.pending[roomID]; !ok {
+		w.order = append([]string{roomID}, w.order...)
+	}
+	w.pending[roomID] = append(updates, w.pending[roomID]...)
+	if len(traces) > 0 {
+		traces = append(traces, w.traces[roomID]...)
+		w.traces[roomID] = traces[:min(len(traces), maxFlushLinks)]
+	}
+	w.pendingCount += len(updates)
+}
+
+// Close stops the background flusher and writes everything still buffered
+func (w *UpdateWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.stop)
+	w.wg.Wait()
+	return w.Flush()
+}
+
+func (w *UpdateWriter) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.Flush()
+		case <-w.flushCh:
+			w.Flush()
+		}
+	}
+}
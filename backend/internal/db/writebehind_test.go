@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUpdateWriterFlushOnClose(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	writer := NewUpdateWriter(db, WriteBehindConfig{FlushInterval: time.Hour, MaxBatch: 1000})
+
+	for i := 0; i < 5; i++ {
+		writer.Enqueue(context.Background(), "writer-room", []byte{0, 2, byte(i)}, Author{})
+	}
+	writer.Enqueue(context.Background(), "other-room", []byte{0, 2, 9}, Author{})
+
+	if writer.Pending() != 6 {
+		t.Errorf("Expected 6 pending updates, got %d", writer.Pending())
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+
+	updates, err := db.GetAllUpdates(context.Background(), "writer-room")
+	if err != nil {
+		t.Fatalf("Failed to get updates: %v", err)
+	}
+	if len(updates) != 5 {
+		t.Fatalf("Expected 5 updates after close, got %d", len(updates))
+	}
+	for i, update := range updates {
+		if update[2] != byte(i) {
+			t.Errorf("Update %d out of order: got %v", i, update)
+		}
+	}
+
+	// Writes after Close go straight to the database
+	writer.Enqueue(context.Background(), "writer-room", []byte{0, 2, 5}, Author{})
+	if count, _ := db.GetUpdateCount(context.Background(), "writer-room"); count != 6 {
+		t.Errorf("Expected 6 updates after late enqueue, got %d", count)
+	}
+	if stats := writer.Stats(); stats.Written != 7 || stats.Pending != 0 {
+		t.Errorf("Expected 7 written and none pending, got %+v", stats)
+	}
+}
+
+func TestUpdateWriterFlushOnBatchSize(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	writer := NewUpdateWriter(db, WriteBehindConfig{FlushInterval: time.Hour, MaxBatch: 3})
+	defer writer.Close()
+
+	for i := 0; i < 3; i++ {
+		writer.Enqueue(context.Background(), "batch-room", []byte{0, 2, byte(i)}, Author{})
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if count, _ := db.GetUpdateCount(context.Background(), "batch-room"); count == 3 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("Expected a full batch to be flushed without waiting for the interval")
+}
+
+func BenchmarkSaveUpdate(b *testing.B) {
+	db, cleanup := setupTestDB(b)
+	defer cleanup()
+
+	update := make([]byte, 64)
+	b.SetBytes(int64(len(update)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.SaveUpdate(context.Background(), "bench-room", update); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUpdateWriter(b *testing.B) {
+	db, cleanup := setupTestDB(b)
+	defer cleanup()
+
+	writer := NewUpdateWriter(db, DefaultWriteBehindConfig())
+	update := make([]byte, 64)
+	b.SetBytes(int64(len(update)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writer.Enqueue(context.Background(), "bench-room", update, Author{})
+	}
+	// Throughput includes getting everything to disk
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func TestUpdateWriterDiscard(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	writer := NewUpdateWriter(db, WriteBehindConfig{FlushInterval: time.Hour, MaxBatch: 1000})
+	writer.Enqueue(context.Background(), "deleted-room", []byte{0, 2, 1}, Author{})
+	writer.Enqueue(context.Background(), "kept-room", []byte{0, 2, 2}, Author{})
+	writer.Enqueue(context.Background(), "deleted-room", []byte{0, 2, 3}, Author{})
+
+	if n := writer.Discard("deleted-room"); n != 2 {
+		t.Errorf("Expected 2 discarded updates, got %d", n)
+	}
+	if n := writer.Discard("deleted-room"); n != 0 {
+		t.Errorf("Expected nothing left to discard, got %d", n)
+	}
+	if writer.Pending() != 1 {
+		t.Errorf("Expected 1 pending update, got %d", writer.Pending())
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	if room, _ := db.GetRoom(context.Background(), "deleted-room"); room != nil {
+		t.Error("Discarded updates should not create the room")
+	}
+	if count, _ := db.GetUpdateCount(context.Background(), "kept-room"); count != 1 {
+		t.Errorf("Expected the other room's update to be written, got %d", count)
+	}
+}
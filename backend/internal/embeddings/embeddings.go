@@ -0,0 +1,387 @@
+// Package embeddings indexes the latest saved version of each room as
+// embedding vectors, so AI completions can be given the parts of a room's
+// document most related to the code being completed. Vectors come from
+// OpenAI or Ollama and are stored in SQLite beside the versions.
+package embeddings
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+type Config struct {
+	Provider  string // "openai" or "ollama"
+	Model     string // Defaults to the provider's usual embedding model
+	OpenAIKey string
+	OllamaURL string
+
+	ChunkLines   int // Lines per indexed chunk
+	ChunkOverlap int // Lines shared by neighbouring chunks
+	MaxChunks    int // Per room; the rest of a longer document is not indexed
+
+	MinScore float64       // Cosine similarity below which a chunk is not relevant
+	Timeout  time.Duration // Per embedding request
+}
+
+func DefaultConfig() Config {
+	return Config{
+		OllamaURL:    "http://localhost:11434",
+		ChunkLines:   40,
+		ChunkOverlap: 8,
+		MaxChunks:    256,
+		MinScore:     0.25,
+		Timeout:      30 * time.Second,
+	}
+}
+
+// Default embedding models by provider
+var defaultModels = map[string]string{
+	"openai": "text-embedding-3-small",
+	"ollama": "nomic-embed-text",
+}
+
+// Validate rejects configurations the index can't run with
+func (c Config) Validate() error {
+	switch c.Provider {
+	case "openai":
+		if c.OpenAIKey == "" {
+			return fmt.Errorf("openai embeddings need an API key")
+		}
+	case "ollama":
+		u, err := url.Parse(c.OllamaURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("ollama URL must be an http(s) URL, got %q", c.OllamaURL)
+		}
+	default:
+		return fmt.Errorf("provider must be openai or ollama, got %q", c.Provider)
+	}
+	if c.ChunkLines < 1 {
+		return fmt.Errorf("chunk lines must be positive, got %d", c.ChunkLines)
+	}
+	if c.ChunkOverlap < 0 || c.ChunkOverlap >= c.ChunkLines {
+		return fmt.Errorf("chunk overlap must be between 0 and %d, got %d", c.ChunkLines-1, c.ChunkOverlap)
+	}
+	if c.MaxChunks < 1 {
+		return fmt.Errorf("max chunks must be positive, got %d", c.MaxChunks)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive, got %v", c.Timeout)
+	}
+	return nil
+}
+
+// Embedder turns texts into vectors, one per text in order
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// Match is an indexed chunk related to a query
+type Match struct {
+	StartLine int     `json:"start_line"`
+	EndLine   int     `json:"end_line"`
+	Content   string  `json:"content"`
+	Score     float64 `json:"score"` // Cosine similarity
+}
+
+// Texts sent per embedding request
+const embedBatchSize = 32
+
+// Index keeps room embeddings up to date as versions are saved and searches
+// them
+type Index struct {
+	database *db.Database
+	config   Config
+	embedder Embedder
+	model    string
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	// Latest unindexed version per room; saves made while a room waits
+	// replace each other
+	mu      sync.Mutex
+	pending map[string]*db.Version
+	wake    chan struct{}
+}
+
+func New(database *db.Database, config Config) (*Index, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Model == "" {
+		config.Model = defaultModels[config.Provider]
+	}
+
+	var embedder Embedder
+	switch config.Provider {
+	case "openai":
+		embedder = newOpenAI(config.OpenAIKey, config.Model, config.Timeout)
+	case "ollama":
+		embedder = newOllama(config.OllamaURL, config.Model, config.Timeout)
+	}
+	return NewWithEmbedder(database, config, embedder), nil
+}
+
+// NewWithEmbedder returns an index that gets its vectors from embedder.
+// config.Provider and config.Model only name the vectors it stores.
+func NewWithEmbedder(database *db.Database, config Config, embedder Embedder) *Index {
+	return &Index{
+		database: database,
+		config:   config,
+		embedder: embedder,
+		model:    config.Provider + "/" + config.Model,
+		stop:     make(chan struct{}),
+		pending:  make(map[string]*db.Version),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (x *Index) Start() {
+	x.wg.Add(1)
+	go x.run()
+	log.Printf("🧭 Embedding index started (%s)", x.model)
+}
+
+// Stop abandons pending versions and waits for the one being indexed
+func (x *Index) Stop() {
+	close(x.stop)
+	x.wg.Wait()
+	log.Println("🧭 Embedding index stopped")
+}
+
+// VersionSaved queues a version for indexing. It never blocks.
+func (x *Index) VersionSaved(v *db.Version) {
+	x.mu.Lock()
+	x.pending[v.RoomID] = v
+	x.mu.Unlock()
+
+	select {
+	case x.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (x *Index) run() {
+	defer x.wg.Done()
+	for {
+		select {
+		case <-x.stop:
+			return
+		case <-x.wake:
+		}
+
+		for {
+			v := x.next()
+			if v == nil {
+				break
+			}
+			x.indexInBackground(v)
+			select {
+			case <-x.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// Takes a pending version, or nil when none is left
+func (x *Index) next() *db.Version {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for roomID, v := range x.pending {
+		delete(x.pending, roomID)
+		return v
+	}
+	return nil
+}
+
+func (x *Index) indexInBackground(v *db.Version) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Abort the embedding request on shutdown
+	go func() {
+		select {
+		case <-x.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := x.IndexVersion(ctx, v); err != nil {
+		log.Printf("Failed to index version %d of room %s: %v", v.ID, v.RoomID, err)
+	}
+}
+
+// A run of lines from a document
+type chunk struct {
+	start, end int // 1-based, inclusive
+	text       string
+}
+
+// Splits content into overlapping runs of lines, skipping blank ones
+func splitChunks(content string, size, overlap, limit int) []chunk {
+	lines := strings.Split(content, "\n")
+	var chunks []chunk
+	for start := 0; start < len(lines) && len(chunks) < limit; start += size - overlap {
+		end := min(start+size, len(lines))
+		text := strings.Join(lines[start:end], "\n")
+		if strings.TrimSpace(text) != "" {
+			chunks = append(chunks, chunk{start: start + 1, end: end, text: text})
+		}
+		if end == len(lines) {
+			break
+		}
+	}
+	return chunks
+}
+
+func hashChunk(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// IndexVersion replaces its room's chunks with those of v. Chunks whose
+// text was already indexed keep their vectors, so only changed parts of the
+// document are sent to the provider.
+func (x *Index) IndexVersion(ctx context.Context, v *db.Version) error {
+	existing, err := x.database.GetEmbeddingChunks(ctx, v.RoomID)
+	if err != nil {
+		return err
+	}
+	known := make(map[string][]float32)
+	for _, c := range existing {
+		if c.Model == x.model {
+			known[c.ContentHash] = c.Embedding
+		}
+	}
+
+	pieces := splitChunks(v.Content, x.config.ChunkLines, x.config.ChunkOverlap, x.config.MaxChunks)
+	chunks := make([]db.EmbeddingChunk, len(pieces))
+	var missing []int
+	for i, p := range pieces {
+		hash := hashChunk(p.text)
+		chunks[i] = db.EmbeddingChunk{
+			RoomID:      v.RoomID,
+			VersionID:   v.ID,
+			StartLine:   p.start,
+			EndLine:     p.end,
+			Content:     p.text,
+			ContentHash: hash,
+			Model:       x.model,
+			Embedding:   known[hash],
+		}
+		if chunks[i].Embedding == nil {
+			missing = append(missing, i)
+		}
+	}
+
+	for start := 0; start < len(missing); start += embedBatchSize {
+		batch := missing[start:min(start+embedBatchSize, len(missing))]
+		texts := make([]string, len(batch))
+		for j, i := range batch {
+			texts[j] = chunks[i].Content
+		}
+		vectors, err := x.embedder.Embed(ctx, texts)
+		if err != nil {
+			return err
+		}
+		if len(vectors) != len(texts) {
+			return fmt.Errorf("asked for %d embeddings, got %d", len(texts), len(vectors))
+		}
+		for j, i := range batch {
+			chunks[i].Embedding = vectors[j]
+		}
+	}
+
+	return x.database.ReplaceEmbeddingChunks(ctx, v.RoomID, chunks)
+}
+
+// Search returns up to limit chunks of the room's indexed version most
+// related to query, best first. A room whose latest version is not indexed
+// yet is queued, and searched with what it has.
+func (x *Index) Search(ctx context.Context, roomID, query string, limit int) ([]Match, error) {
+	if err := x.queueIfStale(ctx, roomID); err != nil {
+		return nil, err
+	}
+
+	chunks, err := x.database.GetEmbeddingChunks(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []db.EmbeddingChunk
+	for _, c := range chunks {
+		if c.Model == x.model {
+			candidates = append(candidates, c)
+		}
+	}
+	if len(candidates) == 0 || strings.TrimSpace(query) == "" {
+		return nil, nil
+	}
+
+	vectors, err := x.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != 1 {
+		return nil, fmt.Errorf("asked for 1 embedding, got %d", len(vectors))
+	}
+
+	var matches []Match
+	for _, c := range candidates {
+		score := cosine(vectors[0], c.Embedding)
+		if score < x.config.MinScore {
+			continue
+		}
+		matches = append(matches, Match{StartLine: c.StartLine, EndLine: c.EndLine, Content: c.Content, Score: score})
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// Queues the room's latest version if its chunks are older, which happens
+// for rooms saved before the index was enabled
+func (x *Index) queueIfStale(ctx context.Context, roomID string) error {
+	indexed, err := x.database.EmbeddingVersion(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	latest, err := x.database.GetLatestVersion(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if latest != nil && latest.ID > indexed {
+		x.VersionSaved(latest)
+	}
+	return nil
+}
+
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,138 @@
+package embeddings
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// Embeds texts as bags of words, so texts sharing words are similar
+type wordEmbedder struct {
+	mu    sync.Mutex
+	texts []string // Every text embedded, in order
+}
+
+func (e *wordEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.mu.Lock()
+	e.texts = append(e.texts, texts...)
+	e.mu.Unlock()
+
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		v := make([]float32, 64)
+		for _, word := range strings.Fields(text) {
+			h := fnv.New32a()
+			h.Write([]byte(word))
+			v[h.Sum32()%64]++
+		}
+		vectors[i] = v
+	}
+	return vectors, nil
+}
+
+func (e *wordEmbedder) calls() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.texts)
+}
+
+func setupTestIndex(t *testing.T) (*Index, *db.Database, *wordEmbedder) {
+	t.Helper()
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	config := DefaultConfig()
+	config.Provider, config.Model = "test", "words"
+	config.ChunkLines, config.ChunkOverlap = 2, 0
+	config.MinScore = 0.1
+	embedder := &wordEmbedder{}
+	return NewWithEmbedder(database, config, embedder), database, embedder
+}
+
+func saveVersion(t *testing.T, database *db.Database, roomID, content string) *db.Version {
+	t.Helper()
+	ctx := context.Background()
+	database.CreateRoom(ctx, roomID, "")
+	v, err := database.CreateVersion(ctx, roomID, "v", "", content, db.BlobHash(content), "", false)
+	if err != nil {
+		t.Fatalf("Failed to create version: %v", err)
+	}
+	return v
+}
+
+func TestSplitChunks(t *testing.T) {
+	chunks := splitChunks("a\nb\n\n\nc\nd\ne", 3, 1, 10)
+	got := fmt.Sprint(chunks)
+	if want := "[{1 3 a\nb\n} {3 5 \n\nc} {5 7 c\nd\ne}]"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if chunks := splitChunks(strings.Repeat("x\n", 100), 2, 0, 5); len(chunks) != 5 {
+		t.Errorf("Expected the chunk limit to apply, got %d chunks", len(chunks))
+	}
+}
+
+func TestIndexAndSearch(t *testing.T) {
+	index, database, embedder := setupTestIndex(t)
+	ctx := context.Background()
+
+	v1 := saveVersion(t, database, "notes", "func parseConfig()\nreads the config file\nfunc startServer()\nlistens on a port")
+	if err := index.IndexVersion(ctx, v1); err != nil {
+		t.Fatalf("Failed to index: %v", err)
+	}
+
+	matches, err := index.Search(ctx, "notes", "load the config", 5)
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if len(matches) == 0 || matches[0].StartLine != 1 || matches[0].EndLine != 2 {
+		t.Fatalf("Expected the config chunk first, got %+v", matches)
+	}
+
+	// Only the changed chunk is embedded again
+	before := embedder.calls()
+	v2 := saveVersion(t, database, "notes", "func parseConfig()\nreads the config file\nfunc stopServer()\ncloses the port")
+	if err := index.IndexVersion(ctx, v2); err != nil {
+		t.Fatalf("Failed to index: %v", err)
+	}
+	if embedded := embedder.calls() - before; embedded != 1 {
+		t.Errorf("Expected 1 chunk to be embedded again, got %d", embedded)
+	}
+	if indexed, _ := database.EmbeddingVersion(ctx, "notes"); indexed != v2.ID {
+		t.Errorf("Expected version %d to be indexed, got %d", v2.ID, indexed)
+	}
+
+	matches, _ = index.Search(ctx, "other", "config", 5)
+	if len(matches) != 0 {
+		t.Errorf("Expected no matches in an unindexed room, got %+v", matches)
+	}
+}
+
+func TestSearchQueuesStaleRooms(t *testing.T) {
+	index, database, _ := setupTestIndex(t)
+	index.Start()
+	defer index.Stop()
+
+	v := saveVersion(t, database, "notes", "saved before the index was enabled")
+	index.Search(context.Background(), "notes", "index", 5)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if indexed, _ := database.EmbeddingVersion(context.Background(), "notes"); indexed == v.ID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the room's latest version to be indexed after a search")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
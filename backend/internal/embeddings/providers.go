@@ -0,0 +1,106 @@
+package embeddings
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Posts a JSON request and decodes the JSON reply into out
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(text)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// OpenAI's embeddings API
+type openAI struct {
+	key    string
+	model  string
+	url    string
+	client *http.Client
+}
+
+func newOpenAI(key, model string, timeout time.Duration) *openAI {
+	return &openAI{
+		key:    key,
+		model:  model,
+		url:    "https://api.openai.com/v1/embeddings",
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (o *openAI) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	err := postJSON(ctx, o.client, o.url, map[string]string{"Authorization": "Bearer " + o.key},
+		map[string]interface{}{"model": o.model, "input": texts}, &result)
+	if err != nil {
+		return nil, fmt.Errorf("openai embeddings: %w", err)
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, d := range result.Data {
+		if d.Index < 0 || d.Index >= len(vectors) {
+			return nil, fmt.Errorf("openai embeddings: unexpected index %d", d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	return vectors, nil
+}
+
+// Ollama's /api/embed endpoint
+type ollama struct {
+	model  string
+	url    string
+	client *http.Client
+}
+
+func newOllama(baseURL, model string, timeout time.Duration) *ollama {
+	return &ollama{
+		model:  model,
+		url:    strings.TrimSuffix(baseURL, "/") + "/api/embed",
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (o *ollama) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var result struct {
+		Embeddings [][]float32 `json:"embeddings"`
+	}
+	err := postJSON(ctx, o.client, o.url, nil,
+		map[string]interface{}{"model": o.model, "input": texts}, &result)
+	if err != nil {
+		return nil, fmt.Errorf("ollama embeddings (try 'ollama pull %s'): %w", o.model, err)
+	}
+	return result.Embeddings, nil
+}
@@ -0,0 +1,179 @@
+// Package events fans out room lifecycle and version events to integrations
+// such as search indexers, which follow them over GET /api/events instead of
+// polling the REST API.
+package events
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types. Rooms open when their first session joins and close when the
+// last one leaves; joins and leaves carry the room's Occupancy.
+const (
+	RoomCreated    = "room.created"
+	RoomDeleted    = "room.deleted"
+	RoomArchived   = "room.archived"
+	RoomOpened     = "room.opened"
+	RoomClosed     = "room.closed"
+	RoomJoined     = "room.joined"
+	RoomLeft       = "room.left"
+	VersionCreated = "version.created"
+	VersionDeleted = "version.deleted"
+)
+
+// Event is one occurrence on the server. IDs increase by one per event and
+// restart from 1 with the process.
+type Event struct {
+	ID     uint64      `json:"id"`
+	Type   string      `json:"type"`
+	RoomID string      `json:"room_id"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// Occupancy is the data of room.joined and room.left events
+type Occupancy struct {
+	Users int `json:"users"` // Sessions in the room afterwards
+}
+
+// Filter selects events for a subscriber. Types holds event types or their
+// category ("room" matches every room.* event); empty fields match anything.
+type Filter struct {
+	RoomID string
+	Types  []string
+}
+
+func (f Filter) Match(e Event) bool {
+	if f.RoomID != "" && e.RoomID != f.RoomID {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	category, _, _ := strings.Cut(e.Type, ".")
+	for _, t := range f.Types {
+		if t == e.Type || t == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Events kept for subscribers that reconnect with the last ID they saw
+const historySize = 1024
+
+// Events queued per subscriber before it is dropped as too slow
+const subscriberBuffer = 256
+
+// Broker publishes events to subscribers without ever blocking the
+// publisher. A subscriber that falls behind is closed and may resume from
+// the last event it received.
+type Broker struct {
+	mu      sync.Mutex
+	nextID  uint64
+	history []Event // Ring of the most recent events
+	start   int     // Index of the oldest event in history
+	subs    map[*Subscription]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		nextID: 1,
+		subs:   make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription receives matching events on C until it is closed
+type Subscription struct {
+	C <-chan Event
+
+	ch     chan Event
+	filter Filter
+	broker *Broker
+	closed bool
+}
+
+// Publish records an event and queues it for every matching subscriber
+func (b *Broker) Publish(eventType, roomID string, data interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := Event{ID: b.nextID, Type: eventType, RoomID: roomID, Time: time.Now().UTC(), Data: data}
+	b.nextID++
+
+	if len(b.history) < historySize {
+		b.history = append(b.history, e)
+	} else {
+		b.history[b.start] = e
+		b.start = (b.start + 1) % historySize
+	}
+
+	for sub := range b.subs {
+		if !sub.filter.Match(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			b.closeLocked(sub)
+		}
+	}
+}
+
+// Subscribe starts delivering events that match filter. When lastID is set,
+// the matching events after it that are still held in history are returned
+// for the caller to send first; complete is false if some were discarded or
+// lastID came from before a restart.
+func (b *Broker) Subscribe(filter Filter, lastID uint64) (sub *Subscription, missed []Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	complete = true
+	if lastID >= b.nextID {
+		// Seen before a restart; everything held is new to the caller
+		complete = false
+		lastID = 0
+	}
+	if lastID > 0 || !complete {
+		n := len(b.history)
+		if n > 0 && b.history[b.start].ID > lastID+1 {
+			complete = false
+		}
+		for i := 0; i < n; i++ {
+			e := b.history[(b.start+i)%n]
+			if e.ID > lastID && filter.Match(e) {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	ch := make(chan Event, subscriberBuffer)
+	sub = &Subscription{C: ch, ch: ch, filter: filter, broker: b}
+	b.subs[sub] = struct{}{}
+	return sub, missed, complete
+}
+
+// Close stops delivery and closes C. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	s.broker.closeLocked(s)
+}
+
+func (b *Broker) closeLocked(sub *Subscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(b.subs, sub)
+	close(sub.ch)
+}
+
+// Subscribers returns the number of open subscriptions
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
@@ -0,0 +1,100 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	e := Event{Type: VersionCreated, RoomID: "notes"}
+	cases := []struct {
+		filter Filter
+		want   bool
+	}{
+		{Filter{}, true},
+		{Filter{RoomID: "notes"}, true},
+		{Filter{RoomID: "other"}, false},
+		{Filter{Types: []string{VersionCreated}}, true},
+		{Filter{Types: []string{"version"}}, true},
+		{Filter{Types: []string{"room", VersionDeleted}}, false},
+		{Filter{RoomID: "notes", Types: []string{"room"}}, false},
+	}
+	for _, c := range cases {
+		if got := c.filter.Match(e); got != c.want {
+			t.Errorf("%+v.Match = %v, want %v", c.filter, got, c.want)
+		}
+	}
+}
+
+func TestBrokerDelivers(t *testing.T) {
+	b := NewBroker()
+	sub, missed, complete := b.Subscribe(Filter{Types: []string{"version"}}, 0)
+	defer sub.Close()
+	if len(missed) != 0 || !complete {
+		t.Fatalf("Expected nothing to replay for a new subscriber, got %d (complete %v)", len(missed), complete)
+	}
+
+	b.Publish(RoomCreated, "notes", nil)
+	b.Publish(VersionCreated, "notes", "v1")
+
+	e := <-sub.C
+	if e.Type != VersionCreated || e.ID != 2 || e.Data != "v1" {
+		t.Errorf("Expected version.created with ID 2, got %+v", e)
+	}
+	select {
+	case e := <-sub.C:
+		t.Errorf("Expected only the matching event, also got %+v", e)
+	default:
+	}
+}
+
+func TestBrokerReplay(t *testing.T) {
+	b := NewBroker()
+	for i := 0; i < 5; i++ {
+		b.Publish(RoomOpened, fmt.Sprintf("room-%d", i), nil)
+	}
+
+	sub, missed, complete := b.Subscribe(Filter{}, 3)
+	sub.Close()
+	if !complete || len(missed) != 2 || missed[0].ID != 4 || missed[1].ID != 5 {
+		t.Errorf("Expected events 4 and 5, got %+v (complete %v)", missed, complete)
+	}
+
+	// An ID from before a restart replays everything held
+	sub, missed, complete = b.Subscribe(Filter{}, 100)
+	sub.Close()
+	if complete || len(missed) != 5 {
+		t.Errorf("Expected all 5 events marked incomplete, got %d (complete %v)", len(missed), complete)
+	}
+
+	// Events pushed out of history are reported as lost
+	for i := 0; i < historySize; i++ {
+		b.Publish(RoomClosed, "room", nil)
+	}
+	sub, missed, complete = b.Subscribe(Filter{}, 3)
+	sub.Close()
+	if complete || len(missed) != historySize || missed[0].ID != 6 {
+		t.Errorf("Expected the %d held events marked incomplete, got %d (complete %v)", historySize, len(missed), complete)
+	}
+}
+
+func TestBrokerDropsSlowSubscriber(t *testing.T) {
+	b := NewBroker()
+	sub, _, _ := b.Subscribe(Filter{}, 0)
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		b.Publish(RoomOpened, "notes", nil)
+	}
+
+	received := 0
+	for range sub.C {
+		received++
+	}
+	if received != subscriberBuffer {
+		t.Errorf("Expected %d queued events before the channel closed, got %d", subscriberBuffer, received)
+	}
+	if n := b.Subscribers(); n != 0 {
+		t.Errorf("Expected the slow subscriber to be removed, %d remain", n)
+	}
+	sub.Close()
+}
@@ -0,0 +1,177 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Destination stores exported files
+type Destination interface {
+	// Put writes one file, replacing any earlier export of it
+	Put(ctx context.Context, name string, content []byte) error
+	// Finish is called after a pass that wrote files, with a summary of it
+	Finish(ctx context.Context, message string) error
+	String() string
+}
+
+// Builds the destination a config names without touching it
+func parseDestination(c Config) (Destination, error) {
+	dest := c.Destination
+	switch {
+	case strings.HasPrefix(dest, "s3://"):
+		u, err := url.Parse(dest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 destination: %w", err)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("S3 destination %q has no bucket", dest)
+		}
+		if c.S3.AccessKeyID == "" || c.S3.SecretAccessKey == "" {
+			return nil, fmt.Errorf("S3 destination needs an access key ID and secret access key")
+		}
+		prefix := strings.Trim(u.Path, "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		return &s3Destination{
+			config: c.S3,
+			bucket: u.Host,
+			prefix: prefix,
+			client: &http.Client{Timeout: time.Minute},
+		}, nil
+
+	case strings.HasPrefix(dest, "git+file://"):
+		path := strings.TrimPrefix(dest, "git+file://")
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("git destination %q must be an absolute path", dest)
+		}
+		return &gitDestination{dir: dirDestination{root: path}, push: c.GitPush}, nil
+
+	case strings.HasPrefix(dest, "file://"):
+		path := strings.TrimPrefix(dest, "file://")
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("file destination %q must be an absolute path", dest)
+		}
+		return &dirDestination{root: path}, nil
+
+	case strings.Contains(dest, "://"):
+		return nil, fmt.Errorf("unsupported destination %q", dest)
+
+	default:
+		return &dirDestination{root: dest}, nil
+	}
+}
+
+// Writes files into a local directory
+type dirDestination struct {
+	root string
+}
+
+func (d *dirDestination) String() string {
+	return d.root
+}
+
+// Writes through a temporary file so readers never see a partial export
+func (d *dirDestination) Put(ctx context.Context, name string, content []byte) error {
+	if err := os.MkdirAll(d.root, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(d.root, ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(d.root, name))
+}
+
+func (d *dirDestination) Finish(ctx context.Context, message string) error {
+	return nil
+}
+
+// Writes files into a git checkout and commits them after each pass
+type gitDestination struct {
+	dir  dirDestination
+	push bool
+}
+
+func (g *gitDestination) String() string {
+	return "git+file://" + g.dir.root
+}
+
+func (g *gitDestination) Put(ctx context.Context, name string, content []byte) error {
+	return g.dir.Put(ctx, name, content)
+}
+
+func (g *gitDestination) Finish(ctx context.Context, message string) error {
+	if _, err := os.Stat(filepath.Join(g.dir.root, ".git")); os.IsNotExist(err) {
+		if _, err := g.git(ctx, "init", "--quiet"); err != nil {
+			return err
+		}
+	}
+	if _, err := g.git(ctx, "add", "--all"); err != nil {
+		return err
+	}
+	// Rewriting a file with the same content leaves nothing to commit
+	if status, err := g.git(ctx, "status", "--porcelain"); err != nil || status == "" {
+		return err
+	}
+
+	if _, err := g.gitEnv(ctx, g.committer(ctx), "commit", "--quiet", "--message", message); err != nil {
+		return err
+	}
+	if g.push {
+		if _, err := g.git(ctx, "push", "--quiet"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commits as Lattice unless the repository or user names a committer
+func (g *gitDestination) committer(ctx context.Context) []string {
+	if email, _ := g.git(ctx, "config", "user.email"); email != "" {
+		return nil
+	}
+	return []string{"GIT_COMMITTER_NAME=Lattice", "GIT_COMMITTER_EMAIL=lattice@localhost",
+		"GIT_AUTHOR_NAME=Lattice", "GIT_AUTHOR_EMAIL=lattice@localhost"}
+}
+
+// Runs git in the checkout and returns its trimmed output
+func (g *gitDestination) git(ctx context.Context, args ...string) (string, error) {
+	return g.gitEnv(ctx, nil, args...)
+}
+
+// Runs git with extra environment variables
+func (g *gitDestination) gitEnv(ctx context.Context, env []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = g.dir.root
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,208 @@
+// Package exporter copies documents out of Lattice: Service periodically
+// writes each room's latest saved version to a directory, an S3 bucket or a
+// git repository, for disaster recovery and for indexing documents outside
+// Lattice, and Mirror commits every manual version to git as it is saved.
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// Export formats
+const (
+	FormatText     = "text"
+	FormatMarkdown = "markdown"
+)
+
+type Config struct {
+	Interval time.Duration
+	// Where files go: a directory path (or file:// URL), s3://bucket/prefix,
+	// or git+file:///path for a git checkout that gets a commit per pass
+	Destination string
+	Format      string
+	S3          S3Config
+	GitPush     bool // Push after each commit to a git destination
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval: time.Hour,
+		Format:   FormatText,
+	}
+}
+
+// Validate rejects configurations the exporter can't run with
+func (c Config) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %v", c.Interval)
+	}
+	if c.Format != FormatText && c.Format != FormatMarkdown {
+		return fmt.Errorf("format must be %q or %q, got %q", FormatText, FormatMarkdown, c.Format)
+	}
+	if c.Destination == "" {
+		return fmt.Errorf("destination is required")
+	}
+	_, err := parseDestination(c)
+	return err
+}
+
+// Rooms read per query during a pass
+const pageSize = 200
+
+// Result describes one export pass
+type Result struct {
+	Rooms     int `json:"rooms"`     // Rooms with a saved version
+	Exported  int `json:"exported"`  // Written this pass
+	Unchanged int `json:"unchanged"` // Latest version already exported
+	Failed    int `json:"failed"`
+}
+
+// Service exports rooms on a timer
+type Service struct {
+	database    *db.Database
+	config      Config
+	destination Destination
+	stop        chan struct{}
+	wg          sync.WaitGroup
+
+	// Serializes passes; exported maps each room to the version last
+	// written for it
+	runMu    sync.Mutex
+	exported map[string]int
+}
+
+func New(database *db.Database, config Config) (*Service, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	destination, err := parseDestination(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Service{
+		database:    database,
+		config:      config,
+		destination: destination,
+		stop:        make(chan struct{}),
+		exported:    make(map[string]int),
+	}, nil
+}
+
+func (s *Service) Start() {
+	s.wg.Add(1)
+	go s.run()
+	log.Printf("📤 Exporter started (interval: %v, destination: %s, format: %s)", s.config.Interval, s.destination, s.config.Format)
+}
+
+func (s *Service) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+	log.Println("📤 Exporter stopped")
+}
+
+func (s *Service) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			result, err := s.RunOnce(context.Background())
+			if err != nil {
+				log.Printf("Error exporting rooms: %v", err)
+			}
+			if result.Exported > 0 || result.Failed > 0 {
+				log.Printf("📤 Exported %d rooms (%d unchanged, %d failed)", result.Exported, result.Unchanged, result.Failed)
+			}
+		}
+	}
+}
+
+// RunOnce exports every room whose latest version changed since it was last
+// exported. A room that fails to export is retried on the next pass.
+func (s *Service) RunOnce(ctx context.Context) (Result, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	var result Result
+	written := make(map[string]int)
+	after := ""
+	for {
+		versions, err := s.database.ListLatestVersions(ctx, after, pageSize)
+		if err != nil {
+			return result, err
+		}
+
+		for i := range versions {
+			v := &versions[i]
+			result.Rooms++
+			if s.exported[v.RoomID] == v.ID {
+				result.Unchanged++
+				continue
+			}
+			if err := s.destination.Put(ctx, s.fileName(v.RoomID), s.render(v)); err != nil {
+				log.Printf("Error exporting room %s: %v", v.RoomID, err)
+				result.Failed++
+				continue
+			}
+			written[v.RoomID] = v.ID
+		}
+
+		if len(versions) < pageSize {
+			break
+		}
+		after = versions[len(versions)-1].RoomID
+	}
+
+	if len(written) > 0 {
+		message := fmt.Sprintf("Export %d rooms at %s", len(written), time.Now().UTC().Format(time.RFC3339))
+		if err := s.destination.Finish(ctx, message); err != nil {
+			result.Failed += len(written)
+			return result, err
+		}
+	}
+	for roomID, versionID := range written {
+		s.exported[roomID] = versionID
+	}
+	result.Exported = len(written)
+	return result, nil
+}
+
+// Room IDs are escaped so none can name a path outside the destination
+func (s *Service) fileName(roomID string) string {
+	name := url.PathEscape(roomID)
+	if s.config.Format == FormatMarkdown {
+		return name + ".md"
+	}
+	return name + ".txt"
+}
+
+func (s *Service) render(v *db.Version) []byte {
+	if s.config.Format == FormatText {
+		return []byte(v.Content)
+	}
+
+	// A fence longer than any run of backticks in the content
+	fence := "```"
+	for strings.Contains(v.Content, fence) {
+		fence += "`"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", v.RoomID)
+	fmt.Fprintf(&b, "_%s, saved %s_\n\n", v.Name, v.CreatedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "%s\n%s\n%s\n", fence, v.Content, fence)
+	return []byte(b.String())
+}
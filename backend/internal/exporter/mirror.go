@@ -0,0 +1,224 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// Commit trailer recording which version a mirror commit holds. The newest
+// one tells a restarted mirror where to resume.
+const versionTrailer = "Lattice-Version"
+
+type MirrorConfig struct {
+	Repo     string        // Absolute path of the git checkout; created if missing
+	Interval time.Duration // How often to look for versions nobody announced
+	Push     bool          // Push after each pass that committed
+}
+
+func DefaultMirrorConfig() MirrorConfig {
+	return MirrorConfig{Interval: time.Minute}
+}
+
+// Validate rejects configurations the mirror can't run with
+func (c MirrorConfig) Validate() error {
+	if !filepath.IsAbs(c.Repo) {
+		return fmt.Errorf("repository must be an absolute path, got %q", c.Repo)
+	}
+	if c.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %v", c.Interval)
+	}
+	return nil
+}
+
+// Versions committed per query during a pass
+const mirrorBatch = 100
+
+// Mirror commits every manually saved version to a git repository, one file
+// per room, so document history can be browsed with git tooling. Versions
+// are committed in the order they were saved, each as its own commit
+// authored by the version's creator at the time it was saved.
+type Mirror struct {
+	database *db.Database
+	config   MirrorConfig
+	repo     *gitDestination
+	wake     chan struct{}
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	// Only touched by the run goroutine; -1 until read from the repository
+	last int
+}
+
+func NewMirror(database *db.Database, config MirrorConfig) (*Mirror, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Mirror{
+		database: database,
+		config:   config,
+		repo:     &gitDestination{dir: dirDestination{root: config.Repo}},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		last:     -1,
+	}, nil
+}
+
+func (m *Mirror) Start() {
+	m.wg.Add(1)
+	go m.run()
+	log.Printf("🌿 Git mirror started (repository: %s)", m.config.Repo)
+}
+
+func (m *Mirror) Stop() {
+	close(m.stop)
+	m.wg.Wait()
+	log.Println("🌿 Git mirror stopped")
+}
+
+// VersionSaved wakes the mirror to commit a new version without waiting for
+// the next interval. It never blocks.
+func (m *Mirror) VersionSaved(v *db.Version) {
+	if v.IsAuto {
+		return
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Mirror) run() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := m.sync(context.Background()); err != nil {
+			log.Printf("Error mirroring versions to git: %v", err)
+		} else if n > 0 {
+			log.Printf("🌿 Mirrored %d versions to git", n)
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case <-m.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Commits every manual version newer than the last one mirrored and returns
+// how many it committed. On error the rest wait for the next pass.
+func (m *Mirror) sync(ctx context.Context) (int, error) {
+	if m.last < 0 {
+		last, err := m.lastMirrored(ctx)
+		if err != nil {
+			return 0, err
+		}
+		m.last = last
+	}
+
+	committed := 0
+	for {
+		versions, err := m.database.ListManualVersionsAfter(ctx, m.last, mirrorBatch)
+		if err != nil {
+			return committed, err
+		}
+		for i := range versions {
+			if err := m.commit(ctx, &versions[i]); err != nil {
+				return committed, fmt.Errorf("version %d: %w", versions[i].ID, err)
+			}
+			m.last = versions[i].ID
+			committed++
+		}
+		if len(versions) < mirrorBatch {
+			break
+		}
+	}
+
+	if committed > 0 && m.config.Push {
+		if _, err := m.repo.git(ctx, "push", "--quiet"); err != nil {
+			return committed, err
+		}
+	}
+	return committed, nil
+}
+
+// The version in the newest commit's trailer, or zero for a new repository
+func (m *Mirror) lastMirrored(ctx context.Context) (int, error) {
+	if err := os.MkdirAll(m.config.Repo, 0755); err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(filepath.Join(m.config.Repo, ".git")); os.IsNotExist(err) {
+		_, err := m.repo.git(ctx, "init", "--quiet")
+		return 0, err
+	}
+	if _, err := m.repo.git(ctx, "rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		return 0, nil // No commits yet
+	}
+
+	out, err := m.repo.git(ctx, "log", "--format=%(trailers:key="+versionTrailer+",valueonly)")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if id, err := strconv.Atoi(strings.TrimSpace(line)); err == nil {
+			return id, nil
+		}
+	}
+	return 0, nil
+}
+
+// Writes a version over its room's file and commits it, even if the content
+// did not change, so every version appears in the history
+func (m *Mirror) commit(ctx context.Context, v *db.Version) error {
+	name := url.PathEscape(v.RoomID) + ".txt"
+	if err := m.repo.Put(ctx, name, []byte(v.Content)); err != nil {
+		return err
+	}
+	if _, err := m.repo.git(ctx, "add", "--", name); err != nil {
+		return err
+	}
+
+	message := v.Name
+	if v.Description != "" {
+		message += "\n\n" + v.Description
+	}
+	message += fmt.Sprintf("\n\nLattice-Room: %s\n%s: %d", v.RoomID, versionTrailer, v.ID)
+
+	// Later variables win, so the version's author replaces the fallback
+	env := append(m.repo.committer(ctx),
+		"GIT_AUTHOR_NAME="+gitIdent(v.CreatedBy),
+		"GIT_AUTHOR_EMAIL=",
+		"GIT_AUTHOR_DATE="+v.CreatedAt.UTC().Format(time.RFC3339),
+	)
+	_, err := m.repo.gitEnv(ctx, env, "commit", "--quiet", "--allow-empty", "--message", message)
+	return err
+}
+
+// Git refuses empty names and angle brackets or newlines in them
+func gitIdent(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '<', '>', '\n', '\r':
+			return -1
+		}
+		return r
+	}, name)
+	if strings.TrimSpace(name) == "" {
+		return "Lattice"
+	}
+	return strings.TrimSpace(name)
+}
@@ -0,0 +1,73 @@
+package exporter
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+func TestMirror(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	database := setupTestDB(t)
+	ctx := context.Background()
+	if err := database.CreateRoom(ctx, "notes", ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	create := func(name, description, content, createdBy string, isAuto bool) {
+		t.Helper()
+		if _, err := database.CreateVersion(ctx, "notes", name, description, content, db.BlobHash(content), createdBy, isAuto); err != nil {
+			t.Fatalf("Failed to create version: %v", err)
+		}
+	}
+	create("Draft", "First pass", "one", "ann", false)
+	create("Auto-save", "", "one and", "", true)
+	create("Final", "", "one and two", "", false)
+
+	repo := filepath.Join(t.TempDir(), "mirror")
+	config := DefaultMirrorConfig()
+	config.Repo = repo
+	mirror, err := NewMirror(database, config)
+	if err != nil {
+		t.Fatalf("Failed to create mirror: %v", err)
+	}
+
+	n, err := mirror.sync(ctx)
+	if err != nil {
+		t.Fatalf("Mirror failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Expected the 2 manual versions to be committed, got %d", n)
+	}
+
+	log, err := exec.Command("git", "-C", repo, "log", "--format=%an|%s|%(trailers:key=Lattice-Version,valueonly)").Output()
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	want := "Lattice|Final|3\n\nann|Draft|1"
+	if got := strings.TrimSpace(string(log)); got != want {
+		t.Errorf("Expected commits %q, got %q", want, got)
+	}
+	body, _ := exec.Command("git", "-C", repo, "log", "-1", "--skip=1", "--format=%b").Output()
+	if !strings.HasPrefix(string(body), "First pass\n") {
+		t.Errorf("Expected the description in the commit body, got %q", body)
+	}
+	if data, _ := os.ReadFile(filepath.Join(repo, "notes.txt")); string(data) != "one and two" {
+		t.Errorf("Expected the room's file to hold the latest version, got %q", data)
+	}
+
+	// A restarted mirror resumes after the last committed version, and
+	// commits a version even when its content is unchanged
+	create("Again", "", "one and two", "", false)
+	restarted, _ := NewMirror(database, config)
+	if n, err := restarted.sync(ctx); err != nil || n != 1 {
+		t.Errorf("Expected 1 new commit after restart, got %d (err %v)", n, err)
+	}
+}
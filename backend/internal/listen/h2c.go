@@ -0,0 +1,23 @@
+package listen
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// H2C serves cleartext HTTP/2 to peers trusted reports true for, such as a
+// TLS-terminating proxy on the same network, alongside HTTP/1.1. Both
+// prior-knowledge connections and "Upgrade: h2c" are accepted. Others, and
+// WebSocket handshakes, which need HTTP/1.1, are served as before.
+func H2C(next http.Handler, trusted func(*http.Request) bool) http.Handler {
+	upgraded := h2c.NewHandler(next, &http2.Server{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if trusted(r) {
+			upgraded.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,152 @@
+// Package listen opens the socket the server accepts connections on: a TCP
+// address, a Unix domain socket, or one passed in by systemd socket
+// activation, which lets a hardened unit serve without binding ports
+// itself.
+package listen
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// First file descriptor systemd passes, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// Config says where to listen
+type Config struct {
+	// "tcp://host:port", a bare "host:port", or "unix:///path/to.sock"
+	Address string
+
+	// Permissions of a Unix socket, which decide who may connect
+	SocketMode fs.FileMode
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Address:    ":8080",
+		SocketMode: 0o660,
+	}
+}
+
+func (c Config) Validate() error {
+	if _, _, err := parse(c.Address); err != nil {
+		return err
+	}
+	if c.SocketMode&^fs.ModePerm != 0 {
+		return fmt.Errorf("socket mode %o has bits beyond permissions", c.SocketMode)
+	}
+	return nil
+}
+
+// Listen returns a socket passed in by systemd if there is one, else opens
+// the configured address. The second result describes it for logs.
+func Listen(config Config) (net.Listener, string, error) {
+	if l, err := Activated(); err != nil || l != nil {
+		if err != nil {
+			return nil, "", err
+		}
+		return l, "systemd socket " + l.Addr().String(), nil
+	}
+
+	network, address, err := parse(config.Address)
+	if err != nil {
+		return nil, "", err
+	}
+	if network == "unix" {
+		return listenUnix(address, config.SocketMode)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, "", err
+	}
+	return l, l.Addr().String(), nil
+}
+
+func parse(address string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		path := strings.TrimPrefix(address, "unix://")
+		if path == "" {
+			return "", "", errors.New("unix:// needs a socket path, such as unix:///run/lattice.sock")
+		}
+		return "unix", path, nil
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	case strings.Contains(address, "://"):
+		return "", "", fmt.Errorf("unsupported listen address %q: want tcp:// or unix://", address)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %w", address, err)
+	}
+	return "tcp", address, nil
+}
+
+// Replaces a socket left behind by a server that didn't shut down cleanly,
+// but nothing else at the path
+func listenUnix(path string, mode fs.FileMode) (net.Listener, string, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, "", fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, "", fmt.Errorf("%s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, "", err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, "", err
+	}
+	// Closing the listener removes the socket file
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, "", err
+	}
+	return l, "unix:" + path, nil
+}
+
+// Activated returns the socket systemd passed this process through
+// LISTEN_FDS and LISTEN_PID, or nil if it passed none. Only one socket is
+// supported. The variables are cleared so child processes don't take it
+// for theirs.
+func Activated() (net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets; configure one", n)
+	}
+
+	syscall.CloseOnExec(listenFDsStart)
+	file := os.NewFile(listenFDsStart, "systemd")
+	defer file.Close()
+	l, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("socket from systemd: %w", err)
+	}
+	return l, nil
+}
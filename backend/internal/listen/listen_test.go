@@ -0,0 +1,139 @@
+package listen
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestValidate(t *testing.T) {
+	for _, address := range []string{":8080", "127.0.0.1:0", "tcp://[::1]:8080", "unix:///run/lattice.sock"} {
+		config := DefaultConfig()
+		config.Address = address
+		if err := config.Validate(); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", address, err)
+		}
+	}
+	for _, address := range []string{"8080", "unix://", "http://localhost:8080"} {
+		config := DefaultConfig()
+		config.Address = address
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected %q to be rejected", address)
+		}
+	}
+
+	config := DefaultConfig()
+	config.SocketMode = 0o4755
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a setuid socket mode to be rejected")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lattice.sock")
+	config := Config{Address: "unix://" + path, SocketMode: 0o600}
+
+	l, desc, err := Listen(config)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if desc != "unix:"+path {
+		t.Errorf("Unexpected description %q", desc)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Socket missing: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected mode 600, got %o", info.Mode().Perm())
+	}
+
+	// A live socket is not taken over
+	if _, _, err := Listen(config); err == nil {
+		t.Error("Expected a socket in use to be refused")
+	}
+	l.Close()
+
+	// A stale one is, but nothing that isn't a socket
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	l, _, err = Listen(config)
+	if err != nil {
+		t.Fatalf("Expected a stale socket to be replaced, got %v", err)
+	}
+	l.Close()
+
+	regular := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(regular, nil, 0o644)
+	if _, _, err := Listen(Config{Address: "unix://" + regular, SocketMode: 0o600}); err == nil {
+		t.Error("Expected a regular file to be left alone")
+	}
+}
+
+func TestActivated(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", "1")
+	l, err := Activated()
+	if err != nil || l != nil {
+		t.Errorf("Expected sockets meant for another process to be ignored, got %v %v", l, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("Expected LISTEN_FDS to be cleared")
+	}
+
+	l, err = Activated()
+	if err != nil || l != nil {
+		t.Errorf("Expected no socket without LISTEN_FDS, got %v %v", l, err)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	trusted := true
+	server := httptest.NewServer(H2C(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}), func(*http.Request) bool { return trusted }))
+	defer server.Close()
+
+	// Prior knowledge, as proxies speak it
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	get := func(c *http.Client) (string, error) {
+		resp, err := c.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	if proto, err := get(client); err != nil || proto != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2.0 from a trusted peer, got %q %v", proto, err)
+	}
+	if proto, err := get(http.DefaultClient); err != nil || proto != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1 to keep working, got %q %v", proto, err)
+	}
+
+	trusted = false
+	client.CloseIdleConnections()
+	if _, err := get(client); err == nil {
+		t.Error("Expected h2c from an untrusted peer to be refused")
+	}
+}
@@ -0,0 +1,236 @@
+// Package metrics exposes hub load in the Prometheus text format, for
+// scraping into dashboards. Besides server-wide gauges it reports clients
+// and message rate for the busiest rooms only: each per-room metric carries
+// at most TopRooms room labels and sums every other room into one series
+// without a room label, so the number of series stays bounded however many
+// rooms are open.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/ws"
+)
+
+// ContentType is the Prometheus text exposition format Write produces
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type Config struct {
+	TopRooms int           // Rooms labelled per metric; zero reports server-wide metrics only
+	Interval time.Duration // How often room message rates are measured
+}
+
+func DefaultConfig() Config {
+	return Config{
+		TopRooms: 10,
+		Interval: 15 * time.Second,
+	}
+}
+
+// Validate rejects configurations the collector can't run with
+func (c Config) Validate() error {
+	if c.TopRooms < 0 {
+		return fmt.Errorf("top rooms must not be negative, got %d", c.TopRooms)
+	}
+	if c.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %v", c.Interval)
+	}
+	return nil
+}
+
+// Source provides live load from the WebSocket hub
+type Source interface {
+	GetRoomCount() int
+	GetClientCount() int
+	MessageCount() uint64
+	GetRoomActivity() map[string]ws.RoomActivity
+}
+
+// Collector measures per-room message rates and writes metrics on request
+type Collector struct {
+	config Config
+	source Source
+	stop   chan struct{}
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	rates map[string]float64 // Messages per second over the last interval
+
+	// Only touched by the run goroutine
+	lastSample   time.Time
+	lastMessages map[string]uint64
+}
+
+func New(source Source, config Config) (*Collector, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Collector{
+		config: config,
+		source: source,
+		stop:   make(chan struct{}),
+		rates:  make(map[string]float64),
+	}, nil
+}
+
+func (c *Collector) Start() {
+	if c.config.TopRooms == 0 {
+		log.Println("📉 Metrics started (server-wide only)")
+		return
+	}
+	c.wg.Add(1)
+	go c.run()
+	log.Printf("📉 Metrics started (top %d rooms, interval: %v)", c.config.TopRooms, c.config.Interval)
+}
+
+func (c *Collector) Stop() {
+	close(c.stop)
+	c.wg.Wait()
+	log.Println("📉 Metrics stopped")
+}
+
+func (c *Collector) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	c.lastSample = time.Now()
+	c.lastMessages = messageCounts(c.source.GetRoomActivity())
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			c.sample(now, c.source.GetRoomActivity())
+		}
+	}
+}
+
+// Measures each room's message rate since the previous sample. A room that
+// opened, or closed and reopened, in between has counted from zero.
+func (c *Collector) sample(now time.Time, activity map[string]ws.RoomActivity) {
+	elapsed := now.Sub(c.lastSample).Seconds()
+	counts := messageCounts(activity)
+
+	rates := make(map[string]float64, len(counts))
+	if elapsed > 0 {
+		for roomID, count := range counts {
+			delta := count
+			if last, ok := c.lastMessages[roomID]; ok && count >= last {
+				delta = count - last
+			}
+			rates[roomID] = float64(delta) / elapsed
+		}
+	}
+	c.lastSample = now
+	c.lastMessages = counts
+
+	c.mu.Lock()
+	c.rates = rates
+	c.mu.Unlock()
+}
+
+func messageCounts(activity map[string]ws.RoomActivity) map[string]uint64 {
+	counts := make(map[string]uint64, len(activity))
+	for roomID, a := range activity {
+		counts[roomID] = a.Messages
+	}
+	return counts
+}
+
+// Write renders the current metrics in the Prometheus text format
+func (c *Collector) Write(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+
+	writeMetric(buf, "lattice_active_rooms", "gauge", "Rooms with at least one connected client.",
+		sample{value: float64(c.source.GetRoomCount())})
+	writeMetric(buf, "lattice_active_clients", "gauge", "Connected clients across all rooms.",
+		sample{value: float64(c.source.GetClientCount())})
+	writeMetric(buf, "lattice_messages_relayed_total", "counter", "Messages received from clients since the server started.",
+		sample{value: float64(c.source.MessageCount())})
+
+	if c.config.TopRooms > 0 {
+		activity := c.source.GetRoomActivity()
+		clients := make(map[string]float64, len(activity))
+		for roomID, a := range activity {
+			clients[roomID] = float64(a.Clients)
+		}
+
+		// Rates of rooms that have closed since the last sample are dropped
+		c.mu.Lock()
+		rates := make(map[string]float64, len(c.rates))
+		for roomID, rate := range c.rates {
+			if _, ok := activity[roomID]; ok {
+				rates[roomID] = rate
+			}
+		}
+		c.mu.Unlock()
+
+		writeMetric(buf, "lattice_room_clients", "gauge",
+			fmt.Sprintf("Connected clients of the %d busiest rooms; the series without a room label sums the rest.", c.config.TopRooms),
+			topRooms(clients, c.config.TopRooms)...)
+		writeMetric(buf, "lattice_room_messages_per_second", "gauge",
+			fmt.Sprintf("Messages per second over the last %v in the %d busiest rooms; the series without a room label sums the rest.", c.config.Interval, c.config.TopRooms),
+			topRooms(rates, c.config.TopRooms)...)
+	}
+
+	return buf.Flush()
+}
+
+type sample struct {
+	room  string // Empty for unlabelled series
+	value float64
+}
+
+// Returns the n rooms with the highest values, ties broken by room ID so
+// the same rooms are reported between scrapes, followed by the sum of the
+// others
+func topRooms(values map[string]float64, n int) []sample {
+	samples := make([]sample, 0, len(values))
+	for roomID, v := range values {
+		samples = append(samples, sample{room: roomID, value: v})
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].value != samples[j].value {
+			return samples[i].value > samples[j].value
+		}
+		return samples[i].room < samples[j].room
+	})
+
+	rest := sample{}
+	if len(samples) > n {
+		for _, s := range samples[n:] {
+			rest.value += s.value
+		}
+		samples = samples[:n]
+	}
+	return append(samples, rest)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, samples ...sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		value := strconv.FormatFloat(s.value, 'g', -1, 64)
+		if s.room == "" {
+			fmt.Fprintf(w, "%s %s\n", name, value)
+		} else {
+			fmt.Fprintf(w, "%s{room=\"%s\"} %s\n", name, escapeLabel(s.room), value)
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/ws"
+)
+
+type fakeSource struct {
+	activity map[string]ws.RoomActivity
+	messages uint64
+}
+
+func (s *fakeSource) GetRoomCount() int { return len(s.activity) }
+func (s *fakeSource) GetClientCount() int {
+	count := 0
+	for _, a := range s.activity {
+		count += a.Clients
+	}
+	return count
+}
+func (s *fakeSource) MessageCount() uint64                        { return s.messages }
+func (s *fakeSource) GetRoomActivity() map[string]ws.RoomActivity { return s.activity }
+
+func TestConfigValidate(t *testing.T) {
+	config := DefaultConfig()
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected the default config to be valid, got %v", err)
+	}
+	config.TopRooms = -1
+	if err := config.Validate(); err == nil {
+		t.Error("Expected negative top rooms to be rejected")
+	}
+	config = DefaultConfig()
+	config.Interval = 0
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a zero interval to be rejected")
+	}
+}
+
+func TestTopRooms(t *testing.T) {
+	config := DefaultConfig()
+	config.TopRooms = 2
+	source := &fakeSource{
+		activity: map[string]ws.RoomActivity{
+			"busy":    {Clients: 9, Messages: 100},
+			"medium":  {Clients: 4, Messages: 10},
+			"quiet":   {Clients: 1, Messages: 0},
+			"another": {Clients: 1, Messages: 40},
+		},
+		messages: 150,
+	}
+	collector, err := New(source, config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	start := time.Now()
+	collector.lastSample = start
+	collector.lastMessages = map[string]uint64{"busy": 40, "medium": 10, "another": 50}
+	// "another" closed and reopened, so its count restarted from zero
+	collector.sample(start.Add(10*time.Second), source.activity)
+
+	var out strings.Builder
+	if err := collector.Write(&out); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	text := out.String()
+
+	for _, want := range []string{
+		"lattice_active_rooms 4\n",
+		"lattice_active_clients 15\n",
+		"# TYPE lattice_messages_relayed_total counter\n",
+		"lattice_messages_relayed_total 150\n",
+		"lattice_room_clients{room=\"busy\"} 9\n",
+		"lattice_room_clients{room=\"medium\"} 4\n",
+		// Ties are broken by room ID, and the rest are summed
+		"lattice_room_clients 2\n",
+		"lattice_room_messages_per_second{room=\"busy\"} 6\n",
+		"lattice_room_messages_per_second{room=\"another\"} 4\n",
+		"lattice_room_messages_per_second 0\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %q in metrics:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, `room="quiet"`) {
+		t.Errorf("Expected rooms beyond the top 2 to be unlabelled:\n%s", text)
+	}
+
+	// Rooms that closed since the sample drop out of the rates
+	delete(source.activity, "busy")
+	out.Reset()
+	if err := collector.Write(&out); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if strings.Contains(out.String(), `lattice_room_messages_per_second{room="busy"}`) {
+		t.Errorf("Expected the closed room's rate to be dropped:\n%s", out.String())
+	}
+}
+
+func TestServerWideOnly(t *testing.T) {
+	config := DefaultConfig()
+	config.TopRooms = 0
+	source := &fakeSource{activity: map[string]ws.RoomActivity{"room": {Clients: 1}}}
+	collector, err := New(source, config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	collector.Start()
+	defer collector.Stop()
+
+	var out strings.Builder
+	if err := collector.Write(&out); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "lattice_active_clients 1\n") || strings.Contains(out.String(), "lattice_room_") {
+		t.Errorf("Expected only server-wide metrics:\n%s", out.String())
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("Expected quotes, backslashes and newlines escaped, got %s", got)
+	}
+}
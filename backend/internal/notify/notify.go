@@ -0,0 +1,249 @@
+// Package notify posts chat messages to Slack and Discord incoming webhooks
+// when something happens that people in a team channel care about: a
+// version is saved by hand, a room is restored to an earlier version, or a
+// room gets busy. It follows the same events as GET /api/events.
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+)
+
+type Config struct {
+	SlackWebhookURL   string
+	DiscordWebhookURL string
+
+	// Notify when a room reaches this many sessions; zero disables. A room
+	// is announced again only after dropping below half of it.
+	UserThreshold int
+
+	// Frontend address rooms are linked from, e.g. https://lattice.example.com;
+	// messages carry no links when empty
+	PublicURL string
+
+	Timeout time.Duration // Per webhook request
+}
+
+func DefaultConfig() Config {
+	return Config{
+		UserThreshold: 10,
+		Timeout:       10 * time.Second,
+	}
+}
+
+// Enabled reports whether any webhook is configured
+func (c Config) Enabled() bool {
+	return c.SlackWebhookURL != "" || c.DiscordWebhookURL != ""
+}
+
+// Validate rejects configurations the notifier can't run with
+func (c Config) Validate() error {
+	for name, raw := range map[string]string{
+		"Slack webhook URL":   c.SlackWebhookURL,
+		"Discord webhook URL": c.DiscordWebhookURL,
+		"public URL":          c.PublicURL,
+	} {
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s must be an http(s) URL, got %q", name, raw)
+		}
+	}
+	if c.UserThreshold < 0 {
+		return fmt.Errorf("user threshold must not be negative, got %d", c.UserThreshold)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive, got %v", c.Timeout)
+	}
+	return nil
+}
+
+// Message is a notification before it is formatted for a chat service
+type Message struct {
+	Title  string
+	Text   string // Plain text; each target escapes it
+	RoomID string
+	Link   string // Room URL, if a public URL is configured
+	Color  int    // Accent as 0xRRGGBB
+}
+
+// Accents by kind of notification
+const (
+	colorVersion = 0x2eb67d
+	colorRestore = 0xecb22e
+	colorBusy    = 0x36c5f0
+)
+
+// Notifier turns events into chat messages
+type Notifier struct {
+	config  Config
+	broker  *events.Broker
+	targets []target
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	// Rooms announced as busy and not yet quiet again; only touched by the
+	// run goroutine
+	busy map[string]bool
+}
+
+func New(broker *events.Broker, config Config) (*Notifier, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	n := &Notifier{
+		config: config,
+		broker: broker,
+		stop:   make(chan struct{}),
+		busy:   make(map[string]bool),
+	}
+	if config.SlackWebhookURL != "" {
+		n.targets = append(n.targets, newSlack(config.SlackWebhookURL, config.Timeout))
+	}
+	if config.DiscordWebhookURL != "" {
+		n.targets = append(n.targets, newDiscord(config.DiscordWebhookURL, config.Timeout))
+	}
+	return n, nil
+}
+
+func (n *Notifier) Start() {
+	n.wg.Add(1)
+	go n.run()
+	log.Printf("🔔 Notifications started (%d webhooks, busy rooms at %d users)", len(n.targets), n.config.UserThreshold)
+}
+
+func (n *Notifier) Stop() {
+	close(n.stop)
+	n.wg.Wait()
+	log.Println("🔔 Notifications stopped")
+}
+
+var filter = events.Filter{Types: []string{
+	events.VersionCreated, events.RoomJoined, events.RoomLeft, events.RoomDeleted,
+}}
+
+func (n *Notifier) run() {
+	defer n.wg.Done()
+
+	var lastID uint64
+	for {
+		// Resubscribes after falling behind, picking up what was missed
+		sub, missed, _ := n.broker.Subscribe(filter, lastID)
+		for _, e := range missed {
+			n.handle(e)
+			lastID = e.ID
+		}
+
+		for open := true; open; {
+			select {
+			case <-n.stop:
+				sub.Close()
+				return
+			case e, ok := <-sub.C:
+				if !ok {
+					open = false
+					continue
+				}
+				n.handle(e)
+				lastID = e.ID
+			}
+		}
+	}
+}
+
+// Posts the message for an event, if it calls for one
+func (n *Notifier) handle(e events.Event) {
+	m, ok := n.message(e)
+	if !ok {
+		return
+	}
+	for _, t := range n.targets {
+		if err := t.post(m); err != nil {
+			log.Printf("Error posting notification to %s: %v", t, err)
+		}
+	}
+}
+
+// The fields of version event data that messages use. Event data is read
+// from its JSON form, as any other subscriber sees it.
+type versionData struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	CreatedBy      string `json:"created_by"`
+	IsAuto         bool   `json:"is_auto"`
+	RestoredFromID int    `json:"restored_from_id"`
+}
+
+func decodeData(e events.Event, v interface{}) bool {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+func (n *Notifier) message(e events.Event) (Message, bool) {
+	m := Message{RoomID: e.RoomID, Link: n.roomLink(e.RoomID)}
+
+	switch e.Type {
+	case events.VersionCreated:
+		var v versionData
+		if !decodeData(e, &v) || v.IsAuto {
+			return m, false
+		}
+		by := v.CreatedBy
+		if by == "" {
+			by = "Someone"
+		}
+		if v.RestoredFromID != 0 {
+			m.Title = fmt.Sprintf("%s restored %s to version %d", by, e.RoomID, v.RestoredFromID)
+			m.Color = colorRestore
+		} else {
+			m.Title = fmt.Sprintf("%s saved \"%s\" in %s", by, v.Name, e.RoomID)
+			m.Color = colorVersion
+		}
+		m.Text = v.Description
+		return m, true
+
+	case events.RoomJoined:
+		var o events.Occupancy
+		if n.config.UserThreshold == 0 || !decodeData(e, &o) || o.Users < n.config.UserThreshold || n.busy[e.RoomID] {
+			return m, false
+		}
+		n.busy[e.RoomID] = true
+		m.Title = fmt.Sprintf("%s is busy: %d people are editing", e.RoomID, o.Users)
+		m.Color = colorBusy
+		return m, true
+
+	case events.RoomLeft:
+		var o events.Occupancy
+		if n.busy[e.RoomID] && decodeData(e, &o) && o.Users < (n.config.UserThreshold+1)/2 {
+			delete(n.busy, e.RoomID)
+		}
+
+	case events.RoomDeleted:
+		delete(n.busy, e.RoomID)
+	}
+	return m, false
+}
+
+func (n *Notifier) roomLink(roomID string) string {
+	if n.config.PublicURL == "" {
+		return ""
+	}
+	u, err := url.Parse(n.config.PublicURL)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = url.Values{"room": {roomID}}.Encode()
+	return u.String()
+}
@@ -0,0 +1,147 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+)
+
+// Records the JSON bodies posted to a fake webhook
+func webhookServer(t *testing.T, status int) (*httptest.Server, chan map[string]interface{}) {
+	t.Helper()
+	posts := make(chan map[string]interface{}, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Invalid webhook body: %v", err)
+		}
+		posts <- body
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, posts
+}
+
+func next(t *testing.T, posts chan map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	select {
+	case body := <-posts:
+		return body
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a webhook post")
+		return nil
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := DefaultConfig()
+	if config.Enabled() {
+		t.Error("Expected the default config to be disabled")
+	}
+	config.SlackWebhookURL = "https://hooks.slack.com/services/T/B/X"
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected a Slack URL to be valid, got %v", err)
+	}
+	config.DiscordWebhookURL = "discord.com/api/webhooks/1/x"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a URL without a scheme to be rejected")
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	slackServer, slackPosts := webhookServer(t, http.StatusOK)
+	discordServer, discordPosts := webhookServer(t, http.StatusNoContent)
+
+	broker := events.NewBroker()
+	config := DefaultConfig()
+	config.SlackWebhookURL = slackServer.URL + "/services/secret"
+	config.DiscordWebhookURL = discordServer.URL + "/api/webhooks/secret"
+	config.UserThreshold = 2
+	config.PublicURL = "https://lattice.example.com/"
+	n, err := New(broker, config)
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+	n.Start()
+	defer n.Stop()
+
+	// Wait for the subscription so no event is published before it
+	for broker.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	type version struct {
+		Name           string `json:"name"`
+		Description    string `json:"description"`
+		CreatedBy      string `json:"created_by"`
+		IsAuto         bool   `json:"is_auto"`
+		RestoredFromID int    `json:"restored_from_id,omitempty"`
+	}
+	broker.Publish(events.VersionCreated, "notes", version{Name: "Auto-save", IsAuto: true})
+	broker.Publish(events.VersionCreated, "notes", version{Name: "Draft <1>", Description: "@everyone *look*", CreatedBy: "ann"})
+
+	slackBody := next(t, slackPosts)
+	if slackBody["text"] != `ann saved "Draft <1>" in notes` {
+		t.Errorf("Expected the auto-save to be skipped and the draft announced, got %v", slackBody["text"])
+	}
+	attachment := slackBody["attachments"].([]interface{})[0].(map[string]interface{})
+	section := attachment["blocks"].([]interface{})[0].(map[string]interface{})
+	text := section["text"].(map[string]interface{})["text"]
+	if text != "*<https://lattice.example.com/?room=notes|ann saved \"Draft &lt;1&gt;\" in notes>*\n@everyone *look*" {
+		t.Errorf("Expected an escaped title linking to the room, got %q", text)
+	}
+
+	discordBody := next(t, discordPosts)
+	embed := discordBody["embeds"].([]interface{})[0].(map[string]interface{})
+	if embed["description"] != `@everyone \*look\*` || embed["url"] != "https://lattice.example.com/?room=notes" {
+		t.Errorf("Expected an escaped description and room link, got %v", embed)
+	}
+	if mentions, _ := json.Marshal(discordBody["allowed_mentions"]); string(mentions) != `{"parse":[]}` {
+		t.Errorf("Expected mentions to be disabled, got %s", mentions)
+	}
+
+	broker.Publish(events.VersionCreated, "notes", version{Name: "Restored", CreatedBy: "bo", RestoredFromID: 3})
+	if body := next(t, slackPosts); body["text"] != "bo restored notes to version 3" {
+		t.Errorf("Expected a restore message, got %v", body["text"])
+	}
+	next(t, discordPosts)
+
+	// Busy once at the threshold, and again only after the room quietens
+	broker.Publish(events.RoomJoined, "notes", events.Occupancy{Users: 1})
+	broker.Publish(events.RoomJoined, "notes", events.Occupancy{Users: 2})
+	broker.Publish(events.RoomJoined, "notes", events.Occupancy{Users: 3})
+	broker.Publish(events.RoomLeft, "notes", events.Occupancy{Users: 2})
+	broker.Publish(events.RoomJoined, "notes", events.Occupancy{Users: 3})
+	broker.Publish(events.RoomLeft, "notes", events.Occupancy{Users: 0})
+	broker.Publish(events.RoomJoined, "notes", events.Occupancy{Users: 2})
+
+	for i := 0; i < 2; i++ {
+		if body := next(t, slackPosts); body["text"] != "notes is busy: 2 people are editing" {
+			t.Errorf("Expected a busy room message, got %v", body["text"])
+		}
+		next(t, discordPosts)
+	}
+	select {
+	case body := <-slackPosts:
+		t.Errorf("Expected two busy messages, also got %v", body["text"])
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookErrorHidesURL(t *testing.T) {
+	server, posts := webhookServer(t, http.StatusForbidden)
+	s := newSlack(server.URL+"/services/secret", time.Second)
+	err := s.post(Message{Title: "Hello"})
+	<-posts
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("Expected an error without the webhook path, got %v", err)
+	}
+	if strings.Contains(s.String(), "secret") {
+		t.Errorf("Expected the target name without the webhook path, got %s", s)
+	}
+}
@@ -0,0 +1,147 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A chat service that messages are posted to
+type target interface {
+	post(m Message) error
+	String() string
+}
+
+// Posts JSON payloads to an incoming webhook URL
+type webhook struct {
+	name    string
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+func (w *webhook) String() string {
+	// The path of a webhook URL is its secret
+	u, err := url.Parse(w.url)
+	if err != nil {
+		return w.name
+	}
+	return w.name + " (" + u.Host + ")"
+}
+
+func (w *webhook) send(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// Errors quote the URL, which holds the secret
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(text)))
+	}
+	return nil
+}
+
+// Slack incoming webhook, formatted with Block Kit
+type slack struct{ webhook }
+
+func newSlack(webhookURL string, timeout time.Duration) *slack {
+	return &slack{webhook{name: "Slack", url: webhookURL, timeout: timeout, client: &http.Client{}}}
+}
+
+func (s *slack) post(m Message) error {
+	title := "*" + slackEscape(m.Title) + "*"
+	if m.Link != "" {
+		title = "*<" + m.Link + "|" + slackEscape(m.Title) + ">*"
+	}
+	text := title
+	if m.Text != "" {
+		text += "\n" + slackEscape(m.Text)
+	}
+
+	return s.send(map[string]interface{}{
+		"text": m.Title, // Shown in notifications
+		"attachments": []map[string]interface{}{{
+			"color": fmt.Sprintf("#%06x", m.Color),
+			"blocks": []map[string]interface{}{{
+				"type": "section",
+				"text": map[string]string{"type": "mrkdwn", "text": text},
+			}},
+		}},
+	})
+}
+
+// Slack treats &, < and > as markup in message text
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// Discord webhook, formatted as an embed
+type discord struct{ webhook }
+
+func newDiscord(webhookURL string, timeout time.Duration) *discord {
+	return &discord{webhook{name: "Discord", url: webhookURL, timeout: timeout, client: &http.Client{}}}
+}
+
+func (d *discord) post(m Message) error {
+	embed := map[string]interface{}{
+		"title": truncate(m.Title, 256),
+		"color": m.Color,
+	}
+	if m.Text != "" {
+		embed["description"] = truncate(discordEscape(m.Text), 4096)
+	}
+	if m.Link != "" {
+		embed["url"] = m.Link
+	}
+
+	return d.send(map[string]interface{}{
+		"embeds": []interface{}{embed},
+		// Room and version names must not ping anyone
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+	})
+}
+
+// Backslash-escapes Discord markdown in descriptions
+func discordEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune("\\*_~`|>[]", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Discord rejects embeds with fields over its length limits
+func truncate(s string, limit int) string {
+	runes := []rune(s)
+	if len(runes) <= limit {
+		return s
+	}
+	return string(runes[:limit-1]) + "…"
+}
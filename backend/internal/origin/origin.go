@@ -0,0 +1,117 @@
+// Package origin decides which browser origins may use the server. CORS and
+// the WebSocket upgrader share one allowlist, since browsers enforce CORS on
+// REST calls but let any page open a WebSocket.
+package origin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Allowlist holds the origins allowed to make cross-origin requests. With
+// no entries, or "*", every origin is allowed. A nil *Allowlist allows
+// everything too.
+type Allowlist struct {
+	any       bool
+	origins   map[string]bool
+	wildcards []wildcard
+}
+
+// Every subdomain of a domain, e.g. scheme "https" and suffix ".example.com"
+type wildcard struct {
+	scheme, suffix string
+}
+
+// Parse reads a comma-separated list of origins such as
+// "https://app.example.com, http://localhost:5173". An entry may start its
+// host with "*." to allow every subdomain.
+func Parse(spec string) (*Allowlist, error) {
+	a := &Allowlist{origins: make(map[string]bool)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			a.any = true
+			continue
+		}
+
+		candidate := entry
+		scheme, domain, isWildcard := strings.Cut(entry, "://*.")
+		if isWildcard {
+			candidate = scheme + "://" + domain
+		}
+		normalized, ok := normalize(candidate)
+		if !ok {
+			return nil, fmt.Errorf("invalid origin %q: want scheme://host[:port]", entry)
+		}
+		if isWildcard {
+			scheme, host, _ := strings.Cut(normalized, "://")
+			a.wildcards = append(a.wildcards, wildcard{scheme: scheme, suffix: "." + host})
+			continue
+		}
+		a.origins[normalized] = true
+	}
+	if len(a.origins) == 0 && len(a.wildcards) == 0 {
+		a.any = true
+	}
+	return a, nil
+}
+
+// Any reports whether every origin is allowed
+func (a *Allowlist) Any() bool {
+	return a == nil || a.any
+}
+
+// Allowed reports whether a browser page at origin may use the server
+func (a *Allowlist) Allowed(origin string) bool {
+	if a.Any() {
+		return true
+	}
+	normalized, ok := normalize(origin)
+	if !ok {
+		return false
+	}
+	if a.origins[normalized] {
+		return true
+	}
+	scheme, host, _ := strings.Cut(normalized, "://")
+	for _, w := range a.wildcards {
+		if w.scheme == scheme && strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check reports whether a request may be served. Requests without an Origin
+// header come from outside a browser and same-origin requests from the
+// server's own pages, so both are allowed whatever the list says.
+func (a *Allowlist) Check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || a.Any() {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return a.Allowed(origin)
+}
+
+// Lower-cases an origin and drops its default port, as browsers send it.
+// Anything with a path, query or credentials is not an origin.
+func normalize(origin string) (string, bool) {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", false
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	if port := u.Port(); (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		host = strings.TrimSuffix(host, ":"+port)
+	}
+	return scheme + "://" + host, true
+}
@@ -0,0 +1,93 @@
+package origin
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	a, err := Parse(" https://app.example.com:443, http://localhost:5173 ,https://*.example.org,")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if a.Any() {
+		t.Error("Expected a list of origins not to allow any")
+	}
+
+	for _, spec := range []string{"app.example.com", "ftp://example.com", "https://example.com/path", "https://user@example.com", "https://"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+
+	for _, spec := range []string{"", "*", "https://app.example.com,*"} {
+		if a, err := Parse(spec); err != nil || !a.Any() {
+			t.Errorf("Expected %q to allow any origin, got %v", spec, err)
+		}
+	}
+
+	var none *Allowlist
+	if !none.Any() || !none.Allowed("https://anywhere.example") {
+		t.Error("Expected a nil allowlist to allow any origin")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	a, err := Parse("https://app.example.com, http://localhost:5173, https://*.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://App.Example.com:443", true},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8443", false},
+		{"http://localhost:5173", true},
+		{"http://localhost:3000", false},
+		{"https://docs.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"http://docs.example.org", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := a.Allowed(tt.origin); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	a, err := Parse("https://app.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		host   string
+		origin string
+		want   bool
+	}{
+		{"no origin", "lattice.example.com", "", true},
+		{"same origin", "lattice.example.com", "https://lattice.example.com", true},
+		{"allowed origin", "lattice.example.com", "https://app.example.com", true},
+		{"foreign origin", "lattice.example.com", "https://evil.example.net", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://"+tt.host+"/ws", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if got := a.Check(req); got != tt.want {
+				t.Errorf("Check() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
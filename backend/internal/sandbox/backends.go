@@ -0,0 +1,92 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// Languages each backend knows how to run. Compiled languages build into
+// /tmp, the only writable place in a Docker sandbox.
+var backendLanguages = map[string]map[string]Language{
+	"docker": {
+		"python":     {File: "main.py", Image: "python:3.12-alpine", Command: []string{"python3", "main.py"}},
+		"javascript": {File: "main.js", Image: "node:20-alpine", Command: []string{"node", "main.js"}},
+		"typescript": {File: "main.ts", Image: "denoland/deno:alpine", Command: []string{"deno", "run", "--quiet", "main.ts"}},
+		"go":         {File: "main.go", Image: "golang:1.22-alpine", Command: []string{"go", "run", "main.go"}},
+		"rust":       {File: "main.rs", Image: "rust:1-alpine", Command: []string{"sh", "-c", "rustc -o /tmp/main main.rs && /tmp/main"}},
+		"c":          {File: "main.c", Image: "gcc:14", Command: []string{"sh", "-c", "gcc -O2 -o /tmp/main main.c && /tmp/main"}},
+		"cpp":        {File: "main.cpp", Image: "gcc:14", Command: []string{"sh", "-c", "g++ -O2 -o /tmp/main main.cpp && /tmp/main"}},
+		"java":       {File: "Main.java", Image: "eclipse-temurin:21-jdk-alpine", Command: []string{"java", "Main.java"}},
+	},
+	// Runs the host's toolchains
+	"firejail": {
+		"python":     {File: "main.py", Command: []string{"python3", "main.py"}},
+		"javascript": {File: "main.js", Command: []string{"node", "main.js"}},
+		"go":         {File: "main.go", Command: []string{"go", "run", "main.go"}},
+		"c":          {File: "main.c", Command: []string{"sh", "-c", "gcc -O2 -o main main.c && ./main"}},
+		"cpp":        {File: "main.cpp", Command: []string{"sh", "-c", "g++ -O2 -o main main.cpp && ./main"}},
+	},
+}
+
+// Runs each program in a fresh container with no network, a read-only root
+// and the code mounted read-only
+type docker struct {
+	config Config
+}
+
+func (d *docker) command(ctx context.Context, lang Language, dir, name string) *exec.Cmd {
+	memory := strconv.FormatInt(d.config.MemoryBytes, 10)
+	args := []string{
+		"run", "--rm", "-i",
+		"--name", name,
+		"--network", "none",
+		"--memory", memory, "--memory-swap", memory,
+		"--pids-limit", strconv.Itoa(d.config.Pids),
+		"--read-only",
+		"--tmpfs", "/tmp:rw,exec,size=64m",
+		"--user", "65534:65534",
+		"--cap-drop", "ALL",
+		"--security-opt", "no-new-privileges",
+		"-e", "HOME=/tmp", "-e", "GOCACHE=/tmp/go-cache", "-e", "GOPATH=/tmp/go", "-e", "DENO_DIR=/tmp/deno",
+		"-v", dir + ":/code:ro",
+		"-w", "/code",
+	}
+	if d.config.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(d.config.CPUs, 'f', -1, 64))
+	}
+	if d.config.Runtime != "" {
+		args = append(args, "--runtime", d.config.Runtime)
+	}
+	args = append(args, lang.Image)
+	args = append(args, lang.Command...)
+
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	// Stopping the client leaves the container running
+	cmd.Cancel = func() error {
+		exec.Command("docker", "kill", name).Run()
+		return cmd.Process.Kill()
+	}
+	return cmd
+}
+
+// Runs each program under firejail with a private home holding the code
+type firejail struct {
+	config Config
+}
+
+func (f *firejail) command(ctx context.Context, lang Language, dir, name string) *exec.Cmd {
+	args := []string{
+		"--quiet", "--noprofile",
+		"--net=none",
+		"--private=" + dir,
+		"--caps.drop=all", "--nonewprivs", "--seccomp",
+		fmt.Sprintf("--rlimit-as=%d", f.config.MemoryBytes),
+		fmt.Sprintf("--rlimit-nproc=%d", f.config.Pids),
+		"--",
+	}
+	args = append(args, lang.Command...)
+
+	return exec.CommandContext(ctx, "firejail", args...)
+}
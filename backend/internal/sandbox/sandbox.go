@@ -0,0 +1,279 @@
+// Package sandbox runs untrusted code from rooms in an isolated process with
+// no network, limited memory, CPU and processes, and a time limit. Docker
+// (with any OCI runtime it supports, such as runc or gVisor's runsc) and
+// firejail are supported backends.
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Backend   string   // "docker" or "firejail"
+	Runtime   string   // Docker OCI runtime, e.g. runc or runsc; empty uses Docker's default
+	Languages []string // Allowlist; each must be a key of the backend's languages
+
+	Timeout        time.Duration // Wall-clock limit per run, including compilation
+	MemoryBytes    int64
+	CPUs           float64 // Docker only
+	Pids           int     // Processes and threads
+	MaxOutputBytes int     // stdout and stderr together; the run is stopped past it
+	MaxConcurrent  int     // Runs at once across the server
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Backend:        "docker",
+		Languages:      []string{"python", "javascript"},
+		Timeout:        10 * time.Second,
+		MemoryBytes:    256 << 20,
+		CPUs:           0.5,
+		Pids:           64,
+		MaxOutputBytes: 256 << 10,
+		MaxConcurrent:  4,
+	}
+}
+
+// Validate rejects configurations the runner can't run with
+func (c Config) Validate() error {
+	languages, ok := backendLanguages[c.Backend]
+	if !ok {
+		return fmt.Errorf("backend must be docker or firejail, got %q", c.Backend)
+	}
+	if c.Runtime != "" && c.Backend != "docker" {
+		return fmt.Errorf("runtime is only used with the docker backend")
+	}
+	if len(c.Languages) == 0 {
+		return fmt.Errorf("no languages allowed")
+	}
+	for _, name := range c.Languages {
+		if _, ok := languages[name]; !ok {
+			return fmt.Errorf("%s cannot run language %q", c.Backend, name)
+		}
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive, got %v", c.Timeout)
+	}
+	if c.MemoryBytes < 16<<20 {
+		return fmt.Errorf("memory must be at least 16 MiB, got %d bytes", c.MemoryBytes)
+	}
+	if c.CPUs < 0 {
+		return fmt.Errorf("CPUs must not be negative, got %v", c.CPUs)
+	}
+	if c.Pids < 1 {
+		return fmt.Errorf("pids must be positive, got %d", c.Pids)
+	}
+	if c.MaxOutputBytes < 1 {
+		return fmt.Errorf("max output must be positive, got %d", c.MaxOutputBytes)
+	}
+	if c.MaxConcurrent < 1 {
+		return fmt.Errorf("max concurrent runs must be positive, got %d", c.MaxConcurrent)
+	}
+	return nil
+}
+
+// Language describes how a backend runs one language
+type Language struct {
+	File    string   // Name the code is saved under in the working directory
+	Image   string   // Docker image
+	Command []string // Run in the working directory
+}
+
+// How long a stopped run may hold its output open, e.g. through a child
+// process that outlived it
+const waitDelay = time.Second
+
+// Output streams
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+// Result describes a finished run
+type Result struct {
+	ExitCode  int           `json:"exit_code"` // -1 if the process was killed
+	Duration  time.Duration `json:"-"`
+	TimedOut  bool          `json:"timed_out"`
+	Truncated bool          `json:"truncated"` // Stopped for exceeding the output limit
+}
+
+var (
+	ErrBusy                = errors.New("too many runs in progress")
+	ErrUnsupportedLanguage = errors.New("language not allowed")
+)
+
+// Builds the command for a run of code saved in dir; name identifies the
+// run so it can be stopped
+type backend interface {
+	command(ctx context.Context, lang Language, dir, name string) *exec.Cmd
+}
+
+// Runner executes code with a backend, limiting how many runs happen at once
+type Runner struct {
+	config    Config
+	backend   backend
+	languages map[string]Language
+	slots     chan struct{}
+}
+
+func New(config Config) (*Runner, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	var b backend
+	switch config.Backend {
+	case "docker":
+		b = &docker{config: config}
+	case "firejail":
+		b = &firejail{config: config}
+	}
+	return newRunner(config, b, backendLanguages[config.Backend]), nil
+}
+
+func newRunner(config Config, b backend, languages map[string]Language) *Runner {
+	allowed := make(map[string]Language)
+	for _, name := range config.Languages {
+		allowed[name] = languages[name]
+	}
+	return &Runner{
+		config:    config,
+		backend:   b,
+		languages: allowed,
+		slots:     make(chan struct{}, config.MaxConcurrent),
+	}
+}
+
+// Languages returns the allowed languages in name order
+func (r *Runner) Languages() []string {
+	names := make([]string, 0, len(r.languages))
+	for name := range r.languages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Allows reports whether language may be run
+func (r *Runner) Allows(language string) bool {
+	_, ok := r.languages[language]
+	return ok
+}
+
+// Run executes code, calling out with each piece of output as it arrives.
+// out is never called concurrently. It fails with ErrBusy when
+// MaxConcurrent runs are in progress; a program that fails, times out or
+// prints too much is a Result, not an error.
+func (r *Runner) Run(ctx context.Context, language, code, stdin string, out func(stream string, data []byte)) (Result, error) {
+	lang, ok := r.languages[language]
+	if !ok {
+		return Result{}, ErrUnsupportedLanguage
+	}
+
+	select {
+	case r.slots <- struct{}{}:
+		defer func() { <-r.slots }()
+	default:
+		return Result{}, ErrBusy
+	}
+
+	dir, err := os.MkdirTemp("", "lattice-run-*")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.RemoveAll(dir)
+	// Sandboxed users are unprivileged and must read the code
+	if err := os.Chmod(dir, 0755); err != nil {
+		return Result{}, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, lang.File), []byte(code), 0644); err != nil {
+		return Result{}, err
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	cmd := r.backend.command(runCtx, lang, dir, filepath.Base(dir))
+	cmd.Dir = dir
+	cmd.WaitDelay = waitDelay
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	sink := &outputSink{out: out, limit: r.config.MaxOutputBytes, stop: cancel}
+	cmd.Stdout = sink.writer(Stdout)
+	cmd.Stderr = sink.writer(Stderr)
+
+	start := time.Now()
+	err = cmd.Run()
+	result := Result{
+		ExitCode:  -1,
+		Duration:  time.Since(start),
+		Truncated: sink.truncated(),
+	}
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	result.TimedOut = errors.Is(runCtx.Err(), context.DeadlineExceeded)
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) && runCtx.Err() == nil {
+		// The backend itself could not start
+		return result, err
+	}
+	return result, nil
+}
+
+// Collects output from both streams, passing it on until the limit
+type outputSink struct {
+	mu      sync.Mutex
+	out     func(stream string, data []byte)
+	limit   int
+	written int
+	cut     bool
+	stop    func()
+}
+
+func (s *outputSink) writer(stream string) *streamWriter {
+	return &streamWriter{sink: s, stream: stream}
+}
+
+func (s *outputSink) truncated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cut
+}
+
+type streamWriter struct {
+	sink   *outputSink
+	stream string
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	s := w.sink
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cut {
+		return len(p), nil
+	}
+
+	data := p
+	if s.written+len(data) > s.limit {
+		data = data[:s.limit-s.written]
+		s.cut = true
+		s.stop()
+	}
+	s.written += len(data)
+	if len(data) > 0 {
+		s.out(w.stream, data)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,117 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Runs shell scripts without isolation, for testing the runner
+type shell struct{}
+
+func (shell) command(ctx context.Context, lang Language, dir, name string) *exec.Cmd {
+	return exec.CommandContext(ctx, "sh", lang.File)
+}
+
+func testRunner(t *testing.T, modify func(*Config)) *Runner {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	config := DefaultConfig()
+	config.Languages = []string{"sh"}
+	config.Timeout = 2 * time.Second
+	if modify != nil {
+		modify(&config)
+	}
+	return newRunner(config, shell{}, map[string]Language{"sh": {File: "main.sh"}})
+}
+
+// Collects a run's output by stream
+type output struct {
+	mu      sync.Mutex
+	streams map[string]string
+}
+
+func (o *output) write(stream string, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.streams == nil {
+		o.streams = map[string]string{}
+	}
+	o.streams[stream] += string(data)
+}
+
+func TestRun(t *testing.T) {
+	r := testRunner(t, nil)
+
+	var out output
+	result, err := r.Run(context.Background(), "sh", "read name\necho hello $name\necho oops >&2\nexit 3", "lattice\n", out.write)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.ExitCode != 3 || result.TimedOut || result.Truncated {
+		t.Errorf("Expected exit code 3, got %+v", result)
+	}
+	if out.streams[Stdout] != "hello lattice\n" || out.streams[Stderr] != "oops\n" {
+		t.Errorf("Expected both streams, got %q", out.streams)
+	}
+
+	if _, err := r.Run(context.Background(), "python", "print(1)", "", out.write); !errors.Is(err, ErrUnsupportedLanguage) {
+		t.Errorf("Expected ErrUnsupportedLanguage, got %v", err)
+	}
+}
+
+func TestRunLimits(t *testing.T) {
+	r := testRunner(t, func(c *Config) {
+		c.Timeout = 200 * time.Millisecond
+		c.MaxOutputBytes = 10
+	})
+
+	result, _ := r.Run(context.Background(), "sh", "sleep 5", "", func(string, []byte) {})
+	if !result.TimedOut || result.Duration > 2*time.Second {
+		t.Errorf("Expected the run to time out promptly, got %+v", result)
+	}
+
+	var out output
+	result, _ = r.Run(context.Background(), "sh", "while true; do echo spam; done", "", out.write)
+	if !result.Truncated || out.streams[Stdout] != strings.Repeat("spam\n", 2) {
+		t.Errorf("Expected output to stop at 10 bytes, got %+v and %q", result, out.streams[Stdout])
+	}
+}
+
+func TestRunBusy(t *testing.T) {
+	r := testRunner(t, func(c *Config) { c.MaxConcurrent = 1 })
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Run(context.Background(), "sh", "echo started\nsleep 1", "", func(string, []byte) {
+			close(started)
+		})
+	}()
+	<-started
+
+	if _, err := r.Run(context.Background(), "sh", "true", "", func(string, []byte) {}); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected ErrBusy while a run is in progress, got %v", err)
+	}
+	<-done
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := DefaultConfig()
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected the default config to be valid, got %v", err)
+	}
+
+	config.Backend = "firejail"
+	config.Languages = []string{"java"}
+	if err := config.Validate(); err == nil {
+		t.Error("Expected firejail to reject java")
+	}
+}
@@ -0,0 +1,145 @@
+// Package shard assigns rooms to server instances by consistent hashing, so
+// every instance of a multi-instance deployment agrees on which one serves a
+// room without asking the others. Adding or removing an instance moves only
+// the rooms of the ring positions it gains or loses, about 1/n of them.
+package shard
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Positions each node takes on the ring; more spread rooms more evenly
+const DefaultReplicas = 128
+
+// Node is one server instance: a stable ID and the base URL clients reach it
+// at, e.g. "https://lattice-2.example.com"
+type Node struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// Ring maps room IDs to the nodes that own them
+type Ring struct {
+	self   Node
+	nodes  []Node
+	points []point // Sorted by hash
+}
+
+type point struct {
+	hash uint64
+	node int
+}
+
+// ParseNodes reads a comma-separated list of id=url pairs such as
+// "a=https://a.example.com,b=https://b.example.com"
+func ParseNodes(spec string) ([]Node, error) {
+	var nodes []Node
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, rawURL, ok := strings.Cut(entry, "=")
+		id, rawURL = strings.TrimSpace(id), strings.TrimSpace(rawURL)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid node %q: want id=url", entry)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL for node %s: want http(s)://host[:port]", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("node %s listed twice", id)
+		}
+		seen[id] = true
+		nodes = append(nodes, Node{ID: id, URL: strings.TrimSuffix(rawURL, "/")})
+	}
+	return nodes, nil
+}
+
+// NewRing builds a ring of nodes as seen by the node with ID self, which
+// must be one of them. Every instance must be given the same nodes to
+// agree on owners; their order doesn't matter.
+func NewRing(nodes []Node, self string, replicas int) (*Ring, error) {
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes")
+	}
+	if replicas <= 0 {
+		return nil, fmt.Errorf("replicas must be positive, got %d", replicas)
+	}
+
+	r := &Ring{nodes: append([]Node(nil), nodes...)}
+	sort.Slice(r.nodes, func(i, j int) bool { return r.nodes[i].ID < r.nodes[j].ID })
+
+	found := false
+	for i, node := range r.nodes {
+		if node.ID == self {
+			r.self = node
+			found = true
+		}
+		for v := 0; v < replicas; v++ {
+			r.points = append(r.points, point{hash: hash(fmt.Sprintf("%s#%d", node.ID, v)), node: i})
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("this node %q is not among the nodes", self)
+	}
+
+	// Ties, vanishingly rare, go to the lower node ID on every instance
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+	return r, nil
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV spreads short, similar keys such as "a#1" and "a#2" poorly, so
+	// its sum goes through the splitmix64 finalizer to even out the ring
+	z := h.Sum64()
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Owner returns the node that serves a room: the first ring position at or
+// after the room's hash
+func (r *Ring) Owner(roomID string) Node {
+	h := hash(roomID)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i].node]
+}
+
+// Owns reports whether this node serves a room
+func (r *Ring) Owns(roomID string) bool {
+	return r.Owner(roomID).ID == r.self.ID
+}
+
+// RouteRoom returns the base URL of the node that serves a room, and
+// whether it is this one
+func (r *Ring) RouteRoom(roomID string) (string, bool) {
+	owner := r.Owner(roomID)
+	return owner.URL, owner.ID == r.self.ID
+}
+
+// Self returns this node
+func (r *Ring) Self() Node {
+	return r.self
+}
+
+// Nodes returns every node in ID order
+func (r *Ring) Nodes() []Node {
+	return append([]Node(nil), r.nodes...)
+}
@@ -0,0 +1,76 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseNodes(t *testing.T) {
+	nodes, err := ParseNodes(" a=https://a.example.com/ , b=http://10.0.0.2:8080")
+	if err != nil {
+		t.Fatalf("ParseNodes failed: %v", err)
+	}
+	if len(nodes) != 2 || nodes[0] != (Node{ID: "a", URL: "https://a.example.com"}) || nodes[1].URL != "http://10.0.0.2:8080" {
+		t.Errorf("Unexpected nodes %+v", nodes)
+	}
+
+	for _, spec := range []string{"a", "=https://a", "a=ftp://a", "a=https://", "a=https://a,a=https://b"} {
+		if _, err := ParseNodes(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestRing(t *testing.T) {
+	nodes := []Node{{ID: "a", URL: "https://a"}, {ID: "b", URL: "https://b"}, {ID: "c", URL: "https://c"}}
+	if _, err := NewRing(nodes, "d", DefaultReplicas); err == nil {
+		t.Error("Expected a ring without this node to be rejected")
+	}
+
+	ring, err := NewRing(nodes, "a", DefaultReplicas)
+	if err != nil {
+		t.Fatalf("NewRing failed: %v", err)
+	}
+	// Every instance agrees whatever order it lists the nodes in
+	other, _ := NewRing([]Node{nodes[2], nodes[0], nodes[1]}, "c", DefaultReplicas)
+
+	counts := make(map[string]int)
+	owned := 0
+	const rooms = 30000
+	for i := 0; i < rooms; i++ {
+		roomID := fmt.Sprintf("room-%d", i)
+		owner := ring.Owner(roomID)
+		counts[owner.ID]++
+		if other.Owner(roomID) != owner {
+			t.Fatalf("Instances disagree on the owner of %s", roomID)
+		}
+		if ring.Owns(roomID) {
+			owned++
+		}
+	}
+	for _, node := range nodes {
+		if share := float64(counts[node.ID]) / rooms; share < 0.25 || share > 0.42 {
+			t.Errorf("Node %s owns %.0f%% of rooms", node.ID, share*100)
+		}
+	}
+	if owned != counts["a"] {
+		t.Errorf("Owns disagrees with Owner: %d vs %d", owned, counts["a"])
+	}
+
+	// Adding a node only moves rooms to it
+	grown, _ := NewRing(append(nodes, Node{ID: "d", URL: "https://d"}), "a", DefaultReplicas)
+	moved := 0
+	for i := 0; i < rooms; i++ {
+		roomID := fmt.Sprintf("room-%d", i)
+		before, after := ring.Owner(roomID), grown.Owner(roomID)
+		if before != after {
+			moved++
+			if after.ID != "d" {
+				t.Fatalf("Room %s moved from %s to %s", roomID, before.ID, after.ID)
+			}
+		}
+	}
+	if share := float64(moved) / rooms; share < 0.15 || share > 0.35 {
+		t.Errorf("Expected about a quarter of rooms to move, got %.0f%%", share*100)
+	}
+}
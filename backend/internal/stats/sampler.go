@@ -0,0 +1,207 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+)
+
+// RoomHistoryRetention is how long per-room client counts are kept. They
+// grow with the number of rooms, so they are kept for less time than the
+// server-wide samples.
+const RoomHistoryRetention = 24 * time.Hour
+
+type Config struct {
+	Interval  time.Duration
+	Retention time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval:  time.Minute,
+		Retention: 30 * 24 * time.Hour,
+	}
+}
+
+// Validate rejects configurations the ticker can't run with
+func (c Config) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %v", c.Interval)
+	}
+	if c.Retention < c.Interval {
+		return fmt.Errorf("retention (%v) must be at least the interval (%v)", c.Retention, c.Interval)
+	}
+	return nil
+}
+
+// Source provides live counters from the WebSocket hub
+type Source interface {
+	GetRoomCount() int
+	GetClientCount() int
+	MessageCount() uint64
+	GetActiveRooms() map[string]int
+}
+
+// Sampler periodically records usage statistics for the history endpoint
+type Sampler struct {
+	database *db.Database
+	source   Source
+	config   Config
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	// Only touched by the run goroutine
+	lastSample   time.Time
+	lastMessages uint64
+}
+
+func New(database *db.Database, source Source, config Config) *Sampler {
+	return &Sampler{
+		database: database,
+		source:   source,
+		config:   config,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (s *Sampler) Start() {
+	s.wg.Add(1)
+	go s.run()
+	log.Printf("📈 Stats sampler started (interval: %v, retention: %v)", s.config.Interval, s.config.Retention)
+}
+
+func (s *Sampler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+	log.Println("📈 Stats sampler stopped")
+}
+
+// Config returns the configuration the sampler was created with
+func (s *Sampler) Config() Config {
+	return s.config
+}
+
+func (s *Sampler) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	s.lastSample = time.Now()
+	s.lastMessages = s.source.MessageCount()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if err := s.sample(now); err != nil {
+				log.Printf("Error recording stats sample: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Sampler) sample(now time.Time) error {
+	ctx := context.Background()
+
+	dbStats, err := s.database.GetStats(ctx)
+	if err != nil {
+		return err
+	}
+
+	storage, err := s.database.GetStorageBytes(ctx)
+	if err != nil {
+		return err
+	}
+
+	messages := s.source.MessageCount()
+	rate := 0.0
+	if elapsed := now.Sub(s.lastSample).Seconds(); elapsed > 0 {
+		rate = float64(messages-s.lastMessages) / elapsed
+	}
+	s.lastSample = now
+	s.lastMessages = messages
+
+	err = s.database.RecordStatsSample(ctx, db.StatsSample{
+		SampledAt:     now,
+		RoomCount:     dbStats["room_count"].(int),
+		ActiveRooms:   s.source.GetRoomCount(),
+		ActiveClients: s.source.GetClientCount(),
+		MessageRate:   rate,
+		StorageBytes:  storage,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.database.RecordRoomClients(ctx, now, s.source.GetActiveRooms()); err != nil {
+		return err
+	}
+
+	if _, err := s.database.PruneStatsSamples(ctx, now.Add(-s.config.Retention)); err != nil {
+		return err
+	}
+	if _, err := s.database.PruneRoomClientSamples(ctx, now.Add(-RoomHistoryRetention)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Downsample groups samples into buckets of step starting at start. Each
+// bucket reports the last value of the gauges and the mean message rate, and
+// is stamped with the bucket start. Empty buckets are omitted.
+func Downsample(samples []db.StatsSample, start time.Time, step time.Duration) []db.StatsSample {
+	points := []db.StatsSample{}
+	var rateSum float64
+	var rateCount int
+
+	for _, sample := range samples {
+		if sample.SampledAt.Before(start) {
+			continue
+		}
+
+		bucket := start.Add(sample.SampledAt.Sub(start) / step * step)
+		if len(points) == 0 || !points[len(points)-1].SampledAt.Equal(bucket) {
+			points = append(points, db.StatsSample{SampledAt: bucket})
+			rateSum, rateCount = 0, 0
+		}
+
+		point := &points[len(points)-1]
+		rateSum += sample.MessageRate
+		rateCount++
+
+		point.RoomCount = sample.RoomCount
+		point.ActiveRooms = sample.ActiveRooms
+		point.ActiveClients = sample.ActiveClients
+		point.StorageBytes = sample.StorageBytes
+		point.MessageRate = rateSum / float64(rateCount)
+	}
+
+	return points
+}
+
+// DownsampleRoomClients groups a room's samples into buckets of step
+// starting at start, reporting the most clients seen in each. Buckets with
+// no samples, when nobody was connected, are omitted.
+func DownsampleRoomClients(samples []db.RoomClientSample, start time.Time, step time.Duration) []db.RoomClientSample {
+	points := []db.RoomClientSample{}
+	for _, sample := range samples {
+		if sample.SampledAt.Before(start) {
+			continue
+		}
+
+		bucket := start.Add(sample.SampledAt.Sub(start) / step * step)
+		if len(points) == 0 || !points[len(points)-1].SampledAt.Equal(bucket) {
+			points = append(points, db.RoomClientSample{SampledAt: bucket})
+		}
+
+		point := &points[len(points)-1]
+		point.Clients = max(point.Clients, sample.Clients)
+	}
+	return points
+}
@@ -0,0 +1,88 @@
+package sync
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errMalformedAwareness = errors.New("malformed awareness message")
+
+// The JSON state of a client that has left
+const awarenessRemoved = "null"
+
+// AwarenessEntry is one Yjs client's presence in an awareness update
+type AwarenessEntry struct {
+	ClientID uint64
+	Clock    uint64
+	State    string // JSON; "null" once the client has left
+}
+
+// Removed reports whether the entry announces that its client has left
+func (e AwarenessEntry) Removed() bool {
+	return e.State == awarenessRemoved
+}
+
+// Removal returns the entry that announces its client has left. Peers only
+// accept it with a newer clock than the state they hold.
+func (e AwarenessEntry) Removal() AwarenessEntry {
+	return AwarenessEntry{ClientID: e.ClientID, Clock: e.Clock + 1, State: awarenessRemoved}
+}
+
+// Decodes an awareness message: the type byte followed by a length-prefixed
+// update holding a count and, per client, its ID, clock and JSON state
+func ParseAwarenessMessage(data []byte) ([]AwarenessEntry, error) {
+	if ParseMessageType(data) != MessageTypeAwareness || len(data) < 2 {
+		return nil, errMalformedAwareness
+	}
+
+	length, n := ReadVarUint(data[1:])
+	if n == 0 || uint64(len(data)-1-n) != length {
+		return nil, errMalformedAwareness
+	}
+	update := data[1+n:]
+
+	count, n := ReadVarUint(update)
+	if n == 0 || count > uint64(len(update)) {
+		return nil, errMalformedAwareness
+	}
+	update = update[n:]
+
+	entries := make([]AwarenessEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var entry AwarenessEntry
+		if entry.ClientID, n = ReadVarUint(update); n == 0 {
+			return nil, errMalformedAwareness
+		}
+		update = update[n:]
+		if entry.Clock, n = ReadVarUint(update); n == 0 {
+			return nil, errMalformedAwareness
+		}
+		update = update[n:]
+
+		size, n := ReadVarUint(update)
+		if n == 0 || uint64(len(update)-n) < size {
+			return nil, errMalformedAwareness
+		}
+		entry.State = string(update[n : n+int(size)])
+		update = update[n+int(size):]
+
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Frames awareness entries as an awareness message
+func EncodeAwarenessMessage(entries []AwarenessEntry) []byte {
+	update := binary.AppendUvarint(nil, uint64(len(entries)))
+	for _, entry := range entries {
+		update = binary.AppendUvarint(update, entry.ClientID)
+		update = binary.AppendUvarint(update, entry.Clock)
+		update = binary.AppendUvarint(update, uint64(len(entry.State)))
+		update = append(update, entry.State...)
+	}
+
+	message := make([]byte, 0, len(update)+1+binary.MaxVarintLen64)
+	message = append(message, byte(MessageTypeAwareness))
+	message = binary.AppendUvarint(message, uint64(len(update)))
+	return append(message, update...)
+}
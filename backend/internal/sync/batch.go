@@ -0,0 +1,51 @@
+package sync
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errMalformedBatch = errors.New("malformed batch message")
+
+// Appends a frame to a batch message, starting a new batch when batch is
+// empty
+func AppendToBatch(batch, frame []byte) []byte {
+	if len(batch) == 0 {
+		batch = []byte{byte(MessageTypeBatch)}
+	}
+	batch = binary.AppendUvarint(batch, uint64(len(frame)))
+	return append(batch, frame...)
+}
+
+// Returns the frames carried by a batch message, in order
+func SplitBatch(data []byte) ([][]byte, error) {
+	if ParseMessageType(data) != MessageTypeBatch || len(data) == 0 {
+		return nil, errMalformedBatch
+	}
+
+	var frames [][]byte
+	for rest := data[1:]; len(rest) > 0; {
+		length, n := ReadVarUint(rest)
+		if n == 0 || uint64(len(rest)-n) < length {
+			return nil, errMalformedBatch
+		}
+		frames = append(frames, rest[n:n+int(length)])
+		rest = rest[n+int(length):]
+	}
+	return frames, nil
+}
+
+// Reports whether a frame carries a live document update, either raw or in a
+// sequenced envelope
+func IsUpdateFrame(data []byte) bool {
+	if len(data) < 2 {
+		return false
+	}
+	switch MessageType(data[0]) {
+	case MessageTypeSync:
+		return SyncStep(data[1]) == SyncUpdate
+	case MessageTypeSequenced:
+		return true
+	}
+	return false
+}
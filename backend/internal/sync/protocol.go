@@ -1,5 +1,10 @@
 package sync
 
+import (
+	"bytes"
+	"encoding/binary"
+)
+
 // Represents the type of sync message
 type MessageType byte
 
@@ -12,6 +17,44 @@ const (
 
 	// Used for authentication messages
 	MessageTypeAuth MessageType = 2
+
+	// Sent by the server with a token for resuming the session after a
+	// reconnect (?resume=token on the WebSocket URL)
+	MessageTypeResume MessageType = 5
+
+	// Wraps a document update for clients that connect with ?seq=1:
+	// the type byte, the room sequence number as a var uint, then the frame
+	MessageTypeSequenced MessageType = 6
+
+	// Sent by sequenced clients to request missed updates: the type byte
+	// followed by the first and last sequence numbers as var uints
+	MessageTypeRefill MessageType = 7
+
+	// Sent by the server to report a rejected message: the type byte
+	// followed by a JSON error object as a var string
+	MessageTypeError MessageType = 8
+
+	// Sent by the server with a JSON control frame (hello, notices,
+	// shutdown) as a var string; the frame's "type" field says which
+	MessageTypeControl MessageType = 9
+
+	// Sent by the server to clients that connect with ?batch=1 and fall
+	// behind: the type byte followed by several frames, each prefixed with
+	// its length as a var uint, to be handled in order
+	MessageTypeBatch MessageType = 10
+
+	// Terminal output on /ws/terminal: the type byte followed by the raw
+	// bytes the host's shell wrote
+	MessageTypeTerminal MessageType = 11
+
+	// Terminal size on /ws/terminal: the type byte followed by the columns
+	// and rows as var uints
+	MessageTypeTerminalResize MessageType = 12
+
+	// WebRTC signaling between members of a room: the type byte followed
+	// by a JSON signal (offer, answer, ICE candidate, join or leave) as a
+	// var string. The server relays it and never handles media.
+	MessageTypeSignal MessageType = 13
 )
 
 // SyncStep represents the step in the Yjs sync protocol
@@ -36,10 +79,84 @@ func ParseMessageType(data []byte) MessageType {
 	return MessageType(data[0])
 }
 
-// Rxtracts the sync step from the second byte
+// Extracts the sync step from the second byte
 func ParseSyncStep(data []byte) SyncStep {
 	if len(data) < 2 {
 		return SyncStep1
 	}
 	return SyncStep(data[1])
 }
+
+// Decodes a lib0 variable-length unsigned integer, returning the value and
+// the number of bytes read (0 if data ends early)
+func ReadVarUint(data []byte) (uint64, int) {
+	var value uint64
+	for i, b := range data {
+		if i >= 10 {
+			return 0, 0
+		}
+		value |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// An encoded Yjs update containing no structs and an empty delete set
+var emptyUpdate = []byte{0, 0}
+
+// Returns the Yjs update carried by a SyncStep2 or SyncUpdate message
+func UpdatePayload(data []byte) ([]byte, bool) {
+	if ParseMessageType(data) != MessageTypeSync || len(data) < 2 {
+		return nil, false
+	}
+
+	step := ParseSyncStep(data)
+	if step != SyncStep2 && step != SyncUpdate {
+		return nil, false
+	}
+
+	length, n := ReadVarUint(data[2:])
+	if n == 0 || uint64(len(data)-2-n) < length {
+		return nil, false
+	}
+
+	start := 2 + n
+	return data[start : start+int(length)], true
+}
+
+// Frames a raw Yjs update as a sync update message
+func EncodeUpdate(update []byte) []byte {
+	message := make([]byte, 0, len(update)+2+binary.MaxVarintLen64)
+	message = append(message, byte(MessageTypeSync), byte(SyncUpdate))
+	message = binary.AppendUvarint(message, uint64(len(update)))
+	return append(message, update...)
+}
+
+// Reports whether a message changes the document and should be stored.
+// SyncStep1 state vectors and empty SyncStep2 replies are handshake traffic.
+func IsDocumentUpdate(data []byte) bool {
+	payload, ok := UpdatePayload(data)
+	if !ok {
+		return false
+	}
+	return len(payload) > 0 && !bytes.Equal(payload, emptyUpdate)
+}
+
+// Reports whether a sync message is complete: a known sync step followed by a
+// length-prefixed payload that exactly fills the rest of the frame
+func IsWellFormed(data []byte) bool {
+	if ParseMessageType(data) != MessageTypeSync || len(data) < 3 {
+		return false
+	}
+
+	switch ParseSyncStep(data) {
+	case SyncStep1, SyncStep2, SyncUpdate:
+	default:
+		return false
+	}
+
+	length, n := ReadVarUint(data[2:])
+	return n > 0 && uint64(len(data)-2-n) == length
+}
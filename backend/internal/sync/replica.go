@@ -0,0 +1,507 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf16"
+)
+
+// TextReplica integrates Yjs v1 updates far enough to read the root text
+// type "content", the text the editor binds to, so the server can
+// materialize a document without a JavaScript runtime. Items in other types
+// are decoded and placed too, since later items may be anchored to them,
+// but only the root text is ever read.
+//
+// Items are split into one unit per clock, which places them exactly as
+// Yjs does without tracking its item splits. Updates may repeat or overlap,
+// as a snapshot and the updates kept after it do; anything already
+// integrated is skipped. Items whose origins have not arrived yet wait
+// until they do, as Yjs keeps them pending.
+type TextReplica struct {
+	units   map[yID]*unit
+	next    map[uint64]uint64 // Next clock expected from each client
+	starts  map[parentRef]*unit
+	pending []*item
+	deletes map[uint64][]clockRange
+}
+
+type yID struct {
+	client, clock uint64
+}
+
+// What an item belongs to: a root type by name, or a type nested in
+// another item, optionally under a map key
+type parentRef struct {
+	root   string
+	item   yID
+	nested bool
+	sub    string
+}
+
+// One clock of an item: a UTF-16 code unit of a string, or a placeholder
+// for content that isn't text
+type unit struct {
+	id          yID
+	origin      *yID
+	rightOrigin *yID
+	parent      parentRef
+	left, right *unit
+	char        uint16
+	isChar      bool
+	gc          bool // Garbage collected, or anchored to something that was
+}
+
+// A decoded struct waiting to be integrated
+type item struct {
+	id          yID
+	length      uint64
+	origin      *yID
+	rightOrigin *yID
+	parent      *parentRef // Only when the item has no origins
+	chars       []uint16   // String content, one per clock
+	gc          bool
+}
+
+type clockRange struct {
+	clock, length uint64
+}
+
+// The root text's parent reference
+var rootText = parentRef{root: textName}
+
+// Content types in an item's info byte
+const (
+	contentGC      = 0
+	contentDeleted = 1
+	contentJSON    = 2
+	contentBinary  = 3
+	contentString  = 4
+	contentEmbed   = 5
+	contentFormat  = 6
+	contentType    = 7
+	contentAny     = 8
+	contentDoc     = 9
+	contentSkip    = 10
+)
+
+// Type refs that carry a node name
+const (
+	typeXMLElement = 3
+	typeXMLHook    = 5
+)
+
+var errTruncated = errors.New("update ends early")
+
+func NewTextReplica() *TextReplica {
+	return &TextReplica{
+		units:   make(map[yID]*unit),
+		next:    make(map[uint64]uint64),
+		starts:  make(map[parentRef]*unit),
+		deletes: make(map[uint64][]clockRange),
+	}
+}
+
+// Apply decodes a Yjs v1 update and integrates what it can. An update that
+// fails to decode changes nothing.
+func (r *TextReplica) Apply(update []byte) error {
+	items, deletes, err := decodeUpdate(update)
+	if err != nil {
+		return err
+	}
+	for client, ranges := range deletes {
+		r.deletes[client] = append(r.deletes[client], ranges...)
+	}
+	r.pending = append(r.pending, items...)
+	r.integratePending()
+	return nil
+}
+
+// Pending returns how many decoded items still wait for their origins
+func (r *TextReplica) Pending() int {
+	return len(r.pending)
+}
+
+// String returns the root text as it reads with every update so far
+func (r *TextReplica) String() string {
+	deleted := make(map[uint64][]clockRange, len(r.deletes))
+	for client, ranges := range r.deletes {
+		deleted[client] = mergeRanges(ranges)
+	}
+
+	var chars []uint16
+	for u := r.starts[rootText]; u != nil; u = u.right {
+		if u.isChar && !isDeleted(deleted[u.id.client], u.id.clock) {
+			chars = append(chars, u.char)
+		}
+	}
+	return string(utf16.Decode(chars))
+}
+
+// Integrates pending items until none can make progress. Each pass keeps
+// the items still missing a dependency for the next update.
+func (r *TextReplica) integratePending() {
+	for progress := true; progress; {
+		progress = false
+		waiting := r.pending[:0]
+		for _, it := range r.pending {
+			if r.integrate(it) {
+				progress = true
+			} else {
+				waiting = append(waiting, it)
+			}
+		}
+		r.pending = waiting
+	}
+}
+
+// Integrates the clocks of an item not seen before, returning false if it
+// must wait for an earlier clock of its client or for an origin
+func (r *TextReplica) integrate(it *item) bool {
+	next := r.next[it.id.client]
+	if it.id.clock > next {
+		return false
+	}
+	end := it.id.clock + it.length
+	if end <= next {
+		return true // Already integrated
+	}
+	offset := next - it.id.clock
+
+	// The first new clock follows the last known one of the same item
+	origin := it.origin
+	if offset > 0 {
+		origin = &yID{it.id.client, next - 1}
+	}
+	for _, dep := range []*yID{origin, it.rightOrigin} {
+		if dep != nil && r.units[*dep] == nil {
+			return false
+		}
+	}
+	if it.parent != nil && it.parent.nested && r.units[it.parent.item] == nil {
+		return false
+	}
+
+	parent, gc := r.resolveParent(it, origin)
+	for i := offset; i < it.length; i++ {
+		u := &unit{
+			id:          yID{it.id.client, it.id.clock + i},
+			origin:      origin,
+			rightOrigin: it.rightOrigin,
+			parent:      parent,
+			gc:          gc,
+		}
+		if it.chars != nil {
+			u.char, u.isChar = it.chars[i], true
+		}
+		r.units[u.id] = u
+		if !gc {
+			r.place(u)
+		}
+		origin = &u.id
+	}
+	r.next[it.id.client] = end
+	return true
+}
+
+// Finds the item's parent: given explicitly, or inherited from the origin
+// it sits beside. Items anchored to collected content are collected too.
+func (r *TextReplica) resolveParent(it *item, origin *yID) (parentRef, bool) {
+	if it.gc {
+		return parentRef{}, true
+	}
+	if it.parent != nil {
+		if it.parent.nested && r.units[it.parent.item].gc {
+			return parentRef{}, true
+		}
+		return *it.parent, false
+	}
+	for _, dep := range []*yID{origin, it.rightOrigin} {
+		if dep != nil {
+			u := r.units[*dep]
+			return u.parent, u.gc
+		}
+	}
+	return parentRef{}, true
+}
+
+// Links a unit into its parent's sequence, resolving concurrent inserts
+// between the same origins as Yjs's Item.integrate does
+func (r *TextReplica) place(u *unit) {
+	var left, right *unit
+	if u.origin != nil {
+		left = r.units[*u.origin]
+	}
+	if u.rightOrigin != nil {
+		right = r.units[*u.rightOrigin]
+	}
+	if left != nil && left.gc || right != nil && right.gc {
+		u.gc = true
+		return
+	}
+
+	if (left == nil && (right == nil || right.left != nil)) || (left != nil && left.right != right) {
+		o := r.starts[u.parent]
+		if left != nil {
+			o = left.right
+		}
+		conflicting := make(map[*unit]bool)
+		beforeOrigin := make(map[*unit]bool)
+		for o != nil && o != right {
+			beforeOrigin[o] = true
+			conflicting[o] = true
+			if sameID(u.origin, o.origin) {
+				// Concurrent inserts at the same place order by client
+				if o.id.client < u.id.client {
+					left = o
+					clear(conflicting)
+				} else if sameID(u.rightOrigin, o.rightOrigin) {
+					break
+				}
+			} else if o.origin != nil && beforeOrigin[r.units[*o.origin]] {
+				if !conflicting[r.units[*o.origin]] {
+					left = o
+					clear(conflicting)
+				}
+			} else {
+				break
+			}
+			o = o.right
+		}
+	}
+
+	u.left = left
+	if left != nil {
+		u.right = left.right
+		left.right = u
+	} else {
+		u.right = r.starts[u.parent]
+		r.starts[u.parent] = u
+	}
+	if u.right != nil {
+		u.right.left = u
+	}
+}
+
+func sameID(a, b *yID) bool {
+	return a == b || (a != nil && b != nil && *a == *b)
+}
+
+// Sorts and joins overlapping ranges so lookups can binary search
+func mergeRanges(ranges []clockRange) []clockRange {
+	sorted := append([]clockRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].clock < sorted[j].clock })
+	merged := sorted[:0]
+	for _, rng := range sorted {
+		if n := len(merged); n > 0 && rng.clock <= merged[n-1].clock+merged[n-1].length {
+			if end := rng.clock + rng.length; end > merged[n-1].clock+merged[n-1].length {
+				merged[n-1].length = end - merged[n-1].clock
+			}
+			continue
+		}
+		merged = append(merged, rng)
+	}
+	return merged
+}
+
+func isDeleted(ranges []clockRange, clock uint64) bool {
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].clock+ranges[i].length > clock })
+	return i < len(ranges) && ranges[i].clock <= clock
+}
+
+// Decodes the structs and delete set of a v1 update
+func decodeUpdate(update []byte) ([]*item, map[uint64][]clockRange, error) {
+	d := &updateDecoder{data: update}
+	var items []*item
+
+	clients := d.uint()
+	for i := uint64(0); i < clients && d.err == nil; i++ {
+		structs := d.uint()
+		client := d.uint()
+		clock := d.uint()
+		for j := uint64(0); j < structs && d.err == nil; j++ {
+			it, length := d.item(client, clock)
+			clock += length
+			if it != nil && length > 0 {
+				items = append(items, it)
+			}
+		}
+	}
+
+	deletes := make(map[uint64][]clockRange)
+	clients = d.uint()
+	for i := uint64(0); i < clients && d.err == nil; i++ {
+		client := d.uint()
+		ranges := d.uint()
+		for j := uint64(0); j < ranges && d.err == nil; j++ {
+			clock, length := d.uint(), d.uint()
+			deletes[client] = append(deletes[client], clockRange{clock, length})
+		}
+	}
+
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	return items, deletes, nil
+}
+
+// Reads lib0-encoded values, remembering the first error
+type updateDecoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (d *updateDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *updateDecoder) byte() byte {
+	if d.err != nil || d.pos >= len(d.data) {
+		d.fail(errTruncated)
+		return 0
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *updateDecoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := ReadVarUint(d.data[d.pos:])
+	if n == 0 {
+		d.fail(errTruncated)
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *updateDecoder) bytes() []byte {
+	n := d.uint()
+	if d.err != nil || n > uint64(len(d.data)-d.pos) {
+		d.fail(errTruncated)
+		return nil
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b
+}
+
+func (d *updateDecoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *updateDecoder) id() *yID {
+	client := d.uint()
+	return &yID{client, d.uint()}
+}
+
+// Skips a value written by lib0's writeAny
+func (d *updateDecoder) skipAny() {
+	switch tag := d.byte(); tag {
+	case 127, 126, 121, 120: // undefined, null, false, true
+	case 125: // Signed varint: continuation in the top bit, like a uint
+		for d.err == nil && d.byte()&0x80 != 0 {
+		}
+	case 124:
+		d.skip(4)
+	case 123, 122:
+		d.skip(8)
+	case 119, 116: // String, Uint8Array
+		d.bytes()
+	case 118: // Object
+		for n := d.uint(); n > 0 && d.err == nil; n-- {
+			d.string()
+			d.skipAny()
+		}
+	case 117: // Array
+		for n := d.uint(); n > 0 && d.err == nil; n-- {
+			d.skipAny()
+		}
+	default:
+		d.fail(fmt.Errorf("unknown value type %d", tag))
+	}
+}
+
+func (d *updateDecoder) skip(n int) {
+	if d.err != nil || n > len(d.data)-d.pos {
+		d.fail(errTruncated)
+		return
+	}
+	d.pos += n
+}
+
+// Decodes one struct starting at clock and returns it with the clocks it
+// spans. Skips span clocks the update leaves out and return no item.
+func (d *updateDecoder) item(client, clock uint64) (*item, uint64) {
+	info := d.byte()
+	it := &item{id: yID{client, clock}}
+	switch info & 0x1f {
+	case contentGC:
+		it.length, it.gc = d.uint(), true
+		return it, it.length
+	case contentSkip:
+		return nil, d.uint()
+	}
+
+	if info&0x80 != 0 {
+		it.origin = d.id()
+	}
+	if info&0x40 != 0 {
+		it.rightOrigin = d.id()
+	}
+	if info&0xc0 == 0 {
+		parent := &parentRef{}
+		if d.uint() == 1 {
+			parent.root = d.string()
+		} else {
+			parent.item, parent.nested = *d.id(), true
+		}
+		if info&0x20 != 0 {
+			parent.sub = d.string()
+		}
+		it.parent = parent
+	}
+
+	switch info & 0x1f {
+	case contentDeleted:
+		it.length = d.uint()
+	case contentJSON:
+		it.length = d.uint()
+		for i := uint64(0); i < it.length && d.err == nil; i++ {
+			d.string()
+		}
+	case contentBinary, contentEmbed:
+		d.bytes()
+		it.length = 1
+	case contentString:
+		it.chars = utf16.Encode([]rune(d.string()))
+		it.length = uint64(len(it.chars))
+	case contentFormat:
+		d.string()
+		d.string()
+		it.length = 1
+	case contentType:
+		if ref := d.uint(); ref == typeXMLElement || ref == typeXMLHook {
+			d.string()
+		}
+		it.length = 1
+	case contentAny:
+		it.length = d.uint()
+		for i := uint64(0); i < it.length && d.err == nil; i++ {
+			d.skipAny()
+		}
+	case contentDoc:
+		d.string()
+		d.skipAny()
+		it.length = 1
+	default:
+		d.fail(fmt.Errorf("unknown content type %d", info&0x1f))
+	}
+	return it, it.length
+}
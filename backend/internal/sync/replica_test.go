@@ -0,0 +1,118 @@
+package sync
+
+import "testing"
+
+// Yjs v1 updates on the root text "content" from clients 1013 (A),
+// 2290 (B) and 3517 (C)
+var (
+	// A types "hello"
+	replicaHello = EncodeTextInsert(1013, 0, "hello")
+
+	// B appends " world" after A's "o" (A:4)
+	replicaWorld = []byte{
+		0x01, 0x01, 0xf2, 0x11, 0x00, // B, clock 0
+		0x84, 0xf5, 0x07, 0x04, // string item with origin A:4
+		0x06, ' ', 'w', 'o', 'r', 'l', 'd',
+		0x00,
+	}
+
+	// C appends "!" after A:4 without having seen B's edit
+	replicaBang = []byte{
+		0x01, 0x01, 0xbd, 0x1b, 0x00, // C, clock 0
+		0x84, 0xf5, 0x07, 0x04,
+		0x01, '!',
+		0x00,
+	}
+
+	// A inserts "," between A:4 and B:0
+	replicaComma = []byte{
+		0x01, 0x01, 0xf5, 0x07, 0x05, // A, clock 5
+		0xc4, 0xf5, 0x07, 0x04, 0xf2, 0x11, 0x00, // origins A:4 and B:0
+		0x01, ',',
+		0x00,
+	}
+
+	// B deletes C's "!"
+	replicaDeleteBang = []byte{
+		0x00,
+		0x01, 0xbd, 0x1b, 0x01, 0x00, 0x01, // C: clock 0, length 1
+	}
+)
+
+func replay(t *testing.T, updates ...[]byte) *TextReplica {
+	t.Helper()
+	r := NewTextReplica()
+	for _, update := range updates {
+		if err := r.Apply(update); err != nil {
+			t.Fatalf("Failed to apply update: %v", err)
+		}
+	}
+	return r
+}
+
+func TestTextReplica(t *testing.T) {
+	// Concurrent inserts converge whichever arrives first, and items that
+	// arrive before their origins wait for them
+	for _, order := range [][][]byte{
+		{replicaHello, replicaWorld, replicaBang, replicaComma, replicaDeleteBang},
+		{replicaHello, replicaBang, replicaWorld, replicaDeleteBang, replicaComma},
+		{replicaDeleteBang, replicaComma, replicaBang, replicaWorld, replicaHello},
+	} {
+		r := replay(t, order...)
+		if got := r.String(); got != "hello, world" {
+			t.Errorf("Expected %q, got %q", "hello, world", got)
+		}
+		if r.Pending() != 0 {
+			t.Errorf("Expected nothing pending, got %d items", r.Pending())
+		}
+	}
+
+	r := replay(t, replicaComma)
+	if r.String() != "" || r.Pending() != 1 {
+		t.Errorf("Expected the comma to wait for its origins, got %q with %d pending", r.String(), r.Pending())
+	}
+}
+
+func TestTextReplicaOverlap(t *testing.T) {
+	// A snapshot and the updates kept after it repeat items; an update
+	// starting inside a known item only adds its new clocks
+	lo := []byte{
+		0x01, 0x01, 0xf5, 0x07, 0x03, // A, clock 3
+		0x84, 0xf5, 0x07, 0x02, // origin A:2
+		0x03, 'l', 'o', ',',
+		0x00,
+	}
+	r := replay(t, replicaHello, replicaHello, lo, replicaWorld, replicaWorld)
+	if got := r.String(); got != "hello, world" {
+		t.Errorf("Expected %q, got %q", "hello, world", got)
+	}
+}
+
+func TestTextReplicaOtherContent(t *testing.T) {
+	// A map entry in another root type, holding the string "x"
+	title := []byte{
+		0x01, 0x01, 0x09, 0x00, // client 9, clock 0
+		0x28,                           // any content under a map key
+		0x01, 0x04, 'm', 'e', 't', 'a', // root type "meta"
+		0x05, 't', 'i', 't', 'l', 'e',
+		0x01, 0x77, 0x01, 'x',
+		0x00,
+	}
+	// Text outside the basic plane takes two UTF-16 clocks
+	emoji := EncodeTextInsert(7, 0, "😀")
+
+	r := replay(t, title, replicaHello, emoji)
+	if got := r.String(); got != "😀hello" {
+		t.Errorf("Expected %q, got %q", "😀hello", got)
+	}
+
+	for _, update := range [][]byte{
+		replicaWorld[:len(replicaWorld)-3],
+		{0x01, 0x01, 0x09, 0x00, 0x1f},
+		{0x01, 0x01, 0x09, 0x00, 0x08, 0x01, 0x04, 'm', 'e', 't', 'a', 0x01, 0x70},
+	} {
+		if err := NewTextReplica().Apply(update); err == nil {
+			t.Errorf("Expected % x to be rejected", update)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package sync
+
+import "encoding/binary"
+
+// The root Yjs text type the editor binds to
+const textName = "content"
+
+// EncodeTextInsert encodes a Yjs update inserting text at the start of the
+// root text type "content": one string item from client at clock, with no
+// origins, and an empty delete set. At clock zero it seeds an empty
+// document with text.
+func EncodeTextInsert(client, clock uint64, text string) []byte {
+	const rootParent = 1
+	update := binary.AppendUvarint(nil, 1) // Clients with structs
+	update = binary.AppendUvarint(update, 1)
+	update = binary.AppendUvarint(update, client)
+	update = binary.AppendUvarint(update, clock)
+	update = append(update, contentString)
+	update = binary.AppendUvarint(update, rootParent)
+	update = appendString(update, textName)
+	update = appendString(update, text)
+	return binary.AppendUvarint(update, 0) // Delete set
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
@@ -0,0 +1,282 @@
+// Package telemetry aggregates anonymous usage of a server, for operators
+// planning capacity across self-hosted instances: rooms created, peak
+// concurrency, and how often each API route and server event is used. It
+// records counts only, never room IDs, names, content or who did what.
+//
+// Telemetry is opt-in. A nil *Collector is valid and records nothing, so
+// instrumented code doesn't check whether it is on.
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+)
+
+type Config struct {
+	// Where aggregates are POSTed as JSON; when empty they are only served
+	// at /api/stats/aggregate
+	Endpoint string
+
+	ReportInterval time.Duration // How often to report to Endpoint
+	SampleInterval time.Duration // How often concurrency is sampled for peaks
+	Timeout        time.Duration // Per report request
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ReportInterval: 24 * time.Hour,
+		SampleInterval: 10 * time.Second,
+		Timeout:        10 * time.Second,
+	}
+}
+
+// Validate rejects configurations the collector can't run with
+func (c Config) Validate() error {
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("endpoint must be an http(s) URL, got %q", c.Endpoint)
+		}
+	}
+	if c.ReportInterval <= 0 {
+		return fmt.Errorf("report interval must be positive, got %v", c.ReportInterval)
+	}
+	if c.SampleInterval <= 0 {
+		return fmt.Errorf("sample interval must be positive, got %v", c.SampleInterval)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive, got %v", c.Timeout)
+	}
+	return nil
+}
+
+// Source provides live concurrency from the WebSocket hub
+type Source interface {
+	GetRoomCount() int
+	GetClientCount() int
+}
+
+// Aggregate is the usage a collector has seen since the server started
+type Aggregate struct {
+	Instance      string            `json:"instance"` // Random per process start; identifies nothing about the host
+	Since         time.Time         `json:"since"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+	RoomsCreated  uint64            `json:"rooms_created"`
+	PeakRooms     int               `json:"peak_rooms"`   // Most rooms open at once
+	PeakClients   int               `json:"peak_clients"` // Most sessions connected at once
+	Events        map[string]uint64 `json:"events"`       // Server events by type, as on /api/events
+	Features      map[string]uint64 `json:"features"`     // API requests by route
+}
+
+// Collector counts usage and reports it
+type Collector struct {
+	config   Config
+	broker   *events.Broker
+	source   Source
+	instance string
+	since    time.Time
+	client   *http.Client
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	mu          sync.Mutex
+	peakRooms   int
+	peakClients int
+	events      map[string]uint64
+	features    map[string]uint64
+}
+
+func New(broker *events.Broker, source Source, config Config) (*Collector, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &Collector{
+		config:   config,
+		broker:   broker,
+		source:   source,
+		instance: hex.EncodeToString(id),
+		since:    time.Now().UTC(),
+		client:   &http.Client{},
+		stop:     make(chan struct{}),
+		events:   make(map[string]uint64),
+		features: make(map[string]uint64),
+	}, nil
+}
+
+func (c *Collector) Start() {
+	c.wg.Add(2)
+	go c.follow()
+	go c.run()
+	if c.config.Endpoint != "" {
+		log.Printf("📊 Anonymous telemetry started (reporting every %v)", c.config.ReportInterval)
+	} else {
+		log.Println("📊 Anonymous telemetry started (not reporting)")
+	}
+}
+
+// Stop ends collection, sending a last report if an endpoint is set
+func (c *Collector) Stop() {
+	close(c.stop)
+	c.wg.Wait()
+	if c.config.Endpoint != "" {
+		if err := c.report(); err != nil {
+			log.Printf("Error sending telemetry report: %v", err)
+		}
+	}
+	log.Println("📊 Anonymous telemetry stopped")
+}
+
+// Aggregate returns the usage seen so far
+func (c *Collector) Aggregate() Aggregate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	a := Aggregate{
+		Instance:      c.instance,
+		Since:         c.since,
+		UptimeSeconds: int64(time.Since(c.since).Seconds()),
+		RoomsCreated:  c.events[events.RoomCreated],
+		PeakRooms:     c.peakRooms,
+		PeakClients:   c.peakClients,
+		Events:        make(map[string]uint64, len(c.events)),
+		Features:      make(map[string]uint64, len(c.features)),
+	}
+	for k, v := range c.events {
+		a.Events[k] = v
+	}
+	for k, v := range c.features {
+		a.Features[k] = v
+	}
+	return a
+}
+
+// Handler counts requests to an API route, named by its pattern such as
+// "GET /api/rooms/{id}" so no path values are kept
+func (c *Collector) Handler(route string, h http.Handler) http.Handler {
+	if c == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		c.features[route]++
+		c.mu.Unlock()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Counts server events, resubscribing after falling behind as notify does
+func (c *Collector) follow() {
+	defer c.wg.Done()
+
+	var lastID uint64
+	for {
+		sub, missed, _ := c.broker.Subscribe(events.Filter{}, lastID)
+		for _, e := range missed {
+			c.countEvent(e)
+			lastID = e.ID
+		}
+
+		for open := true; open; {
+			select {
+			case <-c.stop:
+				sub.Close()
+				return
+			case e, ok := <-sub.C:
+				if !ok {
+					open = false
+					continue
+				}
+				c.countEvent(e)
+				lastID = e.ID
+			}
+		}
+	}
+}
+
+func (c *Collector) countEvent(e events.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events[e.Type]++
+}
+
+func (c *Collector) run() {
+	defer c.wg.Done()
+
+	sample := time.NewTicker(c.config.SampleInterval)
+	defer sample.Stop()
+	var report <-chan time.Time
+	if c.config.Endpoint != "" {
+		ticker := time.NewTicker(c.config.ReportInterval)
+		defer ticker.Stop()
+		report = ticker.C
+	}
+
+	c.sample()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-sample.C:
+			c.sample()
+		case <-report:
+			if err := c.report(); err != nil {
+				log.Printf("Error sending telemetry report: %v", err)
+			}
+		}
+	}
+}
+
+// Records concurrency if it is the highest seen
+func (c *Collector) sample() {
+	rooms, clients := c.source.GetRoomCount(), c.source.GetClientCount()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peakRooms = max(c.peakRooms, rooms)
+	c.peakClients = max(c.peakClients, clients)
+}
+
+// Posts the aggregate to the endpoint. Reports are cumulative since the
+// process started, so a lost one loses nothing.
+func (c *Collector) report() error {
+	body, err := json.Marshal(c.Aggregate())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		// Errors quote the URL, which may hold a token
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+)
+
+type fakeSource struct{ rooms, clients atomic.Int64 }
+
+func (s *fakeSource) GetRoomCount() int   { return int(s.rooms.Load()) }
+func (s *fakeSource) GetClientCount() int { return int(s.clients.Load()) }
+
+func TestConfigValidate(t *testing.T) {
+	config := DefaultConfig()
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected the default config to be valid, got %v", err)
+	}
+	config.Endpoint = "telemetry.example.com/collect"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an endpoint without a scheme to be rejected")
+	}
+	config = DefaultConfig()
+	config.ReportInterval = 0
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a zero report interval to be rejected")
+	}
+}
+
+func TestCollector(t *testing.T) {
+	reports := make(chan Aggregate, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Aggregate
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Errorf("Invalid report body: %v", err)
+		}
+		reports <- a
+	}))
+	defer server.Close()
+
+	broker := events.NewBroker()
+	source := &fakeSource{}
+	source.rooms.Store(3)
+	source.clients.Store(7)
+	config := DefaultConfig()
+	config.Endpoint = server.URL
+	config.SampleInterval = 10 * time.Millisecond
+	collector, err := New(broker, source, config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	collector.Start()
+	// Wait for the subscription so no event is published before it
+	for broker.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	broker.Publish(events.RoomCreated, "secret-room", nil)
+	broker.Publish(events.RoomCreated, "other-room", nil)
+	broker.Publish(events.RoomJoined, "secret-room", nil)
+	handler := collector.Handler("GET /api/rooms/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/rooms/secret-room", nil))
+
+	// Peaks hold after concurrency drops
+	deadline := time.Now().Add(2 * time.Second)
+	for a := collector.Aggregate(); (a.Events[events.RoomJoined] == 0 || a.PeakRooms == 0) && time.Now().Before(deadline); a = collector.Aggregate() {
+		time.Sleep(5 * time.Millisecond)
+	}
+	source.rooms.Store(1)
+	source.clients.Store(1)
+	time.Sleep(30 * time.Millisecond)
+
+	a := collector.Aggregate()
+	if a.RoomsCreated != 2 || a.Events[events.RoomJoined] != 1 {
+		t.Errorf("Expected 2 rooms created and 1 join, got %+v", a)
+	}
+	if a.PeakRooms != 3 || a.PeakClients != 7 {
+		t.Errorf("Expected peaks of 3 rooms and 7 clients, got %d and %d", a.PeakRooms, a.PeakClients)
+	}
+	if a.Features["GET /api/rooms/{id}"] != 1 || len(a.Features) != 1 {
+		t.Errorf("Expected one request counted by route pattern, got %v", a.Features)
+	}
+	if a.Instance == "" {
+		t.Error("Expected an instance ID")
+	}
+
+	// Stopping sends a last report
+	collector.Stop()
+	select {
+	case report := <-reports:
+		if report.RoomsCreated != 2 || report.Instance != a.Instance {
+			t.Errorf("Expected the report to carry the aggregate, got %+v", report)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a report")
+	}
+}
+
+func TestNilCollector(t *testing.T) {
+	var collector *Collector
+	called := false
+	h := collector.Handler("GET /health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	if !called {
+		t.Error("Expected a nil collector to pass requests through")
+	}
+}
@@ -0,0 +1,113 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Instrumentation scope reported with every span
+const scopeName = "github.com/manpreetbhatti/lattice/backend"
+
+type Config struct {
+	// OTLP/HTTP traces URL, e.g. http://localhost:4318/v1/traces
+	Endpoint string
+	// Sent with every export, e.g. for a collector's API key
+	Headers map[string]string
+
+	ServiceName string
+	// Fraction of new traces recorded, from 0 to 1; spans continuing a
+	// caller's trace follow the caller's decision instead
+	SampleRatio float64
+
+	BatchSize     int           // Export once this many spans have ended
+	FlushInterval time.Duration // Export at least this often
+	QueueSize     int           // Ended spans waiting for export; more are dropped
+	Timeout       time.Duration // Per export request
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ServiceName:   "lattice",
+		SampleRatio:   1,
+		BatchSize:     512,
+		FlushInterval: 5 * time.Second,
+		QueueSize:     4096,
+		Timeout:       10 * time.Second,
+	}
+}
+
+// Validate rejects configurations the tracer can't run with
+func (c Config) Validate() error {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("OTLP endpoint must be an http(s) URL, got %q", c.Endpoint)
+	}
+	if c.ServiceName == "" {
+		return fmt.Errorf("service name is required")
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("sample ratio must be between 0 and 1, got %v", c.SampleRatio)
+	}
+	if c.BatchSize <= 0 || c.QueueSize <= 0 {
+		return fmt.Errorf("batch and queue sizes must be positive, got %d and %d", c.BatchSize, c.QueueSize)
+	}
+	if c.FlushInterval <= 0 || c.Timeout <= 0 {
+		return fmt.Errorf("flush interval and timeout must be positive, got %v and %v", c.FlushInterval, c.Timeout)
+	}
+	return nil
+}
+
+// Tracer starts spans through an SDK tracer provider whose batch processor
+// exports them from its own goroutine, so ending a span never waits on the
+// collector
+type Tracer struct {
+	config   Config
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+func New(config Config) (*Tracer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(config.Endpoint),
+		otlptracehttp.WithHeaders(config.Headers),
+		otlptracehttp.WithTimeout(config.Timeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", config.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithMaxExportBatchSize(config.BatchSize),
+			sdktrace.WithBatchTimeout(config.FlushInterval),
+			sdktrace.WithMaxQueueSize(config.QueueSize),
+			sdktrace.WithExportTimeout(config.Timeout),
+		),
+	)
+	return &Tracer{config: config, provider: provider, tracer: provider.Tracer(scopeName)}, nil
+}
+
+// Shutdown exports the spans that have ended and stops the tracer. Spans
+// ending afterwards are dropped.
+func (t *Tracer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), t.config.Timeout)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		log.Printf("Failed to export spans on shutdown: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Handler wraps h in a server span named after its route, such as
+// "GET /api/rooms/{id}", continuing the caller's trace when the request
+// carries a traceparent header
+func Handler(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		ctx, span := Start(ctx, route, WithKind(KindServer), WithAttributes(
+			String("http.request.method", r.Method),
+			String("http.route", route),
+			String("url.path", r.URL.Path),
+		))
+		if !span.IsRecording() {
+			if ctx != r.Context() {
+				r = r.WithContext(ctx)
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			span.SetAttributes(Int("http.response.status_code", recorder.status))
+			if recorder.status >= 500 {
+				RecordError(span, errorStatus(recorder.status))
+			}
+			span.End()
+		}()
+		h.ServeHTTP(recorder, r.WithContext(ctx))
+	})
+}
+
+type errorStatus int
+
+func (s errorStatus) Error() string { return http.StatusText(int(s)) }
+
+// Remembers the response status for the span, passing everything through
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(p)
+}
+
+// Streaming handlers flush as they go
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,136 @@
+// Package tracing records OpenTelemetry spans with the OpenTelemetry SDK and
+// exports them over OTLP/HTTP, so a document edit can be followed from the
+// WebSocket that received it through the hub's fan-out to the transaction
+// that persisted it.
+//
+// Instrumented code calls the package-level Start, which records nothing
+// until SetDefault installs a Tracer.
+package tracing
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// SpanContext identifies a span across goroutines and processes
+type SpanContext = trace.SpanContext
+
+// Span is an operation being timed. Start never returns nil: while tracing
+// is off or the trace was not sampled the span records nothing.
+type Span = trace.Span
+
+// ContextWithSpanContext returns a context whose spans are children of sc,
+// such as an edit whose write was batched with others
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return trace.ContextWithSpanContext(ctx, sc)
+}
+
+// SpanContextFromContext returns the span context started in ctx, if any
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc := trace.SpanContextFromContext(ctx)
+	return sc, sc.IsValid()
+}
+
+// Kind says how a span relates to other processes, as in OTLP
+type Kind = trace.SpanKind
+
+const (
+	KindInternal = trace.SpanKindInternal
+	KindServer   = trace.SpanKindServer // Handles a request from a client
+	KindClient   = trace.SpanKindClient // Calls another service
+	KindConsumer = trace.SpanKindConsumer
+)
+
+// Attr is a span attribute
+type Attr = attribute.KeyValue
+
+func String(key, value string) Attr    { return attribute.String(key, value) }
+func Int(key string, value int) Attr   { return attribute.Int(key, value) }
+func Bool(key string, value bool) Attr { return attribute.Bool(key, value) }
+
+// Option configures a span as it starts
+type Option func(*startConfig)
+
+type startConfig struct {
+	kind      Kind
+	attrs     []Attr
+	links     []trace.Link
+	childOnly bool
+}
+
+func WithKind(kind Kind) Option {
+	return func(c *startConfig) { c.kind = kind }
+}
+
+func WithAttributes(attrs ...Attr) Option {
+	return func(c *startConfig) { c.attrs = append(c.attrs, attrs...) }
+}
+
+// WithLinks relates the span to spans in other traces, such as the edits a
+// batched write persisted
+func WithLinks(links ...SpanContext) Option {
+	return func(c *startConfig) {
+		for _, link := range links {
+			c.links = append(c.links, trace.Link{SpanContext: link})
+		}
+	}
+}
+
+// ChildOnly skips the span unless the context already holds one, for work
+// such as queries that is only interesting as part of a larger operation
+func ChildOnly() Option {
+	return func(c *startConfig) { c.childOnly = true }
+}
+
+// RecordError marks the span as failed with err's message; a nil error is
+// ignored
+func RecordError(span Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+var defaultTracer atomic.Pointer[Tracer]
+
+// SetDefault makes t the tracer behind the package-level Start; nil turns
+// tracing off
+func SetDefault(t *Tracer) {
+	defaultTracer.Store(t)
+}
+
+// Start begins a span as a child of the one in ctx, or as the root of a new
+// trace, and returns a context holding it. Without a default tracer it
+// returns ctx unchanged and a span that records nothing.
+func Start(ctx context.Context, name string, opts ...Option) (context.Context, Span) {
+	t := defaultTracer.Load()
+	if t == nil {
+		return ctx, noop.Span{}
+	}
+	return t.Start(ctx, name, opts...)
+}
+
+// Start begins a span. Children follow their parent's sampling decision, so
+// a trace is recorded whole or not at all; the decision travels in the
+// returned context even when the span is not recorded.
+func (t *Tracer) Start(ctx context.Context, name string, opts ...Option) (context.Context, Span) {
+	config := startConfig{kind: KindInternal}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	if config.childOnly && !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, noop.Span{}
+	}
+	return t.tracer.Start(ctx, name,
+		trace.WithSpanKind(config.kind),
+		trace.WithAttributes(config.attrs...),
+		trace.WithLinks(config.links...),
+	)
+}
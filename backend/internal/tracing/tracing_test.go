@@ -0,0 +1,215 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Collects the spans a tracer exports
+type collector struct {
+	mu      sync.Mutex
+	spans   []*tracepb.Span
+	service string
+	headers http.Header
+}
+
+func startCollector(t *testing.T) (*collector, string) {
+	t.Helper()
+	c := &collector{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		var req coltracepb.ExportTraceServiceRequest
+		if err == nil {
+			err = proto.Unmarshal(body, &req)
+		}
+		if err != nil {
+			t.Errorf("Failed to decode export: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.headers = r.Header
+		for _, rs := range req.ResourceSpans {
+			for _, attr := range rs.Resource.GetAttributes() {
+				if attr.Key == "service.name" {
+					c.service = attr.Value.GetStringValue()
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return c, server.URL + "/v1/traces"
+}
+
+func (c *collector) span(t *testing.T, name string) *tracepb.Span {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, span := range c.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("Expected a %q span among %d exported", name, len(c.spans))
+	return nil
+}
+
+func newTestTracer(t *testing.T, endpoint string, ratio float64) *Tracer {
+	t.Helper()
+	config := DefaultConfig()
+	config.Endpoint = endpoint
+	config.SampleRatio = ratio
+	config.FlushInterval = time.Hour
+	tracer, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create tracer: %v", err)
+	}
+	return tracer
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, endpoint := range []string{"", "localhost:4318", "ftp://collector/v1/traces"} {
+		config := DefaultConfig()
+		config.Endpoint = endpoint
+		if _, err := New(config); err == nil {
+			t.Errorf("Expected endpoint %q to be rejected", endpoint)
+		}
+	}
+	config := DefaultConfig()
+	config.Endpoint = "http://localhost:4318/v1/traces"
+	config.SampleRatio = 2
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a sample ratio above 1 to be rejected")
+	}
+}
+
+func TestSampling(t *testing.T) {
+	tracer := newTestTracer(t, "http://localhost:4318/v1/traces", 0)
+	defer tracer.Shutdown()
+
+	// Unsampled roots are not recorded, and neither are their children
+	ctx, root := tracer.Start(context.Background(), "root")
+	if root.IsRecording() {
+		t.Fatal("Expected no recording with a sample ratio of 0")
+	}
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok || sc.IsSampled() {
+		t.Fatalf("Expected the unsampled decision in the context, got %+v", sc)
+	}
+	if _, child := tracer.Start(ctx, "child"); child.IsRecording() {
+		t.Error("Expected the child of an unsampled span to be skipped")
+	}
+
+	// A caller's sampled trace is continued whatever the ratio
+	traceID, _ := hex.DecodeString("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := hex.DecodeString("00f067aa0ba902b7")
+	parent := SpanContext{}.WithTraceID([16]byte(traceID)).WithSpanID([8]byte(spanID)).WithTraceFlags(1)
+	_, child := tracer.Start(ContextWithSpanContext(context.Background(), parent), "child")
+	if !child.IsRecording() {
+		t.Fatal("Expected the child of a sampled caller to be recorded")
+	}
+	if child.SpanContext().TraceID() != parent.TraceID() {
+		t.Errorf("Expected the child to continue trace %s", parent.TraceID())
+	}
+
+	if _, span := tracer.Start(context.Background(), "query", ChildOnly()); span.IsRecording() || span.SpanContext().IsValid() {
+		t.Error("Expected a child-only span to be skipped without a parent")
+	}
+
+	// Spans started while tracing is off are safe to use
+	_, span := Start(context.Background(), "off")
+	span.SetAttributes(String("key", "value"))
+	RecordError(span, errors.New("failed"))
+	span.End()
+}
+
+func TestExport(t *testing.T) {
+	c, endpoint := startCollector(t)
+	config := DefaultConfig()
+	config.Endpoint = endpoint
+	config.ServiceName = "lattice-test"
+	config.Headers = map[string]string{"X-Api-Key": "secret"}
+	tracer, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create tracer: %v", err)
+	}
+
+	ctx, root := tracer.Start(context.Background(), "root", WithKind(KindServer), WithAttributes(String("room", "export")))
+	_, other := tracer.Start(context.Background(), "other")
+	other.End()
+	_, child := tracer.Start(ctx, "child", WithLinks(other.SpanContext()), WithAttributes(Int("count", 3), Bool("ok", false)))
+	RecordError(child, errors.New("disk full"))
+	child.End()
+	root.End()
+
+	tracer.Shutdown()
+
+	if c.service != "lattice-test" {
+		t.Errorf("Expected service name lattice-test, got %q", c.service)
+	}
+	if got := c.headers.Get("X-Api-Key"); got != "secret" {
+		t.Errorf("Expected the configured header, got %q", got)
+	}
+
+	exportedRoot, exportedChild := c.span(t, "root"), c.span(t, "child")
+	if exportedRoot.Kind != tracepb.Span_SPAN_KIND_SERVER || len(exportedRoot.ParentSpanId) != 0 {
+		t.Errorf("Expected a server root span, got kind %v and parent %x", exportedRoot.Kind, exportedRoot.ParentSpanId)
+	}
+	if string(exportedChild.TraceId) != string(exportedRoot.TraceId) || string(exportedChild.ParentSpanId) != string(exportedRoot.SpanId) {
+		t.Errorf("Expected the child under the root, got trace %x parent %x", exportedChild.TraceId, exportedChild.ParentSpanId)
+	}
+	otherID := other.SpanContext().SpanID()
+	if len(exportedChild.Links) != 1 || string(exportedChild.Links[0].SpanId) != string(otherID[:]) {
+		t.Errorf("Expected a link to the other span, got %+v", exportedChild.Links)
+	}
+	if exportedChild.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || exportedChild.Status.GetMessage() != "disk full" {
+		t.Errorf("Expected an error status, got %+v", exportedChild.Status)
+	}
+	for _, attr := range exportedChild.Attributes {
+		if attr.Key == "count" && attr.Value.GetIntValue() != 3 {
+			t.Errorf("Expected count 3, got %+v", attr.Value)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	c, endpoint := startCollector(t)
+	tracer := newTestTracer(t, endpoint, 1)
+	SetDefault(tracer)
+	defer SetDefault(nil)
+
+	handler := Handler("GET /items/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := SpanContextFromContext(r.Context()); !ok {
+			t.Error("Expected the request context to carry the span")
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/items/7", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	tracer.Shutdown()
+
+	span := c.span(t, "GET /items/{id}")
+	if hex.EncodeToString(span.TraceId) != "4bf92f3577b34da6a3ce929d0e0e4736" || hex.EncodeToString(span.ParentSpanId) != "00f067aa0ba902b7" {
+		t.Errorf("Expected the caller's trace to continue, got trace %x parent %x", span.TraceId, span.ParentSpanId)
+	}
+	if span.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR {
+		t.Errorf("Expected a 503 to mark the span failed, got %+v", span.Status)
+	}
+}
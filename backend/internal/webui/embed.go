@@ -0,0 +1,24 @@
+//go:build embedui
+
+package webui
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Filled by copying the frontend's build output here before building with
+// -tags embedui; see make standalone
+//
+//go:embed all:dist
+var dist embed.FS
+
+var embedded = mustSub(dist, "dist")
+
+func mustSub(files fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(files, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
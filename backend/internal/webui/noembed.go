@@ -0,0 +1,7 @@
+//go:build !embedui
+
+package webui
+
+import "io/fs"
+
+var embedded fs.FS
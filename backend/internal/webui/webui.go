@@ -0,0 +1,119 @@
+// Package webui serves the built frontend from the server itself, so one
+// binary and its SQLite file are a complete deployment. Builds tagged
+// embedui carry the frontend in the binary (see embed.go); any build can
+// serve one from a directory instead.
+package webui
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Vite names files under assets/ by their content hash, so a changed file
+// always gets a new URL and the old one can be cached forever
+const assetsDir = "assets/"
+
+// Embedded returns the frontend built into the binary, or nil if it was
+// built without one
+func Embedded() fs.FS {
+	if embedded == nil || !isFile(embedded, "index.html") {
+		return nil
+	}
+	return embedded
+}
+
+// Handler serves the frontend in files, which must hold index.html at its
+// root. Paths that name no file get index.html so the client can route
+// them, except under assets/ and those with a file extension, which get
+// 404 as they can only be a stale or mistyped asset.
+//
+// basePath is the prefix the server is mounted under, such as "/lattice",
+// or empty at the root. Requests reach the handler without it; index.html
+// gets a <base> naming it so its relative URLs resolve from any route.
+func Handler(files fs.FS, basePath string) http.Handler {
+	fileServer := http.FileServer(http.FS(files))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "SAMEORIGIN")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name != "" && !isFile(files, name) {
+			if strings.HasPrefix(name, assetsDir) || path.Ext(name) != "" {
+				h.Set("Cache-Control", "no-cache")
+				http.NotFound(w, r)
+				return
+			}
+			name = ""
+		}
+
+		if strings.HasPrefix(name, assetsDir) {
+			h.Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			// index.html names the current assets, so it is revalidated on
+			// every load; so are unhashed files such as the favicon
+			h.Set("Cache-Control", "no-cache")
+		}
+
+		// FileServer redirects /index.html to / and lists directories, so
+		// index.html is served by name
+		if name == "" || name == "index.html" {
+			serveIndex(w, r, files, basePath)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+func isFile(files fs.FS, name string) bool {
+	info, err := fs.Stat(files, name)
+	return err == nil && !info.IsDir()
+}
+
+// Tagged with a hash of its content so reloads can be answered with 304
+func serveIndex(w http.ResponseWriter, r *http.Request, files fs.FS, basePath string) {
+	data, err := fs.ReadFile(files, "index.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	data = withBase(data, basePath+"/")
+	sum := sha256.Sum256(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(w, r, "index.html", time.Time{}, bytes.NewReader(data))
+}
+
+// Adds <base href> right after <head>, unless the page sets its own
+func withBase(page []byte, href string) []byte {
+	lower := bytes.ToLower(page)
+	if bytes.Contains(lower, []byte("<base ")) {
+		return page
+	}
+	head := bytes.Index(lower, []byte("<head>"))
+	if head < 0 {
+		return page
+	}
+	at := head + len("<head>")
+	tag := `<base href="` + html.EscapeString(href) + `">`
+
+	out := make([]byte, 0, len(page)+len(tag))
+	out = append(out, page[:at]...)
+	out = append(out, tag...)
+	return append(out, page[at:]...)
+}
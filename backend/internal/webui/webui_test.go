@@ -0,0 +1,80 @@
+package webui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestHandler(t *testing.T) {
+	handler := Handler(fstest.MapFS{
+		"index.html":           {Data: []byte("<!doctype html><html><head><title>Lattice</title></head></html>")},
+		"lattice.svg":          {Data: []byte("<svg></svg>")},
+		"assets/index-abc1.js": {Data: []byte("console.log(1)")},
+	}, "")
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		cache       string
+	}{
+		{"/", http.StatusOK, "text/html", "no-cache"},
+		{"/index.html", http.StatusOK, "text/html", "no-cache"},
+		{"/assets/index-abc1.js", http.StatusOK, "text/javascript", "immutable"},
+		{"/lattice.svg", http.StatusOK, "image/svg+xml", "no-cache"},
+		// Client-side routes get the app
+		{"/room/abc", http.StatusOK, "text/html", "no-cache"},
+		{"/assets", http.StatusOK, "text/html", "no-cache"},
+		// Missing assets don't
+		{"/assets/index-old.js", http.StatusNotFound, "", "no-cache"},
+		{"/favicon.ico", http.StatusNotFound, "", "no-cache"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); tt.contentType != "" && !strings.HasPrefix(ct, tt.contentType) {
+				t.Errorf("Expected content type %s, got %s", tt.contentType, ct)
+			}
+			if cc := w.Header().Get("Cache-Control"); !strings.Contains(cc, tt.cache) {
+				t.Errorf("Expected Cache-Control with %s, got %q", tt.cache, cc)
+			}
+		})
+	}
+
+	// The page's relative URLs resolve from the mount point on any route
+	w := httptest.NewRecorder()
+	Handler(fstest.MapFS{"index.html": {Data: []byte("<html><head><title>x</title></head></html>")}}, "/lattice").
+		ServeHTTP(w, httptest.NewRequest("GET", "/room/abc", nil))
+	if body := w.Body.String(); !strings.Contains(body, `<head><base href="/lattice/"><title>`) {
+		t.Errorf("Expected a <base> for the prefix, got %s", body)
+	}
+
+	// The app is revalidated by its ETag
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag on index.html")
+	}
+	req := httptest.NewRequest("GET", "/room/abc", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a current ETag, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", w.Code)
+	}
+}
@@ -0,0 +1,259 @@
+package ws
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// How long a client connecting to a protected room has to send its auth
+// message
+const authTimeout = 10 * time.Second
+
+// Auth message subtypes, as in y-protocols/auth
+const (
+	authPermissionDenied = 0
+	authToken            = 1
+	authIdentity         = 2
+)
+
+// Reports whether secret admits a client to the room; rooms without a join
+// secret admit everyone
+func (h *Hub) checkJoinSecret(ctx context.Context, roomID, secret string) bool {
+	if h.database == nil {
+		return true
+	}
+
+	ok, err := h.database.CheckJoinSecret(ctx, roomID, secret)
+	if err != nil {
+		log.Printf("Failed to check join secret for room %s: %v", roomID, err)
+		return false
+	}
+	return ok
+}
+
+// Reports whether a session may open the room. With strict rooms only rooms
+// created through the REST API can be joined; otherwise any ID will do and
+// the room is stored once it receives its first update.
+func (h *Hub) checkRoomExists(ctx context.Context, roomID string) bool {
+	if !h.config.StrictRooms || h.database == nil {
+		return true
+	}
+
+	room, err := h.database.GetRoom(ctx, roomID)
+	if err != nil {
+		log.Printf("Failed to look up room %s: %v", roomID, err)
+		return false
+	}
+	return room != nil
+}
+
+// Reports whether the identity token admits a client to a workspace room:
+// it must be for a member of the workspace. Rooms outside workspaces admit
+// everyone.
+func (h *Hub) checkWorkspace(ctx context.Context, roomID, token string) bool {
+	if h.database == nil {
+		return true
+	}
+
+	workspace, err := h.database.RoomWorkspace(ctx, roomID)
+	if err != nil {
+		log.Printf("Failed to look up workspace of room %s: %v", roomID, err)
+		return false
+	}
+	if workspace == nil {
+		return true
+	}
+	if h.identities == nil || token == "" {
+		return false
+	}
+
+	identity, err := h.identities.Verify(token)
+	if err != nil {
+		return false
+	}
+	role, err := h.database.WorkspaceRole(ctx, workspace.ID, identity.ID)
+	if err != nil {
+		log.Printf("Failed to check membership of workspace %s: %v", workspace.ID, err)
+		return false
+	}
+	return role != ""
+}
+
+// Admits a freshly upgraded connection to a protected room. The secret may
+// come from the ?secret= query parameter or from a first message of type
+// MessageTypeAuth carrying the secret as a var string (optionally preceded by
+// the authToken subtype). Rejected connections are told why and closed.
+func (h *Hub) authenticate(ctx context.Context, conn *websocket.Conn, roomID, querySecret, remoteAddr string) bool {
+	if h.checkJoinSecret(ctx, roomID, querySecret) {
+		return true
+	}
+
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, message, err := conn.ReadMessage()
+	if err == nil {
+		if secret, ok := parseAuthMessage(message); ok && h.checkJoinSecret(ctx, roomID, secret) {
+			return true
+		}
+	}
+
+	log.Printf("🔒 Rejected connection to protected room %s from %s", roomID, remoteAddr)
+
+	reason := "permission denied"
+	denied := []byte{byte(protocol.MessageTypeAuth), authPermissionDenied}
+	denied = binary.AppendUvarint(denied, uint64(len(reason)))
+	denied = append(denied, reason...)
+
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	conn.WriteMessage(websocket.BinaryMessage, denied)
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authentication required"))
+	return false
+}
+
+// Extracts the secret from an auth message
+func parseAuthMessage(data []byte) (string, bool) {
+	if len(data) < 2 || protocol.MessageType(data[0]) != protocol.MessageTypeAuth {
+		return "", false
+	}
+
+	payload := data[1:]
+	if payload[0] == authToken && len(payload) > 1 {
+		if secret, ok := readVarString(payload[1:]); ok {
+			return secret, true
+		}
+	}
+	return readVarString(payload)
+}
+
+// Reads a lib0 var string that must fill the rest of data
+func readVarString(data []byte) (string, bool) {
+	length, n := protocol.ReadVarUint(data)
+	if n <= 0 || uint64(len(data)-n) != length {
+		return "", false
+	}
+	return string(data[n:]), true
+}
+
+// Extracts the guest token from an identity message: the auth type, the
+// authIdentity subtype, then the token as a var string
+func parseIdentityMessage(data []byte) (string, bool) {
+	if len(data) < 3 || protocol.MessageType(data[0]) != protocol.MessageTypeAuth || data[1] != authIdentity {
+		return "", false
+	}
+	return readVarString(data[2:])
+}
+
+// Verifies a guest token and attaches its identity to the client. Invalid
+// tokens leave the client anonymous.
+func (c *Client) identify(token string) {
+	if c.hub.identities == nil {
+		return
+	}
+
+	identity, err := c.hub.identities.Verify(token)
+	if err != nil {
+		log.Printf("⚠️ Rejected identity token from client %s: %v", c.clientID, err)
+		return
+	}
+	if identity, err = c.hub.currentProfile(identity); err != nil || identity == nil {
+		log.Printf("⚠️ Rejected identity token from client %s: profile unavailable (%v)", c.clientID, err)
+		return
+	}
+
+	c.mu.Lock()
+	c.identity = identity
+	c.mu.Unlock()
+
+	log.Printf("🪪 Client %s in room %s identified as %s (%s)", c.clientID, c.roomID, identity.Name, identity.ID)
+
+	// Profiles keep a list of recently visited rooms; guests don't
+	if c.hub.database != nil && strings.HasPrefix(identity.ID, db.UserIDPrefix) {
+		if err := c.hub.database.RecordRoomVisit(context.Background(), identity.ID, c.roomID); err != nil {
+			log.Printf("Error recording visit to room %s by %s: %v", c.roomID, identity.ID, err)
+		}
+	}
+}
+
+func (c *Client) getIdentity() *auth.Identity {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.identity
+}
+
+// Who to credit for the client's updates. Without a sender, as for updates
+// applied over HTTP, nobody is.
+func (c *Client) author() db.Author {
+	if c == nil {
+		return db.Author{}
+	}
+	author := db.Author{ClientID: c.clientID}
+	if identity := c.getIdentity(); identity != nil {
+		author.UserID = identity.ID
+	}
+	return author
+}
+
+// Returns identity with the name and color its stored profile has now,
+// since they may have changed since the token was issued. Guests are
+// returned as they are; a deleted profile gives nil.
+func (h *Hub) currentProfile(identity *auth.Identity) (*auth.Identity, error) {
+	if h.database == nil || !strings.HasPrefix(identity.ID, db.UserIDPrefix) {
+		return identity, nil
+	}
+
+	user, err := h.database.GetUser(context.Background(), identity.ID)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	current := *identity
+	current.Name = user.Name
+	current.Color = user.Color
+	return &current, nil
+}
+
+// UpdateIdentity applies a changed profile to every session signed in as
+// it and restamps the awareness states they published, so peers see the
+// new name and color without the sessions reconnecting. It reports how many
+// sessions were updated.
+func (h *Hub) UpdateIdentity(identity *auth.Identity) int {
+	h.mu.RLock()
+	var sessions []*Client
+	for _, clients := range h.rooms {
+		for client := range clients {
+			if current := client.getIdentity(); current != nil && current.ID == identity.ID {
+				sessions = append(sessions, client)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range sessions {
+		client.mu.Lock()
+		updated := *identity
+		updated.ExpiresAt = client.identity.ExpiresAt
+		client.identity = &updated
+		client.mu.Unlock()
+
+		h.mu.RLock()
+		roomState, ok := h.roomStates[client.roomID]
+		h.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		if entries := roomState.restampAwareness(client, &updated); len(entries) > 0 {
+			h.sendToRoom(client.roomID, protocol.EncodeAwarenessMessage(entries))
+		}
+	}
+	return len(sessions)
+}
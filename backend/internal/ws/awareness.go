@@ -0,0 +1,191 @@
+package ws
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// Stores an awareness entry from owner unless the room holds a newer one
+// for the same Yjs client, following the y-protocols rule that a removal may
+// reuse the current clock. Removals drop the stored state. Reports whether
+// the entry was applied.
+func (r *RoomState) SetAwareness(entry protocol.AwarenessEntry, owner *Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if clock, ok := r.awarenessClocks[entry.ClientID]; ok {
+		if entry.Clock < clock || (entry.Clock == clock && !entry.Removed()) {
+			return false
+		}
+	}
+
+	if entry.Removed() {
+		r.forgetAwareness(entry.ClientID)
+		return true
+	}
+	r.AwarenessStates[entry.ClientID] = protocol.EncodeAwarenessMessage([]protocol.AwarenessEntry{entry})
+	r.awarenessClocks[entry.ClientID] = entry.Clock
+	// A reconnecting client publishes under the same Yjs ID, so the newest
+	// session takes the state over from the one it replaced
+	r.awarenessOwners[entry.ClientID] = owner
+	return true
+}
+
+// Drops every awareness state last published by owner, returning the
+// removal entries peers need. Each removal carries a newer clock than the
+// state it replaces so peers accept it without waiting for their own
+// timeout.
+func (r *RoomState) RemoveAwarenessOwnedBy(owner *Client) []protocol.AwarenessEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var removals []protocol.AwarenessEntry
+	for id, o := range r.awarenessOwners {
+		if o != owner {
+			continue
+		}
+		removals = append(removals, protocol.AwarenessEntry{ClientID: id, Clock: r.awarenessClocks[id]}.Removal())
+		r.forgetAwareness(id)
+	}
+	return removals
+}
+
+// Callers hold r.mu
+func (r *RoomState) forgetAwareness(clientID uint64) {
+	delete(r.AwarenessStates, clientID)
+	delete(r.awarenessClocks, clientID)
+	delete(r.awarenessOwners, clientID)
+}
+
+// Rewrites the states owner published with identity's name and color under
+// newer clocks, returning the entries peers need
+func (r *RoomState) restampAwareness(owner *Client, identity *auth.Identity) []protocol.AwarenessEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var entries []protocol.AwarenessEntry
+	for id, o := range r.awarenessOwners {
+		if o != owner {
+			continue
+		}
+		stored, err := protocol.ParseAwarenessMessage(r.AwarenessStates[id])
+		if err != nil || len(stored) != 1 {
+			continue
+		}
+		state, changed := stampState(stored[0].State, identity)
+		if !changed {
+			continue
+		}
+		entry := protocol.AwarenessEntry{ClientID: id, Clock: stored[0].Clock + 1, State: state}
+		r.AwarenessStates[id] = protocol.EncodeAwarenessMessage([]protocol.AwarenessEntry{entry})
+		r.awarenessClocks[id] = entry.Clock
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Overwrites the user in the awareness states a verified client publishes,
+// so peers see its identity rather than whatever name it claims
+func stampAwareness(data []byte, identity *auth.Identity) []byte {
+	entries, err := protocol.ParseAwarenessMessage(data)
+	if err != nil {
+		return data
+	}
+
+	changed := false
+	for i, entry := range entries {
+		if entry.Removed() {
+			continue
+		}
+		if state, ok := stampState(entry.State, identity); ok {
+			entries[i].State = state
+			changed = true
+		}
+	}
+	if !changed {
+		return data
+	}
+	return protocol.EncodeAwarenessMessage(entries)
+}
+
+// Sets the id, name and color of the "user" field of a JSON awareness
+// state, keeping everything else. Reports whether the state changed.
+func stampState(state string, identity *auth.Identity) (string, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(state), &fields) != nil || fields == nil {
+		return state, false
+	}
+	var user map[string]interface{}
+	if raw, ok := fields["user"]; ok {
+		json.Unmarshal(raw, &user)
+	}
+	if user == nil {
+		user = make(map[string]interface{})
+	}
+	if user["id"] == identity.ID && user["name"] == identity.Name && user["color"] == identity.Color {
+		return state, false
+	}
+
+	user["id"] = identity.ID
+	user["name"] = identity.Name
+	user["color"] = identity.Color
+	raw, err := json.Marshal(user)
+	if err != nil {
+		return state, false
+	}
+	fields["user"] = raw
+	stamped, err := json.Marshal(fields)
+	if err != nil {
+		return state, false
+	}
+	return string(stamped), true
+}
+
+// Records the states in a relayed awareness message and which session
+// published them
+func (h *Hub) trackAwareness(roomState *RoomState, message *Message) {
+	entries, err := protocol.ParseAwarenessMessage(message.Data)
+	if err != nil {
+		log.Printf("⚠️ Not storing awareness message in room %s: %v", message.RoomID, err)
+		return
+	}
+
+	for _, entry := range entries {
+		roomState.SetAwareness(entry, message.Sender)
+	}
+}
+
+// Forgets the awareness states a departed session published and broadcasts
+// their removal. This runs for every departure, including connections that
+// died without a close frame and were only noticed when their read deadline
+// passed, so peers never keep a ghost cursor.
+func (h *Hub) releaseAwareness(client *Client) {
+	h.mu.RLock()
+	roomState, ok := h.roomStates[client.roomID]
+	h.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	removals := roomState.RemoveAwarenessOwnedBy(client)
+	if len(removals) == 0 {
+		return
+	}
+	log.Printf("Removing %d awareness states of departed client %s in room %s", len(removals), client.clientID, client.roomID)
+	h.sendToRoom(client.roomID, protocol.EncodeAwarenessMessage(removals))
+}
+
+// Queues a server-generated message for every client in a room
+func (h *Hub) sendToRoom(roomID string, data []byte) {
+	for _, client := range h.roomClients(roomID) {
+		switch client.enqueue(data, nil) {
+		case enqueueOverflowed:
+			h.overflowedMessages.Add(1)
+		case enqueueRejected:
+			h.dropSlowClient(client)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// Application close codes (4000-4999 are reserved for applications by
+// RFC 6455); clients should not reconnect automatically after either
+const (
+	closeCodeKicked = 4001
+	closeCodeBanned = 4003
+)
+
+// Close sent to sessions refused because of an active ban
+const closeReasonBanned = "banned from room"
+
+// BanScope selects what a ban is keyed by
+type BanScope string
+
+const (
+	BanByIP   BanScope = "ip"
+	BanByUser BanScope = "user"
+)
+
+var (
+	ErrClientNotFound = errors.New("client not connected to this room")
+	ErrNoIdentity     = errors.New("client has no verified identity to ban")
+)
+
+// KickOptions optionally bans the kicked client from rejoining the room
+type KickOptions struct {
+	BanDuration time.Duration // Zero kicks without banning
+	BanBy       BanScope      // Defaults to BanByIP
+}
+
+// Ban is an active refusal of one IP or user in one room
+type Ban struct {
+	RoomID string    `json:"room_id"`
+	Scope  BanScope  `json:"scope"`
+	Value  string    `json:"value"`
+	Until  time.Time `json:"until"`
+}
+
+func (b Ban) key() string {
+	return string(b.Scope) + ":" + b.Value
+}
+
+// Host part of a client's remote address, for IP bans
+func (c *Client) remoteIP() string {
+	return hostOf(c.remoteAddr)
+}
+
+// Builds the ban for a client, failing when it has nothing to key it by
+func (c *Client) banFor(scope BanScope, until time.Time) (*Ban, error) {
+	ban := &Ban{RoomID: c.roomID, Scope: scope, Until: until}
+	switch scope {
+	case BanByUser:
+		identity := c.getIdentity()
+		if identity == nil {
+			return nil, ErrNoIdentity
+		}
+		ban.Value = identity.ID
+	default:
+		ban.Scope = BanByIP
+		ban.Value = c.remoteIP()
+	}
+	return ban, nil
+}
+
+func (h *Hub) addBan(ban *Ban) {
+	h.banMu.Lock()
+	defer h.banMu.Unlock()
+
+	bans, ok := h.bans[ban.RoomID]
+	if !ok {
+		bans = make(map[string]time.Time)
+		h.bans[ban.RoomID] = bans
+	}
+	if ban.Until.After(bans[ban.key()]) {
+		bans[ban.key()] = ban.Until
+	}
+}
+
+// Reports whether a client is banned from its room by IP or identity,
+// pruning expired bans for the room as it goes
+func (h *Hub) isBanned(client *Client) bool {
+	h.banMu.Lock()
+	defer h.banMu.Unlock()
+
+	bans, ok := h.bans[client.roomID]
+	if !ok {
+		return false
+	}
+
+	now := time.Now()
+	for key, until := range bans {
+		if !until.After(now) {
+			delete(bans, key)
+		}
+	}
+	if len(bans) == 0 {
+		delete(h.bans, client.roomID)
+		return false
+	}
+
+	if _, ok := bans[string(BanByIP)+":"+client.remoteIP()]; ok {
+		return true
+	}
+	if identity := client.getIdentity(); identity != nil {
+		if _, ok := bans[string(BanByUser)+":"+identity.ID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Bans lists the active bans in a room
+func (h *Hub) Bans(roomID string) []Ban {
+	h.banMu.Lock()
+	defer h.banMu.Unlock()
+
+	now := time.Now()
+	result := make([]Ban, 0, len(h.bans[roomID]))
+	for key, until := range h.bans[roomID] {
+		if !until.After(now) {
+			continue
+		}
+		scope, value, _ := strings.Cut(key, ":")
+		result = append(result, Ban{RoomID: roomID, Scope: BanScope(scope), Value: value, Until: until})
+	}
+	return result
+}
+
+// Closes a session refused at registration; it never joined the room, so
+// the hub owns its send channel until now
+func (h *Hub) refuseBanned(client *Client) {
+	log.Printf("🚫 Refused banned client %s in room %s", client.clientID, client.roomID)
+	client.closeSend(closeCodeBanned, closeReasonBanned)
+}
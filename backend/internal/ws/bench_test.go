@@ -0,0 +1,132 @@
+package ws
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// Typing in the editor produces updates of a few dozen bytes
+func benchUpdate(i int) []byte {
+	payload := make([]byte, 48)
+	payload[0] = byte(i)
+	payload[1] = byte(i >> 8)
+	return protocol.EncodeUpdate(payload)
+}
+
+// Adds clients to a room whose send queues are drained in the background,
+// as writePump would; the returned func stops the drains
+func benchRoom(b *testing.B, hub *Hub, roomID string, n int) ([]*Client, func()) {
+	b.Helper()
+
+	clients := make([]*Client, n)
+	done := make(chan struct{})
+	hub.rooms[roomID] = make(map[*Client]bool, n)
+	for i := range clients {
+		client := newClient(hub, nil, roomID, fmt.Sprintf("bench-%d", i))
+		clients[i] = client
+		hub.rooms[roomID][client] = true
+
+		go func() {
+			for {
+				select {
+				case <-client.send:
+				case <-client.wake:
+					client.takeOverflow()
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	return clients, func() { close(done) }
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	for _, n := range []int{2, 10, 100} {
+		b.Run(fmt.Sprintf("clients=%d", n), func(b *testing.B) {
+			hub := NewHub(nil)
+			clients, stop := benchRoom(b, hub, "bench-room", n)
+			defer stop()
+
+			update := benchUpdate(0)
+			b.SetBytes(int64(len(update) * (n - 1)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				hub.handleBroadcast(&Message{RoomID: "bench-room", Data: update, Sender: clients[0]})
+			}
+		})
+	}
+}
+
+func BenchmarkBroadcastAwareness(b *testing.B) {
+	hub := NewHub(nil)
+	clients, stop := benchRoom(b, hub, "bench-room", 10)
+	defer stop()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sender := clients[i%len(clients)]
+		data := protocol.EncodeAwarenessMessage([]protocol.AwarenessEntry{{
+			ClientID: uint64(i % len(clients)),
+			Clock:    uint64(i),
+			State:    `{"user":{"name":"Ada","color":"#30bced"},"cursor":{"anchor":120,"head":120}}`,
+		}})
+		hub.handleBroadcast(&Message{RoomID: "bench-room", Data: data, Sender: sender})
+	}
+}
+
+func BenchmarkRegisterCatchUp(b *testing.B) {
+	// Every join is logged, which would dominate the measurement
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, updates := range []int{100, 10000} {
+		b.Run(fmt.Sprintf("updates=%d", updates), func(b *testing.B) {
+			hub := NewHub(nil)
+			roomState := hub.getRoomState("bench-room")
+			for i := 0; i < updates; i++ {
+				roomState.AddUpdate(benchUpdate(i))
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client := newClient(hub, nil, "bench-room", "joiner")
+				hub.handleRegister(client)
+				hub.handleUnregister(client)
+			}
+		})
+	}
+}
+
+func BenchmarkEnqueueLagging(b *testing.B) {
+	for _, batching := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batching=%t", batching), func(b *testing.B) {
+			update := benchUpdate(0)
+			var client *Client
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// A client that stays behind, replaced well before it would
+				// reach the overflow limit
+				if i%10000 == 0 {
+					b.StopTimer()
+					client = newClient(nil, nil, "bench-room", "lagging")
+					client.batching = batching
+					for len(client.send) < sendBufferSize {
+						client.send <- update
+					}
+					b.StartTimer()
+				}
+				client.enqueue(update, nil)
+			}
+		})
+	}
+}
@@ -1,13 +1,21 @@
 package ws
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
 	"github.com/manpreetbhatti/lattice/backend/internal/ratelimit"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+	"github.com/manpreetbhatti/lattice/backend/internal/tracing"
 )
 
 const (
@@ -17,16 +25,58 @@ const (
 	maxMessageSize    = 1024 * 1024
 	messagesPerSecond = 100
 	messageBurst      = 200
+	sendBufferSize    = 512
+
+	// Bytes that may wait in a client's overflow queue once its send buffer
+	// is full before the client is told to go away and resync
+	maxOverflowBytes = 8 * 1024 * 1024
+
+	// Bytes of stored history that may wait in the overflow queue at once,
+	// leaving the rest of maxOverflowBytes for live messages
+	historyWindowBytes = maxOverflowBytes / 4
+
+	// Largest batch of coalesced updates sent to a lagging client
+	maxBatchBytes = 1024 * 1024
+
+	// A client whose queue has been backed up this long, or whose writes
+	// take this long on average, is reported as lagging
+	lagThreshold = 500 * time.Millisecond
+)
+
+// Close sent to clients that fall too far behind; the client is expected to
+// reconnect and catch up from the room state
+const (
+	closeCodeSlowClient   = websocket.CloseTryAgainLater
+	closeReasonSlowClient = "send buffer overflow"
 )
 
+// Subprotocol names the wire format sessions speak. Clients offer it in
+// Sec-WebSocket-Protocol so a later format can be negotiated beside it;
+// clients that offer no subprotocol are assumed to speak this one.
+const Subprotocol = "lattice-v1"
+
+// Subprotocols the server accepts, preferred first
+var subprotocols = []string{Subprotocol}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
+	Subprotocols:    subprotocols,
+	// acceptSession checks the origin against the hub's allowlist first,
+	// so a refusal gets a JSON error rather than a bare 403
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
+// Used for sessions granted CapabilityCompression, so clients that didn't
+// ask keep uncompressed frames
+var compressingUpgrader = func() websocket.Upgrader {
+	u := upgrader
+	u.EnableCompression = true
+	return u
+}()
+
 type Client struct {
 	hub         *Hub
 	conn        *websocket.Conn
@@ -34,37 +84,502 @@ type Client struct {
 	roomID      string
 	rateLimiter *ratelimit.Limiter
 	clientID    string
+
+	// Messages waiting for room in send, in delivery order
+	overflow      []pendingMessage
+	overflowBytes int
+	wake          chan struct{}
+	drained       chan struct{} // Signalled when the overflow queue is emptied or closed
+	closeCode     int
+	closeReason   string
+	sendClosed    bool // Set once send is closed; later messages are dropped
+	mu            sync.Mutex
+
+	// Protocol version and capabilities agreed on connect
+	handshake Handshake
+
+	// Token presented on connect, and updates delivered since the last
+	// token was issued
+	resume           *ResumeToken
+	sinceResumeToken int
+
+	// Set while stored history is streamed to the client; no resume token
+	// is issued until it has all been queued
+	catchingUp atomic.Bool
+
+	// Set by CapabilitySequence: document updates arrive wrapped with their
+	// room sequence number and the client may request refills
+	sequenced bool
+
+	// Set by CapabilityBatch: while the client is behind, consecutive
+	// document updates waiting for it are coalesced into one batch frame
+	batching bool
+
+	// TerminalHost or TerminalViewer for /ws/terminal sessions, which are
+	// kept apart from the room's document sessions; empty otherwise
+	terminalRole   string
+	warnedReadOnly bool // Only touched by the reading goroutine
+
+	// Set while the client has joined the room's audio huddle
+	inHuddle atomic.Bool
+
+	// When the overflow queue last became non-empty; zero while the client
+	// keeps up. Guarded by mu.
+	behindSince time.Time
+
+	// Verified identity from a guest token, if one was presented; guarded
+	// by mu
+	identity *auth.Identity
+
+	remoteAddr   string
+	limitIP      string // Address holding a per-IP session slot
+	connectedAt  time.Time
+	lastActivity atomic.Int64 // Unix nanoseconds of the last inbound message
+	messagesIn   atomic.Uint64
+	messagesOut  atomic.Uint64
+	bytesIn      atomic.Uint64
+	bytesOut     atomic.Uint64
+	writeNanos   atomic.Int64 // Moving average of how long a write takes
 }
 
-func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	roomID := r.URL.Query().Get("room")
-	if roomID == "" {
-		roomID = "default"
-	}
+// ConnectionInfo is a snapshot of one client's session statistics
+type ConnectionInfo struct {
+	ClientID     string    `json:"client_id"`
+	RoomID       string    `json:"room_id"`
+	RemoteAddr   string    `json:"remote_addr"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	LastActivity time.Time `json:"last_activity"`
+	IdleSeconds  float64   `json:"idle_seconds"`
+	MessagesIn   uint64    `json:"messages_in"`
+	MessagesOut  uint64    `json:"messages_out"`
+	BytesIn      uint64    `json:"bytes_in"`
+	BytesOut     uint64    `json:"bytes_out"`
+	Queued       int       `json:"queued"`
+	BehindMs     int64     `json:"behind_ms"`        // How long the queue has been backed up
+	WriteMs      float64   `json:"write_latency_ms"` // Moving average per message
+	Lagging      bool      `json:"lagging"`
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("Upgrade error:", err)
-		return
-	}
+	Identity *auth.Identity `json:"identity,omitempty"`
+}
 
-	clientID := fmt.Sprintf("%s-%d", conn.RemoteAddr().String(), time.Now().UnixNano())
+// A queued message; awareness messages carry their sender so a newer
+// awareness update from the same sender can replace a stale one
+type pendingMessage struct {
+	data           []byte
+	awarenessOwner *Client
+}
 
-	client := &Client{
+func newClient(hub *Hub, conn *websocket.Conn, roomID, clientID string) *Client {
+	now := time.Now()
+	c := &Client{
 		hub:         hub,
 		conn:        conn,
-		send:        make(chan []byte, 512),
+		send:        make(chan []byte, sendBufferSize),
 		roomID:      roomID,
 		rateLimiter: ratelimit.NewLimiter(messagesPerSecond, messageBurst),
 		clientID:    clientID,
+		wake:        make(chan struct{}, 1),
+		drained:     make(chan struct{}, 1),
+		connectedAt: now,
+		handshake:   legacyHandshake(),
+	}
+	if conn != nil {
+		c.remoteAddr = conn.RemoteAddr().String()
+	}
+	c.lastActivity.Store(now.UnixNano())
+	return c
+}
+
+// Applies the negotiated capabilities and reads the optional resume and
+// identity tokens from the connect URL
+func (c *Client) applyConnectOptions(r *http.Request) {
+	// A token for another room is ignored; a stale one falls back to full sync
+	if token := r.URL.Query().Get("resume"); token != "" && c.handshake.Has(CapabilityResume) {
+		if resume, err := ParseResumeToken(token); err == nil && resume.RoomID == c.roomID {
+			c.resume = resume
+		}
+	}
+
+	c.sequenced = c.handshake.Has(CapabilitySequence)
+	c.batching = c.handshake.Has(CapabilityBatch)
+
+	if token := r.URL.Query().Get("token"); token != "" {
+		c.identify(token)
+	}
+}
+
+// Records an inbound message for session statistics
+func (c *Client) touch(size int) {
+	c.lastActivity.Store(time.Now().UnixNano())
+	c.messagesIn.Add(1)
+	c.bytesIn.Add(uint64(size))
+}
+
+// Returns when the client last sent a message
+func (c *Client) lastActive() time.Time {
+	return time.Unix(0, c.lastActivity.Load())
+}
+
+func (c *Client) info(now time.Time) ConnectionInfo {
+	c.mu.Lock()
+	queued := len(c.send) + len(c.overflow)
+	identity := c.identity
+	behind := c.behindLocked(now)
+	c.mu.Unlock()
+
+	writeLatency := time.Duration(c.writeNanos.Load())
+	last := c.lastActive()
+	return ConnectionInfo{
+		ClientID:     c.clientID,
+		RoomID:       c.roomID,
+		RemoteAddr:   c.remoteAddr,
+		ConnectedAt:  c.connectedAt,
+		LastActivity: last,
+		IdleSeconds:  now.Sub(last).Seconds(),
+		MessagesIn:   c.messagesIn.Load(),
+		MessagesOut:  c.messagesOut.Load(),
+		BytesIn:      c.bytesIn.Load(),
+		BytesOut:     c.bytesOut.Load(),
+		Queued:       queued,
+		BehindMs:     behind.Milliseconds(),
+		WriteMs:      float64(writeLatency) / float64(time.Millisecond),
+		Lagging:      behind >= lagThreshold || writeLatency >= lagThreshold,
+		Identity:     identity,
+	}
+}
+
+// Outcome of queueing a message for a client
+type enqueueResult int
+
+const (
+	enqueueSent enqueueResult = iota
+	enqueueOverflowed
+	enqueueCoalesced
+	enqueueRejected
+)
+
+// Queues a live message for delivery. Once the send buffer is full messages
+// spill into the overflow queue. There a pending awareness update is replaced
+// by its sender's next one, and document updates join a batch frame if the
+// client accepts batches; clients that don't get every update as its own
+// frame, since Yjs updates can't be merged without decoding them.
+// enqueueRejected means the overflow limit was hit and the client should be
+// disconnected.
+func (c *Client) enqueue(data []byte, sender *Client) enqueueResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sendClosed {
+		return enqueueSent
+	}
+
+	if len(c.overflow) == 0 {
+		select {
+		case c.send <- data:
+			return enqueueSent
+		default:
+		}
+	}
+
+	if sender != nil && len(data) > 0 && data[0] == MessageAwareness {
+		for i := range c.overflow {
+			if c.overflow[i].awarenessOwner == sender {
+				c.overflowBytes += len(data) - len(c.overflow[i].data)
+				c.overflow[i].data = data
+				return enqueueCoalesced
+			}
+		}
+	} else {
+		sender = nil
+	}
+
+	if c.overflowBytes+len(data) > maxOverflowBytes {
+		return enqueueRejected
+	}
+
+	if c.coalesceUpdate(data) {
+		return enqueueCoalesced
+	}
+
+	c.appendOverflow(pendingMessage{data: data, awarenessOwner: sender})
+	c.signal()
+	return enqueueOverflowed
+}
+
+// Folds a document update into the batch at the tail of the overflow queue
+// when the client accepts batches, so a lagging client receives one frame
+// per drain instead of one per update. Callers hold c.mu.
+func (c *Client) coalesceUpdate(data []byte) bool {
+	if !c.batching || !protocol.IsUpdateFrame(data) || len(c.overflow) == 0 {
+		return false
+	}
+
+	tail := &c.overflow[len(c.overflow)-1]
+	isBatch := protocol.ParseMessageType(tail.data) == protocol.MessageTypeBatch
+	if !isBatch && !protocol.IsUpdateFrame(tail.data) {
+		return false
+	}
+	if len(tail.data)+len(data)+2*binary.MaxVarintLen64 > maxBatchBytes {
+		return false
+	}
+
+	before := len(tail.data)
+	if !isBatch {
+		// The queued frame may be shared with other clients' queues
+		tail.data = protocol.AppendToBatch(nil, tail.data)
+	}
+	tail.data = protocol.AppendToBatch(tail.data, data)
+	c.overflowBytes += len(tail.data) - before
+	return true
+}
+
+// Callers hold c.mu
+func (c *Client) appendOverflow(pending pendingMessage) {
+	if len(c.overflow) == 0 {
+		c.behindSince = time.Now()
+	}
+	c.overflow = append(c.overflow, pending)
+	c.overflowBytes += len(pending.data)
+}
+
+// How long the client's queue has been backed up. Callers hold c.mu.
+func (c *Client) behindLocked(now time.Time) time.Duration {
+	if c.behindSince.IsZero() {
+		return 0
+	}
+	return now.Sub(c.behindSince)
+}
+
+// Queues catch-up state for a newly joined client without applying the
+// overflow limit
+func (c *Client) enqueueCatchUp(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sendClosed {
+		return
+	}
+
+	if len(c.overflow) == 0 {
+		select {
+		case c.send <- data:
+			return
+		default:
+		}
+	}
+
+	c.appendOverflow(pendingMessage{data: data})
+	c.signal()
+}
+
+// Queues one frame of stored history, waiting while more than
+// historyWindowBytes of it would be left in the overflow queue. Returns
+// false without queueing once the client is closed or stop is closed.
+func (c *Client) enqueueHistory(data []byte, stop <-chan struct{}) bool {
+	for {
+		c.mu.Lock()
+		if c.sendClosed {
+			c.mu.Unlock()
+			return false
+		}
+		if len(c.overflow) == 0 || c.overflowBytes+len(data) <= historyWindowBytes {
+			if len(c.overflow) == 0 {
+				select {
+				case c.send <- data:
+					c.mu.Unlock()
+					return true
+				default:
+				}
+			}
+			c.appendOverflow(pendingMessage{data: data})
+			c.signal()
+			c.mu.Unlock()
+			return true
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.drained:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+func (c *Client) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Removes and returns everything in the overflow queue
+func (c *Client) takeOverflow() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.overflow) == 0 {
+		return nil
+	}
+
+	batch := make([][]byte, len(c.overflow))
+	for i, pending := range c.overflow {
+		batch[i] = pending.data
+	}
+	c.overflow = nil
+	c.overflowBytes = 0
+	c.behindSince = time.Time{}
+	c.signalDrained()
+	return batch
+}
+
+func (c *Client) signalDrained() {
+	select {
+	case c.drained <- struct{}{}:
+	default:
 	}
+}
+
+// Closes the send queue so writePump sends the given close frame (none if
+// code is zero) and exits. Safe to race with enqueues from any goroutine;
+// the caller must ensure it runs once per client.
+func (c *Client) closeSend(code int, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if code != 0 {
+		c.closeCode = code
+		c.closeReason = reason
+	}
+	c.sendClosed = true
+	close(c.send)
+	c.signalDrained()
+}
 
+// Reports whether the send queue has been closed
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sendClosed
+}
+
+func (c *Client) closeMessage() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeCode == 0 {
+		return []byte{}
+	}
+	return websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+}
+
+func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	client := hub.acceptSession(w, r)
+	if client == nil {
+		return
+	}
+	client.applyConnectOptions(r)
+
+	hub.verifyRoom(client.roomID)
 	hub.register <- client
 
 	go client.writePump()
 	go client.readPump()
 }
 
+// Admits, upgrades and authenticates a connection to the room in ?room=,
+// returning a client ready to register, or nil if it was refused
+func (h *Hub) acceptSession(w http.ResponseWriter, r *http.Request) *Client {
+	// Browsers don't apply CORS to WebSockets, so any page could otherwise
+	// open a session with its visitor's credentials
+	if !h.config.Origins.Check(r) {
+		log.Printf("🚫 Rejected connection from origin %s (%s)", r.Header.Get("Origin"), r.RemoteAddr)
+		apierror.Write(w, http.StatusForbidden, apierror.OriginNotAllowed, "Origin not allowed", nil)
+		return nil
+	}
+	if !offersSubprotocol(r) {
+		apierror.Write(w, http.StatusBadRequest, apierror.UnsupportedProtocol, "No supported subprotocol offered",
+			map[string][]string{"supported": subprotocols})
+		return nil
+	}
+
+	// A refused room ID is reported with a close frame after the upgrade,
+	// like an unsupported version below
+	roomID := r.URL.Query().Get("room")
+	roomErr := h.checkSessionRoom(r.Context(), roomID)
+	if roomErr == nil {
+		if h.redirectSession(w, r, roomID) {
+			return nil
+		}
+
+		if !h.checkRoomExists(r.Context(), roomID) {
+			log.Printf("Rejected connection to unknown room %s from %s", roomID, r.RemoteAddr)
+			apierror.Write(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found", nil)
+			return nil
+		}
+
+		// Workspace rooms need the identity token up front, since membership
+		// decides whether to upgrade at all
+		if !h.checkWorkspace(r.Context(), roomID, r.URL.Query().Get("token")) {
+			log.Printf("🔒 Rejected connection to workspace room %s from %s", roomID, r.RemoteAddr)
+			apierror.Write(w, http.StatusForbidden, apierror.RoomAccessDenied, "Workspace membership required", nil)
+			return nil
+		}
+	}
+
+	ip, ok := h.admitConnection(w, r)
+	if !ok {
+		return nil
+	}
+
+	session, supported := negotiate(r)
+	u := &upgrader
+	if session.Has(CapabilityCompression) {
+		u = &compressingUpgrader
+	}
+	conn, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Upgrade error:", err)
+		h.releaseConnection(ip)
+		return nil
+	}
+
+	// Refused after the upgrade, since browsers only show a WebSocket
+	// client the close code, not an HTTP error
+	if roomErr != nil {
+		log.Printf("Rejected connection to room %q from %s: %v", roomID, r.RemoteAddr, roomErr)
+		h.refuseUpgraded(conn, ip, closeCodeInvalidRoom, closeReason(roomErr))
+		return nil
+	}
+	if !supported {
+		log.Printf("Rejected connection speaking protocol version %q from %s", r.URL.Query().Get("v"), r.RemoteAddr)
+		h.refuseUpgraded(conn, ip, closeCodeUnsupportedVersion, unsupportedVersionReason())
+		return nil
+	}
+
+	// RemoteAddr is the client's own address when it came through a trusted
+	// proxy, which conn.RemoteAddr() is not
+	clientID := fmt.Sprintf("%s-%d", r.RemoteAddr, time.Now().UnixNano())
+
+	if !h.authenticate(r.Context(), conn, roomID, r.URL.Query().Get("secret"), r.RemoteAddr) {
+		conn.Close()
+		h.releaseConnection(ip)
+		return nil
+	}
+
+	client := newClient(h, conn, roomID, clientID)
+	client.remoteAddr = r.RemoteAddr
+	client.limitIP = ip
+	client.handshake = session
+	return client
+}
+
+// Closes a connection refused after its upgrade with the given close frame
+func (h *Hub) refuseUpgraded(conn *websocket.Conn, ip string, code int, reason string) {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+	conn.Close()
+	h.releaseConnection(ip)
+}
+
 func (c *Client) readPump() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -72,6 +587,7 @@ func (c *Client) readPump() {
 		}
 		c.hub.unregister <- c
 		c.conn.Close()
+		c.hub.releaseConnection(c.limitIP)
 	}()
 
 	c.conn.SetReadLimit(maxMessageSize)
@@ -92,11 +608,14 @@ func (c *Client) readPump() {
 			break
 		}
 
+		c.touch(len(message))
+
 		if !c.rateLimiter.Allow() {
 			rateLimitWarnings++
 			if rateLimitWarnings%100 == 1 {
 				log.Printf("⚠️ Rate limit exceeded for client %s in room %s (warning #%d)",
 					c.clientID, c.roomID, rateLimitWarnings)
+				c.warnRateLimited()
 			}
 			if rateLimitWarnings > 1000 {
 				log.Printf("🚫 Disconnecting client %s for excessive rate limit violations", c.clientID)
@@ -105,45 +624,109 @@ func (c *Client) readPump() {
 			continue
 		}
 
-		if err := validateYjsMessage(message); err != nil {
-			log.Printf("⚠️ Invalid message from client %s: %v", c.clientID, err)
-			continue
+		c.dispatch(message)
+	}
+}
+
+// Hands a message received from the client to the hub, whichever transport
+// it arrived on
+func (c *Client) dispatch(message []byte) {
+	if c.terminalRole != "" {
+		c.dispatchTerminal(message)
+		return
+	}
+
+	// Signals go to other members, not through the document relay
+	if len(message) > 0 && protocol.MessageType(message[0]) == protocol.MessageTypeSignal {
+		c.hub.relaySignal(c, message)
+		return
+	}
+
+	if err := validateYjsMessage(message); err != nil {
+		log.Printf("⚠️ Invalid message from client %s: %v", c.clientID, err)
+		return
+	}
+
+	// Secrets are only checked on connect and must never reach other clients
+	if protocol.MessageType(message[0]) == protocol.MessageTypeAuth {
+		if token, ok := parseIdentityMessage(message); ok {
+			c.identify(token)
 		}
+		return
+	}
 
-		c.hub.broadcast <- &Message{
-			RoomID: c.roomID,
-			Data:   message,
-			Sender: c,
+	if protocol.MessageType(message[0]) == protocol.MessageTypeRefill {
+		from, to, err := parseRefill(message)
+		if err != nil || !c.sequenced {
+			log.Printf("⚠️ Ignoring refill from client %s: sequencing not enabled or %v", c.clientID, err)
+			return
 		}
+		c.hub.refill <- &RefillRequest{Client: c, From: from, To: to}
+		return
+	}
+
+	// A document edit starts a trace that follows it through the fan-out
+	// to the write that persists it
+	msg := &Message{RoomID: c.roomID, Data: message, Sender: c}
+	if message[0] == MessageSync && protocol.IsDocumentUpdate(message) {
+		var span tracing.Span
+		msg.ctx, span = tracing.Start(context.Background(), "ws.receive", tracing.WithKind(tracing.KindServer), tracing.WithAttributes(
+			tracing.String("lattice.room_id", c.roomID),
+			tracing.String("lattice.client_id", c.clientID),
+			tracing.Int("messaging.message.body.size", len(message)),
+		))
+		defer span.End()
 	}
+	c.hub.broadcast <- msg
 }
 
+// Reports whether the client speaks a supported subprotocol, or offers none
+func offersSubprotocol(r *http.Request) bool {
+	offered := websocket.Subprotocols(r)
+	if len(offered) == 0 {
+		return true
+	}
+	for _, protocol := range offered {
+		for _, supported := range subprotocols {
+			if protocol == supported {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks that a message is one a client may send. Resume tokens, sequence
+// envelopes, errors, control frames and batches only travel from the
+// server, so a client sending one is refused rather than relayed.
 func validateYjsMessage(data []byte) error {
 	if len(data) == 0 {
 		return fmt.Errorf("empty message")
 	}
 
-	messageType := data[0]
+	messageType := protocol.MessageType(data[0])
 
 	switch messageType {
-	case MessageSync:
+	case protocol.MessageTypeSync:
 		if len(data) < 2 {
 			return fmt.Errorf("sync message too short")
 		}
-		syncType := data[1]
-		if syncType > 10 {
+		switch syncType := protocol.SyncStep(data[1]); syncType {
+		case protocol.SyncStep1, protocol.SyncStep2, protocol.SyncUpdate:
+			return nil
+		default:
 			return fmt.Errorf("invalid sync type: %d", syncType)
 		}
-		return nil
 
-	case MessageAwareness:
+	case protocol.MessageTypeAwareness, protocol.MessageTypeAuth, protocol.MessageTypeRefill:
 		return nil
 
+	case protocol.MessageTypeResume, protocol.MessageTypeSequenced, protocol.MessageTypeError,
+		protocol.MessageTypeControl, protocol.MessageTypeBatch:
+		return fmt.Errorf("server-only message type: %d", messageType)
+
 	default:
-		if messageType > 10 {
-			return fmt.Errorf("unknown message type: %d", messageType)
-		}
-		return nil
+		return fmt.Errorf("unknown message type: %d", messageType)
 	}
 }
 
@@ -160,20 +743,35 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.writeClose()
 				return
 			}
-
-			w, err := c.conn.NextWriter(websocket.BinaryMessage)
-			if err != nil {
+			if err := c.write(message); err != nil {
 				return
 			}
-			w.Write(message)
 
-			if err := w.Close(); err != nil {
-				return
+		case <-c.wake:
+			// Overflowed messages were queued after everything already in send
+			for drained := false; !drained; {
+				select {
+				case message, ok := <-c.send:
+					if !ok {
+						c.writeClose()
+						return
+					}
+					if err := c.write(message); err != nil {
+						return
+					}
+				default:
+					drained = true
+				}
+			}
+
+			for _, message := range c.takeOverflow() {
+				if err := c.write(message); err != nil {
+					return
+				}
 			}
 
 		case <-ticker.C:
@@ -184,3 +782,40 @@ func (c *Client) writePump() {
 		}
 	}
 }
+
+func (c *Client) write(message []byte) error {
+	start := time.Now()
+	c.conn.SetWriteDeadline(start.Add(writeWait))
+
+	w, err := c.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	w.Write(message)
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	c.messagesOut.Add(1)
+	c.bytesOut.Add(uint64(len(message)))
+	c.recordWrite(time.Since(start))
+	return nil
+}
+
+// Folds a write's duration into the moving average, weighting the newest
+// sample at 1/8. Only called from the session's writing goroutine.
+func (c *Client) recordWrite(d time.Duration) {
+	avg := c.writeNanos.Load()
+	if avg == 0 {
+		avg = int64(d)
+	} else {
+		avg += (int64(d) - avg) / 8
+	}
+	c.writeNanos.Store(avg)
+}
+
+func (c *Client) writeClose() {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
+}
@@ -0,0 +1,57 @@
+package ws
+
+import (
+	"log"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
+)
+
+// A compacted room's new snapshot, swapped into its in-memory history by
+// the Run goroutine so no update is sequenced while the history changes
+type compactedRoom struct {
+	roomID   string
+	snapshot []byte
+	covered  int
+	done     chan struct{}
+}
+
+// RoomCompacted replaces the updates a room's new snapshot stands for with
+// the snapshot's own, so memory holds the same history as the database. It
+// implements compaction.Listener and returns once the swap is done, or at
+// once if the room is not loaded or the hub has stopped.
+func (h *Hub) RoomCompacted(roomID string, snapshot []byte, covered int) {
+	req := &compactedRoom{roomID: roomID, snapshot: snapshot, covered: covered, done: make(chan struct{})}
+
+	select {
+	case h.compacted <- req:
+	case <-h.stop:
+		return
+	}
+
+	select {
+	case <-req.done:
+	case <-h.stop:
+	}
+}
+
+func (h *Hub) handleCompacted(req *compactedRoom) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("🔥 Panic in handleCompacted: %v", r)
+		}
+		close(req.done)
+	}()
+
+	h.mu.RLock()
+	roomState, ok := h.roomStates[req.roomID]
+	h.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	if !roomState.ReplaceWithSnapshot(compaction.SplitMergedUpdates(req.snapshot), req.covered) {
+		// The updates it stands for were already dropped from memory, or the
+		// history changed since; catch-up past memory reads the database
+		log.Printf("Snapshot of room %s covers %d updates not all held in memory; keeping them", req.roomID, req.covered)
+	}
+}
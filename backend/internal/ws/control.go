@@ -0,0 +1,152 @@
+package ws
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"time"
+
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// Control frame types
+const (
+	ControlHello       = "hello"
+	ControlRateLimited = "rate_limited"
+	ControlNotice      = "notice"
+	ControlLock        = "lock"
+	ControlShutdown    = "shutdown"
+	ControlTerminal    = "terminal"
+	ControlReadOnly    = "read_only"
+	ControlRedirect    = "redirect"
+)
+
+// HelloFrame is the first frame a session receives, before any document
+// state
+type HelloFrame struct {
+	Type     string        `json:"type"` // Always "hello"
+	RoomID   string        `json:"room_id"`
+	ClientID string        `json:"client_id"`
+	Protocol string        `json:"protocol"` // Subprotocol the session speaks
+	Seq      int           `json:"seq"`      // Updates in the room's history
+	Clients  int           `json:"clients"`  // Sessions in the room, including this one
+	Limits   SessionLimits `json:"limits"`
+
+	// The client's protocol version and the capabilities the server will
+	// use with it, out of those it asked for
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// SessionLimits are the limits the server enforces on a session
+type SessionLimits struct {
+	MaxMessageBytes    int     `json:"max_message_bytes"`
+	MessagesPerSecond  float64 `json:"messages_per_second"`
+	MessageBurst       int     `json:"message_burst"`
+	MaxRoomBytes       int64   `json:"max_room_bytes,omitempty"`       // Zero when unlimited
+	IdleTimeoutSeconds int     `json:"idle_timeout_seconds,omitempty"` // Zero when sessions never idle out
+}
+
+// NoticeFrame tells clients about something they may want to show or act
+// on: rate limiting, a room lock, an announcement or an imminent shutdown
+type NoticeFrame struct {
+	Type         string `json:"type"`
+	Code         string `json:"code,omitempty"`
+	Message      string `json:"message"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+}
+
+// Encodes a control frame as a MessageTypeControl message
+func controlMessage(frame interface{}) []byte {
+	body, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("Error encoding control frame: %v", err)
+		return nil
+	}
+	message := []byte{byte(protocol.MessageTypeControl)}
+	message = binary.AppendUvarint(message, uint64(len(body)))
+	return append(message, body...)
+}
+
+func (h *Hub) sessionLimits() SessionLimits {
+	return SessionLimits{
+		MaxMessageBytes:    maxMessageSize,
+		MessagesPerSecond:  messagesPerSecond,
+		MessageBurst:       messageBurst,
+		MaxRoomBytes:       h.config.MaxRoomBytes,
+		IdleTimeoutSeconds: int(h.config.IdleTimeout / time.Second),
+	}
+}
+
+func (h *Hub) helloMessage(client *Client, roomState *RoomState, clients int) []byte {
+	_, seq := roomState.Position()
+	return controlMessage(HelloFrame{
+		Type:     ControlHello,
+		RoomID:   client.roomID,
+		ClientID: client.clientID,
+		Protocol: Subprotocol,
+		Seq:      seq,
+		Clients:  clients,
+		Limits:   h.sessionLimits(),
+
+		Version:      client.handshake.Version,
+		Capabilities: client.handshake.Capabilities,
+	})
+}
+
+// Tells a client its messages are being dropped by the rate limiter
+func (c *Client) warnRateLimited() {
+	c.enqueueCatchUp(controlMessage(NoticeFrame{
+		Type:         ControlRateLimited,
+		Message:      "rate limit exceeded; messages are being dropped",
+		RetryAfterMs: int64(time.Second / messagesPerSecond / time.Millisecond),
+	}))
+}
+
+// Notify sends a notice to every session in a room, such as a lock
+// announcement. It reports how many sessions it was queued for.
+func (h *Hub) Notify(roomID string, notice NoticeFrame) int {
+	if notice.Type == "" {
+		notice.Type = ControlNotice
+	}
+	return h.SendControl(roomID, notice)
+}
+
+// SendControl sends a control frame to every session in a room. The frame
+// is encoded as JSON and should carry a "type" field clients can switch on.
+// It reports how many sessions it was queued for.
+func (h *Hub) SendControl(roomID string, frame interface{}) int {
+	message := controlMessage(frame)
+	if message == nil {
+		return 0
+	}
+
+	clients := h.roomClients(roomID)
+	for _, client := range clients {
+		client.enqueueCatchUp(message)
+	}
+	return len(clients)
+}
+
+// AnnounceShutdown tells every session the server is going away, so clients
+// can show it and wait before reconnecting rather than retrying at once
+func (h *Hub) AnnounceShutdown(message string, reconnectAfter time.Duration) {
+	h.mu.RLock()
+	roomIDs := make([]string, 0, len(h.rooms))
+	for roomID := range h.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	h.mu.RUnlock()
+
+	notified := 0
+	for _, roomID := range roomIDs {
+		notified += h.Notify(roomID, NoticeFrame{
+			Type:         ControlShutdown,
+			Message:      message,
+			RetryAfterMs: reconnectAfter.Milliseconds(),
+		})
+	}
+	if notified > 0 {
+		log.Printf("📣 Announced shutdown to %d sessions", notified)
+	}
+}
@@ -0,0 +1,90 @@
+package ws
+
+import "log"
+
+// Close sent to sessions in a room that was deleted; clients should not
+// reconnect automatically, as that would start a new, empty room
+const (
+	closeCodeRoomDeleted   = 4004
+	closeReasonRoomDeleted = "room deleted"
+)
+
+// A room deletion, carried out by the Run goroutine so no update for the
+// room is relayed or stored while its state is dropped
+type deleteRequest struct {
+	roomID string
+	closed chan int
+}
+
+// DeleteRoom disconnects every session in a room with the room deleted
+// close code and drops everything the hub holds for it: document state,
+// awareness, bans, terminals and updates not yet written. Call it before
+// deleting the room's rows, so buffered writes cannot create them again.
+// It returns the number of sessions closed.
+func (h *Hub) DeleteRoom(roomID string) (int, error) {
+	req := &deleteRequest{roomID: roomID, closed: make(chan int, 1)}
+
+	select {
+	case h.deletions <- req:
+	case <-h.stop:
+		return 0, ErrHubStopped
+	}
+
+	select {
+	case closed := <-req.closed:
+		return closed, nil
+	case <-h.stop:
+		return 0, ErrHubStopped
+	}
+}
+
+func (h *Hub) handleDelete(req *deleteRequest) {
+	roomID := req.roomID
+	closed := 0
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("🔥 Panic in handleDelete: %v", r)
+		}
+		req.closed <- closed
+	}()
+
+	h.mu.Lock()
+	clients := h.rooms[roomID]
+	for client := range clients {
+		client.closeSend(closeCodeRoomDeleted, closeReasonRoomDeleted)
+	}
+	delete(h.rooms, roomID)
+	delete(h.roomStates, roomID)
+	if len(clients) > 0 {
+		h.publishLeft(roomID, 0)
+	}
+	h.mu.Unlock()
+	closed = len(clients)
+
+	h.terminalMu.Lock()
+	if session, ok := h.terminals[roomID]; ok {
+		if session.host != nil {
+			session.host.closeSend(closeCodeRoomDeleted, closeReasonRoomDeleted)
+			closed++
+		}
+		for viewer := range session.viewers {
+			viewer.closeSend(closeCodeRoomDeleted, closeReasonRoomDeleted)
+			closed++
+		}
+		delete(h.terminals, roomID)
+	}
+	h.terminalMu.Unlock()
+
+	h.banMu.Lock()
+	delete(h.bans, roomID)
+	h.banMu.Unlock()
+
+	delete(h.sinceCompaction, roomID)
+
+	discarded := 0
+	if h.writer != nil {
+		discarded = h.writer.Discard(roomID)
+	}
+
+	log.Printf("🗑️ Room %s deleted: closed %d sessions, discarded %d buffered updates", roomID, closed, discarded)
+}
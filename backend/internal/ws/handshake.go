@@ -0,0 +1,128 @@
+package ws
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion is the newest wire format the server speaks. Clients
+// state the version they speak with ?v= on connect, so a later format can
+// change message framing without breaking editors already deployed.
+// Optional behaviour within a version is negotiated as capabilities.
+const ProtocolVersion = 1
+
+// Versions the server can speak, oldest first
+var protocolVersions = []int{1}
+
+// Capabilities a client may ask for with ?caps=, a comma-separated list
+const (
+	CapabilityBatch       = "batch"       // Coalesce updates into batch frames while the client is behind
+	CapabilityCompression = "compression" // Compress server messages with permessage-deflate
+	CapabilityResume      = "resume"      // Resume tokens, and catch-up from the one in ?resume=
+	CapabilitySequence    = "seq"         // Sequence-numbered updates and refills
+)
+
+// Capabilities the server supports, in the order hello frames list them
+var capabilityOrder = []string{CapabilityBatch, CapabilityCompression, CapabilityResume, CapabilitySequence}
+
+// Close sent when the client's protocol version is one the server can't
+// speak; reconnecting won't help until one side is upgraded
+const closeCodeUnsupportedVersion = 4010
+
+// Handshake is what a session agreed to use: the client's protocol version
+// and the capabilities it asked for that the server granted
+type Handshake struct {
+	Version      int
+	Capabilities []string
+}
+
+// Has reports whether the session was granted a capability
+func (s Handshake) Has(capability string) bool {
+	for _, c := range s.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the client's version and capabilities. Clients that state no
+// version predate the handshake: they speak version 1 with resume tokens,
+// plus batching and sequencing when ?batch=1 and ?seq=1 ask for them.
+// Unknown capabilities are left out, and compression is granted only on a
+// WebSocket whose client offered permessage-deflate. The second result is
+// false for a version the server can't speak.
+func negotiate(r *http.Request) (Handshake, bool) {
+	query := r.URL.Query()
+	version := 1
+	requested := make(map[string]bool)
+	if query.Has("v") {
+		var err error
+		if version, err = strconv.Atoi(query.Get("v")); err != nil || !supportsVersion(version) {
+			return Handshake{}, false
+		}
+		for _, capability := range strings.Split(query.Get("caps"), ",") {
+			requested[strings.TrimSpace(capability)] = true
+		}
+	} else {
+		requested[CapabilityResume] = true
+		requested[CapabilityBatch] = query.Get("batch") == "1"
+		requested[CapabilitySequence] = query.Get("seq") == "1"
+	}
+
+	session := Handshake{Version: version, Capabilities: []string{}}
+	for _, capability := range capabilityOrder {
+		if !requested[capability] {
+			continue
+		}
+		if capability == CapabilityCompression && !offersCompression(r) {
+			continue
+		}
+		session.Capabilities = append(session.Capabilities, capability)
+	}
+	return session, true
+}
+
+// What a session gets before the handshake is read, and what clients that
+// predate it always get
+func legacyHandshake() Handshake {
+	return Handshake{Version: 1, Capabilities: []string{CapabilityResume}}
+}
+
+func supportsVersion(version int) bool {
+	for _, v := range protocolVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a WebSocket upgrade offers per-message compression
+func offersCompression(r *http.Request) bool {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return false
+	}
+	for _, value := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reason sent with closeCodeUnsupportedVersion, naming the versions the
+// client could use instead
+func unsupportedVersionReason() string {
+	versions := make([]string, len(protocolVersions))
+	for i, v := range protocolVersions {
+		versions[i] = strconv.Itoa(v)
+	}
+	return "unsupported protocol version; supported: " + strings.Join(versions, ", ")
+}
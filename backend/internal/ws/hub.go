@@ -1,11 +1,21 @@
 package ws
 
 import (
+	"context"
+	"errors"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
 	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
 	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	"github.com/manpreetbhatti/lattice/backend/internal/events"
+	"github.com/manpreetbhatti/lattice/backend/internal/origin"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+	"github.com/manpreetbhatti/lattice/backend/internal/tracing"
 )
 
 // Message types for Yjs protocol
@@ -23,37 +33,187 @@ const (
 
 // Stores in-memory state for active rooms
 type RoomState struct {
-	Updates         [][]byte
-	AwarenessStates map[uint64][]byte
+	Updates         [][]byte          // The most recent updates; older ones may only be on disk
+	AwarenessStates map[uint64][]byte // Latest awareness message per Yjs client ID
 	ClientCount     int
 	mu              sync.RWMutex
+
+	// Clock of each stored awareness state, so stale updates are ignored,
+	// and the session that last published it
+	awarenessClocks map[uint64]uint64
+	awarenessOwners map[uint64]*Client
+
+	// Identifies this update history; changes whenever Updates is replaced so
+	// resume tokens issued against an older history are rejected
+	epoch uint64
+
+	// Total size of the history, checked against the room quota
+	bytes int64
+
+	// Leading updates dropped from memory to stay within maxResident bytes;
+	// Updates[0] has sequence number spilled+1. Zero maxResident keeps
+	// everything.
+	spilled       int
+	residentBytes int64
+	maxResident   int64
+
+	// Set once the room has been warned about nearing its quota
+	quotaWarned bool
+
+	// Quota from the room's workspace, replacing the hub's when positive
+	quotaOverride atomic.Int64
 }
 
 func NewRoomState() *RoomState {
 	return &RoomState{
 		Updates:         make([][]byte, 0),
 		AwarenessStates: make(map[uint64][]byte),
+		awarenessClocks: make(map[uint64]uint64),
+		awarenessOwners: make(map[uint64]*Client),
+		epoch:           newEpoch(),
 	}
 }
 
-func (r *RoomState) AddUpdate(update []byte) {
+// Stores an update and returns its sequence number (1-based) in the history
+func (r *RoomState) AddUpdate(update []byte) int {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	updateCopy := make([]byte, len(update))
 	copy(updateCopy, update)
 	r.Updates = append(r.Updates, updateCopy)
+	r.bytes += int64(len(update))
+	r.residentBytes += int64(len(update))
+	seq := r.spilled + len(r.Updates)
+	r.trimLocked()
+	return seq
+}
+
+// Drops the oldest updates until the rest fit in maxResident bytes, always
+// keeping the newest
+func (r *RoomState) trimLocked() {
+	if r.maxResident <= 0 {
+		return
+	}
+	for r.residentBytes > r.maxResident && len(r.Updates) > 1 {
+		r.residentBytes -= int64(len(r.Updates[0]))
+		r.Updates[0] = nil
+		r.Updates = r.Updates[1:]
+		r.spilled++
+	}
 }
 
+// Returns the total size of the room's history, including updates no longer
+// held in memory
+func (r *RoomState) Bytes() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.bytes
+}
+
+// Returns the size of the updates held in memory
+func (r *RoomState) ResidentBytes() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.residentBytes
+}
+
+// Returns the updates with sequence numbers from..to inclusive, clipped to
+// the part of the history held in memory, and the sequence number of the
+// first one returned
+func (r *RoomState) UpdateRange(from, to int) ([][]byte, int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if from <= r.spilled {
+		from = r.spilled + 1
+	}
+	if to > r.spilled+len(r.Updates) {
+		to = r.spilled + len(r.Updates)
+	}
+	if from > to {
+		return nil, from
+	}
+	return r.Updates[from-1-r.spilled : to-r.spilled], from
+}
+
+// Returns the updates held in memory
 func (r *RoomState) GetUpdates() [][]byte {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	return r.Updates
 }
 
+// Returns the updates held in memory and whether they are the whole history
+func (r *RoomState) ResidentUpdates() ([][]byte, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Updates, r.spilled == 0
+}
+
 func (r *RoomState) SetUpdates(updates [][]byte) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.Updates = updates
+	r.epoch = newEpoch()
+	r.bytes = 0
+	for _, update := range updates {
+		r.bytes += int64(len(update))
+	}
+	r.spilled = 0
+	r.residentBytes = r.bytes
+	r.trimLocked()
+}
+
+// Replaces the first covered updates of the history with the updates of a
+// snapshot standing for them. When the snapshot holds as many updates,
+// sequence numbers keep their meaning; otherwise the history starts a new
+// epoch so resume tokens issued against the old one are rejected. Reports
+// false, changing nothing, when covered updates are not all in memory or
+// more than the history holds.
+func (r *RoomState) ReplaceWithSnapshot(snapshot [][]byte, covered int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if covered < r.spilled || covered > r.spilled+len(r.Updates) {
+		return false
+	}
+
+	rest := r.Updates[covered-r.spilled:]
+	updates := make([][]byte, 0, len(snapshot)+len(rest))
+	updates = append(updates, snapshot...)
+	updates = append(updates, rest...)
+
+	if len(snapshot) != covered {
+		r.epoch = newEpoch()
+	}
+	r.Updates = updates
+	r.bytes = 0
+	for _, update := range updates {
+		r.bytes += int64(len(update))
+	}
+	r.spilled = 0
+	r.residentBytes = r.bytes
+	r.trimLocked()
+	return true
+}
+
+// Returns the history epoch and the number of updates in it
+func (r *RoomState) Position() (uint64, int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.epoch, r.spilled + len(r.Updates)
+}
+
+// Returns the updates after seq if seq belongs to the current epoch and
+// everything after it is still held in memory
+func (r *RoomState) UpdatesSince(epoch uint64, seq int) ([][]byte, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if epoch != r.epoch || seq < r.spilled || seq > r.spilled+len(r.Updates) {
+		return nil, false
+	}
+	return r.Updates[seq-r.spilled:], true
 }
 
 func (r *RoomState) GetAllAwareness() [][]byte {
@@ -73,26 +233,287 @@ type Hub struct {
 	broadcast  chan *Message
 	register   chan *Client
 	unregister chan *Client
+	refill     chan *RefillRequest
+	apply      chan *applyRequest
+	deletions  chan *deleteRequest
+	compacted  chan *compactedRoom
 	stop       chan struct{}
+	done       chan struct{} // Closed when Run returns
 	database   *db.Database
+	writer     *db.UpdateWriter
+	config     HubConfig
 	mu         sync.RWMutex
+
+	// Slots for stored-history streams, each of which holds a database
+	// connection until its client has taken the history
+	historyStreams chan struct{}
+
+	// Whether Run has started, so Stop knows to wait for it to drain the
+	// broadcast queue. Guards closing stop.
+	running bool
+	runMu   sync.Mutex
+
+	// SSE fallback sessions by ID, so posts can find their client
+	sseSessions map[string]*Client
+	sseMu       sync.Mutex
+
+	// Shared terminals by room
+	terminals  map[string]*terminalSession
+	terminalMu sync.Mutex
+
+	// Updates stored per room since compaction was last requested; only
+	// touched by the Run goroutine
+	compactor       CompactionNotifier
+	sinceCompaction map[string]int
+
+	identities IdentityVerifier
+	ipLimits   *ipLimiter
+	events     EventPublisher
+	router     RoomRouter
+
+	// Active bans by room, then by "scope:value"
+	bans  map[string]map[string]time.Time
+	banMu sync.Mutex
+
+	// Read-only rooms and when their lock expires; see LockRoom
+	lockRequests chan *lockRequest
+	locks        map[string]time.Time
+	lockMu       sync.Mutex
+
+	droppedClients     atomic.Uint64
+	overflowedMessages atomic.Uint64
+	coalescedMessages  atomic.Uint64
+	evictedClients     atomic.Uint64
+	quotaRejections    atomic.Uint64
+
+	// Messages received from clients, for usage statistics, in total and
+	// per room until the room is next reported on after it empties
+	messagesRelayed atomic.Uint64
+	roomMessages    map[string]uint64
+	roomMessagesMu  sync.Mutex
+}
+
+// SendStats counts backpressure events on client send queues
+type SendStats struct {
+	DroppedClients     uint64 `json:"dropped_clients"`
+	OverflowedMessages uint64 `json:"overflowed_messages"`
+	CoalescedMessages  uint64 `json:"coalesced_messages"`
+	EvictedClients     uint64 `json:"evicted_idle_clients"`
+	QuotaRejections    uint64 `json:"quota_rejections"`
 }
 
 type Message struct {
 	RoomID string
 	Data   []byte
 	Sender *Client
+
+	ctx context.Context // Trace of the edit, when the message is one
+}
+
+// Updates submitted outside a WebSocket session, applied by the Run goroutine
+type applyRequest struct {
+	roomID string
+	frames [][]byte
+	result chan applyResult
+}
+
+type applyResult struct {
+	seqs []int
+	err  error
+}
+
+// ErrHubStopped is returned when work is submitted to a hub that has stopped
+var ErrHubStopped = errors.New("hub stopped")
+
+// CompactionNotifier is told when a room has stored enough updates to be
+// worth compacting
+type CompactionNotifier interface {
+	Notify(roomID string)
+	UpdateThreshold() int
+}
+
+// EventPublisher hears when rooms open and close and sessions join and
+// leave; an *events.Broker. Publish must not block.
+type EventPublisher interface {
+	Publish(eventType, roomID string, data interface{})
+}
+
+// IdentityVerifier checks signed identity tokens presented by clients
+type IdentityVerifier interface {
+	Verify(token string) (*auth.Identity, error)
+}
+
+// HubConfig holds tunables for a Hub
+type HubConfig struct {
+	WriteBehind db.WriteBehindConfig
+
+	// Sessions that send nothing for this long are closed even if the TCP
+	// connection still answers pings; zero disables eviction
+	IdleTimeout time.Duration
+
+	// Cumulative update bytes a room may hold; zero disables the limit
+	MaxRoomBytes int64
+
+	// Update bytes a room keeps in memory. Older updates are dropped and
+	// catch-up that needs them is streamed from the database instead. Zero,
+	// or running without a database, keeps every update in memory.
+	MaxResidentBytes int64
+
+	// Refuse sessions for rooms that do not exist yet instead of creating
+	// them on first edit. Has no effect without a database.
+	StrictRooms bool
+
+	RoomIDs RoomIDConfig
+
+	// Browser origins that may open sessions, the same list CORS allows;
+	// nil allows any. Clients that send no Origin are not browsers and are
+	// always allowed.
+	Origins *origin.Allowlist
+
+	ConnectionLimits ConnectionLimitConfig
+
+	// How long Stop waits for queued broadcasts to be relayed and stored
+	// before flushing; messages still queued after it are lost. Zero waits
+	// until the queue is empty.
+	StopTimeout time.Duration
 }
 
+func DefaultHubConfig() HubConfig {
+	return HubConfig{
+		WriteBehind:  db.DefaultWriteBehindConfig(),
+		IdleTimeout:  30 * time.Minute,
+		MaxRoomBytes: 64 << 20,
+
+		MaxResidentBytes: 16 << 20,
+
+		RoomIDs:          DefaultRoomIDConfig(),
+		ConnectionLimits: DefaultConnectionLimitConfig(),
+		StopTimeout:      5 * time.Second,
+	}
+}
+
+// Close sent to sessions evicted for inactivity
+const closeReasonIdle = "idle timeout"
+
+// Close sent to sessions removed through the admin API
+const closeReasonKicked = "removed by an administrator"
+
 func NewHub(database *db.Database) *Hub {
-	return &Hub{
-		rooms:      make(map[string]map[*Client]bool),
-		roomStates: make(map[string]*RoomState),
-		broadcast:  make(chan *Message, 256),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		stop:       make(chan struct{}),
-		database:   database,
+	return NewHubWithConfig(database, DefaultHubConfig())
+}
+
+func NewHubWithConfig(database *db.Database, config HubConfig) *Hub {
+	h := &Hub{
+		rooms:          make(map[string]map[*Client]bool),
+		roomStates:     make(map[string]*RoomState),
+		broadcast:      make(chan *Message, 256),
+		register:       make(chan *Client),
+		unregister:     make(chan *Client),
+		refill:         make(chan *RefillRequest, 64),
+		apply:          make(chan *applyRequest),
+		deletions:      make(chan *deleteRequest),
+		compacted:      make(chan *compactedRoom),
+		lockRequests:   make(chan *lockRequest),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+		database:       database,
+		historyStreams: make(chan struct{}, maxHistoryStreams),
+		config:         config,
+
+		sinceCompaction: make(map[string]int),
+		sseSessions:     make(map[string]*Client),
+		terminals:       make(map[string]*terminalSession),
+		bans:            make(map[string]map[string]time.Time),
+		locks:           make(map[string]time.Time),
+		roomMessages:    make(map[string]uint64),
+		ipLimits:        newIPLimiter(config.ConnectionLimits),
+	}
+
+	if database != nil {
+		h.writer = db.NewUpdateWriter(database, config.WriteBehind)
+	}
+
+	return h
+}
+
+// SetCompactionNotifier makes the hub request compaction of rooms that cross
+// the notifier's update threshold. Must be called before Run.
+func (h *Hub) SetCompactionNotifier(notifier CompactionNotifier) {
+	h.compactor = notifier
+}
+
+// SetIdentityVerifier enables signed identities via ?token= or auth messages.
+// Must be called before Run.
+func (h *Hub) SetIdentityVerifier(verifier IdentityVerifier) {
+	h.identities = verifier
+}
+
+// SetEventPublisher reports rooms opening and closing to publisher. Must be
+// called before Run.
+func (h *Hub) SetEventPublisher(publisher EventPublisher) {
+	h.events = publisher
+}
+
+func (h *Hub) publish(eventType, roomID string, data interface{}) {
+	if h.events != nil {
+		h.events.Publish(eventType, roomID, data)
+	}
+}
+
+// Publishes a session leaving a room, and the room closing if it was the
+// last. Called with h.mu held after the client is removed.
+func (h *Hub) publishLeft(roomID string, remaining int) {
+	h.publish(events.RoomLeft, roomID, events.Occupancy{Users: remaining})
+	if remaining == 0 {
+		h.publish(events.RoomClosed, roomID, nil)
+	}
+}
+
+func (h *Hub) countForCompaction(roomID string) {
+	if h.compactor == nil {
+		return
+	}
+
+	h.sinceCompaction[roomID]++
+	if h.sinceCompaction[roomID] < h.compactor.UpdateThreshold() {
+		return
+	}
+	h.sinceCompaction[roomID] = 0
+	if h.writer == nil {
+		h.compactor.Notify(roomID)
+		return
+	}
+
+	// The compactor counts the room's stored updates, so the buffered ones
+	// are written first; off the hub goroutine, since a flush waits on the
+	// database
+	go func() {
+		if err := h.writer.Flush(); err != nil {
+			log.Printf("Error flushing updates before compaction of room %s: %v", roomID, err)
+		}
+		h.compactor.Notify(roomID)
+	}()
+}
+
+// Quarantines corrupted blobs of a room that isn't loaded, so they are never
+// served to clients. It reads every blob of the room, so it runs on the
+// goroutine about to hand the room to the hub rather than in the Run loop
+// or under h.mu; loaded rooms were checked before they loaded.
+func (h *Hub) verifyRoom(roomID string) {
+	if h.database == nil {
+		return
+	}
+	h.mu.RLock()
+	_, loaded := h.roomStates[roomID]
+	h.mu.RUnlock()
+	if loaded {
+		return
+	}
+
+	if report, err := h.database.VerifyRoom(context.Background(), roomID); err != nil {
+		log.Printf("Error verifying stored updates for room %s: %v", roomID, err)
+	} else if report.Affected() {
+		log.Printf("⚠️ Quarantined %d corrupted blobs in room %s", len(report.Quarantined), roomID)
 	}
 }
 
@@ -108,7 +529,18 @@ func (h *Hub) getRoomState(roomID string) *RoomState {
 	h.roomStates[roomID] = roomState
 
 	if h.database != nil {
-		snapshot, snapshotCount, err := h.database.GetSnapshot(roomID)
+		roomState.maxResident = h.config.MaxResidentBytes
+		// Loading is shared by every client of the room, so it is not tied to
+		// any one request
+		ctx := context.Background()
+
+		if workspace, err := h.database.RoomWorkspace(ctx, roomID); err != nil {
+			log.Printf("Error loading workspace of room %s: %v", roomID, err)
+		} else if workspace != nil {
+			roomState.quotaOverride.Store(workspace.MaxRoomBytes)
+		}
+
+		snapshot, snapshotCount, err := h.database.GetSnapshot(ctx, roomID)
 		if err != nil {
 			log.Printf("Error loading snapshot for room %s: %v", roomID, err)
 		}
@@ -116,12 +548,15 @@ func (h *Hub) getRoomState(roomID string) *RoomState {
 		var allUpdates [][]byte
 
 		if len(snapshot) > 0 {
-			snapshotUpdates := compaction.SplitMergedUpdates(snapshot)
+			snapshotUpdates, err := compaction.DecodeSnapshot(snapshot)
+			if err != nil {
+				log.Printf("Error reading snapshot for room %s: %v", roomID, err)
+			}
 			allUpdates = append(allUpdates, snapshotUpdates...)
 			log.Printf("Loaded snapshot with %d updates for room %s", len(snapshotUpdates), roomID)
 		}
 
-		updates, err := h.database.GetAllUpdates(roomID)
+		updates, err := h.database.GetAllUpdates(ctx, roomID)
 		if err != nil {
 			log.Printf("Error loading updates for room %s: %v", roomID, err)
 		} else if len(updates) > 0 {
@@ -137,90 +572,284 @@ func (h *Hub) getRoomState(roomID string) *RoomState {
 	return roomState
 }
 
-func (h *Hub) handleBroadcast(message *Message) {
+// Relays a message to the room and returns its sequence number when it was
+// stored as a document update, or zero otherwise
+func (h *Hub) handleBroadcast(message *Message) int {
+	// Messages still queued from a session that has since been closed are
+	// dropped, so a deleted room is not recreated by its last edits
+	if message.Sender != nil && message.Sender.isClosed() {
+		return 0
+	}
+	h.countMessage(message.RoomID)
+
+	ctx := message.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracing.Start(ctx, "hub.broadcast", tracing.ChildOnly(),
+		tracing.WithAttributes(tracing.String("lattice.room_id", message.RoomID)))
+	defer span.End()
+
+	var roomState *RoomState
+	var sequenced []byte
+	seq := 0
+	isUpdate := false
 	if len(message.Data) > 0 {
 		messageType := message.Data[0]
-		roomState := h.getRoomState(message.RoomID)
+		roomState = h.getRoomState(message.RoomID)
 
-		if messageType == MessageSync {
-			roomState.AddUpdate(message.Data)
+		// Only deltas are kept; handshake traffic is relayed but not stored
+		if messageType == MessageSync && protocol.IsDocumentUpdate(message.Data) {
+			if h.rejectLocked(message.RoomID, message.Sender) {
+				span.SetAttributes(tracing.Bool("lattice.rejected", true))
+				return 0
+			}
+			if !h.admitUpdate(message.RoomID, roomState, len(message.Data), message.Sender) {
+				span.SetAttributes(tracing.Bool("lattice.rejected", true))
+				return 0
+			}
 
-			if h.database != nil {
-				if err := h.database.SaveUpdate(message.RoomID, message.Data); err != nil {
-					log.Printf("Error persisting update: %v", err)
+			isUpdate = true
+			seq = roomState.AddUpdate(message.Data)
+			sequenced = sequencedFrame(seq, message.Data)
+
+			if h.writer != nil {
+				h.writer.Enqueue(ctx, message.RoomID, message.Data, message.Sender.author())
+			}
+			h.countForCompaction(message.RoomID)
+		}
+
+		if messageType == MessageAwareness {
+			if message.Sender != nil {
+				if identity := message.Sender.getIdentity(); identity != nil {
+					message.Data = stampAwareness(message.Data, identity)
 				}
 			}
+			h.trackAwareness(roomState, message)
+		}
+	}
+
+	// Broadcast to other clients. The room's map is only read under h.mu,
+	// since kicks, idle eviction and SSE sessions change it from other
+	// goroutines, so the fan-out works on a copy and disconnects clients
+	// that overflowed once it is done.
+	var slow []*Client
+	recipients := 0
+	for _, client := range h.roomClients(message.RoomID) {
+		if client != message.Sender {
+			recipients++
+			data := message.Data
+			if client.sequenced && sequenced != nil {
+				data = sequenced
+			}
+
+			switch client.enqueue(data, message.Sender) {
+			case enqueueOverflowed:
+				h.overflowedMessages.Add(1)
+			case enqueueCoalesced:
+				h.coalescedMessages.Add(1)
+			case enqueueRejected:
+				slow = append(slow, client)
+				continue
+			}
+		}
+
+		// The sender's own update is part of the history its token covers
+		if isUpdate && client.handshake.Has(CapabilityResume) && client.countForResume() {
+			client.enqueueCatchUp(resumeTokenMessage(message.RoomID, roomState))
 		}
 	}
 
-	// Broadcast to other clients
+	for _, client := range slow {
+		h.dropSlowClient(client)
+	}
+
+	span.SetAttributes(
+		tracing.Int("lattice.seq", seq),
+		tracing.Int("lattice.recipients", recipients),
+		tracing.Int("lattice.slow_clients", len(slow)),
+	)
+	return seq
+}
+
+// Returns the clients registered in a room, copied so callers can send to
+// them without holding h.mu
+func (h *Hub) roomClients(roomID string) []*Client {
 	h.mu.RLock()
-	clients, ok := h.rooms[message.RoomID]
-	h.mu.RUnlock()
+	defer h.mu.RUnlock()
+
+	clients := make([]*Client, 0, len(h.rooms[roomID]))
+	for client := range h.rooms[roomID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Disconnects a client whose overflow queue is full, telling it why so it can
+// reconnect and resync instead of silently missing updates
+func (h *Hub) dropSlowClient(client *Client) {
+	if h.disconnect(client, closeCodeSlowClient, closeReasonSlowClient) {
+		h.droppedClients.Add(1)
+		log.Printf("⚠️ Dropped slow client %s in room %s (send buffer overflow)", client.clientID, client.roomID)
+	}
+}
 
-	if !ok {
+// Removes a client from its room and closes its send queue so writePump
+// sends the given close frame. Returns false if the client was already gone.
+func (h *Hub) disconnect(client *Client, code int, reason string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	clients, ok := h.rooms[client.roomID]
+	if !ok || !clients[client] {
+		return false
+	}
+
+	client.closeSend(code, reason)
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(h.rooms, client.roomID)
+	}
+	h.publishLeft(client.roomID, len(clients))
+	return true
+}
+
+// Closes sessions that have been silent longer than the idle timeout
+func (h *Hub) evictIdle() {
+	if h.config.IdleTimeout <= 0 {
 		return
 	}
 
-	for client := range clients {
-		if client != message.Sender {
-			select {
-			case client.send <- message.Data:
-			default:
-				h.mu.Lock()
-				close(client.send)
-				delete(clients, client)
-				h.mu.Unlock()
+	cutoff := time.Now().Add(-h.config.IdleTimeout)
+
+	h.mu.RLock()
+	var idle []*Client
+	for _, clients := range h.rooms {
+		for client := range clients {
+			if client.lastActive().Before(cutoff) {
+				idle = append(idle, client)
 			}
 		}
 	}
+	h.mu.RUnlock()
+
+	for _, client := range idle {
+		if h.disconnect(client, websocket.CloseGoingAway, closeReasonIdle) {
+			h.evictedClients.Add(1)
+			log.Printf("Evicted idle client %s in room %s", client.clientID, client.roomID)
+		}
+	}
 }
 
 func (h *Hub) handleRegister(client *Client) {
+	if h.isBanned(client) {
+		h.refuseBanned(client)
+		return
+	}
+	if client.terminalRole != "" {
+		h.joinTerminal(client)
+		return
+	}
+
 	h.mu.Lock()
 	if _, ok := h.rooms[client.roomID]; !ok {
 		h.rooms[client.roomID] = make(map[*Client]bool)
+		h.publish(events.RoomOpened, client.roomID, nil)
 	}
 	h.rooms[client.roomID][client] = true
 	clientCount := len(h.rooms[client.roomID])
+	h.publish(events.RoomJoined, client.roomID, events.Occupancy{Users: clientCount})
 	h.mu.Unlock()
 
-	log.Printf("Client joined room %s (total: %d)", client.roomID, clientCount)
+	if identity := client.getIdentity(); identity != nil {
+		log.Printf("Client joined room %s as %s (%s) (total: %d)", client.roomID, identity.Name, identity.ID, clientCount)
+	} else {
+		log.Printf("Client joined room %s (total: %d)", client.roomID, clientCount)
+	}
 
 	roomState := h.getRoomState(client.roomID)
-	updates := roomState.GetUpdates()
+	client.enqueueCatchUp(h.helloMessage(client, roomState, clientCount))
+
+	updates, complete := roomState.ResidentUpdates()
+	firstSeq := 1
+
+	if client.resume != nil {
+		if missed, ok := roomState.UpdatesSince(client.resume.Epoch, client.resume.Seq); ok {
+			log.Printf("Resuming client in room %s: %d missed updates instead of %d", client.roomID, len(missed), len(updates))
+			updates = missed
+			firstSeq = client.resume.Seq + 1
+			complete = true
+		} else {
+			log.Printf("Cannot resume client in room %s from its token, sending full state", client.roomID)
+		}
+	}
 
-	if len(updates) > 0 {
+	var token []byte
+	if client.handshake.Has(CapabilityResume) {
+		token = resumeTokenMessage(client.roomID, roomState)
+	}
+
+	if !complete {
+		// The token goes out after the stored history instead
+		client.catchingUp.Store(true)
+		go h.sendStoredHistory(client, token)
+		token = nil
+	} else if len(updates) > 0 {
 		log.Printf("Sending %d updates to new client in room %s", len(updates), client.roomID)
-		for _, update := range updates {
-			select {
-			case client.send <- update:
-			default:
-				log.Printf("Failed to send catch-up update")
+		for i, update := range updates {
+			if client.sequenced {
+				update = sequencedFrame(firstSeq+i, update)
 			}
+			client.enqueueCatchUp(update)
 		}
 	}
 
 	// Send awareness states
 	for _, state := range roomState.GetAllAwareness() {
-		select {
-		case client.send <- state:
-		default:
-		}
+		client.enqueueCatchUp(state)
+	}
+
+	if token != nil {
+		client.enqueueCatchUp(token)
 	}
 }
 
 func (h *Hub) Run() {
+	h.runMu.Lock()
+	select {
+	case <-h.stop:
+		h.runMu.Unlock()
+		return
+	default:
+	}
+	h.running = true
+	h.runMu.Unlock()
+
+	defer close(h.done)
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("🔥 Panic in Hub.Run: %v", r)
 		}
 	}()
 
+	var idleTick <-chan time.Time
+	if h.config.IdleTimeout > 0 {
+		interval := h.config.IdleTimeout / 2
+		if interval > time.Minute {
+			interval = time.Minute
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		idleTick = ticker.C
+	}
+
 	for {
 		select {
 		case <-h.stop:
+			h.drainBroadcasts()
 			return
+		case <-idleTick:
+			h.evictIdle()
 		case client := <-h.register:
 			func() {
 				defer func() {
@@ -240,31 +869,185 @@ func (h *Hub) Run() {
 				h.handleUnregister(client)
 			}()
 		case message := <-h.broadcast:
-			func() {
-				defer func() {
-					if r := recover(); r != nil {
-						log.Printf("🔥 Panic in handleBroadcast: %v", r)
-					}
-				}()
-				h.handleBroadcast(message)
-			}()
+			h.safeBroadcast(message)
+		case req := <-h.refill:
+			h.handleRefill(req)
+		case req := <-h.apply:
+			h.handleApply(req)
+		case req := <-h.deletions:
+			h.handleDelete(req)
+		case req := <-h.compacted:
+			h.handleCompacted(req)
+		case req := <-h.lockRequests:
+			h.handleLock(req)
+		}
+	}
+}
+
+func (h *Hub) safeBroadcast(message *Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("🔥 Panic in handleBroadcast: %v", r)
+		}
+	}()
+	h.handleBroadcast(message)
+}
+
+// Relays the messages left in the broadcast queue when the hub stops, so
+// document updates already accepted are stored, giving up after StopTimeout
+func (h *Hub) drainBroadcasts() {
+	var deadline <-chan time.Time
+	if h.config.StopTimeout > 0 {
+		timer := time.NewTimer(h.config.StopTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	drained := 0
+	for {
+		select {
+		case message := <-h.broadcast:
+			h.safeBroadcast(message)
+			drained++
+		case <-deadline:
+			log.Printf("⚠️ Hub stop timed out after relaying %d queued messages; %d left unsent", drained, len(h.broadcast))
+			return
+		default:
+			if drained > 0 {
+				log.Printf("Relayed %d queued messages before stopping", drained)
+			}
+			return
+		}
+	}
+}
+
+// BroadcastToRoom relays a message to every session in a room from outside
+// a WebSocket session, as the Run goroutine would relay a client's message:
+// document updates are sequenced and stored, awareness is tracked. Unlike
+// ApplyUpdates it does not wait for the message to be handled.
+func (h *Hub) BroadcastToRoom(roomID string, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	// The queue is buffered, so a stopped hub could still accept a message
+	// it will never handle
+	select {
+	case <-h.stop:
+		return ErrHubStopped
+	default:
+	}
+
+	h.verifyRoom(roomID)
+	select {
+	case h.broadcast <- &Message{RoomID: roomID, Data: data}:
+		return nil
+	case <-h.stop:
+		return ErrHubStopped
+	}
+}
+
+// ApplyUpdates relays sync frames to a room as if a client had sent them,
+// storing and persisting the document updates. It returns the sequence number
+// assigned to each frame, zero for frames that were not stored. A batch that
+// would take the room over its quota is rejected whole with
+// ErrRoomQuotaExceeded, and one for a locked room with ErrRoomLocked.
+func (h *Hub) ApplyUpdates(roomID string, frames [][]byte) ([]int, error) {
+	req := &applyRequest{roomID: roomID, frames: frames, result: make(chan applyResult, 1)}
+
+	h.verifyRoom(roomID)
+	select {
+	case h.apply <- req:
+	case <-h.stop:
+		return nil, ErrHubStopped
+	}
+
+	select {
+	case result := <-req.result:
+		return result.seqs, result.err
+	case <-h.stop:
+		return nil, ErrHubStopped
+	}
+}
+
+func (h *Hub) handleApply(req *applyRequest) {
+	result := applyResult{seqs: make([]int, len(req.frames))}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("🔥 Panic in handleApply: %v", r)
 		}
+		req.result <- result
+	}()
+
+	if h.roomLocked(req.roomID) {
+		result.err = ErrRoomLocked
+		return
+	}
+
+	roomState := h.getRoomState(req.roomID)
+	if limit := h.roomQuota(roomState); limit > 0 {
+		total := int64(0)
+		for _, frame := range req.frames {
+			total += int64(len(frame))
+		}
+		if roomState.Bytes()+total > limit {
+			h.quotaRejections.Add(1)
+			result.err = ErrRoomQuotaExceeded
+			return
+		}
+	}
+
+	for i, frame := range req.frames {
+		result.seqs[i] = h.handleBroadcast(&Message{RoomID: req.roomID, Data: frame})
 	}
 }
 
+// Stop halts the hub and flushes buffered updates to the database. Messages
+// already queued for broadcast are relayed and stored first, waiting up to
+// StopTimeout for the Run goroutine to finish them.
 func (h *Hub) Stop() {
+	h.runMu.Lock()
 	close(h.stop)
+	running := h.running
+	h.runMu.Unlock()
+	h.ipLimits.stop()
+
+	if running {
+		// The drain itself gives up at StopTimeout; this only guards
+		// against a message handler that never returns
+		var timeout <-chan time.Time
+		if h.config.StopTimeout > 0 {
+			timer := time.NewTimer(2 * h.config.StopTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-h.done:
+		case <-timeout:
+			log.Println("⚠️ Hub did not stop in time; flushing what was stored")
+		}
+	}
+
+	if h.writer != nil {
+		if err := h.writer.Close(); err != nil {
+			log.Printf("Error flushing updates on shutdown: %v", err)
+		}
+	}
 }
 
 func (h *Hub) handleUnregister(client *Client) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	if client.terminalRole != "" {
+		h.leaveTerminal(client, 0, "")
+		return
+	}
 
+	h.mu.Lock()
 	if clients, ok := h.rooms[client.roomID]; ok {
 		if _, ok := clients[client]; ok {
 			delete(clients, client)
-			close(client.send)
+			client.closeSend(0, "")
 
+			h.publishLeft(client.roomID, len(clients))
 			if len(clients) == 0 {
 				delete(h.rooms, client.roomID)
 				log.Printf("Room %s closed (empty)", client.roomID)
@@ -273,6 +1056,10 @@ func (h *Hub) handleUnregister(client *Client) {
 			}
 		}
 	}
+	h.mu.Unlock()
+
+	h.releaseAwareness(client)
+	h.releaseHuddle(client)
 }
 
 func (h *Hub) GetRoomCount() int {
@@ -293,6 +1080,135 @@ func (h *Hub) GetClientCount() int {
 	return count
 }
 
+func (h *Hub) GetSendStats() SendStats {
+	return SendStats{
+		DroppedClients:     h.droppedClients.Load(),
+		OverflowedMessages: h.overflowedMessages.Load(),
+		CoalescedMessages:  h.coalescedMessages.Load(),
+		EvictedClients:     h.evictedClients.Load(),
+		QuotaRejections:    h.quotaRejections.Load(),
+	}
+}
+
+// GetWriteBehindStats reports buffered and persisted update counts; zero
+// without a database
+func (h *Hub) GetWriteBehindStats() db.WriteBehindStats {
+	if h.writer == nil {
+		return db.WriteBehindStats{}
+	}
+	return h.writer.Stats()
+}
+
+// MessageCount returns the number of messages relayed since the hub started
+func (h *Hub) MessageCount() uint64 {
+	return h.messagesRelayed.Load()
+}
+
+func (h *Hub) countMessage(roomID string) {
+	h.messagesRelayed.Add(1)
+	h.roomMessagesMu.Lock()
+	h.roomMessages[roomID]++
+	h.roomMessagesMu.Unlock()
+}
+
+// RoomActivity is a snapshot of an open room's load
+type RoomActivity struct {
+	Clients  int
+	Messages uint64 // Relayed since the room was last opened
+}
+
+// GetRoomActivity returns the load of every open room. Message counts of
+// rooms that have closed are forgotten, so a reopened room counts from zero.
+func (h *Hub) GetRoomActivity() map[string]RoomActivity {
+	h.mu.RLock()
+	result := make(map[string]RoomActivity, len(h.rooms))
+	for roomID, clients := range h.rooms {
+		result[roomID] = RoomActivity{Clients: len(clients)}
+	}
+	h.mu.RUnlock()
+
+	h.roomMessagesMu.Lock()
+	defer h.roomMessagesMu.Unlock()
+	for roomID, count := range h.roomMessages {
+		activity, ok := result[roomID]
+		if !ok {
+			delete(h.roomMessages, roomID)
+			continue
+		}
+		activity.Messages = count
+		result[roomID] = activity
+	}
+	return result
+}
+
+// GetConnections returns session statistics for every connected client
+func (h *Hub) GetConnections() []ConnectionInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	now := time.Now()
+	result := make([]ConnectionInfo, 0)
+	for _, clients := range h.rooms {
+		for client := range clients {
+			result = append(result, client.info(now))
+		}
+	}
+	return result
+}
+
+// Kick disconnects a client from a room with the kicked close code. With a
+// ban duration, the client's IP or user is also refused re-registration for
+// that long; the ban is returned.
+func (h *Hub) Kick(roomID, clientID string, opts KickOptions) (*Ban, error) {
+	h.mu.RLock()
+	var target *Client
+	for client := range h.rooms[roomID] {
+		if client.clientID == clientID {
+			target = client
+			break
+		}
+	}
+	h.mu.RUnlock()
+
+	if target == nil {
+		return nil, ErrClientNotFound
+	}
+
+	var ban *Ban
+	if opts.BanDuration > 0 {
+		var err error
+		if ban, err = target.banFor(opts.BanBy, time.Now().Add(opts.BanDuration)); err != nil {
+			return nil, err
+		}
+		// Banned before disconnecting so an immediate reconnect is refused
+		h.addBan(ban)
+	}
+
+	code, reason := closeCodeKicked, closeReasonKicked
+	if ban != nil {
+		code, reason = closeCodeBanned, closeReasonBanned
+	}
+	if !h.disconnect(target, code, reason) && ban == nil {
+		return nil, ErrClientNotFound
+	}
+
+	if ban != nil {
+		log.Printf("Kicked client %s from room %s and banned %s %s until %s", clientID, roomID, ban.Scope, ban.Value, ban.Until.Format(time.RFC3339))
+	} else {
+		log.Printf("Kicked client %s from room %s", clientID, roomID)
+	}
+	return ban, nil
+}
+
+func (h *Hub) IdleTimeout() time.Duration {
+	return h.config.IdleTimeout
+}
+
+// StrictRooms reports whether rooms must be created before they are joined
+func (h *Hub) StrictRooms() bool {
+	return h.config.StrictRooms
+}
+
 func (h *Hub) GetActiveRooms() map[string]int {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
@@ -1,9 +1,28 @@
 package ws
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/manpreetbhatti/lattice/backend/internal/auth"
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	"github.com/manpreetbhatti/lattice/backend/internal/origin"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
 )
 
 // Simulates a WebSocket client for testing
@@ -148,6 +167,28 @@ func TestHubActiveRooms(t *testing.T) {
 	}
 }
 
+func TestHubRoomActivity(t *testing.T) {
+	hub := NewHub(nil)
+	client := &Client{roomID: "open"}
+	hub.rooms["open"] = map[*Client]bool{client: true}
+
+	hub.countMessage("open")
+	hub.countMessage("open")
+	hub.countMessage("closed")
+
+	activity := hub.GetRoomActivity()
+	if len(activity) != 1 || activity["open"] != (RoomActivity{Clients: 1, Messages: 2}) {
+		t.Errorf("Expected only the open room with 2 messages, got %+v", activity)
+	}
+	if hub.MessageCount() != 3 {
+		t.Errorf("Expected 3 messages in total, got %d", hub.MessageCount())
+	}
+	// Counts of rooms without clients are forgotten
+	if _, ok := hub.roomMessages["closed"]; ok {
+		t.Error("Expected the closed room's count to be dropped")
+	}
+}
+
 func TestBroadcastMessage(t *testing.T) {
 	hub := NewHub(nil)
 	go hub.Run()
@@ -212,7 +253,7 @@ func TestMultipleRoomsBroadcast(t *testing.T) {
 	for _, roomID := range rooms {
 		hub.broadcast <- &Message{
 			RoomID: roomID,
-			Data:   []byte{0, byte(roomID[5])},
+			Data:   []byte{0, SyncUpdate, 1, byte(roomID[5])},
 			Sender: nil,
 		}
 	}
@@ -226,3 +267,2103 @@ func TestMultipleRoomsBroadcast(t *testing.T) {
 		}
 	}
 }
+
+func TestClientOverflowCoalescesAwareness(t *testing.T) {
+	client := newClient(nil, nil, "overflow-room", "overflow-client")
+	sender := newClient(nil, nil, "overflow-room", "sender")
+
+	for i := 0; i < sendBufferSize; i++ {
+		if result := client.enqueue([]byte{MessageSync, SyncUpdate, byte(i)}, sender); result != enqueueSent {
+			t.Fatalf("Expected message %d to be sent directly, got %v", i, result)
+		}
+	}
+
+	if result := client.enqueue([]byte{MessageSync, SyncUpdate, 1}, sender); result != enqueueOverflowed {
+		t.Errorf("Expected sync update to overflow, got %v", result)
+	}
+	if result := client.enqueue([]byte{MessageAwareness, 1}, sender); result != enqueueOverflowed {
+		t.Errorf("Expected first awareness update to overflow, got %v", result)
+	}
+	if result := client.enqueue([]byte{MessageAwareness, 2}, sender); result != enqueueCoalesced {
+		t.Errorf("Expected second awareness update to coalesce, got %v", result)
+	}
+
+	overflow := client.takeOverflow()
+	if len(overflow) != 2 {
+		t.Fatalf("Expected 2 overflowed messages, got %d", len(overflow))
+	}
+	if overflow[1][1] != 2 {
+		t.Error("Coalesced awareness should keep the newest state")
+	}
+}
+
+func TestStoredHistoryWaitsForClient(t *testing.T) {
+	client := newClient(nil, nil, "history-room", "history-client")
+	stop := make(chan struct{})
+
+	for i := 0; i < sendBufferSize; i++ {
+		client.enqueue([]byte{MessageSync, SyncUpdate, 1, byte(i)}, nil)
+	}
+
+	// An empty overflow queue always takes the next frame, however large
+	if !client.enqueueHistory(make([]byte, historyWindowBytes), stop) {
+		t.Fatal("Expected the first frame to be queued")
+	}
+
+	queuedNext := make(chan bool, 1)
+	go func() {
+		queuedNext <- client.enqueueHistory([]byte{MessageSync, SyncUpdate, 1, 0}, stop)
+	}()
+	select {
+	case <-queuedNext:
+		t.Fatal("Expected the history to wait while the window is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	client.takeOverflow()
+	select {
+	case ok := <-queuedNext:
+		if !ok {
+			t.Error("Expected the frame to be queued once the client drained")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("History still waiting after the overflow was drained")
+	}
+
+	// Live messages still fit beside the history
+	if result := client.enqueue([]byte{MessageAwareness, 1}, nil); result != enqueueOverflowed {
+		t.Errorf("Expected a live message to overflow, got %v", result)
+	}
+
+	go func() {
+		queuedNext <- client.enqueueHistory(make([]byte, historyWindowBytes), stop)
+	}()
+	client.closeSend(0, "")
+	select {
+	case ok := <-queuedNext:
+		if ok {
+			t.Error("Expected nothing queued for a closed client")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("History still waiting after the client closed")
+	}
+}
+
+func TestLaggingClientBatchesUpdates(t *testing.T) {
+	client := newClient(nil, nil, "batch-room", "batch-client")
+	client.batching = true
+	sender := newClient(nil, nil, "batch-room", "sender")
+
+	for i := 0; i < sendBufferSize; i++ {
+		client.enqueue([]byte{MessageSync, SyncUpdate, 1, byte(i)}, sender)
+	}
+
+	first := []byte{MessageSync, SyncUpdate, 1, 1}
+	if result := client.enqueue(first, sender); result != enqueueOverflowed {
+		t.Fatalf("Expected the first update to overflow, got %v", result)
+	}
+	for i := 2; i <= 4; i++ {
+		if result := client.enqueue([]byte{MessageSync, SyncUpdate, 1, byte(i)}, sender); result != enqueueCoalesced {
+			t.Errorf("Expected update %d to join the batch, got %v", i, result)
+		}
+	}
+	// Awareness breaks the run, and the next update starts a new entry
+	client.enqueue([]byte{MessageAwareness, 1}, sender)
+	client.enqueue([]byte{MessageSync, SyncUpdate, 1, 5}, sender)
+
+	if info := client.info(time.Now().Add(time.Second)); !info.Lagging || info.BehindMs < 1000 {
+		t.Errorf("Expected the client to be reported as lagging, got %+v", info)
+	}
+
+	overflow := client.takeOverflow()
+	if len(overflow) != 3 {
+		t.Fatalf("Expected a batch, an awareness update and an update, got %d messages", len(overflow))
+	}
+	frames, err := protocol.SplitBatch(overflow[0])
+	if err != nil {
+		t.Fatalf("Failed to split batch: %v", err)
+	}
+	if len(frames) != 4 {
+		t.Fatalf("Expected 4 batched updates, got %d", len(frames))
+	}
+	for i, frame := range frames {
+		if frame[3] != byte(i+1) {
+			t.Errorf("Batched update %d out of order: %v", i, frame)
+		}
+	}
+	if !bytes.Equal(first, []byte{MessageSync, SyncUpdate, 1, 1}) {
+		t.Error("Batching must not modify the shared frame")
+	}
+	if overflow[2][0] != MessageSync {
+		t.Errorf("Expected an unbatched update last, got type %d", overflow[2][0])
+	}
+
+	if info := client.info(time.Now()); info.BehindMs != 0 {
+		t.Errorf("Expected the client to be caught up once drained, got %d ms behind", info.BehindMs)
+	}
+
+	// Clients that did not ask for batches get every update separately
+	plain := newClient(nil, nil, "batch-room", "plain")
+	for i := 0; i < sendBufferSize+3; i++ {
+		plain.enqueue([]byte{MessageSync, SyncUpdate, 1, byte(i)}, sender)
+	}
+	if overflow := plain.takeOverflow(); len(overflow) != 3 {
+		t.Errorf("Expected 3 separate updates, got %d", len(overflow))
+	}
+}
+
+func TestSlowClientDropped(t *testing.T) {
+	hub := NewHub(nil)
+
+	client := newClient(hub, nil, "slow-room", "slow-client")
+	hub.rooms["slow-room"] = map[*Client]bool{client: true}
+
+	// Awareness without a sender is neither stored nor coalesced
+	message := make([]byte, 1024*1024)
+	message[0] = MessageAwareness
+
+	for i := 0; i < sendBufferSize+maxOverflowBytes/len(message)+1; i++ {
+		hub.handleBroadcast(&Message{RoomID: "slow-room", Data: message})
+	}
+
+	if hub.GetClientCount() != 0 {
+		t.Errorf("Expected slow client to be dropped, got %d clients", hub.GetClientCount())
+	}
+
+	stats := hub.GetSendStats()
+	if stats.DroppedClients != 1 {
+		t.Errorf("Expected 1 dropped client, got %d", stats.DroppedClients)
+	}
+	if stats.OverflowedMessages == 0 {
+		t.Error("Expected overflowed messages to be counted")
+	}
+
+	if string(client.closeMessage()[2:]) != closeReasonSlowClient {
+		t.Errorf("Expected close reason %q, got %q", closeReasonSlowClient, client.closeMessage()[2:])
+	}
+}
+
+// Broadcasts fan out while other goroutines kick, notify and register
+// clients in the same room and slow clients get dropped mid-broadcast. Run
+// with -race, which reports the room's map being read during a change.
+func TestBroadcastWhileRoomChanges(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+	defer hub.Stop()
+
+	roomID := "churn-room"
+	message := make([]byte, 64*1024)
+	message[0] = MessageAwareness
+
+	// Readers drain their queues; slow clients never do
+	drain := func(client *Client) {
+		for {
+			select {
+			case _, ok := <-client.send:
+				if !ok {
+					return
+				}
+			case <-client.wake:
+				client.takeOverflow()
+			}
+		}
+	}
+	var slow []*Client
+	for i := 0; i < 4; i++ {
+		reader := newClient(hub, nil, roomID, fmt.Sprintf("reader-%d", i))
+		hub.register <- reader
+		go drain(reader)
+
+		client := newClient(hub, nil, roomID, fmt.Sprintf("slow-%d", i))
+		hub.register <- client
+		slow = append(slow, client)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < sendBufferSize+maxOverflowBytes/len(message)+8; i++ {
+			hub.broadcast <- &Message{RoomID: roomID, Data: message}
+			// Pauses let the readers keep up even on a single CPU
+			if i%32 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			visitor := newClient(hub, nil, roomID, fmt.Sprintf("visitor-%d", i))
+			hub.register <- visitor
+			go drain(visitor)
+			// Registration finishes on the hub goroutine after the send
+			for {
+				if _, err := hub.Kick(roomID, visitor.clientID, KickOptions{}); err == nil {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			hub.Notify(roomID, NoticeFrame{Message: "notice"})
+			hub.GetConnections()
+		}
+	}()
+	wg.Wait()
+
+	// Every slow client was dropped and the readers stayed
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.GetClientCount() != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the 4 readers to remain, got %d clients", hub.GetClientCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dropped := hub.GetSendStats().DroppedClients; dropped != uint64(len(slow)) {
+		t.Errorf("Expected %d dropped clients, got %d", len(slow), dropped)
+	}
+	for _, client := range slow {
+		if string(client.closeMessage()[2:]) != closeReasonSlowClient {
+			t.Errorf("Expected %s to be closed as slow, got %q", client.clientID, client.closeMessage())
+		}
+	}
+}
+
+func TestHandshakeMessagesNotStored(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+	defer hub.Stop()
+
+	roomID := "handshake-test"
+	roomState := hub.getRoomState(roomID)
+
+	messages := [][]byte{
+		{MessageSync, SyncStep1, 1, 0},       // state vector
+		{MessageSync, SyncStep2, 2, 0, 0},    // empty step2 reply
+		{MessageSync, SyncStep2, 3, 1, 2, 3}, // step2 carrying changes
+		{MessageSync, SyncUpdate, 2, 7, 7},   // regular update
+		{MessageSync, SyncUpdate, 9, 1},      // truncated payload
+	}
+	for _, data := range messages {
+		hub.broadcast <- &Message{RoomID: roomID, Data: data}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	updates := roomState.GetUpdates()
+	if len(updates) != 2 {
+		t.Fatalf("Expected 2 stored updates, got %d", len(updates))
+	}
+	if updates[0][1] != SyncStep2 || updates[1][1] != SyncUpdate {
+		t.Errorf("Unexpected stored updates: %v", updates)
+	}
+}
+
+type recordingNotifier struct {
+	threshold int
+	notified  []string
+}
+
+func (n *recordingNotifier) Notify(roomID string) { n.notified = append(n.notified, roomID) }
+func (n *recordingNotifier) UpdateThreshold() int { return n.threshold }
+
+func TestHubNotifiesCompactionAtThreshold(t *testing.T) {
+	hub := NewHub(nil)
+	notifier := &recordingNotifier{threshold: 3}
+	hub.SetCompactionNotifier(notifier)
+
+	for i := 0; i < 7; i++ {
+		hub.handleBroadcast(&Message{RoomID: "busy-room", Data: []byte{MessageSync, SyncUpdate, 1, byte(i)}})
+	}
+	hub.handleBroadcast(&Message{RoomID: "quiet-room", Data: []byte{MessageSync, SyncUpdate, 1, 0}})
+
+	if len(notifier.notified) != 2 {
+		t.Fatalf("Expected 2 notifications, got %d (%v)", len(notifier.notified), notifier.notified)
+	}
+	for _, roomID := range notifier.notified {
+		if roomID != "busy-room" {
+			t.Errorf("Unexpected notification for %s", roomID)
+		}
+	}
+}
+
+// Records how many updates were stored when each notification arrived
+type storedCountNotifier struct {
+	database  *db.Database
+	threshold int
+	counts    chan int
+}
+
+func (n *storedCountNotifier) Notify(roomID string) {
+	count, _ := n.database.GetUpdateCount(context.Background(), roomID)
+	n.counts <- count
+}
+func (n *storedCountNotifier) UpdateThreshold() int { return n.threshold }
+
+func TestCompactionNotifiedAfterFlush(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+
+	roomID := "flush-room"
+	if err := database.CreateRoom(context.Background(), roomID, ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	config := DefaultHubConfig()
+	config.WriteBehind.FlushInterval = time.Hour
+	hub := NewHubWithConfig(database, config)
+	defer hub.Stop()
+	notifier := &storedCountNotifier{database: database, threshold: 3, counts: make(chan int, 1)}
+	hub.SetCompactionNotifier(notifier)
+
+	for i := 0; i < 3; i++ {
+		hub.handleBroadcast(&Message{RoomID: roomID, Data: []byte{MessageSync, SyncUpdate, 1, byte(i)}})
+	}
+
+	select {
+	case count := <-notifier.counts:
+		if count != 3 {
+			t.Errorf("Expected all 3 updates stored before the notification, got %d", count)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the compaction notification")
+	}
+}
+
+func TestEvictIdleClients(t *testing.T) {
+	config := DefaultHubConfig()
+	config.IdleTimeout = time.Minute
+	hub := NewHubWithConfig(nil, config)
+
+	active := newClient(hub, nil, "idle-room", "active")
+	idle := newClient(hub, nil, "idle-room", "idle")
+	idle.lastActivity.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	hub.rooms["idle-room"] = map[*Client]bool{active: true, idle: true}
+
+	active.touch(10)
+	hub.evictIdle()
+
+	connections := hub.GetConnections()
+	if len(connections) != 1 || connections[0].ClientID != "active" {
+		t.Fatalf("Expected only the active client to remain, got %+v", connections)
+	}
+	if connections[0].MessagesIn != 1 || connections[0].BytesIn != 10 {
+		t.Errorf("Expected 1 message and 10 bytes in, got %d and %d", connections[0].MessagesIn, connections[0].BytesIn)
+	}
+
+	if hub.GetSendStats().EvictedClients != 1 {
+		t.Errorf("Expected 1 evicted client, got %d", hub.GetSendStats().EvictedClients)
+	}
+	if _, ok := <-idle.send; ok {
+		t.Error("Evicted client's send channel should be closed")
+	}
+}
+
+func TestKick(t *testing.T) {
+	hub := NewHub(nil)
+
+	target := newClient(hub, nil, "kick-room", "target")
+	other := newClient(hub, nil, "kick-room", "other")
+	hub.rooms["kick-room"] = map[*Client]bool{target: true, other: true}
+
+	if _, err := hub.Kick("other-room", "target", KickOptions{}); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("Kick should not find a client in another room, got %v", err)
+	}
+	if _, err := hub.Kick("kick-room", "target", KickOptions{}); err != nil {
+		t.Fatalf("Expected the client to be kicked, got %v", err)
+	}
+	if _, err := hub.Kick("kick-room", "target", KickOptions{}); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("Kicking a departed client should report not found, got %v", err)
+	}
+
+	if _, ok := <-target.send; ok {
+		t.Error("Kicked client's send channel should be closed")
+	}
+	if target.closeCode != closeCodeKicked {
+		t.Errorf("Expected close code %d, got %d", closeCodeKicked, target.closeCode)
+	}
+	if connections := hub.GetConnections(); len(connections) != 1 || connections[0].ClientID != "other" {
+		t.Errorf("Expected only the other client to remain, got %+v", connections)
+	}
+
+	// A plain kick leaves the client free to rejoin
+	if hub.isBanned(newClient(hub, nil, "kick-room", "again")) {
+		t.Error("Kick without a ban duration should not ban")
+	}
+}
+
+func TestLockRoom(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+
+	config := DefaultHubConfig()
+	config.WriteBehind.FlushInterval = time.Hour
+	hub := NewHubWithConfig(database, config)
+	go hub.Run()
+	defer hub.Stop()
+
+	editor := newClient(hub, nil, "locked", "editor")
+	hub.register <- editor
+	if _, err := hub.ApplyUpdates("locked", [][]byte{protocol.EncodeUpdate([]byte{1})}); err != nil {
+		t.Fatalf("ApplyUpdates failed: %v", err)
+	}
+
+	if _, err := hub.LockRoom("locked", time.Minute); err != nil {
+		t.Fatalf("LockRoom failed: %v", err)
+	}
+	// Buffered updates are written by the time the lock is taken
+	if count, _ := database.GetUpdateCount(context.Background(), "locked"); count != 1 {
+		t.Errorf("Expected the pending update written, got %d stored", count)
+	}
+
+	if _, err := hub.ApplyUpdates("locked", [][]byte{protocol.EncodeUpdate([]byte{2})}); !errors.Is(err, ErrRoomLocked) {
+		t.Errorf("Expected ErrRoomLocked, got %v", err)
+	}
+	for len(editor.send) > 0 {
+		<-editor.send
+	}
+	hub.broadcast <- &Message{RoomID: "locked", Data: protocol.EncodeUpdate([]byte{3}), Sender: editor}
+	rejection := <-editor.send
+	if rejection[0] != byte(protocol.MessageTypeError) || !strings.Contains(string(rejection), ErrorCodeRoomLocked) {
+		t.Errorf("Expected a room_locked error, got %v", rejection)
+	}
+	if updates := hub.getRoomState("locked").GetUpdates(); len(updates) != 1 {
+		t.Errorf("Expected no update stored while locked, got %d", len(updates))
+	}
+
+	if !hub.UnlockRoom("locked") || hub.UnlockRoom("locked") {
+		t.Error("Expected only the first unlock to find a lock")
+	}
+	if _, err := hub.ApplyUpdates("locked", [][]byte{protocol.EncodeUpdate([]byte{4})}); err != nil {
+		t.Errorf("Expected the unlocked room to accept updates, got %v", err)
+	}
+
+	// Abandoned locks expire
+	if _, err := hub.LockRoom("locked", time.Millisecond); err != nil {
+		t.Fatalf("LockRoom failed: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := hub.ApplyUpdates("locked", [][]byte{protocol.EncodeUpdate([]byte{5})}); err != nil {
+		t.Errorf("Expected the lock to have expired, got %v", err)
+	}
+}
+
+func TestStopDrainsBroadcasts(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+
+	hub := NewHub(database)
+	// Holding the hub's lock stalls Run on the first message, so the rest
+	// are still queued when Stop is called
+	hub.mu.Lock()
+	go hub.Run()
+	const queued = 50
+	for i := 0; i < queued; i++ {
+		hub.broadcast <- &Message{RoomID: "draining", Data: protocol.EncodeUpdate([]byte{byte(i)})}
+	}
+	for len(hub.broadcast) == queued {
+		time.Sleep(time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		hub.Stop()
+		close(stopped)
+	}()
+	<-hub.stop
+	hub.mu.Unlock()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	count, err := database.GetUpdateCount(context.Background(), "draining")
+	if err != nil || count != queued {
+		t.Errorf("Expected all %d queued updates stored, got %d (err %v)", queued, count, err)
+	}
+}
+
+func TestDeleteRoom(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	ctx := context.Background()
+
+	hub := NewHub(database)
+	go hub.Run()
+	defer hub.Stop()
+
+	editor := newClient(hub, nil, "doomed", "editor")
+	hub.register <- editor
+	other := newClient(hub, nil, "kept", "other")
+	hub.register <- other
+	hub.addBan(&Ban{RoomID: "doomed", Scope: BanByIP, Value: "203.0.113.7", Until: time.Now().Add(time.Hour)})
+
+	// Waits until the hub has handled every queued message
+	settle := func() {
+		for len(hub.broadcast) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if _, err := hub.ApplyUpdates("kept", nil); err != nil {
+			t.Fatalf("ApplyUpdates failed: %v", err)
+		}
+	}
+
+	hub.broadcast <- &Message{RoomID: "doomed", Data: protocol.EncodeUpdate([]byte{1}), Sender: editor}
+	settle()
+	closed, err := hub.DeleteRoom("doomed")
+	if err != nil || closed != 1 {
+		t.Fatalf("Expected 1 session closed, got %d (err %v)", closed, err)
+	}
+	if err := database.DeleteRoom(ctx, "doomed"); err != nil {
+		t.Fatalf("Failed to delete room: %v", err)
+	}
+
+	for range editor.send {
+		// Drain up to the close
+	}
+	if editor.closeCode != closeCodeRoomDeleted {
+		t.Errorf("Expected close code %d, got %d", closeCodeRoomDeleted, editor.closeCode)
+	}
+
+	// An edit the session sent before it noticed is dropped rather than
+	// recreating the room
+	hub.broadcast <- &Message{RoomID: "doomed", Data: protocol.EncodeUpdate([]byte{2}), Sender: editor}
+	settle()
+	if err := hub.writer.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if room, _ := database.GetRoom(ctx, "doomed"); room != nil {
+		t.Error("Expected the room to stay deleted")
+	}
+	hub.mu.RLock()
+	_, loaded := hub.roomStates["doomed"]
+	hub.mu.RUnlock()
+	if loaded {
+		t.Error("Expected the room's state to be dropped")
+	}
+	if len(hub.Bans("doomed")) != 0 {
+		t.Error("Expected the room's bans to be dropped")
+	}
+	if connections := hub.GetConnections(); len(connections) != 1 || connections[0].ClientID != "other" {
+		t.Errorf("Expected only the other room's session, got %+v", connections)
+	}
+}
+
+func TestKickWithBan(t *testing.T) {
+	hub := NewHub(nil)
+
+	target := newClient(hub, nil, "ban-room", "target")
+	target.remoteAddr = "203.0.113.7:5000"
+	anonymous := newClient(hub, nil, "ban-room", "anonymous")
+	anonymous.remoteAddr = "198.51.100.1:5000"
+	hub.rooms["ban-room"] = map[*Client]bool{target: true, anonymous: true}
+
+	if _, err := hub.Kick("ban-room", "anonymous", KickOptions{BanDuration: time.Hour, BanBy: BanByUser}); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("Expected ErrNoIdentity for a user ban without identity, got %v", err)
+	}
+	if len(hub.Bans("ban-room")) != 0 {
+		t.Error("A failed ban should not be recorded")
+	}
+
+	ban, err := hub.Kick("ban-room", "target", KickOptions{BanDuration: time.Hour})
+	if err != nil {
+		t.Fatalf("Kick failed: %v", err)
+	}
+	if ban == nil || ban.Scope != BanByIP || ban.Value != "203.0.113.7" {
+		t.Fatalf("Expected an IP ban on 203.0.113.7, got %+v", ban)
+	}
+	if target.closeCode != closeCodeBanned {
+		t.Errorf("Expected close code %d, got %d", closeCodeBanned, target.closeCode)
+	}
+
+	// Same IP on a new port is refused; another IP or room is not
+	rejoin := newClient(hub, nil, "ban-room", "rejoin")
+	rejoin.remoteAddr = "203.0.113.7:6000"
+	hub.handleRegister(rejoin)
+	if _, ok := <-rejoin.send; ok {
+		t.Error("Banned client's send channel should be closed")
+	}
+	if rejoin.closeCode != closeCodeBanned {
+		t.Errorf("Expected close code %d, got %d", closeCodeBanned, rejoin.closeCode)
+	}
+	if hub.GetClientCount() != 1 {
+		t.Errorf("Expected the banned client not to join, got %d clients", hub.GetClientCount())
+	}
+
+	elsewhere := newClient(hub, nil, "other-room", "elsewhere")
+	elsewhere.remoteAddr = "203.0.113.7:7000"
+	if hub.isBanned(elsewhere) {
+		t.Error("Ban should only apply to its room")
+	}
+
+	// Expired bans are pruned
+	hub.addBan(&Ban{RoomID: "expired-room", Scope: BanByIP, Value: "203.0.113.7", Until: time.Now().Add(-time.Second)})
+	expired := newClient(hub, nil, "expired-room", "expired")
+	expired.remoteAddr = "203.0.113.7:8000"
+	if hub.isBanned(expired) {
+		t.Error("Expired ban should not apply")
+	}
+	if _, ok := hub.bans["expired-room"]; ok {
+		t.Error("Expired bans should be pruned")
+	}
+}
+
+func TestKickWithUserBan(t *testing.T) {
+	hub := NewHub(nil)
+
+	target := newClient(hub, nil, "ban-room", "target")
+	target.identity = &auth.Identity{ID: "user-1", Name: "Ada"}
+	hub.rooms["ban-room"] = map[*Client]bool{target: true}
+
+	ban, err := hub.Kick("ban-room", "target", KickOptions{BanDuration: time.Minute, BanBy: BanByUser})
+	if err != nil {
+		t.Fatalf("Kick failed: %v", err)
+	}
+	if ban.Scope != BanByUser || ban.Value != "user-1" {
+		t.Errorf("Expected a user ban on user-1, got %+v", ban)
+	}
+
+	// The same user from another address is refused
+	rejoin := newClient(hub, nil, "ban-room", "rejoin")
+	rejoin.remoteAddr = "192.0.2.1:1234"
+	rejoin.identity = &auth.Identity{ID: "user-1"}
+	if !hub.isBanned(rejoin) {
+		t.Error("Expected the user to be banned")
+	}
+	if bans := hub.Bans("ban-room"); len(bans) != 1 || bans[0].Value != "user-1" {
+		t.Errorf("Expected one listed ban, got %+v", bans)
+	}
+}
+
+func TestResumeTokenRoundTrip(t *testing.T) {
+	token := ResumeToken{RoomID: "room:with:colons", Epoch: 0xdeadbeef, Seq: 42}
+
+	parsed, err := ParseResumeToken(token.Encode())
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	if *parsed != token {
+		t.Errorf("Expected %+v, got %+v", token, *parsed)
+	}
+
+	if _, err := ParseResumeToken("not a token"); err == nil {
+		t.Error("Expected error for malformed token")
+	}
+}
+
+func TestRegisterWithResumeToken(t *testing.T) {
+	hub := NewHub(nil)
+
+	roomID := "resume-room"
+	roomState := hub.getRoomState(roomID)
+	for i := 0; i < 5; i++ {
+		roomState.AddUpdate([]byte{MessageSync, SyncUpdate, 1, byte(i)})
+	}
+	epoch, _ := roomState.Position()
+
+	drain := func(c *Client) [][]byte {
+		var received [][]byte
+		for {
+			select {
+			case data := <-c.send:
+				received = append(received, data)
+			default:
+				return append(received, c.takeOverflow()...)
+			}
+		}
+	}
+
+	resumed := newClient(hub, nil, roomID, "resumed")
+	resumed.resume = &ResumeToken{RoomID: roomID, Epoch: epoch, Seq: 3}
+	hub.handleRegister(resumed)
+
+	received := drain(resumed)
+	if len(received) != 4 {
+		t.Fatalf("Expected a hello, 2 missed updates and a token, got %d messages", len(received))
+	}
+	if received[0][0] != byte(protocol.MessageTypeControl) {
+		t.Errorf("Expected hello first, got message type %d", received[0][0])
+	}
+	if received[1][3] != 3 || received[2][3] != 4 {
+		t.Errorf("Expected updates 3 and 4, got %v", received[1:3])
+	}
+	if received[3][0] != byte(protocol.MessageTypeResume) {
+		t.Errorf("Expected resume token last, got message type %d", received[3][0])
+	}
+
+	stale := newClient(hub, nil, roomID, "stale")
+	stale.resume = &ResumeToken{RoomID: roomID, Epoch: epoch + 1, Seq: 3}
+	hub.handleRegister(stale)
+
+	if received := drain(stale); len(received) != 7 {
+		t.Errorf("Expected a hello, full sync of 5 updates and a token for stale token, got %d messages", len(received))
+	}
+}
+
+func TestSequencedBroadcastAndRefill(t *testing.T) {
+	hub := NewHub(nil)
+
+	roomID := "seq-room"
+	sender := newClient(hub, nil, roomID, "sender")
+	plain := newClient(hub, nil, roomID, "plain")
+	sequenced := newClient(hub, nil, roomID, "sequenced")
+	sequenced.sequenced = true
+	for _, c := range []*Client{sender, plain, sequenced} {
+		hub.handleRegister(c)
+		for len(c.send) > 0 {
+			<-c.send
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		hub.handleBroadcast(&Message{RoomID: roomID, Data: []byte{MessageSync, SyncUpdate, 1, byte(i)}, Sender: sender})
+	}
+
+	for i := 0; i < 3; i++ {
+		if data := <-plain.send; data[0] != MessageSync {
+			t.Errorf("Plain client should receive raw frames, got type %d", data[0])
+		}
+
+		data := <-sequenced.send
+		if data[0] != byte(protocol.MessageTypeSequenced) {
+			t.Fatalf("Expected sequenced envelope, got type %d", data[0])
+		}
+		seq, n := protocol.ReadVarUint(data[1:])
+		if int(seq) != i+1 {
+			t.Errorf("Expected sequence %d, got %d", i+1, seq)
+		}
+		if inner := data[1+n:]; inner[0] != MessageSync || inner[3] != byte(i) {
+			t.Errorf("Envelope %d wraps the wrong frame: %v", i, inner)
+		}
+	}
+
+	from, to, err := parseRefill([]byte{byte(protocol.MessageTypeRefill), 2, 3})
+	if err != nil {
+		t.Fatalf("Failed to parse refill: %v", err)
+	}
+	hub.handleRefill(&RefillRequest{Client: sequenced, From: from, To: to})
+
+	if len(sequenced.send) != 2 {
+		t.Fatalf("Expected 2 refilled updates, got %d", len(sequenced.send))
+	}
+	for want := 2; want <= 3; want++ {
+		data := <-sequenced.send
+		if seq, _ := protocol.ReadVarUint(data[1:]); int(seq) != want {
+			t.Errorf("Expected refilled sequence %d, got %d", want, seq)
+		}
+	}
+
+	if _, _, err := parseRefill([]byte{byte(protocol.MessageTypeRefill), 3, 2}); err == nil {
+		t.Error("Expected error for inverted refill range")
+	}
+}
+
+func TestValidateClientMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"sync step 1", []byte{MessageSync, SyncStep1, 0}, true},
+		{"sync step 2", []byte{MessageSync, SyncStep2, 2, 0, 0}, true},
+		{"update", []byte{MessageSync, SyncUpdate, 1, 0}, true},
+		{"awareness", []byte{MessageAwareness, 0}, true},
+		{"refill", []byte{byte(protocol.MessageTypeRefill), 1, 2}, true},
+		{"unknown sync type", []byte{MessageSync, 3, 0}, false},
+		{"sequenced", sequencedFrame(1, []byte{MessageSync, SyncUpdate, 1, 0}), false},
+		{"resume", []byte{byte(protocol.MessageTypeResume), 0}, false},
+		{"control", controlMessage(map[string]string{"type": "hello"}), false},
+		{"batch", protocol.AppendToBatch(nil, []byte{MessageSync, SyncUpdate, 1, 0}), false},
+		{"empty", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateYjsMessage(tt.data); (err == nil) != tt.ok {
+				t.Errorf("Expected ok=%v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestParseAuthMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		secret string
+		ok     bool
+	}{
+		{"var string", []byte{2, 3, 'a', 'b', 'c'}, "abc", true},
+		{"token subtype", []byte{2, 1, 3, 'a', 'b', 'c'}, "abc", true},
+		{"truncated", []byte{2, 5, 'a'}, "", false},
+		{"not auth", []byte{0, 3, 'a', 'b', 'c'}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, ok := parseAuthMessage(tt.data)
+			if ok != tt.ok || secret != tt.secret {
+				t.Errorf("Expected (%q, %v), got (%q, %v)", tt.secret, tt.ok, secret, ok)
+			}
+		})
+	}
+}
+
+func TestIdentifyClient(t *testing.T) {
+	hub := NewHub(nil)
+	issuer := auth.NewIssuer([]byte("test-key"), time.Hour)
+	hub.SetIdentityVerifier(issuer)
+
+	token, _, err := issuer.Issue("Grace", "")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	message := []byte{byte(protocol.MessageTypeAuth), authIdentity}
+	message = binary.AppendUvarint(message, uint64(len(token)))
+	message = append(message, token...)
+
+	parsed, ok := parseIdentityMessage(message)
+	if !ok || parsed != token {
+		t.Fatalf("Failed to parse identity message")
+	}
+
+	client := newClient(hub, nil, "identity-room", "client")
+	client.identify("forged.token")
+	if client.getIdentity() != nil {
+		t.Error("Forged token should leave the client anonymous")
+	}
+
+	client.identify(parsed)
+	if identity := client.info(time.Now()).Identity; identity == nil || identity.Name != "Grace" {
+		t.Errorf("Expected identity Grace in connection info, got %+v", identity)
+	}
+}
+
+func TestIdentifyRecordsVisit(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	ctx := context.Background()
+
+	hub := NewHub(database)
+	issuer := auth.NewIssuer([]byte("test-key"), time.Hour)
+	hub.SetIdentityVerifier(issuer)
+
+	_, user, err := database.CreateUser(ctx, "Ada", "#112233", nil)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	token, _, _ := issuer.IssueFor(user.ID, user.Name, user.Color)
+	guestToken, _, _ := issuer.Issue("Grace", "")
+
+	newClient(hub, nil, "visited-room", "profile").identify(token)
+	newClient(hub, nil, "guest-room", "guest").identify(guestToken)
+
+	recent, err := database.ListRecentRooms(ctx, user.ID, 10)
+	if err != nil || len(recent) != 1 || recent[0].RoomID != "visited-room" {
+		t.Errorf("Expected a visit to visited-room, got %+v, %v", recent, err)
+	}
+}
+
+func TestUpdateAttribution(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	ctx := context.Background()
+
+	hub := NewHub(database)
+	issuer := auth.NewIssuer([]byte("test-key"), time.Hour)
+	hub.SetIdentityVerifier(issuer)
+	_, user, err := database.CreateUser(ctx, "Ada", "#112233", nil)
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	token, _, _ := issuer.IssueFor(user.ID, user.Name, user.Color)
+
+	roomID := "attributed-room"
+	ada := newClient(hub, nil, roomID, "ada-session")
+	ada.identify(token)
+	anonymous := newClient(hub, nil, roomID, "anonymous-session")
+	update := []byte{MessageSync, SyncUpdate, 2, 1, 2}
+	hub.handleBroadcast(&Message{RoomID: roomID, Data: update, Sender: ada})
+	hub.handleBroadcast(&Message{RoomID: roomID, Data: update, Sender: ada})
+	hub.handleBroadcast(&Message{RoomID: roomID, Data: update, Sender: anonymous})
+	hub.handleBroadcast(&Message{RoomID: roomID, Data: update}) // Applied over HTTP
+	hub.Stop()
+
+	contributions, err := database.GetRoomContributions(ctx, roomID)
+	if err != nil {
+		t.Fatalf("Failed to get contributions: %v", err)
+	}
+	if len(contributions) != 3 {
+		t.Fatalf("Expected a user, a session and unattributed updates, got %+v", contributions)
+	}
+	if c := contributions[0]; c.UserID != user.ID || c.Name != "Ada" || c.Updates != 2 || c.Clients != 1 || c.Bytes != 10 {
+		t.Errorf("Expected Ada's two updates first, got %+v", c)
+	}
+	if c := contributions[1]; c.UserID != "" || c.ClientID != "anonymous-session" || c.Updates != 1 {
+		t.Errorf("Expected the anonymous session's update, got %+v", c)
+	}
+	if c := contributions[2]; c.UserID != "" || c.ClientID != "" || c.Clients != 0 || c.Updates != 1 {
+		t.Errorf("Expected the unattributed update last, got %+v", c)
+	}
+}
+
+func TestRoomQuota(t *testing.T) {
+	config := DefaultHubConfig()
+	config.MaxRoomBytes = 10
+	hub := NewHubWithConfig(nil, config)
+
+	roomID := "quota-room"
+	sender := newClient(hub, nil, roomID, "sender")
+	receiver := newClient(hub, nil, roomID, "receiver")
+	for _, c := range []*Client{sender, receiver} {
+		hub.handleRegister(c)
+		for len(c.send) > 0 {
+			<-c.send
+		}
+	}
+
+	// 8 of 10 bytes crosses the warning threshold
+	hub.handleBroadcast(&Message{RoomID: roomID, Data: []byte{MessageSync, SyncUpdate, 5, 1, 2, 3, 4, 5}, Sender: sender})
+	if len(receiver.send) != 1 {
+		t.Fatalf("Expected update under quota to be broadcast")
+	}
+	<-receiver.send
+
+	warning := <-sender.send
+	if warning[0] != byte(protocol.MessageTypeError) || !bytes.Contains(warning, []byte(ErrorCodeQuotaWarning)) {
+		t.Errorf("Expected quota warning, got %q", warning)
+	}
+
+	if seq := hub.handleBroadcast(&Message{RoomID: roomID, Data: []byte{MessageSync, SyncUpdate, 1, 9}, Sender: sender}); seq != 0 {
+		t.Errorf("Expected update over quota to be rejected, got seq %d", seq)
+	}
+	if len(receiver.send) != 0 {
+		t.Error("Rejected update should not be broadcast")
+	}
+
+	rejection := <-sender.send
+	if !bytes.Contains(rejection, []byte(ErrorCodeQuotaExceeded)) {
+		t.Errorf("Expected quota error, got %q", rejection)
+	}
+	if stats := hub.GetSendStats(); stats.QuotaRejections != 1 {
+		t.Errorf("Expected 1 quota rejection, got %d", stats.QuotaRejections)
+	}
+}
+
+func TestIPLimiter(t *testing.T) {
+	limiter := newIPLimiter(ConnectionLimitConfig{MaxPerIP: 2, RatePerMinute: 60, Burst: 3})
+	defer limiter.stop()
+
+	if err := limiter.acquire("198.51.100.1"); err != nil {
+		t.Fatalf("First connection refused: %v", err)
+	}
+	if err := limiter.acquire("198.51.100.1"); err != nil {
+		t.Fatalf("Second connection refused: %v", err)
+	}
+	if err := limiter.acquire("198.51.100.1"); !errors.Is(err, errTooManyConnections) {
+		t.Errorf("Expected errTooManyConnections, got %v", err)
+	}
+	if err := limiter.acquire("198.51.100.2"); err != nil {
+		t.Errorf("Another address should have its own limit, got %v", err)
+	}
+
+	// The refused attempt still spent the burst, so the rate applies next
+	limiter.release("198.51.100.1")
+	if err := limiter.acquire("198.51.100.1"); !errors.Is(err, errConnectionRate) {
+		t.Errorf("Expected errConnectionRate, got %v", err)
+	}
+
+	stats := limiter.stats()
+	if stats.ActiveIPs != 2 || stats.RejectedConcurrent != 1 || stats.RejectedRate != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	limiter.release("198.51.100.1")
+	limiter.release("198.51.100.2")
+	if stats := limiter.stats(); stats.ActiveIPs != 0 {
+		t.Errorf("Expected no active addresses, got %d", stats.ActiveIPs)
+	}
+}
+
+func TestServeWsConnectionLimit(t *testing.T) {
+	config := DefaultHubConfig()
+	config.ConnectionLimits = ConnectionLimitConfig{MaxPerIP: 1}
+	hub := NewHubWithConfig(nil, config)
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?room=limit-room"
+
+	first, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("First dial failed: %v", err)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("Expected the second connection to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %+v", resp)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+
+	// Closing the session frees its slot
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.GetConnectionLimitStats().ActiveIPs != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Slot was not released after the connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	second, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial after release failed: %v", err)
+	}
+	second.Close()
+}
+
+func TestAwarenessMessageRoundTrip(t *testing.T) {
+	entries := []protocol.AwarenessEntry{
+		{ClientID: 42, Clock: 3, State: `{"user":{"name":"Ada"}}`},
+		{ClientID: 1 << 40, Clock: 0, State: "null"},
+	}
+
+	parsed, err := protocol.ParseAwarenessMessage(protocol.EncodeAwarenessMessage(entries))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(parsed) != 2 || parsed[0] != entries[0] || parsed[1] != entries[1] {
+		t.Errorf("Expected %+v, got %+v", entries, parsed)
+	}
+	if parsed[0].Removed() || !parsed[1].Removed() {
+		t.Error("Removed() should only report null states")
+	}
+
+	for _, data := range [][]byte{{1}, {1, 1, 2, 3, 4}, {1, 3, 1, 5, 0}, {0, 1, 0}} {
+		if _, err := protocol.ParseAwarenessMessage(data); err == nil {
+			t.Errorf("Expected %v to be rejected", data)
+		}
+	}
+}
+
+func TestAwarenessTracking(t *testing.T) {
+	hub := NewHub(nil)
+	roomID := "awareness-room"
+
+	alice := newClient(hub, nil, roomID, "alice")
+	bob := newClient(hub, nil, roomID, "bob")
+	hub.handleRegister(alice)
+	hub.handleRegister(bob)
+	drain := func(c *Client) [][]byte {
+		var messages [][]byte
+		for {
+			select {
+			case m := <-c.send:
+				messages = append(messages, m)
+			default:
+				return messages
+			}
+		}
+	}
+	drain(alice)
+	drain(bob)
+
+	cursor := func(clock uint64, state string) []byte {
+		return protocol.EncodeAwarenessMessage([]protocol.AwarenessEntry{{ClientID: 7, Clock: clock, State: state}})
+	}
+	hub.handleBroadcast(&Message{RoomID: roomID, Data: cursor(2, `{"cursor":2}`), Sender: alice})
+	hub.handleBroadcast(&Message{RoomID: roomID, Data: cursor(1, `{"cursor":1}`), Sender: alice})
+
+	roomState := hub.getRoomState(roomID)
+	stored := roomState.GetAllAwareness()
+	if len(stored) != 1 || !bytes.Equal(stored[0], cursor(2, `{"cursor":2}`)) {
+		t.Fatalf("Expected only the newest state to be stored, got %v", stored)
+	}
+
+	// A new joiner sees the existing cursor without waiting for it to move
+	carol := newClient(hub, nil, roomID, "carol")
+	hub.handleRegister(carol)
+	replayed := false
+	for _, m := range drain(carol) {
+		if bytes.Equal(m, cursor(2, `{"cursor":2}`)) {
+			replayed = true
+		}
+	}
+	if !replayed {
+		t.Error("Expected the stored awareness state to be replayed on join")
+	}
+
+	// Leaving removes the state and tells the peers, with a newer clock
+	drain(bob)
+	hub.handleUnregister(alice)
+	if len(roomState.GetAllAwareness()) != 0 {
+		t.Error("Expected the departed client's state to be dropped")
+	}
+	removal := drain(bob)
+	if len(removal) != 1 {
+		t.Fatalf("Expected one removal message, got %d", len(removal))
+	}
+	entries, err := protocol.ParseAwarenessMessage(removal[0])
+	if err != nil {
+		t.Fatalf("Failed to parse removal: %v", err)
+	}
+	if len(entries) != 1 || entries[0].ClientID != 7 || entries[0].Clock != 3 || !entries[0].Removed() {
+		t.Errorf("Unexpected removal %+v", entries)
+	}
+}
+
+func TestAwarenessClientRemovesItself(t *testing.T) {
+	hub := NewHub(nil)
+	roomID := "awareness-room"
+
+	alice := newClient(hub, nil, roomID, "alice")
+	bob := newClient(hub, nil, roomID, "bob")
+	hub.handleRegister(alice)
+	hub.handleRegister(bob)
+
+	entry := protocol.AwarenessEntry{ClientID: 9, Clock: 4, State: `{}`}
+	hub.handleBroadcast(&Message{RoomID: roomID, Data: protocol.EncodeAwarenessMessage([]protocol.AwarenessEntry{entry}), Sender: alice})
+	// y-protocols clients announce their own departure with the same clock
+	entry.State = "null"
+	hub.handleBroadcast(&Message{RoomID: roomID, Data: protocol.EncodeAwarenessMessage([]protocol.AwarenessEntry{entry}), Sender: alice})
+
+	if len(hub.getRoomState(roomID).GetAllAwareness()) != 0 {
+		t.Error("Expected the removed state to be dropped")
+	}
+	for len(bob.send) > 0 {
+		<-bob.send
+	}
+	hub.handleUnregister(alice)
+	if len(bob.send) != 0 {
+		t.Error("No removal should be sent for a state that is already gone")
+	}
+}
+
+func TestAwarenessTakenOverByReconnect(t *testing.T) {
+	hub := NewHub(nil)
+	roomID := "awareness-room"
+
+	stale := newClient(hub, nil, roomID, "stale")
+	fresh := newClient(hub, nil, roomID, "fresh")
+	peer := newClient(hub, nil, roomID, "peer")
+	hub.handleRegister(stale)
+	hub.handleRegister(fresh)
+	hub.handleRegister(peer)
+
+	// The same Yjs client reconnects before its old session is noticed dead
+	publish := func(sender *Client, clock uint64) {
+		data := protocol.EncodeAwarenessMessage([]protocol.AwarenessEntry{{ClientID: 5, Clock: clock, State: `{}`}})
+		hub.handleBroadcast(&Message{RoomID: roomID, Data: data, Sender: sender})
+	}
+	publish(stale, 1)
+	publish(fresh, 2)
+
+	for len(peer.send) > 0 {
+		<-peer.send
+	}
+	hub.handleUnregister(stale)
+	if len(peer.send) != 0 {
+		t.Error("The dead session should not remove a state its replacement now owns")
+	}
+	if len(hub.getRoomState(roomID).GetAllAwareness()) != 1 {
+		t.Error("Expected the reconnected client's state to remain")
+	}
+
+	hub.handleUnregister(fresh)
+	if len(peer.send) != 1 {
+		t.Errorf("Expected a removal once the owning session leaves, got %d messages", len(peer.send))
+	}
+}
+
+func TestAwarenessRemovedOnHardDisconnect(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?room=hard-room"
+
+	peer, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer peer.Close()
+	doomed, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	state := protocol.EncodeAwarenessMessage([]protocol.AwarenessEntry{{ClientID: 11, Clock: 4, State: `{"cursor":1}`}})
+	if err := doomed.WriteMessage(websocket.BinaryMessage, state); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Drop the TCP connection without a close frame
+	doomed.UnderlyingConn().Close()
+
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := peer.ReadMessage()
+		if err != nil {
+			t.Fatalf("Expected an awareness removal, got %v", err)
+		}
+		if data[0] != MessageAwareness || bytes.Equal(data, state) {
+			continue
+		}
+		entries, err := protocol.ParseAwarenessMessage(data)
+		if err != nil {
+			t.Fatalf("Failed to parse: %v", err)
+		}
+		if len(entries) != 1 || entries[0].ClientID != 11 || entries[0].Clock != 5 || !entries[0].Removed() {
+			t.Errorf("Unexpected removal %+v", entries)
+		}
+		return
+	}
+}
+
+// Decodes the JSON body of a control message
+func decodeControl(t *testing.T, data []byte, v interface{}) {
+	t.Helper()
+	if len(data) == 0 || data[0] != byte(protocol.MessageTypeControl) {
+		t.Fatalf("Expected a control message, got %v", data)
+	}
+	length, n := protocol.ReadVarUint(data[1:])
+	if n == 0 || int(length) != len(data)-1-n {
+		t.Fatalf("Malformed control message %v", data)
+	}
+	if err := json.Unmarshal(data[1+n:], v); err != nil {
+		t.Fatalf("Failed to decode control frame: %v", err)
+	}
+}
+
+func TestHelloFrame(t *testing.T) {
+	config := DefaultHubConfig()
+	config.MaxRoomBytes = 1000
+	hub := NewHubWithConfig(nil, config)
+
+	roomState := hub.getRoomState("hello-room")
+	roomState.AddUpdate([]byte{MessageSync, SyncUpdate, 1, 1})
+	roomState.AddUpdate([]byte{MessageSync, SyncUpdate, 1, 2})
+
+	hub.handleRegister(newClient(hub, nil, "hello-room", "first"))
+	client := newClient(hub, nil, "hello-room", "second")
+	hub.handleRegister(client)
+
+	var hello HelloFrame
+	decodeControl(t, <-client.send, &hello)
+	if hello.Type != ControlHello || hello.RoomID != "hello-room" || hello.ClientID != "second" {
+		t.Errorf("Unexpected hello %+v", hello)
+	}
+	if hello.Seq != 2 || hello.Clients != 2 {
+		t.Errorf("Expected seq 2 and 2 clients, got %d and %d", hello.Seq, hello.Clients)
+	}
+	if hello.Limits.MaxRoomBytes != 1000 || hello.Limits.MaxMessageBytes != maxMessageSize || hello.Limits.IdleTimeoutSeconds != 1800 {
+		t.Errorf("Unexpected limits %+v", hello.Limits)
+	}
+}
+
+func TestNotifyAndShutdown(t *testing.T) {
+	hub := NewHub(nil)
+
+	a := newClient(hub, nil, "room-a", "a")
+	b := newClient(hub, nil, "room-b", "b")
+	hub.rooms["room-a"] = map[*Client]bool{a: true}
+	hub.rooms["room-b"] = map[*Client]bool{b: true}
+
+	if n := hub.Notify("room-a", NoticeFrame{Type: ControlLock, Code: "locked", Message: "read only"}); n != 1 {
+		t.Errorf("Expected 1 session notified, got %d", n)
+	}
+	if len(b.send) != 0 {
+		t.Error("Notice should only reach its room")
+	}
+	var notice NoticeFrame
+	decodeControl(t, <-a.send, &notice)
+	if notice.Type != ControlLock || notice.Code != "locked" {
+		t.Errorf("Unexpected notice %+v", notice)
+	}
+
+	hub.AnnounceShutdown("restarting", 5*time.Second)
+	for _, c := range []*Client{a, b} {
+		decodeControl(t, <-c.send, &notice)
+		if notice.Type != ControlShutdown || notice.RetryAfterMs != 5000 {
+			t.Errorf("Unexpected shutdown notice %+v", notice)
+		}
+	}
+
+	// A closed session is skipped rather than panicking
+	hub.disconnect(a, closeCodeKicked, closeReasonKicked)
+	a.enqueueCatchUp([]byte{1})
+}
+
+func TestBroadcastToRoomAndSendControl(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+
+	a := newClient(hub, nil, "room-a", "a")
+	hub.register <- a
+	for len(a.send) > 0 {
+		<-a.send // Catch-up
+	}
+
+	update := protocol.EncodeUpdate([]byte{1, 2, 3})
+	if err := hub.BroadcastToRoom("room-a", update); err != nil {
+		t.Fatalf("BroadcastToRoom failed: %v", err)
+	}
+	select {
+	case got := <-a.send:
+		if !bytes.Equal(got, update) {
+			t.Errorf("Expected the update, got %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the update to reach the room")
+	}
+	if _, seq := hub.getRoomState("room-a").Position(); seq != 1 {
+		t.Errorf("Expected the update to be stored, position %d", seq)
+	}
+
+	frame := map[string]string{"type": "restored", "version": "7"}
+	if n := hub.SendControl("room-a", frame); n != 1 {
+		t.Errorf("Expected 1 session, got %d", n)
+	}
+	var got map[string]string
+	decodeControl(t, <-a.send, &got)
+	if got["type"] != "restored" || got["version"] != "7" {
+		t.Errorf("Unexpected control frame %v", got)
+	}
+	if n := hub.SendControl("room-b", frame); n != 0 {
+		t.Errorf("Expected no sessions in an empty room, got %d", n)
+	}
+
+	hub.Stop()
+	if err := hub.BroadcastToRoom("room-a", update); !errors.Is(err, ErrHubStopped) {
+		t.Errorf("Expected ErrHubStopped, got %v", err)
+	}
+}
+
+func TestRoomStateSpill(t *testing.T) {
+	roomState := NewRoomState()
+	roomState.maxResident = 10
+
+	for i := 0; i < 5; i++ {
+		if seq := roomState.AddUpdate([]byte{MessageSync, SyncUpdate, 1, byte(i)}); seq != i+1 {
+			t.Errorf("Expected sequence %d, got %d", i+1, seq)
+		}
+	}
+
+	if _, seq := roomState.Position(); seq != 5 {
+		t.Errorf("Expected position 5, got %d", seq)
+	}
+	if got := roomState.ResidentBytes(); got != 8 {
+		t.Errorf("Expected 8 resident bytes, got %d", got)
+	}
+	if got := roomState.Bytes(); got != 20 {
+		t.Errorf("Expected the quota to count all 20 bytes, got %d", got)
+	}
+
+	updates, complete := roomState.ResidentUpdates()
+	if complete || len(updates) != 2 || updates[0][3] != 3 {
+		t.Errorf("Expected updates 4 and 5 in memory, got %v (complete %v)", updates, complete)
+	}
+
+	epoch, _ := roomState.Position()
+	if _, ok := roomState.UpdatesSince(epoch, 2); ok {
+		t.Error("Expected resume from a spilled position to fail")
+	}
+	if missed, ok := roomState.UpdatesSince(epoch, 3); !ok || len(missed) != 2 {
+		t.Errorf("Expected 2 missed updates after 3, got %d (ok %v)", len(missed), ok)
+	}
+
+	if refill, from := roomState.UpdateRange(1, 5); from != 4 || len(refill) != 2 {
+		t.Errorf("Expected refill clipped to 4-5, got %d updates from %d", len(refill), from)
+	}
+
+	// A single update larger than the cap is still kept
+	roomState.AddUpdate(make([]byte, 32))
+	if updates, _ := roomState.ResidentUpdates(); len(updates) != 1 {
+		t.Errorf("Expected only the newest update in memory, got %d", len(updates))
+	}
+}
+
+func TestRoomStateReplaceWithSnapshot(t *testing.T) {
+	roomState := NewRoomState()
+	for i := 0; i < 4; i++ {
+		roomState.AddUpdate([]byte{byte(i)})
+	}
+	epoch, _ := roomState.Position()
+
+	// A snapshot of as many updates keeps positions valid
+	if !roomState.ReplaceWithSnapshot([][]byte{{10}, {11}}, 2) {
+		t.Fatal("Expected the snapshot to be applied")
+	}
+	if got, seq := roomState.Position(); got != epoch || seq != 4 {
+		t.Errorf("Expected epoch kept at position 4, got %d at %d", got, seq)
+	}
+	if updates := roomState.GetUpdates(); len(updates) != 4 || updates[0][0] != 10 || updates[2][0] != 2 {
+		t.Errorf("Expected the snapshot then updates 3 and 4, got %v", updates)
+	}
+
+	// A snapshot that folds updates together renumbers the history
+	if !roomState.ReplaceWithSnapshot([][]byte{{12}}, 3) {
+		t.Fatal("Expected the snapshot to be applied")
+	}
+	if got, seq := roomState.Position(); got == epoch || seq != 2 {
+		t.Errorf("Expected a new epoch at position 2, got %d at %d", got, seq)
+	}
+	if roomState.Bytes() != 2 {
+		t.Errorf("Expected 2 bytes, got %d", roomState.Bytes())
+	}
+
+	if roomState.ReplaceWithSnapshot([][]byte{{13}}, 3) {
+		t.Error("Expected a snapshot covering more than the history to be refused")
+	}
+
+	roomState.maxResident = 1
+	roomState.AddUpdate([]byte{5})
+	if roomState.ReplaceWithSnapshot([][]byte{{14}}, 1) {
+		t.Error("Expected a snapshot covering fewer than the spilled updates to be refused")
+	}
+}
+
+func TestCompactionReplacesRoomState(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	ctx := context.Background()
+
+	roomID := "compacted"
+	if err := database.CreateRoom(ctx, roomID, ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	hub := NewHub(database)
+	go hub.Run()
+	defer hub.Stop()
+
+	config := compaction.DefaultConfig()
+	config.UpdateThreshold = 3
+	config.KeepRecentUpdates = 2
+	service := compaction.New(database, config)
+	service.SetListener(hub)
+
+	frames := make([][]byte, 6)
+	for i := range frames {
+		frames[i] = protocol.EncodeUpdate([]byte{byte(i)})
+	}
+	if _, err := hub.ApplyUpdates(roomID, frames); err != nil {
+		t.Fatalf("ApplyUpdates failed: %v", err)
+	}
+	if err := hub.writer.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	before := hub.getRoomState(roomID).GetUpdates()
+	epoch, _ := hub.getRoomState(roomID).Position()
+
+	result, err := service.CompactNow(ctx, roomID)
+	if err != nil || !result.Compacted {
+		t.Fatalf("Expected the room compacted, got %+v (err %v)", result, err)
+	}
+
+	// Memory now holds the snapshot's updates followed by the kept ones,
+	// as a room loaded from the database would
+	after := hub.getRoomState(roomID).GetUpdates()
+	if len(after) != len(before) {
+		t.Fatalf("Expected %d updates, got %d", len(before), len(after))
+	}
+	for i := range after {
+		if !bytes.Equal(after[i], before[i]) {
+			t.Errorf("Update %d changed: %v, want %v", i, after[i], before[i])
+		}
+	}
+
+	if got, seq := hub.getRoomState(roomID).Position(); got != epoch || seq != 6 {
+		t.Errorf("Expected resume positions kept, got epoch %d at %d", got, seq)
+	}
+
+	snapshot, count, err := database.GetSnapshot(ctx, roomID)
+	if err != nil {
+		t.Fatalf("GetSnapshot failed: %v", err)
+	}
+	if got := len(compaction.SplitMergedUpdates(snapshot)); got != 4 || count != 4 {
+		t.Errorf("Expected a snapshot of 4 updates, got %d frames (count %d)", got, count)
+	}
+}
+
+func TestCatchUpFromDatabase(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+
+	roomID := "spill-room"
+	if err := database.CreateRoom(context.Background(), roomID, ""); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	config := DefaultHubConfig()
+	config.WriteBehind.FlushInterval = time.Hour
+	config.MaxResidentBytes = 12
+	hub := NewHubWithConfig(database, config)
+	defer hub.Stop()
+
+	for i := 0; i < 10; i++ {
+		hub.handleBroadcast(&Message{RoomID: roomID, Data: []byte{MessageSync, SyncUpdate, 1, byte(i)}})
+	}
+	if updates, _ := hub.getRoomState(roomID).ResidentUpdates(); len(updates) != 3 {
+		t.Fatalf("Expected 3 updates in memory, got %d", len(updates))
+	}
+
+	client := newClient(hub, nil, roomID, "late")
+	hub.handleRegister(client)
+
+	// The history is streamed off the hub goroutine; the token ends it
+	var received [][]byte
+	timeout := time.After(5 * time.Second)
+	for len(received) == 0 || received[len(received)-1][0] != byte(protocol.MessageTypeResume) {
+		select {
+		case message := <-client.send:
+			received = append(received, message)
+		case <-timeout:
+			t.Fatalf("Timed out after %d messages waiting for the resume token", len(received))
+		}
+	}
+
+	// Hello, every update from the database in order, then the resume token
+	if len(received) != 12 {
+		t.Fatalf("Expected a hello, 10 updates and a token, got %d messages", len(received))
+	}
+	for i, update := range received[1:11] {
+		if update[0] != MessageSync || update[3] != byte(i) {
+			t.Errorf("Update %d out of order: %v", i, update)
+		}
+	}
+	if received[11][0] != byte(protocol.MessageTypeResume) {
+		t.Errorf("Expected resume token last, got message type %d", received[11][0])
+	}
+}
+
+func TestProfileUpdatesReachAwareness(t *testing.T) {
+	hub := NewHub(nil)
+	ada := newClient(hub, nil, "profile-room", "ada")
+	peer := newClient(hub, nil, "profile-room", "peer")
+	for _, client := range []*Client{ada, peer} {
+		hub.handleRegister(client)
+		queued(client)
+	}
+	ada.identity = &auth.Identity{ID: "user-1", Name: "Ada", Color: "#112233"}
+
+	// The identity replaces whatever user the client claims
+	hub.handleBroadcast(&Message{
+		RoomID: "profile-room",
+		Sender: ada,
+		Data: protocol.EncodeAwarenessMessage([]protocol.AwarenessEntry{{
+			ClientID: 7, Clock: 1, State: `{"cursor":3,"user":{"name":"Mallory","color":"#000000"}}`,
+		}}),
+	})
+	got := queued(peer)
+	if len(got) != 1 {
+		t.Fatalf("Expected the awareness update, got %v", got)
+	}
+	entries, err := protocol.ParseAwarenessMessage(got[0])
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Failed to parse awareness: %v", err)
+	}
+	if want := `{"cursor":3,"user":{"color":"#112233","id":"user-1","name":"Ada"}}`; entries[0].State != want {
+		t.Errorf("Expected state %s, got %s", want, entries[0].State)
+	}
+
+	// A profile change restamps the stored state under a newer clock
+	if n := hub.UpdateIdentity(&auth.Identity{ID: "user-1", Name: "Ada L.", Color: "#112233"}); n != 1 {
+		t.Errorf("Expected one session updated, got %d", n)
+	}
+	if identity := ada.getIdentity(); identity.Name != "Ada L." {
+		t.Errorf("Expected the session renamed, got %q", identity.Name)
+	}
+	got = queued(peer)
+	if len(got) != 1 {
+		t.Fatalf("Expected the restamped awareness, got %v", got)
+	}
+	entries, _ = protocol.ParseAwarenessMessage(got[0])
+	if len(entries) != 1 || entries[0].Clock != 2 || !strings.Contains(entries[0].State, `"name":"Ada L."`) {
+		t.Errorf("Unexpected restamped awareness %+v", entries)
+	}
+
+	if n := hub.UpdateIdentity(&auth.Identity{ID: "user-2", Name: "Grace"}); n != 0 {
+		t.Errorf("Expected no sessions for another user, got %d", n)
+	}
+}
+
+func TestWorkspaceRooms(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	ctx := context.Background()
+
+	_, member, _ := database.CreateUser(ctx, "Ada", "#112233", nil)
+	_, outsider, _ := database.CreateUser(ctx, "Bob", "#445566", nil)
+	if _, err := database.CreateWorkspace(ctx, "team", "Team", member.ID); err != nil {
+		t.Fatalf("Failed to create workspace: %v", err)
+	}
+	if _, err := database.SetWorkspaceQuota(ctx, "team", 0, 8); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+	if err := database.AddRoomToWorkspace(ctx, "team", "team-room", ""); err != nil {
+		t.Fatalf("Failed to add room: %v", err)
+	}
+
+	issuer := auth.NewIssuer([]byte("test-key"), time.Hour)
+	hub := NewHub(database)
+	defer hub.Stop()
+	hub.SetIdentityVerifier(issuer)
+
+	memberToken, _, _ := issuer.IssueFor(member.ID, member.Name, member.Color)
+	outsiderToken, _, _ := issuer.IssueFor(outsider.ID, outsider.Name, outsider.Color)
+	for token, want := range map[string]bool{memberToken: true, outsiderToken: false, "": false} {
+		if got := hub.checkWorkspace(ctx, "team-room", token); got != want {
+			t.Errorf("Expected access %v, got %v", want, got)
+		}
+	}
+	if !hub.checkWorkspace(ctx, "public-room", "") {
+		t.Error("Expected rooms outside workspaces to stay open")
+	}
+
+	// The workspace's limit replaces the hub's
+	roomState := hub.getRoomState("team-room")
+	if got := hub.roomQuota(roomState); got != 8 {
+		t.Errorf("Expected the workspace quota, got %d", got)
+	}
+	hub.SetRoomQuota("team-room", 0)
+	if got := hub.roomQuota(roomState); got != hub.MaxRoomBytes() {
+		t.Errorf("Expected the hub quota after clearing, got %d", got)
+	}
+}
+
+func TestApplyUpdatesWorkspaceQuota(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	ctx := context.Background()
+
+	_, owner, _ := database.CreateUser(ctx, "Ada", "#112233", nil)
+	if _, err := database.CreateWorkspace(ctx, "team", "Team", owner.ID); err != nil {
+		t.Fatalf("Failed to create workspace: %v", err)
+	}
+	if _, err := database.SetWorkspaceQuota(ctx, "team", 0, 8); err != nil {
+		t.Fatalf("Failed to set quota: %v", err)
+	}
+	if err := database.AddRoomToWorkspace(ctx, "team", "team-room", ""); err != nil {
+		t.Fatalf("Failed to add room: %v", err)
+	}
+
+	// Tighter than the hub's quota, and enforced when the hub has none
+	for _, hubLimit := range []int64{1 << 20, 0} {
+		config := DefaultHubConfig()
+		config.MaxRoomBytes = hubLimit
+		hub := NewHubWithConfig(database, config)
+		go hub.Run()
+
+		// Each frame fits on its own, but not both
+		frames := [][]byte{protocol.EncodeUpdate([]byte{1, 2, 3}), protocol.EncodeUpdate([]byte{4, 5, 6})}
+		seqs, err := hub.ApplyUpdates("team-room", frames)
+		if !errors.Is(err, ErrRoomQuotaExceeded) {
+			t.Errorf("Hub quota %d: expected the batch rejected whole, got seqs %v and %v", hubLimit, seqs, err)
+		}
+		if bytes := hub.RoomBytes("team-room"); bytes != 0 {
+			t.Errorf("Hub quota %d: expected nothing applied, got %d bytes", hubLimit, bytes)
+		}
+		hub.Stop()
+	}
+}
+
+func TestColdRoomsVerifiedBeforeLoading(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	ctx := context.Background()
+
+	// The second update's payload is truncated
+	if err := database.SaveUpdates(ctx, "cold", [][]byte{{0, 2, 2, 1, 1}, {0, 2, 5, 1, 1}}); err != nil {
+		t.Fatalf("Failed to save updates: %v", err)
+	}
+
+	hub := NewHub(database)
+	go hub.Run()
+	defer hub.Stop()
+
+	if _, err := hub.ApplyUpdates("cold", nil); err != nil {
+		t.Fatalf("ApplyUpdates failed: %v", err)
+	}
+	if count, _ := database.GetQuarantineCount(ctx, "cold"); count != 1 {
+		t.Errorf("Expected the truncated update quarantined, got %d", count)
+	}
+	if updates := hub.getRoomState("cold").GetUpdates(); len(updates) != 1 {
+		t.Errorf("Expected only the valid update loaded, got %d", len(updates))
+	}
+}
+
+func TestStrictRooms(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	if err := database.CreateRoom(context.Background(), "planned", "Planned"); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+
+	config := DefaultHubConfig()
+	config.StrictRooms = true
+	hub := NewHubWithConfig(database, config)
+	go hub.Run()
+	defer hub.Stop()
+	url := startIntegrationServer(t, hub)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?room=typo", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected an unknown room to be refused with 404, got %v", err)
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body.Code != "ROOM_NOT_FOUND" {
+		t.Errorf("Expected ROOM_NOT_FOUND, got %q", body.Code)
+	}
+	if room, _ := database.GetRoom(context.Background(), "typo"); room != nil {
+		t.Error("A refused connection should not create the room")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?room=planned", nil)
+	if err != nil {
+		t.Fatalf("Expected an existing room to be joinable, got %v", err)
+	}
+	conn.Close()
+}
+
+func TestRoomIDRules(t *testing.T) {
+	config := DefaultHubConfig()
+	config.RoomIDs = RoomIDConfig{MaxLength: 12, Pattern: regexp.MustCompile(`^team-`)}
+	hub := NewHubWithConfig(nil, config)
+	go hub.Run()
+	defer hub.Stop()
+
+	for id, want := range map[string]string{
+		"team-a":        "",
+		"":              ErrRoomIDRequired.Error(),
+		"team-abcdefgh": "room ID must be at most 12 characters",
+		"team a":        "room ID may only contain letters, digits, '.', '_' and '-'",
+		"notes":         "room ID must match ^team-",
+	} {
+		err := hub.CheckRoomID(id)
+		if got := fmt.Sprint(err); (err == nil) != (want == "") || (err != nil && got != want) {
+			t.Errorf("%q: expected %q, got %v", id, want, err)
+		}
+	}
+	if err := (RoomIDConfig{MaxLength: MaxRoomIDLength + 1}).Validate(); err == nil {
+		t.Error("Expected a max length above the limit to be rejected")
+	}
+
+	// Sessions that name no room are refused rather than sharing one, as
+	// are new rooms the rules refuse
+	url := startIntegrationServer(t, hub)
+	for query, want := range map[string]string{"": "room is required", "?room=notes": "room ID must match ^team-"} {
+		refused, _, err := websocket.DefaultDialer.Dial(url+query, nil)
+		if err != nil {
+			t.Fatalf("%q: expected the upgrade to succeed before the close, got %v", query, err)
+		}
+		refused.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err = refused.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != closeCodeInvalidRoom || closeErr.Text != want {
+			t.Errorf("%q: expected close %d %q, got %v", query, closeCodeInvalidRoom, want, err)
+		}
+		refused.Close()
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?room=team-a", nil)
+	if err != nil {
+		t.Fatalf("Expected a valid room ID to connect, got %v", err)
+	}
+	conn.Close()
+
+	// Rooms that already exist stay reachable under narrower rules
+	hub.getRoomState("legacy-room")
+	conn, _, err = websocket.DefaultDialer.Dial(url+"?room=legacy-room", nil)
+	if err != nil {
+		t.Fatalf("Expected an existing room to connect, got %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Errorf("Expected a hello from the existing room, got %v", err)
+	}
+	conn.Close()
+
+	// SSE streams get the same code as a close event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ServeSSE(hub, w, r) }))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "?room=notes")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+	if event, data := readSSEEvent(t, bufio.NewReader(resp.Body)); event != "close" || data != "4011 room ID must match ^team-" {
+		t.Errorf("Expected a close event, got %q %q", event, data)
+	}
+}
+
+func TestOriginsAndSubprotocol(t *testing.T) {
+	origins, err := origin.Parse("https://app.example.com")
+	if err != nil {
+		t.Fatalf("Failed to parse origins: %v", err)
+	}
+	config := DefaultHubConfig()
+	config.Origins = origins
+	hub := NewHubWithConfig(nil, config)
+	go hub.Run()
+	defer hub.Stop()
+	url := startIntegrationServer(t, hub) + "?room=origins"
+
+	header := http.Header{"Origin": {"https://evil.example.net"}}
+	_, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a foreign origin to be refused with 403, got %v", err)
+	}
+	var body struct {
+		Code    string `json:"code"`
+		Details struct {
+			Supported []string `json:"supported"`
+		} `json:"details"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body.Code != "ORIGIN_NOT_ALLOWED" {
+		t.Errorf("Expected ORIGIN_NOT_ALLOWED, got %q", body.Code)
+	}
+
+	// An allowed page negotiates the subprotocol it offers
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{"lattice-v2", Subprotocol}
+	conn, _, err := dialer.Dial(url, http.Header{"Origin": {"https://app.example.com"}})
+	if err != nil {
+		t.Fatalf("Expected an allowed origin to connect, got %v", err)
+	}
+	if conn.Subprotocol() != Subprotocol {
+		t.Errorf("Expected %s to be negotiated, got %q", Subprotocol, conn.Subprotocol())
+	}
+	conn.Close()
+
+	// Clients outside a browser send no Origin and may offer no subprotocol
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Expected a client without an origin to connect, got %v", err)
+	}
+	conn.Close()
+
+	dialer.Subprotocols = []string{"lattice-v2"}
+	_, resp, err = dialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected an unknown subprotocol to be refused with 400, got %v", err)
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body.Code != "UNSUPPORTED_PROTOCOL" || len(body.Details.Supported) != 1 || body.Details.Supported[0] != Subprotocol {
+		t.Errorf("Expected UNSUPPORTED_PROTOCOL listing %s, got %+v", Subprotocol, body)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		query        string
+		extensions   string
+		ok           bool
+		capabilities []string
+	}{
+		{"room=a", "", true, []string{CapabilityResume}},
+		{"room=a&batch=1&seq=1", "", true, []string{CapabilityBatch, CapabilityResume, CapabilitySequence}},
+		{"room=a&v=1", "", true, []string{}},
+		{"room=a&v=1&caps=seq,%20resume,unknown,batch", "", true, []string{CapabilityBatch, CapabilityResume, CapabilitySequence}},
+		{"room=a&v=1&caps=compression", "", true, []string{}},
+		{"room=a&v=1&caps=compression", "permessage-deflate; client_max_window_bits", true, []string{CapabilityCompression}},
+		{"room=a&v=1&batch=1", "", true, []string{}},
+		{"room=a&v=2", "", false, nil},
+		{"room=a&v=one", "", false, nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/ws?"+tt.query, nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		if tt.extensions != "" {
+			r.Header.Set("Sec-WebSocket-Extensions", tt.extensions)
+		}
+		session, ok := negotiate(r)
+		if ok != tt.ok {
+			t.Errorf("%s: expected ok %v, got %v", tt.query, tt.ok, ok)
+			continue
+		}
+		if ok && (session.Version != 1 || strings.Join(session.Capabilities, ",") != strings.Join(tt.capabilities, ",")) {
+			t.Errorf("%s: expected version 1 with %v, got %+v", tt.query, tt.capabilities, session)
+		}
+	}
+}
+
+func TestProtocolHandshake(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+	defer hub.Stop()
+	url := startIntegrationServer(t, hub) + "?room=handshake"
+
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	conn, _, err := dialer.Dial(url+"&v=1&caps=compression,batch,teleport", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Expected a hello, got %v", err)
+	}
+	var hello HelloFrame
+	decodeControl(t, data, &hello)
+	if hello.Version != 1 || strings.Join(hello.Capabilities, ",") != "batch,compression" {
+		t.Errorf("Expected version 1 with batch and compression, got %d %v", hello.Version, hello.Capabilities)
+	}
+
+	// Without resume, catch-up ends without a token
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, data, err := conn.ReadMessage(); err == nil && protocol.MessageType(data[0]) == protocol.MessageTypeResume {
+		t.Error("Expected no resume token without the resume capability")
+	}
+
+	// A version the server can't speak is refused with a typed close
+	refused, _, err := websocket.DefaultDialer.Dial(url+"&v=2", nil)
+	if err != nil {
+		t.Fatalf("Expected the upgrade to succeed before the close, got %v", err)
+	}
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = refused.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeCodeUnsupportedVersion || !strings.Contains(closeErr.Text, "supported: 1") {
+		t.Errorf("Expected close %d listing supported versions, got %v", closeCodeUnsupportedVersion, err)
+	}
+}
+
+// Owns the rooms it lists; the rest belong to owner
+type stubRouter struct {
+	owned map[string]bool
+	owner string
+}
+
+func (r stubRouter) RouteRoom(roomID string) (string, bool) {
+	if r.owned[roomID] {
+		return "", true
+	}
+	return r.owner, false
+}
+
+func TestShardRedirect(t *testing.T) {
+	hub := NewHub(nil)
+	hub.SetRoomRouter(stubRouter{owned: map[string]bool{"mine": true}, owner: "https://b.example.com"})
+	go hub.Run()
+	defer hub.Stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) { ServeWs(hub, w, r) })
+	mux.HandleFunc("/sse", func(w http.ResponseWriter, r *http.Request) { ServeSSE(hub, w, r) })
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	// Owned rooms are served here
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?room=mine", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	var hello HelloFrame
+	decodeControl(t, data, &hello)
+	if hello.Type != ControlHello {
+		t.Errorf("Expected a hello, got %+v", hello)
+	}
+	conn.Close()
+
+	// Others get a redirect frame, then the redirect close
+	redirected, _, err := websocket.DefaultDialer.Dial(wsURL+"?room=theirs&v=1", nil)
+	if err != nil {
+		t.Fatalf("Expected the upgrade to succeed before the close, got %v", err)
+	}
+	defer redirected.Close()
+	redirected.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err = redirected.ReadMessage()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	var frame RedirectFrame
+	decodeControl(t, data, &frame)
+	if frame.Type != ControlRedirect || frame.RoomID != "theirs" || frame.URL != "wss://b.example.com/ws" {
+		t.Errorf("Unexpected redirect frame %+v", frame)
+	}
+	_, _, err = redirected.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeCodeRedirect {
+		t.Errorf("Expected close %d, got %v", closeCodeRedirect, err)
+	}
+
+	// Requests that aren't WebSocket handshakes are answered with a 307
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(server.URL + "/sse?room=theirs&v=1")
+	if err != nil {
+		t.Fatalf("SSE request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "https://b.example.com/sse?room=theirs&v=1" {
+		t.Errorf("Expected a 307 to the owner, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
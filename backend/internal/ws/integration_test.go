@@ -0,0 +1,499 @@
+package ws
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gorilla/websocket"
+	"github.com/manpreetbhatti/lattice/backend/internal/db"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+	"github.com/manpreetbhatti/lattice/backend/internal/tracing"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Yjs v1 updates for a short editing session on the root text "content",
+// byte for byte as Y.Doc emits them from its update event. Client IDs are
+// 1013 (A), 2290 (B) and 3517 (C).
+var (
+	// A types "hello" into the empty document
+	yjsHello = []byte{
+		0x01,             // one client with structs
+		0x01,             // one struct
+		0xf5, 0x07, 0x00, // client A, clock 0
+		0x04,                                          // string item without origins
+		0x01, 0x07, 'c', 'o', 'n', 't', 'e', 'n', 't', // parent is the root type "content"
+		0x05, 'h', 'e', 'l', 'l', 'o',
+		0x00, // empty delete set
+	}
+
+	// B appends " world" after A's "o" (A, clock 4)
+	yjsWorld = []byte{
+		0x01, 0x01,
+		0xf2, 0x11, 0x00, // client B, clock 0
+		0x84,             // string item with a left origin
+		0xf5, 0x07, 0x04, // origin A:4
+		0x06, ' ', 'w', 'o', 'r', 'l', 'd',
+		0x00,
+	}
+
+	// C appends "!" after A's "o" at the same time, without having seen B's
+	// edit, so the two inserts conflict
+	yjsBang = []byte{
+		0x01, 0x01,
+		0xbd, 0x1b, 0x00, // client C, clock 0
+		0x84,
+		0xf5, 0x07, 0x04, // origin A:4
+		0x01, '!',
+		0x00,
+	}
+
+	// A inserts "," between its "o" and B's " world"
+	yjsComma = []byte{
+		0x01, 0x01,
+		0xf5, 0x07, 0x05, // client A, clock 5
+		0xc4,             // string item with left and right origins
+		0xf5, 0x07, 0x04, // origin A:4
+		0xf2, 0x11, 0x00, // right origin B:0
+		0x01, ',',
+		0x00,
+	}
+
+	// B deletes C's "!": no structs, one deleted range
+	yjsDeleteBang = []byte{
+		0x00,             // no structs
+		0x01,             // one client in the delete set
+		0xbd, 0x1b, 0x01, // client C, one range
+		0x00, 0x01, // clock 0, length 1
+	}
+)
+
+// A Yjs text replica that integrates the string items and deletions in the
+// fixtures, enough to check that every peer ends up with the same text.
+// Items are split into characters, each placed after its origin and after
+// any concurrent siblings from lower client IDs, as Yjs orders them.
+type yjsText struct {
+	chars   []yjsChar
+	deleted map[yjsID]bool
+}
+
+type yjsID struct{ client, clock uint64 }
+
+type yjsChar struct {
+	id     yjsID
+	origin *yjsID
+	char   string
+}
+
+func newYjsText() *yjsText {
+	return &yjsText{deleted: map[yjsID]bool{}}
+}
+
+func (d *yjsText) String() string {
+	var b strings.Builder
+	for _, c := range d.chars {
+		if !d.deleted[c.id] {
+			b.WriteString(c.char)
+		}
+	}
+	return b.String()
+}
+
+func (d *yjsText) index(id yjsID) int {
+	for i, c := range d.chars {
+		if c.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Integrates a v1 update. Updates must arrive in causal order, which the
+// server guarantees, so a missing origin is an error rather than pending.
+func (d *yjsText) apply(update []byte) error {
+	r := &yjsReader{data: update}
+	clients := r.uint()
+	for i := uint64(0); i < clients; i++ {
+		structs, client, clock := r.uint(), r.uint(), r.uint()
+		for j := uint64(0); j < structs; j++ {
+			info := r.byte()
+			if info&0x1f != 4 {
+				return fmt.Errorf("unsupported struct type %d", info&0x1f)
+			}
+
+			var origin *yjsID
+			if info&0x80 != 0 {
+				origin = &yjsID{r.uint(), r.uint()}
+			}
+			if info&0x40 != 0 {
+				r.uint() // Right origin; only needed for concurrent inserts before an item
+				r.uint()
+			}
+			if info&0xc0 == 0 {
+				if r.uint() != 1 || r.string() != "content" {
+					return fmt.Errorf("expected the root text type")
+				}
+			}
+
+			for _, ch := range r.string() {
+				id := yjsID{client, clock}
+				clock += uint64(len(utf16.Encode([]rune{ch})))
+				if d.index(id) >= 0 {
+					continue // Already integrated
+				}
+				if err := d.insert(yjsChar{id: id, origin: origin, char: string(ch)}); err != nil {
+					return err
+				}
+				origin = &id
+			}
+		}
+	}
+
+	clients = r.uint()
+	for i := uint64(0); i < clients; i++ {
+		client, ranges := r.uint(), r.uint()
+		for j := uint64(0); j < ranges; j++ {
+			clock, length := r.uint(), r.uint()
+			for k := uint64(0); k < length; k++ {
+				d.deleted[yjsID{client, clock + k}] = true
+			}
+		}
+	}
+	return r.err
+}
+
+func (d *yjsText) insert(c yjsChar) error {
+	pos := 0
+	if c.origin != nil {
+		pos = d.index(*c.origin) + 1
+		if pos == 0 {
+			return fmt.Errorf("origin %v of %v not integrated", *c.origin, c.id)
+		}
+	}
+
+	// Skip concurrent siblings that sort first, with everything after them
+	skipped := map[yjsID]bool{}
+	for ; pos < len(d.chars); pos++ {
+		next := d.chars[pos]
+		sibling := sameOrigin(next.origin, c.origin) && next.id.client < c.id.client
+		if !sibling && (next.origin == nil || !skipped[*next.origin]) {
+			break
+		}
+		skipped[next.id] = true
+	}
+
+	d.chars = append(d.chars, yjsChar{})
+	copy(d.chars[pos+1:], d.chars[pos:])
+	d.chars[pos] = c
+	return nil
+}
+
+func sameOrigin(a, b *yjsID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+type yjsReader struct {
+	data []byte
+	err  error
+}
+
+func (r *yjsReader) byte() byte {
+	if len(r.data) == 0 {
+		r.err = fmt.Errorf("update truncated")
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *yjsReader) uint() uint64 {
+	v, n := protocol.ReadVarUint(r.data)
+	if n == 0 {
+		r.err = fmt.Errorf("update truncated")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *yjsReader) string() string {
+	n := r.uint()
+	if uint64(len(r.data)) < n {
+		r.err = fmt.Errorf("update truncated")
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+// A peer connected through the real WebSocket endpoint, keeping its own
+// replica of the document
+type yjsPeer struct {
+	t      *testing.T
+	conn   *websocket.Conn
+	doc    *yjsText
+	resume string // Latest resume token from the server
+	synced int    // Updates received since connecting
+}
+
+func dialPeer(t *testing.T, url string, doc *yjsText) *yjsPeer {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	if doc == nil {
+		doc = newYjsText()
+	}
+	return &yjsPeer{t: t, conn: conn, doc: doc}
+}
+
+// Applies a local edit and sends it to the room
+func (p *yjsPeer) edit(update []byte) {
+	p.t.Helper()
+	if err := p.doc.apply(update); err != nil {
+		p.t.Fatalf("Failed to apply local edit: %v", err)
+	}
+	if err := p.conn.WriteMessage(websocket.BinaryMessage, protocol.EncodeUpdate(update)); err != nil {
+		p.t.Fatalf("Write failed: %v", err)
+	}
+}
+
+// Reads from the server until the replica reads text. Catch-up ends with
+// a resume token, so a peer that has not had one yet also waits for it.
+func (p *yjsPeer) waitFor(text string) {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for p.doc.String() != text || p.resume == "" {
+		_, data, err := p.conn.ReadMessage()
+		if err != nil {
+			p.t.Fatalf("Expected %q, have %q: %v", text, p.doc.String(), err)
+		}
+
+		switch protocol.MessageType(data[0]) {
+		case protocol.MessageTypeSync:
+			if update, ok := protocol.UpdatePayload(data); ok {
+				if err := p.doc.apply(update); err != nil {
+					p.t.Fatalf("Failed to apply update from server: %v", err)
+				}
+				p.synced++
+			}
+		case protocol.MessageTypeResume:
+			_, n := protocol.ReadVarUint(data[1:])
+			p.resume = string(data[1+n:])
+		}
+	}
+}
+
+func startIntegrationServer(t *testing.T, hub *Hub) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestYjsFixtures(t *testing.T) {
+	// The first fixture is what the server itself encodes for seeding rooms
+	if !bytes.Equal(yjsHello, protocol.EncodeTextInsert(1013, 0, "hello")) {
+		t.Error("Expected the hello fixture to match EncodeTextInsert")
+	}
+
+	// Concurrent inserts at the same spot converge whichever arrives first
+	for _, order := range [][][]byte{
+		{yjsHello, yjsWorld, yjsBang, yjsComma, yjsDeleteBang},
+		{yjsHello, yjsBang, yjsWorld, yjsDeleteBang, yjsComma},
+	} {
+		doc := newYjsText()
+		for _, update := range order {
+			if err := doc.apply(update); err != nil {
+				t.Fatalf("Failed to apply fixture: %v", err)
+			}
+		}
+		if got := doc.String(); got != "hello, world" {
+			t.Errorf("Expected %q, got %q", "hello, world", got)
+		}
+	}
+}
+
+func TestIntegrationConvergence(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+	defer hub.Stop()
+	url := startIntegrationServer(t, hub) + "?room=converge"
+
+	a, b, c := dialPeer(t, url, nil), dialPeer(t, url, nil), dialPeer(t, url, nil)
+	for _, peer := range []*yjsPeer{a, b, c} {
+		defer peer.conn.Close()
+		peer.waitFor("")
+	}
+
+	a.edit(yjsHello)
+	b.waitFor("hello")
+	c.waitFor("hello")
+
+	// B and C edit the same spot before seeing each other's change
+	b.edit(yjsWorld)
+	c.edit(yjsBang)
+	for _, peer := range []*yjsPeer{a, b, c} {
+		peer.waitFor("hello world!")
+	}
+
+	a.edit(yjsComma)
+	b.edit(yjsDeleteBang)
+	for _, peer := range []*yjsPeer{a, b, c} {
+		peer.waitFor("hello, world")
+	}
+
+	// A late joiner catches up from the room's history, in order
+	late := dialPeer(t, url, nil)
+	defer late.conn.Close()
+	late.waitFor("hello, world")
+	if late.synced != 5 {
+		t.Errorf("Expected 5 updates in catch-up, got %d", late.synced)
+	}
+}
+
+func TestIntegrationReconnect(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+
+	hub := NewHub(database)
+	go hub.Run()
+	url := startIntegrationServer(t, hub) + "?room=reconnect"
+
+	a := dialPeer(t, url, nil)
+	defer a.conn.Close()
+	a.waitFor("")
+	a.edit(yjsHello)
+
+	b := dialPeer(t, url, nil)
+	b.waitFor("hello")
+	token := b.resume
+	b.conn.Close()
+
+	// C edits while B is away
+	c := dialPeer(t, url, nil)
+	defer c.conn.Close()
+	c.waitFor("hello")
+	c.edit(yjsBang)
+	a.waitFor("hello!")
+
+	// B resumes with its replica and only receives what it missed
+	b = dialPeer(t, url+"&resume="+token, b.doc)
+	b.waitFor("hello!")
+	if b.synced != 1 {
+		t.Errorf("Expected only the missed update on resume, got %d", b.synced)
+	}
+
+	b.edit(yjsWorld)
+	for _, peer := range []*yjsPeer{a, b, c} {
+		peer.waitFor("hello world!")
+	}
+	b.conn.Close()
+
+	// After a restart the room is rebuilt from the database
+	hub.Stop()
+	restarted := NewHub(database)
+	go restarted.Run()
+	defer restarted.Stop()
+	fresh := dialPeer(t, startIntegrationServer(t, restarted)+"?room=reconnect", nil)
+	defer fresh.conn.Close()
+	fresh.waitFor("hello world!")
+}
+
+func TestIntegrationTracing(t *testing.T) {
+	var mu sync.Mutex
+	spans := map[string]*tracepb.Span{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		var req coltracepb.ExportTraceServiceRequest
+		if err == nil {
+			err = proto.Unmarshal(body, &req)
+		}
+		if err != nil {
+			t.Errorf("Failed to decode export: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spans[span.Name] = span
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	config := tracing.DefaultConfig()
+	config.Endpoint = collector.URL
+	tracer, err := tracing.New(config)
+	if err != nil {
+		t.Fatalf("Failed to create tracer: %v", err)
+	}
+	tracing.SetDefault(tracer)
+	defer tracing.SetDefault(nil)
+
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+
+	hub := NewHub(database)
+	go hub.Run()
+	url := startIntegrationServer(t, hub) + "?room=traced"
+
+	a, b := dialPeer(t, url, nil), dialPeer(t, url, nil)
+	defer a.conn.Close()
+	defer b.conn.Close()
+	a.waitFor("")
+	b.waitFor("")
+	a.edit(yjsHello)
+	b.waitFor("hello")
+
+	// Stopping the hub flushes the edit, and shutting the tracer down
+	// exports every span
+	hub.Stop()
+	tracer.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	receive, ok := spans["ws.receive"]
+	if !ok {
+		t.Fatalf("Expected a ws.receive span, got %v", spans)
+	}
+	// Each step is a child of the one before, in the edit's trace
+	parent := receive
+	for _, name := range []string{"hub.broadcast", "db.flush_updates", "INSERT"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("Expected a %s span, got %v", name, spans)
+		}
+		if !bytes.Equal(span.TraceId, receive.TraceId) || !bytes.Equal(span.ParentSpanId, parent.SpanId) {
+			t.Errorf("Expected %s under %s in trace %x, got parent %x in trace %x",
+				name, parent.Name, receive.TraceId, span.ParentSpanId, span.TraceId)
+		}
+		parent = span
+	}
+}
@@ -0,0 +1,151 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	"github.com/manpreetbhatti/lattice/backend/internal/ratelimit"
+)
+
+// ConnectionLimitConfig caps how many sessions one IP may hold open and how
+// quickly it may open new ones; zero disables either check
+type ConnectionLimitConfig struct {
+	MaxPerIP      int // Concurrent WebSocket and SSE sessions
+	RatePerMinute int // Sustained rate of new sessions
+	Burst         int // New sessions allowed at once before the rate applies
+}
+
+func DefaultConnectionLimitConfig() ConnectionLimitConfig {
+	return ConnectionLimitConfig{
+		MaxPerIP:      20,
+		RatePerMinute: 60,
+		Burst:         20,
+	}
+}
+
+var (
+	errTooManyConnections = errors.New("too many concurrent connections from this address")
+	errConnectionRate     = errors.New("connecting too quickly from this address")
+)
+
+// ConnectionLimitStats counts sessions refused by the per-IP limits
+type ConnectionLimitStats struct {
+	ActiveIPs          int    `json:"active_ips"`
+	RejectedConcurrent uint64 `json:"rejected_concurrent"`
+	RejectedRate       uint64 `json:"rejected_rate"`
+}
+
+// Tracks open sessions and connection attempts per IP
+type ipLimiter struct {
+	config ConnectionLimitConfig
+	rates  *ratelimit.ClientLimiters // nil when the rate limit is off
+
+	active map[string]int
+	mu     sync.Mutex
+
+	rejectedConcurrent atomic.Uint64
+	rejectedRate       atomic.Uint64
+}
+
+func newIPLimiter(config ConnectionLimitConfig) *ipLimiter {
+	l := &ipLimiter{
+		config: config,
+		active: make(map[string]int),
+	}
+	if config.RatePerMinute > 0 {
+		burst := config.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		l.rates = ratelimit.NewClientLimiters(float64(config.RatePerMinute)/60, burst)
+	}
+	return l
+}
+
+// Reserves a session slot for ip; every attempt counts against the rate,
+// including ones then refused for concurrency
+func (l *ipLimiter) acquire(ip string) error {
+	if l.rates != nil && !l.rates.Get(ip).Allow() {
+		l.rejectedRate.Add(1)
+		return errConnectionRate
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.config.MaxPerIP > 0 && l.active[ip] >= l.config.MaxPerIP {
+		l.rejectedConcurrent.Add(1)
+		return errTooManyConnections
+	}
+	l.active[ip]++
+	return nil
+}
+
+func (l *ipLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] <= 1 {
+		delete(l.active, ip)
+		return
+	}
+	l.active[ip]--
+}
+
+func (l *ipLimiter) stats() ConnectionLimitStats {
+	l.mu.Lock()
+	activeIPs := len(l.active)
+	l.mu.Unlock()
+
+	return ConnectionLimitStats{
+		ActiveIPs:          activeIPs,
+		RejectedConcurrent: l.rejectedConcurrent.Load(),
+		RejectedRate:       l.rejectedRate.Load(),
+	}
+}
+
+func (l *ipLimiter) stop() {
+	if l.rates != nil {
+		l.rates.Stop()
+	}
+}
+
+// Host part of a remote address, or the address itself if it has no port
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Reserves a session for the request's address, answering 429 and
+// returning false when the address is over its limits. The caller must
+// call releaseConnection with the returned IP once the session ends.
+func (h *Hub) admitConnection(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ip := hostOf(r.RemoteAddr)
+	if err := h.ipLimits.acquire(ip); err != nil {
+		log.Printf("🚫 Refused connection from %s: %v", ip, err)
+		retryAfter := 1
+		if errors.Is(err, errConnectionRate) && h.config.ConnectionLimits.RatePerMinute > 0 {
+			retryAfter = max(1, 60/h.config.ConnectionLimits.RatePerMinute)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		apierror.Write(w, http.StatusTooManyRequests, apierror.RateLimited, err.Error(), nil)
+		return "", false
+	}
+	return ip, true
+}
+
+func (h *Hub) releaseConnection(ip string) {
+	h.ipLimits.release(ip)
+}
+
+// GetConnectionLimitStats reports per-IP connection limit rejections
+func (h *Hub) GetConnectionLimitStats() ConnectionLimitStats {
+	return h.ipLimits.stats()
+}
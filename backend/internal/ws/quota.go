@@ -0,0 +1,151 @@
+package ws
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// Fraction of the room quota at which clients are warned
+const quotaWarnRatio = 0.8
+
+// Error codes sent in MessageTypeError frames
+const (
+	ErrorCodeQuotaExceeded = "room_quota_exceeded"
+	ErrorCodeQuotaWarning  = "room_quota_warning"
+)
+
+// ErrRoomQuotaExceeded is returned when updates would take a room over its
+// storage quota
+var ErrRoomQuotaExceeded = errors.New("room storage quota exceeded")
+
+// ProtocolError is the JSON body of a MessageTypeError frame
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Limit   int64  `json:"limit,omitempty"`
+	Used    int64  `json:"used,omitempty"`
+}
+
+func errorMessage(e ProtocolError) []byte {
+	body, _ := json.Marshal(e)
+	message := []byte{byte(protocol.MessageTypeError)}
+	message = binary.AppendUvarint(message, uint64(len(body)))
+	return append(message, body...)
+}
+
+// MaxRoomBytes returns the per-room update quota, zero when unlimited
+func (h *Hub) MaxRoomBytes() int64 {
+	return h.config.MaxRoomBytes
+}
+
+// SetRoomQuota replaces the update quota of a loaded room, for rooms whose
+// workspace sets its own; zero restores the hub's quota. Rooms load their
+// workspace's quota themselves, so unloaded rooms are skipped.
+func (h *Hub) SetRoomQuota(roomID string, limit int64) {
+	h.mu.RLock()
+	roomState, ok := h.roomStates[roomID]
+	h.mu.RUnlock()
+
+	if ok {
+		roomState.quotaOverride.Store(limit)
+	}
+}
+
+// Returns the update quota for a room, zero when unlimited
+func (h *Hub) roomQuota(roomState *RoomState) int64 {
+	if limit := roomState.quotaOverride.Load(); limit > 0 {
+		return limit
+	}
+	return h.config.MaxRoomBytes
+}
+
+// RoomBytes returns the bytes of a loaded room's updates counted against its
+// quota, including those spilled from memory; zero if the room is not loaded
+func (h *Hub) RoomBytes(roomID string) int64 {
+	h.mu.RLock()
+	roomState, ok := h.roomStates[roomID]
+	h.mu.RUnlock()
+
+	if !ok {
+		return 0
+	}
+	return roomState.Bytes()
+}
+
+// LoadedRoomBytes returns how many rooms hold state in memory and the update
+// bytes they keep in memory between them
+func (h *Hub) LoadedRoomBytes() (int, int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var total int64
+	for _, roomState := range h.roomStates {
+		total += roomState.ResidentBytes()
+	}
+	return len(h.roomStates), total
+}
+
+// Checks an incoming update against the room quota. Rejected updates are
+// reported to the sender, and the sender is warned once when the room first
+// crosses quotaWarnRatio. Only called from the hub goroutine.
+func (h *Hub) admitUpdate(roomID string, roomState *RoomState, size int, sender *Client) bool {
+	limit := h.roomQuota(roomState)
+	if limit <= 0 {
+		return true
+	}
+
+	used := roomState.Bytes()
+	if used+int64(size) > limit {
+		h.quotaRejections.Add(1)
+		log.Printf("🚫 Rejected update for room %s: quota of %d bytes exceeded", roomID, limit)
+		h.sendTo(sender, errorMessage(ProtocolError{
+			Code:    ErrorCodeQuotaExceeded,
+			Message: "room storage quota exceeded; update rejected",
+			Limit:   limit,
+			Used:    used,
+		}))
+		return false
+	}
+
+	if float64(used+int64(size)) >= quotaWarnRatio*float64(limit) && roomState.markQuotaWarned() {
+		log.Printf("⚠️ Room %s is using %d of %d quota bytes", roomID, used+int64(size), limit)
+		h.sendTo(sender, errorMessage(ProtocolError{
+			Code:    ErrorCodeQuotaWarning,
+			Message: "room is nearing its storage quota",
+			Limit:   limit,
+			Used:    used + int64(size),
+		}))
+	}
+
+	return true
+}
+
+// Records that the quota warning was sent; returns false if it already was
+func (r *RoomState) markQuotaWarned() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.quotaWarned {
+		return false
+	}
+	r.quotaWarned = true
+	return true
+}
+
+// Queues a server message for one client if it is still in its room
+func (h *Hub) sendTo(client *Client, message []byte) {
+	if client == nil {
+		return
+	}
+
+	h.mu.RLock()
+	registered := h.rooms[client.roomID][client]
+	h.mu.RUnlock()
+
+	if registered {
+		client.enqueueCatchUp(message)
+	}
+}
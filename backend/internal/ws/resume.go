@@ -0,0 +1,86 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// Updates delivered to a client between refreshed resume tokens
+const resumeTokenInterval = 32
+
+// ResumeToken identifies how much of a room's update history a client has
+// received, so a reconnect only needs the updates after it
+type ResumeToken struct {
+	RoomID string
+	Epoch  uint64
+	Seq    int
+}
+
+func newEpoch() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// Encode returns the opaque form sent to clients
+func (t ResumeToken) Encode() string {
+	raw := fmt.Sprintf("%s\x00%x\x00%d", t.RoomID, t.Epoch, t.Seq)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseResumeToken(token string) (*ResumeToken, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resume token encoding")
+	}
+
+	parts := strings.Split(string(raw), "\x00")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid resume token")
+	}
+
+	epoch, err := strconv.ParseUint(parts[1], 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resume token epoch")
+	}
+
+	seq, err := strconv.Atoi(parts[2])
+	if err != nil || seq < 0 {
+		return nil, fmt.Errorf("invalid resume token sequence")
+	}
+
+	return &ResumeToken{RoomID: parts[0], Epoch: epoch, Seq: seq}, nil
+}
+
+// Builds a resume message: the message type followed by the token as a
+// lib0 var string
+func resumeTokenMessage(roomID string, roomState *RoomState) []byte {
+	epoch, seq := roomState.Position()
+	token := ResumeToken{RoomID: roomID, Epoch: epoch, Seq: seq}.Encode()
+
+	message := []byte{byte(protocol.MessageTypeResume)}
+	message = binary.AppendUvarint(message, uint64(len(token)))
+	return append(message, token...)
+}
+
+// Counts a delivered update and reports whether a fresh token is due.
+// Never due while stored history is still being streamed, since a token
+// would let a reconnect skip the rest of it. Only called from the hub
+// goroutine.
+func (c *Client) countForResume() bool {
+	if c.catchingUp.Load() {
+		return false
+	}
+	c.sinceResumeToken++
+	if c.sinceResumeToken >= resumeTokenInterval {
+		c.sinceResumeToken = 0
+		return true
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxRoomIDLength bounds every room ID, in characters
+const MaxRoomIDLength = 128
+
+// Room IDs end up in URLs and share links, so they are always limited to
+// these characters; a deployment's pattern can only narrow them further
+var roomIDChars = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ErrRoomIDRequired is returned for sessions that name no room
+var ErrRoomIDRequired = errors.New("room is required")
+
+// Close sent to sessions that name no room, or a new room whose ID the
+// rules refuse; the reason says which
+const closeCodeInvalidRoom = 4011
+
+// Longest reason that fits in a close frame
+const maxCloseReasonBytes = 123
+
+// RoomIDConfig decides which room IDs sessions and REST requests may use
+type RoomIDConfig struct {
+	MaxLength int            // At most MaxRoomIDLength
+	Pattern   *regexp.Regexp // IDs must also match this when set
+}
+
+func DefaultRoomIDConfig() RoomIDConfig {
+	return RoomIDConfig{MaxLength: MaxRoomIDLength}
+}
+
+func (c RoomIDConfig) Validate() error {
+	if c.MaxLength < 1 || c.MaxLength > MaxRoomIDLength {
+		return fmt.Errorf("room ID max length must be between 1 and %d, got %d", MaxRoomIDLength, c.MaxLength)
+	}
+	return nil
+}
+
+// RoomIDError says why a room ID was refused
+type RoomIDError struct {
+	Reason string // Reads after the field name, e.g. "must match ^team-"
+}
+
+func (e *RoomIDError) Error() string {
+	return "room ID " + e.Reason
+}
+
+// RoomIDRules returns the room ID rules the hub enforces
+func (h *Hub) RoomIDRules() RoomIDConfig {
+	return h.config.RoomIDs
+}
+
+// CheckRoomID returns why a room ID is refused: ErrRoomIDRequired for an
+// empty one, otherwise a *RoomIDError. It returns nil if the ID may be used.
+func (h *Hub) CheckRoomID(roomID string) error {
+	config := h.config.RoomIDs
+	switch {
+	case roomID == "":
+		return ErrRoomIDRequired
+	case utf8.RuneCountInString(roomID) > config.MaxLength:
+		return &RoomIDError{fmt.Sprintf("must be at most %d characters", config.MaxLength)}
+	case !roomIDChars.MatchString(roomID):
+		return &RoomIDError{"may only contain letters, digits, '.', '_' and '-'"}
+	case config.Pattern != nil && !config.Pattern.MatchString(roomID):
+		return &RoomIDError{fmt.Sprintf("must match %s", config.Pattern)}
+	}
+	return nil
+}
+
+// Returns why a session may not join roomID, or nil. The ID rules only apply
+// to rooms the session would create, so, as with the REST API, rooms made
+// before the rules were narrowed stay usable.
+func (h *Hub) checkSessionRoom(ctx context.Context, roomID string) error {
+	if roomID == "" {
+		return ErrRoomIDRequired
+	}
+	if h.roomExists(ctx, roomID) {
+		return nil
+	}
+	return h.CheckRoomID(roomID)
+}
+
+// Reports whether a room is loaded or stored. A failed lookup counts as
+// missing, so the ID rules still apply.
+func (h *Hub) roomExists(ctx context.Context, roomID string) bool {
+	h.mu.RLock()
+	_, loaded := h.roomStates[roomID]
+	h.mu.RUnlock()
+	if loaded || h.database == nil {
+		return loaded
+	}
+
+	room, err := h.database.GetRoom(ctx, roomID)
+	if err != nil {
+		log.Printf("Failed to look up room %s: %v", roomID, err)
+		return false
+	}
+	return room != nil
+}
+
+// Shortens err's message to fit a close frame
+func closeReason(err error) string {
+	reason := err.Error()
+	if len(reason) > maxCloseReasonBytes {
+		reason = strings.ToValidUTF8(reason[:maxCloseReasonBytes], "")
+	}
+	return reason
+}
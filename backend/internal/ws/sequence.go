@@ -0,0 +1,79 @@
+package ws
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// Largest number of updates returned for a single refill request
+const maxRefillUpdates = 1000
+
+// RefillRequest asks the hub to resend a range of a room's updates to one
+// sequenced client
+type RefillRequest struct {
+	Client *Client
+	From   int
+	To     int
+}
+
+// Wraps a frame in a sequence envelope: the message type, the sequence
+// number as a var uint, then the original frame
+func sequencedFrame(seq int, frame []byte) []byte {
+	message := make([]byte, 0, len(frame)+1+binary.MaxVarintLen64)
+	message = append(message, byte(protocol.MessageTypeSequenced))
+	message = binary.AppendUvarint(message, uint64(seq))
+	return append(message, frame...)
+}
+
+// Parses a refill message into its inclusive sequence range
+func parseRefill(data []byte) (from, to int, err error) {
+	if len(data) < 3 || protocol.MessageType(data[0]) != protocol.MessageTypeRefill {
+		return 0, 0, fmt.Errorf("not a refill message")
+	}
+
+	start, n := protocol.ReadVarUint(data[1:])
+	if n <= 0 {
+		return 0, 0, fmt.Errorf("invalid refill start")
+	}
+	end, m := protocol.ReadVarUint(data[1+n:])
+	if m <= 0 {
+		return 0, 0, fmt.Errorf("invalid refill end")
+	}
+
+	if start == 0 || end < start {
+		return 0, 0, fmt.Errorf("invalid refill range %d-%d", start, end)
+	}
+	if end-start >= maxRefillUpdates {
+		end = start + maxRefillUpdates - 1
+	}
+
+	return int(start), int(end), nil
+}
+
+// Resends the requested updates in their envelopes. Requests from clients
+// that have since left the room are ignored.
+func (h *Hub) handleRefill(req *RefillRequest) {
+	client := req.Client
+
+	h.mu.RLock()
+	registered := h.rooms[client.roomID][client]
+	roomState := h.roomStates[client.roomID]
+	h.mu.RUnlock()
+
+	if !registered || roomState == nil {
+		return
+	}
+
+	// Updates no longer held in memory are not refilled; a client missing
+	// those should reconnect for the full state
+	updates, from := roomState.UpdateRange(req.From, req.To)
+	for i, update := range updates {
+		client.enqueueCatchUp(sequencedFrame(from+i, update))
+	}
+
+	log.Printf("Refilled %d updates (%d-%d) for client %s in room %s",
+		len(updates), from, req.To, client.clientID, client.roomID)
+}
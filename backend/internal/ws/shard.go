@@ -0,0 +1,97 @@
+package ws
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RoomRouter tells a hub which instance of a sharded deployment serves a
+// room: RouteRoom returns that instance's base URL, and local true if it is
+// this one
+type RoomRouter interface {
+	RouteRoom(roomID string) (baseURL string, local bool)
+}
+
+// Close sent to WebSocket sessions for a room another instance serves,
+// after a redirect control frame naming it. Browsers don't follow
+// redirects on WebSocket handshakes, so the client reconnects there itself.
+const (
+	closeCodeRedirect   = 4307
+	closeReasonRedirect = "room served elsewhere"
+)
+
+// RedirectFrame tells a client which server to reconnect to for its room
+type RedirectFrame struct {
+	Type   string `json:"type"` // Always "redirect"
+	RoomID string `json:"room_id"`
+	URL    string `json:"url"` // WebSocket URL, without the query
+}
+
+// SetRoomRouter makes the hub send sessions for rooms it doesn't own to
+// their owner instead of serving them. Must be called before Run.
+func (h *Hub) SetRoomRouter(router RoomRouter) {
+	h.router = router
+}
+
+// RoomOwner returns the base URL of the instance serving a room, or "" if
+// it is this one or the deployment isn't sharded
+func (h *Hub) RoomOwner(roomID string) string {
+	if h.router == nil {
+		return ""
+	}
+	owner, local := h.router.RouteRoom(roomID)
+	if local {
+		return ""
+	}
+	return owner
+}
+
+// Sends a session for a room this instance doesn't own to its owner and
+// reports true, or reports false if the room is served here. WebSocket
+// handshakes are upgraded and sent a redirect frame, other requests a 307
+// to the same path and query on the owner.
+func (h *Hub) redirectSession(w http.ResponseWriter, r *http.Request, roomID string) bool {
+	owner := h.RoomOwner(roomID)
+	if owner == "" {
+		return false
+	}
+	target, err := url.Parse(owner)
+	if err != nil {
+		log.Printf("Error parsing URL %q of the owner of room %s: %v", owner, roomID, err)
+		return false
+	}
+	target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+
+	if !websocket.IsWebSocketUpgrade(r) {
+		target.RawQuery = r.URL.RawQuery
+		http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+		return true
+	}
+
+	switch target.Scheme {
+	case "https":
+		target.Scheme = "wss"
+	default:
+		target.Scheme = "ws"
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Upgrade error:", err)
+		return true
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	conn.WriteMessage(websocket.BinaryMessage, controlMessage(RedirectFrame{
+		Type:   ControlRedirect,
+		RoomID: roomID,
+		URL:    target.String(),
+	}))
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeCodeRedirect, closeReasonRedirect))
+	return true
+}
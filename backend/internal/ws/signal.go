@@ -0,0 +1,128 @@
+package ws
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// Signal types. join and leave go to the whole room; the rest go to the
+// member named in to.
+const (
+	SignalJoin   = "join"
+	SignalLeave  = "leave"
+	SignalOffer  = "offer"
+	SignalAnswer = "answer"
+	SignalICE    = "ice"
+)
+
+// Largest signal accepted; SDP offers with many candidates run to a few KiB
+const maxSignalBytes = 64 * 1024
+
+// Error code sent when a signal names a member who is not in the room
+const ErrorCodeSignalPeerNotFound = "signal_peer_not_found"
+
+// SignalFrame is the JSON body of a MessageTypeSignal message
+type SignalFrame struct {
+	Type    string          `json:"type"`
+	From    string          `json:"from,omitempty"`    // Sender's client ID, set by the server
+	To      string          `json:"to,omitempty"`      // Recipient's client ID, for offer, answer and ice
+	Payload json.RawMessage `json:"payload,omitempty"` // Session description or ICE candidate, relayed untouched
+}
+
+func signalMessage(frame SignalFrame) []byte {
+	body, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("Error encoding signal: %v", err)
+		return nil
+	}
+	message := []byte{byte(protocol.MessageTypeSignal)}
+	message = binary.AppendUvarint(message, uint64(len(body)))
+	return append(message, body...)
+}
+
+// Decodes a signal from a client, rejecting any it may not send
+func parseSignal(data []byte) (SignalFrame, bool) {
+	var frame SignalFrame
+	if len(data) > maxSignalBytes {
+		return frame, false
+	}
+	body, ok := readVarString(data[1:])
+	if !ok || json.Unmarshal([]byte(body), &frame) != nil {
+		return frame, false
+	}
+
+	switch frame.Type {
+	case SignalJoin, SignalLeave:
+		frame.To = ""
+		return frame, true
+	case SignalOffer, SignalAnswer, SignalICE:
+		return frame, frame.To != ""
+	default:
+		return frame, false
+	}
+}
+
+// Relays a signal from a room member. Members announce themselves with join
+// and those already in the huddle answer with offers; leave is also sent on
+// their behalf when they disconnect.
+func (h *Hub) relaySignal(sender *Client, data []byte) {
+	frame, ok := parseSignal(data)
+	if !ok {
+		log.Printf("⚠️ Invalid signal from client %s", sender.clientID)
+		return
+	}
+	h.countMessage(sender.roomID)
+
+	frame.From = sender.clientID
+	switch frame.Type {
+	case SignalJoin:
+		sender.inHuddle.Store(true)
+	case SignalLeave:
+		sender.inHuddle.Store(false)
+	}
+	message := signalMessage(frame)
+
+	h.mu.RLock()
+	clients := h.rooms[sender.roomID]
+	if !clients[sender] {
+		h.mu.RUnlock()
+		return
+	}
+	var recipients []*Client
+	for client := range clients {
+		if client == sender {
+			continue
+		}
+		if frame.To == "" || client.clientID == frame.To {
+			recipients = append(recipients, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	if frame.To != "" && len(recipients) == 0 {
+		sender.enqueueCatchUp(errorMessage(ProtocolError{
+			Code:    ErrorCodeSignalPeerNotFound,
+			Message: "no member " + frame.To + " in this room",
+		}))
+		return
+	}
+	for _, client := range recipients {
+		switch client.enqueue(message, nil) {
+		case enqueueOverflowed:
+			h.overflowedMessages.Add(1)
+		case enqueueRejected:
+			h.dropSlowClient(client)
+		}
+	}
+}
+
+// Tells the room a departed member has left its huddle
+func (h *Hub) releaseHuddle(client *Client) {
+	if !client.inHuddle.Swap(false) {
+		return
+	}
+	h.sendToRoom(client.roomID, signalMessage(SignalFrame{Type: SignalLeave, From: client.clientID}))
+}
@@ -0,0 +1,112 @@
+package ws
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+func encodeSignal(frame SignalFrame) []byte {
+	body, _ := json.Marshal(frame)
+	message := []byte{byte(protocol.MessageTypeSignal)}
+	message = binary.AppendUvarint(message, uint64(len(body)))
+	return append(message, body...)
+}
+
+func decodeSignal(t *testing.T, data []byte) SignalFrame {
+	t.Helper()
+	if len(data) == 0 || data[0] != byte(protocol.MessageTypeSignal) {
+		t.Fatalf("Expected a signal, got %v", data)
+	}
+	body, ok := readVarString(data[1:])
+	if !ok {
+		t.Fatalf("Malformed signal %v", data)
+	}
+	var frame SignalFrame
+	if err := json.Unmarshal([]byte(body), &frame); err != nil {
+		t.Fatalf("Failed to decode signal: %v", err)
+	}
+	return frame
+}
+
+func TestSignalRelay(t *testing.T) {
+	hub := NewHub(nil)
+	alice := newClient(hub, nil, "huddle", "alice")
+	bob := newClient(hub, nil, "huddle", "bob")
+	carol := newClient(hub, nil, "huddle", "carol")
+	outsider := newClient(hub, nil, "elsewhere", "dave")
+	for _, client := range []*Client{alice, bob, carol, outsider} {
+		hub.handleRegister(client)
+		queued(client)
+	}
+
+	// join goes to the whole room, with the sender filled in
+	alice.dispatch(encodeSignal(SignalFrame{Type: SignalJoin, From: "mallory"}))
+	for _, client := range []*Client{bob, carol} {
+		got := queued(client)
+		if len(got) != 1 {
+			t.Fatalf("Expected one signal for %s, got %v", client.clientID, got)
+		}
+		if frame := decodeSignal(t, got[0]); frame.Type != SignalJoin || frame.From != "alice" {
+			t.Errorf("Expected a join from alice, got %+v", frame)
+		}
+	}
+	if got := queued(alice); len(got) != 0 {
+		t.Errorf("Expected no echo to the sender, got %v", got)
+	}
+	if got := queued(outsider); len(got) != 0 {
+		t.Errorf("Expected nothing in another room, got %v", got)
+	}
+
+	// Offers go only to the member they name, payload untouched
+	payload := json.RawMessage(`{"type":"offer","sdp":"v=0\r\n"}`)
+	bob.dispatch(encodeSignal(SignalFrame{Type: SignalOffer, To: "alice", Payload: payload}))
+	got := queued(alice)
+	if len(got) != 1 {
+		t.Fatalf("Expected the offer for alice, got %v", got)
+	}
+	if frame := decodeSignal(t, got[0]); frame.From != "bob" || string(frame.Payload) != string(payload) {
+		t.Errorf("Unexpected offer %+v", frame)
+	}
+	if got := queued(carol); len(got) != 0 {
+		t.Errorf("Expected carol to see no offer, got %v", got)
+	}
+
+	// Members of other rooms can't be reached, and the sender is told
+	bob.dispatch(encodeSignal(SignalFrame{Type: SignalICE, To: "dave"}))
+	if got := queued(outsider); len(got) != 0 {
+		t.Errorf("Expected no signal across rooms, got %v", got)
+	}
+	got = queued(bob)
+	if len(got) != 1 || got[0][0] != byte(protocol.MessageTypeError) {
+		t.Errorf("Expected a peer-not-found error, got %v", got)
+	}
+
+	// Malformed and directed-without-recipient signals are dropped
+	bob.dispatch([]byte{byte(protocol.MessageTypeSignal), 3, '{', '}', '}'})
+	bob.dispatch(encodeSignal(SignalFrame{Type: SignalAnswer}))
+	bob.dispatch(encodeSignal(SignalFrame{Type: "media"}))
+	for _, client := range []*Client{alice, bob, carol} {
+		if got := queued(client); len(got) != 0 {
+			t.Errorf("Expected invalid signals dropped, %s got %v", client.clientID, got)
+		}
+	}
+
+	// A member who leaves without saying so is announced as leaving
+	hub.handleUnregister(alice)
+	got = queued(bob)
+	if len(got) != 1 {
+		t.Fatalf("Expected a leave for alice, got %v", got)
+	}
+	if frame := decodeSignal(t, got[0]); frame.Type != SignalLeave || frame.From != "alice" {
+		t.Errorf("Expected a leave from alice, got %+v", frame)
+	}
+
+	// Not for members who never joined the huddle
+	hub.handleUnregister(carol)
+	if got := queued(bob); len(got) != 0 {
+		t.Errorf("Expected no leave for carol, got %v", got)
+	}
+}
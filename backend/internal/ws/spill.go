@@ -0,0 +1,80 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/compaction"
+)
+
+// Stored-history streams that may run at once
+const maxHistoryStreams = 4
+
+// Returned from the history scan when the client or hub goes away
+var errHistoryStopped = errors.New("history stream stopped")
+
+// Streams a room's full history from the database to a client whose
+// catch-up reaches back past the updates still held in memory, then queues
+// token if there is one. The frames are sent without sequence envelopes:
+// the hello and resume token already tell sequenced clients where the live
+// stream continues.
+//
+// Runs on its own goroutine so the hub keeps serving while the history is
+// read. Updates broadcast after the client joined may reach it before the
+// history does; Yjs applies updates in any order and ignores ones it has
+// already seen. The snapshot and updates are read in one statement, so a
+// compaction can't swap one out from under the other, and frames are only
+// read as fast as the client takes them.
+func (h *Hub) sendStoredHistory(client *Client, token []byte) {
+	select {
+	case h.historyStreams <- struct{}{}:
+		defer func() { <-h.historyStreams }()
+	case <-h.stop:
+		return
+	}
+
+	// Updates dropped from memory may still be waiting in the write buffer.
+	// All of them were buffered before the client joined, so this writes
+	// everything it missed.
+	if h.writer != nil {
+		if err := h.writer.Flush(); err != nil {
+			log.Printf("Error flushing updates before catch-up in room %s: %v", client.roomID, err)
+		}
+	}
+
+	sent := 0
+	err := h.database.ForEachStoredUpdate(context.Background(), client.roomID, func(data []byte, snapshot bool) error {
+		frames := [][]byte{data}
+		if snapshot {
+			updates, err := compaction.DecodeSnapshot(data)
+			if err != nil {
+				log.Printf("Error reading snapshot for catch-up in room %s: %v", client.roomID, err)
+			}
+			frames = updates
+		}
+		for _, frame := range frames {
+			if !client.enqueueHistory(frame, h.stop) {
+				return errHistoryStopped
+			}
+			sent++
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errHistoryStopped):
+		return
+	case err != nil:
+		// catchingUp stays set, so the client gets no token to resume
+		// from and starts over when it reconnects
+		log.Printf("Error streaming updates for catch-up in room %s: %v", client.roomID, err)
+		return
+	}
+
+	log.Printf("Sent %d stored updates to new client in room %s from the database", sent, client.roomID)
+
+	if token != nil {
+		client.enqueueCatchUp(token)
+	}
+	client.catchingUp.Store(false)
+}
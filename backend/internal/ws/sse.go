@@ -0,0 +1,253 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+)
+
+// Maximum number of frames accepted by one SSE post
+const maxSSEPostMessages = 256
+
+// SSEPostRequest carries protocol frames (base64 in JSON) from an SSE session
+type SSEPostRequest struct {
+	Messages [][]byte `json:"messages"`
+}
+
+func newSessionID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func (h *Hub) addSession(id string, client *Client) {
+	h.sseMu.Lock()
+	defer h.sseMu.Unlock()
+	h.sseSessions[id] = client
+}
+
+func (h *Hub) removeSession(id string) {
+	h.sseMu.Lock()
+	defer h.sseMu.Unlock()
+	delete(h.sseSessions, id)
+}
+
+func (h *Hub) session(id string) *Client {
+	h.sseMu.Lock()
+	defer h.sseMu.Unlock()
+	return h.sseSessions[id]
+}
+
+// ServeSSE is the fallback for networks that block WebSockets. The client
+// joins the room like a WebSocket client and receives each frame as a base64
+// "message" event; the first event carries the session ID used to post frames
+// back through ServeSSEPost.
+func ServeSSE(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed", nil)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apierror.Write(w, http.StatusInternalServerError, apierror.Internal, "Streaming not supported", nil)
+		return
+	}
+
+	// EventSource hides HTTP errors from scripts, so a refused room ID is
+	// reported with a close event, as a WebSocket gets a close frame
+	roomID := r.URL.Query().Get("room")
+	if err := hub.checkSessionRoom(r.Context(), roomID); err != nil {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprintf(w, "event: close\ndata: %d %s\n\n", closeCodeInvalidRoom, closeReason(err))
+		flusher.Flush()
+		return
+	}
+
+	if hub.redirectSession(w, r, roomID) {
+		return
+	}
+
+	if !hub.checkRoomExists(r.Context(), roomID) {
+		apierror.Write(w, http.StatusNotFound, apierror.RoomNotFound, "Room not found", nil)
+		return
+	}
+	if !hub.checkJoinSecret(r.Context(), roomID, r.URL.Query().Get("secret")) {
+		apierror.Write(w, http.StatusForbidden, apierror.RoomAccessDenied, "Invalid or missing room secret", nil)
+		return
+	}
+	if !hub.checkWorkspace(r.Context(), roomID, r.URL.Query().Get("token")) {
+		apierror.Write(w, http.StatusForbidden, apierror.RoomAccessDenied, "Workspace membership required", nil)
+		return
+	}
+
+	session, supported := negotiate(r)
+	if !supported {
+		apierror.Write(w, http.StatusBadRequest, apierror.UnsupportedProtocol, unsupportedVersionReason(),
+			map[string][]int{"supported_versions": protocolVersions})
+		return
+	}
+
+	ip, ok := hub.admitConnection(w, r)
+	if !ok {
+		return
+	}
+	defer hub.releaseConnection(ip)
+
+	sessionID := newSessionID()
+	client := newClient(hub, nil, roomID, "sse-"+sessionID)
+	client.remoteAddr = r.RemoteAddr
+	client.handshake = session
+	client.applyConnectOptions(r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	hub.addSession(sessionID, client)
+	defer hub.removeSession(sessionID)
+
+	hub.verifyRoom(roomID)
+	select {
+	case hub.register <- client:
+	case <-hub.stop:
+		return
+	}
+
+	defer func() {
+		select {
+		case hub.unregister <- client:
+		case <-hub.stop:
+		}
+	}()
+
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", sessionID)
+	flusher.Flush()
+
+	client.ssePump(w, flusher, r)
+}
+
+// Streams queued frames as SSE events until the request ends or the hub
+// closes the send queue
+func (c *Client) ssePump(w http.ResponseWriter, flusher http.Flusher, r *http.Request) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case message, ok := <-c.send:
+			if !ok {
+				c.writeSSEClose(w, flusher)
+				return
+			}
+			c.writeSSE(w, message)
+			flusher.Flush()
+
+		case <-c.wake:
+			for drained := false; !drained; {
+				select {
+				case message, ok := <-c.send:
+					if !ok {
+						c.writeSSEClose(w, flusher)
+						return
+					}
+					c.writeSSE(w, message)
+				default:
+					drained = true
+				}
+			}
+
+			for _, message := range c.takeOverflow() {
+				c.writeSSE(w, message)
+			}
+			flusher.Flush()
+
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func (c *Client) writeSSE(w http.ResponseWriter, message []byte) {
+	fmt.Fprintf(w, "data: %s\n\n", base64.StdEncoding.EncodeToString(message))
+	c.messagesOut.Add(1)
+	c.bytesOut.Add(uint64(len(message)))
+}
+
+// Sends the reason the hub closed the session, mirroring the WebSocket close
+// frame
+func (c *Client) writeSSEClose(w http.ResponseWriter, flusher http.Flusher) {
+	c.mu.Lock()
+	code, reason := c.closeCode, c.closeReason
+	c.mu.Unlock()
+
+	if code != 0 {
+		fmt.Fprintf(w, "event: close\ndata: %d %s\n\n", code, reason)
+		flusher.Flush()
+	}
+}
+
+// ServeSSEPost accepts frames from an SSE session and relays them through
+// the hub with the same validation and rate limits as WebSocket messages
+func ServeSSEPost(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed", nil)
+		return
+	}
+
+	// Clients that name the room follow the stream to its owner
+	if roomID := r.URL.Query().Get("room"); roomID != "" && hub.redirectSession(w, r, roomID) {
+		return
+	}
+
+	client := hub.session(r.URL.Query().Get("session"))
+	if client == nil {
+		apierror.Write(w, http.StatusNotFound, apierror.SessionNotFound, "Session not found", nil)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSSEPostMessages*maxMessageSize)
+
+	var req SSEPostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apierror.Write(w, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body", nil)
+		return
+	}
+
+	if len(req.Messages) > maxSSEPostMessages {
+		apierror.Write(w, http.StatusBadRequest, apierror.InvalidBody, fmt.Sprintf("at most %d messages per request", maxSSEPostMessages), nil)
+		return
+	}
+
+	for i, message := range req.Messages {
+		if len(message) > maxMessageSize {
+			apierror.Write(w, http.StatusRequestEntityTooLarge, apierror.PayloadTooLarge, fmt.Sprintf("message %d exceeds %d bytes", i, maxMessageSize), nil)
+			return
+		}
+
+		if !client.rateLimiter.Allow() {
+			log.Printf("⚠️ Rate limit exceeded for SSE client %s in room %s", client.clientID, client.roomID)
+			w.Header().Set("Retry-After", "1")
+			apierror.Write(w, http.StatusTooManyRequests, apierror.RateLimited, fmt.Sprintf("rate limit exceeded after %d messages", i), map[string]int{"accepted": i})
+			return
+		}
+
+		client.touch(len(message))
+		client.dispatch(message)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
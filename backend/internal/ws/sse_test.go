@@ -0,0 +1,112 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reads SSE events from a stream, returning the event name and data
+func readSSEEvent(t *testing.T, reader *bufio.Reader) (string, string) {
+	t.Helper()
+
+	event := "message"
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := strings.TrimPrefix(line, "data: ")
+			reader.ReadString('\n')
+			return event, data
+		}
+	}
+}
+
+func TestSSETransport(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+	defer hub.Stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			ServeSSEPost(hub, w, r)
+			return
+		}
+		ServeSSE(hub, w, r)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	connect := func() (*bufio.Reader, string, func()) {
+		resp, err := http.Get(server.URL + "/events?room=sse-room")
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		reader := bufio.NewReader(resp.Body)
+
+		event, sessionID := readSSEEvent(t, reader)
+		if event != "session" || sessionID == "" {
+			t.Fatalf("Expected session event first, got %q %q", event, sessionID)
+		}
+		// Every joining client is sent a hello and a resume token
+		readSSEEvent(t, reader)
+		readSSEEvent(t, reader)
+
+		return reader, sessionID, func() { resp.Body.Close() }
+	}
+
+	_, senderSession, closeSender := connect()
+	defer closeSender()
+	receiver, _, closeReceiver := connect()
+	defer closeReceiver()
+
+	update := []byte{MessageSync, SyncUpdate, 1, 42}
+	body, _ := json.Marshal(SSEPostRequest{Messages: [][]byte{update}})
+	resp, err := http.Post(server.URL+"/events?session="+senderSession, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+	}
+
+	done := make(chan []byte, 1)
+	go func() {
+		_, data := readSSEEvent(t, receiver)
+		decoded, _ := base64.StdEncoding.DecodeString(data)
+		done <- decoded
+	}()
+
+	select {
+	case data := <-done:
+		if !bytes.Equal(data, update) {
+			t.Errorf("Expected %v, got %v", update, data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for relayed update")
+	}
+
+	resp, err = http.Post(server.URL+"/events?session=unknown", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown session, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,253 @@
+package ws
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/manpreetbhatti/lattice/backend/internal/apierror"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+// Terminal session roles, chosen with ?role= on /ws/terminal
+const (
+	TerminalHost   = "host"
+	TerminalViewer = "viewer"
+)
+
+// Recent output kept per terminal and replayed to viewers who join late.
+// Replay may start partway through an escape sequence.
+const terminalScrollbackBytes = 64 * 1024
+
+// Close sent to a host connecting to a terminal that already has one;
+// clients should not retry automatically
+const (
+	closeCodeTerminalHostTaken   = 4009
+	closeReasonTerminalHostTaken = "terminal already has a host"
+)
+
+// TerminalFrame tells a terminal session who it is and who else is there.
+// It is sent on joining and whenever the host or viewer count changes.
+type TerminalFrame struct {
+	Type     string `json:"type"` // Always "terminal"
+	RoomID   string `json:"room_id"`
+	ClientID string `json:"client_id"`
+	Role     string `json:"role"`
+	Host     bool   `json:"host"` // Whether a host is connected
+	Viewers  int    `json:"viewers"`
+}
+
+// A shared terminal in a room: one host whose output is relayed to any
+// number of read-only viewers
+type terminalSession struct {
+	host    *Client
+	viewers map[*Client]bool
+
+	// Latest output, trimmed to terminalScrollbackBytes when it grows to
+	// twice that, and the latest resize frame
+	scrollback []byte
+	size       []byte
+}
+
+// ServeTerminal upgrades /ws/terminal?room=X&role=host|viewer. The host's
+// terminal output and resize frames are relayed to the room's viewers;
+// anything viewers send is dropped. The role defaults to viewer, and join
+// secrets, bans and per-IP limits apply as on /ws.
+func ServeTerminal(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	role := r.URL.Query().Get("role")
+	switch role {
+	case "":
+		role = TerminalViewer
+	case TerminalHost, TerminalViewer:
+	default:
+		apierror.Write(w, http.StatusBadRequest, apierror.InvalidParameter, "role must be host or viewer", nil)
+		return
+	}
+
+	client := hub.acceptSession(w, r)
+	if client == nil {
+		return
+	}
+	client.terminalRole = role
+	if token := r.URL.Query().Get("token"); token != "" {
+		client.identify(token)
+	}
+
+	hub.verifyRoom(client.roomID)
+	hub.register <- client
+
+	go client.writePump()
+	go client.readPump()
+}
+
+func (h *Hub) joinTerminal(client *Client) {
+	h.terminalMu.Lock()
+	defer h.terminalMu.Unlock()
+
+	session, ok := h.terminals[client.roomID]
+	if !ok {
+		session = &terminalSession{viewers: make(map[*Client]bool)}
+		h.terminals[client.roomID] = session
+	}
+
+	if client.terminalRole == TerminalHost {
+		if session.host != nil {
+			log.Printf("Refused second terminal host %s in room %s", client.clientID, client.roomID)
+			client.closeSend(closeCodeTerminalHostTaken, closeReasonTerminalHostTaken)
+			return
+		}
+		// A new host is a new shell
+		session.host = client
+		session.scrollback = nil
+		session.size = nil
+		log.Printf("🖥️ Terminal host joined room %s", client.roomID)
+	} else {
+		session.viewers[client] = true
+		if session.size != nil {
+			client.enqueueCatchUp(session.size)
+		}
+		if len(session.scrollback) > 0 {
+			replay := session.scrollback[max(0, len(session.scrollback)-terminalScrollbackBytes):]
+			client.enqueueCatchUp(append([]byte{byte(protocol.MessageTypeTerminal)}, replay...))
+		}
+	}
+
+	h.announceTerminal(client.roomID, session)
+}
+
+// Removes a terminal session, closing its send queue with the given close
+// frame. Returns false if it had already left. Viewers stay when the host
+// leaves, so a host can reconnect.
+func (h *Hub) leaveTerminal(client *Client, code int, reason string) bool {
+	h.terminalMu.Lock()
+	defer h.terminalMu.Unlock()
+
+	session, ok := h.terminals[client.roomID]
+	if !ok {
+		return false
+	}
+	switch {
+	case session.host == client:
+		session.host = nil
+		log.Printf("Terminal host left room %s", client.roomID)
+	case session.viewers[client]:
+		delete(session.viewers, client)
+	default:
+		return false
+	}
+	client.closeSend(code, reason)
+
+	if session.host == nil && len(session.viewers) == 0 {
+		delete(h.terminals, client.roomID)
+		return true
+	}
+	h.announceTerminal(client.roomID, session)
+	return true
+}
+
+// Tells every member of a terminal who is there. Callers hold h.terminalMu.
+func (h *Hub) announceTerminal(roomID string, session *terminalSession) {
+	members := make([]*Client, 0, len(session.viewers)+1)
+	if session.host != nil {
+		members = append(members, session.host)
+	}
+	for viewer := range session.viewers {
+		members = append(members, viewer)
+	}
+
+	for _, member := range members {
+		member.enqueueCatchUp(controlMessage(TerminalFrame{
+			Type:     ControlTerminal,
+			RoomID:   roomID,
+			ClientID: member.clientID,
+			Role:     member.terminalRole,
+			Host:     session.host != nil,
+			Viewers:  len(session.viewers),
+		}))
+	}
+}
+
+// Handles a message from a terminal session. Only the host's output and
+// resize frames are relayed; viewers are told once that they are read-only.
+func (c *Client) dispatchTerminal(message []byte) {
+	if len(message) == 0 {
+		return
+	}
+
+	messageType := protocol.MessageType(message[0])
+	if messageType == protocol.MessageTypeAuth {
+		if token, ok := parseIdentityMessage(message); ok {
+			c.identify(token)
+		}
+		return
+	}
+
+	if c.terminalRole != TerminalHost {
+		if !c.warnedReadOnly {
+			c.warnedReadOnly = true
+			c.enqueueCatchUp(controlMessage(NoticeFrame{
+				Type:    ControlReadOnly,
+				Message: "viewers cannot write to the terminal; messages are being dropped",
+			}))
+		}
+		return
+	}
+
+	switch messageType {
+	case protocol.MessageTypeTerminal:
+	case protocol.MessageTypeTerminalResize:
+		if !validResize(message) {
+			log.Printf("⚠️ Invalid terminal resize from client %s", c.clientID)
+			return
+		}
+	default:
+		log.Printf("⚠️ Ignoring message type %d from terminal host %s", messageType, c.clientID)
+		return
+	}
+	c.hub.relayTerminal(c, message)
+}
+
+// Reports whether a resize frame holds exactly a column and a row count
+func validResize(message []byte) bool {
+	rest := message[1:]
+	for i := 0; i < 2; i++ {
+		_, n := protocol.ReadVarUint(rest)
+		if n <= 0 {
+			return false
+		}
+		rest = rest[n:]
+	}
+	return len(rest) == 0
+}
+
+// Sends a host's frame to the terminal's viewers, dropping any that have
+// fallen too far behind
+func (h *Hub) relayTerminal(host *Client, message []byte) {
+	h.countMessage(host.roomID)
+
+	h.terminalMu.Lock()
+	session, ok := h.terminals[host.roomID]
+	if !ok || session.host != host {
+		h.terminalMu.Unlock()
+		return
+	}
+	if protocol.MessageType(message[0]) == protocol.MessageTypeTerminal {
+		session.scrollback = append(session.scrollback, message[1:]...)
+		if len(session.scrollback) > 2*terminalScrollbackBytes {
+			session.scrollback = append([]byte(nil), session.scrollback[len(session.scrollback)-terminalScrollbackBytes:]...)
+		}
+	} else {
+		session.size = message
+	}
+	viewers := make([]*Client, 0, len(session.viewers))
+	for viewer := range session.viewers {
+		viewers = append(viewers, viewer)
+	}
+	h.terminalMu.Unlock()
+
+	for _, viewer := range viewers {
+		if viewer.enqueue(message, nil) == enqueueRejected && h.leaveTerminal(viewer, closeCodeSlowClient, closeReasonSlowClient) {
+			h.droppedClients.Add(1)
+			log.Printf("⚠️ Dropped slow terminal viewer %s in room %s (send buffer overflow)", viewer.clientID, viewer.roomID)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package ws
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	protocol "github.com/manpreetbhatti/lattice/backend/internal/sync"
+)
+
+func newTerminalClient(hub *Hub, roomID, clientID, role string) *Client {
+	client := newClient(hub, nil, roomID, clientID)
+	client.terminalRole = role
+	return client
+}
+
+// Returns the queued messages of a client without waiting
+func queued(client *Client) [][]byte {
+	var messages [][]byte
+	for {
+		select {
+		case message := <-client.send:
+			messages = append(messages, message)
+		default:
+			return append(messages, client.takeOverflow()...)
+		}
+	}
+}
+
+func TestTerminalRelay(t *testing.T) {
+	hub := NewHub(nil)
+
+	host := newTerminalClient(hub, "pair", "host", TerminalHost)
+	hub.handleRegister(host)
+	viewer := newTerminalClient(hub, "pair", "viewer", TerminalViewer)
+	hub.handleRegister(viewer)
+
+	var frame TerminalFrame
+	messages := queued(viewer)
+	decodeControl(t, messages[len(messages)-1], &frame)
+	if frame.Type != ControlTerminal || frame.Role != TerminalViewer || !frame.Host || frame.Viewers != 1 {
+		t.Errorf("Unexpected terminal frame %+v", frame)
+	}
+	queued(host)
+
+	resize := []byte{byte(protocol.MessageTypeTerminalResize), 80, 24}
+	output := append([]byte{byte(protocol.MessageTypeTerminal)}, "$ ls\r\n"...)
+	host.dispatch(resize)
+	host.dispatch(output)
+	host.dispatch([]byte{byte(protocol.MessageTypeTerminalResize), 80})
+	got := queued(viewer)
+	if len(got) != 2 || !bytes.Equal(got[0], resize) || !bytes.Equal(got[1], output) {
+		t.Errorf("Expected the resize and output relayed, got %v", got)
+	}
+
+	// Viewers are read-only and told so once
+	viewer.dispatch(append([]byte{byte(protocol.MessageTypeTerminal)}, "rm -rf /\r"...))
+	viewer.dispatch(append([]byte{byte(protocol.MessageTypeTerminal)}, "exit\r"...))
+	if got := queued(host); len(got) != 0 {
+		t.Errorf("Expected nothing relayed from a viewer, got %v", got)
+	}
+	got = queued(viewer)
+	var notice NoticeFrame
+	if len(got) != 1 {
+		t.Fatalf("Expected one read-only notice, got %v", got)
+	}
+	decodeControl(t, got[0], &notice)
+	if notice.Type != ControlReadOnly {
+		t.Errorf("Expected a read-only notice, got %+v", notice)
+	}
+
+	// A late viewer gets the size and recent output
+	late := newTerminalClient(hub, "pair", "late", TerminalViewer)
+	hub.handleRegister(late)
+	got = queued(late)
+	if len(got) != 3 || !bytes.Equal(got[0], resize) || !bytes.Equal(got[1], output) {
+		t.Errorf("Expected the size and scrollback replayed, got %v", got)
+	}
+
+	// Only one host at a time
+	second := newTerminalClient(hub, "pair", "second", TerminalHost)
+	hub.handleRegister(second)
+	if _, ok := <-second.send; ok || second.closeCode != closeCodeTerminalHostTaken {
+		t.Errorf("Expected the second host to be refused, got close code %d", second.closeCode)
+	}
+	hub.handleUnregister(second)
+
+	// Viewers stay when the host leaves; the terminal goes with its last member
+	hub.handleUnregister(host)
+	got = queued(viewer)
+	decodeControl(t, got[len(got)-1], &frame)
+	if frame.Host || frame.Viewers != 2 {
+		t.Errorf("Expected no host and 2 viewers, got %+v", frame)
+	}
+	hub.handleUnregister(viewer)
+	hub.handleUnregister(late)
+	if len(hub.terminals) != 0 || hub.GetRoomCount() != 0 {
+		t.Errorf("Expected no terminals or rooms left, got %d and %d", len(hub.terminals), hub.GetRoomCount())
+	}
+}
+
+func TestTerminalScrollbackLimit(t *testing.T) {
+	hub := NewHub(nil)
+	host := newTerminalClient(hub, "pair", "host", TerminalHost)
+	hub.handleRegister(host)
+
+	chunk := append([]byte{byte(protocol.MessageTypeTerminal)}, bytes.Repeat([]byte("x"), 1000)...)
+	for i := 0; i < 3*terminalScrollbackBytes/1000; i++ {
+		host.dispatch(chunk)
+	}
+	if n := len(hub.terminals["pair"].scrollback); n > 2*terminalScrollbackBytes {
+		t.Errorf("Scrollback grew to %d bytes", n)
+	}
+
+	viewer := newTerminalClient(hub, "pair", "viewer", TerminalViewer)
+	hub.handleRegister(viewer)
+	if got := queued(viewer); len(got) != 2 || len(got[0]) != 1+terminalScrollbackBytes {
+		t.Errorf("Expected %d bytes of scrollback replayed, got %v", terminalScrollbackBytes, len(got))
+	}
+}
+
+func TestServeTerminal(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+	defer hub.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeTerminal(hub, w, r)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?room=shell"
+
+	if resp, err := http.Get(server.URL + "?room=shell&role=admin"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown role, got %v %v", resp, err)
+	}
+
+	dial := func(role string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(url+"&role="+role, nil)
+		if err != nil {
+			t.Fatalf("Dial as %s failed: %v", role, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		return conn
+	}
+	host := dial(TerminalHost)
+	defer host.Close()
+	viewer := dial(TerminalViewer)
+	defer viewer.Close()
+
+	// The viewer's own terminal frame arrives before anything relayed
+	var frame TerminalFrame
+	for !frame.Host {
+		_, message, err := viewer.ReadMessage()
+		if err != nil {
+			t.Fatalf("Viewer read failed: %v", err)
+		}
+		decodeControl(t, message, &frame)
+	}
+
+	output := append([]byte{byte(protocol.MessageTypeTerminal)}, "hello\r\n"...)
+	host.WriteMessage(websocket.BinaryMessage, output)
+	_, message, err := viewer.ReadMessage()
+	if err != nil || !bytes.Equal(message, output) {
+		t.Fatalf("Expected the host's output, got %v %v", message, err)
+	}
+}
@@ -58,8 +58,6 @@ function App() {
     getText: stableGetText,
     setText: stableSetText,
     userName: userInfo.name,
-    autoSaveInterval: 60000,
-    autoSaveMinChanges: 50,
   });
 
   const handleAIComplete = useCallback(
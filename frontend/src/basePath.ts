@@ -0,0 +1,9 @@
+/**
+ * Path prefix the app is served under, such as "/lattice", or "" at the
+ * root. A server mounted under LATTICE_BASE_PATH names it in the page's
+ * <base> element; API and WebSocket URLs on the same host go beneath it.
+ */
+export const BASE_PATH = new URL(".", document.baseURI).pathname.replace(
+  /\/$/,
+  ""
+);
@@ -1,4 +1,8 @@
-import type { DiffResult, Version } from "../../hooks/useVersionHistory";
+import type {
+  DiffLine,
+  DiffResult,
+  Version,
+} from "../../hooks/useVersionHistory";
 import styles from "./DiffView.module.css";
 
 interface DiffViewProps {
@@ -19,16 +23,31 @@ function formatFullTime(dateString: string): string {
 }
 
 function getStats(diffResult: DiffResult) {
-  const added = diffResult.diff.filter((l) => l.type === "added").length;
-  const removed = diffResult.diff.filter((l) => l.type === "removed").length;
-  const unchanged = diffResult.diff.filter(
-    (l) => l.type === "unchanged"
-  ).length;
+  if (diffResult.summary) {
+    return {
+      added: diffResult.summary.lines_added,
+      removed: diffResult.summary.lines_removed,
+      unchanged: diffResult.summary.lines_unchanged,
+    };
+  }
+  const lines = diffResult.diff ?? [];
+  const added = lines.filter((l) => l.type === "added").length;
+  const removed = lines.filter((l) => l.type === "removed").length;
+  const unchanged = lines.filter((l) => l.type === "unchanged").length;
   return { added, removed, unchanged };
 }
 
+// Rows of the diff table: every line, or each hunk's header and lines
+function getRows(diffResult: DiffResult): (DiffLine | string)[] {
+  if (diffResult.hunks) {
+    return diffResult.hunks.flatMap((hunk) => [hunk.header, ...hunk.lines]);
+  }
+  return diffResult.diff ?? [];
+}
+
 export function DiffView({ diffResult, onClose, onRestore }: DiffViewProps) {
   const stats = getStats(diffResult);
+  const rows = getRows(diffResult);
   const isCurrent = diffResult.to.id === 0;
 
   const handleRestore = async (version: Version) => {
@@ -75,7 +94,7 @@ export function DiffView({ diffResult, onClose, onRestore }: DiffViewProps) {
             <div className={styles.versionDetails}>
               <span className={styles.versionName}>{diffResult.from.name}</span>
               <span className={styles.versionMeta}>
-                <code>{diffResult.from.content_hash}</code>
+                <code>{diffResult.from.content_hash_short ?? diffResult.from.content_hash}</code>
                 <span>{formatFullTime(diffResult.from.created_at)}</span>
               </span>
             </div>
@@ -112,7 +131,7 @@ export function DiffView({ diffResult, onClose, onRestore }: DiffViewProps) {
               </span>
               <span className={styles.versionMeta}>
                 {diffResult.to.content_hash && (
-                  <code>{diffResult.to.content_hash}</code>
+                  <code>{diffResult.to.content_hash_short ?? diffResult.to.content_hash}</code>
                 )}
                 <span>{formatFullTime(diffResult.to.created_at)}</span>
               </span>
@@ -122,7 +141,7 @@ export function DiffView({ diffResult, onClose, onRestore }: DiffViewProps) {
 
         <div className={styles.diffContainer}>
           <div className={styles.diffContent}>
-            {diffResult.diff.length === 0 ? (
+            {rows.length === 0 ? (
               <div className={styles.noDiff}>
                 <svg
                   width="32"
@@ -141,30 +160,38 @@ export function DiffView({ diffResult, onClose, onRestore }: DiffViewProps) {
             ) : (
               <table className={styles.diffTable}>
                 <tbody>
-                  {diffResult.diff.map((line, index) => (
-                    <tr key={index} className={styles[line.type]}>
-                      <td className={styles.lineNum}>
-                        {line.type === "removed" || line.type === "unchanged"
-                          ? line.old_line
-                          : ""}
-                      </td>
-                      <td className={styles.lineNum}>
-                        {line.type === "added" || line.type === "unchanged"
-                          ? line.new_line
-                          : ""}
-                      </td>
-                      <td className={styles.lineType}>
-                        {line.type === "added"
-                          ? "+"
-                          : line.type === "removed"
-                            ? "−"
-                            : " "}
-                      </td>
-                      <td className={styles.lineContent}>
-                        <pre>{line.content || " "}</pre>
-                      </td>
-                    </tr>
-                  ))}
+                  {rows.map((line, index) =>
+                    typeof line === "string" ? (
+                      <tr key={index} className={styles.hunkHeader}>
+                        <td colSpan={4}>
+                          <pre>{line}</pre>
+                        </td>
+                      </tr>
+                    ) : (
+                      <tr key={index} className={styles[line.type]}>
+                        <td className={styles.lineNum}>
+                          {line.type === "removed" || line.type === "unchanged"
+                            ? line.old_line
+                            : ""}
+                        </td>
+                        <td className={styles.lineNum}>
+                          {line.type === "added" || line.type === "unchanged"
+                            ? line.new_line
+                            : ""}
+                        </td>
+                        <td className={styles.lineType}>
+                          {line.type === "added"
+                            ? "+"
+                            : line.type === "removed"
+                              ? "−"
+                              : " "}
+                        </td>
+                        <td className={styles.lineContent}>
+                          <pre>{line.content || " "}</pre>
+                        </td>
+                      </tr>
+                    )
+                  )}
                 </tbody>
               </table>
             )}
@@ -332,7 +332,9 @@ function VersionItem({
           <p className={styles.versionDesc}>{version.description}</p>
         )}
         <div className={styles.versionMeta}>
-          <code className={styles.hash}>{version.content_hash}</code>
+          <code className={styles.hash} title={version.content_hash}>
+            {version.content_hash_short ?? version.content_hash}
+          </code>
           {version.created_by && (
             <span className={styles.author}>by {version.created_by}</span>
           )}
@@ -4,6 +4,32 @@ import * as decoding from "lib0/decoding";
 
 const MESSAGE_SYNC = 0;
 const MESSAGE_AWARENESS = 1;
+const MESSAGE_RESUME = 5;
+const MESSAGE_CONTROL = 9;
+const MESSAGE_BATCH = 10;
+
+// Close codes for sessions an administrator removed; reconnecting would
+// only be refused again
+const CLOSE_KICKED = 4001;
+const CLOSE_BANNED = 4003;
+// The room was deleted; reconnecting would start a new, empty room
+const CLOSE_ROOM_DELETED = 4004;
+// The server can't speak this client's protocol version
+const CLOSE_UNSUPPORTED_VERSION = 4010;
+// The session named no room, or a new room the server's ID rules refuse
+const CLOSE_INVALID_ROOM = 4011;
+// Another server serves the room; the redirect frame before it says which
+const CLOSE_REDIRECT = 4307;
+// Redirects followed in a row before falling back to the reconnect backoff,
+// in case servers disagree about who owns the room
+const MAX_REDIRECTS = 5;
+
+// Wire format this client speaks, offered as the WebSocket subprotocol
+const SUBPROTOCOL = "lattice-v1";
+const PROTOCOL_VERSION = 1;
+// Batch frames while behind, compressed frames and resume tokens; the
+// server's hello says which it granted
+const CAPABILITIES = ["batch", "compression", "resume"];
 
 const SYNC_STEP_1 = 0;
 const SYNC_STEP_2 = 1;
@@ -27,6 +53,34 @@ export interface AwarenessState {
   isTyping?: boolean;
 }
 
+/**
+ * JSON frame the server sends on the control channel: a hello when the
+ * session starts, then notices such as rate limiting, room locks and
+ * shutdown announcements. A session for a room another server serves gets
+ * a redirect naming it instead.
+ */
+export interface ControlFrame {
+  type: "hello" | "rate_limited" | "notice" | "lock" | "shutdown" | "redirect";
+  room_id?: string;
+  client_id?: string;
+  protocol?: string;
+  version?: number;
+  capabilities?: string[];
+  seq?: number;
+  clients?: number;
+  limits?: {
+    max_message_bytes: number;
+    messages_per_second: number;
+    message_burst: number;
+    max_room_bytes?: number;
+    idle_timeout_seconds?: number;
+  };
+  code?: string;
+  message?: string;
+  retry_after_ms?: number;
+  url?: string;
+}
+
 interface AwarenessChange {
   added: number[];
   updated: number[];
@@ -79,18 +133,26 @@ export class LatticeProvider extends EventEmitter {
 
   private ws: WebSocket | null = null;
   private wsUrl: string;
+  // Sent since the socket opened, kept until the hello shows the server
+  // will keep them rather than redirect; null once it has
+  private unconfirmed: Uint8Array[] | null = null;
+  private redirectUrl: string | null = null;
+  private redirects = 0;
   private status: ConnectionStatus = "disconnected";
   private reconnectTimeout: number | null = null;
   private reconnectAttempts = 0;
   private maxReconnectAttempts = 10;
   private synced = false;
+  private resumeToken: string | null = null;
+  private secret: string | null;
 
   private offlineQueue: Uint8Array[] = [];
   private maxOfflineQueueSize = 1000;
 
-  constructor(wsUrl: string, roomId: string, doc: Y.Doc) {
+  constructor(wsUrl: string, roomId: string, doc: Y.Doc, secret?: string) {
     super();
     this.wsUrl = wsUrl;
+    this.secret = secret ?? null;
     this.roomId = roomId;
     this.doc = doc;
     this.awareness = new Awareness(doc);
@@ -119,14 +181,24 @@ export class LatticeProvider extends EventEmitter {
 
     this.setStatus("connecting");
 
-    const url = `${this.wsUrl}?room=${encodeURIComponent(this.roomId)}`;
-    this.ws = new WebSocket(url);
+    let url =
+      `${this.wsUrl}?room=${encodeURIComponent(this.roomId)}` +
+      `&v=${PROTOCOL_VERSION}&caps=${CAPABILITIES.join(",")}`;
+    if (this.resumeToken) {
+      url += `&resume=${encodeURIComponent(this.resumeToken)}`;
+    }
+    // Password or join code for protected rooms
+    if (this.secret) {
+      url += `&secret=${encodeURIComponent(this.secret)}`;
+    }
+    this.ws = new WebSocket(url, SUBPROTOCOL);
     this.ws.binaryType = "arraybuffer";
 
     this.ws.onopen = () => {
       console.log("🌸 Lattice: Connected to room", this.roomId);
       this.setStatus("connected");
       this.reconnectAttempts = 0;
+      this.unconfirmed = [];
 
       // Flush offline queue first (before sync to preserve order)
       this.flushOfflineQueue();
@@ -144,11 +216,36 @@ export class LatticeProvider extends EventEmitter {
       }
     };
 
-    this.ws.onclose = () => {
+    this.ws.onclose = (event) => {
       console.log("🌸 Lattice: Disconnected from room", this.roomId);
       this.ws = null;
       this.synced = false;
       this.setStatus("disconnected");
+      if (
+        event.code === CLOSE_REDIRECT &&
+        this.redirectUrl &&
+        this.redirects < MAX_REDIRECTS
+      ) {
+        this.redirects++;
+        console.log(`🌸 Lattice: Room served by ${this.redirectUrl}`);
+        this.wsUrl = this.redirectUrl;
+        this.redirectUrl = null;
+        this.offlineQueue = [...(this.unconfirmed ?? []), ...this.offlineQueue];
+        this.unconfirmed = null;
+        this.connect();
+        return;
+      }
+      this.unconfirmed = null;
+      if (
+        event.code === CLOSE_KICKED ||
+        event.code === CLOSE_BANNED ||
+        event.code === CLOSE_ROOM_DELETED ||
+        event.code === CLOSE_UNSUPPORTED_VERSION ||
+        event.code === CLOSE_INVALID_ROOM
+      ) {
+        console.log(`🌸 Lattice: Removed from room: ${event.reason}`);
+        return;
+      }
       this.scheduleReconnect();
     };
 
@@ -213,11 +310,37 @@ export class LatticeProvider extends EventEmitter {
       case MESSAGE_AWARENESS:
         this.handleAwarenessMessage(decoder);
         break;
+      case MESSAGE_RESUME:
+        // Lets a reconnect skip updates this client already has
+        this.resumeToken = decoding.readVarString(decoder);
+        break;
+      case MESSAGE_CONTROL:
+        this.handleControlMessage(decoder);
+        break;
+      case MESSAGE_BATCH:
+        // Several frames queued while this client was behind, in order
+        while (decoding.hasContent(decoder)) {
+          this.handleMessage(decoding.readVarUint8Array(decoder));
+        }
+        break;
       default:
         console.warn("🌸 Lattice: Unknown message type", messageType);
     }
   };
 
+  private handleControlMessage(decoder: decoding.Decoder): void {
+    const frame = JSON.parse(decoding.readVarString(decoder)) as ControlFrame;
+    if (frame.type === "hello") {
+      this.unconfirmed = null;
+      this.redirects = 0;
+    } else if (frame.type === "redirect") {
+      this.redirectUrl = frame.url ?? null;
+    } else {
+      console.log(`🌸 Lattice: Server ${frame.type}: ${frame.message}`);
+    }
+    this.emit("control", [frame]);
+  }
+
   private handleSyncMessage(decoder: decoding.Decoder): void {
     const syncType = decoding.readVarUint(decoder);
 
@@ -311,6 +434,7 @@ export class LatticeProvider extends EventEmitter {
   private send(data: Uint8Array): void {
     if (this.ws?.readyState === WebSocket.OPEN) {
       this.ws.send(data);
+      this.unconfirmed?.push(data);
     } else {
       this.queueOfflineMessage(data);
     }
@@ -346,6 +470,7 @@ export class LatticeProvider extends EventEmitter {
     for (const message of queue) {
       if (this.ws?.readyState === WebSocket.OPEN) {
         this.ws.send(message);
+        this.unconfirmed?.push(message);
       } else {
         this.offlineQueue.push(message);
       }
@@ -1,4 +1,5 @@
 import { useState, useCallback, useRef } from "react";
+import { BASE_PATH } from "../basePath";
 
 export interface AICompletion {
   completion: string;
@@ -18,7 +19,7 @@ interface UseAIAssistOptions {
   maxTokens?: number;
 }
 
-const API_BASE = import.meta.env.VITE_API_URL || "";
+const API_BASE = import.meta.env.VITE_API_URL || BASE_PATH;
 
 export function useAIAssist(options: UseAIAssistOptions = {}) {
   const { provider, maxTokens = 150 } = options;
@@ -67,7 +68,7 @@ export function useAIAssist(options: UseAIAssistOptions = {}) {
 
         if (!response.ok) {
           const data = await response.json();
-          throw new Error(data.error || "Failed to get completion");
+          throw new Error(data.message || "Failed to get completion");
         }
 
         const data: AICompletion = await response.json();
@@ -108,7 +109,7 @@ export function useAIAssist(options: UseAIAssistOptions = {}) {
 
         if (!response.ok) {
           const data = await response.json();
-          throw new Error(data.error || "Failed to get explanation");
+          throw new Error(data.message || "Failed to get explanation");
         }
 
         const data: AIExplanation = await response.json();
@@ -152,7 +153,7 @@ export function useAIAssist(options: UseAIAssistOptions = {}) {
 
         if (!response.ok) {
           const data = await response.json();
-          throw new Error(data.error || "Failed to refactor");
+          throw new Error(data.message || "Failed to refactor");
         }
 
         const data: AIRefactor = await response.json();
@@ -1,6 +1,7 @@
 import { useEffect, useRef, useState, useCallback, useMemo } from "react";
 import * as Y from "yjs";
 import { LatticeProvider, ConnectionStatus } from "../crdt/YjsProvider";
+import { BASE_PATH } from "../basePath";
 
 interface User {
   id: string;
@@ -86,8 +87,11 @@ export function useLattice(options: UseLatticeOptions) {
     textRef.current = text;
 
     const protocol = window.location.protocol === "https:" ? "wss:" : "ws:";
-    const host = import.meta.env.VITE_WS_HOST || window.location.host;
-    const wsUrl = `${protocol}//${host}/ws`;
+    // A separate WebSocket host serves from its root
+    const wsHost = import.meta.env.VITE_WS_HOST;
+    const wsUrl = wsHost
+      ? `${protocol}//${wsHost}/ws`
+      : `${protocol}//${window.location.host}${BASE_PATH}/ws`;
 
     const provider = new LatticeProvider(wsUrl, roomId, doc);
     providerRef.current = provider;
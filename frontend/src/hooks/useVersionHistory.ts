@@ -1,4 +1,5 @@
 import { useState, useEffect, useCallback, useRef } from "react";
+import { BASE_PATH } from "../basePath";
 
 export interface Version {
   id: number;
@@ -7,9 +8,19 @@ export interface Version {
   description: string;
   content?: string;
   content_hash: string;
+  content_hash_short?: string;
   created_by: string;
   created_at: string;
   is_auto: boolean;
+  parent_version_id?: number;
+  restored_from_id?: number;
+  pinned?: boolean;
+}
+
+// The server's auto-save policy, shared by every client of a room
+interface AutoSavePolicy {
+  interval_ms: number;
+  min_changes: number;
 }
 
 export interface DiffLine {
@@ -19,10 +30,30 @@ export interface DiffLine {
   new_line?: number;
 }
 
+// A run of changes with the unchanged lines around them, as in git
+export interface DiffHunk {
+  header: string;
+  old_start: number;
+  old_lines: number;
+  new_start: number;
+  new_lines: number;
+  lines: DiffLine[];
+}
+
+export interface DiffSummary {
+  lines_added: number;
+  lines_removed: number;
+  lines_unchanged: number;
+  chars_changed: number;
+  similarity: number;
+}
+
 export interface DiffResult {
   from: Version;
   to: Version;
-  diff: DiffLine[];
+  diff?: DiffLine[];
+  hunks?: DiffHunk[]; // Instead of diff when fetched with context
+  summary?: DiffSummary;
 }
 
 interface UseVersionHistoryOptions {
@@ -30,11 +61,18 @@ interface UseVersionHistoryOptions {
   getText: () => string;
   setText: (text: string) => void;
   userName?: string;
+  // Used until the server's policy is known, or if it can't be fetched
   autoSaveInterval?: number;
   autoSaveMinChanges?: number; // minimum character changes for auto-save
 }
 
-const API_BASE = import.meta.env.VITE_API_URL || "";
+const API_BASE = import.meta.env.VITE_API_URL || BASE_PATH;
+
+// Unchanged lines shown around each change when comparing versions
+const DIFF_CONTEXT_LINES = 3;
+
+const versionsUrl = (roomId: string) =>
+  `${API_BASE}/api/rooms/${encodeURIComponent(roomId)}/versions`;
 
 export function useVersionHistory(options: UseVersionHistoryOptions) {
   const {
@@ -42,10 +80,14 @@ export function useVersionHistory(options: UseVersionHistoryOptions) {
     getText,
     setText,
     userName = "",
-    autoSaveInterval = 60000,
-    autoSaveMinChanges = 50,
+    autoSaveInterval: defaultInterval = 60000,
+    autoSaveMinChanges: defaultMinChanges = 50,
   } = options;
 
+  const [policy, setPolicy] = useState<AutoSavePolicy | null>(null);
+  const autoSaveInterval = policy?.interval_ms || defaultInterval;
+  const autoSaveMinChanges = policy?.min_changes ?? defaultMinChanges;
+
   const [versions, setVersions] = useState<Version[]>([]);
   const [loading, setLoading] = useState(false);
   const [error, setError] = useState<string | null>(null);
@@ -60,8 +102,14 @@ export function useVersionHistory(options: UseVersionHistoryOptions) {
     try {
       setLoading(true);
       const response = await fetch(
-        `${API_BASE}/api/versions?room_id=${encodeURIComponent(roomId)}&limit=50`
+        `${versionsUrl(roomId)}?limit=50`
       );
+      // The room is only stored once its first edit is persisted
+      if (response.status === 404) {
+        setVersions([]);
+        setError(null);
+        return;
+      }
       if (!response.ok) throw new Error("Failed to fetch versions");
       const data = await response.json();
       setVersions(data.versions || []);
@@ -80,11 +128,10 @@ export function useVersionHistory(options: UseVersionHistoryOptions) {
 
       try {
         setLoading(true);
-        const response = await fetch(`${API_BASE}/api/versions`, {
+        const response = await fetch(versionsUrl(roomId), {
           method: "POST",
           headers: { "Content-Type": "application/json" },
           body: JSON.stringify({
-            room_id: roomId,
             name: name || `Snapshot ${new Date().toLocaleString()}`,
             description: description || "",
             content,
@@ -126,11 +173,10 @@ export function useVersionHistory(options: UseVersionHistoryOptions) {
     }
 
     try {
-      const response = await fetch(`${API_BASE}/api/versions`, {
+      const response = await fetch(versionsUrl(roomId), {
         method: "POST",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify({
-          room_id: roomId,
           content,
           created_by: userName,
           is_auto: true,
@@ -175,7 +221,7 @@ export function useVersionHistory(options: UseVersionHistoryOptions) {
       try {
         setLoading(true);
         const response = await fetch(
-          `${API_BASE}/api/versions/diff?from=${fromId}&to=${toId}`
+          `${API_BASE}/api/versions/diff?from=${fromId}&to=${toId}&context=${DIFF_CONTEXT_LINES}`
         );
         if (!response.ok) throw new Error("Failed to fetch diff");
         const result = await response.json();
@@ -251,13 +297,26 @@ export function useVersionHistory(options: UseVersionHistoryOptions) {
     async (versionId: number) => {
       try {
         setLoading(true);
+        // Fails if someone saved since the list was loaded, so their work
+        // isn't silently replaced
+        const latestId = versions.length > 0 ? versions[0].id : 0;
         const response = await fetch(
           `${API_BASE}/api/versions/${versionId}/restore`,
           {
             method: "POST",
+            headers: { "If-Match": `"${latestId}"` },
           }
         );
 
+        if (response.status === 409) {
+          const conflict = await response.json();
+          await fetchVersions();
+          const latest: Version | undefined = conflict.details?.latest_version;
+          if (latest) await getDiff(latest.id, versionId);
+          throw new Error(
+            "A newer version was saved meanwhile; review it before restoring"
+          );
+        }
         if (!response.ok) throw new Error("Failed to restore version");
         const result = await response.json();
 
@@ -280,7 +339,7 @@ export function useVersionHistory(options: UseVersionHistoryOptions) {
         setLoading(false);
       }
     },
-    [setText, fetchVersions]
+    [versions, setText, fetchVersions, getDiff]
   );
 
   const deleteVersion = useCallback(
@@ -309,6 +368,22 @@ export function useVersionHistory(options: UseVersionHistoryOptions) {
     fetchVersions();
   }, [fetchVersions]);
 
+  useEffect(() => {
+    let cancelled = false;
+    setPolicy(null);
+    fetch(`${API_BASE}/api/rooms/${encodeURIComponent(roomId)}/policy`)
+      .then((response) => (response.ok ? response.json() : null))
+      .then((data) => {
+        if (!cancelled && data?.autosave) setPolicy(data.autosave);
+      })
+      .catch(() => {
+        // Keep the defaults
+      });
+    return () => {
+      cancelled = true;
+    };
+  }, [roomId]);
+
   useEffect(() => {
     const interval = setInterval(autoSaveVersion, autoSaveInterval);
     return () => clearInterval(interval);
@@ -3,6 +3,8 @@ import react from "@vitejs/plugin-react";
 
 export default defineConfig({
   plugins: [react()],
+  // Relative asset URLs, so a build works under any LATTICE_BASE_PATH
+  base: "./",
   server: {
     port: 3000,
     proxy: {